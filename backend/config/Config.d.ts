@@ -14,10 +14,202 @@ declare module "node-config-ts" {
     authorizations: Authorizations
     quantumTunnel: QuantumTunnel
     alerts: Alerts
+    scans: Scans
+    scheduler: Scheduler
+    seenStrings: SeenStrings
+    metrics: Metrics
+    iocs: Iocs
+    allowList: AllowList
+    secrets: Secrets
+    cors: Cors
+    http: Http
+    shutdown: Shutdown
+  }
+  interface Shutdown {
+    // stages of background services, stopped in this order
+    order: string[]
+    // per service, 0 waits indefinitely
+    timeoutMs: number
+  }
+  interface Http {
+    maxBodyBytes: number
+  }
+  interface Cors {
+    origins: string[]
+    methods: string[]
+    headers: string[]
+    credentials: boolean
+    maxAgeSeconds: number
+  }
+  interface SeenStrings {
+    baselineTTLDays: number
+    retentionDays: number
+    purgeBatchSize: number
+    // distinct keys per bulk record statement
+    recordBatchSize: number
+    minHits: number
+  }
+  interface Metrics {
+    client: 'none' | 'log'
+  }
+  interface Iocs {
+    bulkSetThreshold: number
+  }
+  interface AllowList {
+    expiredRetentionDays: number
+  }
+  interface Secrets {
+    refresh: SecretRefresh
+    vault: Vault
+  }
+  interface SecretRefresh {
+    cron: string
+    // flag empty or unrotated values instead of storing them
+    verify: boolean
+  }
+  interface Vault {
+    // refreshes secrets with the `vault` provider
+    enabled: boolean
+    address: string
+    token: string
+    // KV version 2 mount of secret references
+    path: string
+    renewToken: boolean
+  }
+  interface Scheduler {
+    overrunPolicy: 'queue' | 'queue-bounded' | 'skip'
+    maxQueueDepth: number
+    jitterSeconds: number
+    maxCatchUpMinutes: number
+    agingPerMinute: number
+    timeZone: string
+    // smallest site interval, lower `run_every_minutes` are clamped
+    minIntervalMinutes: number
+  }
+  interface Scans {
+    summary: ScansSummary
+    idle: ScansIdle
+    targetDrift: ScansTargetDrift
+    export: ScansExport
+    list: ScansList
+    retention: ScansRetention
+    archive: ScansArchive
+  }
+  interface ScansArchive {
+    // events older than this move to object storage, 0 disables
+    afterDays: number
+    // archived events (and their objects) are deleted past this
+    deleteAfterDays: number
+    // entries archived, all when empty
+    entries: string[]
+    batchSize: number
+    storage: ScansArchiveStorage
+  }
+  interface ScansArchiveStorage {
+    endpoint: string
+    region: string
+    bucket: string
+    accessKeyID: string
+    secretAccessKey: string
+    // prefix of object keys
+    prefix: string
+  }
+  interface ScansRetention {
+    // scans and their events
+    days: number
+    // days per event entry (e.g. rule-alert), scans are kept as long
+    // as they hold events of longer retained entries
+    entries: Record<string, number>
+  }
+  interface ScansList {
+    trimScreenshots: boolean
+  }
+  interface ScansExport {
+    batchSize: number
+    maxPerUser: number
+  }
+  interface ScansTargetDrift {
+    runs: number
+  }
+  interface ScansIdle {
+    flagMinutes: number
+    failMinutes: number
+    exemptSourceIDs: string[]
+  }
+  interface ScansSummary {
+    maxDomains: number
+    chunkSize: number
+    includeDomains: boolean
   }
   interface Alerts {
     goAlert: GoAlert
     kafka: Kafka
+    teams: Teams
+    delivery: AlertDelivery
+    hooks: AlertHooks
+    rateLimit: AlertRateLimit
+    dedupe: AlertDedupe
+    alertOnce: AlertOnce
+    // severity of alerts without their own, per rule
+    severity: Record<string, string>
+    // alerts are recorded, sinks get no deliveries
+    dryRun: boolean
+    context: AlertContext
+  }
+  interface AlertContext {
+    // longest string field of alert contexts, 0 keeps them whole
+    maxFieldLength: number
+  }
+  interface AlertOnce {
+    // default window per rule, sites override it for unknown.domain
+    ttlMinutes: Record<string, number>
+  }
+  interface AlertDedupe {
+    // window per rule ('*' for other rules), 0 disables dedupe
+    windowMinutes: Record<string, number>
+  }
+  interface AlertRateLimit {
+    enabled: boolean
+    perScan: number
+    perSiteHour: number
+    sampleSize: number
+    // alerts over the limits, `summary` collapses them into an
+    // alert.storm alert, `count` only counts them on the scan
+    overflow: 'summary' | 'count'
+  }
+  interface AlertHooks {
+    concurrency: number
+    entries: AlertHookEntry[]
+  }
+  interface AlertHookEntry {
+    type: string
+    name?: string
+    url?: string
+    timeoutMs?: number
+    severities?: string[]
+  }
+  interface AlertDelivery {
+    maxAttempts: number
+    // request timeout of HTTP sinks
+    timeoutMs: number
+    // alert jobs processed at once by each jobs process
+    concurrency: number
+    // delay of alert jobs held until their scan log job completes
+    dependencyHoldMs: number
+    backoff: DeliveryBackoff
+    // deprecated, replaces backoff.baseDelayMs when set
+    retryDelayMs?: number
+    headers: DeliveryHeaders
+  }
+  interface DeliveryBackoff {
+    baseDelayMs: number
+    multiplier: number
+    maxDelayMs: number
+    jitter: number
+  }
+  interface DeliveryHeaders {
+    allow: string[]
+    mask: string[]
   }
   interface Kafka {
     enabled: boolean
@@ -27,11 +219,57 @@ declare module "node-config-ts" {
     cert: string
     key: string
     clientID: string
+    fallback: string
+    // rules of the rule alerts sent, all when empty
+    ruleTypes: string[]
   }
   interface GoAlert {
     enabled: boolean
     url: string
     token: string
+    fallback: string
+    // rules of the rule alerts sent, all when empty
+    ruleTypes: string[]
+    // alerts below `minSeverity` are muted in the window
+    quietHours: AlertQuietHours
+    // overrides of alerts.delivery.backoff
+    backoff?: Partial<DeliveryBackoff>
+    // HMAC signing of alert requests, disabled without a secret
+    signing: AlertSigning
+    // JSON body template (see lib/template), alerts are sent as a
+    // query string when empty
+    bodyTemplate: string
+  }
+  interface Teams {
+    enabled: boolean
+    // incoming webhook URL
+    url: string
+    // overrides alerts.delivery.timeoutMs when set
+    timeoutMs: number
+    fallback: string
+    // rules of the rule alerts sent, all when empty
+    ruleTypes: string[]
+    // alerts below `minSeverity` are muted in the window
+    quietHours: AlertQuietHours
+    // overrides of alerts.delivery.backoff
+    backoff?: Partial<DeliveryBackoff>
+    // JSON body template (see lib/template), a MessageCard when empty
+    bodyTemplate: string
+  }
+  interface AlertQuietHours {
+    // local HH:mm, disabled when empty
+    start: string
+    end: string
+    // days the window starts on (0 = Sunday), all when empty
+    days: number[]
+    timeZone: string
+    minSeverity: string
+  }
+  interface AlertSigning {
+    secret: string
+    algorithm: string
+    header: string
+    timestampHeader: string
   }
   interface QuantumTunnel {
     enabled: string
@@ -73,6 +311,7 @@ declare module "node-config-ts" {
     database: string
     secure: boolean
     ca: string
+    checkMigrations: boolean
   }
   interface Redis {
     uri: string
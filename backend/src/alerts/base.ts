@@ -1,5 +1,9 @@
 /** Alert type Base */
 import MerryMaker from '@merrymaker/types'
+import { BackoffPolicy } from '../lib/backoff'
+import { AlertRules } from '../models/alerts'
+import { Severities } from '../models/sites'
+import { inWindow, isTimeZone, TimeWindow } from '../lib/time-zone'
 
 export interface AlertEvent {
   type: 'info' | 'error' | 'warning'
@@ -10,10 +14,193 @@ export interface AlertEvent {
   body?: object
 }
 
+// alert queue job, `alert_id` links rule alerts to their Alert record
+export type AlertQueueEvent = MerryMaker.EventResult & {
+  alert_id?: string
+  // severity of the Alert record
+  severity?: string
+  // scan log job persisting the triggering event, the alert is
+  // held until it completes
+  depends_on?: string
+}
+
+/**
+ * QuietHours
+ *
+ * Daily window (local time of `timeZone`) alerts below
+ * `minSeverity` are muted in
+ */
+export type QuietHours = TimeWindow & {
+  timeZone: string
+  minSeverity: string
+}
+
+// alert redelivery queue job, resends a recorded attempt to its sink
+export type AlertRedeliveryJob = {
+  delivery_id: string
+  // login that requested the redelivery
+  actor: string
+}
+
+// alert retry queue job, the next attempt of a failed delivery
+export type AlertRetryJob = {
+  // name of the sink the attempt failed on
+  sink: string
+  event: AlertEvent
+  alert_id?: string
+  redelivery_of?: string
+  // attempt made by the job (1-based)
+  attempt: number
+  max_attempts: number
+  // backoff overrides of the delivery
+  backoff?: Partial<BackoffPolicy>
+  // names of the sinks already visited (fallback loop guard)
+  visited: string[]
+}
+
+// raw response of an HTTP sink
+export type SinkResponse = {
+  status: number
+  body: string
+}
+
 export interface AlertSinkBase {
   name: string
   enabled: boolean
+  // key of the sink used when delivery fails after retries
+  fallback?: string
+  // rules of the rule alerts sent to the sink, all when empty
+  ruleTypes?: string[]
+  // alerts below the minimum severity are muted in the window
+  quietHours?: QuietHours
+  // delay between retries, overrides alerts.delivery.backoff
+  backoff?: Partial<BackoffPolicy>
+  // extra headers of a delivery attempt (e.g. signatures), sent with it
+  requestHeaders?: (evt: AlertEvent) => Record<string, string>
+  // request headers masked when the attempt is recorded
+  secretHeaders?: string[]
+  // rendered request body (body templates), recorded with the attempt
+  requestBody?: (evt: AlertEvent) => string | undefined
+  // sends `evt` once and resolves with the response whatever its
+  // status (test deliveries)
+  request?: (
+    evt: AlertEvent,
+    headers?: Record<string, string>
+  ) => Promise<SinkResponse>
+  // configured secrets (tokens, webhook URLs), masked in test results
+  secrets?: () => string[]
   send: (
-    evt: MerryMaker.EventResult | MerryMaker.RuleAlertEvent | AlertEvent
+    evt: MerryMaker.EventResult | MerryMaker.RuleAlertEvent | AlertEvent,
+    headers?: Record<string, string>
   ) => Promise<boolean>
 }
+
+/**
+ * ruleTypesFilter
+ *
+ * Validated `ruleTypes` of a sink, unknown rules fail on load
+ */
+export const ruleTypesFilter = (
+  ruleTypes: string[] | undefined,
+  sink: string
+): string[] => {
+  const unknown = (ruleTypes || []).filter((r) => !AlertRules.includes(r))
+  if (unknown.length) {
+    throw new Error(
+      `${sink} ruleTypes: unknown rules "${unknown.join('", "')}"`
+    )
+  }
+  return ruleTypes || []
+}
+
+const HHMM = /^([01]\d|2[0-3]):[0-5]\d$/
+
+/**
+ * quietHoursConfig
+ *
+ * Validated quiet hours of a sink, undefined without a window.
+ * Invalid settings fail on load
+ */
+export const quietHoursConfig = (
+  quietHours: Partial<QuietHours> | undefined,
+  sink: string
+): QuietHours | undefined => {
+  if (!quietHours || !quietHours.start || !quietHours.end) return undefined
+  if (!HHMM.test(quietHours.start) || !HHMM.test(quietHours.end)) {
+    throw new Error(`${sink} quietHours: start and end must be HH:mm`)
+  }
+  const timeZone = quietHours.timeZone || 'UTC'
+  if (!isTimeZone(timeZone)) {
+    throw new Error(`${sink} quietHours: unknown time zone "${timeZone}"`)
+  }
+  const minSeverity = quietHours.minSeverity || 'critical'
+  if (!Severities.includes(minSeverity)) {
+    throw new Error(`${sink} quietHours: unknown severity "${minSeverity}"`)
+  }
+  return {
+    start: quietHours.start,
+    end: quietHours.end,
+    days: quietHours.days || [],
+    timeZone,
+    minSeverity,
+  }
+}
+
+/**
+ * isMuted
+ *
+ * Whether alerts of `severity` to `sink` are muted at `now`.
+ * Events without a severity (e.g. scan failures) are never muted
+ */
+export const isMuted = (
+  sink: AlertSinkBase,
+  severity: string | undefined,
+  now: Date = new Date()
+): boolean => {
+  const quietHours = sink.quietHours
+  if (!quietHours || !severity) return false
+  const rank = Severities.indexOf(severity)
+  if (rank >= Severities.indexOf(quietHours.minSeverity)) return false
+  return inWindow(now, quietHours, quietHours.timeZone)
+}
+
+/**
+ * acceptsEvent
+ *
+ * Whether `sink` receives `evt`. The `ruleTypes` filter (the sink
+ * config unless given) applies to rule alerts only, other events
+ * (e.g. errors) are always sent
+ */
+export const acceptsEvent = (
+  sink: AlertSinkBase,
+  evt: MerryMaker.EventResult | MerryMaker.RuleAlertEvent,
+  ruleTypes: string[] | undefined = sink.ruleTypes
+): boolean => {
+  if (!ruleTypes || !ruleTypes.length) return true
+  if (evt.entry !== 'rule-alert') return true
+  return ruleTypes.includes((evt as MerryMaker.RuleAlertEvent).event.name)
+}
+
+/**
+ * alertTemplateData
+ *
+ * Fields available to sink body templates
+ */
+export const alertTemplateData = (
+  evt: AlertEvent,
+  uri: string
+): Record<string, unknown> => {
+  const body = (evt.body || {}) as Record<string, unknown>
+  return {
+    name: evt.name,
+    type: evt.type,
+    message: evt.message,
+    details: evt.details,
+    summary: `${evt.name} - ${evt.message}`,
+    scan_id: evt.scan_id,
+    scan_url: `${uri}/scans/${evt.scan_id}`,
+    // rule alerts only
+    rule: body.name,
+    context: body.context,
+  }
+}
@@ -6,7 +6,16 @@ import queryString from 'querystring'
 
 import { config } from 'node-config-ts'
 import logger from '../loaders/logger'
-import { AlertSinkBase, AlertEvent } from './base'
+import { signatureHeaders } from '../lib/signature'
+import { jsonTemplate, Template } from '../lib/template'
+import {
+  AlertSinkBase,
+  AlertEvent,
+  alertTemplateData,
+  quietHoursConfig,
+  ruleTypesFilter,
+  SinkResponse,
+} from './base'
 
 const MAX_GO_ALERT_LEN = 128
 
@@ -22,13 +31,128 @@ export const queryFromAlert = (evt: AlertEvent, token: string): string =>
     token,
   })
 
+// rendered when a template is loaded, quotes in its fields must
+// not break the body
+const SAMPLE_EVENT: AlertEvent = {
+  type: 'info',
+  name: 'rule-alert',
+  message: 'example.com "unknown"',
+  details: '{"domain": "example.com"}',
+  scan_id: '00000000-0000-0000-0000-000000000000',
+  body: { name: 'unknown.domain', context: { domain: 'example.com' } },
+}
+
+/**
+ * bodyTemplate
+ *
+ * compiled `bodyTemplate` of the sink, fields are JSON escaped and
+ * templates not rendering JSON are rejected (see `jsonTemplate`)
+ */
+export const bodyTemplate = (
+  goAlertConfig: typeof config.alerts.goAlert,
+  uri: string = config.server.uri
+): Template | undefined =>
+  jsonTemplate(
+    goAlertConfig?.bodyTemplate,
+    'goAlert',
+    alertTemplateData(SAMPLE_EVENT, uri)
+  )
+
+/**
+ * requestBody
+ *
+ * body rendered from the `bodyTemplate`, undefined without one
+ * (the alert is sent as a query string). Rendered templates must
+ * be JSON
+ */
+export const requestBody = (
+  template: Template | undefined,
+  uri: string = config.server.uri
+) => (evt: AlertEvent): string | undefined => {
+  if (!template) {
+    return undefined
+  }
+  const body = template(alertTemplateData(evt, uri))
+  try {
+    JSON.parse(body)
+  } catch (e) {
+    throw new Error(
+      `goAlert body template rendered invalid JSON (${e.message})`
+    )
+  }
+  return body
+}
+
+/**
+ * requestHeaders
+ *
+ * signature headers of the sent payload (templated body or alert
+ * query string), none when signing is not configured
+ */
+export const requestHeaders = (
+  goAlertConfig: typeof config.alerts.goAlert,
+  now: Date = new Date(),
+  template: Template | undefined = bodyTemplate(goAlertConfig)
+) => (evt: AlertEvent): Record<string, string> =>
+  signatureHeaders(
+    goAlertConfig.signing,
+    requestBody(template)(evt) ?? queryFromAlert(evt, goAlertConfig.token),
+    now
+  )
+
+/**
+ * request
+ *
+ * posts the goAlert request of `evt`, signed with `headers`, and
+ * resolves with the response. With a `bodyTemplate` the rendered
+ * body is posted as JSON, the token stays in the query string
+ */
+export const request = (
+  goAlertConfig: typeof config.alerts.goAlert,
+  template: Template | undefined
+) => async (
+  evt: AlertEvent,
+  headers: Record<string, string> = requestHeaders(
+    goAlertConfig,
+    new Date(),
+    template
+  )(evt)
+): Promise<SinkResponse> => {
+  const agent = new https.Agent({
+    rejectUnauthorized: true,
+    ca: [fs.readFileSync(config.server.ca)],
+  })
+
+  const body = requestBody(template)(evt)
+  const query =
+    body === undefined
+      ? queryFromAlert(evt, goAlertConfig.token)
+      : queryString.stringify({ token: goAlertConfig.token })
+  const res = await fetch(`${goAlertConfig.url}?${query}`, {
+    method: 'post',
+    agent,
+    body,
+    headers:
+      body === undefined
+        ? headers
+        : { 'Content-Type': 'application/json', ...headers },
+  })
+  return { status: res.status, body: await res.text() }
+}
+
 /**
  * goAlert
  *
- * sends goAlert message from AlertEvent
+ * sends goAlert message from AlertEvent, signed with `headers`
+ * (see `requestHeaders`) when set
  */
-export const init = (goAlertConfig: typeof config.alerts.goAlert) => async (
-  evt: AlertEvent
+export const init = (
+  goAlertConfig: typeof config.alerts.goAlert,
+  // invalid templates fail on load
+  template: Template | undefined = bodyTemplate(goAlertConfig)
+) => async (
+  evt: AlertEvent,
+  headers?: Record<string, string>
 ): Promise<boolean> => {
   logger.info({
     task: 'go-alert/send',
@@ -36,21 +160,14 @@ export const init = (goAlertConfig: typeof config.alerts.goAlert) => async (
   })
   if (!goAlertConfig.enabled) return
 
-  const agent = new https.Agent({
-    rejectUnauthorized: true,
-    ca: [fs.readFileSync(config.server.ca)],
-  })
-
-  const query = queryFromAlert(evt, goAlertConfig.token)
   try {
-    const res = await fetch(`${goAlertConfig.url}?${query}`, {
-      method: 'post',
-      agent,
-    })
-    const body = await res.text()
+    const { body: result } = await request(goAlertConfig, template)(
+      evt,
+      headers
+    )
     logger.info({
       task: 'go-alert/send',
-      result: body,
+      result,
     })
     return true
   } catch (e) {
@@ -62,8 +179,23 @@ export const init = (goAlertConfig: typeof config.alerts.goAlert) => async (
   }
 }
 
+const template = bodyTemplate(config.alerts.goAlert)
+
 export default {
   name: 'HTTP Alert Sink',
   enabled: config.alerts.goAlert?.enabled === true,
-  send: init(config.alerts.goAlert),
+  fallback: config.alerts.goAlert?.fallback,
+  ruleTypes: ruleTypesFilter(config.alerts.goAlert?.ruleTypes, 'goAlert'),
+  quietHours: quietHoursConfig(config.alerts.goAlert?.quietHours, 'goAlert'),
+  backoff: config.alerts.goAlert?.backoff,
+  requestHeaders: (evt: AlertEvent) =>
+    requestHeaders(config.alerts.goAlert, new Date(), template)(evt),
+  requestBody: requestBody(template),
+  secretHeaders: [config.alerts.goAlert?.signing?.header || 'X-MMK-Signature'],
+  request: request(config.alerts.goAlert, template),
+  secrets: () => [
+    config.alerts.goAlert?.token,
+    config.alerts.goAlert?.signing?.secret,
+  ],
+  send: init(config.alerts.goAlert, template),
 } as AlertSinkBase
@@ -0,0 +1,191 @@
+/** Post-alert hooks */
+import fetch from 'node-fetch'
+import { config } from 'node-config-ts'
+import logger from '../loaders/logger'
+import { metrics, Metrics } from '../lib/metrics'
+import { Alert } from '../models'
+
+export interface AlertHook {
+  name: string
+  // called once the alert is stored, failures are logged only
+  onAlertCreated: (alert: Alert) => Promise<void>
+}
+
+export type HookConfig = {
+  // webhook | noop
+  type: string
+  name?: string
+  // webhook
+  url?: string
+  timeoutMs?: number
+  // only alerts of these severities, all when empty
+  severities?: string[]
+}
+
+/**
+ * noopHook
+ *
+ * Accepts every alert and does nothing, useful to check the wiring
+ */
+export const noopHook = (name = 'noop'): AlertHook => ({
+  name,
+  onAlertCreated: async () => undefined,
+})
+
+/**
+ * webhookHook
+ *
+ * POSTs the alert as JSON to `url`, non-2xx responses are failures
+ */
+export const webhookHook = (opts: {
+  name?: string
+  url: string
+  timeoutMs?: number
+}): AlertHook => ({
+  name: opts.name || 'webhook',
+  onAlertCreated: async (alert: Alert) => {
+    const res = await fetch(opts.url, {
+      method: 'post',
+      body: JSON.stringify({ alert }),
+      headers: { 'Content-Type': 'application/json' },
+      timeout: opts.timeoutMs || 5000,
+    })
+    if (!res.ok) {
+      throw new Error(`webhook responded with ${res.status}`)
+    }
+  },
+})
+
+// skips alerts outside of `severities`
+const withSeverities = (hook: AlertHook, severities?: string[]): AlertHook =>
+  severities && severities.length > 0
+    ? {
+        name: hook.name,
+        onAlertCreated: async (alert: Alert) => {
+          if (severities.includes(alert.severity)) {
+            await hook.onAlertCreated(alert)
+          }
+        },
+      }
+    : hook
+
+/**
+ * AlertHooks
+ *
+ * Runs registered hooks in the background after an alert is
+ * created. At most `concurrency` hook calls run at once, the rest
+ * wait in order. A failing hook never affects the alert or the
+ * other hooks
+ */
+export class AlertHooks {
+  hooks: AlertHook[] = []
+  private running = 0
+  private pending: Array<() => Promise<void>> = []
+  private idleWaiters: Array<() => void> = []
+
+  constructor(
+    private concurrency: number = 4,
+    private stats: Metrics = metrics()
+  ) {}
+
+  use(hook: AlertHook): void {
+    logger.info({
+      task: 'alert hooks',
+      message: `loading hook "${hook.name}"`,
+    })
+    this.hooks.push(hook)
+  }
+
+  /**
+   * dispatch
+   *
+   * Schedules every hook for `alert` and returns immediately
+   */
+  dispatch(alert: Alert): void {
+    this.hooks.forEach((hook) => {
+      this.pending.push(() => this.run(hook, alert))
+    })
+    this.next()
+  }
+
+  /**
+   * idle
+   *
+   * Resolves once no hook is running or waiting
+   */
+  idle(): Promise<void> {
+    if (this.running === 0 && this.pending.length === 0) {
+      return Promise.resolve()
+    }
+    return new Promise((resolve) => this.idleWaiters.push(resolve))
+  }
+
+  private next() {
+    while (this.running < this.concurrency && this.pending.length > 0) {
+      const task = this.pending.shift()
+      this.running += 1
+      task().then(() => {
+        this.running -= 1
+        this.next()
+      })
+    }
+    if (this.running === 0 && this.pending.length === 0) {
+      this.idleWaiters.splice(0).forEach((resolve) => resolve())
+    }
+  }
+
+  private async run(hook: AlertHook, alert: Alert): Promise<void> {
+    const tags = { hook: hook.name }
+    const start = Date.now()
+    try {
+      await hook.onAlertCreated(alert)
+      this.stats.increment('alert_hook.succeeded', tags)
+    } catch (e) {
+      this.stats.increment('alert_hook.failed', tags)
+      logger.error({
+        task: 'alert hooks',
+        hook: hook.name,
+        alert_id: alert.id,
+        error: e.message,
+      })
+    } finally {
+      this.stats.timing('alert_hook.duration', Date.now() - start, tags)
+    }
+  }
+}
+
+/**
+ * loadHooks
+ *
+ * Builds the hooks declared in config, unknown types are skipped
+ */
+export const loadHooks = (
+  hookConfig: typeof config.alerts.hooks,
+  stats?: Metrics
+): AlertHooks => {
+  const registry = new AlertHooks(hookConfig?.concurrency || 4, stats)
+  ;(hookConfig?.entries || []).forEach((entry: HookConfig) => {
+    let hook: AlertHook
+    if (entry.type === 'webhook' && entry.url) {
+      hook = webhookHook({
+        name: entry.name,
+        url: entry.url,
+        timeoutMs: entry.timeoutMs,
+      })
+    } else if (entry.type === 'noop') {
+      hook = noopHook(entry.name)
+    } else {
+      logger.warn({
+        task: 'alert hooks',
+        message: `skipping invalid hook "${entry.name || entry.type}"`,
+      })
+      return
+    }
+    registry.use(withSeverities(hook, entry.severities))
+  })
+  return registry
+}
+
+export const alertHooks = loadHooks(config.alerts.hooks)
+
+export default alertHooks
@@ -5,7 +5,7 @@ import { config } from 'node-config-ts'
 
 import logger from '../loaders/logger'
 
-import { AlertSinkBase, AlertEvent } from './base'
+import { AlertSinkBase, AlertEvent, ruleTypesFilter } from './base'
 
 export interface AlertV1 {
   rule: string
@@ -86,5 +86,7 @@ export const init = (
 export default {
   name: 'Kafka Alert Sink',
   enabled: config.alerts?.kafka?.enabled === true,
+  fallback: config.alerts?.kafka?.fallback,
+  ruleTypes: ruleTypesFilter(config.alerts?.kafka?.ruleTypes, 'kafka'),
   send: init(config.alerts?.kafka),
 } as AlertSinkBase
@@ -0,0 +1,179 @@
+/* Microsoft Teams alert type */
+import fetch from 'node-fetch'
+
+import { config } from 'node-config-ts'
+import logger from '../loaders/logger'
+import { optionalTemplate, Template } from '../lib/template'
+import {
+  AlertSinkBase,
+  AlertEvent,
+  alertTemplateData,
+  quietHoursConfig,
+  ruleTypesFilter,
+  SinkResponse,
+} from './base'
+
+const MAX_TEAMS_TEXT_LEN = 1024
+
+const themeColors: Record<AlertEvent['type'], string> = {
+  error: 'D32F2F',
+  warning: 'F9A825',
+  info: '1976D2',
+}
+
+export interface MessageCardFact {
+  name: string
+  value: string
+}
+
+// legacy actionable message card, accepted by incoming webhooks
+export interface MessageCard {
+  '@type': 'MessageCard'
+  '@context': 'https://schema.org/extensions'
+  summary: string
+  themeColor: string
+  title: string
+  sections: Array<{
+    activityTitle: string
+    facts: MessageCardFact[]
+    text: string
+  }>
+  potentialAction: Array<{
+    '@type': 'OpenUri'
+    name: string
+    targets: Array<{ os: string; uri: string }>
+  }>
+}
+
+/**
+ * cardFromAlert
+ *
+ * formats AlertEvent into a Teams MessageCard
+ */
+export const cardFromAlert = (evt: AlertEvent, uri: string): MessageCard => {
+  const scanURL = `${uri}/scans/${evt.scan_id}`
+  return {
+    '@type': 'MessageCard',
+    '@context': 'https://schema.org/extensions',
+    summary: `${evt.name} - ${evt.message}`,
+    themeColor: themeColors[evt.type] || themeColors.info,
+    title: evt.name,
+    sections: [
+      {
+        activityTitle: evt.message,
+        facts: [
+          { name: 'Level', value: evt.type },
+          { name: 'Scan', value: evt.scan_id },
+        ],
+        text: `${evt.details}`.substring(0, MAX_TEAMS_TEXT_LEN),
+      },
+    ],
+    potentialAction: [
+      {
+        '@type': 'OpenUri',
+        name: 'View scan',
+        targets: [{ os: 'default', uri: scanURL }],
+      },
+    ],
+  }
+}
+
+/**
+ * requestBody
+ *
+ * webhook body, the MessageCard unless a `bodyTemplate` is set.
+ * Rendered templates must be JSON
+ */
+export const requestBody = (
+  template: Template | undefined,
+  uri: string = config.server.uri
+) => (evt: AlertEvent): string => {
+  if (!template) {
+    return JSON.stringify(cardFromAlert(evt, uri))
+  }
+  const body = template(alertTemplateData(evt, uri))
+  try {
+    JSON.parse(body)
+  } catch (e) {
+    throw new Error(`teams body template rendered invalid JSON (${e.message})`)
+  }
+  return body
+}
+
+/**
+ * request
+ *
+ * posts the webhook body of `evt` and resolves with the response
+ */
+export const request = (
+  teamsConfig: typeof config.alerts.teams,
+  template: Template | undefined
+) => async (evt: AlertEvent): Promise<SinkResponse> => {
+  const res = await fetch(teamsConfig.url, {
+    method: 'post',
+    body: requestBody(template)(evt),
+    headers: { 'Content-Type': 'application/json' },
+    timeout: teamsConfig.timeoutMs || config.alerts.delivery.timeoutMs,
+  })
+  return { status: res.status, body: await res.text() }
+}
+
+/**
+ * teams
+ *
+ * posts a MessageCard (or templated body) from AlertEvent to the
+ * incoming webhook, non-2xx responses are failures (retried by `deliver`)
+ */
+export const init = (
+  teamsConfig: typeof config.alerts.teams,
+  // invalid templates fail on load
+  template: Template | undefined = optionalTemplate(
+    teamsConfig.bodyTemplate,
+    'teams'
+  )
+) => async (evt: AlertEvent): Promise<boolean> => {
+  logger.info({
+    task: 'teams/send',
+    action: 'requested to send alert',
+  })
+  if (!teamsConfig.enabled) return
+
+  try {
+    const { status, body } = await request(teamsConfig, template)(evt)
+    if (status < 200 || status >= 300) {
+      throw new Error(`teams responded with ${status} (${body})`)
+    }
+    logger.info({
+      task: 'teams/send',
+      result: body,
+    })
+    return true
+  } catch (e) {
+    logger.error({
+      task: 'teams/send',
+      error: e.message,
+    })
+    throw e
+  }
+}
+
+const bodyTemplate = optionalTemplate(
+  config.alerts.teams?.bodyTemplate,
+  'teams'
+)
+
+export default {
+  name: 'Teams Alert Sink',
+  enabled: config.alerts.teams?.enabled === true,
+  fallback: config.alerts.teams?.fallback,
+  ruleTypes: ruleTypesFilter(config.alerts.teams?.ruleTypes, 'teams'),
+  quietHours: quietHoursConfig(config.alerts.teams?.quietHours, 'teams'),
+  backoff: config.alerts.teams?.backoff,
+  // recorded only when templated, the card is derived from the event
+  requestBody: (evt: AlertEvent) =>
+    bodyTemplate ? requestBody(bodyTemplate)(evt) : undefined,
+  request: request(config.alerts.teams, bodyTemplate),
+  // the webhook URL carries its credentials
+  secrets: () => [config.alerts.teams?.url],
+  send: init(config.alerts.teams, bodyTemplate),
+} as AlertSinkBase
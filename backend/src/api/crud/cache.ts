@@ -85,6 +85,39 @@ export const cachedView = (prefix: string, cache: LRUCache<number>) => async (
   return { has: false, store: 'none' }
 }
 
+/**
+ * cachedViewMany
+ *
+ * `cachedView` for several keys of `type`, local misses are
+ * read from redis with a single MGET
+ */
+export const cachedViewMany = (prefix: string, cache: LRUCache<number>) => async (
+  type: string,
+  keys: string[]
+): Promise<Record<string, CacheResponse>> => {
+  const res: Record<string, CacheResponse> = {}
+  const misses = keys.filter((key) => {
+    if (cache.get(`${prefix}:${type}:${key}`)) {
+      res[key] = { has: true, store: 'local' }
+      return false
+    }
+    return true
+  })
+  if (misses.length === 0) {
+    return res
+  }
+  const fromRedis = await redisClient.mget(
+    ...misses.map((key) => `${prefix}:${type}:${key}`)
+  )
+  misses.forEach((key, i) => {
+    res[key] =
+      fromRedis[i] === '1'
+        ? { has: true, store: 'redis' }
+        : { has: false, store: 'none' }
+  })
+  return res
+}
+
 export const writeRedis = async (key: string): Promise<'OK'> =>
   redisClient.set(key, 1, 'EX', 36000)
 
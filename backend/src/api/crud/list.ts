@@ -1,8 +1,12 @@
 import { Request, Response, NextFunction } from 'express'
 import { OpenAPIV3 } from 'openapi-types'
-import { OrderByDirection, Model } from 'objection'
+import { OrderByDirection, Model, Raw } from 'objection'
 import { BaseClass } from '../../models/base'
 import { ParamSchema, Integer, QueryParam, Parameter } from 'aejo'
+import { writeJSONList } from '../../lib/stream'
+import { Cursor, decodeCursor, encodeCursor } from '../../lib/cursor'
+import { BadRequestError } from '../middleware/client-errors'
+import logger from '../../loaders/logger'
 
 export interface ListRequest {
   page?: number
@@ -39,6 +43,82 @@ export const ListQueryParams: Parameter[] = [
   }),
 ]
 
+export const CursorQueryParams: Parameter[] = [
+  QueryParam({
+    name: 'cursor_after',
+    description: 'page after the `next_cursor` of a previous page',
+    schema: { type: 'string' },
+  }),
+  QueryParam({
+    name: 'cursor_before',
+    description: 'page before the `prev_cursor` of a previous page',
+    schema: { type: 'string' },
+  }),
+]
+
+export const cursorResponseSchema: Record<string, ParamSchema> = {
+  next_cursor: {
+    type: 'string',
+    nullable: true,
+    description: 'cursor of the next page (null on the last page)',
+  },
+  prev_cursor: {
+    type: 'string',
+    nullable: true,
+    description: 'cursor of the previous page (null on the first page)',
+  },
+}
+
+/**
+ * MultiValueQueryParam
+ *
+ * Filter accepting repeated and/or comma-separated values
+ * (`state[]=failed,expired` or `state[]=failed&state[]=expired`)
+ */
+export const MultiValueQueryParam = (opts: {
+  name: string
+  description: string
+  values: string[]
+}): Parameter =>
+  QueryParam({
+    name: opts.name,
+    description: `${opts.description} (comma-separated, one of ${opts.values.join(
+      ', '
+    )})`,
+    schema: {
+      type: 'array',
+      items: {
+        type: 'string',
+      },
+    },
+  })
+
+/**
+ * parseMultiValue
+ *
+ * Splits a multi-value query parameter, each value must be one of
+ * `allowed`. Returns undefined when the parameter is absent
+ */
+export const parseMultiValue = (
+  name: string,
+  raw: unknown,
+  allowed: string[]
+): string[] | undefined => {
+  if (raw === undefined || raw === '') return undefined
+  const values = (Array.isArray(raw) ? raw : [raw])
+    .reduce((acc: string[], v) => acc.concat(String(v).split(',')), [])
+    .map((v) => v.trim())
+    .filter((v) => v.length > 0)
+  const invalid = values.filter((v) => !allowed.includes(v))
+  if (invalid.length || values.length === 0) {
+    throw new BadRequestError(
+      `invalid ${name} value(s) "${invalid.join(',')}"`,
+      { name, invalid, allowed }
+    )
+  }
+  return Array.from(new Set(values))
+}
+
 export const listResponseSchema = (schema: {
   [p: string]: ParamSchema
 }): Record<string, ParamSchema> => ({
@@ -185,3 +265,187 @@ export function listHandler<M extends Model>(
     next()
   }
 }
+
+/**
+ * listStreamHandler
+ *
+ * Same parameters and response as `listHandler`, but the page is
+ * fetched in batches of `batchSize` and streamed to the client so
+ * large rows (event payloads) start rendering before the whole page
+ * has been read. `res.locals.columns` replaces selected fields with
+ * raw expressions (aliased to the field name)
+ */
+export function listStreamHandler<M extends Model>(
+  model: BaseClass<M>,
+  selectable?: string[],
+  batchSize = 50
+) {
+  return async (
+    req: Request,
+    res: Response,
+    next: NextFunction
+  ): Promise<void> => {
+    const { page, pageSize } = getPagable(req.query)
+    const { orderColumn, orderDirection } = getOrder(req.query, selectable)
+    let fields = selectable
+    if (res.locals.selectable && Array.isArray(res.locals.selectable)) {
+      fields = res.locals.selectable.filter((s: string) =>
+        selectable.includes(s)
+      )
+    }
+    const columns: Record<string, Raw> = res.locals.columns || {}
+    const listQuery = model
+      .query()
+      .select(fields.map((field) => columns[field] || field))
+
+    if (res.locals.whereBuilder) {
+      listQuery.modify(res.locals.whereBuilder)
+    }
+    const total = await listQuery.clone().resultSize()
+
+    if (orderColumn) {
+      listQuery.orderBy(orderColumn, orderDirection)
+    }
+    // stable order between batches
+    listQuery.orderBy('id')
+
+    const start = page && pageSize > 0 ? (page - 1) * pageSize : 0
+    const end = pageSize > 0 ? start + pageSize : total
+    let offset = start
+    res.status(200).type('application/json')
+    try {
+      await writeJSONList(res, {
+        total,
+        nextBatch: async () => {
+          if (offset >= end) return []
+          const rows = await listQuery
+            .clone()
+            .offset(offset)
+            .limit(Math.min(batchSize, end - offset))
+          offset += rows.length
+          return rows
+        },
+      })
+    } catch (e) {
+      if (!res.headersSent) throw e
+      // too late for an error response
+      logger.error({
+        module: 'api/crud/list',
+        method: 'listStreamHandler',
+        message: e.message,
+      })
+      res.destroy()
+      return
+    }
+    next()
+  }
+}
+
+type CursorRow = { id: string; created_at: Date }
+
+const parseCursor = (name: string, token: unknown): Cursor | undefined => {
+  if (token === undefined || token === '') return undefined
+  const cursor = typeof token === 'string' ? decodeCursor(token) : null
+  if (cursor === null) {
+    throw new BadRequestError(`invalid ${name}`, { name })
+  }
+  return cursor
+}
+
+/**
+ * cursorListHandler
+ *
+ * `listHandler` with keyset pagination on (`created_at`, `id`)
+ *
+ * With `cursor_after` / `cursor_before` the page is read with a keyset
+ * query in the direction encoded by the cursor and `total` is omitted.
+ * Without a cursor the page is read by offset (jump to page N), both
+ * modes return `next_cursor` / `prev_cursor` when ordered by `created_at`
+ */
+export function cursorListHandler<M extends Model>(
+  model: BaseClass<M>,
+  selectable?: string[]
+) {
+  const table = model.tableName
+  return async (
+    req: Request,
+    res: Response,
+    next: NextFunction
+  ): Promise<void> => {
+    const after = parseCursor('cursor_after', req.query.cursor_after)
+    const before = parseCursor('cursor_before', req.query.cursor_before)
+    if (after && before) {
+      throw new BadRequestError('use one of cursor_after or cursor_before')
+    }
+    const { page, pageSize } = getPagable(req.query)
+    const { orderColumn, orderDirection } = getOrder(req.query, selectable)
+    let fields = selectable
+    if (res.locals.selectable && Array.isArray(res.locals.selectable)) {
+      fields = res.locals.selectable.filter((s: string) =>
+        selectable.includes(s)
+      )
+    }
+    // cursors are built from every row
+    const listQuery = model
+      .query()
+      .select(Array.from(new Set([...fields, 'id', 'created_at'])))
+    if (res.locals.whereBuilder) {
+      listQuery.modify(res.locals.whereBuilder)
+    }
+    const limit = pageSize > 0 ? pageSize : 20
+
+    const cursor = after || before
+    if (cursor === undefined) {
+      if (page) {
+        listQuery.page(page - 1, pageSize <= 0 ? undefined : pageSize)
+      }
+      listQuery
+        .orderBy(orderColumn, orderDirection)
+        .orderBy(`${table}.id`, orderDirection)
+      const { results, total } = ((await listQuery) as unknown) as {
+        results: CursorRow[]
+        total: number
+      }
+      const keyed = orderColumn === 'created_at' && results.length > 0
+      const more = page > 0 && pageSize > 0 && page * pageSize < total
+      res.status(200).send({
+        results,
+        total,
+        next_cursor:
+          keyed && more
+            ? encodeCursor(results[results.length - 1], orderDirection)
+            : null,
+        prev_cursor:
+          keyed && page > 1 ? encodeCursor(results[0], orderDirection) : null,
+      })
+      return next()
+    }
+
+    // `before` pages are read backwards and reversed
+    const dir = cursor.dir
+    const readDir = before ? (dir === 'asc' ? 'desc' : 'asc') : dir
+    const op = readDir === 'asc' ? '>' : '<'
+    const rows = ((await listQuery
+      .whereRaw(`(${table}.created_at, ${table}.id) ${op} (?, ?)`, [
+        cursor.created_at,
+        cursor.id,
+      ])
+      .orderBy(`${table}.created_at`, readDir)
+      .orderBy(`${table}.id`, readDir)
+      .limit(limit + 1)) as unknown) as CursorRow[]
+    const more = rows.length > limit
+    const results = rows.slice(0, limit)
+    if (before) results.reverse()
+    // the cursor row itself is on the other side
+    const hasNext = after ? more : true
+    const hasPrev = before ? more : true
+    const first = results[0]
+    const last = results[results.length - 1]
+    res.status(200).send({
+      results,
+      next_cursor: last && hasNext ? encodeCursor(last, dir) : null,
+      prev_cursor: first && hasPrev ? encodeCursor(first, dir) : null,
+    })
+    next()
+  }
+}
@@ -5,14 +5,18 @@ import { Paths, Controller, PathItem, ajv } from 'aejo'
 import sites from './routes/sites'
 import auth from './routes/auth'
 import allowList from './routes/allow_list'
+import auditLogs from './routes/audit_logs'
 import ioc from './routes/iocs'
 import seenStrings from './routes/seen_strings'
+import seenScripts from './routes/seen_scripts'
 import sources from './routes/sources'
 import scans from './routes/scans'
 import secrets from './routes/secrets'
+import settings from './routes/settings'
 import scanLogs from './routes/scan_logs'
 import alerts from './routes/alerts'
 import queues from './routes/queues'
+import reports from './routes/reports'
 import users from './routes/users'
 import healthCheck from './routes/health/check'
 
@@ -35,6 +39,10 @@ export default (express: Express): { router: Router; pathItem: PathItem } => {
       prefix: '/api/allow_list',
       route: allowList,
     }),
+    Controller({
+      prefix: '/api/audit_logs',
+      route: auditLogs,
+    }),
     Controller({
       prefix: '/api/alerts',
       route: alerts,
@@ -67,14 +75,26 @@ export default (express: Express): { router: Router; pathItem: PathItem } => {
       prefix: '/api/secrets',
       route: secrets,
     }),
+    Controller({
+      prefix: '/api/settings',
+      route: settings,
+    }),
     Controller({
       prefix: '/api/seen_strings',
       route: seenStrings,
     }),
+    Controller({
+      prefix: '/api/seen_scripts',
+      route: seenScripts,
+    }),
     Controller({
       prefix: '/api/sources',
       route: sources,
     }),
+    Controller({
+      prefix: '/api/reports',
+      route: reports,
+    }),
     Controller({
       prefix: '/api/health',
       route: healthCheck
@@ -83,6 +103,10 @@ export default (express: Express): { router: Router; pathItem: PathItem } => {
 
   const swaggerDoc = oas(pathItem)
 
+  app.get('/openapi.json', (_req, res) => {
+    res.status(200).json(swaggerDoc)
+  })
+
   app.use('/api-docs', swaggerUI.serve)
   app.use('/api-docs', swaggerUI.setup(swaggerDoc))
 
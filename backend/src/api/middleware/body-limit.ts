@@ -0,0 +1,22 @@
+import express, { Request, Response, NextFunction } from 'express'
+import { config } from 'node-config-ts'
+import { PayloadTooLargeError } from './client-errors'
+
+/**
+ * jsonBodyLimit
+ *
+ * JSON body parser rejecting bodies larger than `maxBytes` with a 413.
+ * Declared lengths are rejected before reading, streamed bodies stop
+ * being read once the limit is exceeded
+ */
+export default (maxBytes: number = config.http.maxBodyBytes) => {
+  const parser = express.json({ limit: maxBytes })
+  return (req: Request, res: Response, next: NextFunction): void =>
+    parser(req, res, (err?: { type?: string }) => {
+      if (err && err.type === 'entity.too.large') {
+        next(new PayloadTooLargeError(maxBytes))
+        return
+      }
+      next(err)
+    })
+}
@@ -4,6 +4,10 @@ type ErrorContextTypes =
   | 'forbidden'
   | 'unauthorized'
   | 'invalid_creds'
+  | 'bad_request'
+  | 'payload_too_large'
+  | 'conflict'
+  | 'too_many_requests'
 
 interface ClientErrorContext {
   type: ErrorContextTypes
@@ -47,3 +51,39 @@ export class UnauthorizedError extends ClientError {
     })
   }
 }
+
+export class BadRequestError extends ClientError {
+  constructor(message: string, event: unknown = 'general') {
+    super(message, {
+      type: 'bad_request',
+      event,
+    })
+  }
+}
+
+export class PayloadTooLargeError extends ClientError {
+  constructor(maxBytes: number) {
+    super(`Request body exceeds the limit of ${maxBytes} bytes`, {
+      type: 'payload_too_large',
+      event: { maxBytes },
+    })
+  }
+}
+
+export class ConflictError extends ClientError {
+  constructor(message: string, event: unknown = 'general') {
+    super(message, {
+      type: 'conflict',
+      event,
+    })
+  }
+}
+
+export class TooManyRequestsError extends ClientError {
+  constructor(message: string, event: unknown = 'general') {
+    super(message, {
+      type: 'too_many_requests',
+      event,
+    })
+  }
+}
@@ -0,0 +1,59 @@
+import { Request, Response, NextFunction, RequestHandler } from 'express'
+import { config } from 'node-config-ts'
+
+export type CorsPolicy = {
+  // exact origins, `*` allows any origin. Empty disables CORS
+  origins: string[]
+  methods: string[]
+  headers: string[]
+  credentials: boolean
+  maxAgeSeconds: number
+}
+
+const isAllowed = (origin: string, policy: CorsPolicy): boolean =>
+  policy.origins.includes('*') || policy.origins.includes(origin)
+
+/**
+ * checkPolicy
+ *
+ * Rejects policies letting any origin make credentialed requests
+ */
+export const checkPolicy = (policy: CorsPolicy): void => {
+  if (policy.origins.includes('*') && policy.credentials) {
+    throw new Error('cors: "*" origins cannot be combined with credentials')
+  }
+}
+
+/**
+ * corsMiddleware
+ *
+ * Sets CORS headers for allowed origins and answers preflight
+ * requests. Disallowed origins get no CORS headers, so browsers
+ * block the cross-origin response. Every response varies by
+ * origin so caches never share one across origins
+ */
+export default (policy: CorsPolicy = config.cors): RequestHandler => {
+  checkPolicy(policy)
+  const anyOrigin = policy.origins.includes('*')
+  return (req: Request, res: Response, next: NextFunction): void => {
+    res.vary('Origin')
+    const origin = req.get('Origin')
+    if (!origin || !isAllowed(origin, policy)) {
+      next()
+      return
+    }
+    // `*` is sent literally, never with credentials (see `checkPolicy`)
+    res.set('Access-Control-Allow-Origin', anyOrigin ? '*' : origin)
+    if (policy.credentials) {
+      res.set('Access-Control-Allow-Credentials', 'true')
+    }
+    if (req.method === 'OPTIONS' && req.get('Access-Control-Request-Method')) {
+      res.set('Access-Control-Allow-Methods', policy.methods.join(', '))
+      res.set('Access-Control-Allow-Headers', policy.headers.join(', '))
+      res.set('Access-Control-Max-Age', `${policy.maxAgeSeconds}`)
+      res.status(204).end()
+      return
+    }
+    next()
+  }
+}
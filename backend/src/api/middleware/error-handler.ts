@@ -18,6 +18,30 @@ export default function (err: unknown, req: Request, res: Response): boolean {
         .status(401)
         .send({ message: err.message, type: 'Unauthorized', data: err.context })
       break
+    case 'bad_request':
+      res
+        .status(400)
+        .send({ message: err.message, type: 'BadRequest', data: err.context })
+      break
+    case 'payload_too_large':
+      res.status(413).send({
+        message: err.message,
+        type: 'PayloadTooLarge',
+        data: err.context,
+      })
+      break
+    case 'conflict':
+      res
+        .status(409)
+        .send({ message: err.message, type: 'Conflict', data: err.context })
+      break
+    case 'too_many_requests':
+      res.status(429).send({
+        message: err.message,
+        type: 'TooManyRequests',
+        data: err.context,
+      })
+      break
     default:
       res
         .status(422)
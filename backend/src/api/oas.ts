@@ -1,5 +1,23 @@
 /* eslint-disable @typescript-eslint/explicit-module-boundary-types */
 import { PathItem } from 'aejo'
+import { Schema as ScanSchema } from '../models/scans'
+import { Schema as ScanLogSchema } from '../models/scan_logs'
+import { Schema as AlertSchema } from '../models/alerts'
+import { listResponseSchema } from './crud/list'
+
+// shared schemas for tooling consuming the list endpoints
+const components = {
+  schemas: {
+    Scan: { type: 'object', properties: ScanSchema },
+    ScanLog: { type: 'object', properties: ScanLogSchema },
+    Alert: { type: 'object', properties: AlertSchema },
+    ListResponse: {
+      type: 'object',
+      description: 'Paginated list (`page` / `pageSize` query parameters)',
+      properties: listResponseSchema({}),
+    },
+  },
+}
 
 export default (paths: PathItem) => ({
   openapi: '3.0.0',
@@ -9,4 +27,5 @@ export default (paths: PathItem) => ({
     description: 'MerryMaker API Schema',
   },
   paths,
+  components,
 })
@@ -0,0 +1,36 @@
+import { AsyncGet } from 'aejo'
+import { Request, Response, NextFunction } from 'express'
+import { Alert } from '../../../models'
+import { AlertFilterParams, alertFilters } from './filters'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'Count Alerts matching the list filters',
+  parameters: AlertFilterParams,
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              total: {
+                type: 'integer',
+                description: 'Number of matching Alerts',
+              },
+            },
+            additionalProperties: false,
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const total = await Alert.query().modify(alertFilters(req)).resultSize()
+      res.status(200).send({ total })
+      next()
+    },
+  ],
+})
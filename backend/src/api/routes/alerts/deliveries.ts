@@ -0,0 +1,65 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import { MultiValueQueryParam, parseMultiValue } from '../../crud/list'
+import AlertService from '../../../services/alert'
+import AlertDeliveryService from '../../../services/alert_delivery'
+import {
+  DeliveryStatuses,
+  Schema,
+} from '../../../models/alert_deliveries'
+import { uuidParams } from './schemas'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'List delivery attempts of an Alert (oldest first)',
+  parameters: [
+    uuidParams,
+    MultiValueQueryParam({
+      name: 'status',
+      description: 'Filter by attempt status',
+      values: DeliveryStatuses,
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              results: {
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: Schema,
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      await AlertService.view(req.params.id)
+      const status = parseMultiValue(
+        'status',
+        req.query.status,
+        DeliveryStatuses
+      )
+      const results = await AlertDeliveryService.listViewsByAlert(
+        req.params.id,
+        status
+      )
+      res.status(200).send({ results })
+      next()
+    },
+  ],
+})
@@ -0,0 +1,90 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet, QueryParam, Integer } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import AlertService from '../../../services/alert'
+import AlertDeliveryService from '../../../services/alert_delivery'
+import {
+  DeliveryStatuses,
+  Schema,
+} from '../../../models/alert_deliveries'
+import { uuidParams } from './schemas'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'Delivery attempts of an Alert grouped per sink',
+  parameters: [
+    uuidParams,
+    QueryParam({
+      name: 'limit',
+      description: 'Latest attempts returned per sink (all by default)',
+      schema: Integer({ minimum: 1 }),
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              results: {
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: {
+                    sink: Schema.sink,
+                    status: {
+                      description: 'Status of the latest attempt',
+                      type: 'string',
+                      enum: DeliveryStatuses,
+                    },
+                    attempts: {
+                      description: 'Number of recorded attempts',
+                      type: 'integer',
+                    },
+                    first_attempt_at: Schema.created_at,
+                    last_attempt_at: Schema.created_at,
+                    next_attempt_at: Schema.next_attempt_at,
+                    next_retry_in_ms: {
+                      description:
+                        'Time left (ms) before the retry of a failed latest attempt',
+                      type: 'integer',
+                      nullable: true,
+                    },
+                    history: {
+                      type: 'array',
+                      items: {
+                        type: 'object',
+                        properties: Schema,
+                      },
+                    },
+                  },
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      await AlertService.view(req.params.id)
+      const limit =
+        typeof req.query.limit === 'string'
+          ? parseInt(req.query.limit, 10)
+          : undefined
+      const results = await AlertDeliveryService.historyByAlert(
+        req.params.id,
+        limit
+      )
+      res.status(200).send({ results })
+      next()
+    },
+  ],
+})
@@ -0,0 +1,51 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import AlertService from '../../../services/alert'
+import { Schema } from '../../../models/scan_logs'
+import { uuidParams } from './schemas'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'Scan log event that triggered an Alert',
+  parameters: [uuidParams],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              event_id: {
+                description: 'ID of the triggering event',
+                type: 'string',
+                format: 'uuid',
+                nullable: true,
+              },
+              available: {
+                description: 'False when the event was purged',
+                type: 'boolean',
+              },
+              scan_log: {
+                type: 'object',
+                properties: Schema,
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const result = await AlertService.triggeringEvent(req.params.id)
+      res.status(200).send(result)
+      next()
+    },
+  ],
+})
@@ -0,0 +1,53 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet, QueryParam } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import AlertService from '../../../services/alert'
+import { AlertExportFormat } from '../../../lib/alert-export'
+import { uuidParams } from './schemas'
+
+const contentTypes: Record<AlertExportFormat, string> = {
+  html: 'text/html; charset=utf-8',
+  md: 'text/markdown; charset=utf-8',
+}
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'Export Alert as self-contained HTML (or Markdown)',
+  parameters: [
+    uuidParams,
+    QueryParam({
+      name: 'format',
+      description: 'Export format',
+      schema: {
+        type: 'string',
+        enum: ['html', 'md'],
+        default: 'html',
+      },
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'text/html': {
+          schema: { type: 'string' },
+        },
+        'text/markdown': {
+          schema: { type: 'string' },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const format = (req.query.format as AlertExportFormat) || 'html'
+      const body = await AlertService.exportAlert(req.params.id, format)
+      res.status(200).type(contentTypes[format]).send(body)
+      next()
+    },
+  ],
+})
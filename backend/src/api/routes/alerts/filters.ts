@@ -0,0 +1,127 @@
+import { Request } from 'express'
+import { Parameter, QueryParam } from 'aejo'
+import { QueryBuilder } from 'objection'
+import { Alert } from '../../../models'
+import { AlertStatuses, Schema } from '../../../models/alerts'
+import { Severities } from '../../../models/sites'
+import { MultiValueQueryParam, parseMultiValue } from '../../crud/list'
+import { BadRequestError } from '../../middleware/client-errors'
+
+// filters shared by the list and count of alerts, they compose
+// with list cursors
+export const AlertFilterParams: Parameter[] = [
+  QueryParam({
+    name: 'scan_id',
+    description: 'Filter by scan_id',
+    schema: {
+      type: 'string',
+      format: 'uuid',
+    },
+  }),
+  QueryParam({
+    name: 'site_id',
+    description: 'Filter by site_id',
+    schema: {
+      type: 'string',
+      format: 'uuid',
+    },
+  }),
+  MultiValueQueryParam({
+    name: 'rule',
+    description: 'filter results based on rule type',
+    values: Schema.rule.enum as string[],
+  }),
+  MultiValueQueryParam({
+    name: 'severity',
+    description: 'filter results based on severity',
+    values: Severities,
+  }),
+  MultiValueQueryParam({
+    name: 'status',
+    description: 'filter results based on triage status',
+    values: AlertStatuses,
+  }),
+  QueryParam({
+    name: 'created_after',
+    description: 'Alerts created at or after this date',
+    schema: {
+      type: 'string',
+      format: 'date-time',
+    },
+  }),
+  QueryParam({
+    name: 'created_before',
+    description: 'Alerts created before this date',
+    schema: {
+      type: 'string',
+      format: 'date-time',
+    },
+  }),
+  QueryParam({
+    name: 'search',
+    description: 'full-text search on the Alert event',
+    schema: {
+      type: 'string',
+    },
+  }),
+]
+
+const parseDate = (name: string, raw: unknown): Date | undefined => {
+  if (raw === undefined || raw === '') return undefined
+  const date = new Date(String(raw))
+  if (isNaN(date.getTime())) {
+    throw new BadRequestError(`invalid ${name} "${raw}"`, { name })
+  }
+  return date
+}
+
+/**
+ * alertFilters
+ *
+ * Validates the filters of `req` and returns a builder applying them
+ */
+export const alertFilters = (
+  req: Request
+): ((builder: QueryBuilder<Alert>) => void) => {
+  const rule = parseMultiValue(
+    'rule',
+    req.query.rule,
+    Schema.rule.enum as string[]
+  )
+  const severity = parseMultiValue('severity', req.query.severity, Severities)
+  const status = parseMultiValue('status', req.query.status, AlertStatuses)
+  const after = parseDate('created_after', req.query.created_after)
+  const before = parseDate('created_before', req.query.created_before)
+  const { scan_id, site_id, search } = req.query as Record<
+    string,
+    string | string[] | undefined
+  >
+  return (builder: QueryBuilder<Alert>) => {
+    if (scan_id) {
+      builder.where('scan_id', scan_id)
+    }
+    if (site_id) {
+      builder.where('site_id', site_id)
+    }
+    if (rule) {
+      builder.whereIn('rule', rule)
+    }
+    if (severity) {
+      builder.whereIn('severity', severity)
+    }
+    if (status) {
+      builder.whereIn('status', status)
+    }
+    if (after) {
+      builder.where('created_at', '>=', after)
+    }
+    if (before) {
+      builder.where('created_at', '<', before)
+    }
+    if (search && typeof search === 'string' && search.length > 0) {
+      builder.whereRaw("to_tsvector('English', message) @@ ?::tsquery", [
+        `${search.toLowerCase()}:*`,
+      ])
+    }
+  }
+}
@@ -5,10 +5,20 @@ import { Authorized, AuthScope } from '../../middleware/auth'
 import { uuidFormat } from '../../crud/schemas'
 
 import listRoute from './list'
+import countRoute from './count'
 import viewRoute from './view'
 import deleteRoute from './delete'
 import distinctRoute from './distinct'
 import aggRoute from './agg'
+import exportRoute from './export'
+import deliveriesRoute from './deliveries'
+import deliveryHistoryRoute from './delivery-history'
+import eventRoute from './event'
+import statusRoute from './status'
+import redeliverRoute from './redeliver'
+import statusCountsRoute from './status-counts'
+import sinksRoute from './sinks'
+import sinkTestRoute from './sink-test'
 
 const AdminScope = AuthPathOp(Scope(Authorized, 'admin'))
 
@@ -17,6 +27,22 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
     router,
     Path('/', AuthScope(listRoute)),
     Path('/agg', AuthScope(aggRoute)),
+    Path('/count', AuthScope(countRoute)),
+    Path('/status-counts', AuthScope(statusCountsRoute)),
+    Path('/sinks', AuthScope(sinksRoute)),
+    Path('/sinks/:key/test', AdminScope(sinkTestRoute)),
     Path(`/:id(${uuidFormat})`, AuthScope(viewRoute), AdminScope(deleteRoute)),
+    Path(`/:id(${uuidFormat})/export.html`, AuthScope(exportRoute)),
+    Path(`/:id(${uuidFormat})/deliveries`, AuthScope(deliveriesRoute)),
+    Path(
+      `/:id(${uuidFormat})/deliveries/history`,
+      AuthScope(deliveryHistoryRoute)
+    ),
+    Path(
+      `/:id(${uuidFormat})/deliveries/:delivery_id(${uuidFormat})/redeliver`,
+      AdminScope(redeliverRoute)
+    ),
+    Path(`/:id(${uuidFormat})/event`, AuthScope(eventRoute)),
+    Path(`/:id(${uuidFormat})/status`, AuthScope(statusRoute)),
     Path('/distinct', AuthScope(distinctRoute))
   )
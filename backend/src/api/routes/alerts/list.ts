@@ -5,10 +5,13 @@ import { Alert } from '../../../models'
 import { Site } from '../../../models'
 import { Schema } from '../../../models/alerts'
 import {
-  listHandler,
+  cursorListHandler,
+  CursorQueryParams,
+  cursorResponseSchema,
   listResponseSchema,
   ListQueryParams,
 } from '../../crud/list'
+import { AlertFilterParams, alertFilters } from './filters'
 
 const selectable = Alert.selectAble() as string[]
 
@@ -27,22 +30,8 @@ export default AsyncGet({
   description: 'List Alerts',
   parameters: [
     ...ListQueryParams,
-    QueryParam({
-      name: 'scan_id',
-      description: 'Filter by scan_id',
-      schema: {
-        type: 'string',
-        format: 'uuid',
-      },
-    }),
-    QueryParam({
-      name: 'site_id',
-      description: 'Filter by site_id',
-      schema: {
-        type: 'string',
-        format: 'uuid',
-      },
-    }),
+    ...CursorQueryParams,
+    ...AlertFilterParams,
     QueryParam({
       name: 'eager',
       description: 'Eager load related Site name',
@@ -65,24 +54,6 @@ export default AsyncGet({
         },
       },
     }),
-    QueryParam({
-      name: 'rule',
-      description: 'filter results based on rule type',
-      schema: {
-        type: 'array',
-        items: {
-          type: 'string',
-          enum: Schema.rule.enum,
-        },
-      },
-    }),
-    QueryParam({
-      name: 'search',
-      description: 'full-text search on the Alert event',
-      schema: {
-        type: 'string',
-      },
-    }),
   ],
   responses: {
     '200': {
@@ -91,20 +62,23 @@ export default AsyncGet({
         'application/json': {
           schema: {
             type: 'object',
-            properties: listResponseSchema({
-              ...Schema,
-              site: {
-                type: 'object',
-                nullable: true,
-                description: 'Included when eager query is provided',
-                properties: {
-                  name: {
-                    type: 'string',
-                    description: 'Name of site',
+            properties: {
+              ...listResponseSchema({
+                ...Schema,
+                site: {
+                  type: 'object',
+                  nullable: true,
+                  description: 'Included when eager query is provided',
+                  properties: {
+                    name: {
+                      type: 'string',
+                      description: 'Name of site',
+                    },
                   },
                 },
-              },
-            }),
+              }),
+              ...cursorResponseSchema,
+            },
             additionalProperties: false,
           },
         },
@@ -113,32 +87,19 @@ export default AsyncGet({
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const filters = alertFilters(req)
       res.locals.whereBuilder = (builder: QueryBuilder<Alert>) => {
-        const { rule, scan_id, site_id, eager } = req.query as Record<
+        const { eager } = req.query as Record<
           string,
           string | string[] | undefined
         >
-        if (scan_id) {
-          builder.where('scan_id', scan_id)
-        }
-        if (site_id) {
-          builder.where('site_id', site_id)
-        }
-        if (rule) {
-          builder.whereIn('rule', rule)
-        }
-        if (req.query.search && typeof req.query.search === 'string' && req.query.search.length > 0) {
-          builder.whereRaw("to_tsvector('English', message) @@ ?::tsquery", [
-            `${req.query.search.toLowerCase()}:*`,
-          ])
-        }
-
+        filters(builder)
         if (eager && Array.isArray(eager)) {
           eagerLoad(eager, builder)
         }
       }
       next()
     },
-    listHandler<Alert>(Alert, selectable),
+    cursorListHandler<Alert>(Alert, selectable),
   ],
 })
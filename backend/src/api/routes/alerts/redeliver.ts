@@ -0,0 +1,62 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost, PathParam } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import AlertService from '../../../services/alert'
+import { uuidParams } from './schemas'
+
+export default AsyncPost({
+  tags: ['alerts'],
+  description: 'Queue a redelivery of a failed Alert delivery to its sink',
+  parameters: [
+    uuidParams,
+    PathParam({
+      name: 'delivery_id',
+      description: 'Alert Delivery ID',
+      schema: {
+        type: 'string',
+        format: 'uuid',
+      },
+    }),
+  ],
+  responses: {
+    '202': {
+      description: 'Accepted',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              job_id: {
+                type: 'string',
+                description: 'ID of the redelivery job',
+              },
+              delivery_id: {
+                type: 'string',
+                format: 'uuid',
+                description: 'ID of the redelivered attempt',
+              },
+              sink: {
+                type: 'string',
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const queued = await AlertService.requestRedelivery(
+        req.params.id,
+        req.params.delivery_id,
+        req.session.data.lanid
+      )
+      res.status(202).send(queued)
+      next()
+    },
+  ],
+})
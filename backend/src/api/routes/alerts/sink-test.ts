@@ -0,0 +1,56 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost, PathParam } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import AlertService from '../../../services/alert'
+
+export default AsyncPost({
+  tags: ['alerts'],
+  description:
+    'Send a test delivery to an alert sink, no alert or attempt is recorded',
+  parameters: [
+    PathParam({
+      name: 'key',
+      description: 'Alert sink key (e.g. goAlert)',
+      schema: {
+        type: 'string',
+      },
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              sink: { type: 'string' },
+              delivered: { type: 'boolean' },
+              status: {
+                type: 'integer',
+                nullable: true,
+                description: 'Response status of HTTP sinks',
+              },
+              latency_ms: { type: 'integer' },
+              error: {
+                type: 'string',
+                description: 'Failure, secrets of the sink are masked',
+              },
+            },
+          },
+        },
+      },
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const result = await AlertService.testDelivery(
+        req.params.key,
+        req.session.data.lanid
+      )
+      res.status(200).send(result)
+      next()
+    },
+  ],
+})
@@ -0,0 +1,44 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import AlertService from '../../../services/alert'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'List configured alert sinks and their rule filters',
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              results: {
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: {
+                    key: { type: 'string' },
+                    name: { type: 'string' },
+                    enabled: { type: 'boolean' },
+                    fallback: { type: 'string', nullable: true },
+                    rule_types: {
+                      type: 'array',
+                      items: { type: 'string' },
+                    },
+                  },
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (_req: Request, res: Response, next: NextFunction): Promise<void> => {
+      res.status(200).send({ results: await AlertService.sinks() })
+      next()
+    },
+  ],
+})
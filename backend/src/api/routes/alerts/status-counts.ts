@@ -0,0 +1,32 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { AlertStatuses } from '../../../models/alerts'
+import AlertService from '../../../services/alert'
+
+export default AsyncGet({
+  tags: ['alerts'],
+  description: 'Count Alerts by status',
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: [...AlertStatuses, 'handled'].reduce(
+              (props, status) => ({ ...props, [status]: { type: 'integer' } }),
+              {}
+            ),
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (_req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const counts = await AlertService.statusCounts()
+      res.status(200).send(counts)
+      next()
+    },
+  ],
+})
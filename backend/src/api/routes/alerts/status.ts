@@ -0,0 +1,86 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import { AlertStatuses, Schema } from '../../../models/alerts'
+import { Schema as AllowListSchema } from '../../../models/allow_list'
+import AlertService from '../../../services/alert'
+import { uuidParams } from './schemas'
+
+export default AsyncPost({
+  tags: ['alerts'],
+  description: 'Transition Alert triage status',
+  parameters: [uuidParams],
+  requestBody: {
+    description: 'Status transition',
+    content: {
+      'application/json': {
+        schema: {
+          type: 'object',
+          properties: {
+            alert_status: {
+              type: 'object',
+              properties: {
+                status: {
+                  type: 'string',
+                  enum: AlertStatuses,
+                },
+                note: {
+                  type: 'string',
+                  maxLength: 2048,
+                },
+                allow_list: {
+                  type: 'boolean',
+                  description:
+                    'Allow-list the alert context domain (false_positive only)',
+                },
+              },
+              required: ['status'],
+              additionalProperties: false,
+            },
+          },
+          required: ['alert_status'],
+          additionalProperties: false,
+        },
+      },
+    },
+  },
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              alert: {
+                type: 'object',
+                properties: Schema,
+              },
+              allow_list: {
+                type: 'object',
+                properties: AllowListSchema,
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const { status, note, allow_list } = req.body.alert_status
+      const result = await AlertService.transition(
+        req.params.id,
+        status,
+        req.session.data.lanid,
+        { note, allowList: allow_list }
+      )
+      res.status(200).send(result)
+      next()
+    },
+  ],
+})
@@ -0,0 +1,61 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import { allowListBatchBody } from './schemas'
+import AllowListService from '../../../services/allow_list'
+import { validationErrorResponse } from '../../crud/schemas'
+
+export default AsyncPost({
+  tags: ['allow_list'],
+  description:
+    'Matches several values against active entries of a type at once (keys are regular expressions)',
+  requestBody: allowListBatchBody,
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const { type, keys } = req.body.allow_list as {
+        type: string
+        keys: string[]
+      }
+      const results = await AllowListService.matchMany(
+        type,
+        Array.from(new Set(keys))
+      )
+      res.status(200).send({ results })
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              results: {
+                description:
+                  'Matches by value, values without a match are left out',
+                type: 'object',
+                additionalProperties: {
+                  type: 'object',
+                  properties: {
+                    total: {
+                      type: 'integer',
+                      description: 'Matching entries',
+                    },
+                    expires_at: {
+                      type: 'string',
+                      format: 'date-time',
+                      nullable: true,
+                      description: 'Earliest expiry of the matching entries',
+                    },
+                  },
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+    '422': validationErrorResponse,
+  },
+})
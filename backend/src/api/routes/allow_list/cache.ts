@@ -15,7 +15,7 @@ export default AsyncGet({
       const hit = await AllowListService.cached_view({ type, key })
       // if not in cache, check the DB
       if (!hit.has) {
-        const dbHit = await AllowListService.findOne({
+        const dbHit = await AllowListService.findActive({
           type: typeof AllowListType,
           key,
         })
@@ -10,7 +10,10 @@ export default AsyncPost({
   requestBody: allowListBody,
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const created = await AllowListService.create(req.body.allow_list)
+      const created = await AllowListService.create(
+        req.body.allow_list,
+        req.session.data.lanid
+      )
       res.status(200).send(created)
       next()
     },
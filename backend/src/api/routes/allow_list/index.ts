@@ -7,6 +7,7 @@ import { uuidFormat } from '../../crud/schemas'
 import listRoute from './list'
 import createRoute from './create'
 import cacheRoute from './cache'
+import batchCacheRoute from './batch-cache'
 import viewRoute from './view'
 import updateRoute from './update'
 import deleteRoute from './delete'
@@ -25,6 +26,7 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
       AuthPathOp(Scope(Authorized, 'admin', 'transport'))(createRoute)
     ),
     Path('/_cache', TransportScope(cacheRoute)),
+    Path('/_cache/_batch', TransportScope(batchCacheRoute)),
     Path(
       `/:id(${uuidFormat})`,
       AuthScope(viewRoute),
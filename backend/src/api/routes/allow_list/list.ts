@@ -8,6 +8,7 @@ import {
   ListQueryParams,
 } from '../../crud/list'
 import { QueryBuilder } from 'objection'
+import { whereActive } from '../../../services/allow_list'
 
 const selectable = AllowList.selectAble()
 
@@ -69,8 +70,9 @@ export default AsyncGet({
         if (req.query.type && typeof req.query.type === 'string') {
           builder.where('type', req.query.type)
         }
-        // use `~` for all matches (regex)
+        // use `~` for all matches (regex), expired entries never match
         if (req.query.key && typeof req.query.key === 'string') {
+          builder.modify(whereActive)
           builder.whereRaw('? ~ key', [req.query.key])
         }
       }
@@ -13,6 +13,7 @@ export const allowListBody: MediaSchema = {
             properties: {
               type: Schema.type,
               key: Schema.key,
+              expires_at: Schema.expires_at,
             },
             required: ['type', 'key'],
             additionalProperties: false,
@@ -25,6 +26,38 @@ export const allowListBody: MediaSchema = {
   },
 }
 
+// values per batch lookup
+export const MAX_BATCH_KEYS = 500
+
+export const allowListBatchBody: MediaSchema = {
+  description: 'Allow List batch lookup',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: {
+          allow_list: {
+            type: 'object',
+            properties: {
+              type: Schema.type,
+              keys: {
+                type: 'array',
+                items: { type: 'string' },
+                minItems: 1,
+                maxItems: MAX_BATCH_KEYS,
+              },
+            },
+            required: ['type', 'keys'],
+            additionalProperties: false,
+          },
+        },
+        additionalProperties: false,
+        required: ['allow_list'],
+      },
+    },
+  },
+}
+
 export const allowListResponse: MediaSchema = {
   description: 'OK',
   content: {
@@ -20,7 +20,8 @@ export default AsyncPut({
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
       const updated = await AllowListService.update(
         req.params.id,
-        req.body.allow_list
+        req.body.allow_list,
+        req.session.data.lanid
       )
       res.status(200).send(updated)
       next()
@@ -0,0 +1,10 @@
+import { Router } from 'express'
+import { AuthPathOp, Scope, PathItem, Path, Route } from 'aejo'
+import { Authorized } from '../../middleware/auth'
+
+import listRoute from './list'
+
+const AdminScope = AuthPathOp(Scope(Authorized, 'admin'))
+
+export default (router: Router): { paths: PathItem[]; router: Router } =>
+  Route(router, Path('/', AdminScope(listRoute)))
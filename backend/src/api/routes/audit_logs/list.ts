@@ -0,0 +1,86 @@
+import { Request, Response, NextFunction } from 'express'
+import { QueryBuilder } from 'objection'
+import { AsyncGet, QueryParam } from 'aejo'
+import {
+  listHandler,
+  listResponseSchema,
+  ListQueryParams,
+} from '../../crud/list'
+import AuditLog, { AuditEntityTypes, Schema } from '../../../models/audit_logs'
+import { whereFilters } from '../../../services/audit'
+
+const selectable = AuditLog.selectAble()
+
+export default AsyncGet({
+  tags: ['audit_logs'],
+  description: 'List audit log entries of admin actions',
+  parameters: [
+    ...ListQueryParams,
+    QueryParam({
+      name: 'actor',
+      description: 'filter on the login of the user',
+      schema: {
+        type: 'string',
+      },
+    }),
+    QueryParam({
+      name: 'entity_type',
+      description: 'filter on the type of the changed entity',
+      schema: {
+        type: 'string',
+        enum: AuditEntityTypes,
+      },
+    }),
+    QueryParam({
+      name: 'entity_id',
+      description: 'filter on the ID (or sink key) of the changed entity',
+      schema: {
+        type: 'string',
+      },
+    }),
+    QueryParam({
+      name: 'from',
+      description: 'date filter using created_at >= `from`',
+      schema: {
+        type: 'string',
+        format: 'date-time',
+      },
+    }),
+    QueryParam({
+      name: 'to',
+      description: 'date filter using created_at < `to`',
+      schema: {
+        type: 'string',
+        format: 'date-time',
+      },
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: listResponseSchema(Schema),
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const query = req.query as Record<string, string | undefined>
+      res.locals.whereBuilder = (builder: QueryBuilder<AuditLog>) =>
+        whereFilters({
+          actor: query.actor,
+          entity_type: query.entity_type,
+          entity_id: query.entity_id,
+          since: query.from ? new Date(query.from) : undefined,
+          until: query.to ? new Date(query.to) : undefined,
+        })(builder)
+      next()
+    },
+    listHandler<AuditLog>(AuditLog, selectable),
+  ],
+})
@@ -2,7 +2,7 @@ import { Request, Response, NextFunction } from 'express'
 import { AsyncPost } from 'aejo'
 import { validationErrorResponse } from '../../crud/schemas'
 import IocService from '../../../services/ioc'
-import { IocType } from '../../../models/iocs'
+import { IocType, IocTypes, Schema } from '../../../models/iocs'
 
 export default AsyncPost({
   tags: ['iocs'],
@@ -22,16 +22,16 @@ export default AsyncPost({
                   minItems: 1,
                   items: {
                     type: 'string',
-                    format: 'regex',
                   },
                 },
                 type: {
                   type: 'string',
-                  enum: ['fqdn', 'ip', 'literal'],
+                  enum: IocTypes,
                 },
                 enabled: {
                   type: 'boolean',
                 },
+                expires_at: Schema.expires_at,
               },
               required: ['values', 'type', 'enabled'],
               additionalProperties: false,
@@ -55,12 +55,17 @@ export default AsyncPost({
         values,
         type,
         enabled,
+        expires_at,
       }: {
         values: string[]
         type: IocType
         enabled: boolean
+        expires_at?: Date | null
       } = req.body.iocs
-      await IocService.bulkCreate({ values, type, enabled })
+      await IocService.bulkCreate(
+        { values, type, enabled, expires_at },
+        req.session.data.lanid
+      )
       res.status(200).send({ message: 'created' })
       next()
     },
@@ -2,7 +2,7 @@ import { Request, Response, NextFunction } from 'express'
 import { AsyncGet } from 'aejo'
 import { cacheViewParams, cacheViewSchema } from '../../crud/cache'
 import { validationErrorResponse } from '../../crud/schemas'
-import IocService from '../../../services/ioc'
+import IocService, { normalizeValue } from '../../../services/ioc'
 import { IocType } from '../../../models/iocs'
 
 export default AsyncGet({
@@ -14,9 +14,9 @@ export default AsyncGet({
       const { type, key } = req.query as Record<string, string>
       const hit = await IocService.cached_view({ type, key })
       if (!hit.has) {
-        const dbHit = await IocService.findOne({
+        const dbHit = await IocService.findActive({
           type: type as IocType,
-          value: key,
+          value: normalizeValue(type as IocType, key),
         })
         if (dbHit) {
           hit.store = 'database'
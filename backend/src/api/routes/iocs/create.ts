@@ -10,7 +10,10 @@ export default AsyncPost({
   requestBody: iocBody,
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const created = await IocService.create(req.body.ioc)
+      const created = await IocService.create(
+        req.body.ioc,
+        req.session.data.lanid
+      )
       res.status(200).send(created)
       next()
     },
@@ -1,3 +1,4 @@
+import { isIP } from 'net'
 import { Request, Response, NextFunction } from 'express'
 import { QueryBuilder } from 'objection'
 import { AsyncGet, QueryParam } from 'aejo'
@@ -6,10 +7,52 @@ import {
   listResponseSchema,
   ListQueryParams,
 } from '../../crud/list'
-import Ioc, { Schema } from '../../../models/iocs'
+import Ioc, { IocType, IocTypes, Schema } from '../../../models/iocs'
+import { whereActive } from '../../../services/ioc'
 
 const selectable = Ioc.selectAble()
 
+// types with regular expression values
+const patternTypes: IocType[] = ['fqdn', 'ip', 'literal']
+
+/**
+ * matchValue
+ *
+ * Filters IOCs of `type` matching `value`: url IOCs as substrings of
+ * `value`, ip_cidr as ranges containing it, sha256 exactly and the
+ * rest as regular expressions
+ */
+const matchValue = (
+  builder: QueryBuilder<Ioc>,
+  type: IocType | undefined,
+  value: string
+) => {
+  switch (type) {
+    case 'url':
+      builder.whereRaw('strpos(?, value) > 0', [value])
+      break
+    case 'ip_cidr':
+      if (isIP(value)) {
+        // guarded, postgres may cast before the type filter is applied
+        builder.whereRaw(
+          "case when type = 'ip_cidr' then ?::inet <<= value::inet end",
+          [value]
+        )
+      } else {
+        builder.whereRaw('false')
+      }
+      break
+    case 'sha256':
+      builder.where('value', value.toLowerCase())
+      break
+    default:
+      if (type === undefined) {
+        builder.whereIn('type', patternTypes)
+      }
+      builder.whereRaw('? ~ value', [value])
+  }
+}
+
 export default AsyncGet({
   tags: ['iocs'],
   description: 'List IOCs',
@@ -20,15 +63,15 @@ export default AsyncGet({
       description: 'filter on type',
       schema: {
         type: 'string',
-        enum: ['fqdn', 'ip', 'literal'],
+        enum: IocTypes,
       },
     }),
     QueryParam({
       name: 'value',
-      description: 'filter on values using a regular expression',
+      description:
+        'filter on IOCs matching value (regular expression, substring, range or hash depending on type)',
       schema: {
         type: 'string',
-        format: 'regex',
       },
     }),
     QueryParam({
@@ -59,11 +102,15 @@ export default AsyncGet({
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
       res.locals.whereBuilder = (builder: QueryBuilder<Ioc>) => {
+        let type: IocType | undefined
         if (req.query.type && typeof req.query.type === 'string') {
-          builder.where('type', req.query.type)
+          type = req.query.type as IocType
+          builder.where('type', type)
         }
+        // rule lookups, expired or disabled IOCs never match
         if (req.query.value && typeof req.query.value === 'string') {
-          builder.whereRaw('? ~ value', [req.query.value])
+          builder.modify(whereActive)
+          matchValue(builder, type, req.query.value)
         }
       }
       next()
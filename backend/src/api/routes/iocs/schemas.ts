@@ -14,6 +14,7 @@ export const iocBody: MediaSchema = {
               value: Schema.value,
               type: Schema.type,
               enabled: Schema.enabled,
+              expires_at: Schema.expires_at,
             },
             required: ['value', 'type', 'enabled'],
             additionalProperties: false,
@@ -19,7 +19,11 @@ export default AsyncPut({
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const updated = await IocService.update(req.params.id, req.body.ioc)
+      const updated = await IocService.update(
+        req.params.id,
+        req.body.ioc,
+        req.session.data.lanid
+      )
       res.status(200).send(updated)
       next()
     },
@@ -25,6 +25,51 @@ export default AsyncGet({
                 description: 'Number of scheduled scans waiting to be run',
                 type: 'integer',
               },
+              awaiting_rules: {
+                description:
+                  'Number of completed scans with events waiting for rules',
+                type: 'integer',
+              },
+              awaiting_rule_events: {
+                description: 'Number of events of those scans still waiting',
+                type: 'integer',
+              },
+              held_alerts: {
+                description:
+                  'Number of alert jobs held until their event is persisted',
+                type: 'integer',
+              },
+              held_alert_jobs: {
+                description:
+                  'Oldest held alert jobs with the scan log job they wait for',
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: {
+                    job_id: { type: 'string' },
+                    scan_id: { type: 'string', format: 'uuid' },
+                    depends_on: {
+                      description: 'Scan log job the alert job waits for',
+                      type: 'string',
+                    },
+                  },
+                },
+              },
+              max_wait_seconds: {
+                description:
+                  'Wait of the oldest scheduled scan per type, in seconds',
+                type: 'object',
+                properties: {
+                  scheduled: {
+                    description: 'Site scans added by the scheduler',
+                    type: 'integer',
+                  },
+                  test: {
+                    description: 'Test scans of sources',
+                    type: 'integer',
+                  },
+                },
+              },
             },
           },
         },
@@ -0,0 +1,9 @@
+import { Router } from 'express'
+import { Route, Path, PathItem, Scope, AuthPathOp } from 'aejo'
+import { Authorized } from '../../middleware/auth'
+
+import topDomainsRoute from './top-domains'
+
+const AdminScope = AuthPathOp(Scope(Authorized, 'admin'))
+export default (router: Router): { paths: PathItem[]; router: Router } =>
+  Route(router, Path('/top-domains', AdminScope(topDomainsRoute)))
@@ -0,0 +1,71 @@
+import { AsyncGet, QueryParam } from 'aejo'
+import { Request, Response, NextFunction } from 'express'
+import ScanLogService from '../../../services/scan_logs'
+import { parseSince } from '../../../lib/since'
+import { BadRequestError } from '../../middleware/client-errors'
+
+export default AsyncGet({
+  tags: ['reports'],
+  description: 'Domains with the most request events across all sites',
+  parameters: [
+    QueryParam({
+      name: 'since',
+      description: 'Start of the window, relative (7d, 24h, 30m) or a date',
+      schema: {
+        type: 'string',
+        default: '7d',
+      },
+    }),
+    QueryParam({
+      name: 'limit',
+      description: 'Number of domains',
+      schema: {
+        type: 'integer',
+        minimum: 1,
+        maximum: 1000,
+        default: 10,
+      },
+    }),
+  ],
+  responses: {
+    '200': {
+      description: 'Top domains',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              since: { type: 'string', format: 'date-time' },
+              domains: {
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: {
+                    domain: { type: 'string' },
+                    events: { type: 'integer' },
+                    sites: { type: 'integer' },
+                  },
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const since = parseSince((req.query.since as string) || '7d')
+      if (since === null) {
+        return next(new BadRequestError('invalid since', { name: 'since' }))
+      }
+      const domains = await ScanLogService.topDomains({
+        since,
+        limit: (req.query.limit as unknown as number) || 10,
+      })
+      res.set('Cache-Control', 'no-store')
+      res.status(200).send({ since: since.toISOString(), domains })
+      next()
+    },
+  ],
+})
@@ -0,0 +1,36 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { uuidParams } from '../../crud/schemas'
+import ScanLogService from '../../../services/scan_logs'
+
+export default AsyncGet({
+  tags: ['scan_logs'],
+  description: 'Number of ScanLogs per entry type for a scan',
+  parameters: [uuidParams],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'array',
+            items: {
+              type: 'object',
+              properties: {
+                entry: { type: 'string' },
+                count: { type: 'integer' },
+              },
+            },
+          },
+        },
+      },
+    },
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const facets = await ScanLogService.entryFacets(req.params.id)
+      res.status(200).send(facets)
+      next()
+    },
+  ],
+})
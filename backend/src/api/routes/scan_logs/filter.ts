@@ -0,0 +1,143 @@
+import { Request, Response, NextFunction } from 'express'
+import { Parameter, QueryParam } from 'aejo'
+import { QueryBuilder } from 'objection'
+import { Schema } from '../../../models/scan_logs'
+import { ScanLog } from '../../../models'
+import EventFilter, {
+  EventFilterError,
+  FilterClause,
+} from '../../../lib/event-filter'
+import { BadRequestError } from '../../middleware/client-errors'
+import { escapeLike } from '../../../lib/utils'
+
+// shorter substrings can not use the trigram index
+export const MIN_BODY_SEARCH_LENGTH = 3
+
+// entries covered by the (partial) trigram index, the same list as
+// its migration so the planner can use it. Screenshots, snapshots
+// and script bodies are not searched
+export const BODY_SEARCH_ENTRIES = [
+  'request',
+  'response-error',
+  'function-call',
+  'cookie',
+  'file-download',
+  'worker-created',
+  'page-error',
+  'console-message',
+  'rule-alert',
+  'log-message',
+  'error',
+]
+const bodySearchEntries = BODY_SEARCH_ENTRIES.map((e) => `'${e}'`).join(', ')
+
+// ScanLog filters shared by the list and the export
+export const scanLogFilterParams: Parameter[] = [
+  QueryParam({
+    name: 'search',
+    description: 'full-text search on the ScanLog event',
+    schema: {
+      type: 'string',
+    },
+  }),
+  QueryParam({
+    name: 'search_body',
+    description: `match \`search\` as a substring of the raw event JSON (e.g. a URL or sha256), at least ${MIN_BODY_SEARCH_LENGTH} characters. Only ${BODY_SEARCH_ENTRIES.join(', ')} entries are searched`,
+    schema: {
+      type: 'boolean',
+      default: false,
+    },
+  }),
+  QueryParam({
+    name: 'where',
+    description:
+      'filter on event fields, e.g. `request.url~"/gateway/",response.status>=500`',
+    schema: {
+      type: 'string',
+    },
+  }),
+  QueryParam({
+    name: 'from',
+    description: 'date filter using created_at > `from`',
+    schema: {
+      type: 'string',
+      format: 'date-time',
+    },
+  }),
+  QueryParam({
+    name: 'entry',
+    description: 'filter results based on entry type',
+    schema: {
+      type: 'array',
+      items: {
+        type: 'string',
+        enum: Schema.entry.enum,
+      },
+    },
+  }),
+]
+
+/**
+ * scanLogFilter
+ *
+ * Sets `res.locals.whereBuilder` from the `scanLogFilterParams`
+ * (and `scan_id`) of the query
+ */
+export const scanLogFilter = async (
+  req: Request,
+  res: Response,
+  next: NextFunction
+): Promise<void> => {
+  let clauses: FilterClause[] = []
+  if (typeof req.query.where === 'string' && req.query.where.length) {
+    try {
+      clauses = EventFilter.parse(req.query.where)
+    } catch (e) {
+      if (e instanceof EventFilterError) {
+        throw new BadRequestError(`invalid where expression: ${e.message}`)
+      }
+      throw e
+    }
+  }
+  const searchBody =
+    (req.query.search_body as unknown) === true ||
+    req.query.search_body === 'true'
+  const search = typeof req.query.search === 'string' ? req.query.search : ''
+  if (searchBody && search.length < MIN_BODY_SEARCH_LENGTH) {
+    throw new BadRequestError(
+      `search must be at least ${MIN_BODY_SEARCH_LENGTH} characters`,
+      { name: 'search' }
+    )
+  }
+  // filter on scan_id
+  res.locals.whereBuilder = (builder: QueryBuilder<ScanLog>) => {
+    if (req.query.scan_id && typeof req.query.scan_id === 'string') {
+      builder.where('scan_id', req.query.scan_id)
+    }
+
+    if (searchBody) {
+      // uses the partial trigram index on event::text
+      builder.whereRaw(`entry in (${bodySearchEntries})`)
+      builder.whereRaw('event::text ilike ?', [`%${escapeLike(search)}%`])
+    } else if (search.length > 0) {
+      builder.whereRaw("to_tsvector('English', event) @@ ?::tsquery", [
+        `${search.toLowerCase()}:*`,
+      ])
+    }
+    // allow filtering on created_at after a given date
+    if (req.query.from && typeof req.query.from === 'string') {
+      builder.whereRaw('created_at > ?', [req.query.from])
+    }
+
+    if (
+      req.query.entry &&
+      Array.isArray(req.query.entry) &&
+      req.query.entry.length
+    ) {
+      builder.whereIn('entry', req.query.entry as string[])
+    }
+
+    EventFilter.applyFilter(builder, clauses)
+  }
+  next()
+}
@@ -6,6 +6,7 @@ import { Authenticated } from '../../middleware/auth'
 import listRoute from './list'
 import viewRoute from './view'
 import distinctRoute from './distinct'
+import facetsRoute from './facets'
 
 const AuthScope = AuthPathOp(Scope(Authenticated, 'user'))
 
@@ -14,5 +15,6 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
     router,
     Path('/', AuthScope(listRoute)),
     Path(`/:id(${uuidFormat})`, AuthScope(viewRoute)),
-    Path(`/:id(${uuidFormat})/distinct`, AuthScope(distinctRoute))
+    Path(`/:id(${uuidFormat})/distinct`, AuthScope(distinctRoute)),
+    Path(`/:id(${uuidFormat})/facets`, AuthScope(facetsRoute))
   )
@@ -0,0 +1,52 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import { uuidParams, validationErrorResponse } from '../../crud/schemas'
+
+import ScanService from '../../../services/scan'
+import { getScannerQueue } from '../../../lib/queues'
+import { Schema } from '../../../models/scans'
+
+export default AsyncPost({
+  tags: ['scans'],
+  description:
+    'Cancel a scheduled Scan (logs are kept). Responds 202 when a scanner already picked up the Scan',
+  parameters: [uuidParams],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: Schema,
+          },
+        },
+      },
+    },
+    '202': {
+      description: 'Cancelled, the running scan job will finish',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: Schema,
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const { scan, running } = await ScanService.cancel(
+        req.params.id,
+        await getScannerQueue()
+      )
+      res.status(running ? 202 : 200).send(scan)
+      next()
+    },
+  ],
+})
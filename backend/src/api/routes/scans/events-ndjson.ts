@@ -0,0 +1,43 @@
+import { Request, Response, NextFunction } from 'express'
+
+import { AsyncGet, QueryParam } from 'aejo'
+import { uuidParams } from '../alerts/schemas'
+import { scanLogFilter, scanLogFilterParams } from '../scan_logs/filter'
+import { afterCursorParam, streamScanLogs } from './export'
+
+export default AsyncGet({
+  tags: ['scans'],
+  description:
+    'Stream the ScanLogs of the scan matching the ScanLog list filters as newline-delimited JSON',
+  parameters: [
+    uuidParams,
+    ...scanLogFilterParams,
+    QueryParam({
+      name: 'trim',
+      description: 'drop screenshot images from the events (`trim=1`)',
+      schema: { type: 'string', enum: ['0', '1', 'false', 'true'] }
+    }),
+    afterCursorParam
+  ],
+  middleware: [
+    scanLogFilter,
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      res.locals.trim = ['1', 'true'].includes(String(req.query.trim))
+      next()
+    },
+    streamScanLogs
+  ],
+  responses: {
+    200: {
+      description: 'Ok',
+      content: {
+        'application/x-ndjson': {
+          schema: {
+            type: 'string',
+            description: 'one ScanLog (with `cursor`) per line'
+          }
+        }
+      }
+    }
+  }
+})
@@ -0,0 +1,118 @@
+import { Request, Response, NextFunction } from 'express'
+import { config } from 'node-config-ts'
+
+import { AsyncGet, QueryParam } from 'aejo'
+import { uuidParams } from '../alerts/schemas'
+import ScanService from '../../../services/scan'
+import ScanLogService from '../../../services/scan_logs'
+import { ScanLog } from '../../../models'
+import { decodeCursor } from '../../../lib/cursor'
+import { writeNDJSON } from '../../../lib/stream'
+import {
+  BadRequestError,
+  TooManyRequestsError
+} from '../../middleware/client-errors'
+import logger from '../../../loaders/logger'
+
+/**
+ * streamScanLogs
+ *
+ * Streams the ScanLogs of scan `:id` as NDJSON, narrowed by
+ * `res.locals.whereBuilder` and without screenshot images when
+ * `res.locals.trim` is set. Resumes after `after_cursor`
+ */
+export const streamScanLogs = async (
+  req: Request,
+  res: Response,
+  next: NextFunction
+): Promise<void> => {
+  const { id } = req.params
+  let after
+  if (req.query.after_cursor) {
+    after = decodeCursor(String(req.query.after_cursor))
+    if (after === null) {
+      throw new BadRequestError('invalid after_cursor', {
+        name: 'after_cursor'
+      })
+    }
+  }
+  await ScanService.view(id)
+  const user = (req.session.data as UserSession)?.lanid || 'anonymous'
+  const { batchSize, maxPerUser } = config.scans.export
+  if (!(await ScanLogService.acquireExport(user, maxPerUser))) {
+    throw new TooManyRequestsError(
+      `at most ${maxPerUser} exports can run at once`,
+      { maxPerUser }
+    )
+  }
+  try {
+    // rows left to export, for progress
+    const remaining = ScanLog.query()
+      .where('scan_id', id)
+      .modify(res.locals.whereBuilder)
+    if (after) {
+      remaining.whereRaw('(created_at, id) > (?, ?)', [
+        after.created_at,
+        after.id
+      ])
+    }
+    const total = await remaining.resultSize()
+    res.status(200)
+    res.set({
+      'Content-Type': 'application/x-ndjson',
+      'Content-Disposition': `attachment; filename="scan-${id}.ndjson"`,
+      'X-Total-Count': String(total),
+      Trailer: 'X-Served-Count'
+    })
+    await writeNDJSON(
+      res,
+      ScanLogService.exportBatches(id, {
+        batchSize,
+        after,
+        whereBuilder: res.locals.whereBuilder,
+        trim: res.locals.trim === true
+      }),
+      written => res.addTrailers({ 'X-Served-Count': String(written) })
+    )
+  } catch (e) {
+    if (!res.headersSent) throw e
+    // too late for an error response
+    logger.error({
+      module: 'api/routes/scans/export',
+      scan_id: id,
+      message: e.message
+    })
+    res.destroy()
+    return
+  } finally {
+    await ScanLogService.releaseExport(user)
+  }
+  next()
+}
+
+export const afterCursorParam = QueryParam({
+  name: 'after_cursor',
+  description: 'resume an interrupted export after the row of `cursor`',
+  schema: { type: 'string' }
+})
+
+export default AsyncGet({
+  tags: ['scans'],
+  description:
+    'Stream every ScanLog of the scan as newline-delimited JSON, each line carries the `cursor` to resume after it',
+  parameters: [uuidParams, afterCursorParam],
+  middleware: [streamScanLogs],
+  responses: {
+    200: {
+      description: 'Ok',
+      content: {
+        'application/x-ndjson': {
+          schema: {
+            type: 'string',
+            description: 'one ScanLog (with `cursor`) per line'
+          }
+        }
+      }
+    }
+  }
+})
@@ -8,8 +8,14 @@ import viewRoute from './view'
 import deleteRoute from './delete'
 import bulkDeleteRoute from './bulk-delete'
 import summaryRoute from './summary'
+import rulesRoute from './rules'
+import rulesResultsRoute from './rules-results'
+import cancelRoute from './cancel'
+import exportRoute from './export'
+import eventsNDJSONRoute from './events-ndjson'
 
 const AdminScope = AuthPathOp(Scope(Authorized, 'admin'))
+const TransportScope = AuthPathOp(Scope(Authorized, 'transport'))
 
 export default (router: Router): { paths: PathItem[]; router: Router } =>
   Route(
@@ -17,5 +23,10 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
     Path('/', AuthScope(listRoute)),
     Path(`/:id(${uuidFormat})`, AuthScope(viewRoute), AdminScope(deleteRoute)),
     Path('/bulk_delete', AdminScope(bulkDeleteRoute)),
-    Path(`/:id(${uuidFormat})/summary`, summaryRoute)
+    Path(`/:id(${uuidFormat})/summary`, summaryRoute),
+    Path(`/:id(${uuidFormat})/cancel`, AdminScope(cancelRoute)),
+    Path(`/:id(${uuidFormat})/rules`, TransportScope(rulesRoute)),
+    Path(`/:id(${uuidFormat})/rules-results`, AuthScope(rulesResultsRoute)),
+    Path(`/:id(${uuidFormat})/events/export`, AuthScope(exportRoute)),
+    Path(`/:id(${uuidFormat})/events.ndjson`, AuthScope(eventsNDJSONRoute))
   )
@@ -2,9 +2,16 @@ import { Request, Response, NextFunction } from 'express'
 
 import { QueryBuilder } from 'objection'
 import { AsyncGet, QueryParam } from 'aejo'
-import Scan, { Schema } from '../../../models/scans'
+import Scan, { Schema, ScanStates } from '../../../models/scans'
 import { eagerLoad } from './handlers'
-import { listHandler, ListQueryParams } from '../../crud/list'
+import {
+  cursorListHandler,
+  CursorQueryParams,
+  cursorResponseSchema,
+  ListQueryParams,
+  MultiValueQueryParam,
+  parseMultiValue,
+} from '../../crud/list'
 
 const selectable = Scan.selectAble()
 
@@ -13,6 +20,7 @@ export default AsyncGet({
   description: 'List Scans',
   parameters: [
     ...ListQueryParams,
+    ...CursorQueryParams,
     QueryParam({
       name: 'site_id',
       description: 'Filter by site_id',
@@ -21,6 +29,11 @@ export default AsyncGet({
         format: 'uuid',
       },
     }),
+    MultiValueQueryParam({
+      name: 'state',
+      description: 'Filter by scan state',
+      values: ScanStates,
+    }),
     QueryParam({
       name: 'eager',
       description: 'Eager load related Site name',
@@ -59,8 +72,9 @@ export default AsyncGet({
               },
               total: {
                 type: 'integer',
-                description: 'Total number of results',
+                description: 'Total number of results (offset pages only)',
               },
+              ...cursorResponseSchema,
             },
             additionalProperties: false,
           },
@@ -74,11 +88,15 @@ export default AsyncGet({
         string,
         string | string[]
       >
+      const state = parseMultiValue('state', req.query.state, ScanStates)
       // filter on site_id
       res.locals.whereBuilder = (builder: QueryBuilder<Scan>) => {
         if (site_id) {
           builder.where('site_id', site_id)
         }
+        if (state) {
+          builder.whereIn('state', state)
+        }
         if (eager && Array.isArray(eager)) {
           eagerLoad(eager as string[], builder)
         }
@@ -88,6 +106,6 @@ export default AsyncGet({
       }
       next()
     },
-    listHandler<Scan>(Scan, selectable),
+    cursorListHandler<Scan>(Scan, selectable),
   ],
 })
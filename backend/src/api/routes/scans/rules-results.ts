@@ -0,0 +1,80 @@
+import { Request, Response, NextFunction } from 'express'
+
+import { AsyncGet } from 'aejo'
+import { uuidParams } from '../alerts/schemas'
+import ScanService from '../../../services/scan'
+
+export default AsyncGet({
+  tags: ['scans'],
+  description:
+    'Rule alert totals and unknown domains that would have alerted (learning mode) for a Scan',
+  parameters: [uuidParams],
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const results = await ScanService.rulesResults(req.params.id)
+      res.status(200).json(results)
+      next()
+    }
+  ],
+  responses: {
+    200: {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              scan_id: { type: 'string', format: 'uuid' },
+              learning_mode: {
+                description: 'Site was learning when the scan ran',
+                type: 'boolean'
+              },
+              target_drift: {
+                description:
+                  'Set when the scan landed away from the site target URL',
+                type: 'object',
+                nullable: true,
+                properties: {
+                  reason: { type: 'string', enum: ['domain', 'path'] },
+                  landing_url: { type: 'string' }
+                }
+              },
+              alerts: {
+                description: 'Number of alerts by rule name',
+                type: 'object',
+                additionalProperties: { type: 'integer' }
+              },
+              would_alert: {
+                description: 'One entry per rule / domain, first seen first',
+                type: 'array',
+                items: {
+                  type: 'object',
+                  properties: {
+                    rule: { type: 'string' },
+                    domain: { type: 'string' },
+                    message: { type: 'string' },
+                    page_url: {
+                      description:
+                        'Page of the request, the scan landing URL when unknown',
+                      type: 'string',
+                      nullable: true
+                    },
+                    request_url: { type: 'string' },
+                    first_seen: { type: 'string', format: 'date-time' },
+                    count: {
+                      description: 'Results for the domain in the scan',
+                      type: 'integer'
+                    }
+                  }
+                }
+              }
+            }
+          }
+        }
+      }
+    },
+    404: {
+      description: 'Not Found'
+    }
+  }
+})
@@ -0,0 +1,67 @@
+import { Request, Response, NextFunction } from 'express'
+
+import { AsyncGet } from 'aejo'
+import { uuidParams } from '../alerts/schemas'
+import ScanService from '../../../services/scan'
+
+export default AsyncGet({
+  tags: ['scans'],
+  description: 'Rules disabled and IOC exceptions for the site of a Scan',
+  parameters: [uuidParams],
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const rules = await ScanService.disabledRules(req.params.id)
+      res.status(200).json(rules)
+      next()
+    }
+  ],
+  responses: {
+    200: {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              site_id: {
+                description: 'ID of Site (null for test scans)',
+                type: 'string',
+                nullable: true
+              },
+              disabled: {
+                description: 'Rule names the scanner should skip',
+                type: 'array',
+                items: { type: 'string' }
+              },
+              ioc_exceptions: {
+                description: 'IOC values that do not alert for the site',
+                type: 'array',
+                items: { type: 'string' }
+              },
+              untrusted_suffixes: {
+                description:
+                  'Global allowlist suffixes the site does not trust',
+                type: 'array',
+                items: { type: 'string' }
+              },
+              learning: {
+                description:
+                  'Unknown domains are added to the seen baseline without alerting',
+                type: 'boolean'
+              },
+              baseline_until: {
+                description: 'End of learning mode',
+                type: 'string',
+                format: 'date-time',
+                nullable: true
+              }
+            }
+          }
+        }
+      }
+    },
+    404: {
+      description: 'Not Found'
+    }
+  }
+})
@@ -52,6 +52,10 @@ export default AsyncGet({
               totalReq: {
                 description: 'Number of web requests',
                 type: 'integer'
+              },
+              samplesDisabled: {
+                description: 'Per-domain request list omitted by settings',
+                type: 'boolean'
               }
             }
           }
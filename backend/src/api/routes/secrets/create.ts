@@ -21,6 +21,9 @@ export default AsyncPost({
                 name: Schema.name,
                 type: Schema.type,
                 value: Schema.value,
+                refresh_interval_minutes: Schema.refresh_interval_minutes,
+                provider: Schema.provider,
+                provider_ref: Schema.provider_ref,
               },
               required: ['name', 'type', 'value'],
               additionalProperties: false,
@@ -34,7 +37,10 @@ export default AsyncPost({
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const created = await SecretService.create(req.body.secret)
+      const created = await SecretService.create(
+        req.body.secret,
+        req.session.data.lanid
+      )
       res.status(200).send(created)
       next()
     },
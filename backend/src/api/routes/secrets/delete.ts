@@ -35,7 +35,10 @@ export default AsyncDelete({
       if (active) {
         throw new ClientError('Cannot delete active secret')
       }
-      const deleted = await SecretService.destroy(req.params.id)
+      const deleted = await SecretService.destroy(
+        req.params.id,
+        req.session.data.lanid
+      )
       res.status(200).send({ total: deleted })
       next()
     },
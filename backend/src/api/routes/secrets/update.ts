@@ -21,6 +21,9 @@ export default AsyncPut({
               properties: {
                 type: Schema.type,
                 value: Schema.value,
+                refresh_interval_minutes: Schema.refresh_interval_minutes,
+                provider: Schema.provider,
+                provider_ref: Schema.provider_ref,
               },
               required: ['type', 'value'],
               additionalProperties: false,
@@ -41,7 +44,11 @@ export default AsyncPut({
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const updated = await SecretService.update(req.params.id, req.body.secret)
+      const updated = await SecretService.update(
+        req.params.id,
+        req.body.secret,
+        req.session.data.lanid
+      )
       res.status(200).send(updated)
       next()
     },
@@ -0,0 +1,10 @@
+import { Router } from 'express'
+import { AuthPathOp, Path, PathItem, Route, Scope } from 'aejo'
+import { Authorized } from '../../middleware/auth'
+
+const TransportScope = AuthPathOp(Scope(Authorized, 'transport'))
+
+import observeRoute from './observe'
+
+export default (router: Router): { paths: PathItem[]; router: Router } =>
+  Route(router, Path('/_observe', TransportScope(observeRoute)))
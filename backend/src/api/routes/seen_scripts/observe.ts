@@ -0,0 +1,36 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import { observeBody, observeResponseSchema } from './schemas'
+import SeenScriptService from '../../../services/seen_script'
+import { validationErrorResponse } from '../../crud/schemas'
+
+export default AsyncPost({
+  tags: ['seen_scripts'],
+  description: 'Records a script hash, reports hash changes of known scripts',
+  requestBody: observeBody,
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const { scan_id, url, sha256 } = req.body.seen_script as Record<
+        string,
+        string
+      >
+      const result = await SeenScriptService.observeByScan(scan_id, url, sha256)
+      res.status(200).send(result)
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: observeResponseSchema,
+        },
+      },
+    },
+    '404': {
+      description: 'Scan Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+})
@@ -0,0 +1,46 @@
+import { MediaSchema } from 'aejo'
+import { Schema } from '../../../models/seen_scripts'
+
+export const observeBody: MediaSchema = {
+  description: 'Script hash seen in a scan',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: {
+          seen_script: {
+            type: 'object',
+            properties: {
+              scan_id: {
+                description: 'Scan the script was loaded in',
+                type: 'string',
+                format: 'uuid',
+              },
+              url: Schema.url,
+              sha256: Schema.sha256,
+            },
+            required: ['scan_id', 'url', 'sha256'],
+            additionalProperties: false,
+          },
+        },
+        required: ['seen_script'],
+        additionalProperties: false,
+      },
+    },
+  },
+}
+
+export const observeResponseSchema = {
+  type: 'object',
+  properties: {
+    previous: {
+      description: 'Hash seen before (null for new scripts)',
+      type: 'string',
+      nullable: true,
+    },
+    changed: {
+      description: 'Hash of a known script changed',
+      type: 'boolean',
+    },
+  },
+}
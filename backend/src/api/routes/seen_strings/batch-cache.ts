@@ -0,0 +1,110 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import {
+  SeenCacheResponse,
+  seenCacheViewSchema,
+  seenStringBatchBody,
+} from './schemas'
+import SeenStringService from '../../../services/seen_string'
+import ScanLogService from '../../../services/scan_logs'
+import { Scan, SeenString } from '../../../models'
+import { validationErrorResponse } from '../../crud/schemas'
+import { metrics } from '../../../lib/metrics'
+
+export default AsyncPost({
+  tags: ['seen_string'],
+  description:
+    'Checks several keys of a type at once (read-only, same result as GET /_cache per key). Unseen domains of a scan also report its site alert-once windows',
+  requestBody: seenStringBatchBody,
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const params = req.body.seen_strings as {
+        type: string
+        keys: string[]
+        scan_id?: string
+      }
+      const { type } = params
+      // requested key -> stored key
+      const normalized = params.keys.reduce((acc, key) => {
+        acc[key] = SeenString.normalizeKey(type, key)
+        return acc
+      }, {} as Record<string, string>)
+      const keys = Array.from(new Set(Object.values(normalized)))
+      const minHits = await SeenStringService.minHits(params.scan_id)
+      const ttlDays = await SeenStringService.baselineTTLDays(params.scan_id)
+      // cached hits are not checked against thresholds or the TTL
+      const hits: Record<string, SeenCacheResponse> =
+        minHits > 1 || ttlDays > 0
+          ? keys.reduce((acc, key) => {
+              acc[key] = { has: false, store: 'none' }
+              return acc
+            }, {} as Record<string, SeenCacheResponse>)
+          : await SeenStringService.cached_view_many(type, keys)
+      const misses = keys.filter((key) => !hits[key].has)
+      if (misses.length > 0) {
+        const touched: string[] = []
+        const rows = await SeenStringService.findMany(type, misses)
+        for (const row of rows) {
+          if (SeenStringService.isExpiredBaseline(row, ttlDays)) {
+            metrics().increment('seen_strings.baseline.expired', { type })
+            continue
+          }
+          if (row.hit_count >= minHits) {
+            hits[row.key] = { has: true, store: 'database' }
+          } else {
+            hits[row.key] = {
+              has: false,
+              store: 'none',
+              hit_count: row.hit_count,
+              below_threshold: true,
+            }
+          }
+          touched.push(row.id)
+        }
+        await SeenStringService.touch(touched)
+      }
+      // unseen domains that would be suppressed by alert-once
+      const unseen = keys.filter((key) => hits[key].store === 'none')
+      if (type === 'domain' && params.scan_id && unseen.length > 0) {
+        const scan = await Scan.query()
+          .select('site_id')
+          .findById(params.scan_id)
+        if (scan?.site_id) {
+          const once = await ScanLogService.peekAlertOnceMany(
+            scan.site_id,
+            unseen
+          )
+          once.forEach((key) => {
+            hits[key] = { ...hits[key], alert_once: true }
+          })
+        }
+      }
+      const results = Object.keys(normalized).reduce((acc, key) => {
+        acc[key] = hits[normalized[key]]
+        return acc
+      }, {} as Record<string, SeenCacheResponse>)
+      res.status(200).send({ results })
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              results: {
+                description: 'Lookup result by requested key',
+                type: 'object',
+                additionalProperties: seenCacheViewSchema,
+              },
+            },
+          },
+        },
+      },
+    },
+    '422': validationErrorResponse,
+  },
+})
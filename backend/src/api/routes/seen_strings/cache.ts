@@ -1,32 +1,60 @@
 import { Request, Response, NextFunction } from 'express'
 import { AsyncPost } from 'aejo'
-import { seenStringBody } from './schemas'
-import { cacheViewSchema } from '../../crud/cache'
+import {
+  SeenCacheResponse,
+  seenCacheViewSchema,
+  seenStringCacheBody,
+} from './schemas'
 import SeenStringService from '../../../services/seen_string'
+import { SeenString } from '../../../models'
 import { validationErrorResponse } from '../../crud/schemas'
+import { metrics } from '../../../lib/metrics'
 
 export default AsyncPost({
   tags: ['seen_string'],
   description: 'Read-through cache',
-  requestBody: seenStringBody,
+  requestBody: seenStringCacheBody,
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const { type, key } = req.body.seen_string as Record<string, string>
-      const hit = await SeenStringService.cached_view({ type, key })
+      const params = req.body.seen_string as Record<string, string>
+      const { type } = params
+      const key = SeenString.normalizeKey(type, params.key)
+      const minHits = await SeenStringService.minHits(params.scan_id)
+      const ttlDays = await SeenStringService.baselineTTLDays(params.scan_id)
+      // the cache only holds strings past the default threshold,
+      // stricter thresholds and the baseline TTL are checked
+      // against the stored string
+      const hit: SeenCacheResponse =
+        minHits > 1 || ttlDays > 0
+          ? { has: false, store: 'none' }
+          : await SeenStringService.cached_view({ type, key })
       if (!hit.has) {
         const dbHit = await SeenStringService.findOne({
           type,
           key,
         })
+        let seen: SeenString
         if (dbHit) {
-          await SeenStringService.update(dbHit.id, { last_cached: new Date() })
-          hit.store = 'database'
-          hit.has = true
+          const expired = SeenStringService.isExpiredBaseline(dbHit, ttlDays)
+          // hit re-baselines expired strings
+          seen = await SeenStringService.recordHit(dbHit.id, expired)
+          if (expired) {
+            metrics().increment('seen_strings.baseline.expired', { type })
+          } else if (seen.hit_count >= minHits) {
+            hit.store = 'database'
+            hit.has = true
+          }
         } else {
-          await SeenStringService.create({
+          seen = await SeenStringService.create({
             type,
             key,
           })
+        }
+        if (seen.hit_count < minHits) {
+          metrics().increment('seen_strings.below_threshold', { type })
+          hit.hit_count = seen.hit_count
+          hit.below_threshold = true
+        } else if (minHits <= 1 && !hit.has) {
           await SeenStringService.cached_write_view({ key, type }, 'database')
         }
       }
@@ -39,7 +67,7 @@ export default AsyncPost({
       description: 'Ok',
       content: {
         'application/json': {
-          schema: cacheViewSchema,
+          schema: seenCacheViewSchema,
         },
       },
     },
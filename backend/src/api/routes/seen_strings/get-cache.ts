@@ -1,8 +1,11 @@
 import { Response, Request, NextFunction } from 'express'
-import { cacheViewParams, cacheViewSchema } from '../../crud/cache'
+import { cacheViewParams } from '../../crud/cache'
 import { AsyncGet } from 'aejo'
 import SeenStringService from '../../../services/seen_string'
+import { SeenString } from '../../../models'
 import { validationErrorResponse } from '../../crud/schemas'
+import { SeenCacheResponse, seenCacheViewSchema } from './schemas'
+import { metrics } from '../../../lib/metrics'
 
 export default AsyncGet({
   tags: ['seen_string'],
@@ -10,16 +13,32 @@ export default AsyncGet({
   parameters: cacheViewParams,
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const { type, key } = req.query as Record<string, string>
-      const hit = await SeenStringService.cached_view({ type, key })
+      const params = req.query as Record<string, string>
+      const { type } = params
+      const key = SeenString.normalizeKey(type, params.key)
+      const minHits = await SeenStringService.minHits()
+      const ttlDays = await SeenStringService.baselineTTLDays()
+      const hit: SeenCacheResponse =
+        minHits > 1 || ttlDays > 0
+          ? { has: false, store: 'none' }
+          : await SeenStringService.cached_view({ type, key })
       if (!hit.has) {
         const dbHit = await SeenStringService.findOne({
           type,
           key,
         })
-        if (dbHit) {
-          hit.store = 'database'
-          hit.has = true
+        const expired =
+          dbHit && SeenStringService.isExpiredBaseline(dbHit, ttlDays)
+        if (expired) {
+          metrics().increment('seen_strings.baseline.expired', { type })
+        } else if (dbHit) {
+          if (dbHit.hit_count >= minHits) {
+            hit.store = 'database'
+            hit.has = true
+          } else {
+            hit.hit_count = dbHit.hit_count
+            hit.below_threshold = true
+          }
           await SeenStringService.update(dbHit.id, { last_cached: new Date() })
         }
       }
@@ -32,7 +51,7 @@ export default AsyncGet({
       description: 'Ok',
       content: {
         'application/json': {
-          schema: cacheViewSchema,
+          schema: seenCacheViewSchema,
         },
       },
     },
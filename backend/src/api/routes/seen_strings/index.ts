@@ -14,6 +14,8 @@ import deleteRoute from './delete'
 import createRoute from './create'
 import getCacheRoute from './get-cache'
 import cacheRoute from './cache'
+import batchCacheRoute from './batch-cache'
+import recordBatchRoute from './record-batch'
 
 export default (router: Router): { paths: PathItem[]; router: Router } =>
   Route(
@@ -21,6 +23,8 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
     Path('/', AdminScope(listRoute), AdminScope(createRoute)),
     Path('/distinct', AuthScope(distinctRoute)),
     Path('/_cache', TransportScope(cacheRoute), TransportScope(getCacheRoute)),
+    Path('/_cache/_batch', TransportScope(batchCacheRoute)),
+    Path('/_record/_batch', TransportScope(recordBatchRoute)),
     Path(
       `/:id(${uuidFormat})`,
       AdminScope(viewRoute),
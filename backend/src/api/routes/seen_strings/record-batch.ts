@@ -0,0 +1,42 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPost } from 'aejo'
+import { seenStringRecordBody } from './schemas'
+import SeenStringService from '../../../services/seen_string'
+import { validationErrorResponse } from '../../crud/schemas'
+
+export default AsyncPost({
+  tags: ['seen_string'],
+  description:
+    'Records hits of several keys of a type at once (creates unknown keys)',
+  requestBody: seenStringRecordBody,
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const params = req.body.seen_strings as { type: string; keys: string[] }
+      const recorded = await SeenStringService.bulkRecord(
+        params.type,
+        params.keys
+      )
+      res.status(200).send({ recorded })
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              recorded: {
+                description: 'Number of distinct keys recorded',
+                type: 'integer',
+              },
+            },
+          },
+        },
+      },
+    },
+    '422': validationErrorResponse,
+  },
+})
@@ -1,4 +1,5 @@
-import { MediaSchema } from 'aejo'
+import { MediaSchema, ParamSchema } from 'aejo'
+import { cacheViewSchema, CacheResponse } from '../../crud/cache'
 import { Schema } from '../../../models/seen_strings'
 
 export const seenStringBody: MediaSchema = {
@@ -25,6 +26,105 @@ export const seenStringBody: MediaSchema = {
   },
 }
 
+export const seenStringCacheBody: MediaSchema = {
+  description: 'Seen String cache lookup',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: {
+          seen_string: {
+            type: 'object',
+            properties: {
+              type: Schema.type,
+              key: Schema.key,
+              scan_id: {
+                description: 'Scan the string was seen in (site thresholds)',
+                type: 'string',
+                format: 'uuid',
+              },
+            },
+            required: ['type', 'key'],
+            additionalProperties: false,
+          },
+        },
+        required: ['seen_string'],
+        additionalProperties: false,
+      },
+    },
+  },
+}
+
+// keys per batch lookup
+export const MAX_BATCH_KEYS = 500
+
+export const seenStringBatchBody: MediaSchema = {
+  description: 'Seen String batch cache lookup',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: {
+          seen_strings: {
+            type: 'object',
+            properties: {
+              type: Schema.type,
+              keys: {
+                type: 'array',
+                items: Schema.key,
+                minItems: 1,
+                maxItems: MAX_BATCH_KEYS,
+              },
+              scan_id: {
+                description: 'Scan the strings were seen in (site thresholds)',
+                type: 'string',
+                format: 'uuid',
+              },
+            },
+            required: ['type', 'keys'],
+            additionalProperties: false,
+          },
+        },
+        required: ['seen_strings'],
+        additionalProperties: false,
+      },
+    },
+  },
+}
+
+// hits per bulk record request, repeated keys included
+export const MAX_RECORD_KEYS = 5000
+
+export const seenStringRecordBody: MediaSchema = {
+  description: 'Seen String hits to record',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: {
+          seen_strings: {
+            type: 'object',
+            properties: {
+              type: Schema.type,
+              keys: {
+                description: 'Seen keys, once per hit',
+                type: 'array',
+                items: Schema.key,
+                minItems: 1,
+                maxItems: MAX_RECORD_KEYS,
+              },
+            },
+            required: ['type', 'keys'],
+            additionalProperties: false,
+          },
+        },
+        required: ['seen_strings'],
+        additionalProperties: false,
+      },
+    },
+  },
+}
+
 export const seenStringResponse: MediaSchema = {
   description: 'OK',
   content: {
@@ -36,3 +136,29 @@ export const seenStringResponse: MediaSchema = {
     },
   },
 }
+
+export type SeenCacheResponse = CacheResponse & {
+  hit_count?: number
+  below_threshold?: boolean
+  alert_once?: boolean
+}
+
+export const seenCacheViewSchema: ParamSchema = {
+  ...cacheViewSchema,
+  properties: {
+    ...(cacheViewSchema.properties as Record<string, ParamSchema>),
+    hit_count: {
+      type: 'integer',
+      description: 'Times the string was seen',
+    },
+    below_threshold: {
+      type: 'boolean',
+      description: 'Seen fewer times than required to suppress alerts',
+    },
+    alert_once: {
+      type: 'boolean',
+      description:
+        'Domain already alerted for the site of the scan (alert-once window)',
+    },
+  },
+}
@@ -0,0 +1,40 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncDelete } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import { keyParams } from './schemas'
+import SettingService from '../../../services/setting'
+
+export default AsyncDelete({
+  tags: ['settings'],
+  description: 'Reset organization setting to the config default',
+  parameters: [keyParams],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              total: {
+                type: 'integer',
+                description: 'Number of settings removed',
+              },
+            },
+          },
+        },
+      },
+    },
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const total = await SettingService.reset(
+        req.params.key,
+        req.session.data.lanid
+      )
+      res.status(200).send({ total })
+      next()
+    },
+  ],
+})
@@ -0,0 +1,20 @@
+import { Router } from 'express'
+import { AuthPathOp, Scope, PathItem, Path, Route } from 'aejo'
+import { Authorized } from '../../middleware/auth'
+
+import listRoute from './list'
+import updateRoute from './update'
+import deleteRoute from './delete'
+
+const AdminScope = AuthPathOp(Scope(Authorized, 'admin'))
+
+export default (router: Router): { paths: PathItem[]; router: Router } =>
+  Route(
+    router,
+    Path('/', AdminScope(listRoute)),
+    Path(
+      '/:key([A-Za-z0-9_.]+)',
+      AdminScope(updateRoute),
+      AdminScope(deleteRoute)
+    )
+  )
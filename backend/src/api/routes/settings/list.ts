@@ -0,0 +1,29 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { settingView } from './schemas'
+import SettingService from '../../../services/setting'
+
+export default AsyncGet({
+  tags: ['settings'],
+  description: 'List organization settings',
+  middleware: [
+    async (_req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const settings = await SettingService.list()
+      res.status(200).send(settings)
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'array',
+            items: settingView,
+          },
+        },
+      },
+    },
+  },
+})
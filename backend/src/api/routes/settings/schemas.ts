@@ -0,0 +1,52 @@
+import { MediaSchema, ParamSchema, PathParam } from 'aejo'
+import { Schema } from '../../../models/settings'
+
+export const keyParams = PathParam({
+  name: 'key',
+  description: 'Setting key',
+  schema: {
+    type: 'string',
+  },
+})
+
+export const settingView: ParamSchema = {
+  type: 'object',
+  properties: {
+    key: Schema.key,
+    description: {
+      type: 'string',
+      description: 'Setting description',
+    },
+    schema: {
+      type: 'object',
+      description: 'JSON schema of the setting value',
+    },
+    default: {
+      ...Schema.value,
+      description: 'Config file default',
+    },
+    value: {
+      ...Schema.value,
+      description: 'Organization value',
+      nullable: true,
+    },
+    effective: {
+      ...Schema.value,
+      description: 'Value in use',
+    },
+    updated_by: Schema.updated_by,
+    updated_at: Schema.updated_at,
+  },
+}
+
+export const settingResponse: MediaSchema = {
+  description: 'Ok',
+  content: {
+    'application/json': {
+      schema: {
+        type: 'object',
+        properties: Schema,
+      },
+    },
+  },
+}
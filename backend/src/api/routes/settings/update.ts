@@ -0,0 +1,49 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncPut } from 'aejo'
+import { validationErrorResponse } from '../../crud/schemas'
+import { Schema } from '../../../models/settings'
+import { keyParams, settingResponse } from './schemas'
+import SettingService from '../../../services/setting'
+
+export default AsyncPut({
+  tags: ['settings'],
+  description: 'Update organization setting',
+  parameters: [keyParams],
+  requestBody: {
+    description: 'Setting Object',
+    content: {
+      'application/json': {
+        schema: {
+          type: 'object',
+          properties: {
+            setting: {
+              type: 'object',
+              properties: {
+                value: Schema.value,
+              },
+              required: ['value'],
+              additionalProperties: false,
+            },
+          },
+          required: ['setting'],
+          additionalProperties: false,
+        },
+      },
+    },
+  },
+  responses: {
+    '200': settingResponse,
+    '422': validationErrorResponse,
+  },
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const updated = await SettingService.update(
+        req.params.key,
+        req.body.setting.value,
+        req.session.data.lanid
+      )
+      res.status(200).send(updated)
+      next()
+    },
+  ],
+})
@@ -10,13 +10,19 @@ export default AsyncPost({
   requestBody: siteBody,
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const created = await SiteService.create(req.body.site)
+      const created = await SiteService.create(
+        req.body.site,
+        req.session.data.lanid
+      )
       res.status(200).send(created)
       next()
     },
   ],
   responses: {
     '200': siteResponse,
+    '409': {
+      description: 'Site name already exists',
+    },
     '422': validationErrorResponse,
   },
 })
@@ -29,7 +29,10 @@ export default AsyncDelete({
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const deleted = await SiteService.destroy(req.params.id)
+      const deleted = await SiteService.destroy(
+        req.params.id,
+        req.session.data.lanid
+      )
       res.status(200).send({ total: deleted })
       next()
     },
@@ -11,6 +11,9 @@ import createRoute from './create'
 import updateRoute from './update'
 import viewRoute from './view'
 import deleteRoute from './delete'
+import summaryRoute from './summary'
+import scanStatsRoute from './scan-stats'
+import scheduleRoute from './schedule'
 
 export default (router: Router): { paths: PathItem[]; router: Router } =>
   Route(
@@ -21,5 +24,8 @@ export default (router: Router): { paths: PathItem[]; router: Router } =>
       UserScope(viewRoute),
       AdminScope(updateRoute),
       AdminScope(deleteRoute)
-    )
+    ),
+    Path(`/:id(${uuidFormat})/summary`, UserScope(summaryRoute)),
+    Path(`/:id(${uuidFormat})/scan_stats`, UserScope(scanStatsRoute)),
+    Path(`/:id(${uuidFormat})/schedule`, UserScope(scheduleRoute))
   )
@@ -0,0 +1,47 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { uuidParams } from '../../crud/schemas'
+import SiteService from '../../../services/site'
+import ScanService from '../../../services/scan'
+import { ScanStates } from '../../../models/scans'
+
+export default AsyncGet({
+  tags: ['sites'],
+  description: 'Number of scans by state for a Site',
+  parameters: [uuidParams],
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      await SiteService.view(req.params.id)
+      const counts = await ScanService.stateCounts(req.params.id)
+      res.status(200).json(counts)
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: ScanStates.reduce(
+              (acc, state) => {
+                acc[state] = {
+                  description: `Number of ${state} scans`,
+                  type: 'integer',
+                }
+                return acc
+              },
+              {
+                total: { description: 'Number of scans', type: 'integer' },
+              } as Record<string, { description: string; type: string }>
+            ),
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+  },
+})
@@ -0,0 +1,53 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet } from 'aejo'
+import { uuidParams } from '../../crud/schemas'
+import SiteService from '../../../services/site'
+
+export default AsyncGet({
+  tags: ['sites'],
+  description: 'Next run of a Site in the display time zone',
+  parameters: [uuidParams],
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      const site = await SiteService.view(req.params.id)
+      const schedule = await SiteService.schedule(site)
+      res.status(200).json(schedule)
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              last_run: {
+                type: 'string',
+                format: 'date-time',
+                nullable: true,
+              },
+              next_run: {
+                description: 'Next run (UTC)',
+                type: 'string',
+                format: 'date-time',
+              },
+              time_zone: {
+                description: 'Display time zone',
+                type: 'string',
+              },
+              next_run_local: {
+                description: 'Next run in the display time zone',
+                type: 'string',
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+  },
+})
@@ -27,6 +27,17 @@ export const siteBody: MediaSchema = {
               active: Schema.active,
               source_id: Schema.source_id,
               run_every_minutes: Schema.run_every_minutes,
+              overrun_policy: Schema.overrun_policy,
+              alert_ttl_minutes: Schema.alert_ttl_minutes,
+              unknown_domain_severity: Schema.unknown_domain_severity,
+              seen_min_hits: Schema.seen_min_hits,
+              seen_baseline_ttl_days: Schema.seen_baseline_ttl_days,
+              priority: Schema.priority,
+              rules_config: Schema.rules_config,
+              ioc_exceptions: Schema.ioc_exceptions,
+              untrusted_suffixes: Schema.untrusted_suffixes,
+              baseline_until: Schema.baseline_until,
+              target_url: Schema.target_url,
             },
             required: ['name', 'active', 'source_id', 'run_every_minutes'],
             additionalProperties: false,
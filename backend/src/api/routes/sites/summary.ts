@@ -0,0 +1,95 @@
+import { Request, Response, NextFunction } from 'express'
+import { AsyncGet, QueryParam, Integer } from 'aejo'
+import { uuidParams, validationErrorResponse } from '../../crud/schemas'
+import SiteService from '../../../services/site'
+import ScanService from '../../../services/scan'
+
+export default AsyncGet({
+  tags: ['sites'],
+  description: 'Rule alert totals across recent completed scans of a Site',
+  parameters: [
+    uuidParams,
+    QueryParam({
+      name: 'limit',
+      description: 'number of recent completed scans to aggregate',
+      schema: Integer({ minimum: 1, maximum: 100 }),
+    }),
+  ],
+  middleware: [
+    async (req: Request, res: Response, next: NextFunction): Promise<void> => {
+      await SiteService.view(req.params.id)
+      const limit =
+        typeof req.query.limit === 'string'
+          ? parseInt(req.query.limit, 10)
+          : undefined
+      const summary = await ScanService.siteSummary(req.params.id, limit)
+      res.status(200).json(summary)
+      next()
+    },
+  ],
+  responses: {
+    '200': {
+      description: 'Ok',
+      content: {
+        'application/json': {
+          schema: {
+            type: 'object',
+            properties: {
+              scans: {
+                description: 'Number of completed scans aggregated',
+                type: 'integer',
+              },
+              totalAlerts: {
+                description: 'Number of alerts',
+                type: 'integer',
+              },
+              rules: {
+                description: 'Number of alerts by rule',
+                type: 'object',
+                additionalProperties: { type: 'integer' },
+              },
+              unknownDomains: {
+                description: 'Number of unknown domain alerts',
+                type: 'integer',
+              },
+              belowSeenThreshold: {
+                description:
+                  'Number of unknown domain alerts below the seen threshold',
+                type: 'integer',
+              },
+              iocMatches: {
+                description: 'Number of IOC domain alerts',
+                type: 'integer',
+              },
+              scriptHashChanges: {
+                description: 'Number of known scripts with a changed hash',
+                type: 'integer',
+              },
+              exfilAlerts: {
+                description: 'Number of payloads sent to unknown domains',
+                type: 'integer',
+              },
+              targetDrift: {
+                description: 'Landing URL compared to the site target URL',
+                type: 'object',
+                properties: {
+                  target_url: { type: 'string', nullable: true },
+                  last_url: { type: 'string', nullable: true },
+                  runs: {
+                    description: 'Consecutive scans away from the target',
+                    type: 'integer',
+                  },
+                  drifting: { type: 'boolean' },
+                },
+              },
+            },
+          },
+        },
+      },
+    },
+    '404': {
+      description: 'Not Found',
+    },
+    '422': validationErrorResponse,
+  },
+})
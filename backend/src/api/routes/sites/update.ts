@@ -14,11 +14,18 @@ export default AsyncPut({
     '404': {
       description: 'Not Found',
     },
+    '409': {
+      description: 'Site name already exists',
+    },
     '422': validationErrorResponse,
   },
   middleware: [
     async (req: Request, res: Response, next: NextFunction): Promise<void> => {
-      const updated = await SiteService.update(req.params.id, req.body.site)
+      const updated = await SiteService.update(
+        req.params.id,
+        req.body.site,
+        req.session.data.lanid
+      )
       res.status(200).send(updated)
       next()
     },
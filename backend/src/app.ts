@@ -8,12 +8,24 @@ import app from './express-boot'
 import https from 'https'
 import fs from 'fs'
 import { redisClient } from './repos/redis'
+import { knex } from './models'
+import { checkSchema } from './lib/schema'
 
 const RedisStore = connectRedis(expressSession)
 
 import logger from './loaders/logger'
 
 async function startServer() {
+  // fail fast instead of erroring on missing tables / columns later
+  if (config.postgres.checkMigrations) {
+    try {
+      await checkSchema(knex)
+    } catch (e) {
+      logger.error(e.message)
+      process.exit(1)
+    }
+  }
+
   const web = app({
     app: express(),
     middleware: expressSession({
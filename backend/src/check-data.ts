@@ -0,0 +1,23 @@
+// usage: yarn check-data [--fix] [--json]
+import { knex } from './models'
+import DataCheckService from './services/data_check'
+
+;(async () => {
+  const issues = await DataCheckService.check()
+  const fix = process.argv.includes('--fix')
+  const fixed = fix && issues.length ? await DataCheckService.fix(issues) : null
+  if (process.argv.includes('--json')) {
+    console.log(JSON.stringify({ issues, fixed }))
+  } else {
+    issues.forEach((i) => {
+      console.log(`${i.table}\t${i.problem}\t${i.id}\t${i.type}\t${i.detail}`)
+    })
+    console.log(`${issues.length} issues found`)
+    if (fixed) {
+      console.log(`${fixed.deleted} entries deleted, ${fixed.updated} normalized`)
+    }
+  }
+  await knex.destroy()
+  // unresolved issues fail the command
+  process.exit(issues.length && !fix ? 1 : 0)
+})()
@@ -0,0 +1,66 @@
+// usage: yarn list-dead-letter [--type sink] [--limit 100] [--json]
+//        yarn replay-dead-letter --job-id <delivery id> [--actor login]
+import os from 'os'
+import { knex } from './models'
+import AlertService from './services/alert'
+import AlertDeliveryService from './services/alert_delivery'
+
+const flag = (name: string, fallback: string): string => {
+  const idx = process.argv.indexOf(`--${name}`)
+  return idx >= 0 && process.argv[idx + 1] ? process.argv[idx + 1] : fallback
+}
+
+const list = async (): Promise<number> => {
+  const limit = parseInt(flag('limit', '100'), 10)
+  if (!(limit > 0)) {
+    console.error('usage: list-dead-letter [--type sink] [--limit 100] [--json]')
+    return 2
+  }
+  const deliveries = await AlertDeliveryService.listDeadLettered({
+    sink: flag('type', '') || undefined,
+    limit,
+  })
+  if (process.argv.includes('--json')) {
+    console.log(JSON.stringify({ deliveries }))
+  } else {
+    deliveries.forEach((d) => {
+      const error = d.response?.error || ''
+      console.log(
+        `${d.id}\t${d.sink}\t${d.created_at.toISOString()}\t${d.alert_id || '-'}\t${error}`
+      )
+    })
+    console.log(`${deliveries.length} dead-lettered deliveries`)
+  }
+  return 0
+}
+
+const replay = async (): Promise<number> => {
+  const id = flag('job-id', '')
+  if (!id) {
+    console.error('usage: replay-dead-letter --job-id <delivery id> [--actor login]')
+    return 2
+  }
+  const actor = flag('actor', os.userInfo().username)
+  const result = await AlertService.replay(id, actor)
+  if (process.argv.includes('--json')) {
+    console.log(JSON.stringify(result))
+  } else if (result.delivered) {
+    console.log(`${id} replayed to ${result.sink}`)
+  } else {
+    console.log(`${id} replay to ${result.sink} failed: ${result.error}`)
+  }
+  // failed replays are dead-lettered again
+  return result.delivered ? 0 : 1
+}
+
+;(async () => {
+  let code: number
+  try {
+    code = process.argv[2] === 'replay' ? await replay() : await list()
+  } catch (e) {
+    console.error(e.message)
+    code = 1
+  }
+  await knex.destroy()
+  process.exit(code)
+})()
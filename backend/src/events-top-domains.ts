@@ -0,0 +1,29 @@
+// usage: yarn events-top-domains [--since 7d] [--limit 10] [--json]
+import { knex } from './models'
+import ScanLogService from './services/scan_logs'
+import { parseSince } from './lib/since'
+
+const flag = (name: string, fallback: string): string => {
+  const idx = process.argv.indexOf(`--${name}`)
+  return idx >= 0 && process.argv[idx + 1] ? process.argv[idx + 1] : fallback
+}
+
+;(async () => {
+  const since = parseSince(flag('since', '7d'))
+  const limit = parseInt(flag('limit', '10'), 10)
+  if (since === null || !(limit > 0)) {
+    console.error('usage: events-top-domains [--since 7d] [--limit 10] [--json]')
+    process.exit(2)
+  }
+  const domains = await ScanLogService.topDomains({ since, limit })
+  if (process.argv.includes('--json')) {
+    console.log(JSON.stringify({ since: since.toISOString(), domains }))
+  } else {
+    console.log(`request events since ${since.toISOString()}`)
+    domains.forEach((d) => {
+      console.log(`${d.events}\t${d.sites} sites\t${d.domain}`)
+    })
+  }
+  await knex.destroy()
+  process.exit(0)
+})()
@@ -0,0 +1,31 @@
+// usage: yarn export-audit-log [--since 30d] [--actor login]
+//                              [--entity-type site] [--entity-id id]
+// prints one JSON entry per line, oldest first
+import { knex } from './models'
+import AuditService from './services/audit'
+import { parseSince } from './lib/since'
+
+const flag = (name: string, fallback: string): string => {
+  const idx = process.argv.indexOf(`--${name}`)
+  return idx >= 0 && process.argv[idx + 1] ? process.argv[idx + 1] : fallback
+}
+
+;(async () => {
+  const since = parseSince(flag('since', '30d'))
+  if (since === null) {
+    console.error(
+      'usage: export-audit-log [--since 30d] [--actor login] ' +
+        '[--entity-type site] [--entity-id id]'
+    )
+    process.exit(2)
+  }
+  const entries = await AuditService.list({
+    since,
+    actor: flag('actor', '') || undefined,
+    entity_type: flag('entity-type', '') || undefined,
+    entity_id: flag('entity-id', '') || undefined,
+  })
+  entries.forEach((entry) => console.log(JSON.stringify(entry)))
+  await knex.destroy()
+  process.exit(0)
+})()
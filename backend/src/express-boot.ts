@@ -1,8 +1,10 @@
-import express, { Request, Response, NextFunction, Express } from 'express'
+import { Request, Response, NextFunction, Express } from 'express'
 
 import ErrorMiddlewareHandler from './api/middleware/error-handler'
 import ObjectionErrorHandler from './api/middleware/objection-errors'
 import AejoErrorHandler from './api/middleware/aejo-errors'
+import CorsMiddleware from './api/middleware/cors'
+import JsonBodyLimit from './api/middleware/body-limit'
 
 import logger from './loaders/logger'
 import routes from './api'
@@ -34,11 +36,14 @@ function server(opts: {
   const { app } = opts
   app.enable('trust proxy')
 
+  // JSON API only, preflight requests are answered before the session
+  app.use('/api', CorsMiddleware())
+
   if (opts.middleware) {
     app.use(opts.middleware)
   }
 
-  app.use(express.json())
+  app.use(JsonBodyLimit())
 
   // inject transport session values
   if (opts.middlewareSession) {
@@ -0,0 +1,131 @@
+// usage: yarn fire-http-alert [--sink goAlert] [--name n] [--message m]
+//                             [--details d] [--type info|warning|error]
+//        yarn fire-http-alert --file alerts.json [--concurrency 4]
+// both print `--format text` (default) or `json`
+import fs from 'fs'
+import { knex } from './models'
+import AlertService, { AlertSpec, FireResult } from './services/alert'
+
+const flag = (name: string, fallback: string): string => {
+  const idx = process.argv.indexOf(`--${name}`)
+  return idx >= 0 && process.argv[idx + 1] ? process.argv[idx + 1] : fallback
+}
+
+/**
+ * readSpecs
+ *
+ * Alert specs of a JSON file, an array of objects
+ * (e.g. `[{ "sink": "teams", "message": "test" }]`)
+ */
+export const readSpecs = (path: string): AlertSpec[] => {
+  const specs = JSON.parse(fs.readFileSync(path, 'utf8'))
+  if (!Array.isArray(specs) || specs.some((s) => typeof s !== 'object')) {
+    throw new Error(`${path}: expected an array of alerts`)
+  }
+  return specs
+}
+
+export type ErrorCategory =
+  | 'disabled'
+  | 'timeout'
+  | 'network'
+  | 'http'
+  | 'template'
+  | 'other'
+
+// node-fetch system errors
+const NETWORK_ERROR = /ECONNREFUSED|ENOTFOUND|ECONNRESET|EAI_AGAIN|request to .* failed/
+
+/**
+ * errorCategory
+ *
+ * Coarse cause of a failed delivery, from its error message
+ */
+export const errorCategory = (error: string): ErrorCategory => {
+  if (/is not enabled/.test(error)) return 'disabled'
+  if (/timeout|timed out/i.test(error)) return 'timeout'
+  if (/responded with \d{3}/.test(error)) return 'http'
+  if (/template/i.test(error)) return 'template'
+  if (NETWORK_ERROR.test(error)) return 'network'
+  return 'other'
+}
+
+/**
+ * formatResults
+ *
+ * Tab separated lines and a summary (`text`), or a JSON document
+ * of the outcomes (`json`)
+ */
+export const formatResults = (
+  results: FireResult[],
+  format: 'text' | 'json' = 'text'
+): string => {
+  const failed = results.filter((r) => !r.delivered).length
+  if (format === 'json') {
+    return JSON.stringify({
+      results: results.map((r) => ({
+        index: r.index,
+        sink: r.sink,
+        status: r.delivered ? 'delivered' : 'failed',
+        latency_ms: r.latency_ms,
+        ...(r.error
+          ? { error: r.error, error_category: errorCategory(r.error) }
+          : {}),
+      })),
+      delivered: results.length - failed,
+      failed,
+    })
+  }
+  return results
+    .map((r) =>
+      r.delivered
+        ? `#${r.index}\t${r.sink}\tdelivered\t${r.latency_ms}ms`
+        : `#${r.index}\t${r.sink}\tfailed\t${r.latency_ms}ms\t${r.error}`
+    )
+    .concat(`${results.length - failed} delivered / ${failed} failed`)
+    .join('\n')
+}
+
+const run = async (): Promise<number> => {
+  const format = flag('format', 'text')
+  if (format !== 'text' && format !== 'json') {
+    console.error('usage: fire-http-alert [--format text|json]')
+    return 2
+  }
+  const file = flag('file', '')
+  let results: FireResult[]
+  if (file) {
+    const concurrency = parseInt(flag('concurrency', '1'), 10)
+    if (!(concurrency > 0)) {
+      console.error('usage: fire-http-alert --file alerts.json [--concurrency 4]')
+      return 2
+    }
+    results = await AlertService.fireBatch(readSpecs(file), { concurrency })
+  } else {
+    results = [
+      await AlertService.fire({
+        sink: flag('sink', 'goAlert'),
+        type: flag('type', 'info') as AlertSpec['type'],
+        name: flag('name', 'manual-alert'),
+        message: flag('message', 'manual alert'),
+        details: flag('details', ''),
+      }),
+    ]
+  }
+  console.log(formatResults(results, format))
+  return results.some((r) => !r.delivered) ? 1 : 0
+}
+
+if (require.main === module) {
+  ;(async () => {
+    let code: number
+    try {
+      code = await run()
+    } catch (e) {
+      console.error(e.message)
+      code = 1
+    }
+    await knex.destroy()
+    process.exit(code)
+  })()
+}
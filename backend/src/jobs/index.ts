@@ -1,22 +1,38 @@
 import { config } from 'node-config-ts'
 import { createClient } from '../repos/redis'
 import logger from '../loaders/logger'
-import SiteService from '../services/site'
-import ScanService from '../services/scan'
+import SchedulerService from '../services/scheduler'
+import ScanService, { PENDING_RULES_KEY } from '../services/scan'
 import SourceService from '../services/source'
 import AlertService from '../services/alert'
 import ScanLogService from '../services/scan_logs'
 import SeenStringService from '../services/seen_string'
+import IocService from '../services/ioc'
+import AllowListService from '../services/allow_list'
+import ScanLogArchiveService from '../services/scan_log_archive'
+import AlertDependencyService from '../services/alert_dependency'
+import SecretRefreshService from '../services/secret_refresh'
 
 import Queues from './queues'
+import { describeAttempt } from '../lib/attempts'
+import { metrics } from '../lib/metrics'
+import { GracefulStop } from '../lib/graceful-stop'
 
 import { EventEmitter } from 'events'
 
 EventEmitter.defaultMaxListeners = 15
 
 const redisClient = createClient()
+const stats = metrics()
 
 Queues.scannerEventQueue.process(ScanLogService.work)
+// alert jobs held by a scan log job are promoted once it finished
+Queues.scannerEventQueue.on('completed', ScanLogService.releaseHeldBy)
+Queues.scannerEventQueue.on('failed', ScanLogService.releaseHeldBy)
+// held alert jobs listed with their dependency in the queue stats
+const HELD_ALERTS_SHOWN = 20
+// queue stats reporting, cleared on shutdown
+let statsInterval: NodeJS.Timeout
 ;(async () => {
 
   logger.info('Syncing source cache')
@@ -30,20 +46,40 @@ Queues.scannerEventQueue.process(ScanLogService.work)
     Queues.scannerQueue.empty()
   }
   Queues.localQueue.empty()
-  setInterval(async () => {
+  statsInterval = setInterval(async () => {
     const sQueue = await Queues.scannerQueue.count()
     const ssCount = await Queues.scannerScheduler.count()
     const sECount = await Queues.scannerEventQueue.count()
+    const ruleJobs = await Queues.ruleQueue.getJobCounts()
+    const awaiting = await ScanService.awaitingRules(
+      await redisClient.hgetall(PENDING_RULES_KEY)
+    )
+    const heldAlerts = await AlertDependencyService.listHeld()
+    const maxWait = await ScanService.maxWaitSeconds()
+    stats.gauge(
+      'rules.jobs.pending',
+      ruleJobs.waiting + ruleJobs.active + ruleJobs.delayed
+    )
+    stats.gauge('scans.awaiting_rules', awaiting.scans)
+    stats.gauge('scans.awaiting_rules.events', awaiting.events)
+    stats.gauge('alerts.held', heldAlerts.length)
+    stats.gauge('scans.max_wait_seconds.scheduled', maxWait.scheduled)
+    stats.gauge('scans.max_wait_seconds.test', maxWait.test)
     await redisClient.set(
       'job-queue',
       JSON.stringify({
         schedule: sQueue,
         event: sECount,
-        scanner: sQueue
+        scanner: sQueue,
+        awaiting_rules: awaiting.scans,
+        awaiting_rule_events: awaiting.events,
+        held_alerts: heldAlerts.length,
+        held_alert_jobs: heldAlerts.slice(0, HELD_ALERTS_SHOWN),
+        max_wait_seconds: maxWait
       })
     )
     logger.info(
-      `Schedule Count ${ssCount} / Event Queue ${sECount} / Scanner Queue ${sQueue}`
+      `Schedule Count ${ssCount} / Event Queue ${sECount} / Scanner Queue ${sQueue} / Awaiting Rules ${awaiting.scans}`
     )
   }, 5000)
 })()
@@ -81,6 +117,66 @@ Queues.localQueue.add(
   }
 )
 
+Queues.localQueue.add(
+  'scanner-idle-check',
+  { run: 1 },
+  {
+    // check running scans for event progress every minute
+    repeat: { cron: '* * * * *' },
+    removeOnComplete: true
+  }
+)
+
+Queues.localQueue.add(
+  'scanLogs-archive',
+  { run: 1 },
+  {
+    // move old event payloads to object storage every hour at :30
+    repeat: { cron: '30 * * * *' },
+    removeOnComplete: true
+  }
+)
+
+Queues.localQueue.add(
+  'alerts-release-held',
+  { run: 1 },
+  {
+    // release alert jobs of finished scan log jobs every minute
+    repeat: { cron: '* * * * *' },
+    removeOnComplete: true
+  }
+)
+
+Queues.localQueue.add(
+  'secrets-refresh',
+  { run: 1 },
+  {
+    // refresh qt secrets, verifying the value rotated
+    repeat: { cron: config.secrets.refresh.cron },
+    removeOnComplete: true
+  }
+)
+
+Queues.localQueue.add(
+  'iocs-expire',
+  { run: 1 },
+  {
+    // disable expired IOCs every 5 minutes
+    repeat: { cron: '*/5 * * * *' },
+    removeOnComplete: true
+  }
+)
+
+Queues.localQueue.add(
+  'allowList-expired-purge',
+  { run: 1 },
+  {
+    // delete long expired allow list entries everyday at 03:00
+    repeat: { cron: '0 3 * * *' },
+    removeOnComplete: true
+  }
+)
+
 // Update job states
 Queues.scannerQueue.on('global:active', async jobId => {
   const job = await Queues.scannerQueue.getJob(jobId)
@@ -111,7 +207,12 @@ Queues.scannerQueue.on('global:completed', async jobId => {
 
 Queues.scannerQueue.on('global:failed', async jobId => {
   const job = await Queues.scannerQueue.getJob(jobId)
-  await ScanService.updateState(job.data.scan_id, 'failed', job.failedReason)
+  const { label } = describeAttempt(job.attemptsMade, job.opts.attempts)
+  await ScanService.updateState(
+    job.data.scan_id,
+    'failed',
+    `${job.failedReason} (${label})`
+  )
   if (job.data.test) {
     return
   }
@@ -121,7 +222,7 @@ Queues.scannerQueue.on('global:failed', async jobId => {
       entry: 'error',
       scan_id: job.data.scan_id,
       event: {
-        message: `${job.data.name}/${job.name} - ${job.failedReason}`
+        message: `${job.data.name}/${job.name} - ${job.failedReason} (${label})`
       }
     },
     {
@@ -131,14 +232,25 @@ Queues.scannerQueue.on('global:failed', async jobId => {
   )
 })
 
-// purge scans 14 days or older, and test scans 6 hours and older
+// purge archived events past `deleteAfterDays`, scans past retention
+// (14 days by default, longer for retained event types) and test
+// scans 6 hours and older
 Queues.localQueue.process('scanner-daily-purge', async () => {
-  await ScanService.purge(14)
+  // object store failures must not hold back scan retention
+  try {
+    await ScanLogArchiveService.purgeArchived()
+  } catch (e) {
+    logger.error({
+      task: 'scanner-daily-purge',
+      action: 'purge archived scan logs',
+      error: e.message
+    })
+  }
+  await ScanService.purge(config.scans.retention.days)
   await ScanService.purgeTests(6)
 })
 
-// six months
-const MAX_SEEN_STRING_DAYS = 30 * 6
+const MAX_SEEN_STRING_DAYS = config.seenStrings.retentionDays
 
 Queues.localQueue.process('seenStrings-daily-purge', async () => {
   logger.info(`Running daily seenString purge (${MAX_SEEN_STRING_DAYS} days)`)
@@ -156,20 +268,45 @@ Queues.localQueue.process('scanner-hourly-purge', () =>
   ScanService.findAndExpire(60)
 )
 
+Queues.localQueue.process('scanner-idle-check', async () => {
+  const res = await ScanService.findAndFailIdle()
+  if (res.flagged || res.failed) {
+    logger.info(
+      `Idle scans: ${res.flagged} flagged / ${res.failed} failed / ${res.retried} retried / ${res.cleared} cleared`
+    )
+  }
+})
+
+Queues.localQueue.process('scanLogs-archive', () =>
+  ScanLogArchiveService.archive()
+)
+
+Queues.localQueue.process('alerts-release-held', () =>
+  AlertDependencyService.releaseHeld()
+)
+
+Queues.localQueue.process('secrets-refresh', async () => {
+  const totals = await SecretRefreshService.refreshAll()
+  if (Object.keys(totals).length) {
+    logger.info({ task: 'secrets-refresh', ...totals })
+  }
+})
+
+// secrets with their own `refresh_interval_minutes`
+Queues.localQueue.process('secret-refresh', job =>
+  SecretRefreshService.refreshScheduled(job.data.secret_id)
+)
+
+Queues.localQueue.process('iocs-expire', () => IocService.expire())
+
+Queues.localQueue.process('allowList-expired-purge', () =>
+  AllowListService.purgeExpired(config.allowList.expiredRetentionDays)
+)
+
 /** Add scans ready to run to the queue */
 Queues.scannerScheduler.process(async (_job, done) => {
   try {
-    const totalSched = await ScanService.totalScheduled()
-    if (totalSched > 20) {
-      // attempt to prevent backfill
-      logger.warn(`Too many scehduled ${totalSched}, trying again later`)
-      return done()
-    }
-    const runnable = await SiteService.getRunnable()
-    logger.debug('found runnable', runnable)
-    for (let i = 0; i < runnable.length; i += 1) {
-      await ScanService.schedule(Queues.scannerQueue, { site: runnable[i] })
-    }
+    await SchedulerService.timedTick(Queues.scannerQueue)
     done()
   } catch (e) {
     done(e)
@@ -180,14 +317,93 @@ Queues.scannerScheduler.on('completed', job => {
   logger.debug('completed', job.data)
 })
 
-Queues.alertQueue.process(async (job, done) => {
+// jobs are taken in queue order, each keeps its own lock
+// renewed by bull until done
+Queues.alertQueue.process(
+  config.alerts.delivery.concurrency || 1,
+  async (job, done) => {
+    try {
+      // held jobs of a pending scan log job are queued again
+      if (await AlertDependencyService.ready(job)) {
+        await AlertService.process(job.data)
+      }
+      done()
+    } catch (e) {
+      done(e)
+    }
+  }
+)
+
+Queues.alertRedeliveryQueue.process(async (job, done) => {
   try {
-    await AlertService.process(job.data)
+    await AlertService.redeliver(job.data)
     done()
   } catch (e) {
     done(e)
   }
 })
 
+// failed delivery attempts, queued with their backoff delay
+Queues.alertRetryQueue.process(
+  config.alerts.delivery.concurrency || 1,
+  async (job, done) => {
+    try {
+      await AlertService.retry(job.data)
+      done()
+    } catch (e) {
+      done(e)
+    }
+  }
+)
+
 // Remove old scans on startup
 ScanService.findAndExpire(60)
+
+// shutdown, the scheduler stops enqueuing scans before workers
+// drain, and workers drain before the reaper (idle / expiry
+// checks) stops, so nothing is re-enqueued or reaped mid-drain.
+// local pauses wait for active jobs
+const gracefulStop = new GracefulStop()
+gracefulStop.register('scanner-scheduler', 'scheduler', () =>
+  Queues.scannerScheduler.pause(true)
+)
+gracefulStop.register('scan-log-worker', 'workers', () =>
+  Queues.scannerEventQueue.pause(true)
+)
+gracefulStop.register('alert-worker', 'workers', () =>
+  Queues.alertQueue.pause(true)
+)
+gracefulStop.register('alert-redelivery-worker', 'workers', () =>
+  Queues.alertRedeliveryQueue.pause(true)
+)
+gracefulStop.register('alert-retry-worker', 'workers', () =>
+  Queues.alertRetryQueue.pause(true)
+)
+gracefulStop.register('reaper', 'reaper', () => Queues.localQueue.pause(true))
+// stats read the queues and redis, closed by the next stage
+gracefulStop.register('queue-stats', 'reaper', async () =>
+  clearInterval(statsInterval)
+)
+gracefulStop.register('queues', 'queues', async () => {
+  await Promise.all(
+    [
+      Queues.scannerScheduler,
+      Queues.scannerQueue,
+      Queues.scannerEventQueue,
+      Queues.alertQueue,
+      Queues.alertRedeliveryQueue,
+      Queues.alertRetryQueue,
+      Queues.localQueue,
+      Queues.qtSecretRefresh,
+      Queues.ruleQueue
+    ].map(queue => queue.close())
+  )
+  await redisClient.quit()
+})
+
+process.once('SIGTERM', async () => {
+  logger.info('SIGTERM received, stopping background services')
+  await gracefulStop.stop()
+  logger.info('background services stopped')
+  process.exit(0)
+})
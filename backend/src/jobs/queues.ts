@@ -1,6 +1,12 @@
 import Queue from 'bull'
 import MerryMaker from '@merrymaker/types'
 import { createClient } from '../repos/redis'
+import {
+  AlertQueueEvent,
+  AlertRedeliveryJob,
+  AlertRetryJob,
+} from '../alerts/base'
+import { PendingRuleJob } from '../services/scan'
 
 const redisClient = createClient()
 const redisSubscriber = createClient()
@@ -36,7 +42,24 @@ const qtSecretRefresh = new Queue('qt-secret-refresh', {
   createClient,
 })
 
-const alertQueue = new Queue<MerryMaker.EventResult>('alert-queue', {
+const alertQueue = new Queue<AlertQueueEvent>('alert-queue', {
+  createClient,
+})
+
+const alertRedeliveryQueue = new Queue<AlertRedeliveryJob>(
+  'alert-redelivery-queue',
+  {
+    createClient,
+  }
+)
+
+// failed delivery attempts, added with their backoff delay
+const alertRetryQueue = new Queue<AlertRetryJob>('alert-retry-queue', {
+  createClient,
+})
+
+// processed by the scanner, only inspected here
+const ruleQueue = new Queue<PendingRuleJob>('rule-queue', {
   createClient,
 })
 
@@ -47,4 +70,7 @@ export default {
   scannerEventQueue,
   qtSecretRefresh,
   alertQueue,
+  alertRedeliveryQueue,
+  alertRetryQueue,
+  ruleQueue,
 }
@@ -0,0 +1,158 @@
+/**
+ * Self-contained renderings of a single alert for tickets / email
+ *
+ * HTML output uses inline styles only (no external assets)
+ */
+import { Alert } from '../models'
+
+export type AlertExportFormat = 'html' | 'md'
+
+export type AlertDetailView = {
+  id: string
+  rule: string
+  message: string
+  severity: string | null
+  created_at: string
+  site: { id: string; name: string } | null
+  scan_id: string | null
+  // flattened context, [key, value]
+  context: Array<[string, string]>
+  links: { alert: string; scan?: string; site?: string }
+}
+
+const formatValue = (value: unknown): string =>
+  typeof value === 'string' ? value : JSON.stringify(value)
+
+/**
+ * buildAlertView
+ *
+ * Alert detail view model shared by the export formats
+ */
+export const buildAlertView = (
+  alert: Alert & { site?: { id: string; name: string } },
+  baseURL: string
+): AlertDetailView => ({
+  id: alert.id,
+  rule: alert.rule,
+  message: alert.message,
+  severity: alert.severity || null,
+  created_at: new Date(alert.created_at).toISOString(),
+  site: alert.site ? { id: alert.site.id, name: alert.site.name } : null,
+  scan_id: alert.scan_id || null,
+  context: Object.keys(alert.context || {})
+    .sort()
+    .map((key) => [key, formatValue(alert.context[key])]),
+  links: {
+    alert: `${baseURL}/alerts?id=${alert.id}`,
+    scan: alert.scan_id ? `${baseURL}/scans/${alert.scan_id}` : undefined,
+    site: alert.site_id ? `${baseURL}/site/${alert.site_id}` : undefined,
+  },
+})
+
+const escapeHTML = (value: string): string =>
+  value
+    .replace(/&/g, '&amp;')
+    .replace(/</g, '&lt;')
+    .replace(/>/g, '&gt;')
+    .replace(/"/g, '&quot;')
+    .replace(/'/g, '&#39;')
+
+const cell = 'padding:4px 8px;border:1px solid #ddd;text-align:left;'
+
+/**
+ * renderHTML
+ *
+ * Renders the alert as a standalone HTML document
+ */
+export const renderHTML = (view: AlertDetailView): string => {
+  const rows: Array<[string, string]> = [
+    ['Rule', view.rule],
+    ['Severity', view.severity || 'n/a'],
+    ['Created', view.created_at],
+    ['Site', view.site ? view.site.name : 'n/a'],
+    ['Scan', view.scan_id || 'n/a'],
+  ]
+  const table = (entries: Array<[string, string]>) =>
+    entries
+      .map(
+        ([k, v]) =>
+          `<tr><th style="${cell}background:#f5f5f5;">${escapeHTML(
+            k
+          )}</th><td style="${cell}font-family:monospace;word-break:break-all;">${escapeHTML(
+            v
+          )}</td></tr>`
+      )
+      .join('\n')
+  const links = Object.entries(view.links)
+    .filter(([, href]) => href !== undefined)
+    .map(
+      ([name, href]) =>
+        `<li><a href="${escapeHTML(href)}" style="color:#1565c0;">${escapeHTML(
+          name
+        )}</a></li>`
+    )
+    .join('\n')
+  return `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Alert ${escapeHTML(view.id)}</title>
+</head>
+<body style="font-family:Arial,Helvetica,sans-serif;font-size:14px;color:#212121;">
+<h2 style="margin:0 0 8px 0;">${escapeHTML(view.message)}</h2>
+<table style="border-collapse:collapse;margin-bottom:16px;">
+${table(rows)}
+</table>
+<h3 style="margin:0 0 8px 0;">Context</h3>
+<table style="border-collapse:collapse;margin-bottom:16px;">
+${table(view.context)}
+</table>
+<ul style="padding-left:16px;">
+${links}
+</ul>
+</body>
+</html>
+`
+}
+
+const escapeMarkdown = (value: string): string =>
+  value.replace(/([\\`*_{}[\]()#+!|<>])/g, '\\$1').replace(/\r?\n/g, ' ')
+
+/**
+ * renderMarkdown
+ *
+ * Renders the alert as Markdown
+ */
+export const renderMarkdown = (view: AlertDetailView): string => {
+  const row = ([k, v]: [string, string]) =>
+    `| ${escapeMarkdown(k)} | ${escapeMarkdown(v)} |`
+  const lines = [
+    `## ${escapeMarkdown(view.message)}`,
+    '',
+    '| Field | Value |',
+    '| --- | --- |',
+    row(['Rule', view.rule]),
+    row(['Severity', view.severity || 'n/a']),
+    row(['Created', view.created_at]),
+    row(['Site', view.site ? view.site.name : 'n/a']),
+    row(['Scan', view.scan_id || 'n/a']),
+    '',
+    '### Context',
+    '',
+    '| Key | Value |',
+    '| --- | --- |',
+    ...view.context.map(row),
+    '',
+    ...Object.entries(view.links)
+      .filter(([, href]) => href !== undefined)
+      .map(([name, href]) => `- [${name}](${href})`),
+    '',
+  ]
+  return lines.join('\n')
+}
+
+export default {
+  buildAlertView,
+  renderHTML,
+  renderMarkdown,
+}
@@ -0,0 +1,36 @@
+export type AttemptView = {
+  // current attempt (1-based)
+  attempt: number
+  // total attempts allowed, including the first one
+  maxAttempts: number
+  retriesAllowed: number
+  label: string
+}
+
+/**
+ * describeAttempt
+ *
+ * Display values for a job attempt. `maxAttempts` follows the Bull
+ * `attempts` option (total runs, 0 or unset means a single run) and
+ * `attemptsMade` the Bull job counter
+ *
+ *   describeAttempt(1, 3).label // "attempt 1 of 3"
+ *   describeAttempt(1, 1).label // "attempt 1 of 1 (no retries)"
+ */
+export const describeAttempt = (
+  attemptsMade: number,
+  maxAttempts?: number
+): AttemptView => {
+  const max = Math.max(1, maxAttempts || 1)
+  const attempt = Math.min(Math.max(1, attemptsMade || 1), max)
+  const retriesAllowed = max - 1
+  let label = `attempt ${attempt} of ${max}`
+  if (retriesAllowed === 0) {
+    label += ' (no retries)'
+  }
+  return { attempt, maxAttempts: max, retriesAllowed, label }
+}
+
+export default {
+  describeAttempt,
+}
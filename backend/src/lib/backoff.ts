@@ -0,0 +1,58 @@
+export type BackoffPolicy = {
+  // delay before the first retry
+  baseDelayMs: number
+  // growth of the delay per attempt
+  multiplier: number
+  maxDelayMs: number
+  // fraction (0-1) of the delay randomly taken off, 0 disables jitter
+  jitter: number
+}
+
+/**
+ * backoffDelay
+ *
+ * Delay (ms) before retrying after failed `attempt` (1-based)
+ *
+ *   backoffDelay({ baseDelayMs: 1000, multiplier: 2, maxDelayMs: 5000, jitter: 0 }, 3)
+ *   // 4000
+ */
+export const backoffDelay = (
+  policy: BackoffPolicy,
+  attempt: number,
+  random: () => number = Math.random
+): number => {
+  const base = Math.max(0, policy.baseDelayMs)
+  const multiplier = Math.max(1, policy.multiplier)
+  const delay = Math.min(
+    base * Math.pow(multiplier, Math.max(0, attempt - 1)),
+    Math.max(0, policy.maxDelayMs)
+  )
+  const jitter = Math.min(1, Math.max(0, policy.jitter || 0))
+  return Math.round(delay * (1 - jitter * random()))
+}
+
+/**
+ * resolveBackoff
+ *
+ * Policy with the fields set in `overrides` replacing the defaults,
+ * later overrides win
+ */
+export const resolveBackoff = (
+  defaults: BackoffPolicy,
+  ...overrides: Array<Partial<BackoffPolicy> | undefined>
+): BackoffPolicy =>
+  overrides.reduce<BackoffPolicy>((policy, override) => {
+    if (!override) return policy
+    const res = { ...policy }
+    ;(Object.keys(override) as Array<keyof BackoffPolicy>).forEach((key) => {
+      if (typeof override[key] === 'number') {
+        res[key] = override[key]
+      }
+    })
+    return res
+  }, defaults)
+
+export default {
+  backoffDelay,
+  resolveBackoff,
+}
@@ -0,0 +1,40 @@
+/**
+ * truncationMarker
+ *
+ * Suffix of a string cut to the field limit, with the
+ * number of characters dropped
+ */
+export const truncationMarker = (dropped: number): string =>
+  `…[truncated ${dropped} chars]`
+
+const truncateValue = (value: unknown, maxLength: number): unknown => {
+  if (typeof value === 'string') {
+    return value.length > maxLength
+      ? `${value.slice(0, maxLength)}${truncationMarker(
+          value.length - maxLength
+        )}`
+      : value
+  }
+  if (Array.isArray(value)) {
+    return value.map((v) => truncateValue(v, maxLength))
+  }
+  if (value !== null && typeof value === 'object') {
+    return Object.entries(value).reduce(
+      (acc, [k, v]) => ({ ...acc, [k]: truncateValue(v, maxLength) }),
+      {} as Record<string, unknown>
+    )
+  }
+  return value
+}
+
+/**
+ * truncateContext
+ *
+ * Copy of an alert context with string fields (nested ones
+ * included) longer than `maxLength` cut, keeping a single giant
+ * URL from bloating the alert and its deliveries. 0 disables it
+ */
+export const truncateContext = <T>(context: T, maxLength: number): T => {
+  if (!context || maxLength <= 0) return context
+  return truncateValue(context, maxLength) as T
+}
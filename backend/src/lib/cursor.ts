@@ -0,0 +1,55 @@
+import { OrderByDirection } from 'objection'
+
+/**
+ * Keyset cursor on (`created_at`, `id`)
+ *
+ * Tokens are opaque to clients, they carry the sort direction so
+ * a page keeps its order when followed with other filters unchanged
+ */
+export type Cursor = {
+  created_at: string
+  id: string
+  dir: OrderByDirection
+}
+
+type CursorRow = {
+  id: string
+  created_at: Date | string
+}
+
+/**
+ * encodeCursor
+ *
+ * Opaque token pointing at `row`
+ */
+export const encodeCursor = (
+  row: CursorRow,
+  dir: OrderByDirection = 'desc'
+): string =>
+  Buffer.from(
+    JSON.stringify([new Date(row.created_at).toISOString(), row.id, dir])
+  ).toString('base64')
+
+/**
+ * decodeCursor
+ *
+ * Returns null for malformed tokens
+ */
+export const decodeCursor = (token: string): Cursor | null => {
+  try {
+    const value = JSON.parse(Buffer.from(token, 'base64').toString('utf8'))
+    if (!Array.isArray(value) || value.length !== 3) return null
+    const [createdAt, id, dir] = value
+    if (
+      typeof createdAt !== 'string' ||
+      isNaN(Date.parse(createdAt)) ||
+      typeof id !== 'string' ||
+      !['asc', 'desc'].includes(dir)
+    ) {
+      return null
+    }
+    return { created_at: createdAt, id, dir }
+  } catch (e) {
+    return null
+  }
+}
@@ -0,0 +1,48 @@
+import { domainToASCII } from 'url'
+
+// plain host names, anything else (regex patterns, URLs) is left alone
+const HOST_PATTERN = /^[^\s/\\^$*+?()[\]{}|:]+$/
+
+/**
+ * normalizeDomain
+ *
+ * Lowercases `value` and converts Unicode (IDN) hosts to their
+ * ASCII punycode form so both representations share a key.
+ * lowercase ASCII domains are returned unchanged
+ */
+export const normalizeDomain = (value: string): string => {
+  if (typeof value !== 'string' || !HOST_PATTERN.test(value)) {
+    return value
+  }
+  const host = value.toLowerCase().replace(/\.+$/, '')
+  return domainToASCII(host) || host
+}
+
+/**
+ * isPlainHost
+ *
+ * True for host names without pattern or URL characters
+ */
+export const isPlainHost = (value: string): boolean =>
+  typeof value === 'string' && HOST_PATTERN.test(value)
+
+/**
+ * isValidHost
+ *
+ * True when the plain host `value` converts to a valid ASCII
+ * domain (labels of at most 63 characters)
+ */
+export const isValidHost = (value: string): boolean => {
+  if (!isPlainHost(value)) return false
+  const ascii = domainToASCII(value.toLowerCase().replace(/\.+$/, ''))
+  return (
+    ascii.length > 0 &&
+    ascii.split('.').every((label) => label.length > 0 && label.length <= 63)
+  )
+}
+
+export default {
+  normalizeDomain,
+  isPlainHost,
+  isValidHost,
+}
@@ -0,0 +1,196 @@
+/**
+ * Constrained filter expressions for ScanLog events
+ *
+ * Syntax: one or more comma separated clauses of `path op value`
+ *
+ *   request.url~"/gateway/",response.status>=500
+ *
+ * - path: dot separated keys ([A-Za-z_][A-Za-z0-9_-]*), max depth of 5
+ * - op: `~` (contains), `=`, `!=`, `>`, `>=`, `<`, `<=`
+ * - value: double quoted string, number, true, false
+ */
+import { QueryBuilder, Model } from 'objection'
+
+export const MAX_PATH_DEPTH = 5
+export const MAX_CLAUSES = 10
+
+export type FilterOperator = '~' | '=' | '!=' | '>' | '>=' | '<' | '<='
+
+export type FilterValue = string | number | boolean
+
+export type FilterClause = {
+  path: string[]
+  op: FilterOperator
+  value: FilterValue
+}
+
+export class EventFilterError extends Error {
+  constructor(message: string, public readonly position: number) {
+    super(`${message} (at position ${position})`)
+    Object.setPrototypeOf(this, EventFilterError.prototype)
+  }
+}
+
+const KEY_PATTERN = /^[A-Za-z_][A-Za-z0-9_-]*$/
+const NUMBER_PATTERN = /^-?\d+(\.\d+)?$/
+const OPERATORS: FilterOperator[] = ['>=', '<=', '!=', '~', '=', '>', '<']
+const NUMERIC_OPERATORS: FilterOperator[] = ['>', '>=', '<', '<=']
+
+/**
+ * splitClauses
+ *
+ * splits an expression on commas outside of quoted strings
+ */
+const splitClauses = (expr: string): Array<{ text: string; pos: number }> => {
+  const clauses: Array<{ text: string; pos: number }> = []
+  let inQuote = false
+  let start = 0
+  for (let i = 0; i < expr.length; i += 1) {
+    const c = expr[i]
+    if (inQuote && c === '\\') {
+      i += 1
+    } else if (c === '"') {
+      inQuote = !inQuote
+    } else if (c === ',' && !inQuote) {
+      clauses.push({ text: expr.slice(start, i), pos: start })
+      start = i + 1
+    }
+  }
+  if (inQuote) {
+    throw new EventFilterError('unterminated string', expr.length)
+  }
+  clauses.push({ text: expr.slice(start), pos: start })
+  return clauses
+}
+
+const parseValue = (raw: string, pos: number): FilterValue => {
+  const value = raw.trim()
+  if (value.startsWith('"')) {
+    if (value.length < 2 || !value.endsWith('"')) {
+      throw new EventFilterError('unterminated string', pos)
+    }
+    return value.slice(1, -1).replace(/\\(.)/g, '$1')
+  }
+  if (value === 'true' || value === 'false') {
+    return value === 'true'
+  }
+  if (NUMBER_PATTERN.test(value)) {
+    return parseFloat(value)
+  }
+  throw new EventFilterError(
+    'value must be a quoted string, number or boolean',
+    pos
+  )
+}
+
+const parseClause = (text: string, pos: number): FilterClause => {
+  // find the first operator outside of the path
+  let opIndex = -1
+  let op: FilterOperator
+  for (let i = 0; i < text.length && opIndex === -1; i += 1) {
+    if (text[i] === '"') break
+    const found = OPERATORS.find((o) => text.startsWith(o, i))
+    if (found) {
+      opIndex = i
+      op = found
+    }
+  }
+  if (opIndex === -1) {
+    throw new EventFilterError('missing operator', pos)
+  }
+  const rawPath = text.slice(0, opIndex).trim()
+  if (rawPath.length === 0) {
+    throw new EventFilterError('missing path', pos)
+  }
+  const path = rawPath.split('.')
+  if (path.length > MAX_PATH_DEPTH) {
+    throw new EventFilterError(
+      `path exceeds max depth of ${MAX_PATH_DEPTH}`,
+      pos
+    )
+  }
+  path.forEach((key) => {
+    if (!KEY_PATTERN.test(key)) {
+      throw new EventFilterError(`invalid path key "${key}"`, pos)
+    }
+  })
+  const value = parseValue(text.slice(opIndex + op.length), pos + opIndex)
+  if (NUMERIC_OPERATORS.includes(op) && typeof value !== 'number') {
+    throw new EventFilterError(`"${op}" requires a numeric value`, pos)
+  }
+  if (op === '~' && typeof value !== 'string') {
+    throw new EventFilterError('"~" requires a string value', pos)
+  }
+  return { path, op, value }
+}
+
+/**
+ * parse
+ *
+ * Parses a filter expression into clauses
+ *
+ * Throws EventFilterError on invalid expressions
+ */
+export const parse = (expr: string): FilterClause[] => {
+  if (typeof expr !== 'string' || expr.trim().length === 0) {
+    throw new EventFilterError('empty expression', 0)
+  }
+  const clauses = splitClauses(expr)
+  if (clauses.length > MAX_CLAUSES) {
+    throw new EventFilterError(`more than ${MAX_CLAUSES} clauses`, 0)
+  }
+  return clauses.map(({ text, pos }) => parseClause(text, pos))
+}
+
+// keys are validated against KEY_PATTERN, safe as a text[] literal
+const pathLiteral = (path: string[]): string => `{${path.join(',')}}`
+
+/**
+ * applyClause
+ *
+ * Adds a parameterized jsonb condition on the `event` column
+ */
+export const applyClause = <M extends Model>(
+  builder: QueryBuilder<M, M[]>,
+  clause: FilterClause
+): QueryBuilder<M, M[]> => {
+  const path = pathLiteral(clause.path)
+  const { op, value } = clause
+  if (op === '~') {
+    return builder.whereRaw('strpos(event::jsonb #>> ?::text[], ?) > 0', [
+      path,
+      value,
+    ])
+  }
+  if (typeof value === 'number') {
+    return builder.whereRaw(
+      `CASE WHEN jsonb_typeof(event::jsonb #> ?::text[]) = 'number'
+        THEN (event::jsonb #>> ?::text[])::numeric ${op} ?
+        ELSE false END`,
+      [path, path, value]
+    )
+  }
+  const sqlOp = op === '!=' ? 'IS DISTINCT FROM' : '='
+  return builder.whereRaw(`event::jsonb #>> ?::text[] ${sqlOp} ?`, [
+    path,
+    String(value),
+  ])
+}
+
+/**
+ * applyFilter
+ *
+ * Adds all clauses to the builder (AND)
+ */
+export const applyFilter = <M extends Model>(
+  builder: QueryBuilder<M, M[]>,
+  clauses: FilterClause[]
+): QueryBuilder<M, M[]> => {
+  clauses.forEach((clause) => applyClause(builder, clause))
+  return builder
+}
+
+export default {
+  parse,
+  applyFilter,
+}
@@ -0,0 +1,105 @@
+import { config } from 'node-config-ts'
+import logger from '../loaders/logger'
+
+export type StopFunction = () => Promise<void>
+
+type Registration = {
+  name: string
+  stage: string
+  stop: StopFunction
+}
+
+export type StopResult = {
+  name: string
+  stage: string
+  // stop failed or timed out
+  error?: string
+}
+
+const withTimeout = async (stop: StopFunction, ms: number): Promise<void> => {
+  if (ms <= 0) {
+    return stop()
+  }
+  let timer: NodeJS.Timeout
+  try {
+    await Promise.race([
+      stop(),
+      new Promise<void>((_resolve, reject) => {
+        timer = setTimeout(
+          () => reject(new Error(`timed out after ${ms}ms`)),
+          ms
+        )
+      }),
+    ])
+  } finally {
+    clearTimeout(timer)
+  }
+}
+
+/**
+ * GracefulStop
+ *
+ * Stops registered background services stage by stage, following
+ * `order` (e.g. the scheduler stops enqueuing before workers drain,
+ * workers drain before the reaper stops). Services of a stage stop
+ * concurrently, stages missing from `order` stop last in
+ * registration order. A failing service never blocks the next ones
+ */
+export class GracefulStop {
+  private registrations: Registration[] = []
+
+  constructor(
+    private order: string[] = config.shutdown.order,
+    private timeoutMs: number = config.shutdown.timeoutMs
+  ) {}
+
+  register(name: string, stage: string, stop: StopFunction): void {
+    this.registrations.push({ name, stage, stop })
+  }
+
+  /**
+   * stages
+   *
+   * Registered stages in stop order
+   */
+  stages(): string[] {
+    const registered = Array.from(
+      new Set(this.registrations.map((r) => r.stage))
+    )
+    return this.order
+      .filter((stage) => registered.includes(stage))
+      .concat(registered.filter((stage) => !this.order.includes(stage)))
+  }
+
+  async stop(): Promise<StopResult[]> {
+    const results: StopResult[] = []
+    for (const stage of this.stages()) {
+      const services = this.registrations.filter((r) => r.stage === stage)
+      logger.info({
+        task: 'graceful-stop',
+        stage,
+        services: services.map((s) => s.name),
+      })
+      const stopped = await Promise.all(
+        services.map(async ({ name, stop }) => {
+          try {
+            await withTimeout(stop, this.timeoutMs)
+            return { name, stage }
+          } catch (e) {
+            logger.error({
+              task: 'graceful-stop',
+              stage,
+              service: name,
+              error: e.message,
+            })
+            return { name, stage, error: e.message }
+          }
+        })
+      )
+      results.push(...stopped)
+    }
+    return results
+  }
+}
+
+export default GracefulStop
@@ -0,0 +1,74 @@
+import { config } from 'node-config-ts'
+
+export const MASKED_VALUE = '********'
+
+export type HeaderPolicy = {
+  // when set, only these headers are shown verbatim
+  allow: string[]
+  // always masked
+  mask: string[]
+}
+
+export type HeaderEntry = {
+  name: string
+  value: string
+  masked: boolean
+}
+
+const defaultPolicy = (): HeaderPolicy => config.alerts.delivery.headers
+
+const isMasked = (name: string, policy: HeaderPolicy): boolean => {
+  const key = name.toLowerCase()
+  if (policy.mask.some((h) => h.toLowerCase() === key)) {
+    return true
+  }
+  return (
+    policy.allow.length > 0 &&
+    !policy.allow.some((h) => h.toLowerCase() === key)
+  )
+}
+
+/**
+ * mapToHeaderList
+ *
+ * Sorted header list with sensitive values masked, masked
+ * headers are kept so their presence is still visible
+ */
+export const mapToHeaderList = (
+  headers: Record<string, unknown> | null | undefined,
+  policy: HeaderPolicy = defaultPolicy()
+): HeaderEntry[] =>
+  Object.keys(headers || {})
+    .sort()
+    .map((name) => {
+      const masked = isMasked(name, policy)
+      const value = headers[name]
+      return {
+        name,
+        value: masked
+          ? MASKED_VALUE
+          : Array.isArray(value)
+          ? value.join(', ')
+          : String(value),
+        masked,
+      }
+    })
+
+/**
+ * redactHeaders
+ *
+ * Same as `mapToHeaderList`, keyed by header name
+ */
+export const redactHeaders = (
+  headers: Record<string, unknown> | null | undefined,
+  policy: HeaderPolicy = defaultPolicy()
+): Record<string, string> =>
+  mapToHeaderList(headers, policy).reduce((acc, h) => {
+    acc[h.name] = h.value
+    return acc
+  }, {} as Record<string, string>)
+
+export default {
+  mapToHeaderList,
+  redactHeaders,
+}
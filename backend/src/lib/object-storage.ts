@@ -0,0 +1,173 @@
+import crypto from 'crypto'
+import fetch from 'node-fetch'
+
+export type StorageConfig = {
+  // e.g. https://s3.us-east-1.amazonaws.com or a MinIO URL
+  endpoint: string
+  region: string
+  bucket: string
+  accessKeyID: string
+  secretAccessKey: string
+}
+
+export interface ObjectStorage {
+  put(key: string, body: string): Promise<void>
+  get(key: string): Promise<string>
+  delete(key: string): Promise<void>
+}
+
+export class StorageError extends Error {
+  constructor(message: string, public status?: number) {
+    super(message)
+    this.name = 'StorageError'
+  }
+}
+
+const sha256 = (data: string): string =>
+  crypto.createHash('sha256').update(data).digest('hex')
+
+const hmac = (key: crypto.BinaryLike, data: string): Buffer =>
+  crypto.createHmac('sha256', key).update(data).digest()
+
+// RFC 3986 encoding of each path segment
+const encodePath = (path: string): string =>
+  path
+    .split('/')
+    .map((segment) =>
+      encodeURIComponent(segment).replace(
+        /[!'()*]/g,
+        (c) => `%${c.charCodeAt(0).toString(16).toUpperCase()}`
+      )
+    )
+    .join('/')
+
+export type SignableRequest = {
+  method: string
+  host: string
+  // unencoded, starting with a slash
+  path: string
+  headers?: Record<string, string>
+  body?: string
+}
+
+/**
+ * signRequest
+ *
+ * AWS Signature Version 4 headers of an S3 request (host,
+ * x-amz-date, x-amz-content-sha256 and authorization)
+ */
+export const signRequest = (
+  req: SignableRequest,
+  storage: Pick<StorageConfig, 'region' | 'accessKeyID' | 'secretAccessKey'>,
+  now: Date = new Date()
+): Record<string, string> => {
+  const amzDate = now.toISOString().replace(/[:-]|\.\d{3}/g, '')
+  const dateStamp = amzDate.substring(0, 8)
+  const payloadHash = sha256(req.body || '')
+  const headers: Record<string, string> = {
+    ...req.headers,
+    host: req.host,
+    'x-amz-content-sha256': payloadHash,
+    'x-amz-date': amzDate,
+  }
+  const names = Object.keys(headers)
+    .map((name) => name.toLowerCase())
+    .sort()
+  const lowered = Object.entries(headers).reduce(
+    (acc, [name, value]) => ({ ...acc, [name.toLowerCase()]: value }),
+    {} as Record<string, string>
+  )
+  const signedHeaders = names.join(';')
+  const canonicalRequest = [
+    req.method,
+    encodePath(req.path),
+    '',
+    names.map((name) => `${name}:${lowered[name].trim()}\n`).join(''),
+    signedHeaders,
+    payloadHash,
+  ].join('\n')
+  const scope = `${dateStamp}/${storage.region}/s3/aws4_request`
+  const stringToSign = [
+    'AWS4-HMAC-SHA256',
+    amzDate,
+    scope,
+    sha256(canonicalRequest),
+  ].join('\n')
+  const signingKey = ['s3', 'aws4_request'].reduce(
+    (key, part) => hmac(key, part),
+    hmac(hmac(`AWS4${storage.secretAccessKey}`, dateStamp), storage.region)
+  )
+  const signature = hmac(signingKey, stringToSign).toString('hex')
+  return {
+    ...headers,
+    authorization: `AWS4-HMAC-SHA256 Credential=${storage.accessKeyID}/${scope}, SignedHeaders=${signedHeaders}, Signature=${signature}`,
+  }
+}
+
+/**
+ * S3Storage
+ *
+ * Minimal client of S3 compatible storage, objects are addressed
+ * path-style (`endpoint/bucket/key`)
+ */
+export class S3Storage implements ObjectStorage {
+  constructor(private storage: StorageConfig) {}
+
+  private async request(
+    method: string,
+    key: string,
+    body?: string
+  ): Promise<string> {
+    const url = new URL(this.storage.endpoint)
+    const path = `${url.pathname.replace(/\/$/, '')}/${
+      this.storage.bucket
+    }/${key}`
+    const headers = signRequest(
+      {
+        method,
+        host: url.host,
+        path,
+        body,
+        headers:
+          body === undefined ? {} : { 'content-type': 'application/json' },
+      },
+      this.storage
+    )
+    const res = await fetch(`${url.origin}${encodePath(path)}`, {
+      method,
+      body,
+      headers,
+    })
+    const text = await res.text()
+    if (!res.ok) {
+      throw new StorageError(
+        `${method} ${key} responded with ${res.status}`,
+        res.status
+      )
+    }
+    return text
+  }
+
+  async put(key: string, body: string): Promise<void> {
+    await this.request('PUT', key, body)
+  }
+
+  async get(key: string): Promise<string> {
+    return this.request('GET', key)
+  }
+
+  async delete(key: string): Promise<void> {
+    try {
+      await this.request('DELETE', key)
+    } catch (e) {
+      // already gone
+      if (e instanceof StorageError && e.status === 404) return
+      throw e
+    }
+  }
+}
+
+export default {
+  S3Storage,
+  signRequest,
+}
@@ -0,0 +1,90 @@
+import fs from 'fs'
+import path from 'path'
+import { Knex } from 'knex'
+
+export const MIGRATIONS_DIR = path.join(__dirname, '..', 'migrations')
+const MIGRATIONS_TABLE = 'knex_migrations'
+
+// pending migrations listed in the error
+const MAX_LISTED = 5
+
+export class SchemaOutdatedError extends Error {
+  constructor(public pending: string[]) {
+    super(
+      `database schema is missing ${pending.length} migration(s) ` +
+        `(${pending.slice(0, MAX_LISTED).join(', ')}` +
+        `${pending.length > MAX_LISTED ? ', ...' : ''}) ` +
+        '- run migrations (yarn migrate)'
+    )
+    this.name = 'SchemaOutdatedError'
+  }
+}
+
+// migrations are named `<timestamp>_<name>.(ts|js)`, applied ones
+// are recorded with the extension of the build that ran them
+const migrationName = (file: string): string => file.replace(/\.(ts|js)$/, '')
+
+/**
+ * shippedMigrations
+ *
+ * Names (without extension) of the migrations shipped in `dir`
+ */
+export const shippedMigrations = (dir: string = MIGRATIONS_DIR): string[] =>
+  fs
+    .readdirSync(dir)
+    .filter((f) => /^\d+_.+\.(ts|js)$/.test(f) && !f.endsWith('.d.ts'))
+    .map(migrationName)
+    .sort()
+
+/**
+ * appliedMigrations
+ *
+ * Names (without extension) of the migrations applied to the
+ * database, empty when migrations never ran
+ */
+export const appliedMigrations = async (db: Knex): Promise<string[]> => {
+  if (!(await db.schema.hasTable(MIGRATIONS_TABLE))) {
+    return []
+  }
+  const rows: Array<{ name: string }> = await db(MIGRATIONS_TABLE).select(
+    'name'
+  )
+  return rows.map((r) => migrationName(r.name)).sort()
+}
+
+/**
+ * pendingMigrations
+ *
+ * Shipped migrations not applied to the database, including
+ * older ones skipped while newer ones ran
+ */
+export const pendingMigrations = async (
+  db: Knex,
+  dir: string = MIGRATIONS_DIR
+): Promise<string[]> => {
+  const applied = new Set(await appliedMigrations(db))
+  return shippedMigrations(dir).filter((name) => !applied.has(name))
+}
+
+/**
+ * checkSchema
+ *
+ * Rejects with `SchemaOutdatedError` when a migration shipped with
+ * this build is not applied. Migrations of newer builds are accepted
+ */
+export const checkSchema = async (
+  db: Knex,
+  dir: string = MIGRATIONS_DIR
+): Promise<void> => {
+  const pending = await pendingMigrations(db, dir)
+  if (pending.length > 0) {
+    throw new SchemaOutdatedError(pending)
+  }
+}
+
+export default {
+  checkSchema,
+  appliedMigrations,
+  pendingMigrations,
+  shippedMigrations,
+}
@@ -0,0 +1,136 @@
+import fetch from 'node-fetch'
+
+// secret fields read by providers
+export type SecretRef = {
+  id?: string
+  name: string
+  // location of the value in the provider (e.g. a Vault path)
+  provider_ref?: string | null
+}
+
+/**
+ * SecretProvider
+ *
+ * Source of refreshed secret values
+ */
+export interface SecretProvider {
+  name: string
+  enabled: boolean
+  // current value of `ref`, null when the source has none
+  fetch(ref: SecretRef): Promise<string | null>
+  // values only change when edited at the source, an identical
+  // value is expected and not recorded as `unchanged`
+  static?: boolean
+}
+
+/**
+ * ProviderTokenError
+ *
+ * The provider credentials were rejected or could not be renewed,
+ * kept apart from errors of a single secret
+ */
+export class ProviderTokenError extends Error {
+  constructor(message: string, public status?: number) {
+    super(message)
+    this.name = 'ProviderTokenError'
+  }
+}
+
+export type VaultConfig = {
+  enabled: boolean
+  // e.g. https://vault.example.com:8200
+  address: string
+  token: string
+  // KV version 2 mount
+  path: string
+  // renew the token before reads, once half of its lease is used
+  renewToken: boolean
+}
+
+type Fetch = typeof fetch
+
+/**
+ * VaultProvider
+ *
+ * Reads secrets of a Vault KV version 2 engine. References are
+ * `<path>#<field>` below the mount, the field defaults to `value`
+ */
+export class VaultProvider implements SecretProvider {
+  name = 'vault'
+  static = true
+  // no renewal before (ms since epoch), set from the token lease
+  private renewAt = 0
+
+  constructor(private vault: VaultConfig, private request: Fetch = fetch) {}
+
+  get enabled(): boolean {
+    return !!this.vault.enabled
+  }
+
+  private url(path: string): string {
+    return `${this.vault.address.replace(/\/$/, '')}/v1/${path}`
+  }
+
+  private headers(): Record<string, string> {
+    return { 'X-Vault-Token': this.vault.token }
+  }
+
+  /**
+   * renew
+   *
+   * Extends the lease of the configured token, a rejected renewal
+   * throws `ProviderTokenError`. The next renewal is due once half
+   * of the new lease is used, tokens without a lease are renewed
+   * before every read
+   */
+  async renew(now: number = Date.now()): Promise<void> {
+    const res = await this.request(this.url('auth/token/renew-self'), {
+      method: 'POST',
+      headers: this.headers(),
+    })
+    if (!res.ok) {
+      throw new ProviderTokenError(
+        `vault token renewal failed, responded with ${res.status}`,
+        res.status
+      )
+    }
+    const body = await res.json().catch(() => null)
+    const lease = body?.auth?.lease_duration
+    this.renewAt = lease > 0 ? now + (lease * 1000) / 2 : 0
+  }
+
+  async fetch(ref: SecretRef): Promise<string | null> {
+    if (!ref.provider_ref) {
+      throw new Error(`secret ${ref.name} has no vault path`)
+    }
+    const [path, field = 'value'] = ref.provider_ref.split('#')
+    const now = Date.now()
+    if (this.vault.renewToken && now >= this.renewAt) {
+      await this.renew(now)
+    }
+    const mount = this.vault.path.replace(/^\/|\/$/g, '')
+    const res = await this.request(
+      this.url(`${mount}/data/${path.replace(/^\//, '')}`),
+      { headers: this.headers() }
+    )
+    if (res.status === 403) {
+      throw new ProviderTokenError(
+        'vault token rejected, responded with 403',
+        res.status
+      )
+    }
+    if (res.status === 404) {
+      return null
+    }
+    if (!res.ok) {
+      throw new Error(`vault read of ${path} responded with ${res.status}`)
+    }
+    const body = await res.json()
+    const value = body?.data?.data?.[field]
+    return typeof value === 'string' ? value : null
+  }
+}
+
+export default {
+  VaultProvider,
+}
@@ -0,0 +1,62 @@
+import crypto from 'crypto'
+
+export type SigningPolicy = {
+  // signing is disabled when empty
+  secret: string
+  // HMAC digest, e.g. sha256
+  algorithm: string
+  header: string
+  // unix time (seconds) the signature was made at
+  timestampHeader: string
+}
+
+/**
+ * signPayload
+ *
+ * Hex HMAC of `timestamp.body`, receivers reject stale timestamps
+ * to prevent replays
+ *
+ *   signPayload('secret', 'sha256', 1664784000, 'body')
+ *   // 'sha256=...'
+ */
+export const signPayload = (
+  secret: string,
+  algorithm: string,
+  timestamp: number,
+  body: string
+): string =>
+  `${algorithm}=${crypto
+    .createHmac(algorithm, secret)
+    .update(`${timestamp}.${body}`)
+    .digest('hex')}`
+
+/**
+ * signatureHeaders
+ *
+ * Signature and timestamp headers of `body`, none when
+ * the policy has no secret
+ */
+export const signatureHeaders = (
+  policy: Partial<SigningPolicy> | undefined,
+  body: string,
+  now: Date = new Date()
+): Record<string, string> => {
+  if (!policy || !policy.secret) {
+    return {}
+  }
+  const timestamp = Math.floor(now.getTime() / 1000)
+  return {
+    [policy.header || 'X-MMK-Signature']: signPayload(
+      policy.secret,
+      policy.algorithm || 'sha256',
+      timestamp,
+      body
+    ),
+    [policy.timestampHeader || 'X-MMK-Timestamp']: String(timestamp),
+  }
+}
+
+export default {
+  signPayload,
+  signatureHeaders,
+}
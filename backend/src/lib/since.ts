@@ -0,0 +1,27 @@
+// relative windows, e.g. `7d`, `24h` or `30m`
+const RELATIVE = /^(\d+)([dhm])$/
+
+const UNIT_MS: Record<string, number> = {
+  d: 24 * 60 * 60 * 1000,
+  h: 60 * 60 * 1000,
+  m: 60 * 1000,
+}
+
+/**
+ * parseSince
+ *
+ * Resolves the start of a `--since` / `since` window, either relative
+ * to `now` (`7d`, `24h`, `30m`) or an ISO date. Null when invalid
+ */
+export const parseSince = (value: string, now = new Date()): Date | null => {
+  const match = RELATIVE.exec(value || '')
+  if (match) {
+    return new Date(now.getTime() - parseInt(match[1], 10) * UNIT_MS[match[2]])
+  }
+  const date = new Date(value)
+  return Number.isNaN(date.getTime()) ? null : date
+}
+
+export default {
+  parseSince,
+}
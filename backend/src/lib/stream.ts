@@ -0,0 +1,111 @@
+import { Writable } from 'stream'
+
+// compression middleware adds `flush` to the response
+type FlushableWritable = Writable & { flush?: () => void }
+
+export class StreamClosedError extends Error {
+  constructor() {
+    super('stream closed before all rows were written')
+    this.name = 'StreamClosedError'
+  }
+}
+
+/**
+ * drained
+ *
+ * Resolves once `out` drains, rejects when it closes (client gone)
+ * or errors first so callers stop fetching rows nobody reads
+ */
+const drained = (out: Writable): Promise<void> =>
+  new Promise((resolve, reject) => {
+    const done = (err?: Error) => {
+      out.off('drain', onDrain)
+      out.off('close', onClose)
+      out.off('error', onError)
+      if (err) {
+        reject(err)
+      } else {
+        resolve()
+      }
+    }
+    const onDrain = () => done()
+    const onClose = () => done(new StreamClosedError())
+    const onError = (err: Error) => done(err)
+    out.on('drain', onDrain)
+    out.on('close', onClose)
+    out.on('error', onError)
+  })
+
+const write = async (out: FlushableWritable, chunk: string): Promise<void> => {
+  if (out.destroyed) {
+    throw new StreamClosedError()
+  }
+  if (!out.write(chunk)) {
+    await drained(out)
+  }
+  if (typeof out.flush === 'function') {
+    out.flush()
+  }
+}
+
+/**
+ * writeJSONList
+ *
+ * Streams a `{ total, results }` list response to `out`
+ *
+ * The header (total) is written before the first batch is fetched,
+ * each batch from `nextBatch` is flushed as soon as it resolves and
+ * the closing brackets are written once `nextBatch` returns an
+ * empty array. Resolves with the number of rows written
+ */
+export const writeJSONList = async (
+  out: FlushableWritable,
+  opts: {
+    total: number
+    nextBatch: () => Promise<unknown[]>
+  }
+): Promise<number> => {
+  await write(out, `{"total":${opts.total},"results":[`)
+  let written = 0
+  for (;;) {
+    const batch = await opts.nextBatch()
+    if (batch.length === 0) break
+    const rows = batch.map((row) => JSON.stringify(row)).join(',')
+    await write(out, `${written ? ',' : ''}${rows}`)
+    written += batch.length
+  }
+  out.end(']}')
+  return written
+}
+
+/**
+ * writeNDJSON
+ *
+ * Streams rows from `nextBatch` to `out` as newline-delimited JSON,
+ * one flush per batch. `out` is ended once `nextBatch` returns an
+ * empty array, `beforeEnd` runs just before (e.g. to add trailers).
+ * Resolves with the number of rows written
+ */
+export const writeNDJSON = async (
+  out: FlushableWritable,
+  nextBatch: () => Promise<unknown[]>,
+  beforeEnd?: (written: number) => void
+): Promise<number> => {
+  let written = 0
+  for (;;) {
+    const batch = await nextBatch()
+    if (batch.length === 0) break
+    await write(out, batch.map((row) => `${JSON.stringify(row)}\n`).join(''))
+    written += batch.length
+  }
+  if (beforeEnd) {
+    beforeEnd(written)
+  }
+  out.end()
+  return written
+}
+
+export default {
+  writeJSONList,
+  writeNDJSON,
+}
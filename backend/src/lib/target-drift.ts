@@ -0,0 +1,71 @@
+import { parseDomain, ParseResultType } from 'parse-domain'
+
+export type DriftReason = 'domain' | 'path'
+
+export type TargetComparison = {
+  drift: boolean
+  reason: DriftReason | null
+}
+
+/**
+ * registrableDomain
+ *
+ * eTLD+1 of `hostname` (`shop.example.co.uk` -> `example.co.uk`).
+ * Hosts missing from the public suffix list are returned as-is
+ */
+export const registrableDomain = (hostname: string): string => {
+  const host = hostname.toLowerCase().replace(/\.+$/, '')
+  const res = parseDomain(host)
+  if (res.type !== ParseResultType.Listed || !res.domain) {
+    return host
+  }
+  return [res.domain, ...res.topLevelDomains].join('.')
+}
+
+const isWeb = (url: URL): boolean =>
+  ['http:', 'https:'].includes(url.protocol) && url.hostname.length > 0
+
+const pathSegments = (pathname: string): string[] =>
+  pathname.split('/').filter((s) => s.length > 0)
+
+/**
+ * compareTarget
+ *
+ * Compares the URL a scan ended on (`actual`) to the site target.
+ * Subdomain redirects of the same registrable domain are not drift,
+ * the target path must stay a (segment) prefix of the actual path.
+ * URLs that do not parse (or are not http) are never reported as drift
+ */
+export const compareTarget = (
+  target: string,
+  actual: string
+): TargetComparison => {
+  let targetURL: URL
+  let actualURL: URL
+  try {
+    targetURL = new URL(target)
+    actualURL = new URL(actual)
+  } catch (e) {
+    return { drift: false, reason: null }
+  }
+  if (!isWeb(targetURL) || !isWeb(actualURL)) {
+    return { drift: false, reason: null }
+  }
+  if (
+    registrableDomain(targetURL.hostname) !==
+    registrableDomain(actualURL.hostname)
+  ) {
+    return { drift: true, reason: 'domain' }
+  }
+  const targetPath = pathSegments(targetURL.pathname)
+  const actualPath = pathSegments(actualURL.pathname)
+  if (targetPath.some((segment, i) => actualPath[i] !== segment)) {
+    return { drift: true, reason: 'path' }
+  }
+  return { drift: false, reason: null }
+}
+
+export default {
+  compareTarget,
+  registrableDomain,
+}
@@ -0,0 +1,142 @@
+/**
+ * Minimal body templates of alert sinks
+ *
+ *   {"text": {{ summary | json }}, "scan": "{{ scan_url }}"}
+ *
+ * `{{ path }}` inserts a dot separated field (objects as JSON, missing
+ * fields as ''), the `json` filter inserts the JSON encoded value so
+ * strings can be embedded in JSON bodies. Templates of JSON bodies
+ * escape unfiltered fields (`jsonEscape`)
+ */
+export type Template = (data: Record<string, unknown>) => string
+
+// escapes inserted text, unfiltered fields only
+export type Escape = (value: string) => string
+
+export class TemplateError extends Error {
+  constructor(message: string) {
+    super(message)
+    this.name = 'TemplateError'
+  }
+}
+
+const PATH_RE = /^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$/
+
+const FILTERS: Record<string, (value: unknown) => string> = {
+  json: (value) => JSON.stringify(value === undefined ? null : value),
+}
+
+/**
+ * jsonEscape
+ *
+ * `value` escaped for a JSON string, a field inside quotes cannot
+ * end the string or add members
+ */
+export const jsonEscape: Escape = (value) => JSON.stringify(value).slice(1, -1)
+
+const text = (value: unknown): string => {
+  if (value === undefined || value === null) return ''
+  if (typeof value === 'object') return JSON.stringify(value)
+  return String(value)
+}
+
+const lookup = (data: Record<string, unknown>, path: string[]): unknown =>
+  path.reduce(
+    (value: unknown, key) =>
+      value !== null && typeof value === 'object'
+        ? (value as Record<string, unknown>)[key]
+        : undefined,
+    data
+  )
+
+/**
+ * compileTemplate
+ *
+ * Parses `source`, throws a TemplateError for unclosed tags, invalid
+ * paths or unknown filters. Unfiltered fields are passed to `escape`
+ */
+export const compileTemplate = (
+  source: string,
+  escape: Escape = (value) => value
+): Template => {
+  const parts: Array<string | { path: string[]; filter?: string }> = []
+  let pos = 0
+  while (pos < source.length) {
+    const open = source.indexOf('{{', pos)
+    if (open === -1) {
+      parts.push(source.slice(pos))
+      break
+    }
+    const close = source.indexOf('}}', open + 2)
+    if (close === -1) {
+      throw new TemplateError(`unclosed tag at ${open}`)
+    }
+    parts.push(source.slice(pos, open))
+    const [expr, filter, ...rest] = source
+      .slice(open + 2, close)
+      .split('|')
+      .map((s) => s.trim())
+    if (!PATH_RE.test(expr)) {
+      throw new TemplateError(`invalid field "${expr}" at ${open}`)
+    }
+    if (rest.length || (filter !== undefined && !(filter in FILTERS))) {
+      throw new TemplateError(`unknown filter "${filter}" at ${open}`)
+    }
+    parts.push({ path: expr.split('.'), filter })
+    pos = close + 2
+  }
+  return (data) =>
+    parts
+      .map((part) => {
+        if (typeof part === 'string') return part
+        const value = lookup(data, part.path)
+        return part.filter
+          ? FILTERS[part.filter](value)
+          : escape(text(value))
+      })
+      .join('')
+}
+
+/**
+ * optionalTemplate
+ *
+ * Compiled `source`, undefined when empty (sinks use their
+ * default body)
+ */
+export const optionalTemplate = (
+  source: string | undefined,
+  name: string,
+  escape?: Escape
+): Template | undefined => {
+  if (!source) return undefined
+  try {
+    return compileTemplate(source, escape)
+  } catch (e) {
+    throw new TemplateError(`${name} body template: ${e.message}`)
+  }
+}
+
+/**
+ * jsonTemplate
+ *
+ * `optionalTemplate` of a JSON body, fields are JSON escaped. Throws
+ * when `sample` does not render to JSON, so broken templates fail
+ * when the sink is configured rather than on each alert
+ */
+export const jsonTemplate = (
+  source: string | undefined,
+  name: string,
+  sample: Record<string, unknown>
+): Template | undefined => {
+  const template = optionalTemplate(source, name, jsonEscape)
+  if (template) {
+    try {
+      JSON.parse(template(sample))
+    } catch (e) {
+      throw new TemplateError(
+        `${name} body template renders invalid JSON (${e.message})`
+      )
+    }
+  }
+  return template
+}
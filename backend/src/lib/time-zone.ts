@@ -0,0 +1,111 @@
+// Display time zone helpers, stored times stay UTC
+
+export type ZonedTime = {
+  // 0 (Sunday) - 6
+  day: number
+  // minutes since local midnight
+  minutes: number
+}
+
+/**
+ * TimeWindow
+ *
+ * Daily window in local `HH:mm` time, windows with `start` after
+ * `end` span midnight (`22:00` - `06:00`). `days` limits the days
+ * the window starts on (0 = Sunday), all days when empty
+ */
+export type TimeWindow = {
+  start: string
+  end: string
+  days?: number[]
+}
+
+const weekdays = ['Sun', 'Mon', 'Tue', 'Wed', 'Thu', 'Fri', 'Sat']
+
+/**
+ * isTimeZone
+ *
+ * IANA time zone name check (`America/Chicago`, `UTC`)
+ */
+export const isTimeZone = (tz: string): boolean => {
+  try {
+    new Intl.DateTimeFormat('en-US', { timeZone: tz })
+    return true
+  } catch (e) {
+    return false
+  }
+}
+
+/**
+ * zonedTime
+ *
+ * Local day of week and time of `date` in `tz`
+ */
+export const zonedTime = (date: Date, tz: string): ZonedTime => {
+  const parts = new Intl.DateTimeFormat('en-US', {
+    timeZone: tz,
+    weekday: 'short',
+    hour: '2-digit',
+    minute: '2-digit',
+    hour12: false,
+  }).formatToParts(date)
+  const part = (type: string) => parts.find((p) => p.type === type)?.value
+  // some ICU versions format midnight as `24` without an hour cycle
+  const hour = parseInt(part('hour'), 10) % 24
+  return {
+    day: weekdays.indexOf(part('weekday')),
+    minutes: hour * 60 + parseInt(part('minute'), 10),
+  }
+}
+
+const parseHHMM = (value: string): number => {
+  const [hours, minutes] = value.split(':').map((v) => parseInt(v, 10))
+  return hours * 60 + minutes
+}
+
+/**
+ * inWindow
+ *
+ * `now` (UTC) falls within `window` defined in local time of `tz`
+ */
+export const inWindow = (
+  now: Date,
+  window: TimeWindow,
+  tz: string
+): boolean => {
+  const { day, minutes } = zonedTime(now, tz)
+  const start = parseHHMM(window.start)
+  const end = parseHHMM(window.end)
+  const startsOn = (d: number) =>
+    !window.days || window.days.length === 0 || window.days.includes(d)
+  if (start <= end) {
+    return startsOn(day) && minutes >= start && minutes < end
+  }
+  // spans midnight, the early part belongs to the previous day
+  if (minutes >= start) {
+    return startsOn(day)
+  }
+  return minutes < end && startsOn((day + 6) % 7)
+}
+
+/**
+ * formatInZone
+ *
+ * `YYYY-MM-DD HH:mm` local time of `date` in `tz`
+ */
+export const formatInZone = (date: Date, tz: string): string => {
+  const parts = new Intl.DateTimeFormat('en-US', {
+    timeZone: tz,
+    year: 'numeric',
+    month: '2-digit',
+    day: '2-digit',
+    hour: '2-digit',
+    minute: '2-digit',
+    hour12: false,
+  }).formatToParts(date)
+  const part = (type: string) => parts.find((p) => p.type === type)?.value
+  const hour = `0${parseInt(part('hour'), 10) % 24}`.slice(-2)
+  return `${part('year')}-${part('month')}-${part('day')} ${hour}:${part(
+    'minute'
+  )}`
+}
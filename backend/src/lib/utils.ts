@@ -5,3 +5,11 @@
  */
 export const stripJSONUnicode = (obj: unknown) =>
   JSON.parse(JSON.stringify(obj, null).replace(/([^ -~]|\\u0000)+/g, ''))
+
+/**
+ * escapeLike
+ *
+ * Escapes LIKE / ILIKE wildcards so `value` matches literally
+ */
+export const escapeLike = (value: string): string =>
+  value.replace(/[\\%_]/g, (c) => `\\${c}`)
@@ -0,0 +1,14 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.createTable('settings', (table) => {
+    table.string('key').notNullable().primary().comment('Setting key')
+    table.jsonb('value').notNullable().comment('Setting value')
+    table.string('updated_by').comment('Login of the last editor')
+    table.timestamps(true, true)
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.dropTable('settings')
+}
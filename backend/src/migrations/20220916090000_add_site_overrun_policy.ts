@@ -0,0 +1,16 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .string('overrun_policy')
+      .nullable()
+      .comment('Overrides the scheduler overrun policy (null uses default)')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('overrun_policy')
+  })
+}
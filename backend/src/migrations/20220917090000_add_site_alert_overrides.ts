@@ -0,0 +1,29 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  await knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('alert_ttl_minutes')
+      .notNullable()
+      .defaultTo(1440)
+      .comment('Minutes before the same unknown domain alerts again')
+    table
+      .string('unknown_domain_severity')
+      .notNullable()
+      .defaultTo('medium')
+      .comment('Severity of unknown.domain alerts')
+  })
+  return knex.schema.alterTable('alerts', (table) => {
+    table.string('severity').nullable().comment('Alert severity')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  await knex.schema.alterTable('alerts', (table) => {
+    table.dropColumn('severity')
+  })
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('alert_ttl_minutes')
+    table.dropColumn('unknown_domain_severity')
+  })
+}
@@ -0,0 +1,16 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table
+      .timestamp('idle_at')
+      .nullable()
+      .comment('Flagged for producing no new events')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table.dropColumn('idle_at')
+  })
+}
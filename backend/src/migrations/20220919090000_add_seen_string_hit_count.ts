@@ -0,0 +1,26 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  await knex.schema.alterTable('seen_strings', (table) => {
+    table
+      .integer('hit_count')
+      .notNullable()
+      .defaultTo(1)
+      .comment('Number of times the string was seen')
+  })
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('seen_min_hits')
+      .nullable()
+      .comment('Hits before a domain is considered seen (null uses the default)')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  await knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('seen_min_hits')
+  })
+  return knex.schema.alterTable('seen_strings', (table) => {
+    table.dropColumn('hit_count')
+  })
+}
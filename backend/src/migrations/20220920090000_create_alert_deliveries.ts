@@ -0,0 +1,29 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.createTable('alert_deliveries', (table) => {
+    table.uuid('id').primary()
+    table
+      .uuid('alert_id')
+      .nullable()
+      .references('id')
+      .inTable('alerts')
+      .onDelete('CASCADE')
+      .comment('Delivered alert (null for non rule-alert events)')
+    table.uuid('scan_id').nullable().comment('Scan of the delivered event')
+    table.string('sink').notNullable().comment('Alert sink name')
+    table.integer('attempt').notNullable().comment('Attempt number (per sink)')
+    table
+      .string('status')
+      .notNullable()
+      .comment('Attempt result (succeeded / failed)')
+    table.jsonb('request').comment('Event sent to the sink')
+    table.jsonb('response').comment('Sink result or error')
+    table.timestamp('created_at').notNullable().defaultTo(knex.fn.now())
+    table.index(['alert_id', 'created_at'])
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.dropTable('alert_deliveries')
+}
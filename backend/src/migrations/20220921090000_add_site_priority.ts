@@ -0,0 +1,17 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('priority')
+      .notNullable()
+      .defaultTo(50)
+      .comment('Scheduling priority, higher runs first')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('priority')
+  })
+}
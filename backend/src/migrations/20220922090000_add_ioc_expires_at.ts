@@ -0,0 +1,17 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('iocs', (table) => {
+    table
+      .dateTime('expires_at')
+      .nullable()
+      .index()
+      .comment('IOC is disabled after this date (null never expires)')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('iocs', (table) => {
+    table.dropColumn('expires_at')
+  })
+}
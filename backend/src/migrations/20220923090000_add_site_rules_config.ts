@@ -0,0 +1,16 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .jsonb('rules_config')
+      .nullable()
+      .comment('Per rule settings, e.g. {"yara": {"enabled": false}}')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('rules_config')
+  })
+}
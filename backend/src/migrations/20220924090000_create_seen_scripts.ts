@@ -0,0 +1,26 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.createTable('seen_scripts', (table) => {
+    table.uuid('id').primary()
+    table
+      .uuid('site_id')
+      .notNullable()
+      .references('id')
+      .inTable('sites')
+      .onDelete('CASCADE')
+    table.string('url', 2048).notNullable().comment('Script URL')
+    table.string('sha256', 64).notNullable().comment('Last seen script hash')
+    table.timestamp('created_at').notNullable().defaultTo(knex.fn.now())
+    table
+      .timestamp('changed_at')
+      .nullable()
+      .comment('Datetime the hash last changed')
+    table.timestamp('last_seen').notNullable().defaultTo(knex.fn.now())
+    table.unique(['site_id', 'url'])
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.dropTable('seen_scripts')
+}
@@ -0,0 +1,15 @@
+import { Knex } from 'knex'
+
+// dead-lettered deliveries are rare, a partial index keeps
+// operator lookups cheap without indexing every attempt
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.raw(
+    `CREATE INDEX alert_deliveries_dead_lettered_index
+      ON alert_deliveries (created_at)
+      WHERE status = 'dead_lettered'`
+  )
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.raw('DROP INDEX alert_deliveries_dead_lettered_index')
+}
@@ -0,0 +1,27 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .string('target_url', 2048)
+      .nullable()
+      .comment('URL scans of the site are expected to land on')
+    table
+      .string('last_url', 2048)
+      .nullable()
+      .comment('URL the last completed scan landed on')
+    table
+      .integer('drift_count')
+      .notNullable()
+      .defaultTo(0)
+      .comment('Consecutive scans that landed away from the target')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('target_url')
+    table.dropColumn('last_url')
+    table.dropColumn('drift_count')
+  })
+}
@@ -0,0 +1,20 @@
+import { Knex } from 'knex'
+
+// built concurrently, scan_logs is large and written to constantly
+export const config = { transaction: false }
+
+// installation wide request reports (e.g. top domains) are bounded
+// by a time window, only request events are indexed
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.raw(
+    `CREATE INDEX CONCURRENTLY scan_logs_request_created_at_index
+      ON scan_logs (created_at)
+      WHERE entry = 'request'`
+  )
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.raw(
+    'DROP INDEX CONCURRENTLY scan_logs_request_created_at_index'
+  )
+}
@@ -0,0 +1,16 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .jsonb('ioc_exceptions')
+      .nullable()
+      .comment('IOC values that do not alert for the site, e.g. ["partner.test"]')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('ioc_exceptions')
+  })
+}
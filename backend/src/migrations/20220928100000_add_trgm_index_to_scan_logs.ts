@@ -0,0 +1,22 @@
+import { Knex } from 'knex'
+
+// built concurrently, scan_logs is large and written to constantly
+export const config = { transaction: false }
+
+// substring search on the raw event JSON (`search_body`), limited to
+// the searched entries (BODY_SEARCH_ENTRIES of the scan log filter),
+// screenshots, snapshots and script bodies are not indexed
+export async function up(knex: Knex): Promise<void> {
+  await knex.raw('CREATE EXTENSION IF NOT EXISTS pg_trgm')
+  return knex.raw(
+    `CREATE INDEX CONCURRENTLY scan_log_event_trgm_idx
+      ON scan_logs USING gin ((event::text) gin_trgm_ops)
+      WHERE entry IN ('request', 'response-error', 'function-call',
+        'cookie', 'file-download', 'worker-created', 'page-error',
+        'console-message', 'rule-alert', 'log-message', 'error')`
+  )
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.raw('DROP INDEX CONCURRENTLY IF EXISTS scan_log_event_trgm_idx')
+}
@@ -0,0 +1,21 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table
+      .integer('retry_delay_ms')
+      .nullable()
+      .comment('Backoff delay before the next attempt')
+    table
+      .timestamp('next_attempt_at')
+      .nullable()
+      .comment('Scheduled time of the next attempt')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table.dropColumn('retry_delay_ms')
+    table.dropColumn('next_attempt_at')
+  })
+}
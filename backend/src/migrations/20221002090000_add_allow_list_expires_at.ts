@@ -0,0 +1,17 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('allow_list', (table) => {
+    table
+      .timestamp('expires_at')
+      .nullable()
+      .index()
+      .comment('Entry stops matching after this date, null never expires')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('allow_list', (table) => {
+    table.dropColumn('expires_at')
+  })
+}
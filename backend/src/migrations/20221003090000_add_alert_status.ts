@@ -0,0 +1,30 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alerts', (table) => {
+    table
+      .string('status', 32)
+      .notNullable()
+      .defaultTo('open')
+      .index()
+      .comment('Triage state: open, acknowledged, resolved or false_positive')
+    table
+      .timestamp('status_updated_at')
+      .nullable()
+      .comment('Date of the last status transition')
+    table
+      .string('status_updated_by')
+      .nullable()
+      .comment('Login of the last status transition')
+    table.text('status_note').nullable().comment('Note of the last transition')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alerts', (table) => {
+    table.dropColumn('status')
+    table.dropColumn('status_updated_at')
+    table.dropColumn('status_updated_by')
+    table.dropColumn('status_note')
+  })
+}
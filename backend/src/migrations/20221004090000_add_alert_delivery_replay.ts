@@ -0,0 +1,21 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table
+      .timestamp('replayed_at')
+      .nullable()
+      .comment('Date the dead-lettered attempt was replayed')
+    table
+      .string('replayed_by')
+      .nullable()
+      .comment('Login that replayed the dead-lettered attempt')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table.dropColumn('replayed_at')
+    table.dropColumn('replayed_by')
+  })
+}
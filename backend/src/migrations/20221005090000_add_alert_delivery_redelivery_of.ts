@@ -0,0 +1,19 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table
+      .uuid('redelivery_of')
+      .nullable()
+      .references('id')
+      .inTable('alert_deliveries')
+      .onDelete('SET NULL')
+      .comment('Failed attempt this attempt redelivers')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('alert_deliveries', (table) => {
+    table.dropColumn('redelivery_of')
+  })
+}
@@ -0,0 +1,15 @@
+import { Knex } from 'knex'
+
+// built concurrently, alerts are written to while migrating
+export const config = { transaction: false }
+
+// keyset pagination of the alert list, see `cursorListHandler`
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.raw(
+    'CREATE INDEX CONCURRENTLY alerts_created_at_id_index ON alerts (created_at, id)'
+  )
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.raw('DROP INDEX CONCURRENTLY alerts_created_at_id_index')
+}
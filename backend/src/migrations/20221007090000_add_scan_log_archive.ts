@@ -0,0 +1,29 @@
+import { Knex } from 'knex'
+
+// the index is built concurrently, scan_logs is large and written
+// to constantly
+export const config = { transaction: false }
+
+export async function up(knex: Knex): Promise<void> {
+  await knex.schema.alterTable('scan_logs', (table) => {
+    table
+      .string('storage_key')
+      .nullable()
+      .comment('Object storage key of the archived event')
+    table
+      .timestamp('archived_at')
+      .nullable()
+      .comment('Set once the event moved to object storage')
+  })
+  await knex.schema.raw(
+    'CREATE INDEX CONCURRENTLY scan_logs_archived_at_index ON scan_logs (archived_at)'
+  )
+}
+
+export async function down(knex: Knex): Promise<void> {
+  await knex.schema.raw('DROP INDEX CONCURRENTLY scan_logs_archived_at_index')
+  await knex.schema.alterTable('scan_logs', (table) => {
+    table.dropColumn('storage_key')
+    table.dropColumn('archived_at')
+  })
+}
@@ -0,0 +1,28 @@
+import { Knex } from 'knex'
+
+// existing windows are kept as site overrides, new sites follow
+// the unknown.domain rule default
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('alert_ttl_minutes')
+      .nullable()
+      .defaultTo(null)
+      .comment('Overrides the alert-once window of unknown domains')
+      .alter()
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  await knex('sites').whereNull('alert_ttl_minutes').update({
+    alert_ttl_minutes: 1440,
+  })
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('alert_ttl_minutes')
+      .notNullable()
+      .defaultTo(1440)
+      .comment('Minutes before the same unknown domain alerts again')
+      .alter()
+  })
+}
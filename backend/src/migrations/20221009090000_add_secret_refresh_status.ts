@@ -0,0 +1,26 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table
+      .timestamp('last_refreshed_at')
+      .nullable()
+      .comment('Last refresh of the secret value')
+    table
+      .string('last_refresh_status')
+      .nullable()
+      .comment('succeeded, failed or unchanged')
+    table
+      .text('last_refresh_error')
+      .nullable()
+      .comment('Reason of a failed or unchanged refresh')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table.dropColumn('last_refreshed_at')
+    table.dropColumn('last_refresh_status')
+    table.dropColumn('last_refresh_error')
+  })
+}
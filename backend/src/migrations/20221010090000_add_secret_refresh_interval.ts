@@ -0,0 +1,16 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table
+      .integer('refresh_interval_minutes')
+      .nullable()
+      .comment('Refresh interval, null refreshes on the global schedule')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table.dropColumn('refresh_interval_minutes')
+  })
+}
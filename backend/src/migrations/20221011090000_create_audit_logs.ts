@@ -0,0 +1,26 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.createTable('audit_logs', (table) => {
+    table.uuid('id').primary()
+    table
+      .string('actor')
+      .notNullable()
+      .comment('Login of the user, `system` for background jobs')
+    table.string('action').notNullable().comment('create, update, delete...')
+    table
+      .string('entity_type')
+      .notNullable()
+      .comment('site, allow_list, ioc, secret or alert_sink')
+    table.string('entity_id').nullable().comment('ID or key of the entity')
+    table.jsonb('changes').comment('Changed fields ({ field: { from, to } })')
+    table.timestamp('created_at').notNullable().defaultTo(knex.fn.now())
+    table.index(['entity_type', 'entity_id', 'created_at'])
+    table.index(['actor', 'created_at'])
+    table.index('created_at')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.dropTable('audit_logs')
+}
@@ -0,0 +1,17 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table
+      .integer('suppressed_alerts')
+      .notNullable()
+      .defaultTo(0)
+      .comment('Alerts over the per scan cap (`count` overflow)')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table.dropColumn('suppressed_alerts')
+  })
+}
@@ -0,0 +1,21 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table
+      .string('provider')
+      .nullable()
+      .comment('Source of refreshed values, null for the default')
+    table
+      .string('provider_ref')
+      .nullable()
+      .comment('Location of the value in the provider')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('secrets', (table) => {
+    table.dropColumn('provider')
+    table.dropColumn('provider_ref')
+  })
+}
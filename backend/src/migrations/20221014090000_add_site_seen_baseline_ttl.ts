@@ -0,0 +1,18 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table
+      .integer('seen_baseline_ttl_days')
+      .nullable()
+      .comment(
+        'Days without a hit before a seen string expires (null uses the default)'
+      )
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('sites', (table) => {
+    table.dropColumn('seen_baseline_ttl_days')
+  })
+}
@@ -0,0 +1,21 @@
+import { Knex } from 'knex'
+
+export async function up(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table
+      .string('landing_url', 2048)
+      .nullable()
+      .comment('URL the main frame landed on, set once per scan')
+    table
+      .string('target_drift')
+      .nullable()
+      .comment('How the landing URL drifted from the site target')
+  })
+}
+
+export async function down(knex: Knex): Promise<void> {
+  return knex.schema.alterTable('scans', (table) => {
+    table.dropColumn('landing_url')
+    table.dropColumn('target_drift')
+  })
+}
@@ -0,0 +1,175 @@
+import { Model } from 'objection'
+import { v4 as uuidv4 } from 'uuid'
+import { ParamSchema } from 'aejo'
+import BaseModel from './base'
+import Alert from './alerts'
+
+// dead_lettered: final attempt failed, the sink gave up
+// (replays are recorded as new attempts, see `replayed_at`)
+export const DeliveryStatuses = [
+  'succeeded',
+  'failed',
+  'dead_lettered',
+  // not sent, quiet hours of the sink
+  'muted',
+]
+
+export interface AlertDeliveryAttributes {
+  id?: string
+  alert_id?: string | null
+  scan_id?: string | null
+  sink: string
+  attempt: number
+  status: string
+  request?: Record<string, unknown>
+  response?: Record<string, unknown>
+  // backoff before the next attempt, null once no retry follows
+  retry_delay_ms?: number | null
+  next_attempt_at?: Date | null
+  replayed_at?: Date | null
+  replayed_by?: string | null
+  // failed attempt this one redelivers
+  redelivery_of?: string | null
+  created_at?: Date
+}
+
+export const Schema: { [prop: string]: ParamSchema } = {
+  id: {
+    description: 'ID of Alert Delivery',
+    type: 'string',
+    format: 'uuid',
+  },
+  alert_id: {
+    description: 'ID of delivered Alert',
+    type: 'string',
+    format: 'uuid',
+    nullable: true,
+  },
+  scan_id: {
+    description: 'ID of related Scan',
+    type: 'string',
+    format: 'uuid',
+    nullable: true,
+  },
+  sink: {
+    description: 'Alert sink',
+    type: 'string',
+  },
+  attempt: {
+    description: 'Attempt number (per sink)',
+    type: 'integer',
+  },
+  status: {
+    description: 'Attempt result',
+    type: 'string',
+    enum: DeliveryStatuses,
+  },
+  request: {
+    description: 'Event sent to the sink',
+    type: 'object',
+    nullable: true,
+  },
+  response: {
+    description: 'Sink result or error',
+    type: 'object',
+    nullable: true,
+  },
+  retry_delay_ms: {
+    description: 'Delay (ms) before the next attempt',
+    type: 'integer',
+    nullable: true,
+  },
+  next_attempt_at: {
+    description: 'Datetime of the next attempt (failed attempts only)',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  replayed_at: {
+    description: 'Datetime the dead-lettered attempt was replayed',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  replayed_by: {
+    description: 'Login that replayed the dead-lettered attempt',
+    type: 'string',
+    nullable: true,
+  },
+  redelivery_of: {
+    description: 'ID of the failed attempt this attempt redelivers',
+    type: 'string',
+    format: 'uuid',
+    nullable: true,
+  },
+  created_at: {
+    description: 'Datetime of the attempt',
+    type: 'string',
+    format: 'date-time',
+  },
+}
+
+export default class AlertDelivery extends BaseModel<AlertDeliveryAttributes> {
+  id!: string
+  alert_id?: string | null
+  scan_id?: string | null
+  sink: string
+  attempt: number
+  status: string
+  request?: Record<string, unknown>
+  response?: Record<string, unknown>
+  retry_delay_ms?: number | null
+  next_attempt_at?: Date | null
+  replayed_at?: Date | null
+  replayed_by?: string | null
+  redelivery_of?: string | null
+  created_at: Date
+
+  static relationMappings = {
+    alert: {
+      relation: Model.BelongsToOneRelation,
+      modelClass: Alert,
+      join: {
+        from: 'alert_deliveries.alert_id',
+        to: 'alerts.id',
+      },
+    },
+  }
+
+  static get tableName(): string {
+    return 'alert_deliveries'
+  }
+
+  static selectAble(): Array<keyof AlertDeliveryAttributes> {
+    return [
+      'id',
+      'alert_id',
+      'scan_id',
+      'sink',
+      'attempt',
+      'status',
+      'request',
+      'response',
+      'retry_delay_ms',
+      'next_attempt_at',
+      'replayed_at',
+      'replayed_by',
+      'redelivery_of',
+      'created_at',
+    ]
+  }
+
+  static updateAble(): Array<keyof AlertDeliveryAttributes> {
+    return []
+  }
+
+  static insertAble(): Array<keyof AlertDeliveryAttributes> {
+    return []
+  }
+
+  $beforeInsert(): void {
+    this.id = uuidv4()
+    // failed attempts schedule their retry from `created_at`
+    this.created_at = this.created_at || new Date()
+  }
+}
@@ -2,11 +2,48 @@ import { Model } from 'objection'
 import { v4 as uuidv4 } from 'uuid'
 
 import Scan from './scans'
-import Site from './sites'
+import Site, { Severities } from './sites'
 
 import BaseModel from './base'
 import { ParamSchema } from 'aejo'
 
+// triage states, see `AlertStatusTransitions`
+export type AlertStatus = 'open' | 'acknowledged' | 'resolved' | 'false_positive'
+
+export const AlertStatuses: AlertStatus[] = [
+  'open',
+  'acknowledged',
+  'resolved',
+  'false_positive',
+]
+
+// states an alert can move to from each state, handled
+// alerts can be reopened
+export const AlertStatusTransitions: Record<AlertStatus, AlertStatus[]> = {
+  open: ['acknowledged', 'resolved', 'false_positive'],
+  acknowledged: ['open', 'resolved', 'false_positive'],
+  resolved: ['open'],
+  false_positive: ['open'],
+}
+
+// states of alerts not handled yet
+export const ActiveAlertStatuses: AlertStatus[] = ['open', 'acknowledged']
+
+// rules raising alerts
+export const AlertRules = [
+  'ioc.payload',
+  'ioc.domain',
+  'ioc.url',
+  'ioc.ip',
+  'ioc.hash',
+  'unknown.domain',
+  'google.analytics',
+  'yara',
+  'domain.via.websocket',
+  'script.hash',
+  'exfil',
+]
+
 export interface AlertAttributes {
   id?: string
   rule: string
@@ -14,6 +51,11 @@ export interface AlertAttributes {
   context?: Record<string, unknown>
   scan_id?: string
   site_id?: string
+  severity?: string
+  status?: AlertStatus
+  status_updated_at?: Date | null
+  status_updated_by?: string | null
+  status_note?: string | null
   created_at: Date
 }
 
@@ -26,14 +68,7 @@ export const Schema: { [prop: string]: ParamSchema } = {
   rule: {
     description: 'Associated Rule',
     type: 'string',
-    enum: [
-      'ioc.payload',
-      'ioc.domain',
-      'unknown.domain',
-      'google.analytics',
-      'yara',
-      'domain.via.websocket',
-    ],
+    enum: AlertRules,
   },
   message: {
     description: 'Alert Message',
@@ -53,6 +88,33 @@ export const Schema: { [prop: string]: ParamSchema } = {
     type: 'string',
     format: 'uuid',
   },
+  severity: {
+    description: 'Alert severity',
+    type: 'string',
+    enum: Severities,
+    nullable: true,
+  },
+  status: {
+    description: 'Triage state',
+    type: 'string',
+    enum: AlertStatuses,
+  },
+  status_updated_at: {
+    description: 'Datetime of the last status transition',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  status_updated_by: {
+    description: 'Login of the last status transition',
+    type: 'string',
+    nullable: true,
+  },
+  status_note: {
+    description: 'Note of the last status transition',
+    type: 'string',
+    nullable: true,
+  },
   created_at: {
     description: 'Datetime of Alert',
     type: 'string',
@@ -67,6 +129,11 @@ export default class Alert extends BaseModel<AlertAttributes> {
   context?: Record<string, unknown>
   scan_id?: string
   site_id?: string
+  severity?: string
+  status: AlertStatus
+  status_updated_at?: Date | null
+  status_updated_by?: string | null
+  status_note?: string | null
   created_at: Date
 
   static relationMappings = {
@@ -99,6 +166,11 @@ export default class Alert extends BaseModel<AlertAttributes> {
       'message',
       'scan_id',
       'site_id',
+      'severity',
+      'status',
+      'status_updated_at',
+      'status_updated_by',
+      'status_note',
       'created_at',
       'context',
     ]
@@ -1,6 +1,7 @@
 import BaseModel from './base'
 import { v4 as uuidv4 } from 'uuid'
 import { ParamSchema } from 'aejo'
+import { normalizeDomain } from '../lib/domains'
 
 export const AllowListType = [
   'fqdn',
@@ -15,6 +16,7 @@ export interface AllowListAttributes {
   id?: string
   type: typeof AllowListType[number]
   key: string
+  expires_at?: Date | null
   created_at?: Date
   updated_at?: Date
 }
@@ -35,6 +37,12 @@ export const Schema: { [prop: string]: ParamSchema } = {
     type: 'string',
     format: 'regex'
   },
+  expires_at: {
+    description: 'Entry stops matching after this date (null never expires)',
+    type: 'string',
+    format: 'date-time',
+    nullable: true
+  },
   created_at: {
     description: 'Created Date',
     type: 'string',
@@ -51,6 +59,7 @@ export default class AllowList extends BaseModel<AllowListAttributes> {
   id!: string
   key: string
   type: string
+  expires_at?: Date | null
   created_at: Date
   updated_at?: Date
 
@@ -58,25 +67,39 @@ export default class AllowList extends BaseModel<AllowListAttributes> {
     return 'allow_list'
   }
 
+  /**
+   * normalizeKey
+   *
+   * Plain fqdn keys are stored in ASCII (punycode) form,
+   * patterns are kept as-is
+   */
+  static normalizeKey(type: string, key: string): string {
+    return type === 'fqdn' ? normalizeDomain(key) : key
+  }
+
   $beforeInsert(): void {
     this.id = uuidv4()
+    this.key = AllowList.normalizeKey(this.type, this.key)
     this.created_at = new Date()
   }
 
   $beforeUpdate(): void {
+    if (this.key !== undefined && this.type !== undefined) {
+      this.key = AllowList.normalizeKey(this.type, this.key)
+    }
     this.updated_at = new Date()
   }
 
   static selectAble(): Array<keyof AllowListAttributes> {
-    return ['id', 'key', 'created_at', 'type', 'updated_at']
+    return ['id', 'key', 'created_at', 'type', 'updated_at', 'expires_at']
   }
 
   static insertAble(): Array<keyof AllowListAttributes> {
-    return ['key', 'created_at', 'type', 'updated_at']
+    return ['key', 'created_at', 'type', 'updated_at', 'expires_at']
   }
 
   static updateAble(): Array<keyof AllowListAttributes> {
-    return ['updated_at', 'type', 'key']
+    return ['updated_at', 'type', 'key', 'expires_at']
   }
 
   static build(o: Partial<AllowListAttributes>): AllowList {
@@ -0,0 +1,111 @@
+import { v4 as uuidv4 } from 'uuid'
+import { ParamSchema } from 'aejo'
+import BaseModel from './base'
+
+export const AuditActions = [
+  'create',
+  'update',
+  'delete',
+  // alert sinks
+  'test',
+  'replay',
+  'redeliver',
+]
+
+export const AuditEntityTypes = [
+  'site',
+  'allow_list',
+  'ioc',
+  'secret',
+  'alert_sink',
+  'setting',
+]
+
+export type AuditChanges = Record<string, { from?: unknown; to?: unknown }>
+
+export interface AuditLogAttributes {
+  id?: string
+  actor: string
+  action: string
+  entity_type: string
+  entity_id?: string | null
+  changes?: AuditChanges | null
+  created_at?: Date
+}
+
+export const Schema: { [prop: string]: ParamSchema } = {
+  id: {
+    description: 'ID of Audit Log entry',
+    type: 'string',
+    format: 'uuid',
+  },
+  actor: {
+    description: 'Login of the user (`system` for background jobs)',
+    type: 'string',
+  },
+  action: {
+    description: 'Action taken',
+    type: 'string',
+    enum: AuditActions,
+  },
+  entity_type: {
+    description: 'Type of the changed entity',
+    type: 'string',
+    enum: AuditEntityTypes,
+  },
+  entity_id: {
+    description: 'ID of the changed entity (sink key for alert sinks)',
+    type: 'string',
+    nullable: true,
+  },
+  changes: {
+    description: 'Changed fields ({ field: { from, to } })',
+    type: 'object',
+    nullable: true,
+  },
+  created_at: {
+    description: 'Datetime of the action',
+    type: 'string',
+    format: 'date-time',
+  },
+}
+
+export default class AuditLog extends BaseModel<AuditLogAttributes> {
+  id!: string
+  actor: string
+  action: string
+  entity_type: string
+  entity_id?: string | null
+  changes?: AuditChanges | null
+  created_at: Date
+
+  static get tableName(): string {
+    return 'audit_logs'
+  }
+
+  static selectAble(): Array<keyof AuditLogAttributes> {
+    return [
+      'id',
+      'actor',
+      'action',
+      'entity_type',
+      'entity_id',
+      'changes',
+      'created_at',
+    ]
+  }
+
+  // entries are never edited
+  static updateAble(): Array<keyof AuditLogAttributes> {
+    return []
+  }
+
+  static insertAble(): Array<keyof AuditLogAttributes> {
+    return []
+  }
+
+  $beforeInsert(): void {
+    this.id = uuidv4()
+    this.created_at = new Date()
+  }
+}
@@ -3,16 +3,20 @@ import _knex, { Knex } from 'knex'
 
 import { config } from 'node-config-ts'
 import Alert, { AlertAttributes } from './alerts'
+import AlertDelivery, { AlertDeliveryAttributes } from './alert_deliveries'
 import AllowList, { AllowListAttributes } from './allow_list'
+import AuditLog, { AuditLogAttributes } from './audit_logs'
 import File, { FileAttributes } from './files'
 import Site, { SiteAttributes } from './sites'
 import Ioc, { IocAttributes } from './iocs'
 import SeenString, { SeenStringAttributes } from './seen_strings'
+import SeenScript, { SeenScriptAttributes } from './seen_scripts'
 import Source, { SourceAttributes } from './sources'
 import SourceSecret, { SourceSecretAttributes } from './source_secrets'
 import Scan, { ScanAttributes } from './scans'
 import ScanLog, { ScanLogAttributes } from './scan_logs'
 import Secret, { SecretAttributes } from './secrets'
+import Setting, { SettingAttributes } from './settings'
 import User, { UserAttributes } from './users'
 import logger from '../loaders/logger'
 
@@ -46,21 +50,29 @@ const knex = _knex({
 Site.knex(knex)
 Ioc.knex(knex)
 SeenString.knex(knex)
+SeenScript.knex(knex)
 Source.knex(knex)
 Scan.knex(knex)
 Secret.knex(knex)
 SourceSecret.knex(knex)
 Alert.knex(knex)
+AlertDelivery.knex(knex)
 AllowList.knex(knex)
+AuditLog.knex(knex)
 File.knex(knex)
 ScanLog.knex(knex)
 User.knex(knex)
+Setting.knex(knex)
 
 export {
   Alert,
   AlertAttributes,
+  AlertDelivery,
+  AlertDeliveryAttributes,
   AllowList,
   AllowListAttributes,
+  AuditLog,
+  AuditLogAttributes,
   File,
   FileAttributes,
   Site,
@@ -69,6 +81,8 @@ export {
   IocAttributes,
   SeenString,
   SeenStringAttributes,
+  SeenScript,
+  SeenScriptAttributes,
   Scan,
   ScanAttributes,
   ScanLog,
@@ -79,6 +93,8 @@ export {
   SourceSecretAttributes,
   Secret,
   SecretAttributes,
+  Setting,
+  SettingAttributes,
   User,
   UserAttributes,
   knex,
@@ -3,13 +3,31 @@ import BaseModel from './base'
 import { v4 as uuidv4 } from 'uuid'
 import { ParamSchema } from 'aejo'
 
-export type IocType = 'fqdn' | 'ip' | 'literal'
+export type IocType =
+  | 'fqdn'
+  | 'ip'
+  | 'literal'
+  | 'url'
+  | 'ip_cidr'
+  | 'sha256'
+
+// fqdn / literal values are regular expressions, url values are
+// matched as substrings, ip_cidr as ranges and sha256 exactly
+export const IocTypes: IocType[] = [
+  'fqdn',
+  'ip',
+  'literal',
+  'url',
+  'ip_cidr',
+  'sha256',
+]
 
 export interface IocAttributes {
   id?: string
   type: IocType
   value: string
   enabled: boolean
+  expires_at?: Date | null
   created_at?: Date
 }
 
@@ -22,17 +40,22 @@ export const Schema: { [prop: string]: ParamSchema } = {
   type: {
     description: 'IOC Type',
     type: 'string',
-    enum: ['fqdn', 'ip', 'literal'],
+    enum: IocTypes,
   },
   value: {
     description: 'IOC Value',
     type: 'string',
-    format: 'regex',
   },
   enabled: {
     description: 'Active IOC',
     type: 'boolean',
   },
+  expires_at: {
+    description: 'IOC is disabled after this date (null never expires)',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
   created_at: {
     description: 'Created Date',
     type: 'string',
@@ -47,6 +70,8 @@ export default class Ioc extends BaseModel<IocAttributes> {
   /** IOC value */
   value!: string
   enabled: boolean
+  /** disabled by the IOC reaper once passed */
+  expires_at?: Date | null
   created_at: Date
 
   static get tableName(): string {
@@ -59,15 +84,15 @@ export default class Ioc extends BaseModel<IocAttributes> {
   }
 
   static updateAble(): Array<keyof IocAttributes> {
-    return ['type', 'value', 'enabled']
+    return ['type', 'value', 'enabled', 'expires_at']
   }
 
   static selectAble(): Array<keyof IocAttributes> {
-    return ['id', 'type', 'value', 'enabled', 'created_at']
+    return ['id', 'type', 'value', 'enabled', 'expires_at', 'created_at']
   }
 
   static insertAble(): Array<keyof IocAttributes> {
-    return ['type', 'value', 'enabled']
+    return ['type', 'value', 'enabled', 'expires_at']
   }
 
   static build(o: Partial<IocAttributes>): Ioc {
@@ -81,7 +106,7 @@ export default class Ioc extends BaseModel<IocAttributes> {
       properties: {
         type: {
           type: 'string',
-          enum: ['fqdn', 'ip', 'literal'],
+          enum: IocTypes,
         },
         value: {
           type: 'string',
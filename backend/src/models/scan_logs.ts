@@ -12,6 +12,9 @@ export interface ScanLogAttributes {
   event: MerryMaker.ScanEventPayload
   scan_id: string
   level: ScanLogLevels
+  // set once `event` moved to object storage (see scan_log_archive)
+  storage_key?: string | null
+  archived_at?: Date | null
   created_at: Date
 }
 
@@ -57,6 +60,17 @@ export const Schema: { [prop: string]: ParamSchema } = {
     description: 'Log Level',
     enum: ['info', 'error', 'warning'],
   },
+  storage_key: {
+    type: 'string',
+    description: 'Object storage key of the archived event',
+    nullable: true,
+  },
+  archived_at: {
+    type: 'string',
+    description: 'Date the event was archived to object storage',
+    format: 'date-time',
+    nullable: true,
+  },
   created_at: {
     type: 'string',
     description: 'Date ScanLog entry was created',
@@ -70,6 +84,8 @@ export default class ScanLog extends BaseModel<ScanLogAttributes> {
   scan_id: string
   event: MerryMaker.ScanEventPayload
   level: ScanLogLevels
+  storage_key?: string | null
+  archived_at?: Date | null
   created_at: Date
 
   static get tableName(): string {
@@ -89,7 +105,8 @@ export default class ScanLog extends BaseModel<ScanLogAttributes> {
   }
 
   $beforeInsert(): void {
-    this.id = uuidv4()
+    // scanner events arrive with an ID shared with the alerts they trigger
+    this.id = this.id || uuidv4()
     if (this.event) {
       this.event = stripJSONUnicode(this.event)
     }
@@ -8,6 +8,17 @@ import { Schema as SourceSchema } from './sources'
 import BaseModel from './base'
 import { ParamSchema } from 'aejo'
 
+// lifecycle of a scan (`scheduled` -> `active` -> `completed`)
+export const ScanStates = [
+  'scheduled',
+  'active',
+  'running',
+  'completed',
+  'failed',
+  'expired',
+  'cancelled',
+]
+
 export interface ScanAttributes {
   id?: string
   site_id?: string
@@ -16,6 +27,10 @@ export interface ScanAttributes {
   created_at?: Date
   state: string
   test?: boolean
+  idle_at?: Date | null
+  suppressed_alerts?: number
+  landing_url?: string | null
+  target_drift?: string | null
 }
 
 export const Schema: { [prop: string]: ParamSchema } = {
@@ -40,6 +55,20 @@ export const Schema: { [prop: string]: ParamSchema } = {
     properties: SourceSchema,
     nullable: true,
   },
+  state: {
+    description: 'State of the scan',
+    type: 'string',
+    enum: ScanStates,
+  },
+  test: {
+    description: 'Test scan',
+    type: 'boolean',
+  },
+  created_at: {
+    description: 'Date the scan was scheduled',
+    type: 'string',
+    format: 'date-time',
+  },
 }
 
 export default class Scan extends BaseModel<ScanAttributes> {
@@ -50,6 +79,14 @@ export default class Scan extends BaseModel<ScanAttributes> {
   source: Source
   test?: boolean
   state: string
+  /** flagged for producing no new events */
+  idle_at?: Date | null
+  /** alerts counted instead of created over the per scan cap */
+  suppressed_alerts?: number
+  /** URL the main frame landed on */
+  landing_url?: string | null
+  /** drift of `landing_url` from the site target (domain / path) */
+  target_drift?: string | null
 
   static relationMappings = {
     site: {
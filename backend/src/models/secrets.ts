@@ -8,11 +8,27 @@ import { ParamSchema } from 'aejo'
 
 export type SecretTypes = 'manual' | 'external' | 'qt'
 
+// unchanged: the refreshed value is identical to the previous one
+export const RefreshStatuses = ['succeeded', 'failed', 'unchanged']
+
+// sources of refreshed values besides the default (quantum tunnel)
+export const SecretProviders = ['vault']
+
+// bounds of `refresh_interval_minutes` (5 minutes to a week)
+export const MIN_REFRESH_INTERVAL = 5
+export const MAX_REFRESH_INTERVAL = 10080
+
 export interface SecretAttributes {
   id?: string
   name: string
   type: SecretTypes
   value: string
+  last_refreshed_at?: Date | null
+  last_refresh_status?: string | null
+  last_refresh_error?: string | null
+  refresh_interval_minutes?: number | null
+  provider?: string | null
+  provider_ref?: string | null
   created_at?: Date
   updated_at?: Date
 }
@@ -38,6 +54,42 @@ export const Schema: { [prop: string]: ParamSchema } = {
     description: 'Secret Value',
     type: 'string',
   },
+  last_refreshed_at: {
+    description: 'Last refresh of the value',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  last_refresh_status: {
+    description: 'Result of the last refresh',
+    type: 'string',
+    enum: RefreshStatuses,
+    nullable: true,
+  },
+  last_refresh_error: {
+    description: 'Reason of a failed or unchanged refresh',
+    type: 'string',
+    nullable: true,
+  },
+  refresh_interval_minutes: {
+    description:
+      'Minutes between refreshes (null uses the global refresh schedule)',
+    type: 'integer',
+    minimum: MIN_REFRESH_INTERVAL,
+    maximum: MAX_REFRESH_INTERVAL,
+    nullable: true,
+  },
+  provider: {
+    description: 'Source of refreshed values (null uses the default)',
+    type: 'string',
+    enum: [...SecretProviders, null],
+    nullable: true,
+  },
+  provider_ref: {
+    description: 'Location of the value, e.g. `team/app#token` for Vault',
+    type: 'string',
+    nullable: true,
+  },
   created_at: {
     description: 'Created Date',
     type: 'string',
@@ -56,6 +108,12 @@ export default class Secret extends BaseModel<SecretAttributes> {
   type: SecretTypes
   value: string
   name: string
+  last_refreshed_at?: Date | null
+  last_refresh_status?: string | null
+  last_refresh_error?: string | null
+  refresh_interval_minutes?: number | null
+  provider?: string | null
+  provider_ref?: string | null
   created_at: Date
   updated_at?: Date
 
@@ -74,20 +132,52 @@ export default class Secret extends BaseModel<SecretAttributes> {
   async $beforeUpdate(): Promise<void> {
     this.updated_at = new Date()
     if (config.quantumTunnel.enabled === 'true' && this.type === 'qt') {
-      this.value = await redisClient.get('qtToken')
+      // an empty token never replaces the current value
+      const token = await redisClient.get('qtToken')
+      if (token) {
+        this.value = token
+      }
     }
   }
 
   static selectAble(): SecretAttributesArr {
-    return ['id', 'name', 'type', 'value', 'created_at', 'updated_at']
+    return [
+      'id',
+      'name',
+      'type',
+      'value',
+      'last_refreshed_at',
+      'last_refresh_status',
+      'last_refresh_error',
+      'refresh_interval_minutes',
+      'provider',
+      'provider_ref',
+      'created_at',
+      'updated_at',
+    ]
   }
 
   static insertAble(): SecretAttributesArr {
-    return ['name', 'type', 'value', 'updated_at']
+    return [
+      'name',
+      'type',
+      'value',
+      'refresh_interval_minutes',
+      'provider',
+      'provider_ref',
+      'updated_at',
+    ]
   }
 
   static updateAble(): SecretAttributesArr {
-    return ['updated_at', 'type', 'value']
+    return [
+      'updated_at',
+      'type',
+      'value',
+      'refresh_interval_minutes',
+      'provider',
+      'provider_ref',
+    ]
   }
 
   static build(o: Partial<SecretAttributes>): Secret {
@@ -109,6 +199,19 @@ export default class Secret extends BaseModel<SecretAttributes> {
           minLength: 2,
           maxLength: 64,
         },
+        refresh_interval_minutes: {
+          type: ['integer', 'null'],
+          minimum: MIN_REFRESH_INTERVAL,
+          maximum: MAX_REFRESH_INTERVAL,
+        },
+        provider: {
+          type: ['string', 'null'],
+          enum: [...SecretProviders, null],
+        },
+        provider_ref: {
+          type: ['string', 'null'],
+          maxLength: 255,
+        },
       },
     }
   }
@@ -0,0 +1,85 @@
+import { v4 as uuidv4 } from 'uuid'
+import { ParamSchema } from 'aejo'
+import BaseModel from './base'
+
+export interface SeenScriptAttributes {
+  id?: string
+  site_id: string
+  url: string
+  sha256: string
+  created_at?: Date
+  changed_at?: Date | null
+  last_seen?: Date
+}
+
+export const Schema: { [prop: string]: ParamSchema } = {
+  id: {
+    description: 'ID of Seen Script',
+    type: 'string',
+    format: 'uuid',
+  },
+  site_id: {
+    description: 'ID of Site the script was loaded by',
+    type: 'string',
+    format: 'uuid',
+  },
+  url: {
+    description: 'Script URL',
+    type: 'string',
+    maxLength: 2048,
+  },
+  sha256: {
+    description: 'SHA-256 of the script body',
+    type: 'string',
+    pattern: '^[a-fA-F0-9]{64}$',
+  },
+  created_at: {
+    description: 'Datetime the script was first seen',
+    type: 'string',
+    format: 'date-time',
+  },
+  changed_at: {
+    description: 'Datetime the hash last changed',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  last_seen: {
+    description: 'Datetime the script was last seen',
+    type: 'string',
+    format: 'date-time',
+  },
+}
+
+export default class SeenScript extends BaseModel<SeenScriptAttributes> {
+  id!: string
+  site_id: string
+  url: string
+  sha256: string
+  created_at: Date
+  changed_at?: Date | null
+  last_seen: Date
+
+  static get tableName(): string {
+    return 'seen_scripts'
+  }
+
+  static selectAble(): Array<keyof SeenScriptAttributes> {
+    return [
+      'id',
+      'site_id',
+      'url',
+      'sha256',
+      'created_at',
+      'changed_at',
+      'last_seen',
+    ]
+  }
+
+  $beforeInsert(): void {
+    this.id = uuidv4()
+    this.sha256 = this.sha256.toLowerCase()
+    this.created_at = new Date()
+    this.last_seen = new Date()
+  }
+}
@@ -1,6 +1,10 @@
 import BaseModel from './base'
 import { v4 as uuidv4 } from 'uuid'
 import { ParamSchema } from 'aejo'
+import { normalizeDomain } from '../lib/domains'
+
+// key types holding host names
+const domainTypes = ['domain', 'fqdn']
 
 export interface SeenStringAttributes {
   id?: string
@@ -8,6 +12,7 @@ export interface SeenStringAttributes {
   type: string
   created_at: Date
   last_cached?: Date
+  hit_count?: number
 }
 
 export const Schema: { [prop: string]: ParamSchema } = {
@@ -33,6 +38,10 @@ export const Schema: { [prop: string]: ParamSchema } = {
     description: 'Date last seen in cache',
     type: 'string',
     format: 'date-time'
+  },
+  hit_count: {
+    description: 'Number of times the string was seen',
+    type: 'integer'
   }
 }
 
@@ -42,20 +51,38 @@ export default class SeenString extends BaseModel<SeenStringAttributes> {
   type: string
   created_at: Date
   last_cached?: Date
+  hit_count: number
 
   static get tableName(): string {
     return 'seen_strings'
   }
 
+  /**
+   * normalizeKey
+   *
+   * Domain keys are stored in ASCII (punycode) form
+   */
+  static normalizeKey(type: string, key: string): string {
+    return domainTypes.includes(type) ? normalizeDomain(key) : key
+  }
+
   $beforeInsert(): void {
+    this.key = SeenString.normalizeKey(this.type, this.key)
     this.created_at = new Date()
     this.last_cached =
       this.last_cached !== undefined ? this.last_cached : new Date()
+    this.hit_count = this.hit_count !== undefined ? this.hit_count : 1
     this.id = uuidv4()
   }
 
+  $beforeUpdate(): void {
+    if (this.key !== undefined) {
+      this.key = SeenString.normalizeKey(this.type, this.key)
+    }
+  }
+
   static selectAble(): Array<keyof SeenStringAttributes> {
-    return ['id', 'key', 'created_at', 'type', 'last_cached']
+    return ['id', 'key', 'created_at', 'type', 'last_cached', 'hit_count']
   }
 
   static insertAble(): Array<keyof SeenStringAttributes> {
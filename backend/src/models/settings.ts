@@ -0,0 +1,81 @@
+import BaseModel from './base'
+import { Pojo } from 'objection'
+import { ParamSchema } from 'aejo'
+
+export type SettingValue = string | number | boolean | string[]
+
+export interface SettingAttributes {
+  key: string
+  value: SettingValue
+  updated_by?: string
+  created_at?: Date
+  updated_at?: Date
+}
+
+export const Schema: { [prop: string]: ParamSchema } = {
+  key: {
+    description: 'Setting key',
+    type: 'string',
+  },
+  value: {
+    description: 'Setting value',
+    oneOf: [
+      { type: 'string' },
+      { type: 'number' },
+      { type: 'boolean' },
+      { type: 'array', items: { type: 'string' } },
+    ],
+  },
+  updated_by: {
+    description: 'Login of the last editor',
+    type: 'string',
+    nullable: true,
+  },
+  created_at: {
+    description: 'Created Date',
+    type: 'string',
+    format: 'date-time',
+  },
+  updated_at: {
+    description: 'Updated Date',
+    type: 'string',
+    format: 'date-time',
+  },
+}
+
+export default class Setting extends BaseModel<SettingAttributes> {
+  key!: string
+  value: SettingValue
+  updated_by?: string
+  created_at: Date
+  updated_at: Date
+
+  static get tableName(): string {
+    return 'settings'
+  }
+
+  static get idColumn(): string {
+    return 'key'
+  }
+
+  static selectAble(): Array<keyof SettingAttributes> {
+    return ['key', 'value', 'updated_by', 'created_at', 'updated_at']
+  }
+
+  static insertAble(): Array<keyof SettingAttributes> {
+    return ['key', 'value', 'updated_by']
+  }
+
+  static updateAble(): Array<keyof SettingAttributes> {
+    return ['value', 'updated_by']
+  }
+
+  // values are stored as JSON in a jsonb column
+  $formatDatabaseJson(json: Pojo): Pojo {
+    const formatted = super.$formatDatabaseJson(json)
+    if (formatted.value !== undefined) {
+      formatted.value = JSON.stringify(formatted.value)
+    }
+    return formatted
+  }
+}
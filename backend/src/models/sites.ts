@@ -13,10 +13,45 @@ export interface SiteAttributes {
   active: boolean
   run_every_minutes: number
   source_id: string
+  overrun_policy?: string | null
+  alert_ttl_minutes?: number | null
+  unknown_domain_severity?: string
+  seen_min_hits?: number | null
+  seen_baseline_ttl_days?: number | null
+  priority?: number
+  rules_config?: RulesConfig | null
+  ioc_exceptions?: string[] | null
+  untrusted_suffixes?: string[] | null
+  baseline_until?: Date | null
+  target_url?: string | null
+  last_url?: string | null
+  drift_count?: number
   created_at?: Date
   updated_at?: Date
 }
 
+export const OverrunPolicies = ['queue', 'queue-bounded', 'skip']
+
+export const Severities = ['low', 'medium', 'high', 'critical']
+
+// scanner rules that can be turned off per site
+export const ConfigurableRules = [
+  'unknown.domain',
+  'ioc.domain',
+  'ioc.url',
+  'ioc.ip',
+  'ioc.hash',
+  'ioc.payload',
+  'google.analytics',
+  'yara',
+  'domain.via.websocket',
+  'script.hash',
+  'exfil',
+]
+
+// settings by rule name, rules missing from the config are enabled
+export type RulesConfig = Record<string, { enabled: boolean }>
+
 export const Schema: { [prop: string]: ParamSchema } = {
   id: {
     description: 'ID of Site',
@@ -45,6 +80,94 @@ export const Schema: { [prop: string]: ParamSchema } = {
     type: 'string',
     format: 'uuid',
   },
+  overrun_policy: {
+    description: 'Scheduler overrun policy (null uses the default)',
+    type: 'string',
+    enum: [...OverrunPolicies, null],
+    nullable: true,
+  },
+  alert_ttl_minutes: {
+    description:
+      'Minutes before the same unknown domain alerts again (null uses the default)',
+    type: 'integer',
+    minimum: 1,
+    nullable: true,
+  },
+  unknown_domain_severity: {
+    description: 'Severity of unknown.domain alerts',
+    type: 'string',
+    enum: Severities,
+  },
+  seen_min_hits: {
+    description:
+      'Hits before a domain is considered seen (null uses the default)',
+    type: 'integer',
+    minimum: 1,
+    nullable: true,
+  },
+  seen_baseline_ttl_days: {
+    description:
+      'Days without a hit before a seen string expires (null uses the default, 0 disables)',
+    type: 'integer',
+    minimum: 0,
+    nullable: true,
+  },
+  priority: {
+    description: 'Scheduling priority, higher runs first',
+    type: 'integer',
+    minimum: 0,
+    maximum: 100,
+  },
+  rules_config: {
+    description: 'Settings by rule name (missing rules are enabled)',
+    type: 'object',
+    nullable: true,
+    additionalProperties: {
+      type: 'object',
+      properties: {
+        enabled: { type: 'boolean' },
+      },
+      required: ['enabled'],
+    },
+  },
+  ioc_exceptions: {
+    description: 'IOC values that do not alert for this site (still recorded)',
+    type: 'array',
+    nullable: true,
+    maxItems: 500,
+    items: { type: 'string', minLength: 1, maxLength: 2048 },
+  },
+  untrusted_suffixes: {
+    description:
+      'Global allowlist suffixes not trusted for this site, e.g. doubleclick.net',
+    type: 'array',
+    nullable: true,
+    maxItems: 100,
+    items: { type: 'string', minLength: 1, maxLength: 255 },
+  },
+  baseline_until: {
+    description:
+      'Learning mode, unknown domains are added to the seen baseline without alerting until this date',
+    type: 'string',
+    format: 'date-time',
+    nullable: true,
+  },
+  target_url: {
+    description: 'URL scans are expected to land on (drift warnings)',
+    type: 'string',
+    format: 'uri',
+    maxLength: 2048,
+    nullable: true,
+  },
+  last_url: {
+    description: 'URL the last completed scan landed on',
+    type: 'string',
+    nullable: true,
+  },
+  drift_count: {
+    description: 'Consecutive scans that landed away from the target URL',
+    type: 'integer',
+  },
   created_at: {
     description: 'Created Date',
     type: 'string',
@@ -66,13 +189,56 @@ export default class Site extends BaseModel<SiteAttributes> {
   /** Source ID */
   source_id: string
   run_every_minutes: number
+  /** Overrides the scheduler overrun policy */
+  overrun_policy?: string | null
+  /** Overrides the alert-once window for unknown domains */
+  alert_ttl_minutes?: number | null
+  /** Severity of unknown.domain alerts */
+  unknown_domain_severity: string
+  /** Overrides the seen_strings hit threshold */
+  seen_min_hits?: number | null
+  /** Overrides the seen_strings baseline TTL */
+  seen_baseline_ttl_days?: number | null
+  /** Scheduling priority, higher runs first */
+  priority: number
+  /** Per rule settings (null runs every rule) */
+  rules_config?: RulesConfig | null
+  /** IOC values excepted for this site */
+  ioc_exceptions?: string[] | null
+  /** Global allowlist suffixes the site does not trust */
+  untrusted_suffixes?: string[] | null
+  /** Learning mode (no unknown domain alerts) ends at */
+  baseline_until?: Date | null
+  /** URL scans are expected to land on */
+  target_url?: string | null
+  /** URL the last completed scan landed on */
+  last_url?: string | null
+  /** Consecutive scans that landed away from `target_url` */
+  drift_count: number
   /** Site will run on next scheduled interval */
   active!: boolean
   created_at: Date
   updated_at: Date
 
   static updateAble(): Array<keyof Site> {
-    return ['name', 'active', 'source_id', 'run_every_minutes', 'last_run']
+    return [
+      'name',
+      'active',
+      'source_id',
+      'run_every_minutes',
+      'last_run',
+      'overrun_policy',
+      'alert_ttl_minutes',
+      'unknown_domain_severity',
+      'seen_min_hits',
+      'seen_baseline_ttl_days',
+      'priority',
+      'rules_config',
+      'ioc_exceptions',
+      'untrusted_suffixes',
+      'baseline_until',
+      'target_url',
+    ]
   }
 
   static selectAble(): Array<keyof Site> {
@@ -83,12 +249,41 @@ export default class Site extends BaseModel<SiteAttributes> {
       'run_every_minutes',
       'last_run',
       'active',
+      'overrun_policy',
+      'alert_ttl_minutes',
+      'unknown_domain_severity',
+      'seen_min_hits',
+      'seen_baseline_ttl_days',
+      'priority',
+      'rules_config',
+      'ioc_exceptions',
+      'untrusted_suffixes',
+      'baseline_until',
+      'target_url',
+      'last_url',
+      'drift_count',
       'created_at',
       'updated_at',
     ]
   }
   static insertAble(): Array<keyof Site> {
-    return ['name', 'active', 'source_id', 'run_every_minutes']
+    return [
+      'name',
+      'active',
+      'source_id',
+      'run_every_minutes',
+      'overrun_policy',
+      'alert_ttl_minutes',
+      'unknown_domain_severity',
+      'seen_min_hits',
+      'seen_baseline_ttl_days',
+      'priority',
+      'rules_config',
+      'ioc_exceptions',
+      'untrusted_suffixes',
+      'baseline_until',
+      'target_url',
+    ]
   }
 
   static build(o: Partial<Site>): Site {
@@ -144,6 +339,46 @@ export default class Site extends BaseModel<SiteAttributes> {
         run_every_minutes: {
           type: 'integer',
         },
+        overrun_policy: {
+          type: ['string', 'null'],
+          enum: [...OverrunPolicies, null],
+        },
+        alert_ttl_minutes: {
+          type: ['integer', 'null'],
+          minimum: 1,
+        },
+        unknown_domain_severity: {
+          type: 'string',
+          enum: Severities,
+        },
+        seen_min_hits: {
+          type: ['integer', 'null'],
+          minimum: 1,
+        },
+        seen_baseline_ttl_days: {
+          type: ['integer', 'null'],
+          minimum: 0,
+        },
+        priority: {
+          type: 'integer',
+          minimum: 0,
+          maximum: 100,
+        },
+        rules_config: {
+          type: ['object', 'null'],
+        },
+        ioc_exceptions: {
+          type: ['array', 'null'],
+          items: { type: 'string' },
+        },
+        untrusted_suffixes: {
+          type: ['array', 'null'],
+          items: { type: 'string' },
+        },
+        target_url: {
+          type: ['string', 'null'],
+          maxLength: 2048,
+        },
       },
     }
   }
@@ -1,9 +1,42 @@
 import MerryMaker from '@merrymaker/types'
-import { Alert } from '../models'
-import { AlertEvent, AlertSinkBase } from '../alerts/base'
+import { JobOptions } from 'bull'
+import addMilliseconds from 'date-fns/addMilliseconds'
+import { config } from 'node-config-ts'
+import { validate as validateUUID } from 'uuid'
+import { Alert, AlertDelivery, AllowList, ScanLog } from '../models'
+import {
+  AlertStatus,
+  AlertStatuses,
+  AlertStatusTransitions,
+} from '../models/alerts'
+import { ClientError } from '../api/middleware/client-errors'
+import AllowListService from './allow_list'
+import {
+  acceptsEvent,
+  isMuted,
+  AlertEvent,
+  AlertQueueEvent,
+  AlertRedeliveryJob,
+  AlertRetryJob,
+  AlertSinkBase,
+} from '../alerts/base'
 import GoAlertSink from '../alerts/go-alert'
 import KafkaAlertSink from '../alerts/kafka'
+import TeamsAlertSink from '../alerts/teams'
 import logger from '../loaders/logger'
+import Queues from '../jobs/queues'
+import AlertDeliveryService from './alert_delivery'
+import AuditService from './audit'
+import SettingService, { definitions as settingDefinitions } from './setting'
+import ScanLogArchiveService from './scan_log_archive'
+import {
+  AlertExportFormat,
+  buildAlertView,
+  renderHTML,
+  renderMarkdown,
+} from '../lib/alert-export'
+import { BackoffPolicy, backoffDelay, resolveBackoff } from '../lib/backoff'
+import { MASKED_VALUE, redactHeaders } from '../lib/headers'
 
 type MappedSinks = { [k in MerryMaker.ScanEventType]?: AlertSinkBase[] }
 
@@ -60,6 +93,566 @@ const alertSinks = {
   },
 }
 
+// sinks available as a fallback, by key
+export const sinkRegistry: Record<string, AlertSinkBase> = {
+  goAlert: GoAlertSink,
+  kafka: KafkaAlertSink,
+  teams: TeamsAlertSink,
+}
+
+/**
+ * recordedSink
+ *
+ * Sink of a recorded delivery, attempts record the sink `name`
+ * (registry keys are accepted too)
+ */
+export const recordedSink = (
+  registry: Record<string, AlertSinkBase>,
+  name: string
+): AlertSinkBase | undefined =>
+  registry[name] || Object.values(registry).find((s) => s.name === name)
+
+/**
+ * sinkRuleTypes
+ *
+ * Rules `sink` receives (empty for every rule): the organization
+ * setting of registered sinks, validated when saved, defaulting to
+ * the sink config
+ */
+export const sinkRuleTypes = async (
+  sink: AlertSinkBase,
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<string[]> => {
+  const key = Object.keys(registry).find((k) => registry[k] === sink)
+  const setting = `alerts.sinks.${key}.ruleTypes`
+  if (key === undefined || settingDefinitions[setting] === undefined) {
+    return sink.ruleTypes || []
+  }
+  return SettingService.get<string[]>(setting)
+}
+
+type DeliveryOptions = {
+  maxAttempts?: number
+  // overrides the sink backoff
+  backoff?: Partial<BackoffPolicy>
+  registry?: Record<string, AlertSinkBase>
+  // alert the delivery attempts are recorded against
+  alertID?: string
+  // failed attempt being redelivered
+  redeliveryOf?: string
+  // first attempt made, retry jobs continue the count
+  attempt?: number
+  // retries wait in process instead of being queued (manual alerts)
+  inline?: boolean
+  // queue of retries, `Queues.alertRetryQueue` by default
+  retryQueue?: {
+    add: (job: AlertRetryJob, opts: JobOptions) => Promise<unknown>
+  }
+}
+
+const sleep = (ms: number) =>
+  new Promise((resolve) => setTimeout(resolve, ms))
+
+/**
+ * deliveryBackoff
+ *
+ * Configured backoff, a `retryDelayMs` left in older configs
+ * is used as its base delay
+ */
+export const deliveryBackoff = (): BackoffPolicy => {
+  const { backoff, retryDelayMs } = config.alerts.delivery
+  return typeof retryDelayMs === 'number'
+    ? { ...backoff, baseDelayMs: retryDelayMs }
+    : backoff
+}
+
+if (typeof config.alerts.delivery.retryDelayMs === 'number') {
+  logger.warn({
+    task: 'alert loader',
+    message:
+      'alerts.delivery.retryDelayMs is deprecated, set alerts.delivery.backoff.baseDelayMs instead',
+  })
+}
+
+/**
+ * deliver
+ *
+ * Sends `evt` to `sink`, retrying up to `maxAttempts` times. The
+ * delay between attempts follows the sink's backoff policy and is
+ * recorded with the failed attempt (`next_attempt_at`). Retries are
+ * queued with that delay (see `retry`) and resolve false until made,
+ * `inline` deliveries wait for them instead.
+ *
+ * When every attempt fails the event is delivered to the
+ * sink's (enabled) `fallback`. Sinks are visited at most once per event
+ * to guard against fallback loops. Every attempt is recorded
+ */
+export const deliver = async (
+  sink: AlertSinkBase,
+  evt: AlertEvent,
+  opts: DeliveryOptions = {},
+  visited: Set<AlertSinkBase> = new Set()
+): Promise<boolean> => {
+  const maxAttempts = opts.maxAttempts || config.alerts.delivery.maxAttempts
+  const backoff = resolveBackoff(deliveryBackoff(), sink.backoff, opts.backoff)
+  const registry = opts.registry || sinkRegistry
+  visited.add(sink)
+  // templated bodies are recorded as sent, render errors
+  // surface when sending
+  let sentBody: string | undefined
+  try {
+    sentBody = sink.requestBody ? sink.requestBody(evt) : undefined
+  } catch (e) {
+    sentBody = undefined
+  }
+  const recordAttempt = (
+    attempt: number,
+    status: 'succeeded' | 'failed' | 'dead_lettered',
+    response: Record<string, unknown>,
+    headers: Record<string, string> | undefined,
+    retryDelayMs: number | null = null,
+    at: Date = new Date()
+  ) =>
+    AlertDeliveryService.record({
+      alert_id: opts.alertID || null,
+      scan_id: evt.scan_id || null,
+      sink: sink.name,
+      attempt,
+      status,
+      // signatures are never recorded
+      request: {
+        ...evt,
+        ...(headers
+          ? {
+              headers: redactHeaders(headers, {
+                allow: [],
+                mask: sink.secretHeaders || [],
+              }),
+            }
+          : {}),
+        ...(sentBody !== undefined ? { sent_body: sentBody } : {}),
+      },
+      response,
+      retry_delay_ms: retryDelayMs,
+      next_attempt_at:
+        retryDelayMs === null ? null : addMilliseconds(at, retryDelayMs),
+      redelivery_of: opts.redeliveryOf || null,
+      created_at: at,
+    })
+  let lastErr: Error
+  for (let attempt = opts.attempt || 1; attempt <= maxAttempts; attempt += 1) {
+    // signed per attempt, timestamps must stay fresh
+    const headers = sink.requestHeaders ? sink.requestHeaders(evt) : undefined
+    try {
+      const result = await (headers ? sink.send(evt, headers) : sink.send(evt))
+      await recordAttempt(attempt, 'succeeded', { result }, headers)
+      return result
+    } catch (e) {
+      lastErr = e
+      // the last attempt is dead-lettered, earlier ones will be retried
+      const retryDelayMs =
+        attempt < maxAttempts ? backoffDelay(backoff, attempt) : null
+      await recordAttempt(
+        attempt,
+        retryDelayMs === null ? 'dead_lettered' : 'failed',
+        { error: e.message },
+        headers,
+        retryDelayMs
+      )
+      logger.warn({
+        task: 'alert/deliver',
+        sink: sink.name,
+        attempt,
+        retry_delay_ms: retryDelayMs,
+        error: e.message,
+      })
+      if (retryDelayMs === null) break
+      if (!opts.inline) {
+        const retryQueue = opts.retryQueue || Queues.alertRetryQueue
+        await retryQueue.add(
+          {
+            sink: sink.name,
+            event: evt,
+            alert_id: opts.alertID,
+            redelivery_of: opts.redeliveryOf,
+            attempt: attempt + 1,
+            max_attempts: maxAttempts,
+            backoff: opts.backoff,
+            visited: Array.from(visited).map((s) => s.name),
+          },
+          { delay: retryDelayMs, removeOnComplete: true }
+        )
+        return false
+      }
+      await sleep(retryDelayMs)
+    }
+  }
+  const fallback = sink.fallback ? registry[sink.fallback] : undefined
+  if (fallback === undefined || !fallback.enabled) {
+    throw lastErr
+  }
+  if (visited.has(fallback)) {
+    logger.error({
+      task: 'alert/deliver',
+      sink: sink.name,
+      error: `fallback loop detected (${sink.fallback})`,
+    })
+    throw lastErr
+  }
+  logger.info({
+    task: 'alert/deliver',
+    sink: sink.name,
+    message: `delivering to fallback "${fallback.name}"`,
+  })
+  return deliver(fallback, evt, { ...opts, attempt: 1 }, visited)
+}
+
+/**
+ * retry
+ *
+ * Makes the queued attempt of a failed delivery (see `deliver`),
+ * further failures are queued again or go to the fallback
+ */
+const retry = async (
+  job: AlertRetryJob,
+  opts: Pick<DeliveryOptions, 'registry' | 'retryQueue'> = {}
+): Promise<boolean> => {
+  const registry = opts.registry || sinkRegistry
+  const sink = recordedSink(registry, job.sink)
+  if (sink === undefined || !sink.enabled) {
+    throw new Error(`sink "${job.sink}" is not enabled`)
+  }
+  const visited = new Set(
+    job.visited
+      .map((name) => recordedSink(registry, name))
+      .filter((s): s is AlertSinkBase => s !== undefined)
+  )
+  return deliver(
+    sink,
+    job.event,
+    {
+      ...opts,
+      registry,
+      alertID: job.alert_id,
+      redeliveryOf: job.redelivery_of,
+      attempt: job.attempt,
+      maxAttempts: job.max_attempts,
+      backoff: job.backoff,
+    },
+    visited
+  )
+}
+
+export type ReplayResult = {
+  delivery_id: string
+  sink: string
+  delivered: boolean
+  error?: string
+}
+
+/**
+ * redeliverAttempt
+ *
+ * Resends the recorded event of a failed attempt to its sink,
+ * new attempts link back to it (`redelivery_of`)
+ */
+const redeliverAttempt = async (
+  delivery: AlertDelivery,
+  registry: Record<string, AlertSinkBase>
+): Promise<ReplayResult> => {
+  const sink = recordedSink(registry, delivery.sink)
+  // headers are re-signed and bodies re-rendered on delivery
+  // eslint-disable-next-line @typescript-eslint/no-unused-vars
+  const { headers, sent_body, ...evt } = (delivery.request ||
+    {}) as AlertEvent & {
+    headers?: unknown
+    sent_body?: unknown
+  }
+  const result: ReplayResult = {
+    delivery_id: delivery.id,
+    sink: delivery.sink,
+    delivered: false,
+  }
+  try {
+    if (sink === undefined || !sink.enabled) {
+      throw new Error(`sink "${delivery.sink}" is not enabled`)
+    }
+    result.delivered = await deliver(sink, evt, {
+      alertID: delivery.alert_id || undefined,
+      redeliveryOf: delivery.id,
+      registry,
+    })
+  } catch (e) {
+    result.error = e.message
+  }
+  return result
+}
+
+/**
+ * replay
+ *
+ * Redelivers the event of a dead-lettered attempt to its sink with a
+ * fresh retry budget, on behalf of `actor`. New attempts are recorded
+ * as deliveries of the same alert, the replayed one only records the
+ * replay (`replayed_at`, `replayed_by`)
+ */
+const replay = async (
+  id: string,
+  actor: string,
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<ReplayResult> => {
+  const delivery = await AlertDeliveryService.markForReplay(id, actor)
+  const result = await redeliverAttempt(delivery, registry)
+  logger.info({ task: 'alert/replay', actor, ...result })
+  await AuditService.record(actor, {
+    action: 'replay',
+    entity_type: 'alert_sink',
+    entity_id: result.sink,
+    after: result,
+  })
+  return result
+}
+
+// attempts that can be redelivered, a succeeded attempt never is
+const REDELIVERABLE_STATUSES = ['failed', 'dead_lettered']
+
+/**
+ * requestRedelivery
+ *
+ * Queues a redelivery of a failed attempt of alert `alertID`
+ * to the same sink
+ */
+const requestRedelivery = async (
+  alertID: string,
+  deliveryID: string,
+  actor: string,
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<{ job_id: string; delivery_id: string; sink: string }> => {
+  const delivery = await AlertDelivery.query()
+    .findOne({ id: deliveryID, alert_id: alertID })
+    .throwIfNotFound()
+  if (!REDELIVERABLE_STATUSES.includes(delivery.status)) {
+    throw new ClientError(
+      `delivery ${deliveryID} is ${delivery.status}, only failed attempts can be redelivered`
+    )
+  }
+  const sink = recordedSink(registry, delivery.sink)
+  if (sink === undefined || !sink.enabled) {
+    throw new ClientError(`sink "${delivery.sink}" is not enabled`)
+  }
+  const job = await Queues.alertRedeliveryQueue.add(
+    { delivery_id: deliveryID, actor },
+    { removeOnComplete: true }
+  )
+  logger.info({
+    task: 'alert/redeliver',
+    alert_id: alertID,
+    delivery_id: deliveryID,
+    sink: delivery.sink,
+    actor,
+  })
+  await AuditService.record(actor, {
+    action: 'redeliver',
+    entity_type: 'alert_sink',
+    entity_id: delivery.sink,
+    after: { alert_id: alertID, delivery_id: deliveryID },
+  })
+  return { job_id: String(job.id), delivery_id: deliveryID, sink: delivery.sink }
+}
+
+/**
+ * redeliver
+ *
+ * Processes a redelivery job, see `requestRedelivery`
+ */
+const redeliver = async (
+  job: AlertRedeliveryJob,
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<ReplayResult> => {
+  const delivery = await AlertDelivery.query()
+    .findById(job.delivery_id)
+    .throwIfNotFound()
+  const result = await redeliverAttempt(delivery, registry)
+  logger.info({ task: 'alert/redeliver', actor: job.actor, ...result })
+  return result
+}
+
+// manual alert of `fire-http-alert`
+export type AlertSpec = Partial<Omit<AlertEvent, 'body'>> & {
+  // sink registry key, the HTTP sink (goAlert) by default
+  sink?: string
+}
+
+export type FireResult = {
+  // position of the spec in the batch
+  index: number
+  sink: string
+  delivered: boolean
+  latency_ms: number
+  error?: string
+}
+
+export type FireOptions = Omit<DeliveryOptions, 'alertID' | 'redeliveryOf'> & {
+  // alerts delivered at once
+  concurrency?: number
+}
+
+/**
+ * fire
+ *
+ * Delivers a manual alert (`spec`) to its sink with the usual
+ * retries and fallback, failures are reported in the result
+ */
+const fire = async (
+  spec: AlertSpec,
+  opts: FireOptions = {},
+  index = 0
+): Promise<FireResult> => {
+  const registry = opts.registry || sinkRegistry
+  const key = spec.sink || 'goAlert'
+  const start = Date.now()
+  const result = (delivered: boolean, error?: string): FireResult => ({
+    index,
+    sink: key,
+    delivered,
+    latency_ms: Date.now() - start,
+    ...(error ? { error } : {}),
+  })
+  const sink = registry[key]
+  if (sink === undefined || !sink.enabled) {
+    return result(false, `sink "${key}" is not enabled`)
+  }
+  const evt: AlertEvent = {
+    type: spec.type || 'info',
+    name: spec.name || 'manual-alert',
+    scan_id: spec.scan_id,
+    message: spec.message || 'manual alert',
+    details: spec.details || '',
+  }
+  try {
+    // manual alerts report the outcome of every attempt
+    return result(
+      (await deliver(sink, evt, { ...opts, registry, inline: true })) !== false
+    )
+  } catch (e) {
+    return result(false, e.message)
+  }
+}
+
+/**
+ * fireBatch
+ *
+ * Fires every spec, at most `concurrency` at once. Results
+ * follow the order of `specs`
+ */
+const fireBatch = async (
+  specs: AlertSpec[],
+  opts: FireOptions = {}
+): Promise<FireResult[]> => {
+  const results: FireResult[] = new Array(specs.length)
+  let next = 0
+  const worker = async () => {
+    while (next < specs.length) {
+      const index = next
+      next += 1
+      results[index] = await fire(specs[index], opts, index)
+    }
+  }
+  const workers = Math.max(1, Math.min(opts.concurrency || 1, specs.length))
+  await Promise.all(Array.from({ length: workers }, worker))
+  return results
+}
+
+export type TestDeliveryResult = {
+  sink: string
+  delivered: boolean
+  // response status, null for sinks without HTTP responses (kafka)
+  status: number | null
+  latency_ms: number
+  error?: string
+}
+
+// synthetic event of test deliveries, never recorded
+export const testEvent = (): AlertEvent => ({
+  type: 'info',
+  name: 'test-delivery',
+  scan_id: '',
+  message: '[TEST] merrymaker test delivery, please ignore',
+  details: 'Sent to check the sink configuration, no alert was created',
+})
+
+/**
+ * sendTestEvent
+ *
+ * Sends a synthetic event to the sink `key` once. Signing and
+ * tokens of the sink are used, their values are masked in the result
+ */
+const sendTestEvent = async (
+  key: string,
+  registry: Record<string, AlertSinkBase>
+): Promise<TestDeliveryResult> => {
+  const sink = registry[key]
+  if (sink === undefined) {
+    throw new ClientError(`unknown sink "${key}"`)
+  }
+  if (!sink.enabled) {
+    throw new ClientError(`sink "${key}" is not enabled`)
+  }
+  const secrets = (sink.secrets ? sink.secrets() : []).filter((s) => !!s)
+  const mask = (message: string) =>
+    secrets.reduce((m, secret) => m.split(secret).join(MASKED_VALUE), message)
+  const evt = testEvent()
+  const start = Date.now()
+  const result = (
+    delivered: boolean,
+    status: number | null,
+    error?: string
+  ): TestDeliveryResult => ({
+    sink: key,
+    delivered,
+    status,
+    latency_ms: Date.now() - start,
+    ...(error ? { error: mask(error) } : {}),
+  })
+  try {
+    const headers = sink.requestHeaders ? sink.requestHeaders(evt) : undefined
+    if (sink.request) {
+      const res = await sink.request(evt, headers)
+      const ok = res.status >= 200 && res.status < 300
+      return result(
+        ok,
+        res.status,
+        ok ? undefined : `responded with ${res.status} (${res.body})`
+      )
+    }
+    const sent = await (headers ? sink.send(evt, headers) : sink.send(evt))
+    return result(sent !== false, null)
+  } catch (e) {
+    return result(false, null, e.message)
+  }
+}
+
+/**
+ * testDelivery
+ *
+ * Sends a test event to the sink `key` on behalf of `actor`, without
+ * creating an alert or recording the attempt (see `sendTestEvent`)
+ */
+const testDelivery = async (
+  key: string,
+  actor: string,
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<TestDeliveryResult> => {
+  const result = await sendTestEvent(key, registry)
+  await AuditService.record(actor, {
+    action: 'test',
+    entity_type: 'alert_sink',
+    entity_id: key,
+    after: result,
+  })
+  return result
+}
+
 if (GoAlertSink.enabled) {
   alertSinks.use('error', GoAlertSink)
   alertSinks.use('rule-alert', GoAlertSink)
@@ -69,9 +662,175 @@ if (KafkaAlertSink.enabled) {
   alertSinks.use('rule-alert', KafkaAlertSink)
 }
 
+if (TeamsAlertSink.enabled) {
+  alertSinks.use('error', TeamsAlertSink)
+  alertSinks.use('rule-alert', TeamsAlertSink)
+}
+
 const view = async (id: string): Promise<Alert> =>
   Alert.query().findById(id).throwIfNotFound()
 
+/**
+ * exportAlert
+ *
+ * Renders a single alert (with its site) as standalone HTML or Markdown
+ */
+const exportAlert = async (
+  id: string,
+  format: AlertExportFormat = 'html'
+): Promise<string> => {
+  const alert = await Alert.query()
+    .findById(id)
+    .withGraphFetched('site')
+    .throwIfNotFound()
+  const view = buildAlertView(alert, config.server.uri)
+  return format === 'md' ? renderMarkdown(view) : renderHTML(view)
+}
+
+export type TriggeringEvent = {
+  event_id: string | null
+  // false when the alert has no event or it was purged
+  available: boolean
+  scan_log?: ScanLog
+}
+
+/**
+ * triggeringEvent
+ *
+ * Resolves the scan log event referenced by the alert's
+ * `context.event_id`
+ */
+const triggeringEvent = async (id: string): Promise<TriggeringEvent> => {
+  const alert = await view(id)
+  const eventID = alert.context?.event_id
+  if (typeof eventID !== 'string') {
+    return { event_id: null, available: false }
+  }
+  const scanLog = validateUUID(eventID)
+    ? await ScanLog.query().findById(eventID)
+    : undefined
+  if (!scanLog) {
+    return { event_id: eventID, available: false }
+  }
+  return {
+    event_id: eventID,
+    available: true,
+    scan_log: await ScanLogArchiveService.restore(scanLog),
+  }
+}
+
+export type TransitionOptions = {
+  note?: string
+  // false positives only, allow-list the alert's `context.domain`
+  allowList?: boolean
+}
+
+export type TransitionResult = {
+  alert: Alert
+  // entry matching the domain, when requested
+  allow_list?: AllowList
+}
+
+/**
+ * transition
+ *
+ * Moves an alert to `status` on behalf of `actor`, following
+ * `AlertStatusTransitions`. Marking a false positive can allow-list
+ * the alerted domain at the same time
+ */
+const transition = async (
+  id: string,
+  status: AlertStatus,
+  actor: string,
+  opts: TransitionOptions = {}
+): Promise<TransitionResult> => {
+  const alert = await view(id)
+  const current = alert.status || 'open'
+  if (!AlertStatusTransitions[current].includes(status)) {
+    throw new ClientError(`cannot move a ${current} alert to ${status}`)
+  }
+  const domain = alert.context?.domain
+  if (opts.allowList) {
+    if (status !== 'false_positive') {
+      throw new ClientError('only false positives can be allow-listed')
+    }
+    if (typeof domain !== 'string' || domain.length === 0) {
+      throw new ClientError('alert has no domain to allow-list')
+    }
+  }
+  const updated = await Alert.query().patchAndFetchById(id, {
+    status,
+    status_updated_at: new Date(),
+    status_updated_by: actor,
+    status_note: opts.note || null,
+  })
+  if (!opts.allowList) {
+    return { alert: updated }
+  }
+  // (key, type) is unique, an expired entry is made permanent again
+  const existing = await AllowListService.findOne({
+    type: 'fqdn',
+    key: domain as string,
+  })
+  let entry: AllowList
+  if (!existing) {
+    entry = await AllowListService.create(
+      {
+        type: 'fqdn',
+        key: domain as string,
+      },
+      actor
+    )
+  } else if (existing.expires_at && new Date(existing.expires_at) <= new Date()) {
+    entry = await AllowListService.update(
+      existing.id,
+      { expires_at: null },
+      actor
+    )
+  } else {
+    entry = existing
+  }
+  logger.info({
+    task: 'alert/transition',
+    alert_id: id,
+    actor,
+    message: `allow-listed ${domain} as a false positive`,
+  })
+  return { alert: updated, allow_list: entry }
+}
+
+export type AlertStatusCounts = Record<AlertStatus, number> & {
+  // acknowledged, resolved and false positive alerts
+  handled: number
+}
+
+/**
+ * statusCounts
+ *
+ * Number of alerts by status, every status is present
+ */
+const statusCounts = async (): Promise<AlertStatusCounts> => {
+  const rows = ((await Alert.query()
+    .select('status')
+    .count('id', { as: 'total' })
+    .groupBy('status')) as unknown) as Array<{ status: string; total: string }>
+  const counts = AlertStatuses.reduce(
+    (acc, status) => {
+      acc[status] = 0
+      return acc
+    },
+    { handled: 0 } as AlertStatusCounts
+  )
+  rows.forEach((row) => {
+    const total = parseInt(row.total, 10)
+    counts[row.status as AlertStatus] = total
+    if (row.status !== 'open') {
+      counts.handled += total
+    }
+  })
+  return counts
+}
+
 const distinct = async (column: string): Promise<Alert[]> =>
   Alert.query().distinct(column)
 
@@ -105,18 +864,126 @@ function toAlertEvent(evt: MerryMaker.EventResult): AlertEvent {
   }
 }
 
-export async function process(evt: MerryMaker.EventResult): Promise<void> {
+export type DispatchResult = {
+  // sinks the event was delivered to
+  delivered: number
+  // sinks in quiet hours
+  muted: number
+}
+
+/**
+ * eventSeverity
+ *
+ * Severity of a queued event, jobs queued without one fall
+ * back to their Alert record
+ */
+const eventSeverity = async (
+  evt: AlertQueueEvent
+): Promise<string | undefined> => {
+  if (evt.severity || !evt.alert_id) return evt.severity
+  const alert = await Alert.query().findById(evt.alert_id)
+  return alert?.severity
+}
+
+/**
+ * dispatch
+ *
+ * Delivers `evt` to `sinks`, sinks in quiet hours (or every sink
+ * with the `alerts.dryRun` setting) record a muted attempt instead
+ */
+export const dispatch = async (
+  sinks: AlertSinkBase[],
+  evt: AlertQueueEvent,
+  now: Date = new Date()
+): Promise<DispatchResult> => {
   const alertEvent = toAlertEvent(evt)
-  if (alertSinks.sinks[evt.entry] === undefined) return
+  const severity = await eventSeverity(evt)
+  const accepted = await Promise.all(
+    sinks.map(async (s) => acceptsEvent(s, evt, await sinkRuleTypes(s)))
+  )
+  const targets = sinks.filter((_s, i) => accepted[i])
+  const dryRun = await SettingService.get<boolean>('alerts.dryRun')
+  const muted = targets.filter((s) => dryRun || isMuted(s, severity, now))
   await Promise.all(
-    alertSinks.sinks[evt.entry].map((s: AlertSinkBase) => s.send(alertEvent))
+    targets.map((s) =>
+      muted.includes(s)
+        ? AlertDeliveryService.record({
+            alert_id: evt.alert_id || null,
+            scan_id: evt.scan_id || null,
+            sink: s.name,
+            attempt: 0,
+            status: 'muted',
+            request: alertEvent,
+            response: {
+              reason: dryRun ? 'dry_run' : 'quiet_hours',
+              severity: severity || null,
+            },
+          })
+        : deliver(s, alertEvent, { alertID: evt.alert_id })
+    )
   )
+  if (muted.length) {
+    logger.info({
+      task: 'alert/dispatch',
+      alert_id: evt.alert_id,
+      muted: muted.map((s) => s.name),
+    })
+  }
+  return { delivered: targets.length - muted.length, muted: muted.length }
+}
+
+export async function process(evt: AlertQueueEvent): Promise<DispatchResult> {
+  if (alertSinks.sinks[evt.entry] === undefined) {
+    return { delivered: 0, muted: 0 }
+  }
+  return dispatch(alertSinks.sinks[evt.entry], evt)
+}
+
+export type AlertSinkSummary = {
+  key: string
+  name: string
+  enabled: boolean
+  fallback: string | null
+  // empty when the sink receives every rule
+  rule_types: string[]
 }
 
+/**
+ * sinks
+ *
+ * Configured alert sinks and their rule filters in use
+ */
+const sinks = async (
+  registry: Record<string, AlertSinkBase> = sinkRegistry
+): Promise<AlertSinkSummary[]> =>
+  Promise.all(
+    Object.entries(registry).map(async ([key, sink]) => ({
+      key,
+      name: sink.name,
+      enabled: sink.enabled,
+      fallback: sink.fallback || null,
+      rule_types: await sinkRuleTypes(sink, registry),
+    }))
+  )
+
 export default {
   dateHist,
+  deliver,
+  dispatch,
   distinct,
+  fire,
+  fireBatch,
   process,
   destroy,
+  redeliver,
+  replay,
+  requestRedelivery,
+  retry,
+  sinks,
+  exportAlert,
+  statusCounts,
+  testDelivery,
+  transition,
+  triggeringEvent,
   view,
 }
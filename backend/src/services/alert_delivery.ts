@@ -0,0 +1,223 @@
+import { AlertDelivery, AlertDeliveryAttributes } from '../models'
+import { redactHeaders } from '../lib/headers'
+import { ClientError } from '../api/middleware/client-errors'
+import logger from '../loaders/logger'
+
+type Exchange = Record<string, unknown> | null | undefined
+
+// masks sensitive values of a captured `headers` object
+const withRedactedHeaders = (exchange: Exchange): Exchange => {
+  if (!exchange || typeof exchange.headers !== 'object') {
+    return exchange
+  }
+  return {
+    ...exchange,
+    headers: redactHeaders(exchange.headers as Record<string, unknown>),
+  }
+}
+
+/**
+ * alertDeliveryRequestView
+ *
+ * Recorded request of a delivery attempt, sensitive headers masked
+ */
+export const alertDeliveryRequestView = (delivery: AlertDelivery): Exchange =>
+  withRedactedHeaders(delivery.request)
+
+/**
+ * alertDeliveryResponseView
+ *
+ * Recorded response of a delivery attempt, sensitive headers masked
+ */
+export const alertDeliveryResponseView = (
+  delivery: AlertDelivery
+): Exchange => withRedactedHeaders(delivery.response)
+
+/**
+ * record
+ *
+ * Persists a single delivery attempt, captured headers are stored
+ * masked. Failures are logged, never thrown, so history does not
+ * block delivery
+ */
+const record = async (
+  attrs: AlertDeliveryAttributes
+): Promise<AlertDelivery | null> => {
+  try {
+    return await AlertDelivery.query().insert({
+      ...attrs,
+      request: withRedactedHeaders(attrs.request),
+      response: withRedactedHeaders(attrs.response),
+    })
+  } catch (e) {
+    logger.error({
+      module: 'services/alert_delivery',
+      method: 'record',
+      sink: attrs.sink,
+      error: e.message,
+    })
+    return null
+  }
+}
+
+/**
+ * listByAlert
+ *
+ * Delivery attempts of an alert, oldest first,
+ * limited to `statuses` when set
+ */
+const listByAlert = async (
+  alertID: string,
+  statuses?: string[]
+): Promise<AlertDelivery[]> =>
+  AlertDelivery.query()
+    .where('alert_id', alertID)
+    .modify((builder) => {
+      if (statuses) {
+        builder.whereIn('status', statuses)
+      }
+    })
+    .orderBy([
+      { column: 'created_at', order: 'asc' },
+      { column: 'attempt', order: 'asc' },
+    ])
+
+/**
+ * listViewsByAlert
+ *
+ * Same as `listByAlert`, with captured headers masked for display
+ */
+const listViewsByAlert = async (
+  alertID: string,
+  statuses?: string[]
+): Promise<AlertDeliveryAttributes[]> => {
+  const deliveries = await listByAlert(alertID, statuses)
+  return deliveries.map((d) => ({
+    ...d.toJSON(),
+    request: alertDeliveryRequestView(d),
+    response: alertDeliveryResponseView(d),
+  }))
+}
+
+export type DeliveryHistory = {
+  sink: string
+  // status of the latest attempt
+  status: string
+  attempts: number
+  first_attempt_at?: Date
+  last_attempt_at?: Date
+  // retry of a failed latest attempt, null without one
+  next_attempt_at: Date | null
+  // time left before that retry (ms), 0 once due
+  next_retry_in_ms: number | null
+  // oldest first, the latest `limit` when set
+  history: AlertDeliveryAttributes[]
+}
+
+/**
+ * historyByAlert
+ *
+ * Delivery attempts of an alert grouped per sink (in order of
+ * their first attempt), headers masked like `listViewsByAlert`.
+ * Sinks waiting for a retry report it relative to `now`
+ */
+const historyByAlert = async (
+  alertID: string,
+  limit?: number,
+  now: Date = new Date()
+): Promise<DeliveryHistory[]> => {
+  const bySink = new Map<string, AlertDeliveryAttributes[]>()
+  for (const delivery of await listViewsByAlert(alertID)) {
+    const attempts = bySink.get(delivery.sink) || []
+    attempts.push(delivery)
+    bySink.set(delivery.sink, attempts)
+  }
+  return Array.from(bySink.entries()).map(([sink, attempts]) => {
+    const latest = attempts[attempts.length - 1]
+    const nextAttemptAt =
+      latest.status === 'failed' && latest.next_attempt_at
+        ? new Date(latest.next_attempt_at)
+        : null
+    return {
+      sink,
+      status: latest.status,
+      attempts: attempts.length,
+      first_attempt_at: attempts[0].created_at,
+      last_attempt_at: latest.created_at,
+      next_attempt_at: nextAttemptAt,
+      next_retry_in_ms: nextAttemptAt
+        ? Math.max(0, nextAttemptAt.valueOf() - now.valueOf())
+        : null,
+      history: limit ? attempts.slice(-limit) : attempts,
+    }
+  })
+}
+
+/**
+ * listDeadLettered
+ *
+ * Dead-lettered attempts not replayed yet, newest first,
+ * limited to `sink` when set
+ */
+const listDeadLettered = async (
+  opts: { sink?: string; limit?: number } = {}
+): Promise<AlertDelivery[]> =>
+  AlertDelivery.query()
+    .where('status', 'dead_lettered')
+    .whereNull('replayed_at')
+    .modify((builder) => {
+      if (opts.sink) {
+        builder.where('sink', opts.sink)
+      }
+    })
+    .orderBy('created_at', 'desc')
+    .limit(opts.limit || 100)
+
+/**
+ * markForReplay
+ *
+ * Records who replayed a dead-lettered attempt and when, an attempt
+ * is replayed once. The attempt is otherwise left as is, the replay
+ * attempts are recorded as new deliveries (`redelivery_of`)
+ */
+const markForReplay = async (
+  id: string,
+  actor: string
+): Promise<AlertDelivery> =>
+  AlertDelivery.transaction(async (trx) => {
+    const delivery = await AlertDelivery.query(trx)
+      .findById(id)
+      .forUpdate()
+      .throwIfNotFound()
+    if (delivery.status !== 'dead_lettered') {
+      throw new ClientError(
+        `delivery ${id} is ${delivery.status}, only dead-lettered attempts can be replayed`
+      )
+    }
+    if (delivery.replayed_at) {
+      throw new ClientError(
+        `delivery ${id} was already replayed by ${delivery.replayed_by}`
+      )
+    }
+    const marked = await AlertDelivery.query(trx).patchAndFetchById(id, {
+      replayed_at: new Date(),
+      replayed_by: actor,
+    })
+    logger.info({
+      module: 'services/alert_delivery',
+      method: 'markForReplay',
+      delivery_id: id,
+      sink: delivery.sink,
+      actor,
+    })
+    return marked
+  })
+
+export default {
+  record,
+  listByAlert,
+  listViewsByAlert,
+  historyByAlert,
+  listDeadLettered,
+  markForReplay,
+}
@@ -0,0 +1,163 @@
+import { Job, JobId, Queue } from 'bull'
+import { config } from 'node-config-ts'
+import { AlertQueueEvent } from '../alerts/base'
+import Queues from '../jobs/queues'
+import logger from '../loaders/logger'
+
+export type DependencyState = 'completed' | 'failed' | 'pending'
+
+/**
+ * dependencyState
+ *
+ * State of the scan log job an alert job depends on. Scan log jobs
+ * are removed once completed, a missing job counts as completed
+ */
+export const dependencyState = async (
+  jobID: JobId,
+  queue: Queue = Queues.scannerEventQueue
+): Promise<DependencyState> => {
+  const job = await queue.getJob(jobID)
+  if (!job) return 'completed'
+  const state = await job.getState()
+  if (state === 'completed' || state === 'failed') return state
+  return 'pending'
+}
+
+export class DependencyFailedError extends Error {
+  constructor(public dependsOn: JobId) {
+    super(`scan log job ${dependsOn} failed, alert not delivered`)
+    this.name = 'DependencyFailedError'
+  }
+}
+
+/**
+ * holdOptions
+ *
+ * Options of alert jobs held until their scan log job completes,
+ * the scan log worker promotes them once bull marked it completed
+ */
+export const holdOptions = (): { delay: number } => ({
+  delay: config.alerts.delivery.dependencyHoldMs,
+})
+
+/**
+ * ready
+ *
+ * True when `job` can be delivered. Jobs whose dependency is still
+ * pending are queued again for another hold, jobs whose dependency
+ * failed throw `DependencyFailedError`
+ */
+const ready = async (
+  job: Job<AlertQueueEvent>,
+  queue: Queue = Queues.scannerEventQueue
+): Promise<boolean> => {
+  const dependsOn = job.data.depends_on
+  if (dependsOn === undefined) return true
+  const state = await dependencyState(dependsOn, queue)
+  if (state === 'failed') {
+    throw new DependencyFailedError(dependsOn)
+  }
+  if (state === 'completed') return true
+  logger.info({
+    module: 'services/alert_dependency',
+    method: 'ready',
+    job_id: job.id,
+    depends_on: dependsOn,
+  })
+  await job.queue.add(job.data, {
+    ...holdOptions(),
+    attempts: job.opts.attempts,
+    removeOnComplete: job.opts.removeOnComplete,
+  })
+  return false
+}
+
+export type ReleaseResult = {
+  // dependency completed, promoted for delivery
+  released: number
+  // dependency failed, promoted so the worker fails them
+  failed: number
+  // dependency still pending
+  held: number
+}
+
+/**
+ * releaseHeld
+ *
+ * Reaper of held alert jobs, promotes those whose dependency
+ * finished without promoting them (the scan log job failed, or its
+ * worker stopped before the promotion) so none stays held past a
+ * finished dependency. Failed dependencies fail the alert job in
+ * the worker instead of leaving it pending
+ */
+const releaseHeld = async (
+  alertQueue: Queue<AlertQueueEvent> = Queues.alertQueue,
+  queue: Queue = Queues.scannerEventQueue
+): Promise<ReleaseResult> => {
+  const result = { released: 0, failed: 0, held: 0 }
+  const jobs = (await alertQueue.getDelayed()).filter(
+    (job) => job && job.data.depends_on !== undefined
+  )
+  for (const job of jobs) {
+    const state = await dependencyState(job.data.depends_on, queue)
+    if (state === 'pending') {
+      result.held += 1
+      continue
+    }
+    try {
+      await job.promote()
+    } catch (e) {
+      // promoted or removed meanwhile
+      continue
+    }
+    result[state === 'completed' ? 'released' : 'failed'] += 1
+  }
+  if (result.released || result.failed) {
+    logger.info({
+      module: 'services/alert_dependency',
+      method: 'releaseHeld',
+      ...result,
+    })
+  }
+  return result
+}
+
+export type HeldAlert = {
+  job_id: string
+  scan_id: string
+  // scan log job the alert job waits for
+  depends_on: string
+}
+
+/**
+ * listHeld
+ *
+ * Alert jobs waiting for their scan log job
+ */
+const listHeld = async (
+  alertQueue: Queue<AlertQueueEvent> = Queues.alertQueue
+): Promise<HeldAlert[]> =>
+  (await alertQueue.getDelayed())
+    .filter((job) => job && job.data.depends_on !== undefined)
+    .map((job) => ({
+      job_id: String(job.id),
+      scan_id: job.data.scan_id,
+      depends_on: job.data.depends_on,
+    }))
+
+/**
+ * countHeld
+ *
+ * Number of alert jobs waiting for their scan log job
+ */
+const countHeld = async (
+  alertQueue: Queue<AlertQueueEvent> = Queues.alertQueue
+): Promise<number> => (await listHeld(alertQueue)).length
+
+export default {
+  dependencyState,
+  ready,
+  releaseHeld,
+  listHeld,
+  countHeld,
+}
@@ -1,6 +1,10 @@
 import { cachedView } from '../api/crud/cache'
 import LRUCache from 'lru-native2'
+import { QueryBuilder, raw } from 'objection'
 import { AllowList, AllowListAttributes } from '../models'
+import { ClientError } from '../api/middleware/client-errors'
+import logger from '../loaders/logger'
+import AuditService from './audit'
 
 export const cache = new LRUCache<number>({
   maxElements: 10000,
@@ -11,30 +15,180 @@ export const cache = new LRUCache<number>({
 
 const cached_view = cachedView(AllowList.tableName, cache)
 
+/**
+ * validateExpiry
+ *
+ * New expiry dates must be valid and in the future
+ */
+const validateExpiry = (expiresAt: Date | string | null | undefined): void => {
+  if (expiresAt === undefined || expiresAt === null) return
+  const expires = new Date(expiresAt)
+  if (isNaN(expires.getTime())) {
+    throw new ClientError(`invalid expires_at "${expiresAt}"`)
+  }
+  if (expires <= new Date()) {
+    throw new ClientError('expires_at must be in the future')
+  }
+}
+
+/**
+ * whereActive
+ *
+ * Limits `builder` to entries that have not expired at `now`
+ */
+export const whereActive = (
+  builder: QueryBuilder<AllowList>,
+  now: Date = new Date()
+): QueryBuilder<AllowList> =>
+  builder.where((b) =>
+    b.whereNull('expires_at').orWhere('expires_at', '>', now)
+  )
+
 const view = async (id: string): Promise<AllowList> =>
   AllowList.query().findById(id).throwIfNotFound()
 
 const update = async (
   id: string,
-  attrs: Partial<AllowListAttributes>
-): Promise<AllowList> => AllowList.query().patchAndFetchById(id, attrs)
+  attrs: Partial<AllowListAttributes>,
+  actor?: string
+): Promise<AllowList> => {
+  const current = await view(id)
+  if (attrs.expires_at) {
+    // an unchanged (past) expiry does not block other edits
+    const unchanged =
+      current.expires_at &&
+      new Date(current.expires_at).getTime() ===
+        new Date(attrs.expires_at).getTime()
+    if (!unchanged) {
+      validateExpiry(attrs.expires_at)
+    }
+  }
+  const updated = await AllowList.query().patchAndFetchById(id, attrs)
+  await AuditService.record(actor, {
+    action: 'update',
+    entity_type: 'allow_list',
+    entity_id: id,
+    before: current,
+    after: updated,
+  })
+  return updated
+}
 
 const findOne = async (
   query: Partial<AllowListAttributes>
 ): Promise<AllowList> => AllowList.query().findOne(query)
 
+// entry matching `query` that has not expired (used by rule lookups)
+const findActive = async (
+  query: Partial<AllowListAttributes>
+): Promise<AllowList> =>
+  AllowList.query().modify(whereActive).findOne(query)
+
+export type AllowListMatch = {
+  total: number
+  // earliest expiry of the matching entries, null when none expires
+  expires_at: Date | null
+}
+
+/**
+ * matchMany
+ *
+ * Active entries of `type` matching each of `values`, keys are
+ * regular expressions (like the list `key` filter). One query,
+ * values without a match are left out
+ */
+const matchMany = async (
+  type: string,
+  values: string[]
+): Promise<Record<string, AllowListMatch>> => {
+  if (values.length === 0) {
+    return {}
+  }
+  const rows = ((await AllowList.query()
+    .select(raw('v.value'))
+    .count('allow_list.id', { as: 'total' })
+    .min('allow_list.expires_at', { as: 'expires_at' })
+    .joinRaw(
+      'join unnest(?::text[]) as v(value) on v.value ~ allow_list.key',
+      [values]
+    )
+    .where('allow_list.type', type)
+    .modify(whereActive)
+    .groupBy('v.value')) as unknown) as Array<{
+    value: string
+    total: string
+    expires_at: Date | null
+  }>
+  return rows.reduce((acc, row) => {
+    acc[row.value] = { total: Number(row.total), expires_at: row.expires_at }
+    return acc
+  }, {} as Record<string, AllowListMatch>)
+}
+
 const create = async (
-  attrs: Partial<AllowListAttributes>
-): Promise<AllowList> => AllowList.query().insert(attrs)
+  attrs: Partial<AllowListAttributes>,
+  actor?: string
+): Promise<AllowList> => {
+  validateExpiry(attrs.expires_at)
+  const created = await AllowList.query().insert(attrs)
+  await AuditService.record(actor, {
+    action: 'create',
+    entity_type: 'allow_list',
+    entity_id: created.id,
+    after: created,
+  })
+  return created
+}
 
-const destroy = async (id: string): Promise<number> =>
-  AllowList.query().deleteById(id)
+const destroy = async (id: string, actor?: string): Promise<number> => {
+  const before = await AllowList.query().findById(id)
+  const total = await AllowList.query().deleteById(id)
+  if (total > 0) {
+    await AuditService.record(actor, {
+      action: 'delete',
+      entity_type: 'allow_list',
+      entity_id: id,
+      before,
+    })
+  }
+  return total
+}
+
+/**
+ * purgeExpired
+ *
+ * Deletes entries expired for more than `retentionDays`, expired
+ * entries are kept until then so they can be reviewed or extended
+ */
+const purgeExpired = async (
+  retentionDays: number,
+  now: Date = new Date()
+): Promise<number> => {
+  const total = await AllowList.query()
+    .delete()
+    .where(
+      'expires_at',
+      '<=',
+      new Date(now.getTime() - retentionDays * 24 * 60 * 60 * 1000)
+    )
+  if (total > 0) {
+    logger.info({
+      module: 'services/allow_list',
+      method: 'purgeExpired',
+      message: `deleted ${total} expired allow list entries`,
+    })
+  }
+  return total
+}
 
 export default {
   view,
   findOne,
+  findActive,
+  matchMany,
   cached_view,
   create,
   update,
   destroy,
+  purgeExpired,
 }
@@ -0,0 +1,139 @@
+import { QueryBuilder } from 'objection'
+import { AuditLog } from '../models'
+import { AuditChanges } from '../models/audit_logs'
+import logger from '../loaders/logger'
+
+// actor of changes made outside of a user session (jobs, scripts)
+export const SYSTEM_ACTOR = 'system'
+
+export const REDACTED_VALUE = '[redacted]'
+
+// fields never written to the audit log, by entity type
+const redactedFields: Record<string, string[]> = {
+  secret: ['value'],
+}
+
+// bumped on every write, not a change of its own
+const ignoredFields = ['updated_at']
+
+export type AuditEntry = {
+  action: string
+  entity_type: string
+  entity_id?: string | null
+  // entity before / after the action, omitted for creates / deletes
+  before?: object | null
+  after?: object | null
+}
+
+// JSON representation, dates are compared as strings
+const toJSON = (entity: object | null | undefined): Record<string, unknown> =>
+  JSON.parse(JSON.stringify(entity || {}))
+
+/**
+ * auditDiff
+ *
+ * Fields that differ between `before` and `after`. Values of
+ * `redact` fields are replaced by `REDACTED_VALUE`
+ */
+export const auditDiff = (
+  before: object | null | undefined,
+  after: object | null | undefined,
+  redact: string[] = []
+): AuditChanges => {
+  const from = toJSON(before)
+  const to = toJSON(after)
+  const mask = (field: string, value: unknown) =>
+    value !== undefined && redact.includes(field) ? REDACTED_VALUE : value
+  return Array.from(new Set([...Object.keys(from), ...Object.keys(to)]))
+    .filter(
+      (field) =>
+        !ignoredFields.includes(field) &&
+        JSON.stringify(from[field]) !== JSON.stringify(to[field])
+    )
+    .reduce(
+      (changes, field) => ({
+        ...changes,
+        [field]: {
+          ...(field in from ? { from: mask(field, from[field]) } : {}),
+          ...(field in to ? { to: mask(field, to[field]) } : {}),
+        },
+      }),
+      {} as AuditChanges
+    )
+}
+
+/**
+ * record
+ *
+ * Writes an audit log entry of `entry` done by `actor`. A failed
+ * write is logged as an error, it never fails the audited action
+ */
+const record = async (
+  actor: string | undefined,
+  entry: AuditEntry
+): Promise<AuditLog | null> => {
+  try {
+    return await AuditLog.query().insert({
+      actor: actor || SYSTEM_ACTOR,
+      action: entry.action,
+      entity_type: entry.entity_type,
+      entity_id: entry.entity_id ?? null,
+      changes: auditDiff(
+        entry.before,
+        entry.after,
+        redactedFields[entry.entity_type]
+      ),
+    })
+  } catch (e) {
+    logger.error({
+      module: 'services/audit',
+      method: 'record',
+      message: 'audit log entry not written',
+      actor: actor || SYSTEM_ACTOR,
+      action: entry.action,
+      entity_type: entry.entity_type,
+      entity_id: entry.entity_id,
+      error: e.message,
+    })
+    return null
+  }
+}
+
+export type AuditFilters = {
+  actor?: string
+  entity_type?: string
+  entity_id?: string
+  since?: Date
+  until?: Date
+}
+
+/**
+ * whereFilters
+ *
+ * Query modifier of audit log entries matching `filters`
+ */
+export const whereFilters =
+  (filters: AuditFilters) =>
+  (builder: QueryBuilder<AuditLog>): void => {
+    if (filters.actor) builder.where('actor', filters.actor)
+    if (filters.entity_type) builder.where('entity_type', filters.entity_type)
+    if (filters.entity_id) builder.where('entity_id', filters.entity_id)
+    if (filters.since) builder.where('created_at', '>=', filters.since)
+    if (filters.until) builder.where('created_at', '<', filters.until)
+  }
+
+/**
+ * list
+ *
+ * Audit log entries matching `filters`, oldest first
+ */
+const list = async (filters: AuditFilters = {}): Promise<AuditLog[]> =>
+  AuditLog.query()
+    .modify(whereFilters(filters))
+    .orderBy('created_at')
+    .orderBy('id')
+
+export default {
+  list,
+  record,
+}
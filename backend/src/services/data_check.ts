@@ -0,0 +1,175 @@
+import { AllowList, Ioc, knex } from '../models'
+import { IocType } from '../models/iocs'
+import { isPlainHost, isValidHost } from '../lib/domains'
+import IocService, { bumpVersion, normalizeValue } from './ioc'
+
+export type DataTable = 'iocs' | 'allow_list'
+
+export type DataProblem = 'invalid' | 'duplicate' | 'not_normalized'
+
+export type DataIssue = {
+  table: DataTable
+  id: string
+  type: string
+  value: string
+  problem: DataProblem
+  detail: string
+  // normalized value (not_normalized only)
+  fixed?: string
+}
+
+export type FixResult = {
+  updated: number
+  deleted: number
+}
+
+type Entry = { id: string; type: string; value: string; created_at: Date }
+
+const pick = ({ id, type, value }: Entry) => ({ id, type, value })
+
+const isRegExp = (value: string): boolean => {
+  try {
+    new RegExp(value)
+    return true
+  } catch (e) {
+    return false
+  }
+}
+
+// reason `value` is malformed, null when valid
+const iocProblem = (type: string, value: string): string | null => {
+  if (value.length === 0) return 'empty value'
+  try {
+    IocService.validateValue(type as IocType, value)
+  } catch (e) {
+    return e.message
+  }
+  if (type === 'fqdn' && isPlainHost(value) && !isValidHost(value)) {
+    return `invalid domain "${value}"`
+  }
+  return null
+}
+
+const allowListProblem = (type: string, value: string): string | null => {
+  if (value.length === 0) return 'empty key'
+  if (!isRegExp(value)) return `invalid pattern "${value}"`
+  if (type === 'fqdn' && isPlainHost(value) && !isValidHost(value)) {
+    return `invalid domain "${value}"`
+  }
+  return null
+}
+
+const normalizeIoc = (type: string, value: string): string =>
+  normalizeValue(type as IocType, value.trim())
+
+const normalizeAllowList = (type: string, value: string): string =>
+  AllowList.normalizeKey(type, value.trim())
+
+/**
+ * findIssues
+ *
+ * Invalid entries, then entries sharing a (type, normalized value)
+ * with another one. The entry already normalized (else the oldest)
+ * of a group is kept, the others are duplicates. A kept entry that
+ * is not normalized is reported with its `fixed` value
+ */
+const findIssues = (
+  table: DataTable,
+  entries: Entry[],
+  problem: (type: string, value: string) => string | null,
+  normalize: (type: string, value: string) => string
+): DataIssue[] => {
+  const issues: DataIssue[] = []
+  const groups = new Map<string, Array<Entry & { normalized: string }>>()
+  entries.forEach((entry) => {
+    const normalized = normalize(entry.type, entry.value)
+    const reason = problem(entry.type, normalized)
+    if (reason !== null) {
+      issues.push({ table, ...pick(entry), problem: 'invalid', detail: reason })
+      return
+    }
+    const key = JSON.stringify([entry.type, normalized])
+    if (!groups.has(key)) groups.set(key, [])
+    groups.get(key).push({ ...entry, normalized })
+  })
+  groups.forEach((group) => {
+    group.sort(
+      (a, b) =>
+        Number(b.value === b.normalized) - Number(a.value === a.normalized) ||
+        new Date(a.created_at).getTime() - new Date(b.created_at).getTime()
+    )
+    const [kept, ...duplicates] = group
+    duplicates.forEach((entry) => {
+      issues.push({
+        table,
+        ...pick(entry),
+        problem: 'duplicate',
+        detail: `duplicate of ${kept.id} (${kept.normalized})`,
+      })
+    })
+    if (kept.value !== kept.normalized) {
+      issues.push({
+        table,
+        ...pick(kept),
+        problem: 'not_normalized',
+        detail: `should be "${kept.normalized}"`,
+        fixed: kept.normalized,
+      })
+    }
+  })
+  return issues
+}
+
+/**
+ * check
+ *
+ * Invalid, duplicate and non-normalized IOCs and allow list keys
+ */
+const check = async (): Promise<DataIssue[]> => {
+  const iocs = await Ioc.query()
+    .select('id', 'type', 'value', 'created_at')
+    .orderBy('id')
+  const allowList = await AllowList.query()
+    .select('id', 'type', 'key as value', 'created_at')
+    .orderBy('id')
+  return [
+    ...findIssues('iocs', iocs as Entry[], iocProblem, normalizeIoc),
+    ...findIssues(
+      'allow_list',
+      (allowList as unknown) as Entry[],
+      allowListProblem,
+      normalizeAllowList
+    ),
+  ]
+}
+
+/**
+ * fix
+ *
+ * Deletes invalid and duplicate entries and normalizes the others
+ * in one transaction. Scanners drop their IOC caches afterwards
+ */
+const fix = async (issues: DataIssue[]): Promise<FixResult> => {
+  const result: FixResult = { updated: 0, deleted: 0 }
+  const column = (table: DataTable) => (table === 'iocs' ? 'value' : 'key')
+  await knex.transaction(async (trx) => {
+    // deletes first, normalized values may collide with duplicates
+    for (const issue of issues.filter((i) => i.problem !== 'not_normalized')) {
+      result.deleted += await trx(issue.table).where('id', issue.id).del()
+    }
+    for (const issue of issues.filter((i) => i.problem === 'not_normalized')) {
+      result.updated += await trx(issue.table)
+        .where('id', issue.id)
+        .update({ [column(issue.table)]: issue.fixed })
+    }
+  })
+  if (issues.some((i) => i.table === 'iocs')) {
+    await bumpVersion()
+  }
+  return result
+}
+
+export default {
+  check,
+  fix,
+}
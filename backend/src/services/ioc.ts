@@ -1,7 +1,16 @@
+import { isIP } from 'net'
+import { config } from 'node-config-ts'
+import { v4 as uuidv4 } from 'uuid'
+import { QueryBuilder } from 'objection'
 import { Ioc, IocAttributes } from '../models'
 import { cachedView } from '../api/crud/cache'
 import LRUCache from 'lru-native2'
 import { IocType } from '../models/iocs'
+import { ClientError } from '../api/middleware/client-errors'
+import { redisClient } from '../repos/redis'
+import logger from '../loaders/logger'
+import AuditService from './audit'
+import { normalizeDomain } from '../lib/domains'
 
 export const cache = new LRUCache<number>({
   maxElements: 10000,
@@ -14,42 +23,275 @@ export type IocBulkCreate = {
   values: string[]
   type: IocType
   enabled: boolean
+  expires_at?: Date | null
 }
 
 const cached_view = cachedView(Ioc.tableName, cache)
 
+// bumped on every change, scanners drop their IOC caches when it moves
+export const VERSION_KEY = 'iocs:version'
+
+export const bumpVersion = async (): Promise<number> => redisClient.incr(VERSION_KEY)
+
+const isCIDR = (value: string): boolean => {
+  const [addr, prefix, ...rest] = value.split('/')
+  const family = isIP(addr)
+  if (family === 0 || rest.length || !/^\d{1,3}$/.test(prefix || '')) {
+    return false
+  }
+  return parseInt(prefix, 10) <= (family === 4 ? 32 : 128)
+}
+
+const isRegExp = (value: string): boolean => {
+  try {
+    new RegExp(value)
+    return true
+  } catch (e) {
+    return false
+  }
+}
+
+/**
+ * validateValue
+ *
+ * Checks `value` is well formed for its IOC `type`
+ */
+const validateValue = (type: IocType, value: string): void => {
+  let valid = true
+  if (type === 'ip_cidr') {
+    valid = isCIDR(value)
+  } else if (type === 'sha256') {
+    valid = /^[0-9a-f]{64}$/i.test(value)
+  } else if (type !== 'url') {
+    valid = isRegExp(value)
+  }
+  if (!valid) {
+    throw new ClientError(`invalid ${type} value "${value}"`)
+  }
+}
+
+/**
+ * validateExpiry
+ *
+ * Enabled IOCs cannot expire in the past
+ */
+const validateExpiry = (
+  enabled: boolean | undefined,
+  expiresAt: Date | string | null | undefined
+): void => {
+  if (expiresAt === undefined || expiresAt === null) return
+  const expires = new Date(expiresAt)
+  if (isNaN(expires.getTime())) {
+    throw new ClientError(`invalid expires_at "${expiresAt}"`)
+  }
+  if (enabled !== false && expires <= new Date()) {
+    throw new ClientError(
+      'expires_at must be in the future, extend or clear it to enable the IOC'
+    )
+  }
+}
+
+/**
+ * whereActive
+ *
+ * Limits `builder` to enabled IOCs that have not expired at `now`
+ */
+export const whereActive = (
+  builder: QueryBuilder<Ioc>,
+  now: Date = new Date()
+): QueryBuilder<Ioc> =>
+  builder
+    .where('enabled', true)
+    .where((b) => b.whereNull('expires_at').orWhere('expires_at', '>', now))
+
+// hashes are stored lowercase and plain hosts in their normalized
+// (lowercase, punycode) form for exact matches
+export const normalizeValue = (type: IocType, value: string): string => {
+  if (type === 'sha256') return value.toLowerCase()
+  if (type === 'fqdn') return normalizeDomain(value.trim())
+  return value
+}
+
 const view = async (id: string): Promise<Ioc> =>
   Ioc.query().findById(id).throwIfNotFound()
 
 const findOne = async (query: Partial<IocAttributes>): Promise<Ioc> =>
   Ioc.query().findOne(query)
 
-const create = async (attrs: Partial<IocAttributes>): Promise<Ioc> =>
-  Ioc.query().insert(attrs)
+// active IOC matching `query` (used by rule lookups)
+const findActive = async (query: Partial<IocAttributes>): Promise<Ioc> =>
+  Ioc.query().modify(whereActive).findOne(query)
+
+const create = async (
+  attrs: Partial<IocAttributes>,
+  actor?: string
+): Promise<Ioc> => {
+  validateValue(attrs.type, attrs.value)
+  validateExpiry(attrs.enabled, attrs.expires_at)
+  const created = await Ioc.query().insert({
+    ...attrs,
+    value: normalizeValue(attrs.type, attrs.value),
+  })
+  await bumpVersion()
+  await AuditService.record(actor, {
+    action: 'create',
+    entity_type: 'ioc',
+    entity_id: created.id,
+    after: created,
+  })
+  return created
+}
+
+// one row per record, matches the iocs columns
+const BULK_SET_SQL = `
+insert into iocs (id, type, value, enabled, expires_at, created_at)
+select v.id, v.type, v.value, v.enabled, v.expires_at, v.created_at
+from json_to_recordset(?::json) as v(
+  id uuid,
+  type text,
+  value text,
+  enabled boolean,
+  expires_at timestamptz,
+  created_at timestamptz
+)
+on conflict (type, value) do nothing
+`
 
-const bulkCreate = async (bulk: IocBulkCreate): Promise<void> => {
+/**
+ * insertMany
+ *
+ * Inserts `iocs`, skipping existing type / value pairs.
+ *
+ * Up to `threshold` rows use a multi-row INSERT (one bind parameter
+ * per column and row). Larger batches are sent as a single JSON
+ * parameter expanded by postgres, which avoids the bind parameter
+ * limit (65535, ~16k IOCs) and the cost of parsing a statement with
+ * tens of thousands of parameters. Below a few hundred rows both
+ * paths are on par, the JSON encoding only pays off for large lists
+ */
+export const insertMany = async (
+  iocs: IocAttributes[],
+  threshold: number = config.iocs?.bulkSetThreshold || 1000
+): Promise<void> => {
+  if (iocs.length === 0) return
+  if (iocs.length <= threshold) {
+    await Ioc.query().insert(iocs).onConflict(['value', 'type']).ignore()
+    return
+  }
+  const now = new Date()
+  const rows = iocs.map((ioc) => ({
+    id: uuidv4(),
+    type: ioc.type,
+    value: ioc.value,
+    enabled: ioc.enabled,
+    expires_at: ioc.expires_at || null,
+    created_at: now,
+  }))
+  await Ioc.knex().raw(BULK_SET_SQL, [JSON.stringify(rows)])
+}
+
+const bulkCreate = async (
+  bulk: IocBulkCreate,
+  actor?: string
+): Promise<void> => {
+  bulk.values.forEach((value) => validateValue(bulk.type, value))
+  validateExpiry(bulk.enabled, bulk.expires_at)
   const iocs: IocAttributes[] = bulk.values.map((value) => ({
-    value,
+    value: normalizeValue(bulk.type, value),
     type: bulk.type,
     enabled: bulk.enabled,
+    expires_at: bulk.expires_at,
   }))
-  await Ioc.query().insert(iocs).onConflict(['value', 'type']).ignore()
+  await insertMany(iocs)
+  await bumpVersion()
+  // one entry per batch, existing values were skipped
+  await AuditService.record(actor, {
+    action: 'create',
+    entity_type: 'ioc',
+    after: {
+      type: bulk.type,
+      enabled: bulk.enabled,
+      expires_at: bulk.expires_at,
+      values: iocs.map((ioc) => ioc.value),
+    },
+  })
 }
 
 const update = async (
   id: string,
-  attrs: Partial<IocAttributes>
-): Promise<Ioc> => Ioc.query().patchAndFetchById(id, attrs)
+  attrs: Partial<IocAttributes>,
+  actor?: string
+): Promise<Ioc> => {
+  if (attrs.type !== undefined && attrs.value !== undefined) {
+    validateValue(attrs.type, attrs.value)
+    attrs = { ...attrs, value: normalizeValue(attrs.type, attrs.value) }
+  }
+  if (attrs.expires_at !== undefined) {
+    validateExpiry(attrs.enabled, attrs.expires_at)
+  } else if (attrs.enabled) {
+    // re-enabling must not leave an expiry in the past
+    const current = await view(id)
+    validateExpiry(true, current.expires_at)
+  }
+  const before = await Ioc.query().findById(id)
+  const updated = await Ioc.query().patchAndFetchById(id, attrs)
+  await bumpVersion()
+  await AuditService.record(actor, {
+    action: 'update',
+    entity_type: 'ioc',
+    entity_id: id,
+    before,
+    after: updated,
+  })
+  return updated
+}
 
-const destroy = async (id: string): Promise<number> =>
-  Ioc.query().deleteById(id)
+const destroy = async (id: string, actor?: string): Promise<number> => {
+  const before = await Ioc.query().findById(id)
+  const total = await Ioc.query().deleteById(id)
+  await bumpVersion()
+  if (total > 0) {
+    await AuditService.record(actor, {
+      action: 'delete',
+      entity_type: 'ioc',
+      entity_id: id,
+      before,
+    })
+  }
+  return total
+}
+
+/**
+ * expire
+ *
+ * Disables enabled IOCs past their `expires_at`, the IOC version is
+ * bumped so scanners drop cached matches. Returns the number disabled
+ */
+const expire = async (now: Date = new Date()): Promise<number> => {
+  const total = await Ioc.query()
+    .patch({ enabled: false })
+    .where('enabled', true)
+    .where('expires_at', '<=', now)
+  if (total > 0) {
+    await bumpVersion()
+    logger.info({
+      module: 'services/ioc',
+      method: 'expire',
+      message: `disabled ${total} expired IOCs`,
+    })
+  }
+  return total
+}
 
 export default {
   view,
   destroy,
   findOne,
+  findActive,
   update,
   cached_view,
   create,
   bulkCreate,
+  validateValue,
+  expire,
 }
@@ -1,17 +1,28 @@
-import { Scan, ScanLog, Site, Source } from '../models'
+import { isIP } from 'net'
+import { Alert, Scan, ScanLog, Site, Source } from '../models'
 import { Queue, Job } from 'bull'
 import logger from '../loaders/logger'
 import { ScanLogLevels } from '../models/scan_logs'
+import { ScanStates } from '../models/scans'
 import { QueryBuilder, raw } from 'objection'
 import MerryMaker from '@merrymaker/types'
+import { config } from 'node-config-ts'
+import { validate as validateUUID } from 'uuid'
+import { metrics, Metrics } from '../lib/metrics'
 
-import scanLogService from './scan_logs'
+import scanLogService, { STORM_RULE } from './scan_logs'
+import SettingService from './setting'
+import SiteService, { TargetDrift, queuePriority } from './site'
+import { ClientError } from '../api/middleware/client-errors'
+import Queues from '../jobs/queues'
 
 type ScheduledScan = { scan: Scan; job: Job }
 type ScanScheduleOptions = {
   site?: Site
   source?: Source
   test?: boolean
+  // site priority including aging, defaults to the site priority
+  priority?: number
 }
 
 const isActive = async (id: string): Promise<boolean> => {
@@ -85,7 +96,11 @@ const schedule = async (
       attempts: opts.test ? 1 : 3,
       // fail after 30 minutes
       timeout: 1000 * 60 * 30,
-      removeOnFail: true
+      removeOnFail: true,
+      // reserved by site priority, test scans first
+      priority: opts.site
+        ? queuePriority(opts.priority ?? opts.site.priority)
+        : 1
     }
   )
   await ScanLog.query().insertAndFetch({
@@ -104,10 +119,62 @@ const schedule = async (
   return { scan: scanInst, job: jobInst }
 }
 
+export type CancelResult = {
+  scan: Scan
+  // a scanner already picked up the scan job
+  running: boolean
+}
+
+/**
+ * cancel
+ *   Cancels a scheduled scan, keeping its logs
+ *   Scans that already started cannot be cancelled
+ *
+ *   A job a scanner picked up before the scan state changed is
+ *   locked, it is discarded (never retried) and finishes with its
+ *   state updates ignored. `running` reports it
+ */
+const cancel = async (
+  id: string,
+  queue: Queue<MerryMaker.ScanQueueJob>
+): Promise<CancelResult> => {
+  const scan = await view(id)
+  // guarded update, the scan may start while cancelling
+  const updated = await Scan.query()
+    .patch({ state: 'cancelled' })
+    .where({ id, state: 'scheduled' })
+  if (updated === 0) {
+    throw new ClientError(`Cannot cancel ${scan.state} scan`)
+  }
+  const jobs = await queue.getJobs(['active', 'waiting', 'delayed'])
+  const job = jobs.find(j => j && j.data.scan_id === id)
+  const running = job ? await job.isActive() : false
+  if (running) {
+    job.discard()
+  } else if (job) {
+    await job.remove()
+  }
+  await ScanLog.query().insert({
+    entry: 'log-message',
+    event: {
+      message: running
+        ? 'Scan cancelled, the running scan job will finish'
+        : 'Scan cancelled'
+    },
+    level: 'info',
+    scan_id: id,
+    created_at: new Date()
+  })
+  return { scan: await view(id), running }
+}
+
 /**
  * updateState
  *   Updates the state of a running scan
  *   Appends a Scan Log Entry on state change
+ *
+ *   Completed, cancelled and idle-failed (`idle_at` set) scans
+ *   keep their state
  */
 const updateState = async (
   scan_id: string,
@@ -120,9 +187,13 @@ const updateState = async (
     logger.warn(`Unable to find scan with id ${scan_id}`)
     return
   }
-  if (scanInst.state === 'completed') {
+  if (
+    scanInst.state === 'completed' ||
+    scanInst.state === 'cancelled' ||
+    (scanInst.state === 'failed' && scanInst.idle_at)
+  ) {
     logger.warn(
-      `Scan state cannot be changed to "${state}" when already complete`
+      `Scan state cannot be changed to "${state}" when already ${scanInst.state}`
     )
     return
   }
@@ -154,15 +225,143 @@ const updateState = async (
   return scanInst
 }
 
+/**
+ * landingURL
+ *
+ * URL a scan ended on, the last main frame navigation (final
+ * hop of redirects). Frame documents carry their parent page as
+ * referer, the navigation and its redirects do not. Falls back to
+ * the first document request, null without document requests
+ **/
+const landingURL = async (scanID: string): Promise<string | null> => {
+  const documents = () =>
+    ScanLog.query()
+      .select(raw("event::jsonb->>'url'").as('url'))
+      .where({ scan_id: scanID, entry: 'request' })
+      .whereRaw("event::jsonb->>'resourceType' = 'document'")
+  const log =
+    (await documents()
+      .whereRaw("coalesce(event::jsonb->'headers'->>'referer', '') = ''")
+      .orderBy('created_at', 'desc')
+      .first()) || (await documents().orderBy('created_at', 'asc').first())
+  return ((log as unknown) as { url?: string })?.url || null
+}
+
+/**
+ * trackLanding
+ *
+ * Records the landing URL of a completed site scan and
+ * logs a warning when it drifted from the site target URL.
+ * A scan is tracked once, retried completions are skipped
+ **/
+const trackLanding = async (scan?: Scan): Promise<void> => {
+  if (!scan || !scan.site_id || scan.test) return
+  const url = await landingURL(scan.id)
+  if (url === null) return
+  const claimed = await Scan.query()
+    .patch({ landing_url: url })
+    .where('id', scan.id)
+    .whereNull('landing_url')
+  if (claimed === 0) return
+  const { drift, reason } = await SiteService.recordLandingURL(
+    scan.site_id,
+    url
+  )
+  if (drift) {
+    await Scan.query()
+      .patch({ target_drift: reason })
+      .where('id', scan.id)
+    await ScanLog.query().insert({
+      entry: 'log-message',
+      level: 'warning',
+      event: { message: `target drift (${reason}): scan landed on ${url}` },
+      scan_id: scan.id,
+      created_at: new Date()
+    })
+  }
+}
+
+const olderThanDays = (days: number, column = 'created_at') =>
+  raw(`?? <= NOW() - (? * INTERVAL '1 day')`, [column, days])
+
+/**
+ * pruneEvents
+ *
+ * Deletes scan events past their retention, `maxDays` unless their
+ * entry has an override (`scans.retention.entries`). Returns the
+ * number of deleted events. Without overrides events go with
+ * their scans. Archived events are left to `scans.archive.deleteAfterDays`
+ */
+const pruneEvents = async (
+  maxDays: number,
+  overrides: Record<string, number> = config.scans.retention.entries
+): Promise<number> => {
+  const entries = Object.keys(overrides)
+  if (entries.length === 0) return 0
+  // other events past retention only remain in retained scans
+  let total = await ScanLog.query()
+    .delete()
+    .whereIn(
+      'scan_id',
+      Scan.query()
+        .select('id')
+        .where(olderThanDays(maxDays, 'scans.created_at'))
+    )
+    .whereNotIn('entry', entries)
+    .whereNull('archived_at')
+    .where(olderThanDays(maxDays, 'scan_logs.created_at'))
+  for (const entry of entries) {
+    total += await ScanLog.query()
+      .delete()
+      .where('entry', entry)
+      .whereNull('archived_at')
+      .where(olderThanDays(overrides[entry], 'scan_logs.created_at'))
+  }
+  return total
+}
+
 /**
  * purge
  *
- *  Delete scans older than or equal to `maxDays`
+ * Delete scans older than or equal to `maxDays`. Scans holding events
+ * retained longer (`scans.retention.entries`, e.g. alerts) or archived
+ * events are kept with only those events until they expire too
  */
-const purge = async (maxDays: number): Promise<number> =>
-  Scan.query()
+const purge = async (
+  maxDays: number,
+  overrides: Record<string, number> = config.scans.retention.entries
+): Promise<number> => {
+  const events = await pruneEvents(maxDays, overrides)
+  const retained = Object.keys(overrides).filter(
+    entry => overrides[entry] > maxDays
+  )
+  const total = await Scan.query()
     .delete()
-    .where(raw("created_at <= NOW() - INTERVAL '?? days'", [maxDays]))
+    .where(olderThanDays(maxDays))
+    .whereNotExists(
+      // deleted with their objects (see scan_log_archive)
+      ScanLog.query()
+        .whereColumn('scan_logs.scan_id', 'scans.id')
+        .whereNotNull('scan_logs.archived_at')
+    )
+    .modify(builder => {
+      if (retained.length) {
+        // remaining events of these entries are still retained
+        builder.whereNotExists(
+          ScanLog.query()
+            .whereColumn('scan_logs.scan_id', 'scans.id')
+            .whereIn('scan_logs.entry', retained)
+        )
+      }
+    })
+  logger.info({
+    module: 'services/scan',
+    method: 'purge',
+    scans: total,
+    events
+  })
+  return total
+}
 
 /**
  * ruleAlertEvent
@@ -194,6 +393,152 @@ const totalScheduled = async (): Promise<number> =>
     .where('state', '=', 'scheduled')
     .resultSize()
 
+// scan states that count against a site's queue depth
+const PENDING_STATES = ['scheduled', 'active', 'running']
+
+/**
+ * pendingBySite
+ *
+ * Returns the number of scheduled or running scans per site
+ */
+const pendingBySite = async (
+  siteIDs: string[]
+): Promise<Record<string, number>> => {
+  if (siteIDs.length === 0) return {}
+  const rows = ((await Scan.query()
+    .select('site_id')
+    .count('id', { as: 'total' })
+    .whereIn('site_id', siteIDs)
+    .whereIn('state', PENDING_STATES)
+    .groupBy('site_id')) as unknown) as Array<{
+    site_id: string
+    total: string
+  }>
+  return rows.reduce((acc, row) => {
+    acc[row.site_id] = parseInt(row.total, 10)
+    return acc
+  }, {} as Record<string, number>)
+}
+
+// pending rule job data, see scanner `RuleJobData`
+export type PendingRuleJob = {
+  rule?: string
+  event?: { scanID?: string; eventID?: string }
+}
+
+// scan ID -> events with rule jobs left, kept by the scanner
+// (scanner lib/pending-rules)
+export const PENDING_RULES_KEY = 'rules:pending:scans'
+
+export type AwaitingRules = {
+  // completed scans with events waiting for a rules run
+  scans: number
+  // their events still waiting
+  events: number
+}
+
+/**
+ * awaitingRules
+ *
+ * Completed scans among the scans with pending rule work
+ * (`PENDING_RULES_KEY`, events by scan ID). Events are counted
+ * once whatever the number of rules they wait for
+ */
+const awaitingRules = async (
+  pending: Record<string, string | number>
+): Promise<AwaitingRules> => {
+  const eventsByScan = new Map<string, number>()
+  Object.entries(pending || {}).forEach(([scanID, events]) => {
+    const total = Number(events)
+    if (!validateUUID(scanID) || !(total > 0)) return
+    eventsByScan.set(scanID, total)
+  })
+  if (eventsByScan.size === 0) return { scans: 0, events: 0 }
+  const completed = await Scan.query()
+    .select('id')
+    .whereIn('id', Array.from(eventsByScan.keys()))
+    .where('state', 'completed')
+  return completed.reduce(
+    (acc, scan) => {
+      acc.scans += 1
+      acc.events += eventsByScan.get(scan.id)
+      return acc
+    },
+    { scans: 0, events: 0 } as AwaitingRules
+  )
+}
+
+export type ScanWaitTimes = {
+  // site scans added by the scheduler
+  scheduled: number
+  // ad-hoc scans of sources
+  test: number
+}
+
+/**
+ * maxWaitSeconds
+ *
+ * Seconds the oldest scan still in the 'scheduled' state has waited
+ * at `now`, per type (0 when none waits), to alert on starvation
+ */
+const maxWaitSeconds = async (
+  now: Date = new Date()
+): Promise<ScanWaitTimes> => {
+  const rows = ((await Scan.query()
+    .select('test')
+    .min('created_at', { as: 'oldest' })
+    .where('state', 'scheduled')
+    .groupBy('test')) as unknown) as Array<{
+    test: boolean | null
+    oldest: Date
+  }>
+  return rows.reduce(
+    (acc, row) => {
+      const waited = Math.max(
+        0,
+        Math.floor((now.getTime() - new Date(row.oldest).getTime()) / 1000)
+      )
+      const type = row.test ? 'test' : 'scheduled'
+      acc[type] = Math.max(acc[type], waited)
+      return acc
+    },
+    { scheduled: 0, test: 0 } as ScanWaitTimes
+  )
+}
+
+export type ScanStateCounts = Record<string, number> & { total: number }
+
+/**
+ * stateCounts
+ *
+ * Number of scans by state, limited to `siteID` when set.
+ * Every state is present (zero when no scans match)
+ */
+const stateCounts = async (siteID?: string): Promise<ScanStateCounts> => {
+  const rows = ((await Scan.query()
+    .select('state')
+    .count('id', { as: 'total' })
+    .modify(builder => {
+      if (siteID) {
+        builder.where('site_id', siteID)
+      }
+    })
+    .groupBy('state')) as unknown) as Array<{ state: string; total: string }>
+  const counts = ScanStates.reduce(
+    (acc, state) => {
+      acc[state] = 0
+      return acc
+    },
+    { total: 0 } as ScanStateCounts
+  )
+  rows.forEach(row => {
+    const total = parseInt(row.total, 10)
+    counts[row.state] = total
+    counts.total += total
+  })
+  return counts
+}
+
 /**
  * expire
  *
@@ -233,6 +578,138 @@ const findAndExpire = async (maxMinutes: number): Promise<number> => {
   return 0
 }
 
+export const IDLE_FAILURE = 'idle — no event progress'
+
+type IdleCheckResult = {
+  // scans flagged as idle
+  flagged: number
+  // flagged scans that produced events again
+  cleared: number
+  // scans failed after `failMinutes` without events
+  failed: number
+  // failed site scans scheduled again
+  retried: number
+}
+
+/**
+ * failIdleJob
+ *
+ * Fails the bull job of an idle scan. The job is discarded so the
+ * hung scanner can neither finish nor retry it, site scans with
+ * attempts left are scheduled again as a new scan instead.
+ * Returns true when rescheduled
+ */
+const failIdleJob = async (
+  scan: Scan,
+  queue: Queue<MerryMaker.ScanQueueJob>
+): Promise<boolean> => {
+  const jobs = await queue.getJobs(['active', 'waiting', 'delayed'])
+  const job = jobs.find(j => j && j.data.scan_id === scan.id)
+  if (!job) return false
+  const retry = job.attemptsMade + 1 < (job.opts.attempts || 1)
+  job.discard()
+  try {
+    await job.moveToFailed({ message: IDLE_FAILURE }, true)
+  } catch (e) {
+    logger.warn({
+      module: 'services/scan',
+      method: 'failIdleJob',
+      scan_id: scan.id,
+      error: e.message
+    })
+  }
+  if (!retry || !scan.site_id || job.data.test) return false
+  const site = await Site.query().findById(scan.site_id)
+  if (!site) return false
+  await schedule(queue, { site })
+  return true
+}
+
+/**
+ * findAndFailIdle
+ *
+ * Checks running scans for event progress using the newest
+ * ScanLog per scan (or the scan creation date).
+ *
+ * Scans without new events for `flagMinutes` are flagged (`idle_at`),
+ * after `failMinutes` they are failed with IDLE_FAILURE for good and
+ * their bull job is failed too (see `failIdleJob`).
+ * Scans using a source in `exemptSourceIDs` are skipped
+ */
+const findAndFailIdle = async (
+  opt: {
+    flagMinutes?: number
+    failMinutes?: number
+    exemptSourceIDs?: string[]
+    now?: Date
+    queue?: Queue<MerryMaker.ScanQueueJob>
+  } = {}
+): Promise<IdleCheckResult> => {
+  const flagMinutes = opt.flagMinutes || config.scans.idle.flagMinutes
+  const failMinutes = opt.failMinutes || config.scans.idle.failMinutes
+  const exempt = opt.exemptSourceIDs || config.scans.idle.exemptSourceIDs
+  const now = opt.now || new Date()
+  const queue = opt.queue || Queues.scannerQueue
+  const result: IdleCheckResult = {
+    flagged: 0,
+    cleared: 0,
+    failed: 0,
+    retried: 0
+  }
+  const query = Scan.query()
+    .select('scans.*')
+    .select(
+      raw(
+        'coalesce(max(scan_logs.created_at), scans.created_at) as last_event'
+      )
+    )
+    .leftJoin('scan_logs', 'scan_logs.scan_id', 'scans.id')
+    .whereIn('scans.state', ['active', 'running'])
+    .groupBy('scans.id')
+  if (exempt.length) {
+    query.whereNotIn('scans.source_id', exempt)
+  }
+  const scans = ((await query) as unknown) as Array<
+    Scan & { last_event: Date }
+  >
+  for (const scan of scans) {
+    const idleMinutes =
+      (now.valueOf() - new Date(scan.last_event).valueOf()) / 60000
+    if (idleMinutes >= failMinutes) {
+      logger.warn({
+        module: 'services/scan',
+        method: 'findAndFailIdle',
+        scan_id: scan.id,
+        message: `no events for ${Math.floor(idleMinutes)} minutes, failing`
+      })
+      // `idle_at` keeps the failed state final
+      if (!scan.idle_at) {
+        await Scan.query()
+          .findById(scan.id)
+          .patch({ idle_at: now })
+      }
+      await updateState(scan.id, 'failed', IDLE_FAILURE)
+      result.failed += 1
+      if (await failIdleJob(scan, queue)) {
+        result.retried += 1
+      }
+    } else if (idleMinutes >= flagMinutes) {
+      if (!scan.idle_at) {
+        await Scan.query()
+          .findById(scan.id)
+          .patch({ idle_at: now })
+        result.flagged += 1
+      }
+    } else if (scan.idle_at) {
+      await Scan.query()
+        .findById(scan.id)
+        .patch({ idle_at: null })
+      result.cleared += 1
+    }
+  }
+  return result
+}
+
 // Tracks a composite grouping based on key
 type CompositeGroup = {
   // key in object to group by
@@ -287,6 +764,12 @@ const urlComposite: CompositeGroup = {
 const sumComposite = (comp: Record<string, number>) =>
   Object.entries(comp).reduce((acc, [, b]) => acc + b, 0)
 
+// Returns sum of a domain CompositeGroup where the host is an IP literal
+const sumIPHosts = (comp: Record<string, number>) =>
+  Object.entries(comp)
+    .filter(([host]) => isIP(host.replace(/^\[|\]$/g, '')))
+    .reduce((acc, [, b]) => acc + b, 0)
+
 /**
  * Order a CompositeGroup based on total ASC
  *
@@ -298,42 +781,140 @@ const orderComposite = (obj: Record<string, number>) =>
     .sort(([, a], [, b]) => a - b)
     .reverse()
 
+// Grouped totals keyed by CompositeGroup key
+type GroupedLogs = Record<string, Record<string, number>>
+
+// Grouped totals with guardrail stats
+type GroupedLogsStats = {
+  groups: GroupedLogs
+  // events counted but not individually tracked (per CompositeGroup key)
+  untracked: Record<string, number>
+  // true if any CompositeGroup reached `maxKeys`
+  capReached: boolean
+  // peak heap usage (bytes) sampled while grouping
+  heapUsed: number
+  // number of chunks fetched
+  chunks: number
+}
+
+// sample heap usage every n scan logs
+const HEAP_SAMPLE_RATE = 1000
+
 /**
- * groupLogs
+ * groupLogsWithStats
  *
  * Fetches ScanLogs for a scan with a matching `entry`
  *
  * Accepts an array of CompositeGroups to produce one or more
  * groups based on the CompositeGroup key
+ *
+ * Tracks at most `maxKeys` distinct values per CompositeGroup,
+ * additional values are counted in `untracked`
+ *
+ * ScanLogs are fetched in chunks of `chunkSize` (ordered by id)
+ * to avoid loading every event for large scans at once
+ *
+ * Reaching the cap of a group is counted in the
+ * `scans.summary.<group>_cap_reached` metric
  **/
-const groupLogs = async (
+const groupLogsWithStats = async (
   id: string,
   opt: {
     entry: string
     composites: CompositeGroup[]
+    maxKeys?: number
+    chunkSize?: number
+    // defaults to the configured client
+    stats?: Metrics
   }
-) => {
-  const res = await scanLogService.getByScanID(id, builder =>
-    builder.where('entry', opt.entry)
-  )
+): Promise<GroupedLogsStats> => {
   const { composites } = opt
-  return res.reduce((acc, l) => {
+  const maxKeys = opt.maxKeys || Infinity
+  const chunkSize = opt.chunkSize || config.scans.summary.chunkSize
+  const stats: GroupedLogsStats = {
+    groups: {},
+    untracked: {},
+    capReached: false,
+    heapUsed: process.memoryUsage().heapUsed,
+    chunks: 0
+  }
+  // distinct values tracked per group
+  const tracked: Record<string, number> = {}
+  let processed = 0
+  const accumulate = (l: ScanLog) => {
+    if (processed % HEAP_SAMPLE_RATE === 0) {
+      stats.heapUsed = Math.max(stats.heapUsed, process.memoryUsage().heapUsed)
+    }
+    processed += 1
     // iterate through all CompositeGroups
     composites.forEach(comps => {
       const evtK = comps.group(l)
       const { key } = comps
-      if (!evtK) return acc
+      if (!evtK) return
       // init an empty object for this group
-      if (acc[key] === undefined) acc[key] = {}
+      if (stats.groups[key] === undefined) {
+        stats.groups[key] = {}
+        tracked[key] = 0
+      }
       // increment or set to 1 if new
-      if (acc[key][evtK]) {
-        acc[key][evtK] += 1
+      if (stats.groups[key][evtK]) {
+        stats.groups[key][evtK] += 1
+      } else if (tracked[key] < maxKeys) {
+        stats.groups[key][evtK] = 1
+        tracked[key] += 1
       } else {
-        acc[key][evtK] = 1
+        stats.capReached = true
+        stats.untracked[key] = (stats.untracked[key] || 0) + 1
       }
     })
-    return acc
-  }, {} as Record<string, Record<string, number>>)
+  }
+  let lastID: string
+  for (;;) {
+    const chunk = await scanLogService.getByScanID(id, builder => {
+      builder
+        .where('entry', opt.entry)
+        .orderBy('id')
+        .limit(chunkSize)
+      if (lastID) builder.where('id', '>', lastID)
+    })
+    stats.chunks += 1
+    chunk.forEach(accumulate)
+    if (chunk.length < chunkSize) break
+    lastID = chunk[chunk.length - 1].id
+  }
+  if (stats.capReached) {
+    logger.warn({
+      module: 'services/scan',
+      method: 'groupLogs',
+      scan_id: id,
+      message: `distinct value cap (${maxKeys}) reached`,
+      untracked: stats.untracked
+    })
+    const client = metrics(opt.stats)
+    Object.keys(stats.untracked).forEach(key =>
+      client.increment(`scans.summary.${key}_cap_reached`)
+    )
+  }
+  return stats
+}
+
+/**
+ * groupLogs
+ *
+ * Fetches ScanLogs for a scan with a matching `entry`
+ *
+ * Accepts an array of CompositeGroups to produce one or more
+ * groups based on the CompositeGroup key
+ **/
+const groupLogs = async (
+  id: string,
+  opt: {
+    entry: string
+    composites: CompositeGroup[]
+  }
+): Promise<GroupedLogs> => {
+  const { groups } = await groupLogsWithStats(id, opt)
+  return groups
 }
 
 /**
@@ -346,15 +927,29 @@ const groupLogs = async (
  * of events
  **/
 const summary = async (id: string) => {
-  const requests = await groupLogs(id, {
+  const {
+    groups: requests,
+    untracked,
+    capReached,
+    heapUsed
+  } = await groupLogsWithStats(id, {
     entry: 'request',
-    composites: [domainComposite]
+    composites: [domainComposite],
+    maxKeys: await SettingService.get<number>('scans.summary.maxDomains')
   })
-  let totalReq = 0
+  const includeDomains = await SettingService.get<boolean>(
+    'scans.summary.includeDomains'
+  )
+  let totalReq = untracked.domain || 0
+  let totalIPHostReq = 0
   const orderedDomains = { domain: [] }
   if (requests.domain !== undefined) {
-    totalReq = sumComposite(requests.domain)
-    orderedDomains.domain = orderComposite(requests.domain)
+    totalReq += sumComposite(requests.domain)
+    totalIPHostReq = sumIPHosts(requests.domain)
+    // counts are kept when the domain list is omitted
+    if (includeDomains) {
+      orderedDomains.domain = orderComposite(requests.domain)
+    }
   }
   const totalFunc = await scanLogService.countByScanID(id, 'function-call')
   const totalErrors = await scanLogService.countByScanID(id, 'page-error')
@@ -370,28 +965,319 @@ const summary = async (id: string) => {
     'rule-alert',
     ruleAlertEvent
   )
+  // alerts collapsed by the rate limit
+  const storm = await Alert.query().findOne({
+    scan_id: id,
+    rule: STORM_RULE
+  })
+  const stormCount = storm?.context?.suppressed_count
+  const stormDomains = storm?.context?.domains
+  // unknown domains did not alert while the site was learning
+  const scan = await Scan.query()
+    .select('created_at', 'site_id', 'suppressed_alerts')
+    .findById(id)
+  const site = scan?.site_id
+    ? await Site.query().select('baseline_until').findById(scan.site_id)
+    : undefined
 
   return {
     // ordered
     requests: orderedDomains,
     totalReq,
+    totalIPHostReq,
     totalAlerts,
     totalErrors,
     totalFunc,
-    totalCookies
+    totalCookies,
+    domainCapReached: capReached,
+    untrackedReq: untracked.domain || 0,
+    samplesDisabled: !includeDomains,
+    // storm summary or alerts counted on the scan (`count` overflow)
+    suppressedAlerts:
+      typeof stormCount === 'number'
+        ? stormCount
+        : scan?.suppressed_alerts || 0,
+    suppressedDomains: Array.isArray(stormDomains) ? stormDomains : [],
+    learningMode: inLearningMode(site, scan?.created_at),
+    heapUsed
+  }
+}
+
+type SiteSummary = {
+  // number of completed scans aggregated
+  scans: number
+  totalAlerts: number
+  // alert totals by rule name
+  rules: Record<string, number>
+  unknownDomains: number
+  // unknown.domain alerts for domains seen fewer than the min hits
+  belowSeenThreshold: number
+  iocMatches: number
+  // script.hash alerts (known script changed)
+  scriptHashChanges: number
+  // exfil alerts (payloads sent to unknown domains)
+  exfilAlerts: number
+  // landing URL compared to the site target URL
+  targetDrift: TargetDrift
+}
+
+/**
+ * siteSummary
+ *
+ * Aggregates rule alerts across the `limit` most
+ * recent completed scans for a site
+ **/
+const siteSummary = async (
+  siteID: string,
+  limit = 10
+): Promise<SiteSummary> => {
+  const scans = await Scan.query()
+    .select('id')
+    .where({ site_id: siteID, state: 'completed' })
+    .orderBy('created_at', 'desc')
+    .limit(limit)
+  const res: SiteSummary = {
+    scans: scans.length,
+    totalAlerts: 0,
+    rules: {},
+    unknownDomains: 0,
+    belowSeenThreshold: 0,
+    iocMatches: 0,
+    scriptHashChanges: 0,
+    exfilAlerts: 0,
+    targetDrift: SiteService.targetDrift(await SiteService.view(siteID))
+  }
+  if (scans.length === 0) return res
+  const rows = ((await ScanLog.query()
+    .select(raw("event::jsonb->>'name'").as('rule'))
+    .count('id', { as: 'total' })
+    .select(
+      raw(
+        "count(id) filter (where event::jsonb->'context'->>'below_seen_threshold' = 'true')"
+      ).as('below')
+    )
+    .whereIn(
+      'scan_id',
+      scans.map(s => s.id)
+    )
+    .where('entry', 'rule-alert')
+    .modify(ruleAlertEvent)
+    .groupByRaw("event::jsonb->>'name'")) as unknown) as Array<{
+    rule: string
+    total: string
+    below: string
+  }>
+  rows.forEach(row => {
+    const total = parseInt(row.total, 10)
+    res.rules[row.rule] = total
+    res.totalAlerts += total
+    res.belowSeenThreshold += parseInt(row.below, 10)
+  })
+  res.unknownDomains =
+    (res.rules['unknown.domain'] || 0) - res.belowSeenThreshold
+  res.iocMatches = res.rules['ioc.domain'] || 0
+  res.scriptHashChanges = res.rules['script.hash'] || 0
+  res.exfilAlerts = res.rules['exfil'] || 0
+  return res
+}
+
+export type ScanRules = {
+  site_id: string | null
+  disabled: string[]
+  // IOC values that do not alert for the site (lowercase)
+  ioc_exceptions: string[]
+  // global allowlist suffixes the site does not trust (lowercase)
+  untrusted_suffixes: string[]
+  // unknown domains build the seen baseline without alerting
+  learning: boolean
+  baseline_until: Date | null
+}
+
+/**
+ * inLearningMode
+ *
+ * True while `now` is before the site's `baseline_until`
+ */
+export const inLearningMode = (
+  site: Pick<Site, 'baseline_until'> | undefined,
+  now = new Date()
+): boolean =>
+  !!site?.baseline_until && new Date(site.baseline_until) > now
+
+/**
+ * disabledRules
+ *
+ * Rules turned off in the scan's site `rules_config`, the site's
+ * IOC exceptions, un-trusted global allowlist suffixes and learning
+ * mode. Test scans without a site run every rule
+ **/
+const disabledRules = async (id: string): Promise<ScanRules> => {
+  const scan = await view(id)
+  if (!scan.site_id) {
+    return {
+      site_id: null,
+      disabled: [],
+      ioc_exceptions: [],
+      untrusted_suffixes: [],
+      learning: false,
+      baseline_until: null
+    }
+  }
+  const site = await Site.query()
+    .select(
+      'rules_config',
+      'ioc_exceptions',
+      'untrusted_suffixes',
+      'baseline_until'
+    )
+    .findById(scan.site_id)
+  const rulesConfig = site?.rules_config || {}
+  return {
+    site_id: scan.site_id,
+    disabled: Object.keys(rulesConfig)
+      .filter(rule => rulesConfig[rule].enabled === false)
+      .sort(),
+    ioc_exceptions: (site?.ioc_exceptions || []).map(value =>
+      value.trim().toLowerCase()
+    ),
+    untrusted_suffixes: (site?.untrusted_suffixes || []).map(value =>
+      value
+        .trim()
+        .toLowerCase()
+        .replace(/^\*?\./, '')
+    ),
+    learning: inLearningMode(site),
+    baseline_until: site?.baseline_until || null
+  }
+}
+
+// domain that would have alerted while the site was learning
+export type WouldAlertDomain = {
+  rule: string
+  domain: string
+  // message of the first result
+  message: string
+  // page the request was made from, the scan landing URL when unknown
+  page_url: string | null
+  // first request to the domain
+  request_url: string
+  first_seen: Date
+  // results for the domain in the scan
+  count: number
+}
+
+export type RulesResults = {
+  scan_id: string
+  learning_mode: boolean
+  // the scan landed away from the site target URL
+  target_drift: { reason: string; landing_url: string } | null
+  // alerts by rule name
+  alerts: Record<string, number>
+  would_alert: WouldAlertDomain[]
+}
+
+/**
+ * rulesResults
+ *
+ * Alert totals of a scan and the unknown domains recorded in
+ * learning mode, one entry per rule / domain in first seen order
+ **/
+const rulesResults = async (id: string): Promise<RulesResults> => {
+  const scan = await view(id)
+  const site = scan.site_id
+    ? await Site.query()
+        .select('baseline_until')
+        .findById(scan.site_id)
+    : undefined
+  const counts = ((await ScanLog.query()
+    .select(raw("event::jsonb->>'name'").as('rule'))
+    .count('id', { as: 'total' })
+    .where({ scan_id: id, entry: 'rule-alert' })
+    .modify(ruleAlertEvent)
+    .groupByRaw("event::jsonb->>'name'")) as unknown) as Array<{
+    rule: string
+    total: string
+  }>
+  const alerts: Record<string, number> = {}
+  counts.forEach(row => {
+    alerts[row.rule] = parseInt(row.total, 10)
+  })
+  const logs = await ScanLog.query()
+    .select('event', 'created_at')
+    .where({ scan_id: id, entry: 'rule-alert' })
+    .whereRaw('event::jsonb @> ?', [{ context: { learning: true } }])
+    .orderBy([
+      { column: 'created_at', order: 'asc' },
+      { column: 'id', order: 'asc' }
+    ])
+  const byDomain = new Map<string, WouldAlertDomain>()
+  let landing: string | null | undefined
+  for (const log of logs) {
+    const evt = log.event as MerryMaker.RuleAlert
+    const context = evt.context || {}
+    const key = `${evt.name}|${context.domain}`
+    const seenAt = context.seen_at
+      ? new Date(context.seen_at)
+      : new Date(log.created_at)
+    const found = byDomain.get(key)
+    if (found) {
+      found.count += 1
+      if (seenAt < found.first_seen) {
+        found.first_seen = seenAt
+      }
+      continue
+    }
+    let pageURL = context.page_url || null
+    if (pageURL === null) {
+      if (landing === undefined) {
+        landing = await landingURL(id)
+      }
+      pageURL = landing
+    }
+    byDomain.set(key, {
+      rule: evt.name,
+      domain: context.domain,
+      message: evt.message,
+      page_url: pageURL,
+      request_url: context.url,
+      first_seen: seenAt,
+      count: 1
+    })
+  }
+  return {
+    scan_id: id,
+    learning_mode: inLearningMode(site, scan.created_at),
+    target_drift: scan.target_drift
+      ? { reason: scan.target_drift, landing_url: scan.landing_url }
+      : null,
+    alerts,
+    would_alert: Array.from(byDomain.values())
   }
 }
 
 export default {
   schedule,
+  cancel,
+  disabledRules,
+  rulesResults,
+  siteSummary,
   summary,
   domainComposite,
   updateState,
   purge,
+  pruneEvents,
   purgeTests,
   bulkDelete,
   groupLogs,
+  groupLogsWithStats,
   totalScheduled,
+  findAndFailIdle,
+  pendingBySite,
+  maxWaitSeconds,
+  awaitingRules,
+  stateCounts,
+  landingURL,
+  trackLanding,
   isActive,
   urlComposite,
   view,
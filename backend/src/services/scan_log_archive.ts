@@ -0,0 +1,166 @@
+import { config } from 'node-config-ts'
+import { subDays } from 'date-fns'
+import { ScanLog } from '../models'
+import logger from '../loaders/logger'
+import { metrics, Metrics } from '../lib/metrics'
+import { ObjectStorage, S3Storage } from '../lib/object-storage'
+
+// `event` of archived scan logs, the payload is in object storage
+export const ARCHIVED_EVENT = { archived: true }
+
+let defaultStorage: ObjectStorage
+
+/**
+ * archiveStorage
+ *
+ * Object storage of archived events (`scans.archive.storage`)
+ */
+export const archiveStorage = (): ObjectStorage => {
+  if (!defaultStorage) {
+    defaultStorage = new S3Storage(config.scans.archive.storage)
+  }
+  return defaultStorage
+}
+
+export const storageKey = (
+  log: Pick<ScanLog, 'id' | 'scan_id'>,
+  prefix: string = config.scans.archive.storage.prefix
+): string => `${prefix || ''}${log.scan_id}/${log.id}.json`
+
+export type ArchiveOptions = {
+  storage?: ObjectStorage
+  entries?: string[]
+  batchSize?: number
+  stats?: Metrics
+  now?: Date
+}
+
+export type ArchiveResult = {
+  events: number
+  bytes: number
+}
+
+/**
+ * archive
+ *
+ * Uploads the events of scan logs older than `afterDays` to object
+ * storage and replaces them with a stub (`ARCHIVED_EVENT`). Stops at
+ * the first failed upload, the remaining events are retried on
+ * the next run
+ */
+const archive = async (
+  afterDays: number = config.scans.archive.afterDays,
+  opts: ArchiveOptions = {}
+): Promise<ArchiveResult> => {
+  const result = { events: 0, bytes: 0 }
+  if (!afterDays) return result
+  const storage = opts.storage || archiveStorage()
+  const entries = opts.entries || config.scans.archive.entries
+  const batchSize = opts.batchSize || config.scans.archive.batchSize
+  const cutoff = subDays(opts.now || new Date(), afterDays)
+  for (;;) {
+    const logs = await ScanLog.query()
+      .select('id', 'scan_id', 'event')
+      .whereNull('archived_at')
+      .where('created_at', '<', cutoff)
+      .modify((builder) => {
+        if (entries.length) {
+          builder.whereIn('entry', entries)
+        }
+      })
+      .orderBy('created_at')
+      .limit(batchSize)
+    for (const log of logs) {
+      const key = storageKey(log)
+      const body = JSON.stringify(log.event)
+      try {
+        await storage.put(key, body)
+      } catch (e) {
+        logger.error({
+          module: 'services/scan_log_archive',
+          method: 'archive',
+          scan_log_id: log.id,
+          error: e.message,
+        })
+        metrics(opts.stats).gauge('scan_logs.archived_bytes', result.bytes)
+        return result
+      }
+      await ScanLog.query()
+        .patch({
+          event: ARCHIVED_EVENT,
+          storage_key: key,
+          archived_at: new Date(),
+        } as Partial<ScanLog>)
+        .where('id', log.id)
+        .whereNull('archived_at')
+      result.events += 1
+      result.bytes += Buffer.byteLength(body)
+    }
+    if (logs.length < batchSize) break
+  }
+  metrics(opts.stats).gauge('scan_logs.archived_bytes', result.bytes)
+  logger.info({
+    module: 'services/scan_log_archive',
+    method: 'archive',
+    ...result,
+  })
+  return result
+}
+
+/**
+ * purgeArchived
+ *
+ * Deletes archived scan logs older than `deleteAfterDays` along
+ * with their objects. Returns the number of deleted scan logs
+ */
+const purgeArchived = async (
+  deleteAfterDays: number = config.scans.archive.deleteAfterDays,
+  opts: Pick<ArchiveOptions, 'storage' | 'batchSize' | 'now'> = {}
+): Promise<number> => {
+  if (!deleteAfterDays) return 0
+  const batchSize = opts.batchSize || config.scans.archive.batchSize
+  const cutoff = subDays(opts.now || new Date(), deleteAfterDays)
+  let total = 0
+  for (;;) {
+    const logs = await ScanLog.query()
+      .select('id', 'storage_key')
+      .whereNotNull('archived_at')
+      .where('created_at', '<', cutoff)
+      .limit(batchSize)
+    if (logs.length === 0) break
+    // storage is only set up once there is something to delete
+    const storage = opts.storage || archiveStorage()
+    for (const log of logs) {
+      await storage.delete(log.storage_key)
+    }
+    total += await ScanLog.query()
+      .delete()
+      .whereIn(
+        'id',
+        logs.map((log) => log.id)
+      )
+    if (logs.length < batchSize) break
+  }
+  return total
+}
+
+/**
+ * restore
+ *
+ * `log` with its archived event fetched from storage, other
+ * scan logs are returned as is
+ */
+const restore = async (
+  log: ScanLog,
+  storage: ObjectStorage = archiveStorage()
+): Promise<ScanLog> => {
+  if (!log.archived_at || !log.storage_key) return log
+  log.event = JSON.parse(await storage.get(log.storage_key))
+  return log
+}
+
+export default {
+  archive,
+  purgeArchived,
+  restore,
+}
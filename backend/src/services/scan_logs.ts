@@ -1,13 +1,25 @@
 import { Job } from 'bull'
-import { Modifier, QueryBuilder } from 'objection'
+import { createHash } from 'crypto'
+import { v4 as uuidv4, validate as validateUUID } from 'uuid'
+import { Modifier, QueryBuilder, raw } from 'objection'
 import LRUCache from 'lru-native2'
 import ScanService from '../services/scan'
+import ScanLogArchiveService from './scan_log_archive'
 import SiteService from '../services/site'
-import { ScanLog, Scan, Alert } from '../models/'
+import { ScanLog, Scan, Alert, Site } from '../models/'
+import { Severities } from '../models/sites'
+import { ActiveAlertStatuses } from '../models/alerts'
 import { EventEmitter } from 'events'
 import MerryMaker, { EventMessage } from '@merrymaker/types'
 import Queues from '../jobs/queues'
 import logger from '../loaders/logger'
+import { redisClient } from '../repos/redis'
+import { config } from 'node-config-ts'
+import alertHooks from '../alerts/hooks'
+import SettingService, { definitions as settingDefinitions } from './setting'
+import { holdOptions } from './alert_dependency'
+import { Cursor, encodeCursor } from '../lib/cursor'
+import { truncateContext } from '../lib/context'
 
 const oneHour = 1000 * 60 * 60
 
@@ -20,20 +32,41 @@ const siteScanCache = new LRUCache({
 
 const events = new EventEmitter()
 
+// alert jobs held until the scan log job (key) that queued them
+// finishes, promoted by `releaseHeldBy`
+const heldAlertJobs = new Map<string, Job>()
+
+/**
+ * eventID
+ *
+ * ID assigned by the scanner to an event, alerts triggered
+ * by the event reference it as `context.event_id`
+ */
+const eventID = (evt: unknown): string | undefined => {
+  const id = (evt as { id?: unknown }).id
+  return typeof id === 'string' && validateUUID(id) ? id : undefined
+}
+
 async function work(
   job: Job<MerryMaker.EventResult | MerryMaker.RuleAlertEvent>
 ): Promise<ScanLog> {
   const evt = job.data
+  let alertJob: Job | undefined
   if (evt.entry === 'rule-alert' && !evt.test) {
     // ALERT!
     try {
-      await handleAlert(evt as MerryMaker.RuleAlertEvent)
+      const res = await handleAlert(
+        evt as MerryMaker.RuleAlertEvent,
+        String(job.id)
+      )
+      alertJob = res.job
     } catch (e) {
       logger.error('Exception while handling alert', e.message)
       throw e
     }
   } else if (evt.entry === 'complete') {
-    await ScanService.updateState(evt.scan_id, 'completed')
+    const scan = await ScanService.updateState(evt.scan_id, 'completed')
+    await ScanService.trackLanding(scan)
   } else if (evt.entry === 'active') {
     await ScanService.updateState(evt.scan_id, 'active')
   } else if (evt.entry === 'failed') {
@@ -41,16 +74,45 @@ async function work(
   }
 
   const logEntry = await ScanLog.query().insert({
+    id: eventID(evt),
     created_at: new Date(),
     entry: evt.entry,
     level: evt.level,
     scan_id: evt.scan_id,
     event: evt.event
   })
+  if (alertJob) {
+    heldAlertJobs.set(String(job.id), alertJob)
+  }
   events.emit('new-entry', logEntry)
   return logEntry
 }
 
+/**
+ * releaseHeldBy
+ *
+ * Scan log queue 'completed' / 'failed' handler, promotes the alert
+ * job held by `job`. Run once bull marked the job finished, promoted
+ * earlier `AlertDependencyService.ready` still sees it active and
+ * holds the alert again. Jobs already released (hold elapsed or
+ * reaped) are left as is
+ */
+async function releaseHeldBy(job: Job): Promise<void> {
+  const key = String(job.id)
+  const alertJob = heldAlertJobs.get(key)
+  if (!alertJob) return
+  heldAlertJobs.delete(key)
+  try {
+    await alertJob.promote()
+  } catch (e) {
+    logger.debug({
+      message: 'alert job already released',
+      job_id: alertJob.id,
+      error: e.message
+    })
+  }
+}
+
 async function handleFailed(job: Job<MerryMaker.EventResult>) {
   const scan = await ScanService.updateState(
     job.data.scan_id,
@@ -84,10 +146,13 @@ const getByScanID = async (
     .where('scan_id', id)
     .modify(whereBuilder)
 
+// archived events are fetched from object storage
 const view = async (id: string): Promise<ScanLog> =>
-  ScanLog.query()
-    .findById(id)
-    .throwIfNotFound()
+  ScanLogArchiveService.restore(
+    await ScanLog.query()
+      .findById(id)
+      .throwIfNotFound()
+  )
 
 const distinct = async (
   column: string,
@@ -115,18 +180,620 @@ const countByScanID = (
     .modify(whereBuilder)
     .resultSize()
 
+// screenshot events without the base64 image
+const TRIMMED_EVENT_SQL = `case when entry = 'screenshot'
+  then (event::jsonb - 'payload' || '{"payload_trimmed": true}')::json
+  else event end as event`
+
+/**
+ * trimmedEvent
+ *
+ * `event` column with screenshot images replaced by `payload_trimmed`
+ */
+export const trimmedEvent = () => raw(TRIMMED_EVENT_SQL)
+
+// ScanLog with the cursor to resume an export after it
+export type ExportRow = Partial<ScanLog> & { cursor: string }
+
+/**
+ * exportBatches
+ *
+ * Batch reader over the ScanLogs of a scan in (`created_at`, `id`)
+ * order, starting after `after` when resuming an export. Returns an
+ * empty batch once every row was read
+ */
+const exportBatches = (
+  scanID: string,
+  opts: {
+    batchSize: number
+    after?: Cursor
+    whereBuilder?: Modifier<QueryBuilder<ScanLog, ScanLog[]>>
+    // drop screenshot images
+    trim?: boolean
+  }
+): (() => Promise<ExportRow[]>) => {
+  let after = opts.after
+  return async () => {
+    const query = ScanLog.query()
+      .select(
+        opts.trim
+          ? [
+              'id',
+              'entry',
+              'scan_id',
+              'level',
+              'created_at',
+              trimmedEvent()
+            ]
+          : ScanLog.selectAble()
+      )
+      .where('scan_id', scanID)
+      .modify(opts.whereBuilder)
+      .orderBy('created_at', 'asc')
+      .orderBy('id', 'asc')
+      .limit(opts.batchSize)
+    if (after) {
+      query.whereRaw('(created_at, id) > (?, ?)', [after.created_at, after.id])
+    }
+    const rows = await query
+    if (rows.length === 0) {
+      return []
+    }
+    const last = rows[rows.length - 1]
+    after = {
+      created_at: new Date(last.created_at).toISOString(),
+      id: last.id,
+      dir: 'asc'
+    }
+    return rows.map(row => ({
+      ...row.toJSON(),
+      cursor: encodeCursor(row, 'asc')
+    }))
+  }
+}
+
+// lost releases free the slot after an hour
+const EXPORT_SLOT_TTL_SECONDS = 60 * 60
+
+const exportSlotKey = (user: string) => `scan_log_export:${user}`
+
+/**
+ * acquireExport
+ *
+ * Claims one of the `maxPerUser` concurrent export slots of `user`,
+ * resolves false when every slot is taken
+ */
+const acquireExport = async (
+  user: string,
+  maxPerUser: number
+): Promise<boolean> => {
+  const key = exportSlotKey(user)
+  const res = await redisClient
+    .multi()
+    .incr(key)
+    .expire(key, EXPORT_SLOT_TTL_SECONDS)
+    .exec()
+  if ((res[0][1] as number) > maxPerUser) {
+    await redisClient.decr(key)
+    return false
+  }
+  return true
+}
+
+const releaseExport = async (user: string): Promise<void> => {
+  await redisClient.decr(exportSlotKey(user))
+}
+
+export type EntryFacet = {
+  entry: string
+  count: number
+}
+
+/**
+ * entryFacets
+ *
+ * Number of ScanLogs per `entry` for a scan, most frequent first
+ */
+const entryFacets = async (scanID: string): Promise<EntryFacet[]> => {
+  const rows = ((await ScanLog.query()
+    .select('entry')
+    .count('* as count')
+    .where('scan_id', scanID)
+    .groupBy('entry')
+    .orderBy([
+      { column: 'count', order: 'desc' },
+      { column: 'entry', order: 'asc' }
+    ])) as unknown) as Array<{ entry: string; count: string }>
+  return rows.map(row => ({ entry: row.entry, count: Number(row.count) }))
+}
+
+// host of `scheme://[userinfo@]host[:port]/...` URLs
+const URL_HOST_PATTERN = '^[a-zA-Z][a-zA-Z0-9+.-]*://(?:[^@/]*@)?([^/:?#]+)'
+
+// uses the partial request index on created_at
+const TOP_DOMAINS_SQL = `
+select domain, count(*)::integer as events, count(distinct site_id)::integer as sites
+from (
+  select lower(substring(scan_logs.event->>'url' from :pattern)) as domain,
+    scans.site_id
+  from scan_logs
+  join scans on scans.id = scan_logs.scan_id
+  where scan_logs.entry = 'request' and scan_logs.created_at >= :since
+) requests
+where domain is not null
+group by domain
+order by events desc, domain asc
+limit :limit
+`
+
+export type TopDomain = {
+  domain: string
+  // request events in the window
+  events: number
+  // distinct sites requesting the domain
+  sites: number
+}
+
+/**
+ * topDomains
+ *
+ * Domains with the most request events across all sites
+ * since `since`, with the number of sites requesting them
+ */
+const topDomains = async (opts: {
+  since: Date
+  limit: number
+}): Promise<TopDomain[]> => {
+  const res = await ScanLog.knex().raw(TOP_DOMAINS_SQL, {
+    pattern: URL_HOST_PATTERN,
+    since: opts.since,
+    limit: opts.limit
+  })
+  return res.rows
+}
+
+const severityRank = (severity: string): number =>
+  Severities.indexOf(severity)
+
+// `alerts.severity` setting of `rule`, null when unset
+const ruleSeverity = async (
+  rule: string,
+  siteValue?: string | null
+): Promise<string | null> => {
+  const key = `alerts.severity.${rule}`
+  if (settingDefinitions[key] === undefined) return siteValue || null
+  return (await SettingService.resolve<string>(key, siteValue || null)) || null
+}
+
+/**
+ * resolveSeverity
+ *
+ * unknown.domain alerts use the site severity (or the rule setting,
+ * `medium` by default), raised to the rule provided
+ * `context.severity` when that is higher. Other rules use
+ * `context.severity`, or their rule setting
+ */
+const resolveSeverity = async (
+  rule: string,
+  context: Record<string, unknown> | undefined,
+  site: Partial<Pick<Site, 'unknown_domain_severity'>>
+): Promise<string | null> => {
+  const ctxSeverity =
+    typeof context?.severity === 'string' &&
+    Severities.includes(context.severity)
+      ? context.severity
+      : null
+  if (rule !== 'unknown.domain') {
+    return ctxSeverity || ruleSeverity(rule)
+  }
+  const siteSeverity =
+    (await ruleSeverity(rule, site.unknown_domain_severity)) || 'medium'
+  if (ctxSeverity && severityRank(ctxSeverity) > severityRank(siteSeverity)) {
+    return ctxSeverity
+  }
+  return siteSeverity
+}
+
+// deletes the claim only while `token` still owns it
+const RELEASE_SCRIPT = `if redis.call('get', KEYS[1]) == ARGV[1] then
+  return redis.call('del', KEYS[1])
+end
+return 0`
+
+/**
+ * alertOnceKey
+ *
+ * Key of the alert-once window for an unknown domain on a site,
+ * or of the per-scan dedupe of exfil alerts. Null when the alert
+ * is not deduped
+ */
+const alertOnceKey = (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent
+): string | null => {
+  const domain = logEvent.event.context?.domain
+  if (typeof domain !== 'string') {
+    return null
+  }
+  if (logEvent.rule === 'exfil') {
+    return `exfil_once:${site_id}:${logEvent.scan_id}:${domain}`
+  }
+  if (logEvent.rule !== 'unknown.domain') {
+    return null
+  }
+  return unknownDomainOnceKey(site_id, domain)
+}
+
+const unknownDomainOnceKey = (site_id: string, domain: string): string =>
+  `alert_once:${site_id}:unknown.domain:${domain}`
+
+/**
+ * peekAlertOnce
+ *
+ * Read-only check, returns true when the alert would be
+ * suppressed by an existing alert-once window
+ */
+const peekAlertOnce = async (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent
+): Promise<boolean> => {
+  const key = alertOnceKey(site_id, logEvent)
+  if (key === null) {
+    return false
+  }
+  return (await redisClient.exists(key)) === 1
+}
+
+/**
+ * peekAlertOnceMany
+ *
+ * `peekAlertOnce` for several unknown domains of a site with
+ * one MGET, returns the domains inside an alert-once window
+ */
+const peekAlertOnceMany = async (
+  site_id: string,
+  domains: string[]
+): Promise<Set<string>> => {
+  if (domains.length === 0) {
+    return new Set()
+  }
+  const windows = await redisClient.mget(
+    ...domains.map(domain => unknownDomainOnceKey(site_id, domain))
+  )
+  return new Set(domains.filter((_, i) => windows[i] !== null))
+}
+
+/**
+ * alertOnceTTL
+ *
+ * Minutes of the alert-once window of `rule`. Sites override it
+ * for unknown domains (`alert_ttl_minutes`), then the organization
+ * setting and the `alerts.alertOnce.ttlMinutes` default apply
+ */
+export const alertOnceTTL = async (
+  rule: string,
+  site?: Pick<Site, 'alert_ttl_minutes'>
+): Promise<number> => {
+  const key = `alerts.alertOnce.ttlMinutes.${rule}`
+  if (settingDefinitions[key] === undefined) {
+    return config.alerts.alertOnce?.ttlMinutes?.[rule] || 1440
+  }
+  return SettingService.resolve<number>(
+    key,
+    rule === 'unknown.domain' ? site?.alert_ttl_minutes : null
+  )
+}
+
+/**
+ * alertOnce
+ *
+ * Claims the alert-once window for an unknown domain on a site
+ * with an atomic SET NX, the first caller wins. Returns the claim
+ * token (or 'unclaimed' when alert-once does not apply), null if
+ * the domain already alerted within `ttlMinutes`
+ */
+const alertOnce = async (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent,
+  ttlMinutes: number
+): Promise<string | null> => {
+  const key = alertOnceKey(site_id, logEvent)
+  if (key === null) {
+    return 'unclaimed'
+  }
+  const token = uuidv4()
+  const res = await redisClient.set(key, token, 'EX', ttlMinutes * 60, 'NX')
+  return res === 'OK' ? token : null
+}
+
+/**
+ * releaseClaim
+ *
+ * Deletes `key` while `token` still owns it, failures are logged
+ */
+const releaseClaim = async (key: string, token: string): Promise<void> => {
+  try {
+    await redisClient.eval(RELEASE_SCRIPT, 1, key, token)
+  } catch (e) {
+    logger.error({
+      message: 'failed releasing alert claim',
+      key,
+      error: e.message
+    })
+  }
+}
+
+/**
+ * releaseAlertOnce
+ *
+ * Releases a claim made by `alertOnce` so a failed alert
+ * is not suppressed for the rest of the window
+ */
+const releaseAlertOnce = async (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent,
+  token: string
+): Promise<void> => {
+  const key = alertOnceKey(site_id, logEvent)
+  if (key === null) {
+    return
+  }
+  await releaseClaim(key, token)
+}
+
+// context keys identifying what an alert is about, by precedence
+const SUBJECT_KEYS = ['domain', 'url', 'hash', 'value']
+
+/**
+ * alertFingerprint
+ *
+ * Stable hash of the site, rule and subject of an alert (the first
+ * of `SUBJECT_KEYS` in its context, its message otherwise), equal
+ * for alerts every sink would deliver as the same
+ */
+export const alertFingerprint = (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent
+): string => {
+  const context = logEvent.event.context || {}
+  const key = SUBJECT_KEYS.find(k => typeof context[k] === 'string')
+  const subject = key ? `${key}:${context[key]}` : `${logEvent.event.message}`
+  return createHash('sha256')
+    .update([site_id, logEvent.rule, subject].join('\n'))
+    .digest('hex')
+}
+
+/**
+ * dedupeWindow
+ *
+ * Minutes identical alerts of `rule` are deduped for, see
+ * `alerts.dedupe.windowMinutes` ('*' applies to unlisted rules)
+ */
+export const dedupeWindow = (rule: string): number => {
+  const windows = config.alerts.dedupe?.windowMinutes || {}
+  const minutes = rule in windows ? windows[rule] : windows['*']
+  return minutes > 0 ? minutes : 0
+}
+
+type DedupeClaim = {
+  // null when the rule is not deduped
+  key: string | null
+  fingerprint?: string
+  token?: string
+  // active alert with the same fingerprint
+  existing?: Alert
+  // duplicates of `existing` suppressed so far
+  suppressed?: number
+}
+
+/**
+ * claimFingerprint
+ *
+ * Claims the dedupe window of the alert fingerprint like
+ * `alertOnce` claims alert-once windows. When an identical alert
+ * is active (open or acknowledged) within the window, resolves
+ * with it (and counts the duplicate against it) instead
+ */
+const claimFingerprint = async (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent
+): Promise<DedupeClaim> => {
+  const minutes = dedupeWindow(logEvent.rule)
+  if (minutes === 0) {
+    return { key: null }
+  }
+  const fingerprint = alertFingerprint(site_id, logEvent)
+  const key = `alert_fp:${fingerprint}`
+  const token = `pending:${uuidv4()}`
+  if ((await redisClient.set(key, token, 'EX', minutes * 60, 'NX')) === 'OK') {
+    return { key, fingerprint, token }
+  }
+  const id = await redisClient.get(key)
+  const existing = validateUUID(id || '')
+    ? await Alert.query()
+        .findById(id)
+        .whereIn('status', ActiveAlertStatuses)
+    : undefined
+  if (id && !existing && !id.startsWith('pending:')) {
+    // alert deleted or handled, the next identical one is a new alert
+    await redisClient.set(key, token, 'EX', minutes * 60)
+    return { key, fingerprint, token }
+  }
+  const suppressed = await redisClient.incr(`${key}:suppressed`)
+  await redisClient.expire(`${key}:suppressed`, minutes * 60)
+  if (!existing) {
+    // identical alert still being created
+    return { key, fingerprint, suppressed }
+  }
+  return {
+    key,
+    fingerprint,
+    suppressed,
+    existing: await Alert.query().patchAndFetchById(existing.id, {
+      context: { ...existing.context, suppressed_duplicates: suppressed }
+    })
+  }
+}
+
+// rule of the summary alert created once a scan is rate limited
+export const STORM_RULE = 'alert.storm'
+const STORM_TTL_SECONDS = 24 * 60 * 60
+
+/**
+ * alertBudget
+ *
+ * Counts the alert against the scan and the hourly site budget,
+ * resolves false once either limit of `alerts.rateLimit` is exceeded
+ */
+const alertBudget = async (
+  site_id: string,
+  scan_id: string,
+  now = new Date()
+): Promise<boolean> => {
+  const limits = config.alerts.rateLimit
+  if (!limits?.enabled) {
+    return true
+  }
+  const hour = Math.floor(now.getTime() / 3600000)
+  const scanKey = `alert_rate:scan:${scan_id}`
+  const siteKey = `alert_rate:site:${site_id}:${hour}`
+  const res = await redisClient
+    .multi()
+    .incr(scanKey)
+    .expire(scanKey, STORM_TTL_SECONDS)
+    .incr(siteKey)
+    .expire(siteKey, 3600)
+    .exec()
+  const scanCount = res[0][1] as number
+  const siteCount = res[2][1] as number
+  return scanCount <= limits.perScan && siteCount <= limits.perSiteHour
+}
+
+const stormMessage = (rule: string, count: number): string =>
+  `alert storm detected: ${count} additional ${
+    rule === 'unknown.domain' ? 'unknown domains' : `${rule} alerts`
+  } suppressed`
+
+/**
+ * recordStorm
+ *
+ * Collapses a rate limited alert into the summary alert of its
+ * scan. The first suppressed alert creates (and queues) the summary,
+ * later ones update its count and sample of domains
+ */
+const recordStorm = async (
+  site_id: string,
+  logEvent: MerryMaker.RuleAlertEvent
+): Promise<Alert | undefined> => {
+  const prefix = `alert_storm:${logEvent.scan_id}`
+  const domain = logEvent.event.context?.domain
+  const sampleSize = await SettingService.get<number>(
+    'alerts.rateLimit.sampleSize'
+  )
+  const count = await redisClient.incr(`${prefix}:count`)
+  await redisClient.expire(`${prefix}:count`, STORM_TTL_SECONDS)
+  if (typeof domain === 'string') {
+    if ((await redisClient.scard(`${prefix}:domains`)) < sampleSize) {
+      await redisClient.sadd(`${prefix}:domains`, domain)
+      await redisClient.expire(`${prefix}:domains`, STORM_TTL_SECONDS)
+    }
+  }
+  const domains = (await redisClient.smembers(`${prefix}:domains`)).sort()
+  const context = {
+    rule: logEvent.rule,
+    suppressed_count: count,
+    domains
+  }
+  const claimed = await redisClient.set(
+    `${prefix}:alert`,
+    'pending',
+    'EX',
+    STORM_TTL_SECONDS,
+    'NX'
+  )
+  if (claimed !== 'OK') {
+    // created by an earlier suppression, an update racing the
+    // creation is picked up by the next one
+    const id = await redisClient.get(`${prefix}:alert`)
+    if (!validateUUID(id || '')) {
+      return undefined
+    }
+    return Alert.query().patchAndFetchById(id, {
+      message: stormMessage(logEvent.rule, count),
+      context
+    })
+  }
+  const alert = await Alert.query().insert({
+    rule: STORM_RULE,
+    message: stormMessage(logEvent.rule, count),
+    context,
+    scan_id: logEvent.scan_id,
+    site_id,
+    severity: 'high',
+    created_at: new Date()
+  })
+  await redisClient.set(
+    `${prefix}:alert`,
+    alert.id,
+    'EX',
+    STORM_TTL_SECONDS
+  )
+  await Queues.alertQueue.add(
+    {
+      level: 'info',
+      entry: 'rule-alert',
+      scan_id: logEvent.scan_id,
+      event: {
+        name: STORM_RULE,
+        level: logEvent.event.level,
+        alert: true,
+        message: alert.message,
+        context
+      },
+      alert_id: alert.id,
+      severity: alert.severity
+    },
+    { removeOnComplete: true }
+  )
+  return alert
+}
+
+/**
+ * countOverflow
+ *
+ * Counts an alert over the limits on its scan (`count` overflow),
+ * a single update without an alert or a delivery. Returns the
+ * number of alerts suppressed so far
+ */
+const countOverflow = async (scan_id: string): Promise<number> => {
+  const [scan] = await Scan.query()
+    .increment('suppressed_alerts', 1)
+    .where('id', scan_id)
+    .returning('suppressed_alerts')
+  return scan?.suppressed_alerts || 0
+}
+
 /**
  * handleAlert
  *
  * Handles rule alerts from scanner.
  *
  * Adds the alert to the AlertQueue, and inserts a new Alert
- * record for the UI.
+ * record for the UI. With `dependsOn`, the alert job is held
+ * until that scan log job persisted the triggering event.
  *
  */
 const handleAlert = async (
-  logEvent: MerryMaker.RuleAlertEvent
-): Promise<{ result: string; alertEvent?: Alert; job?: Job }> => {
+  logEvent: MerryMaker.RuleAlertEvent,
+  // scan log job the alert job is held for
+  dependsOn?: string
+): Promise<{
+  result: string
+  alertEvent?: Alert
+  job?: Job
+  // duplicates of `alertEvent` suppressed within its dedupe window
+  suppressed?: number
+}> => {
   if (!logEvent.event.alert) {
     return { result: 'event.alert is false' }
   }
@@ -146,38 +813,124 @@ const handleAlert = async (
   }
   // read-through cache
   siteScanCache.set(logEvent.scan_id, site_id)
-  const job = await Queues.alertQueue.add(
-    {
-      level: 'info',
-      entry: 'rule-alert',
-      scan_id: logEvent.scan_id,
-      event: logEvent.event
-    },
-    {
-      removeOnComplete: true
-      // need to split out goAlert and kakfa sending
-      //attempts: 3,
+  const site = await Site.query()
+    .findById(site_id)
+    .select('id', 'alert_ttl_minutes', 'unknown_domain_severity')
+  const claim = await alertOnce(
+    site_id,
+    logEvent,
+    await alertOnceTTL(logEvent.rule, site)
+  )
+  if (claim === null) {
+    return { result: 'suppressed by alert-once window' }
+  }
+  const dedupe = await claimFingerprint(site_id, logEvent)
+  if (dedupe.key !== null && dedupe.token === undefined) {
+    return {
+      result: 'suppressed by alert fingerprint',
+      alertEvent: dedupe.existing,
+      suppressed: dedupe.suppressed
     }
+  }
+  if (!(await alertBudget(site_id, logEvent.scan_id))) {
+    // no alert was created, the domain may alert once the limit resets
+    await releaseAlertOnce(site_id, logEvent, claim)
+    if (dedupe.key !== null) {
+      await releaseClaim(dedupe.key, dedupe.token)
+    }
+    if (config.alerts.rateLimit.overflow === 'count') {
+      const suppressed = await countOverflow(logEvent.scan_id)
+      return { result: 'suppressed by alert cap', suppressed }
+    }
+    const alertEvent = await recordStorm(site_id, logEvent)
+    return { result: 'suppressed by alert rate limit', alertEvent }
+  }
+  // oversized fields are cut in the alert and its deliveries,
+  // the scan log keeps the full event
+  const context = truncateContext(
+    logEvent.event.context,
+    config.alerts.context?.maxFieldLength || 0
   )
-  // Need to alert AlertService
-  const alertEvent = await Alert.query().insert({
-    rule: logEvent.rule,
-    message: logEvent.event.message,
-    context: logEvent.event.context,
-    scan_id: logEvent.scan_id,
-    site_id,
-    created_at: new Date()
-  })
+  const severity = await resolveSeverity(
+    logEvent.rule,
+    logEvent.event.context,
+    site || {}
+  )
+  let alertEvent: Alert
+  let job: Job
+  try {
+    // the alert is only committed once its job is queued, a failed
+    // add rolls the insert back so a retry does not duplicate it
+    const queued = await Alert.transaction(async trx => {
+      // Need to alert AlertService
+      const inserted = await Alert.query(trx).insert({
+        rule: logEvent.rule,
+        message: logEvent.event.message,
+        context: dedupe.fingerprint
+          ? { ...context, fingerprint: dedupe.fingerprint }
+          : context,
+        scan_id: logEvent.scan_id,
+        site_id,
+        severity,
+        created_at: new Date()
+      })
+      const added = await Queues.alertQueue.add(
+        {
+          level: 'info',
+          entry: 'rule-alert',
+          scan_id: logEvent.scan_id,
+          event: { ...logEvent.event, context },
+          alert_id: inserted.id,
+          severity: inserted.severity,
+          depends_on: dependsOn
+        },
+        {
+          removeOnComplete: true,
+          ...(dependsOn ? holdOptions() : {})
+          // need to split out goAlert and kakfa sending
+          //attempts: 3,
+        }
+      )
+      return { inserted, added }
+    })
+    alertEvent = queued.inserted
+    job = queued.added
+    if (dedupe.key !== null) {
+      await redisClient.set(
+        dedupe.key,
+        alertEvent.id,
+        'EX',
+        dedupeWindow(logEvent.rule) * 60
+      )
+    }
+  } catch (e) {
+    await releaseAlertOnce(site_id, logEvent, claim)
+    if (dedupe.key !== null) {
+      await releaseClaim(dedupe.key, dedupe.token)
+    }
+    throw e
+  }
+  // runs in the background, hooks never fail the alert
+  alertHooks.dispatch(alertEvent)
   return { result: 'alerted', alertEvent, job }
 }
 
 export default {
   events,
   work,
+  releaseHeldBy,
   view,
   distinct,
   countByScanID,
   getByScanID,
   handleAlert,
-  siteScanCache
+  peekAlertOnce,
+  peekAlertOnceMany,
+  resolveSeverity,
+  siteScanCache,
+  topDomains,
+  entryFacets,
+  exportBatches,
+  acquireExport,
+  releaseExport
 }
@@ -0,0 +1,193 @@
+import { Queue } from 'bull'
+import { addMinutes, differenceInMinutes } from 'date-fns'
+import { config } from 'node-config-ts'
+import MerryMaker from '@merrymaker/types'
+import logger from '../loaders/logger'
+import ScanService from './scan'
+import SiteService, { clampInterval } from './site'
+import SettingService from './setting'
+import { Site } from '../models'
+import { metrics, Metrics } from '../lib/metrics'
+
+/**
+ * OverrunPolicy
+ *
+ * queue - schedule a scan every time a site is runnable
+ * queue-bounded - skip sites with `maxQueueDepth` or more pending scans
+ * skip - skip sites with any pending scan
+ */
+export type OverrunPolicy = 'queue' | 'queue-bounded' | 'skip'
+
+export type TickOptions = {
+  overrunPolicy: OverrunPolicy
+  maxQueueDepth: number
+  jitterSeconds: number
+  // sites overdue by more than this (minutes) are caught up with a
+  // single scan instead of one per missed interval (0 disables)
+  maxCatchUpMinutes: number
+  // priority boost per minute a site is overdue (0 disables)
+  agingPerMinute: number
+}
+
+export type TickResult = {
+  // runnable sites found
+  due: number
+  // scans added to the queue
+  scheduled: number
+  // sites skipped by the overrun policy
+  throttled: number
+  // scheduled sites overdue by more than `maxCatchUpMinutes`
+  caughtUp: number
+}
+
+// attempt to prevent backfill
+const MAX_SCHEDULED = 20
+
+// organization settings (or config defaults)
+const defaultOptions = async (): Promise<TickOptions> => ({
+  overrunPolicy: await SettingService.get<OverrunPolicy>(
+    'scheduler.overrunPolicy'
+  ),
+  maxQueueDepth: await SettingService.get<number>('scheduler.maxQueueDepth'),
+  jitterSeconds: await SettingService.get<number>('scheduler.jitterSeconds'),
+  maxCatchUpMinutes: config.scheduler.maxCatchUpMinutes,
+  agingPerMinute: config.scheduler.agingPerMinute,
+})
+
+/**
+ * missedIntervals
+ *
+ * Number of whole intervals `site` missed when it is overdue
+ * by more than `maxCatchUpMinutes` at `now`, otherwise 0
+ */
+const missedIntervals = (
+  site: Site,
+  now: Date,
+  maxCatchUpMinutes: number
+): number => {
+  if (!maxCatchUpMinutes || !site.last_run) return 0
+  const interval = clampInterval(site.run_every_minutes)
+  const due = addMinutes(site.last_run, interval)
+  const overdue = differenceInMinutes(now, due)
+  if (overdue <= maxCatchUpMinutes) return 0
+  // a 0 minute interval (no floor) misses a single run
+  return interval > 0 ? Math.floor(overdue / interval) + 1 : 1
+}
+
+/**
+ * tick
+ *
+ * Adds scans for runnable sites to the `queue`
+ */
+const tick = async (
+  queue: Queue<MerryMaker.ScanQueueJob>,
+  options: Partial<TickOptions> = {}
+): Promise<TickResult> => {
+  const opts = { ...(await defaultOptions()), ...options }
+  const result: TickResult = {
+    due: 0,
+    scheduled: 0,
+    throttled: 0,
+    caughtUp: 0,
+  }
+  const totalSched = await ScanService.totalScheduled()
+  if (totalSched > MAX_SCHEDULED) {
+    logger.warn(`Too many scehduled ${totalSched}, trying again later`)
+    return result
+  }
+  const now = new Date()
+  const runnable = await SiteService.getRunnable(
+    now,
+    opts.jitterSeconds,
+    opts.agingPerMinute
+  )
+  logger.debug('found runnable', runnable)
+  result.due = runnable.length
+  // per-site policy overrides the default
+  const policyOf = (site: Site): OverrunPolicy =>
+    (site.overrun_policy as OverrunPolicy) || opts.overrunPolicy
+  // pending scans at or above which a site is throttled
+  const maxDepth = (site: Site): number | null => {
+    switch (policyOf(site)) {
+      case 'queue-bounded':
+        return opts.maxQueueDepth
+      case 'skip':
+        return 1
+      default:
+        return null
+    }
+  }
+  const bounded = runnable.filter((s) => maxDepth(s) !== null)
+  let pending: Record<string, number> = {}
+  if (bounded.length) {
+    pending = await ScanService.pendingBySite(bounded.map((s) => s.id))
+  }
+  for (let i = 0; i < runnable.length; i += 1) {
+    const site = runnable[i]
+    const depth = pending[site.id] || 0
+    const max = maxDepth(site)
+    if (max !== null && depth >= max) {
+      logger.warn({
+        module: 'services/scheduler',
+        method: 'tick',
+        site_id: site.id,
+        message: `throttled ${site.name}, ${depth} scans pending (max ${max})`,
+      })
+      result.throttled += 1
+      continue
+    }
+    // missed intervals are not replayed, scheduling moves
+    // `last_run` (the next-due marker) to now
+    const missed = missedIntervals(site, now, opts.maxCatchUpMinutes)
+    if (missed > 0) {
+      logger.info({
+        module: 'services/scheduler',
+        method: 'tick',
+        site_id: site.id,
+        message: `catching up ${site.name}, ${missed} intervals missed`,
+      })
+      result.caughtUp += 1
+    }
+    await ScanService.schedule(queue, {
+      site,
+      priority: site.effective_priority,
+    })
+    result.scheduled += 1
+  }
+  return result
+}
+
+/**
+ * timedTick
+ *
+ * Runs `tick` reporting its duration and the number of sites
+ * due / scheduled to `client` (no-op when not set).
+ * Failed ticks are tagged with `status: error`
+ */
+const timedTick = async (
+  queue: Queue<MerryMaker.ScanQueueJob>,
+  client?: Metrics | null,
+  options: Partial<TickOptions> = {}
+): Promise<TickResult> => {
+  const m = metrics(client)
+  const start = Date.now()
+  try {
+    const result = await tick(queue, options)
+    const tags = { status: 'ok' }
+    m.timing('scheduler.tick.duration_ms', Date.now() - start, tags)
+    m.gauge('scheduler.tick.tasks_due', result.due, tags)
+    m.gauge('scheduler.tick.tasks_processed', result.scheduled, tags)
+    m.gauge('scheduler.tick.tasks_caught_up', result.caughtUp, tags)
+    return result
+  } catch (e) {
+    const tags = { status: 'error' }
+    m.timing('scheduler.tick.duration_ms', Date.now() - start, tags)
+    m.increment('scheduler.tick.errors', tags)
+    throw e
+  }
+}
+
+export default {
+  tick,
+  timedTick,
+}
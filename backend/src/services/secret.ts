@@ -1,5 +1,6 @@
 import { SourceSecret, Secret, SecretAttributes } from '../models'
 import SourceService from './source'
+import AuditService from './audit'
 
 /**
  * update
@@ -8,8 +9,10 @@ import SourceService from './source'
  */
 const update = async (
   id: string,
-  secret: Partial<SecretAttributes>
+  secret: Partial<SecretAttributes>,
+  actor?: string
 ): Promise<Secret> => {
+  const before = await Secret.query().findById(id)
   const updated = await Secret.query().patchAndFetchById(
     id,
     Secret.updateAble().reduce(
@@ -19,17 +22,46 @@ const update = async (
   )
   const sources = await SourceSecret.query().where({ secret_id: updated.id })
   await Promise.all(sources.map((s) => SourceService.cache(s.source_id)))
+  await AuditService.record(actor, {
+    action: 'update',
+    entity_type: 'secret',
+    entity_id: id,
+    before,
+    after: updated,
+  })
   return updated
 }
 
-const create = async (attrs: Partial<SecretAttributes>): Promise<Secret> =>
-  Secret.query().insert(attrs)
+const create = async (
+  attrs: Partial<SecretAttributes>,
+  actor?: string
+): Promise<Secret> => {
+  const created = await Secret.query().insert(attrs)
+  await AuditService.record(actor, {
+    action: 'create',
+    entity_type: 'secret',
+    entity_id: created.id,
+    after: created,
+  })
+  return created
+}
 
 const view = async (id: string): Promise<Secret> =>
   Secret.query().findById(id).throwIfNotFound()
 
-const destroy = async (id: string): Promise<number> =>
-  Secret.query().deleteById(id)
+const destroy = async (id: string, actor?: string): Promise<number> => {
+  const before = await Secret.query().findById(id)
+  const total = await Secret.query().deleteById(id)
+  if (total > 0) {
+    await AuditService.record(actor, {
+      action: 'delete',
+      entity_type: 'secret',
+      entity_id: id,
+      before,
+    })
+  }
+  return total
+}
 
 const isInUse = async (id: string): Promise<boolean> => {
   const res = await SourceSecret.query().where({ secret_id: id })
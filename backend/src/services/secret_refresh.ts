@@ -0,0 +1,269 @@
+import { Job, Queue } from 'bull'
+import { addMinutes } from 'date-fns'
+import { config } from 'node-config-ts'
+import { Secret } from '../models'
+import Queues from '../jobs/queues'
+import { redisClient } from '../repos/redis'
+import logger from '../loaders/logger'
+import {
+  ProviderTokenError,
+  SecretProvider,
+  VaultProvider,
+} from '../lib/secret-providers'
+import SecretService from './secret'
+
+/**
+ * SecretFetcher
+ *
+ * Fetches the current value of a secret from its source
+ */
+export type SecretFetcher = (secret: Secret) => Promise<string | null>
+
+// qt secrets hold the quantum tunnel token cached in redis
+export const qtFetcher: SecretFetcher = async () => redisClient.get('qtToken')
+
+// secrets without a `provider`, refreshed from the quantum tunnel
+export const defaultProvider: SecretProvider = {
+  name: 'default',
+  get enabled() {
+    return config.quantumTunnel.enabled === 'true'
+  },
+  fetch: qtFetcher,
+}
+
+export const providers: Record<string, SecretProvider> = {
+  default: defaultProvider,
+  vault: new VaultProvider(config.secrets.vault),
+}
+
+/**
+ * providerFor
+ *
+ * Provider selected by the `provider` of `secret`, undefined
+ * for unknown providers
+ */
+export const providerFor = (
+  secret: Pick<Secret, 'provider'>,
+  registry: Record<string, SecretProvider> = providers
+): SecretProvider | undefined => registry[secret.provider || 'default']
+
+export type RefreshCheck = {
+  status: 'failed' | 'unchanged'
+  error: string
+}
+
+/**
+ * verifyRefresh
+ *
+ * Flags a refreshed value that is empty or identical to the
+ * previous one, null when the value rotated
+ */
+export const verifyRefresh = (
+  previous: string,
+  next: string | null
+): RefreshCheck | null => {
+  if (!next) {
+    return { status: 'failed', error: 'refreshed value is empty' }
+  }
+  if (next === previous) {
+    return {
+      status: 'unchanged',
+      error: 'refreshed value is identical to the previous one',
+    }
+  }
+  return null
+}
+
+// stores the outcome of a refresh, the value is left as is
+const record = async (
+  secret: Secret,
+  result: { status: string; error: string | null }
+): Promise<Secret> => {
+  if (result.status !== 'succeeded') {
+    logger.warn({
+      module: 'services/secret_refresh',
+      method: 'refresh',
+      secret_id: secret.id,
+      name: secret.name,
+      ...result,
+    })
+  }
+  return Secret.query().patchAndFetchById(secret.id, {
+    last_refreshed_at: new Date(),
+    last_refresh_status: result.status,
+    last_refresh_error: result.error,
+  })
+}
+
+export type RefreshOptions = {
+  // replaces the provider of the secret
+  fetch?: SecretFetcher
+  providers?: Record<string, SecretProvider>
+  // defaults to `secrets.refresh.verify`
+  verify?: boolean
+}
+
+// secrets whose provider is enabled, or any with a `fetch` override
+const refreshable = (secret: Secret, opts: RefreshOptions): boolean =>
+  !!opts.fetch || !!providerFor(secret, opts.providers)?.enabled
+
+/**
+ * refresh
+ *
+ * Fetches a new value of `secret` from its provider and records the
+ * outcome in `last_refresh_status` / `last_refresh_error`. Unless
+ * verification is off, empty values fail the refresh and identical
+ * ones are recorded as `unchanged` (except for static providers),
+ * the stored value is kept in both cases. Rejected provider tokens
+ * are recorded as token errors
+ */
+const refresh = async (
+  secret: Secret,
+  opts: RefreshOptions = {}
+): Promise<Secret> => {
+  const provider = providerFor(secret, opts.providers)
+  const fetch = opts.fetch || (provider && provider.fetch.bind(provider))
+  if (!fetch) {
+    return record(secret, {
+      status: 'failed',
+      error: `unknown secret provider "${secret.provider}"`,
+    })
+  }
+  const verify = opts.verify ?? config.secrets.refresh.verify
+  let value: string | null
+  try {
+    value = await fetch(secret)
+  } catch (e) {
+    return record(secret, {
+      status: 'failed',
+      error:
+        e instanceof ProviderTokenError
+          ? `token error: ${e.message}`
+          : e.message,
+    })
+  }
+  const check = verify ? verifyRefresh(secret.value, value) : null
+  if (check && check.status === 'unchanged' && provider?.static) {
+    // static secrets change only when edited at the source
+    return record(secret, { status: 'succeeded', error: null })
+  }
+  if (check) {
+    return record(secret, check)
+  }
+  await SecretService.update(secret.id, {
+    type: secret.type,
+    value: value || '',
+  })
+  return record(secret, { status: 'succeeded', error: null })
+}
+
+/**
+ * nextRefreshAt
+ *
+ * Next refresh of a secret with its own `refresh_interval_minutes`,
+ * null for secrets refreshed on the global schedule. Secrets never
+ * refreshed are due right away
+ */
+export const nextRefreshAt = (
+  secret: Pick<Secret, 'refresh_interval_minutes' | 'last_refreshed_at'>,
+  now: Date = new Date()
+): Date | null => {
+  if (!secret.refresh_interval_minutes) return null
+  if (!secret.last_refreshed_at) return now
+  return addMinutes(
+    new Date(secret.last_refreshed_at),
+    secret.refresh_interval_minutes
+  )
+}
+
+export type RefreshJob = {
+  secret_id: string
+}
+
+export type ScheduleOptions = {
+  queue?: Queue
+  now?: Date
+}
+
+/**
+ * schedule
+ *
+ * Queues the next refresh of a secret with its own interval as a
+ * delayed `secret-refresh` job. Jobs are keyed by secret and refresh
+ * time, scheduling the same refresh again adds no job. Finished jobs
+ * are removed so a failed refresh can be scheduled again
+ */
+const schedule = async (
+  secret: Secret,
+  opts: ScheduleOptions = {}
+): Promise<Job<RefreshJob> | null> => {
+  const now = opts.now || new Date()
+  const at = nextRefreshAt(secret, now)
+  if (!at) return null
+  const queue = opts.queue || Queues.localQueue
+  return queue.add(
+    'secret-refresh',
+    { secret_id: secret.id },
+    {
+      jobId: `secret-refresh:${secret.id}:${at.getTime()}`,
+      delay: Math.max(0, at.getTime() - now.getTime()),
+      removeOnComplete: true,
+      removeOnFail: true,
+    }
+  )
+}
+
+/**
+ * refreshScheduled
+ *
+ * Refreshes secret `id` from its `secret-refresh` job and schedules
+ * the next one. Jobs outdated by an earlier refresh or a changed
+ * interval are skipped
+ */
+const refreshScheduled = async (
+  id: string,
+  opts: RefreshOptions & ScheduleOptions = {}
+): Promise<Secret | null> => {
+  const now = opts.now || new Date()
+  const secret = await Secret.query().findById(id)
+  if (!secret || !refreshable(secret, opts)) return null
+  const at = nextRefreshAt(secret, now)
+  if (!at || at > now) return null
+  const refreshed = await refresh(secret, opts)
+  await schedule(refreshed, { queue: opts.queue })
+  return refreshed
+}
+
+/**
+ * refreshAll
+ *
+ * Refreshes the qt secrets and the secrets of a provider while
+ * their provider is enabled, returns the number of refreshes per
+ * status. Secrets with their own interval are only scheduled, which
+ * picks up new or changed intervals
+ */
+const refreshAll = async (
+  opts: RefreshOptions & ScheduleOptions = {}
+): Promise<Record<string, number>> => {
+  const totals: Record<string, number> = {}
+  const secrets = await Secret.query().where((builder) =>
+    builder.where('type', 'qt').orWhereNotNull('provider')
+  )
+  for (const secret of secrets) {
+    if (!refreshable(secret, opts)) continue
+    if (secret.refresh_interval_minutes) {
+      await schedule(secret, opts)
+      continue
+    }
+    const { last_refresh_status } = await refresh(secret, opts)
+    totals[last_refresh_status] = (totals[last_refresh_status] || 0) + 1
+  }
+  return totals
+}
+
+export default {
+  refresh,
+  refreshAll,
+  refreshScheduled,
+  schedule,
+}
@@ -0,0 +1,77 @@
+import { Scan, SeenScript } from '../models'
+import { redisClient } from '../repos/redis'
+
+// hashes cached for a day, the table is the source of truth
+const CACHE_SECONDS = 60 * 60 * 24
+
+export type ScriptObservation = {
+  // hash seen before this observation, null for new scripts
+  previous: string | null
+  changed: boolean
+}
+
+const cacheKey = (siteID: string, url: string) =>
+  `seen_script:${siteID}:${url}`
+
+/**
+ * observe
+ *
+ * Records `sha256` as the latest hash of script `url` on a site.
+ * `changed` is true when a previously seen script has a new hash,
+ * only one concurrent observer of the same change gets `changed`
+ */
+const observe = async (
+  siteID: string,
+  url: string,
+  sha256: string
+): Promise<ScriptObservation> => {
+  const hash = sha256.toLowerCase()
+  const key = cacheKey(siteID, url)
+  if ((await redisClient.get(key)) === hash) {
+    return { previous: hash, changed: false }
+  }
+  const seen = await SeenScript.query().findOne({ site_id: siteID, url })
+  let res: ScriptObservation = { previous: null, changed: false }
+  if (!seen) {
+    await SeenScript.query()
+      .insert({ site_id: siteID, url, sha256: hash })
+      .onConflict(['site_id', 'url'])
+      .ignore()
+  } else if (seen.sha256 === hash) {
+    await SeenScript.query()
+      .patch({ last_seen: new Date() })
+      .findById(seen.id)
+    res = { previous: hash, changed: false }
+  } else {
+    // conditional update, the first writer claims the change
+    const updated = await SeenScript.query()
+      .patch({ sha256: hash, changed_at: new Date(), last_seen: new Date() })
+      .where({ id: seen.id, sha256: seen.sha256 })
+    res = { previous: seen.sha256, changed: updated === 1 }
+  }
+  await redisClient.setex(key, CACHE_SECONDS, hash)
+  return res
+}
+
+/**
+ * observeByScan
+ *
+ * Same as `observe` for the site of `scanID`. Scans
+ * without a site (tests) are not recorded
+ */
+const observeByScan = async (
+  scanID: string,
+  url: string,
+  sha256: string
+): Promise<ScriptObservation> => {
+  const scan = await Scan.query().findById(scanID).throwIfNotFound()
+  if (!scan.site_id || scan.test) {
+    return { previous: null, changed: false }
+  }
+  return observe(scan.site_id, url, sha256)
+}
+
+export default {
+  observe,
+  observeByScan,
+}
@@ -1,7 +1,15 @@
-import { cachedView, updateCache, writeLRU } from '../api/crud/cache'
+import {
+  cachedView,
+  cachedViewMany,
+  updateCache,
+  writeLRU,
+} from '../api/crud/cache'
 import { raw } from 'objection'
+import { v4 as uuidv4 } from 'uuid'
 import LRUCache from 'lru-native2'
-import { SeenString, SeenStringAttributes } from '../models'
+import { config } from 'node-config-ts'
+import { Scan, SeenString, SeenStringAttributes, Site } from '../models'
+import SettingService from './setting'
 
 export const cache = new LRUCache<number>({
   maxElements: 10000,
@@ -12,6 +20,7 @@ export const cache = new LRUCache<number>({
 
 const cached_view = cachedView(SeenString.tableName, cache)
 const cached_write_view = updateCache(SeenString.tableName, writeLRU(cache))
+const cached_view_many = cachedViewMany(SeenString.tableName, cache)
 
 const view = async (id: string): Promise<SeenString> =>
   SeenString.query().findById(id).throwIfNotFound()
@@ -28,21 +37,179 @@ const findOne = async (
   query: Partial<SeenStringAttributes>
 ): Promise<SeenString> => SeenString.query().findOne(query)
 
+const findMany = async (type: string, keys: string[]): Promise<SeenString[]> =>
+  SeenString.query().where({ type }).whereIn('key', keys)
+
+/**
+ * touch
+ *
+ * Marks seen strings as cached now (one update)
+ */
+const touch = async (ids: string[]): Promise<number> =>
+  ids.length === 0
+    ? 0
+    : SeenString.query().patch({ last_cached: new Date() }).whereIn('id', ids)
+
 const create = async (
   attrs: Partial<SeenStringAttributes>
 ): Promise<SeenString> => SeenString.query().insert(attrs)
 
+/**
+ * isExpiredBaseline
+ *
+ * True when the baseline TTL (`ttlDays`, 0 disables) is enabled
+ * and `seen` has not been hit (`last_cached`) within the TTL
+ */
+const isExpiredBaseline = (
+  seen: SeenString,
+  ttlDays: number,
+  now: Date = new Date()
+): boolean => {
+  if (!ttlDays || !seen.last_cached) {
+    return false
+  }
+  const age = now.valueOf() - new Date(seen.last_cached).valueOf()
+  return age > ttlDays * 24 * 60 * 60 * 1000
+}
+
+// site override of a seen string setting, null without a scan
+const siteOverride = async (
+  scanID: string | undefined,
+  column: 'seen_min_hits' | 'seen_baseline_ttl_days'
+): Promise<number | null> => {
+  if (!scanID) return null
+  const site = await Site.query()
+    .select(`sites.${column}`)
+    .whereIn('id', Scan.query().select('site_id').where('id', scanID))
+    .first()
+  return site?.[column] ?? null
+}
+
+/**
+ * minHits
+ *
+ * Hits required before a seen string suppresses alerts.
+ * Precedence: site of `scanID` > organization setting > config default
+ */
+const minHits = async (scanID?: string): Promise<number> =>
+  SettingService.resolve<number>(
+    'seenStrings.minHits',
+    await siteOverride(scanID, 'seen_min_hits')
+  )
+
+/**
+ * baselineTTLDays
+ *
+ * Days without a hit before a seen string expires from the
+ * baseline, 0 disables expiry. Precedence: site of `scanID` >
+ * organization setting > config default
+ */
+const baselineTTLDays = async (scanID?: string): Promise<number> =>
+  SettingService.resolve<number>(
+    'seenStrings.baselineTTLDays',
+    await siteOverride(scanID, 'seen_baseline_ttl_days')
+  )
+
+/**
+ * recordHit
+ *
+ * Increments `hit_count` (or restarts it at 1 when `reset`)
+ * and bumps `last_cached`. Returns the updated record
+ */
+const recordHit = async (id: string, reset = false): Promise<SeenString> =>
+  SeenString.query().patchAndFetchById(id, {
+    hit_count: reset ? 1 : raw('hit_count + 1'),
+    last_cached: new Date(),
+  })
+
+// one row per key, hits are added to existing strings. strings
+// not hit since the cutoff (baseline TTL) restart from their hits
+const BULK_RECORD_SQL = `
+insert into seen_strings (id, key, type, hit_count, created_at, last_cached)
+select v.id, v.key, v.type, v.hits, v.seen_at, v.seen_at
+from json_to_recordset(cast(:rows as json)) as v(
+  id uuid,
+  key text,
+  type text,
+  hits integer,
+  seen_at timestamptz
+)
+on conflict (key, type) do update set
+  hit_count = case
+    when cast(:cutoff as timestamptz) is not null
+      and seen_strings.last_cached < cast(:cutoff as timestamptz)
+    then excluded.hit_count
+    else seen_strings.hit_count + excluded.hit_count
+  end,
+  last_cached = excluded.last_cached
+`
+
+/**
+ * bulkRecord
+ *
+ * Records a hit per entry of `keys` (repeated keys count several
+ * hits), upserting up to `batchSize` distinct keys per statement.
+ * Returns the number of distinct keys recorded
+ */
+const bulkRecord = async (
+  type: string,
+  keys: string[],
+  batchSize: number = config.seenStrings.recordBatchSize,
+  now: Date = new Date()
+): Promise<number> => {
+  const hits = new Map<string, number>()
+  keys.forEach((key) => {
+    const normalized = SeenString.normalizeKey(type, key)
+    hits.set(normalized, (hits.get(normalized) || 0) + 1)
+  })
+  if (hits.size === 0) return 0
+  const ttlDays = await SettingService.get<number>('seenStrings.baselineTTLDays')
+  const cutoff = ttlDays
+    ? new Date(now.valueOf() - ttlDays * 24 * 60 * 60 * 1000)
+    : null
+  const rows = Array.from(hits.entries()).map(([key, count]) => ({
+    id: uuidv4(),
+    key,
+    type,
+    hits: count,
+    seen_at: now,
+  }))
+  for (let i = 0; i < rows.length; i += batchSize) {
+    await SeenString.knex().raw(BULK_RECORD_SQL, {
+      rows: JSON.stringify(rows.slice(i, i + batchSize)),
+      cutoff,
+    })
+  }
+  return rows.length
+}
+
 /**
  * purgeDBCache
  *
  * Deletes SeenStrings where `last_cached` < now-`daysAgo`
- * or is NULL
+ * or is NULL, in batches of `batchSize`
  */
-const purgeDBCache = async (daysAgo: number): Promise<number> =>
-  SeenString.query()
-    .delete()
-    .where(raw("last_cached <= NOW() - INTERVAL '?? days'", [daysAgo]))
-    .orWhereNull('last_cached')
+const purgeDBCache = async (
+  daysAgo: number,
+  batchSize: number = config.seenStrings.purgeBatchSize
+): Promise<number> => {
+  let total = 0
+  for (;;) {
+    const deleted = await SeenString.query()
+      .delete()
+      .whereIn(
+        'id',
+        SeenString.query()
+          .select('id')
+          .where(raw("last_cached <= NOW() - INTERVAL '?? days'", [daysAgo]))
+          .orWhereNull('last_cached')
+          .limit(batchSize)
+      )
+    total += deleted
+    if (deleted < batchSize) break
+  }
+  return total
+}
 
 
 const destroy = async (id: string): Promise<number> =>
@@ -53,9 +220,17 @@ export default {
   distinct,
   cached_view,
   cached_write_view,
+  cached_view_many,
   purgeDBCache,
+  isExpiredBaseline,
+  baselineTTLDays,
+  minHits,
+  recordHit,
+  bulkRecord,
   update,
   findOne,
+  findMany,
+  touch,
   create,
   destroy,
 }
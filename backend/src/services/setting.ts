@@ -0,0 +1,327 @@
+import Ajv from 'ajv'
+import LRUCache from 'lru-native2'
+import { config } from 'node-config-ts'
+import { Setting } from '../models'
+import { SettingValue } from '../models/settings'
+import { AlertRules } from '../models/alerts'
+import { OverrunPolicies, Severities } from '../models/sites'
+import { ClientError } from '../api/middleware/client-errors'
+import AuditService from './audit'
+import { isTimeZone } from '../lib/time-zone'
+
+const ajv = new Ajv()
+
+type SettingDefinition = {
+  description: string
+  schema: Record<string, unknown>
+  // config file default
+  default: () => SettingValue
+  // checks the schema cannot express, returns an error message
+  check?: (value: SettingValue) => string | null
+}
+
+export type SettingView = {
+  key: string
+  description: string
+  schema: Record<string, unknown>
+  default: SettingValue
+  // organization value (null if not set)
+  value: SettingValue | null
+  effective: SettingValue
+  updated_by?: string
+  updated_at?: Date
+}
+
+/**
+ * sinkRuleTypes
+ *
+ * Rule types the `sink` alert sink receives, empty for every rule.
+ * Only known rules are saved, the config file sets the default
+ */
+const sinkRuleTypes = (
+  sink: string,
+  defaults: () => string[] | undefined
+): SettingDefinition => ({
+  description: `Rules delivered to the ${sink} alert sink (empty delivers every rule)`,
+  schema: {
+    type: 'array',
+    items: { type: 'string', enum: AlertRules },
+    uniqueItems: true,
+  },
+  default: () => defaults() || [],
+})
+
+/**
+ * alertOnceTTL
+ *
+ * Alert-once window of `rule`, sites override it for unknown domains
+ */
+const alertOnceTTL = (rule: string): SettingDefinition => ({
+  description: `Minutes before the same ${rule} alert is raised again`,
+  schema: { type: 'integer', minimum: 1 },
+  default: () => config.alerts.alertOnce?.ttlMinutes?.[rule] || 1440,
+})
+
+/**
+ * ruleSeverity
+ *
+ * Severity of `rule` alerts that carry none, sites override it for
+ * unknown domains
+ */
+const ruleSeverity = (rule: string): SettingDefinition => ({
+  description: `Severity of ${rule} alerts without their own (empty for none)`,
+  schema: { type: 'string', enum: ['', ...Severities] },
+  default: () => config.alerts.severity?.[rule] || '',
+})
+
+// one setting per rule of `define`
+const perRule = (
+  prefix: string,
+  define: (rule: string) => SettingDefinition
+): Record<string, SettingDefinition> =>
+  AlertRules.reduce((acc, rule) => {
+    acc[`${prefix}.${rule}`] = define(rule)
+    return acc
+  }, {} as Record<string, SettingDefinition>)
+
+/**
+ * Organization-wide settings
+ *
+ * Each setting overrides a config file default at runtime
+ */
+export const definitions: Record<string, SettingDefinition> = {
+  'scheduler.overrunPolicy': {
+    description: 'Scheduling policy when a site already has pending scans',
+    schema: { type: 'string', enum: OverrunPolicies },
+    default: () => config.scheduler.overrunPolicy,
+  },
+  'scheduler.maxQueueDepth': {
+    description: 'Max pending scans per site (queue-bounded policy)',
+    schema: { type: 'integer', minimum: 1 },
+    default: () => config.scheduler.maxQueueDepth,
+  },
+  'scheduler.jitterSeconds': {
+    description: 'Window (seconds) used to spread site run times',
+    schema: { type: 'integer', minimum: 0 },
+    default: () => config.scheduler.jitterSeconds,
+  },
+  'scheduler.timeZone': {
+    description: 'Time zone (IANA name) used to display and evaluate schedules',
+    schema: { type: 'string', minLength: 1 },
+    default: () => config.scheduler.timeZone,
+    check: (value) =>
+      isTimeZone(value as string) ? null : 'unknown time zone',
+  },
+  'scans.summary.maxDomains': {
+    description: 'Max distinct domains tracked in a scan summary',
+    schema: { type: 'integer', minimum: 1 },
+    default: () => config.scans.summary.maxDomains,
+  },
+  'scans.summary.includeDomains': {
+    description: 'Include the per-domain request list in scan summaries',
+    schema: { type: 'boolean' },
+    default: () => config.scans.summary.includeDomains,
+  },
+  'seenStrings.baselineTTLDays': {
+    description:
+      'Days without a hit before a seen string no longer suppresses alerts (0 disables)',
+    schema: { type: 'integer', minimum: 0 },
+    default: () => config.seenStrings.baselineTTLDays,
+  },
+  'seenStrings.minHits': {
+    description: 'Hits before a seen domain stops alerting',
+    schema: { type: 'integer', minimum: 1 },
+    default: () => config.seenStrings.minHits,
+  },
+  'alerts.sinks.goAlert.ruleTypes': sinkRuleTypes(
+    'goAlert',
+    () => config.alerts.goAlert?.ruleTypes
+  ),
+  'alerts.sinks.kafka.ruleTypes': sinkRuleTypes(
+    'kafka',
+    () => config.alerts.kafka?.ruleTypes
+  ),
+  'alerts.sinks.teams.ruleTypes': sinkRuleTypes(
+    'teams',
+    () => config.alerts.teams?.ruleTypes
+  ),
+  'alerts.dryRun': {
+    description: 'Record alerts without delivering them to any sink',
+    schema: { type: 'boolean' },
+    default: () => config.alerts.dryRun,
+  },
+  'alerts.rateLimit.sampleSize': {
+    description: 'Domains sampled in the summary of rate limited alerts',
+    schema: { type: 'integer', minimum: 0 },
+    default: () => config.alerts.rateLimit.sampleSize,
+  },
+  ...perRule('alerts.alertOnce.ttlMinutes', alertOnceTTL),
+  ...perRule('alerts.severity', ruleSeverity),
+}
+
+const validators = Object.entries(definitions).reduce(
+  (acc, [key, def]) => {
+    acc[key] = ajv.compile(def.schema)
+    return acc
+  },
+  {} as Record<string, ReturnType<typeof ajv.compile>>
+)
+
+const CACHE_KEY = 'settings'
+
+export const cache = new LRUCache<Record<string, Setting>>({
+  maxElements: 1,
+  maxAge: 60000,
+  size: 1,
+  maxLoadFactor: 2.0,
+})
+
+/**
+ * invalidate
+ *
+ * Clears cached organization settings
+ */
+const invalidate = (): void => {
+  cache.remove(CACHE_KEY)
+}
+
+// read-through cache of all organization settings
+const loadAll = async (): Promise<Record<string, Setting>> => {
+  const hit = cache.get(CACHE_KEY)
+  if (hit) return hit
+  const rows = await Setting.query()
+  const res = rows.reduce((acc, row) => {
+    acc[row.key] = row
+    return acc
+  }, {} as Record<string, Setting>)
+  cache.set(CACHE_KEY, res)
+  return res
+}
+
+const definition = (key: string): SettingDefinition => {
+  const def = definitions[key]
+  if (def === undefined) {
+    throw new ClientError(`unknown setting "${key}"`)
+  }
+  return def
+}
+
+/**
+ * get
+ *
+ * Returns the organization value for `key`, or the config default
+ */
+const get = async <T extends SettingValue>(key: string): Promise<T> => {
+  const def = definition(key)
+  const all = await loadAll()
+  if (all[key] !== undefined) {
+    return all[key].value as T
+  }
+  return def.default() as T
+}
+
+/**
+ * resolve
+ *
+ * Precedence: site value > organization setting > config default
+ */
+const resolve = async <T extends SettingValue>(
+  key: string,
+  siteValue?: T | null
+): Promise<T> => {
+  if (siteValue !== undefined && siteValue !== null) {
+    return siteValue
+  }
+  return get<T>(key)
+}
+
+/**
+ * list
+ *
+ * Returns all settings with their defaults and effective values
+ */
+const list = async (): Promise<SettingView[]> => {
+  const all = await loadAll()
+  return Object.entries(definitions).map(([key, def]) => {
+    const row = all[key]
+    const value = row === undefined ? null : row.value
+    return {
+      key,
+      description: def.description,
+      schema: def.schema,
+      default: def.default(),
+      value,
+      effective: value === null ? def.default() : value,
+      updated_by: row?.updated_by,
+      updated_at: row?.updated_at,
+    }
+  })
+}
+
+/**
+ * update
+ *
+ * Validates and upserts an organization setting
+ */
+const update = async (
+  key: string,
+  value: SettingValue,
+  actor: string
+): Promise<Setting> => {
+  const def = definition(key)
+  const validate = validators[key]
+  if (!validate(value)) {
+    throw new ClientError(
+      `invalid value for "${key}": ${ajv.errorsText(validate.errors)}`
+    )
+  }
+  const invalid = def.check ? def.check(value) : null
+  if (invalid !== null) {
+    throw new ClientError(`invalid value for "${key}": ${invalid}`)
+  }
+  const before = await Setting.query().findById(key)
+  const record = await Setting.query()
+    .insert({ key, value, updated_by: actor })
+    .onConflict('key')
+    .merge()
+    .returning('*')
+  invalidate()
+  await AuditService.record(actor, {
+    action: before ? 'update' : 'create',
+    entity_type: 'setting',
+    entity_id: key,
+    before,
+    after: record,
+  })
+  return record
+}
+
+/**
+ * reset
+ *
+ * Removes an organization setting (falls back to the config default)
+ */
+const reset = async (key: string, actor: string): Promise<number> => {
+  definition(key)
+  const before = await Setting.query().findById(key)
+  const total = await Setting.query().deleteById(key)
+  invalidate()
+  if (total > 0) {
+    await AuditService.record(actor, {
+      action: 'delete',
+      entity_type: 'setting',
+      entity_id: key,
+      before,
+    })
+  }
+  return total
+}
+
+export default {
+  get,
+  resolve,
+  list,
+  update,
+  reset,
+  invalidate,
+}
@@ -1,44 +1,374 @@
-import { differenceInMinutes } from 'date-fns'
+import { createHash } from 'crypto'
+import {
+  addMinutes,
+  addSeconds,
+  differenceInMinutes,
+  differenceInSeconds,
+} from 'date-fns'
+import { config } from 'node-config-ts'
+import { UniqueViolationError, raw } from 'objection'
 import { Site, SiteAttributes } from '../models'
+import { ConflictError } from '../api/middleware/client-errors'
+import { compareTarget, TargetComparison } from '../lib/target-drift'
+import { formatInZone } from '../lib/time-zone'
+import logger from '../loaders/logger'
+import SettingService from './setting'
+import AuditService from './audit'
 
-const getRunnable = async (): Promise<Site[]> => {
-  const whereQuery: Partial<SiteAttributes> = {
-    active: true,
+/**
+ * clampInterval
+ *
+ * Scan interval (minutes) raised to the `minIntervalMinutes` floor,
+ * tiny intervals would hammer the scanners
+ */
+export const clampInterval = (
+  minutes: number,
+  floor: number = config.scheduler.minIntervalMinutes
+): number => Math.max(minutes || 0, floor || 0)
+
+/**
+ * enforceIntervalFloor
+ *
+ * Clamps `attrs.run_every_minutes` to the floor, logging a warning
+ * when it was below
+ */
+const enforceIntervalFloor = (
+  attrs: Partial<SiteAttributes>,
+  floor: number = config.scheduler.minIntervalMinutes
+): Partial<SiteAttributes> => {
+  if (attrs.run_every_minutes === undefined) return attrs
+  const clamped = clampInterval(attrs.run_every_minutes, floor)
+  if (clamped === attrs.run_every_minutes) return attrs
+  logger.warn({
+    module: 'services/site',
+    site: attrs.name,
+    message: `run_every_minutes ${attrs.run_every_minutes} is below the ${floor} minute floor, clamped`,
+  })
+  return { ...attrs, run_every_minutes: clamped }
+}
+
+/**
+ * jitterOffset
+ *
+ * Deterministic offset (seconds) in the range [0, jitterSeconds)
+ * derived from `key`
+ */
+const jitterOffset = (key: string, jitterSeconds: number): number => {
+  if (!jitterSeconds || jitterSeconds <= 0) return 0
+  const digest = createHash('md5').update(key).digest()
+  return digest.readUInt32BE(0) % jitterSeconds
+}
+
+/**
+ * isDue
+ *
+ * Site is due when `run_every_minutes` (plus its jitter offset)
+ * has passed since `last_run`
+ */
+const isDue = (site: Site, now: Date, jitterSeconds: number): boolean => {
+  const interval = clampInterval(site.run_every_minutes)
+  if (jitterSeconds > 0) {
+    const diff = differenceInSeconds(now, site.last_run)
+    const offset = jitterOffset(site.name, jitterSeconds)
+    return diff > interval * 60 + offset || isNaN(diff)
   }
-  const sites = await Site.query().where(whereQuery)
-  const now = new Date()
-  const res: Site[] = []
-  for (let i = 0; i < sites.length; i += 1) {
-    const site = sites[i]
-    const diff = differenceInMinutes(now, site.last_run)
-    if (diff > site.run_every_minutes || isNaN(diff)) {
-      res.push(site)
+  const diff = differenceInMinutes(now, site.last_run)
+  return diff > interval || isNaN(diff)
+}
+
+/**
+ * nextRun
+ *
+ * Earliest time (UTC) `site` is due, `now` when it never ran
+ * or is already overdue
+ */
+const nextRun = (
+  site: Pick<Site, 'name' | 'last_run' | 'run_every_minutes'>,
+  now: Date,
+  jitterSeconds: number
+): Date => {
+  if (!site.last_run) return now
+  const due = addSeconds(
+    addMinutes(site.last_run, clampInterval(site.run_every_minutes)),
+    jitterOffset(site.name, jitterSeconds)
+  )
+  return due > now ? due : now
+}
+
+export type SiteSchedule = {
+  last_run: Date | null
+  next_run: Date
+  // display time zone and `next_run` in local time
+  time_zone: string
+  next_run_local: string
+}
+
+/**
+ * schedule
+ *
+ * Next run of `site` with its local time in the organization
+ * display time zone
+ */
+const schedule = async (
+  site: Site,
+  now: Date = new Date()
+): Promise<SiteSchedule> => {
+  const timeZone = await SettingService.get<string>('scheduler.timeZone')
+  const jitterSeconds = await SettingService.get<number>(
+    'scheduler.jitterSeconds'
+  )
+  const next = nextRun(site, now, jitterSeconds)
+  return {
+    last_run: site.last_run || null,
+    next_run: next,
+    time_zone: timeZone,
+    next_run_local: formatInZone(next, timeZone),
+  }
+}
+
+// `id:interval` of sites warned to run below the floor, and the
+// floor they were warned for. Config is loaded once per process
+const clampWarnings = {
+  floor: null as number | null,
+  sites: new Set<string>(),
+}
+
+/**
+ * warnClamped
+ *
+ * Warns about `sites` running below the interval floor, once per
+ * site interval until the floor changes
+ */
+const warnClamped = (
+  sites: Site[],
+  floor: number = config.scheduler.minIntervalMinutes
+): void => {
+  if (clampWarnings.floor !== floor) {
+    clampWarnings.floor = floor
+    clampWarnings.sites.clear()
+  }
+  sites.forEach((site) => {
+    const key = `${site.id}:${site.run_every_minutes}`
+    if (
+      clampInterval(site.run_every_minutes, floor) === site.run_every_minutes ||
+      clampWarnings.sites.has(key)
+    ) {
+      return
     }
+    clampWarnings.sites.add(key)
+    logger.warn({
+      module: 'services/site',
+      method: 'getRunnable',
+      site_id: site.id,
+      message: `${site.name} runs every ${site.run_every_minutes} minutes, below the floor (clamped)`,
+    })
+  })
+}
+
+// highest site priority, aged priorities are capped to it
+export const MAX_PRIORITY = 100
+
+// priority plus `?` (aging per minute) for each minute overdue at `?` (now),
+// intervals are at least `?` (floor) minutes. Capped at `MAX_PRIORITY` so
+// long overdue sites tie with the highest priority and run oldest first
+const EFFECTIVE_PRIORITY = `least(${MAX_PRIORITY}, priority + ? * greatest(0,
+  extract(epoch from (?::timestamptz - coalesce(last_run, created_at))) / 60
+  - greatest(run_every_minutes, ?)))`
+
+/**
+ * queuePriority
+ *
+ * Bull job priority of a site priority (lower runs first), so the
+ * scanners reserve scans in the order `getRunnable` returns them.
+ * Aged priorities are rounded down so only sites at `MAX_PRIORITY`
+ * share the top slot (reserved oldest first). 1 is left for test scans
+ */
+export const queuePriority = (priority: number): number =>
+  MAX_PRIORITY + 2 - Math.min(MAX_PRIORITY, Math.floor(priority || 0))
+
+export type RunnableSite = Site & {
+  // priority including aging, at most `MAX_PRIORITY`
+  effective_priority: number
+}
+
+/**
+ * getRunnable
+ *
+ * Returns active sites that are due to run at `now`, highest
+ * (effective) priority first
+ *
+ * Due times are spread within a [0, `jitterSeconds`) window
+ * per site to avoid sites with the same interval running together.
+ * `agingPerMinute` boosts the priority of a site for every minute
+ * it is overdue, up to `MAX_PRIORITY`, so low priority sites are not
+ * starved (0 disables). Sites below the interval floor are warned
+ * about once per floor (see `warnClamped`)
+ */
+const getRunnable = async (
+  now: Date = new Date(),
+  jitterSeconds: number = config.scheduler.jitterSeconds,
+  agingPerMinute: number = config.scheduler.agingPerMinute
+): Promise<RunnableSite[]> => {
+  const whereQuery: Partial<SiteAttributes> = {
+    active: true,
   }
-  return res
+  const sites = (await Site.query()
+    .select(
+      'sites.*',
+      raw(`(${EFFECTIVE_PRIORITY})::float8 as effective_priority`, [
+        agingPerMinute || 0,
+        now,
+        config.scheduler.minIntervalMinutes || 0,
+      ])
+    )
+    .where(whereQuery)
+    .orderBy('effective_priority', 'desc')
+    .orderBy('last_run', 'asc')) as RunnableSite[]
+  warnClamped(sites)
+  return sites.filter((site) => isDue(site, now, jitterSeconds))
 }
 
 const view = async (id: string): Promise<Site> =>
   Site.query().findById(id).throwIfNotFound()
 
-const create = async (attrs: Partial<SiteAttributes>): Promise<Site> =>
-  Site.query().insert(attrs)
+export class SiteExistsError extends ConflictError {
+  constructor(name: string) {
+    super(`A site named "${name}" already exists`, { name })
+    Object.setPrototypeOf(this, SiteExistsError.prototype)
+  }
+}
+
+/**
+ * nameConflict
+ *
+ * Maps a unique violation on `sites.name` to `SiteExistsError`,
+ * other errors are returned as-is
+ */
+const nameConflict = (err: unknown, name?: string): unknown => {
+  if (
+    err instanceof UniqueViolationError &&
+    (err.columns || []).includes('name')
+  ) {
+    return new SiteExistsError(name)
+  }
+  return err
+}
+
+const create = async (
+  attrs: Partial<SiteAttributes>,
+  actor?: string
+): Promise<Site> => {
+  let created: Site
+  try {
+    created = await Site.query().insert(enforceIntervalFloor(attrs))
+  } catch (e) {
+    throw nameConflict(e, attrs.name)
+  }
+  await AuditService.record(actor, {
+    action: 'create',
+    entity_type: 'site',
+    entity_id: created.id,
+    after: created,
+  })
+  return created
+}
 
 const update = async (
   id: string,
-  site: Partial<SiteAttributes>
+  site: Partial<SiteAttributes>,
+  actor?: string
 ): Promise<Site> => {
-  const updated = await Site.query().patchAndFetchById(id, site)
+  const before = await Site.query().findById(id)
+  let updated: Site
+  try {
+    updated = await Site.query().patchAndFetchById(
+      id,
+      enforceIntervalFloor(site)
+    )
+  } catch (e) {
+    throw nameConflict(e, site.name)
+  }
+  await AuditService.record(actor, {
+    action: 'update',
+    entity_type: 'site',
+    entity_id: id,
+    before,
+    after: updated,
+  })
   return updated
 }
 
-const destroy = async (id: string): Promise<number> =>
-  Site.query().deleteById(id)
+const destroy = async (id: string, actor?: string): Promise<number> => {
+  const before = await Site.query().findById(id)
+  const total = await Site.query().deleteById(id)
+  if (total > 0) {
+    await AuditService.record(actor, {
+      action: 'delete',
+      entity_type: 'site',
+      entity_id: id,
+      before,
+    })
+  }
+  return total
+}
+
+export type TargetDrift = {
+  target_url: string | null
+  last_url: string | null
+  // consecutive drifting scans
+  runs: number
+  // `runs` reached the configured threshold
+  drifting: boolean
+}
+
+/**
+ * targetDrift
+ *
+ * Drift status of a site, warnings start once `threshold`
+ * consecutive scans landed away from the target URL
+ */
+const targetDrift = (
+  site: Pick<Site, 'target_url' | 'last_url' | 'drift_count'>,
+  threshold: number = config.scans.targetDrift.runs
+): TargetDrift => ({
+  target_url: site.target_url || null,
+  last_url: site.last_url || null,
+  runs: site.drift_count || 0,
+  drifting: !!site.target_url && (site.drift_count || 0) >= threshold,
+})
+
+/**
+ * recordLandingURL
+ *
+ * Stores the URL a completed scan landed on and counts consecutive
+ * scans drifting from `target_url` (reset on a matching scan)
+ */
+const recordLandingURL = async (
+  id: string,
+  url: string
+): Promise<TargetComparison> => {
+  const site = await view(id)
+  const comparison = site.target_url
+    ? compareTarget(site.target_url, url)
+    : { drift: false, reason: null }
+  await Site.query()
+    .patch({
+      last_url: url,
+      drift_count: comparison.drift ? site.drift_count + 1 : 0,
+    })
+    .findById(id)
+  return comparison
+}
 
 export default {
   getRunnable,
+  jitterOffset,
+  nextRun,
+  schedule,
   view,
   update,
   create,
   destroy,
+  targetDrift,
+  recordLandingURL,
 }
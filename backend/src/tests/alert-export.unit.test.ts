@@ -0,0 +1,61 @@
+// ./lib/alert-export.ts test
+import { readFileSync } from 'fs'
+import { join } from 'path'
+import { Alert } from '../models'
+import {
+  buildAlertView,
+  renderHTML,
+  renderMarkdown,
+} from '../lib/alert-export'
+
+const golden = (name: string): string =>
+  readFileSync(join(__dirname, 'golden', name), 'utf8')
+
+const alert = Alert.fromJson({
+  id: '2f6b5b3e-8a7d-4c0e-9a51-3f1d0c1b7e42',
+  rule: 'unknown.domain',
+  message: 'evil.example.com <unknown> | "new"',
+  severity: 'high',
+  scan_id: 'c4a1b0f2-6f7e-4d3b-8e25-9b0a7d6c5e13',
+  site_id: '8e9d0c1b-2a3f-4b5c-8d7e-6f5a4b3c2d10',
+  context: {
+    url: 'https://evil.example.com/a.js?x=1&y=<2>',
+    hostname: 'evil.example.com',
+    count: 3,
+  },
+  created_at: new Date('2022-09-19T12:00:00.000Z'),
+}) as Alert & { site: { id: string; name: string } }
+alert.site = { id: alert.site_id, name: 'Example & Co' }
+
+const baseURL = 'https://merrymaker.example.com'
+
+describe('Alert Export', () => {
+  it('renders self-contained html', () => {
+    const html = renderHTML(buildAlertView(alert, baseURL))
+    expect(html).toEqual(golden('alert-export.html'))
+    expect(html).not.toMatch(/<link|<script|<style/)
+  })
+  it('renders markdown', () => {
+    expect(renderMarkdown(buildAlertView(alert, baseURL))).toEqual(
+      golden('alert-export.md')
+    )
+  })
+  it('omits scan and site links when not set', () => {
+    const view = buildAlertView(
+      Alert.fromJson({
+        id: alert.id,
+        rule: 'yara',
+        message: 'match',
+        context: {},
+        created_at: new Date('2022-09-19T12:00:00.000Z'),
+      }),
+      baseURL
+    )
+    expect(view.links).toEqual({
+      alert: `${baseURL}/alerts?id=${alert.id}`,
+      scan: undefined,
+      site: undefined,
+    })
+    expect(renderMarkdown(view)).not.toMatch(/\/scans\//)
+  })
+})
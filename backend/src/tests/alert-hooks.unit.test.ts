@@ -0,0 +1,147 @@
+import http from 'http'
+import { AddressInfo } from 'net'
+import {
+  AlertHook,
+  AlertHooks,
+  loadHooks,
+  noopHook,
+  webhookHook,
+} from '../alerts/hooks'
+import { Metrics } from '../lib/metrics'
+import { Alert } from '../models'
+
+const testAlert = (attrs: Partial<Alert> = {}) =>
+  ({
+    id: 'f0e1a2b3-0000-4000-8000-000000000001',
+    rule: 'unknown.domain',
+    message: 'example.test unknown',
+    severity: 'critical',
+    ...attrs,
+  } as Alert)
+
+const fakeMetrics = () => {
+  const increments: Array<[string, Record<string, string>]> = []
+  const stats: Metrics = {
+    timing: () => undefined,
+    gauge: () => undefined,
+    increment: (name, tags) => increments.push([name, tags]),
+  }
+  return { stats, increments }
+}
+
+const recordingHook = (name: string, seen: string[]): AlertHook => ({
+  name,
+  onAlertCreated: async (alert) => {
+    seen.push(`${name}:${alert.id}`)
+  },
+})
+
+describe('Alert hooks', () => {
+  describe('AlertHooks', () => {
+    it('isolates failing hooks', async () => {
+      const { stats, increments } = fakeMetrics()
+      const hooks = new AlertHooks(2, stats)
+      const seen: string[] = []
+      hooks.use({
+        name: 'broken',
+        onAlertCreated: async () => {
+          throw new Error('jira is down')
+        },
+      })
+      hooks.use(recordingHook('ok', seen))
+      expect(() => hooks.dispatch(testAlert())).not.toThrow()
+      await hooks.idle()
+      expect(seen).toEqual(['ok:f0e1a2b3-0000-4000-8000-000000000001'])
+      expect(increments).toEqual(
+        expect.arrayContaining([
+          ['alert_hook.failed', { hook: 'broken' }],
+          ['alert_hook.succeeded', { hook: 'ok' }],
+        ])
+      )
+    })
+    it('does not wait for hooks', () => {
+      const hooks = new AlertHooks(1)
+      hooks.use({ name: 'slow', onAlertCreated: () => new Promise(() => null) })
+      const start = Date.now()
+      hooks.dispatch(testAlert())
+      expect(Date.now() - start).toBeLessThan(50)
+    })
+    it('bounds concurrent hook calls', async () => {
+      const hooks = new AlertHooks(2)
+      let running = 0
+      let maxRunning = 0
+      hooks.use({
+        name: 'counting',
+        onAlertCreated: async () => {
+          running += 1
+          maxRunning = Math.max(maxRunning, running)
+          await new Promise((resolve) => setTimeout(resolve, 5))
+          running -= 1
+        },
+      })
+      for (let i = 0; i < 6; i += 1) {
+        hooks.dispatch(testAlert({ id: `${i}` }))
+      }
+      await hooks.idle()
+      expect(maxRunning).toEqual(2)
+    })
+  })
+  describe('webhookHook', () => {
+    let server: http.Server
+    let url: string
+    let received: Array<{ alert: Alert }>
+    let status: number
+    beforeAll(async () => {
+      server = http.createServer((req, res) => {
+        let body = ''
+        req.on('data', (chunk) => (body += chunk))
+        req.on('end', () => {
+          received.push(JSON.parse(body))
+          res.writeHead(status)
+          res.end()
+        })
+      })
+      await new Promise<void>((resolve) => server.listen(0, resolve))
+      url = `http://127.0.0.1:${(server.address() as AddressInfo).port}/hook`
+    })
+    afterAll(async () => {
+      await new Promise((resolve) => server.close(resolve))
+    })
+    beforeEach(() => {
+      received = []
+      status = 204
+    })
+    it('posts the alert', async () => {
+      await webhookHook({ url }).onAlertCreated(testAlert())
+      expect(received).toEqual([
+        { alert: expect.objectContaining({ rule: 'unknown.domain' }) },
+      ])
+    })
+    it('fails on error responses', async () => {
+      status = 500
+      await expect(
+        webhookHook({ url }).onAlertCreated(testAlert())
+      ).rejects.toThrow('webhook responded with 500')
+    })
+    it('filters by severity when loaded from config', async () => {
+      const hooks = loadHooks({
+        concurrency: 1,
+        entries: [{ type: 'webhook', url, severities: ['critical'] }],
+      })
+      hooks.dispatch(testAlert({ severity: 'low' }))
+      hooks.dispatch(testAlert({ severity: 'critical' }))
+      await hooks.idle()
+      expect(received).toHaveLength(1)
+      expect(received[0].alert.severity).toEqual('critical')
+    })
+  })
+  describe('loadHooks', () => {
+    it('skips invalid entries', () => {
+      const hooks = loadHooks({
+        concurrency: 1,
+        entries: [{ type: 'noop' }, { type: 'webhook' }, { type: 'jira' }],
+      })
+      expect(hooks.hooks.map((h) => h.name)).toEqual([noopHook().name])
+    })
+  })
+})
@@ -0,0 +1,137 @@
+// ./alerts/base.ts rule filter test
+import MerryMaker from '@merrymaker/types'
+import {
+  acceptsEvent,
+  AlertSinkBase,
+  isMuted,
+  quietHoursConfig,
+  ruleTypesFilter,
+} from '../alerts/base'
+
+const sink = (ruleTypes?: string[]): AlertSinkBase => ({
+  name: 'test sink',
+  enabled: true,
+  ruleTypes,
+  send: async () => true,
+})
+
+const ruleAlert = (name: string) =>
+  ({
+    entry: 'rule-alert',
+    scan_id: 'scan',
+    level: 'info',
+    event: { name, message: 'matched', alert: true, context: {} },
+  } as unknown as MerryMaker.RuleAlertEvent)
+
+describe('Alert sink rule filter', () => {
+  describe('ruleTypesFilter', () => {
+    it('accepts known rules', () => {
+      expect(ruleTypesFilter(['ioc.domain', 'yara'], 'pager')).toEqual([
+        'ioc.domain',
+        'yara',
+      ])
+    })
+    it('defaults to an empty filter', () => {
+      expect(ruleTypesFilter(undefined, 'pager')).toEqual([])
+    })
+    it('rejects unknown rules', () => {
+      expect(() => ruleTypesFilter(['ioc.domian'], 'pager')).toThrow(
+        'pager ruleTypes: unknown rules "ioc.domian"'
+      )
+    })
+  })
+  describe('acceptsEvent', () => {
+    it('sends every rule without a filter', () => {
+      expect(acceptsEvent(sink(), ruleAlert('unknown.domain'))).toBe(true)
+      expect(acceptsEvent(sink([]), ruleAlert('unknown.domain'))).toBe(true)
+    })
+    it('sends filtered rules only', () => {
+      const pager = sink(['ioc.domain'])
+      expect(acceptsEvent(pager, ruleAlert('ioc.domain'))).toBe(true)
+      expect(acceptsEvent(pager, ruleAlert('unknown.domain'))).toBe(false)
+    })
+    it('uses the given rule filter over the sink config', () => {
+      const pager = sink(['ioc.domain'])
+      expect(acceptsEvent(pager, ruleAlert('yara'), ['yara'])).toBe(true)
+      expect(acceptsEvent(pager, ruleAlert('ioc.domain'), ['yara'])).toBe(
+        false
+      )
+    })
+    it('sends events other than rule alerts', () => {
+      const evt = {
+        entry: 'error',
+        scan_id: 'scan',
+        level: 'error',
+        event: { message: 'failed' },
+      } as unknown as MerryMaker.EventResult
+      expect(acceptsEvent(sink(['ioc.domain']), evt)).toBe(true)
+    })
+  })
+  describe('quietHoursConfig', () => {
+    it('is disabled without a window', () => {
+      expect(quietHoursConfig(undefined, 'pager')).toBeUndefined()
+      expect(quietHoursConfig({ start: '', end: '' }, 'pager')).toBeUndefined()
+    })
+    it('defaults the zone and severity', () => {
+      expect(
+        quietHoursConfig({ start: '22:00', end: '06:00' }, 'pager')
+      ).toEqual({
+        start: '22:00',
+        end: '06:00',
+        days: [],
+        timeZone: 'UTC',
+        minSeverity: 'critical',
+      })
+    })
+    it('rejects invalid settings', () => {
+      expect(() =>
+        quietHoursConfig({ start: '10pm', end: '06:00' }, 'pager')
+      ).toThrow('pager quietHours: start and end must be HH:mm')
+      expect(() =>
+        quietHoursConfig(
+          { start: '22:00', end: '06:00', timeZone: 'Mars/Olympus' },
+          'pager'
+        )
+      ).toThrow('unknown time zone')
+      expect(() =>
+        quietHoursConfig(
+          { start: '22:00', end: '06:00', minSeverity: 'urgent' },
+          'pager'
+        )
+      ).toThrow('unknown severity')
+    })
+  })
+  describe('isMuted', () => {
+    const pager = {
+      ...sink(),
+      quietHours: quietHoursConfig(
+        {
+          start: '22:00',
+          end: '06:00',
+          timeZone: 'America/Chicago',
+          minSeverity: 'high',
+        },
+        'pager'
+      ),
+    }
+    // 23:30 in Chicago (CDT)
+    const night = new Date('2022-10-04T04:30:00Z')
+    const day = new Date('2022-10-04T15:00:00Z')
+    it('mutes alerts below the minimum severity in the window', () => {
+      expect(isMuted(pager, 'medium', night)).toBe(true)
+    })
+    it('delivers events without a severity', () => {
+      expect(isMuted(pager, undefined, night)).toBe(false)
+    })
+    it('delivers alerts at or above the minimum severity', () => {
+      expect(isMuted(pager, 'high', night)).toBe(false)
+      expect(isMuted(pager, 'critical', night)).toBe(false)
+    })
+    it('delivers outside the window', () => {
+      expect(isMuted(pager, 'low', day)).toBe(false)
+    })
+    it('never mutes sinks without quiet hours', () => {
+      expect(isMuted(sink(), 'low', night)).toBe(false)
+    })
+  })
+})
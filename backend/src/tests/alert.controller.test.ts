@@ -5,8 +5,9 @@ import AlertFactory from './factories/alert.factory'
 import ScanFactory from './factories/scans.factory'
 import SiteFactory from './factories/sites.factory'
 import SourceFactory from './factories/sources.factory'
-import { Alert, knex } from '../models'
+import { Alert, AlertDelivery, ScanLog, knex } from '../models'
 import request from 'supertest'
+import { sinkRegistry } from '../services/alert'
 
 const chance = new Chance()
 
@@ -99,6 +100,52 @@ describe('Alert Controller', () => {
         .query({ 'rule[]': 'yara' })
       expect(res.body.total).toBe(0)
     })
+    it('should filter on comma-separated "severity" values', async () => {
+      await AlertFactory.build({ severity: 'high' }).$query().insert()
+      await AlertFactory.build({ severity: 'critical' }).$query().insert()
+      await AlertFactory.build({ severity: 'low' }).$query().insert()
+      const res = await request(adminSession().app)
+        .get('/api/alerts')
+        .query({ 'severity[]': 'high,critical' })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(2)
+      expect(res.body.results.map((r: Alert) => r.severity).sort()).toEqual([
+        'critical',
+        'high',
+      ])
+    })
+    it('should combine "rule" and "severity" filters', async () => {
+      await AlertFactory.build({ rule: 'yara', severity: 'high' })
+        .$query()
+        .insert()
+      await AlertFactory.build({ severity: 'high' }).$query().insert()
+      const res = await request(adminSession().app)
+        .get('/api/alerts')
+        .query({ 'rule[]': 'yara,ioc.domain', 'severity[]': 'high' })
+      expect(res.body.total).toBe(1)
+      expect(res.body.results[0].rule).toBe('yara')
+    })
+    it('should filter by "status"', async () => {
+      await AlertFactory.build({ status: 'resolved' }).$query().insert()
+      await AlertFactory.build({ status: 'false_positive' }).$query().insert()
+      const res = await request(adminSession().app)
+        .get('/api/alerts')
+        .query({ 'status[]': 'resolved,false_positive' })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(2)
+      const open = await request(adminSession().app)
+        .get('/api/alerts')
+        .query({ 'status[]': 'open' })
+      expect(open.body.total).toBe(1)
+      expect(open.body.results[0].id).toBe(seed.id)
+    })
+    it('should reject invalid "severity" values', async () => {
+      const res = await request(adminSession().app)
+        .get('/api/alerts')
+        .query({ 'severity[]': 'urgent,bogus' })
+      expect(res.status).toBe(400)
+      expect(res.body.data.event.invalid).toEqual(['urgent', 'bogus'])
+    })
     it('should return only matching search results', async () => {
       const res = await request(userSession().app)
         .get('/api/alerts')
@@ -129,6 +176,88 @@ describe('Alert Controller', () => {
       expect(res.body.data.path).toBe('/eager/0')
     })
   })
+  describe('GET /api/alerts cursor pagination', () => {
+    const list = (query: Record<string, string | number>) =>
+      request(userSession().app)
+        .get('/api/alerts')
+        .query({
+          pageSize: 2,
+          orderColumn: 'created_at',
+          orderDirection: 'desc',
+          ...query,
+        })
+    beforeEach(async () => {
+      for (let i = 1; i <= 5; i += 1) {
+        await AlertFactory.build({
+          severity: 'high',
+          created_at: new Date(Date.now() + i * 60000),
+        })
+          .$query()
+          .insert()
+      }
+    })
+    it('should walk filtered pages with cursors', async () => {
+      const first = await list({ 'severity[]': 'high' })
+      expect(first.status).toBe(200)
+      expect(first.body.total).toBe(5)
+      const second = await list({
+        'severity[]': 'high',
+        cursor_after: first.body.next_cursor,
+      })
+      expect(second.body.total).toBeUndefined()
+      const third = await list({
+        'severity[]': 'high',
+        cursor_after: second.body.next_cursor,
+      })
+      expect(third.body.results).toHaveLength(1)
+      expect(third.body.next_cursor).toBeNull()
+      const ids = [first, second, third].reduce(
+        (acc: string[], page) =>
+          acc.concat(page.body.results.map((r: Alert) => r.id)),
+        []
+      )
+      expect(new Set(ids).size).toBe(5)
+      expect(ids).not.toContain(seed.id)
+    })
+    it('should page back with cursor_before', async () => {
+      const first = await list({})
+      const second = await list({ cursor_after: first.body.next_cursor })
+      const back = await list({ cursor_before: second.body.prev_cursor })
+      expect(back.body.results.map((r: Alert) => r.id)).toEqual(
+        first.body.results.map((r: Alert) => r.id)
+      )
+    })
+    it('should filter by date range', async () => {
+      const res = await list({
+        pageSize: 10,
+        created_after: new Date(Date.now() + 90000).toISOString(),
+        created_before: new Date(Date.now() + 210000).toISOString(),
+      })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(2)
+    })
+    it('should reject an invalid date', async () => {
+      const res = await list({ created_after: 'yesterday' })
+      // schema (422) or handler (400) validation
+      expect([400, 422]).toContain(res.status)
+    })
+  })
+  describe('GET /api/alerts/count', () => {
+    it('should count Alerts matching the filters', async () => {
+      await AlertFactory.build({ severity: 'high' }).$query().insert()
+      const res = await request(userSession().app)
+        .get('/api/alerts/count')
+        .query({ 'severity[]': 'high' })
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({ total: 1 })
+      const validate = ajv.compile(
+        api['/api/alerts/count'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+  })
   describe('GET /api/alerts/:id', () => {
     it('should get Alert by ID', async () => {
       const res = await request(userSession().app).get(`/api/alerts/${seed.id}`)
@@ -148,6 +277,361 @@ describe('Alert Controller', () => {
       expect(res.status).toBe(404)
     })
   })
+  describe('GET /api/alerts/:id/export.html', () => {
+    it('should export Alert as html', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/export.html`
+      )
+      expect(res.status).toBe(200)
+      expect(res.type).toBe('text/html')
+      expect(res.text).toContain('IOC example.com')
+    })
+    it('should export Alert as markdown', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/export.html?format=md`
+      )
+      expect(res.status).toBe(200)
+      expect(res.type).toBe('text/markdown')
+      expect(res.text).toMatch(/^## IOC example\.com/)
+    })
+    it('should return 422 for invalid format', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/export.html?format=pdf`
+      )
+      expect(res.status).toBe(422)
+    })
+    it('should return 404 for invalid ID', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${chance.guid({ version: 4 })}/export.html`
+      )
+      expect(res.status).toBe(404)
+    })
+  })
+  describe('GET /api/alerts/:id/deliveries', () => {
+    it('should list delivery attempts', async () => {
+      for (const attempt of [1, 2]) {
+        await AlertDelivery.query().insert({
+          alert_id: seed.id,
+          scan_id: seed.scan_id,
+          sink: 'goalert',
+          attempt,
+          status: attempt === 1 ? 'failed' : 'succeeded',
+        })
+      }
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/deliveries`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.results.map((r: AlertDelivery) => r.attempt)).toEqual([
+        1,
+        2,
+      ])
+      const validate = ajv.compile(
+        api['/api/alerts/:id/deliveries'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should filter dead-lettered attempts', async () => {
+      for (const attempt of [1, 2]) {
+        await AlertDelivery.query().insert({
+          alert_id: seed.id,
+          sink: 'goalert',
+          attempt,
+          status: attempt === 1 ? 'failed' : 'dead_lettered',
+        })
+      }
+      const res = await request(userSession().app)
+        .get(`/api/alerts/${seed.id}/deliveries`)
+        .query({ 'status[]': 'dead_lettered' })
+      expect(res.status).toBe(200)
+      expect(res.body.results).toHaveLength(1)
+      expect(res.body.results[0].attempt).toBe(2)
+    })
+    it('should mask sensitive headers', async () => {
+      await AlertDelivery.query().insert({
+        alert_id: seed.id,
+        sink: 'webhook',
+        attempt: 1,
+        status: 'succeeded',
+        request: {
+          headers: {
+            Authorization: 'Bearer secret',
+            'Content-Type': 'application/json',
+          },
+        },
+      })
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/deliveries`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.results[0].request.headers).toEqual({
+        Authorization: '********',
+        'Content-Type': 'application/json',
+      })
+    })
+    it('should return 404 for invalid ID', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${chance.guid({ version: 4 })}/deliveries`
+      )
+      expect(res.status).toBe(404)
+    })
+  })
+  describe('GET /api/alerts/:id/deliveries/history', () => {
+    beforeEach(async () => {
+      const attempts = [
+        { sink: 'goalert', attempt: 1, status: 'failed' },
+        { sink: 'teams', attempt: 1, status: 'succeeded' },
+        { sink: 'goalert', attempt: 2, status: 'failed' },
+        { sink: 'goalert', attempt: 3, status: 'succeeded' },
+      ]
+      for (const [i, attrs] of attempts.entries()) {
+        await AlertDelivery.query()
+          .insert({ alert_id: seed.id, scan_id: seed.scan_id, ...attrs })
+          .then((d) =>
+            d.$query().patch({ created_at: new Date(Date.now() + i * 1000) })
+          )
+      }
+    })
+    it('should group every attempt per sink', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/deliveries/history`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.results).toHaveLength(2)
+      const [goalert, teams] = res.body.results
+      expect(goalert.sink).toBe('goalert')
+      expect(goalert.status).toBe('succeeded')
+      expect(goalert.attempts).toBe(3)
+      expect(
+        goalert.history.map((d: AlertDelivery) => [d.attempt, d.status])
+      ).toEqual([
+        [1, 'failed'],
+        [2, 'failed'],
+        [3, 'succeeded'],
+      ])
+      expect(teams.attempts).toBe(1)
+      const validate = ajv.compile(
+        api['/api/alerts/:id/deliveries/history'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should limit the attempts returned per sink', async () => {
+      const res = await request(userSession().app)
+        .get(`/api/alerts/${seed.id}/deliveries/history`)
+        .query({ limit: 1 })
+      expect(res.status).toBe(200)
+      expect(res.body.results[0].attempts).toBe(3)
+      expect(
+        res.body.results[0].history.map((d: AlertDelivery) => d.attempt)
+      ).toEqual([3])
+    })
+    it('should report the next retry of a failed sink', async () => {
+      const nextAttemptAt = new Date(Date.now() + 3600000)
+      await AlertDelivery.query().insert({
+        alert_id: seed.id,
+        scan_id: seed.scan_id,
+        sink: 'kafka',
+        attempt: 1,
+        status: 'failed',
+        retry_delay_ms: 3600000,
+        next_attempt_at: nextAttemptAt,
+      })
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/deliveries/history`
+      )
+      expect(res.status).toBe(200)
+      const bySink = (sink: string) =>
+        res.body.results.find((r: { sink: string }) => r.sink === sink)
+      expect(bySink('goalert').next_retry_in_ms).toBeNull()
+      const kafka = bySink('kafka')
+      expect(new Date(kafka.next_attempt_at)).toEqual(nextAttemptAt)
+      expect(kafka.next_retry_in_ms).toBeGreaterThan(0)
+      expect(kafka.next_retry_in_ms).toBeLessThanOrEqual(3600000)
+    })
+  })
+  describe('POST /api/alerts/:id/deliveries/:delivery_id/redeliver', () => {
+    const attempt = (status: string) =>
+      AlertDelivery.query().insert({
+        alert_id: seed.id,
+        scan_id: seed.scan_id,
+        sink: sinkRegistry.goAlert.name,
+        attempt: 3,
+        status,
+        request: { name: 'rule-alert', message: seed.message },
+      })
+    const redeliver = (delivery: AlertDelivery) =>
+      request(adminSession().app).post(
+        `/api/alerts/${seed.id}/deliveries/${delivery.id}/redeliver`
+      )
+    beforeEach(() => {
+      sinkRegistry.goAlert.enabled = true
+    })
+    afterEach(() => {
+      sinkRegistry.goAlert.enabled = false
+    })
+    it('should queue a redelivery of a failed attempt', async () => {
+      const delivery = await attempt('dead_lettered')
+      const res = await redeliver(delivery)
+      expect(res.status).toBe(202)
+      expect(res.body.delivery_id).toBe(delivery.id)
+      expect(res.body.sink).toBe(sinkRegistry.goAlert.name)
+      const validate = ajv.compile(
+        api['/api/alerts/:id/deliveries/:delivery_id/redeliver'].post
+          .responses['202'].content['application/json'].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should refuse to redeliver a succeeded attempt', async () => {
+      const res = await redeliver(await attempt('succeeded'))
+      expect(res.status).toBe(422)
+    })
+    it('should refuse disabled sinks', async () => {
+      sinkRegistry.goAlert.enabled = false
+      const res = await redeliver(await attempt('failed'))
+      expect(res.status).toBe(422)
+    })
+    it('should not allow user to redeliver', async () => {
+      const delivery = await attempt('failed')
+      const res = await request(userSession().app).post(
+        `/api/alerts/${seed.id}/deliveries/${delivery.id}/redeliver`
+      )
+      expect(res.status).toBe(403)
+    })
+    it('should return 404 for a delivery of another alert', async () => {
+      const res = await request(adminSession().app).post(
+        `/api/alerts/${seed.id}/deliveries/${chance.guid({
+          version: 4,
+        })}/redeliver`
+      )
+      expect(res.status).toBe(404)
+    })
+  })
+  describe('GET /api/alerts/:id/event', () => {
+    const eventID = chance.guid({ version: 4 })
+    const withEvent = () =>
+      Alert.query().patchAndFetchById(seed.id, {
+        context: { ...seed.context, event_id: eventID },
+      })
+    it('should resolve the triggering event', async () => {
+      await withEvent()
+      await ScanLog.query().insert({
+        id: eventID,
+        scan_id: seed.scan_id,
+        entry: 'request',
+        level: 'info',
+        event: { url: 'https://example.com/script.js' },
+        created_at: new Date(),
+      })
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/event`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.event_id).toBe(eventID)
+      expect(res.body.available).toBe(true)
+      expect(res.body.scan_log.id).toBe(eventID)
+      const validate = ajv.compile(
+        api['/api/alerts/:id/event'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should flag purged events as unavailable', async () => {
+      await withEvent()
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/event`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({ event_id: eventID, available: false })
+    })
+    it('should handle alerts without an event', async () => {
+      const res = await request(userSession().app).get(
+        `/api/alerts/${seed.id}/event`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({ event_id: null, available: false })
+    })
+  })
+  describe('POST /api/alerts/:id/status', () => {
+    it('should transition Alert status', async () => {
+      const res = await request(userSession().app)
+        .post(`/api/alerts/${seed.id}/status`)
+        .send({ alert_status: { status: 'acknowledged', note: 'on it' } })
+      expect(res.status).toBe(200)
+      expect(res.body.alert.status).toBe('acknowledged')
+      expect(res.body.alert.status_updated_by).toBe('z000n00')
+      const validate = ajv.compile(
+        api['/api/alerts/:id/status'].post.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should reject invalid transitions', async () => {
+      await Alert.query().patchAndFetchById(seed.id, { status: 'resolved' })
+      const res = await request(userSession().app)
+        .post(`/api/alerts/${seed.id}/status`)
+        .send({ alert_status: { status: 'false_positive' } })
+      expect(res.status).toBe(422)
+    })
+    it('should return validation error on unknown status', async () => {
+      const res = await request(userSession().app)
+        .post(`/api/alerts/${seed.id}/status`)
+        .send({ alert_status: { status: 'closed' } })
+      expect(res.status).toBe(422)
+    })
+  })
+  describe('GET /api/alerts/status-counts', () => {
+    it('should count Alerts by status', async () => {
+      const res = await request(userSession().app).get(
+        '/api/alerts/status-counts'
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({
+        open: 1,
+        acknowledged: 0,
+        resolved: 0,
+        false_positive: 0,
+        handled: 0,
+      })
+    })
+  })
+  describe('GET /api/alerts/sinks', () => {
+    it('should list alert sinks with their rule filters', async () => {
+      const res = await request(userSession().app).get('/api/alerts/sinks')
+      expect(res.status).toBe(200)
+      expect(res.body.results.map((s: { key: string }) => s.key)).toEqual([
+        'goAlert',
+        'kafka',
+        'teams',
+      ])
+      expect(res.body.results[0].rule_types).toEqual([])
+      const validate = ajv.compile(
+        api['/api/alerts/sinks'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+  })
+  describe('POST /api/alerts/sinks/:key/test', () => {
+    it('should reject disabled sinks', async () => {
+      const res = await request(adminSession().app).post(
+        '/api/alerts/sinks/goAlert/test'
+      )
+      expect(res.status).toBe(422)
+    })
+    it('should reject unknown sinks', async () => {
+      const res = await request(adminSession().app).post(
+        '/api/alerts/sinks/pager/test'
+      )
+      expect(res.status).toBe(422)
+    })
+  })
   describe('GET /api/alerts/distinct', () => {
     it('should get distinct alert column values', async () => {
       const res = await request(adminSession().app)
@@ -1,9 +1,24 @@
-import AlertService from '../services/alert'
+import fs from 'fs'
+import os from 'os'
+import path from 'path'
+import AlertService, { sinkRuleTypes } from '../services/alert'
+import SettingService from '../services/setting'
+import { errorCategory, formatResults, readSpecs } from '../fire-http-alert'
+import AlertDeliveryService from '../services/alert_delivery'
+import { JobOptions } from 'bull'
+import {
+  AlertEvent,
+  AlertQueueEvent,
+  AlertRetryJob,
+  AlertSinkBase
+} from '../alerts/base'
+import { MASKED_VALUE } from '../lib/headers'
 import AlertFactory from './factories/alert.factory'
 import ScanFactory from './factories/scans.factory'
 import SiteFactory from './factories/sites.factory'
 import SourceFactory from './factories/sources.factory'
 import { resetDB } from './utils'
+import { Alert, AlertDelivery, AllowList } from '../models'
 import sub from 'date-fns/sub'
 
 describe('Alert Service', () => {
@@ -74,4 +89,641 @@ describe('Alert Service', () => {
       expect(res.rows[3].count).toBe(0)
     })
   })
+  describe('deliver', () => {
+    const evt: AlertEvent = {
+      type: 'info',
+      name: 'rule-alert',
+      scan_id: '12345',
+      message: 'unknown.domain - example.com unknown',
+      details: '{}',
+    }
+    const fakeSink = (
+      name: string,
+      ok: boolean,
+      fallback?: string
+    ): AlertSinkBase & { send: jest.Mock } => ({
+      name,
+      enabled: true,
+      fallback,
+      send: jest.fn(async () => {
+        if (!ok) throw new Error(`${name} down`)
+        return true
+      }),
+    })
+    // retries wait in process, see 'queued retries'
+    const opts = (registry: Record<string, AlertSinkBase>) => ({
+      maxAttempts: 3,
+      backoff: { baseDelayMs: 0 },
+      inline: true,
+      registry,
+    })
+    it('does not use the fallback on success', async () => {
+      const primary = fakeSink('primary', true, 'secondary')
+      const secondary = fakeSink('secondary', true)
+      await AlertService.deliver(primary, evt, opts({ primary, secondary }))
+      expect(primary.send).toHaveBeenCalledTimes(1)
+      expect(secondary.send).not.toHaveBeenCalled()
+    })
+    it('delivers once to the fallback after retries', async () => {
+      const primary = fakeSink('primary', false, 'secondary')
+      const secondary = fakeSink('secondary', true)
+      const res = await AlertService.deliver(
+        primary,
+        evt,
+        opts({ primary, secondary })
+      )
+      expect(res).toBe(true)
+      expect(primary.send).toHaveBeenCalledTimes(3)
+      expect(secondary.send).toHaveBeenCalledTimes(1)
+      expect(secondary.send).toHaveBeenCalledWith(evt)
+    })
+    it('throws without a fallback', async () => {
+      const primary = fakeSink('primary', false)
+      await expect(
+        AlertService.deliver(primary, evt, opts({ primary }))
+      ).rejects.toThrow('primary down')
+    })
+    it('records every attempt in order', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      const alert = await AlertFactory.build({
+        site_id: site.id,
+        scan_id: scan.id
+      })
+        .$query()
+        .insert()
+      const flaky = fakeSink('flaky', true)
+      flaky.send
+        .mockRejectedValueOnce(new Error('timeout'))
+        .mockRejectedValueOnce(new Error('bad gateway'))
+      await AlertService.deliver(
+        flaky,
+        { ...evt, scan_id: scan.id },
+        { ...opts({ flaky }), alertID: alert.id }
+      )
+      const actual = await AlertDeliveryService.listByAlert(alert.id)
+      expect(
+        actual.map(({ sink, attempt, status, response }) => ({
+          sink,
+          attempt,
+          status,
+          response
+        }))
+      ).toEqual([
+        {
+          sink: 'flaky',
+          attempt: 1,
+          status: 'failed',
+          response: { error: 'timeout' }
+        },
+        {
+          sink: 'flaky',
+          attempt: 2,
+          status: 'failed',
+          response: { error: 'bad gateway' }
+        },
+        {
+          sink: 'flaky',
+          attempt: 3,
+          status: 'succeeded',
+          response: { result: true }
+        }
+      ])
+      expect(actual[0].request.scan_id).toBe(scan.id)
+    })
+    it('dead-letters the last attempt when retries are exhausted', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      const alert = await AlertFactory.build({
+        site_id: site.id,
+        scan_id: scan.id
+      })
+        .$query()
+        .insert()
+      const down = fakeSink('down', false)
+      await expect(
+        AlertService.deliver(
+          down,
+          { ...evt, scan_id: scan.id },
+          { ...opts({ down }), maxAttempts: 2, alertID: alert.id }
+        )
+      ).rejects.toThrow('down down')
+      const actual = await AlertDeliveryService.listByAlert(alert.id)
+      expect(actual.map(({ attempt, status }) => ({ attempt, status }))).toEqual(
+        [
+          { attempt: 1, status: 'failed' },
+          { attempt: 2, status: 'dead_lettered' }
+        ]
+      )
+    })
+    it('records the backoff delay of retried attempts', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      const alert = await AlertFactory.build({
+        site_id: site.id,
+        scan_id: scan.id
+      })
+        .$query()
+        .insert()
+      const down = {
+        ...fakeSink('down', false),
+        backoff: { baseDelayMs: 5, multiplier: 2, maxDelayMs: 8, jitter: 0 }
+      }
+      await expect(
+        AlertService.deliver(
+          down,
+          { ...evt, scan_id: scan.id },
+          {
+            maxAttempts: 4,
+            inline: true,
+            registry: { down },
+            alertID: alert.id
+          }
+        )
+      ).rejects.toThrow('down down')
+      const actual = await AlertDeliveryService.listByAlert(alert.id)
+      expect(actual.map(d => d.retry_delay_ms)).toEqual([5, 8, 8, null])
+      expect(actual[3].next_attempt_at).toBeNull()
+      // retries are scheduled from the failed attempt
+      actual.slice(0, 3).forEach(d => {
+        const scheduledIn =
+          new Date(d.next_attempt_at).valueOf() -
+          new Date(d.created_at).valueOf()
+        expect(scheduledIn).toBe(d.retry_delay_ms)
+      })
+    })
+    describe('queued retries', () => {
+      const queue = () => {
+        const jobs: Array<{ data: AlertRetryJob; delay: number }> = []
+        return {
+          jobs,
+          add: jest.fn(async (data: AlertRetryJob, jobOpts: JobOptions) => {
+            jobs.push({ data, delay: jobOpts.delay })
+          })
+        }
+      }
+      const backoff = { baseDelayMs: 100, multiplier: 2, jitter: 0 }
+      it('queues the next attempt with its backoff delay', async () => {
+        const retryQueue = queue()
+        const flaky = fakeSink('flaky', true)
+        flaky.send.mockRejectedValueOnce(new Error('timeout'))
+        const res = await AlertService.deliver(flaky, evt, {
+          maxAttempts: 3,
+          backoff,
+          registry: { flaky },
+          retryQueue
+        })
+        expect(res).toBe(false)
+        expect(flaky.send).toHaveBeenCalledTimes(1)
+        expect(retryQueue.jobs).toEqual([
+          {
+            data: expect.objectContaining({
+              sink: 'flaky',
+              event: evt,
+              attempt: 2,
+              max_attempts: 3,
+              visited: ['flaky']
+            }),
+            delay: 100
+          }
+        ])
+        const retried = await AlertService.retry(retryQueue.jobs[0].data, {
+          registry: { flaky },
+          retryQueue
+        })
+        expect(retried).toBe(true)
+        expect(flaky.send).toHaveBeenCalledTimes(2)
+        expect(retryQueue.jobs).toHaveLength(1)
+      })
+      it('goes to the fallback once retries are exhausted', async () => {
+        const retryQueue = queue()
+        const primary = fakeSink('primary', false, 'secondary')
+        const secondary = fakeSink('secondary', true)
+        const registry = { primary, secondary }
+        await AlertService.deliver(primary, evt, {
+          maxAttempts: 2,
+          backoff,
+          registry,
+          retryQueue
+        })
+        const res = await AlertService.retry(retryQueue.jobs[0].data, {
+          registry,
+          retryQueue
+        })
+        expect(res).toBe(true)
+        expect(retryQueue.jobs.map(j => j.delay)).toEqual([100])
+        expect(primary.send).toHaveBeenCalledTimes(2)
+        expect(secondary.send).toHaveBeenCalledTimes(1)
+      })
+      it('keeps the fallback loop guard across retries', async () => {
+        const retryQueue = queue()
+        const primary = fakeSink('primary', false, 'secondary')
+        const secondary = fakeSink('secondary', false, 'primary')
+        const registry = { primary, secondary }
+        await AlertService.deliver(primary, evt, {
+          maxAttempts: 2,
+          backoff,
+          registry,
+          retryQueue
+        })
+        // primary exhausted, secondary fails its first attempt
+        await AlertService.retry(retryQueue.jobs[0].data, {
+          registry,
+          retryQueue
+        })
+        expect(retryQueue.jobs[1].data).toMatchObject({
+          sink: 'secondary',
+          attempt: 2,
+          visited: ['primary', 'secondary']
+        })
+        await expect(
+          AlertService.retry(retryQueue.jobs[1].data, { registry, retryQueue })
+        ).rejects.toThrow('secondary down')
+        expect(primary.send).toHaveBeenCalledTimes(2)
+      })
+    })
+    it('sends signed headers and masks the signature', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      const alert = await AlertFactory.build({
+        site_id: site.id,
+        scan_id: scan.id
+      })
+        .$query()
+        .insert()
+      const signed = {
+        ...fakeSink('signed', true),
+        requestHeaders: () => ({
+          'X-MMK-Signature': 'sha256=abc',
+          'X-MMK-Timestamp': '1664784000'
+        }),
+        secretHeaders: ['X-MMK-Signature']
+      }
+      await AlertService.deliver(
+        signed,
+        { ...evt, scan_id: scan.id },
+        { ...opts({ signed }), alertID: alert.id }
+      )
+      expect(signed.send).toHaveBeenCalledWith(
+        { ...evt, scan_id: scan.id },
+        { 'X-MMK-Signature': 'sha256=abc', 'X-MMK-Timestamp': '1664784000' }
+      )
+      const [actual] = await AlertDeliveryService.listByAlert(alert.id)
+      expect(actual.request.headers).toEqual({
+        'X-MMK-Signature': MASKED_VALUE,
+        'X-MMK-Timestamp': '1664784000'
+      })
+    })
+    it('guards against fallback loops', async () => {
+      const primary = fakeSink('primary', false, 'secondary')
+      const secondary = fakeSink('secondary', false, 'primary')
+      await expect(
+        AlertService.deliver(primary, evt, opts({ primary, secondary }))
+      ).rejects.toThrow('secondary down')
+      expect(primary.send).toHaveBeenCalledTimes(3)
+      expect(secondary.send).toHaveBeenCalledTimes(3)
+    })
+  })
+  describe('transition', () => {
+    const seedAlert = async (context: Record<string, unknown> = {}) => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      return AlertFactory.build({ site_id: site.id, scan_id: scan.id, context })
+        .$query()
+        .insert()
+        .returning('*')
+    }
+    it('records the actor and note of a transition', async () => {
+      const alert = await seedAlert()
+      expect(alert.status).toBe('open')
+      const { alert: actual } = await AlertService.transition(
+        alert.id,
+        'acknowledged',
+        'z000n00',
+        { note: 'looking' }
+      )
+      expect(actual.status).toBe('acknowledged')
+      expect(actual.status_updated_by).toBe('z000n00')
+      expect(actual.status_note).toBe('looking')
+      expect(actual.status_updated_at).toBeTruthy()
+    })
+    it('rejects transitions not allowed from the current status', async () => {
+      const alert = await seedAlert()
+      await AlertService.transition(alert.id, 'resolved', 'z000n00')
+      await expect(
+        AlertService.transition(alert.id, 'acknowledged', 'z000n00')
+      ).rejects.toThrow('cannot move a resolved alert to acknowledged')
+      const { alert: reopened } = await AlertService.transition(
+        alert.id,
+        'open',
+        'z000n00'
+      )
+      expect(reopened.status).toBe('open')
+    })
+    it('allow-lists the domain of a false positive', async () => {
+      const alert = await seedAlert({ domain: 'cdn.example.com' })
+      const res = await AlertService.transition(
+        alert.id,
+        'false_positive',
+        'z000n00',
+        { allowList: true }
+      )
+      expect(res.alert.status).toBe('false_positive')
+      expect(res.allow_list.key).toBe('cdn.example.com')
+      expect(res.allow_list.type).toBe('fqdn')
+      // reopening and marking again reuses the entry
+      await AlertService.transition(alert.id, 'open', 'z000n00')
+      const again = await AlertService.transition(
+        alert.id,
+        'false_positive',
+        'z000n00',
+        { allowList: true }
+      )
+      expect(again.allow_list.id).toBe(res.allow_list.id)
+      expect(await AllowList.query().resultSize()).toBe(1)
+    })
+    it('requires a domain to allow-list', async () => {
+      const alert = await seedAlert()
+      await expect(
+        AlertService.transition(alert.id, 'false_positive', 'z000n00', {
+          allowList: true
+        })
+      ).rejects.toThrow('alert has no domain to allow-list')
+      const { alert: unchanged } = await AlertService.transition(
+        alert.id,
+        'acknowledged',
+        'z000n00'
+      )
+      expect(unchanged.status).toBe('acknowledged')
+    })
+  })
+  describe('fireBatch', () => {
+    const sink = (): AlertSinkBase & { send: jest.Mock } => ({
+      name: 'HTTP Alert Sink',
+      enabled: true,
+      send: jest.fn(async () => true),
+    })
+    it('dispatches every alert of a file', async () => {
+      const file = path.join(os.tmpdir(), `alerts-${Date.now()}.json`)
+      fs.writeFileSync(
+        file,
+        JSON.stringify([
+          { message: 'first' },
+          { message: 'second', name: 'load-test' },
+          { message: 'third', type: 'warning' },
+        ])
+      )
+      const goAlert = sink()
+      const results = await AlertService.fireBatch(readSpecs(file), {
+        concurrency: 2,
+        maxAttempts: 1,
+        registry: { goAlert },
+      })
+      fs.unlinkSync(file)
+      expect(results.map((r) => [r.index, r.delivered])).toEqual([
+        [0, true],
+        [1, true],
+        [2, true],
+      ])
+      expect(goAlert.send).toHaveBeenCalledTimes(3)
+      const messages = goAlert.send.mock.calls.map(([evt]) => evt.message)
+      expect(messages.sort()).toEqual(['first', 'second', 'third'])
+    })
+    it('prints the outcome as JSON', async () => {
+      const result = await AlertService.fire(
+        { message: 'json' },
+        { maxAttempts: 1, registry: { goAlert: sink() } }
+      )
+      const output = JSON.parse(formatResults([result], 'json'))
+      expect(output.results[0]).toMatchObject({
+        sink: 'goAlert',
+        status: 'delivered',
+      })
+      expect(output.results[0].error_category).toBeUndefined()
+      expect(output).toMatchObject({ delivered: 1, failed: 0 })
+    })
+    it('categorizes errors', () => {
+      expect(errorCategory('sink "teams" is not enabled')).toEqual('disabled')
+      expect(errorCategory('teams responded with 500 ()')).toEqual('http')
+      expect(
+        errorCategory('request to https://alerts failed, reason: ECONNREFUSED')
+      ).toEqual('network')
+      expect(errorCategory('network timeout at: https://alerts')).toEqual(
+        'timeout'
+      )
+    })
+    it('reports failed alerts', async () => {
+      const results = await AlertService.fireBatch(
+        [{ sink: 'teams' }, { message: 'ok' }],
+        { maxAttempts: 1, registry: { goAlert: sink() } }
+      )
+      expect(results[0]).toMatchObject({
+        sink: 'teams',
+        delivered: false,
+        error: 'sink "teams" is not enabled',
+      })
+      expect(results[1].delivered).toBe(true)
+    })
+  })
+  describe('dispatch', () => {
+    const night = new Date('2022-10-04T23:30:00Z')
+    const ruleAlert = (severity: string) => ({
+      entry: 'rule-alert' as const,
+      level: 'info' as const,
+      scan_id: '12345',
+      event: {
+        name: 'unknown.domain',
+        message: 'example.com unknown',
+        alert: true,
+        level: 'info',
+        context: {},
+      },
+      severity,
+    })
+    const sink = (name: string, quiet: boolean) => ({
+      name,
+      enabled: true,
+      send: jest.fn(async () => true),
+      ...(quiet
+        ? {
+            quietHours: {
+              start: '22:00',
+              end: '06:00',
+              days: [] as number[],
+              timeZone: 'UTC',
+              minSeverity: 'critical',
+            },
+          }
+        : {}),
+    })
+    it('records muted attempts for sinks in quiet hours', async () => {
+      const pager = sink('pager', true)
+      const chatops = sink('chatops', false)
+      const res = await AlertService.dispatch(
+        [pager, chatops],
+        ruleAlert('medium') as unknown as AlertQueueEvent,
+        night
+      )
+      expect(res).toEqual({ delivered: 1, muted: 1 })
+      expect(pager.send).not.toHaveBeenCalled()
+      expect(chatops.send).toHaveBeenCalledTimes(1)
+      const muted = await AlertDelivery.query().where({ sink: 'pager' })
+      expect(muted.map((d) => d.status)).toEqual(['muted'])
+    })
+    it('delivers critical alerts in quiet hours', async () => {
+      const pager = sink('pager', true)
+      const res = await AlertService.dispatch(
+        [pager],
+        ruleAlert('critical') as unknown as AlertQueueEvent,
+        night
+      )
+      expect(res).toEqual({ delivered: 1, muted: 0 })
+      expect(pager.send).toHaveBeenCalledTimes(1)
+    })
+    it('records muted attempts for every sink in dry-run', async () => {
+      const chatops = sink('chatops', false)
+      await SettingService.update('alerts.dryRun', true, 'admin')
+      try {
+        const res = await AlertService.dispatch(
+          [chatops],
+          ruleAlert('critical') as unknown as AlertQueueEvent,
+          night
+        )
+        expect(res).toEqual({ delivered: 0, muted: 1 })
+        expect(chatops.send).not.toHaveBeenCalled()
+        const [muted] = await AlertDelivery.query().where({ sink: 'chatops' })
+        expect(muted.response).toMatchObject({ reason: 'dry_run' })
+      } finally {
+        await SettingService.reset('alerts.dryRun', 'admin')
+      }
+    })
+    it('filters registered sinks by their saved rules', async () => {
+      const pager = sink('pager', false)
+      const registry = { goAlert: pager }
+      SettingService.invalidate()
+      try {
+        expect(await sinkRuleTypes(pager, registry)).toEqual([])
+        await SettingService.update(
+          'alerts.sinks.goAlert.ruleTypes',
+          ['ioc.domain'],
+          'admin'
+        )
+        expect(await sinkRuleTypes(pager, registry)).toEqual(['ioc.domain'])
+        // unregistered sinks keep their config
+        const chatops = { ...sink('chatops', false), ruleTypes: ['yara'] }
+        expect(await sinkRuleTypes(chatops, registry)).toEqual(['yara'])
+      } finally {
+        SettingService.invalidate()
+      }
+    })
+  })
+  describe('testDelivery', () => {
+    const httpSink = (status: number, body = ''): AlertSinkBase => ({
+      name: 'HTTP Alert Sink',
+      enabled: true,
+      secrets: () => ['super-secret-token', ''],
+      request: jest.fn(async () => ({ status, body })),
+      send: jest.fn(async () => true),
+    })
+    it('reports the response status without recording', async () => {
+      const goAlert = httpSink(204)
+      const res = await AlertService.testDelivery('goAlert', 'admin', {
+        goAlert,
+      })
+      expect(res).toMatchObject({
+        sink: 'goAlert',
+        delivered: true,
+        status: 204,
+      })
+      expect(goAlert.send).not.toHaveBeenCalled()
+      expect(await AlertDelivery.query().resultSize()).toBe(0)
+      expect(await Alert.query().resultSize()).toBe(0)
+    })
+    it('masks secrets of failures', async () => {
+      const goAlert = httpSink(401, 'bad token super-secret-token')
+      const res = await AlertService.testDelivery('goAlert', 'admin', {
+        goAlert,
+      })
+      expect(res.delivered).toBe(false)
+      expect(res.status).toBe(401)
+      expect(res.error).toEqual(`responded with 401 (bad token ${MASKED_VALUE})`)
+    })
+    it('rejects disabled sinks', async () => {
+      await expect(
+        AlertService.testDelivery('goAlert', 'admin', {
+          goAlert: { ...httpSink(200), enabled: false },
+        })
+      ).rejects.toThrow('sink "goAlert" is not enabled')
+    })
+  })
+  describe('statusCounts', () => {
+    it('counts alerts by status', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        site_id: site.id,
+        source_id: source.id
+      })
+        .$query()
+        .insert()
+      const alerts = await Promise.all(
+        [1, 2, 3].map(() =>
+          AlertFactory.build({ site_id: site.id, scan_id: scan.id })
+            .$query()
+            .insert()
+        )
+      )
+      await AlertService.transition(alerts[0].id, 'resolved', 'z000n00')
+      await AlertService.transition(alerts[1].id, 'acknowledged', 'z000n00')
+      expect(await AlertService.statusCounts()).toEqual({
+        open: 1,
+        acknowledged: 1,
+        resolved: 1,
+        false_positive: 0,
+        handled: 2
+      })
+    })
+  })
 })
@@ -0,0 +1,186 @@
+import AlertService from '../services/alert'
+import AlertDeliveryService from '../services/alert_delivery'
+import { AlertSinkBase } from '../alerts/base'
+import { AlertDelivery } from '../models'
+import { resetDB } from './utils'
+import { MASKED_VALUE } from '../lib/headers'
+
+// recorded deliveries store the sink name
+const GO_ALERT = 'HTTP Alert Sink'
+const KAFKA = 'Kafka Alert Sink'
+
+const deadLetter = (sink: string, created_at = new Date()) =>
+  AlertDelivery.query()
+    .insert({
+      sink,
+      attempt: 3,
+      status: 'dead_lettered',
+      request: {
+        type: 'info',
+        name: 'rule-alert',
+        scan_id: '12345',
+        message: 'unknown.domain - example.com unknown',
+        headers: { 'X-MMK-Signature': '**********' },
+      },
+      response: { error: `${sink} down` },
+    })
+    .then((d) => d.$query().patchAndFetch({ created_at }))
+
+describe('AlertDelivery Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+  })
+  describe('record', () => {
+    it('stores captured headers masked', async () => {
+      const delivery = await AlertDeliveryService.record({
+        sink: GO_ALERT,
+        attempt: 1,
+        status: 'failed',
+        request: {
+          name: 'rule-alert',
+          headers: {
+            Authorization: 'Bearer secret-token',
+            'Content-Type': 'application/json',
+          },
+        },
+      })
+      const stored = await AlertDelivery.query().findById(delivery.id)
+      expect(stored.request.headers).toEqual({
+        Authorization: MASKED_VALUE,
+        'Content-Type': 'application/json',
+      })
+    })
+  })
+  describe('listDeadLettered', () => {
+    it('lists dead-lettered attempts, newest first', async () => {
+      const older = await deadLetter(GO_ALERT, new Date(Date.now() - 60000))
+      const newer = await deadLetter(KAFKA)
+      await AlertDelivery.query().insert({
+        sink: GO_ALERT,
+        attempt: 1,
+        status: 'failed',
+      })
+      const actual = await AlertDeliveryService.listDeadLettered()
+      expect(actual.map((d) => d.id)).toEqual([newer.id, older.id])
+    })
+    it('filters by sink', async () => {
+      const goAlert = await deadLetter(GO_ALERT)
+      await deadLetter(KAFKA)
+      const actual = await AlertDeliveryService.listDeadLettered({
+        sink: GO_ALERT,
+      })
+      expect(actual.map((d) => d.id)).toEqual([goAlert.id])
+    })
+  })
+  describe('markForReplay', () => {
+    it('records the actor, leaving the attempt as is', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      const actual = await AlertDeliveryService.markForReplay(
+        delivery.id,
+        'z000n00'
+      )
+      expect(actual.replayed_by).toBe('z000n00')
+      expect(actual.replayed_at).toBeTruthy()
+      expect(actual.status).toBe('dead_lettered')
+      expect(actual.attempt).toBe(3)
+      expect(actual.response).toEqual(delivery.response)
+      expect(actual.created_at).toEqual(delivery.created_at)
+    })
+    it('only marks dead-lettered attempts', async () => {
+      const delivery = await AlertDelivery.query().insert({
+        sink: GO_ALERT,
+        attempt: 1,
+        status: 'failed',
+      })
+      await expect(
+        AlertDeliveryService.markForReplay(delivery.id, 'z000n00')
+      ).rejects.toThrow('only dead-lettered attempts can be replayed')
+    })
+    it('replays an attempt once', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      await AlertDeliveryService.markForReplay(delivery.id, 'z000n00')
+      await expect(
+        AlertDeliveryService.markForReplay(delivery.id, 'z000n00')
+      ).rejects.toThrow('already replayed by z000n00')
+    })
+    it('is no longer listed as dead-lettered', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      await AlertDeliveryService.markForReplay(delivery.id, 'z000n00')
+      expect(await AlertDeliveryService.listDeadLettered()).toEqual([])
+    })
+  })
+  describe('replay', () => {
+    const fakeSink = (ok: boolean): AlertSinkBase & { send: jest.Mock } => ({
+      name: GO_ALERT,
+      enabled: true,
+      send: jest.fn(async () => {
+        if (!ok) throw new Error('go-alert down')
+        return true
+      }),
+    })
+    it('redelivers the recorded event without its headers', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      const sink = fakeSink(true)
+      const res = await AlertService.replay(delivery.id, 'z000n00', {
+        goAlert: sink,
+      })
+      expect(res).toEqual({
+        delivery_id: delivery.id,
+        sink: GO_ALERT,
+        delivered: true,
+      })
+      expect(sink.send).toHaveBeenCalledWith({
+        type: 'info',
+        name: 'rule-alert',
+        scan_id: '12345',
+        message: 'unknown.domain - example.com unknown',
+      })
+      const replayed = await AlertDelivery.query().findById(delivery.id)
+      expect(replayed.status).toBe('dead_lettered')
+      expect(replayed.attempt).toBe(3)
+      expect(replayed.replayed_by).toBe('z000n00')
+      const attempts = await AlertDelivery.query().where('status', 'succeeded')
+      expect(attempts).toHaveLength(1)
+      expect(attempts[0].attempt).toBe(1)
+      expect(attempts[0].redelivery_of).toBe(delivery.id)
+    })
+    it('reports a disabled sink', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      const res = await AlertService.replay(delivery.id, 'z000n00', {
+        goAlert: { ...fakeSink(true), enabled: false },
+      })
+      expect(res.delivered).toBe(false)
+      expect(res.error).toBe(`sink "${GO_ALERT}" is not enabled`)
+    })
+    it('links new attempts to the replayed one', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      await AlertService.replay(delivery.id, 'z000n00', {
+        goAlert: fakeSink(true),
+      })
+      const [attempt] = await AlertDelivery.query().where(
+        'redelivery_of',
+        delivery.id
+      )
+      expect(attempt.status).toBe('succeeded')
+    })
+  })
+  describe('redeliver', () => {
+    it('resends a failed attempt, leaving it untouched', async () => {
+      const delivery = await deadLetter(GO_ALERT)
+      const send = jest.fn(async () => true)
+      const res = await AlertService.redeliver(
+        { delivery_id: delivery.id, actor: 'z000n00' },
+        { goAlert: { name: GO_ALERT, enabled: true, send } }
+      )
+      expect(res.delivered).toBe(true)
+      expect(send).toHaveBeenCalledTimes(1)
+      const original = await AlertDelivery.query().findById(delivery.id)
+      expect(original.status).toBe('dead_lettered')
+      const [attempt] = await AlertDelivery.query().where(
+        'redelivery_of',
+        delivery.id
+      )
+      expect(attempt.attempt).toBe(1)
+    })
+  })
+})
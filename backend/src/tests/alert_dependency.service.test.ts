@@ -0,0 +1,112 @@
+import Queue from 'bull'
+import { createClient } from '../repos/redis'
+import { AlertQueueEvent } from '../alerts/base'
+import AlertDependencyService, {
+  DependencyFailedError,
+  dependencyState,
+} from '../services/alert_dependency'
+
+const scanLogQueue = new Queue('test-dependency-scan-log-queue', {
+  createClient,
+})
+const alertQueue = new Queue<AlertQueueEvent>('test-dependency-alert-queue', {
+  createClient,
+})
+
+const alertEvent = (depends_on: string): AlertQueueEvent => ({
+  level: 'info',
+  entry: 'rule-alert',
+  scan_id: '12345',
+  event: { message: 'unknown.domain - example.com unknown' },
+  depends_on,
+})
+
+// scan log job failed by its worker
+const failedJob = async () => {
+  const job = await scanLogQueue.add({ entry: 'rule-alert' })
+  await job.moveToFailed({ message: 'insert failed' }, true)
+  return job
+}
+
+describe('AlertDependency Service', () => {
+  beforeEach(async () => {
+    await scanLogQueue.empty()
+    await alertQueue.empty()
+    await scanLogQueue.clean(0, 'failed')
+    await alertQueue.clean(0, 'delayed')
+  })
+  afterAll(async () => {
+    await Promise.all([scanLogQueue.close(), alertQueue.close()])
+  })
+  describe('dependencyState', () => {
+    it('counts removed jobs as completed', async () => {
+      expect(await dependencyState('missing', scanLogQueue)).toBe('completed')
+    })
+    it('reports waiting and failed jobs', async () => {
+      const waiting = await scanLogQueue.add({ entry: 'rule-alert' })
+      const failed = await failedJob()
+      expect(await dependencyState(waiting.id, scanLogQueue)).toBe('pending')
+      expect(await dependencyState(failed.id, scanLogQueue)).toBe('failed')
+    })
+  })
+  describe('ready', () => {
+    it('delivers jobs without a pending dependency', async () => {
+      const job = await alertQueue.add(alertEvent('missing'))
+      expect(await AlertDependencyService.ready(job, scanLogQueue)).toBe(true)
+    })
+    it('holds the job again while the dependency is pending', async () => {
+      const parent = await scanLogQueue.add({ entry: 'rule-alert' })
+      const job = await alertQueue.add(alertEvent(String(parent.id)))
+      expect(await AlertDependencyService.ready(job, scanLogQueue)).toBe(false)
+      const held = await alertQueue.getDelayed()
+      expect(held.map((j) => j.data.depends_on)).toEqual([String(parent.id)])
+    })
+    it('fails the job once the dependency failed', async () => {
+      const parent = await failedJob()
+      const job = await alertQueue.add(alertEvent(String(parent.id)))
+      await expect(
+        AlertDependencyService.ready(job, scanLogQueue)
+      ).rejects.toThrow(DependencyFailedError)
+    })
+  })
+  describe('releaseHeld', () => {
+    it('promotes held jobs of finished dependencies only', async () => {
+      const pending = await scanLogQueue.add({ entry: 'rule-alert' })
+      const failed = await failedJob()
+      const held = await alertQueue.add(alertEvent(String(pending.id)), {
+        delay: 60000,
+      })
+      const released = await alertQueue.add(alertEvent('missing'), {
+        delay: 60000,
+      })
+      const orphan = await alertQueue.add(alertEvent(String(failed.id)), {
+        delay: 60000,
+      })
+      const result = await AlertDependencyService.releaseHeld(
+        alertQueue,
+        scanLogQueue
+      )
+      expect(result).toEqual({ released: 1, failed: 1, held: 1 })
+      expect(await held.getState()).toBe('delayed')
+      expect(await released.getState()).toBe('waiting')
+      expect(await orphan.getState()).toBe('waiting')
+      expect(await AlertDependencyService.countHeld(alertQueue)).toBe(1)
+    })
+  })
+  describe('listHeld', () => {
+    it('lists held jobs with their dependency', async () => {
+      const parent = await scanLogQueue.add({ entry: 'rule-alert' })
+      const held = await alertQueue.add(alertEvent(String(parent.id)), {
+        delay: 60000,
+      })
+      await alertQueue.add(alertEvent('missing'))
+      expect(await AlertDependencyService.listHeld(alertQueue)).toEqual([
+        {
+          job_id: String(held.id),
+          scan_id: '12345',
+          depends_on: String(parent.id),
+        },
+      ])
+    })
+  })
+})
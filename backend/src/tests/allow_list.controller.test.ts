@@ -98,6 +98,34 @@ describe('AllowList Controller', () => {
       expect(res.body.total).toBe(1)
       expect(res.body.results[0].key).toBe('.*.google.com')
     })
+    it('should not match expired entries', async () => {
+      await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'vendor.test',
+        expires_at: new Date(Date.now() - 1000),
+      })
+      const res = await request(userSession().app)
+        .get('/api/allow_list')
+        .query({ type: 'fqdn', key: 'vendor.test' })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(0)
+    })
+    it('should list expired entries with their expiry', async () => {
+      const expiresAt = new Date(Date.now() - 1000)
+      await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'vendor.test',
+        expires_at: expiresAt,
+      })
+      const res = await request(userSession().app)
+        .get('/api/allow_list')
+        .query({ type: 'fqdn' })
+      expect(res.status).toBe(200)
+      const entry = res.body.results.find(
+        (r: AllowList) => r.key === 'vendor.test'
+      )
+      expect(new Date(entry.expires_at)).toEqual(expiresAt)
+    })
   })
   describe('GET /api/allow_list/:id', () => {
     it('should return an AllowList by id', async () => {
@@ -135,6 +163,34 @@ describe('AllowList Controller', () => {
       expect(res.status).toBe(200)
       expect(res.body.key).toBe('example.com')
     })
+    it('should accept an optional expiry', async () => {
+      const expiresAt = new Date(Date.now() + 30 * 24 * 60 * 60 * 1000)
+      const res = await request(adminSession().app)
+        .post('/api/allow_list')
+        .send({
+          allow_list: {
+            key: 'vendor.test',
+            type: 'fqdn',
+            expires_at: expiresAt.toISOString(),
+          },
+        })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(200)
+      expect(new Date(res.body.expires_at)).toEqual(expiresAt)
+    })
+    it('should reject an expiry in the past', async () => {
+      const res = await request(adminSession().app)
+        .post('/api/allow_list')
+        .send({
+          allow_list: {
+            key: 'vendor.test',
+            type: 'fqdn',
+            expires_at: new Date(Date.now() - 1000).toISOString(),
+          },
+        })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
     it('should prevent invalid regular expression keys', async () => {
       const res = await request(adminSession().app)
         .post('/api/allow_list')
@@ -236,4 +292,58 @@ describe('AllowList Controller', () => {
       expect(res.status).toBe(422)
     })
   })
+  describe('POST /api/allow_list/_cache/_batch', () => {
+    const batch = (keys: string[]) =>
+      request(transportSession().app)
+        .post('/api/allow_list/_cache/_batch')
+        .send({ allow_list: { type: 'fqdn', keys } })
+        .set('Accept', 'application/json')
+    it('should match every value in one call', async () => {
+      const expires = new Date(Date.now() + 60 * 60 * 1000)
+      await AllowListFactory.build({ type: 'fqdn', key: 'allowed.test' })
+        .$query()
+        .insert()
+      await AllowListFactory.build({
+        type: 'fqdn',
+        key: 'cdn.allowed.test',
+        expires_at: expires,
+      })
+        .$query()
+        .insert()
+      await AllowListFactory.build({
+        type: 'fqdn',
+        key: 'expired.test',
+        expires_at: new Date(Date.now() - 1000),
+      })
+        .$query()
+        .insert()
+      const res = await batch([
+        'allowed.test',
+        'cdn.allowed.test',
+        'expired.test',
+        'unknown.test',
+      ])
+      expect(res.status).toBe(200)
+      expect(res.body.results).toEqual({
+        'allowed.test': { total: 1, expires_at: null },
+        'cdn.allowed.test': { total: 2, expires_at: expires.toISOString() },
+      })
+      const validate = ajv.compile(
+        api['/api/allow_list/_cache/_batch'].post.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should reject an empty batch', async () => {
+      const res = await batch([])
+      expect(res.status).toBe(422)
+    })
+    it('should be restricted to transport', async () => {
+      const res = await request(userSession().app)
+        .post('/api/allow_list/_cache/_batch')
+        .send({ allow_list: { type: 'fqdn', keys: ['allowed.test'] } })
+      expect(res.status).toBe(403)
+    })
+  })
 })
@@ -0,0 +1,63 @@
+import { addDays, subDays } from 'date-fns'
+import { AllowList, knex } from '../models'
+import AllowListFactory from './factories/allow_list.factory'
+import AllowListService from '../services/allow_list'
+import { resetDB } from './utils'
+
+describe('AllowList Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  describe('create', () => {
+    it('rejects an expiry in the past', async () => {
+      await expect(
+        AllowListService.create({
+          type: 'fqdn',
+          key: 'vendor.test',
+          expires_at: subDays(new Date(), 1),
+        })
+      ).rejects.toThrow('expires_at must be in the future')
+    })
+  })
+  describe('findActive', () => {
+    it('skips expired entries', async () => {
+      await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'vendor.test',
+        expires_at: subDays(new Date(), 1),
+      })
+      expect(
+        await AllowListService.findActive({ type: 'fqdn', key: 'vendor.test' })
+      ).toBeUndefined()
+    })
+  })
+  describe('purgeExpired', () => {
+    it('deletes entries expired before the retention period', async () => {
+      const old = await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'old.test',
+        expires_at: subDays(new Date(), 31),
+      })
+      const recent = await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'recent.test',
+        expires_at: subDays(new Date(), 1),
+      })
+      const active = await AllowList.query().insert({
+        type: 'fqdn',
+        key: 'active.test',
+        expires_at: addDays(new Date(), 30),
+      })
+      const permanent = await AllowListFactory.build().$query().insert()
+      expect(await AllowListService.purgeExpired(30)).toBe(1)
+      expect(await AllowList.query().findById(old.id)).toBeUndefined()
+      const kept = await AllowList.query()
+        .whereIn('id', [recent.id, active.id, permanent.id])
+        .resultSize()
+      expect(kept).toBe(3)
+    })
+  })
+})
@@ -0,0 +1,37 @@
+// ./lib/attempts.ts test
+import { describeAttempt } from '../lib/attempts'
+
+describe('Attempts', () => {
+  describe('describeAttempt', () => {
+    it('describes a single attempt', () => {
+      expect(describeAttempt(1, 1)).toEqual({
+        attempt: 1,
+        maxAttempts: 1,
+        retriesAllowed: 0,
+        label: 'attempt 1 of 1 (no retries)',
+      })
+    })
+    it('describes attempts with retries', () => {
+      expect(describeAttempt(1, 3).label).toBe('attempt 1 of 3')
+      expect(describeAttempt(3, 3)).toEqual({
+        attempt: 3,
+        maxAttempts: 3,
+        retriesAllowed: 2,
+        label: 'attempt 3 of 3',
+      })
+    })
+    it('treats 0 attempts as a single run', () => {
+      expect(describeAttempt(1, 0)).toEqual({
+        attempt: 1,
+        maxAttempts: 1,
+        retriesAllowed: 0,
+        label: 'attempt 1 of 1 (no retries)',
+      })
+    })
+    it('clamps the attempt counter', () => {
+      expect(describeAttempt(0, 3).label).toBe('attempt 1 of 3')
+      expect(describeAttempt(5, 3).label).toBe('attempt 3 of 3')
+      expect(describeAttempt(2).label).toBe('attempt 1 of 1 (no retries)')
+    })
+  })
+})
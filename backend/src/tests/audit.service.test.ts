@@ -0,0 +1,110 @@
+import { AuditLog } from '../models'
+import AuditService, {
+  auditDiff,
+  REDACTED_VALUE,
+  SYSTEM_ACTOR,
+} from '../services/audit'
+import AllowListService from '../services/allow_list'
+import SecretService from '../services/secret'
+import IocService from '../services/ioc'
+import SecretFactory from './factories/secrets.factory'
+import { resetDB } from './utils'
+
+describe('Audit Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+  })
+  describe('auditDiff', () => {
+    it('keeps changed fields only', () => {
+      expect(
+        auditDiff(
+          { key: 'a.test', type: 'fqdn', updated_at: new Date(0) },
+          { key: 'b.test', type: 'fqdn', updated_at: new Date() }
+        )
+      ).toEqual({ key: { from: 'a.test', to: 'b.test' } })
+    })
+    it('records created and deleted fields', () => {
+      expect(auditDiff(null, { key: 'a.test' })).toEqual({
+        key: { to: 'a.test' },
+      })
+      expect(auditDiff({ key: 'a.test' }, null)).toEqual({
+        key: { from: 'a.test' },
+      })
+    })
+    it('redacts fields', () => {
+      expect(auditDiff({ value: 'moo' }, { value: 'car' }, ['value'])).toEqual(
+        { value: { from: REDACTED_VALUE, to: REDACTED_VALUE } }
+      )
+    })
+  })
+  describe('record', () => {
+    it('never fails the audited action', async () => {
+      const entry = await AuditService.record('x'.repeat(300), {
+        action: 'create',
+        entity_type: 'site',
+      })
+      expect(entry).toBeNull()
+      expect(await AuditLog.query().resultSize()).toBe(0)
+    })
+    it('defaults to the system actor', async () => {
+      const entry = await AuditService.record(undefined, {
+        action: 'delete',
+        entity_type: 'ioc',
+        entity_id: 'abc',
+      })
+      expect(entry?.actor).toBe(SYSTEM_ACTOR)
+    })
+  })
+  describe('audited services', () => {
+    it('records allow list changes with their actor', async () => {
+      const created = await AllowListService.create(
+        { type: 'fqdn', key: 'a.test' },
+        'z000n00'
+      )
+      await AllowListService.update(created.id, { key: 'b.test' }, 'z000n00')
+      await AllowListService.destroy(created.id, 'z000n01')
+      const entries = await AuditService.list({ entity_id: created.id })
+      expect(
+        entries.map(({ actor, action }) => ({ actor, action }))
+      ).toEqual([
+        { actor: 'z000n00', action: 'create' },
+        { actor: 'z000n00', action: 'update' },
+        { actor: 'z000n01', action: 'delete' },
+      ])
+      expect(entries[1].changes).toEqual({
+        key: { from: 'a.test', to: 'b.test' },
+      })
+    })
+    it('records bulk IOC additions as one entry', async () => {
+      await IocService.bulkCreate(
+        { values: ['a.test', 'b.test'], type: 'fqdn', enabled: true },
+        'z000n00'
+      )
+      const [entry] = await AuditService.list({ entity_type: 'ioc' })
+      expect(entry.entity_id).toBeNull()
+      expect(entry.changes.values.to).toEqual(['a.test', 'b.test'])
+    })
+    it('never records secret values', async () => {
+      const secret = await SecretFactory.build({ value: 'moo' })
+        .$query()
+        .insert()
+      await SecretService.update(
+        secret.id,
+        { type: 'manual', value: 'moocar' },
+        'z000n00'
+      )
+      const [entry] = await AuditService.list({ entity_type: 'secret' })
+      expect(entry.changes).toEqual({
+        value: { from: REDACTED_VALUE, to: REDACTED_VALUE },
+      })
+    })
+    it('filters by actor and date', async () => {
+      await AllowListService.create({ type: 'fqdn', key: 'a.test' }, 'a')
+      await AllowListService.create({ type: 'fqdn', key: 'b.test' }, 'b')
+      expect(await AuditService.list({ actor: 'b' })).toHaveLength(1)
+      expect(
+        await AuditService.list({ since: new Date(Date.now() + 60000) })
+      ).toHaveLength(0)
+    })
+  })
+})
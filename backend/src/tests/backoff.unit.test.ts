@@ -0,0 +1,46 @@
+// ./lib/backoff.ts test
+import { backoffDelay, resolveBackoff } from '../lib/backoff'
+
+describe('Backoff', () => {
+  const policy = {
+    baseDelayMs: 1000,
+    multiplier: 3,
+    maxDelayMs: 45000,
+    jitter: 0,
+  }
+  describe('backoffDelay', () => {
+    it('grows the delay per attempt', () => {
+      expect([1, 2, 3, 4].map((a) => backoffDelay(policy, a))).toEqual([
+        1000,
+        3000,
+        9000,
+        27000,
+      ])
+    })
+    it('caps the delay at maxDelayMs', () => {
+      expect(backoffDelay(policy, 5)).toBe(45000)
+      expect(backoffDelay(policy, 50)).toBe(45000)
+    })
+    it('keeps a fixed delay with a multiplier of 1', () => {
+      expect(backoffDelay({ ...policy, multiplier: 1 }, 4)).toBe(1000)
+    })
+    it('takes up to the jitter fraction off the delay', () => {
+      const jittered = { ...policy, jitter: 0.5 }
+      expect(backoffDelay(jittered, 2, () => 0)).toBe(3000)
+      expect(backoffDelay(jittered, 2, () => 1)).toBe(1500)
+      expect(backoffDelay(jittered, 2, () => 0.5)).toBe(2250)
+    })
+  })
+  describe('resolveBackoff', () => {
+    it('applies overrides in order', () => {
+      expect(
+        resolveBackoff(policy, { multiplier: 2 }, undefined, {
+          baseDelayMs: 0,
+        })
+      ).toEqual({ ...policy, multiplier: 2, baseDelayMs: 0 })
+    })
+    it('ignores unset fields', () => {
+      expect(resolveBackoff(policy, { jitter: undefined })).toEqual(policy)
+    })
+  })
+})
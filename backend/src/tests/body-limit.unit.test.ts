@@ -0,0 +1,58 @@
+// ./api/middleware/body-limit.ts test
+import express from 'express'
+import request from 'supertest'
+import jsonBodyLimit from '../api/middleware/body-limit'
+import ErrorMiddlewareHandler from '../api/middleware/error-handler'
+
+const makeApp = (maxBytes: number, handler: jest.Mock) => {
+  const app = express()
+  app.use(jsonBodyLimit(maxBytes))
+  app.post('/api/ingest', (req, res) => {
+    handler(req.body)
+    res.status(200).send({ ok: true })
+  })
+  app.use(
+    (
+      err: Error,
+      req: express.Request,
+      res: express.Response,
+      next: express.NextFunction
+    ) => {
+      if (!ErrorMiddlewareHandler(err, req, res)) next(err)
+    }
+  )
+  return app
+}
+
+describe('JSON body limit', () => {
+  it('accepts bodies within the limit', async () => {
+    const handler = jest.fn()
+    const res = await request(makeApp(1024, handler))
+      .post('/api/ingest')
+      .send({ data: 'a'.repeat(100) })
+    expect(res.status).toBe(200)
+    expect(handler).toHaveBeenCalledTimes(1)
+  })
+  it('rejects oversized bodies with a 413', async () => {
+    const handler = jest.fn()
+    const res = await request(makeApp(1024, handler))
+      .post('/api/ingest')
+      .send({ data: 'a'.repeat(4096) })
+    expect(res.status).toBe(413)
+    expect(res.body.type).toBe('PayloadTooLarge')
+    expect(res.body.message).toBe(
+      'Request body exceeds the limit of 1024 bytes'
+    )
+    expect(handler).not.toHaveBeenCalled()
+  })
+  it('stops reading chunked bodies past the limit', async () => {
+    const handler = jest.fn()
+    const req = request(makeApp(1024, handler))
+      .post('/api/ingest')
+      .set('Content-Type', 'application/json')
+      .set('Transfer-Encoding', 'chunked')
+    const res = await req.send(`{"data":"${'a'.repeat(8192)}"}`)
+    expect(res.status).toBe(413)
+    expect(handler).not.toHaveBeenCalled()
+  })
+})
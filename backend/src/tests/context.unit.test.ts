@@ -0,0 +1,28 @@
+import { truncateContext, truncationMarker } from '../lib/context'
+
+describe('truncateContext', () => {
+  it('cuts long strings with a marker', () => {
+    const url = `https://example.com/?q=${'a'.repeat(100)}`
+    const actual = truncateContext({ url, domain: 'example.com' }, 20)
+    expect(actual).toEqual({
+      url: `${url.slice(0, 20)}${truncationMarker(url.length - 20)}`,
+      domain: 'example.com',
+    })
+  })
+  it('walks nested objects and arrays', () => {
+    const actual = truncateContext(
+      { request: { referrer: 'x'.repeat(10) }, urls: ['y'.repeat(10)], n: 3 },
+      5
+    )
+    expect(actual).toEqual({
+      request: { referrer: `xxxxx${truncationMarker(5)}` },
+      urls: [`yyyyy${truncationMarker(5)}`],
+      n: 3,
+    })
+  })
+  it('is disabled by a zero limit', () => {
+    const context = { url: 'z'.repeat(10) }
+    expect(truncateContext(context, 0)).toBe(context)
+    expect(truncateContext(undefined, 5)).toBeUndefined()
+  })
+})
@@ -0,0 +1,81 @@
+// ./api/middleware/cors.ts test
+import express from 'express'
+import request from 'supertest'
+import corsMiddleware, { CorsPolicy } from '../api/middleware/cors'
+
+const policy: CorsPolicy = {
+  origins: ['https://tools.example.com'],
+  methods: ['GET', 'POST'],
+  headers: ['Content-Type', 'Authorization'],
+  credentials: true,
+  maxAgeSeconds: 60,
+}
+
+const makeApp = (p: CorsPolicy) => {
+  const app = express()
+  app.use('/api', corsMiddleware(p))
+  app.get('/api/things', (_req, res) => res.json({ ok: true }))
+  app.get('/sites', (_req, res) => res.send('<html></html>'))
+  return app
+}
+
+describe('CORS middleware', () => {
+  const app = makeApp(policy)
+  it('sets CORS headers for an allowed origin', async () => {
+    const res = await request(app)
+      .get('/api/things')
+      .set('Origin', 'https://tools.example.com')
+    expect(res.status).toBe(200)
+    expect(res.header['access-control-allow-origin']).toBe(
+      'https://tools.example.com'
+    )
+    expect(res.header['access-control-allow-credentials']).toBe('true')
+    expect(res.header['vary']).toContain('Origin')
+  })
+  it('does not set CORS headers for a disallowed origin', async () => {
+    const res = await request(app)
+      .get('/api/things')
+      .set('Origin', 'https://evil.example.com')
+    expect(res.status).toBe(200)
+    expect(res.header['access-control-allow-origin']).toBeUndefined()
+    expect(res.header['vary']).toContain('Origin')
+  })
+  it('allows any origin without credentials', async () => {
+    const res = await request(
+      makeApp({ ...policy, origins: ['*'], credentials: false })
+    )
+      .get('/api/things')
+      .set('Origin', 'https://evil.example.com')
+    expect(res.header['access-control-allow-origin']).toBe('*')
+    expect(res.header['access-control-allow-credentials']).toBeUndefined()
+  })
+  it('rejects any origin with credentials', () => {
+    expect(() => corsMiddleware({ ...policy, origins: ['*'] })).toThrow(
+      'cannot be combined with credentials'
+    )
+  })
+  it('answers preflight requests for an allowed origin', async () => {
+    const res = await request(app)
+      .options('/api/things')
+      .set('Origin', 'https://tools.example.com')
+      .set('Access-Control-Request-Method', 'POST')
+    expect(res.status).toBe(204)
+    expect(res.header['access-control-allow-methods']).toBe('GET, POST')
+    expect(res.header['access-control-allow-headers']).toBe(
+      'Content-Type, Authorization'
+    )
+    expect(res.header['access-control-max-age']).toBe('60')
+  })
+  it('does not apply to non API routes', async () => {
+    const res = await request(app)
+      .get('/sites')
+      .set('Origin', 'https://tools.example.com')
+    expect(res.header['access-control-allow-origin']).toBeUndefined()
+  })
+  it('allows no cross-origin requests by default', async () => {
+    const res = await request(makeApp({ ...policy, origins: [] }))
+      .get('/api/things')
+      .set('Origin', 'https://tools.example.com')
+    expect(res.header['access-control-allow-origin']).toBeUndefined()
+  })
+})
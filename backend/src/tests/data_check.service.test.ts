@@ -0,0 +1,101 @@
+import { v4 as uuidv4 } from 'uuid'
+import { AllowList, Ioc, knex } from '../models'
+import DataCheckService from '../services/data_check'
+import { VERSION_KEY } from '../services/ioc'
+import { redisClient } from '../repos/redis'
+import { resetDB } from './utils'
+
+// inserts rows as-is, model hooks would normalize them
+const seedIoc = async (
+  type: string,
+  value: string,
+  created_at = new Date()
+) => {
+  const id = uuidv4()
+  await knex('iocs').insert({ id, type, value, enabled: true, created_at })
+  return id
+}
+
+const seedAllowList = async (
+  type: string,
+  key: string,
+  created_at = new Date()
+) => {
+  const id = uuidv4()
+  await knex('allow_list').insert({ id, type, key, created_at })
+  return id
+}
+
+describe('Data Check Service', () => {
+  let ids: Record<string, string>
+  beforeEach(async () => {
+    await resetDB()
+    const older = new Date(Date.now() - 60000)
+    ids = {
+      validIoc: await seedIoc('fqdn', 'evil\\.test'),
+      badRegex: await seedIoc('literal', '(unclosed'),
+      badHash: await seedIoc('sha256', 'not-a-hash'),
+      upperHash: await seedIoc('sha256', 'A'.repeat(64), older),
+      lowerHash: await seedIoc('sha256', 'a'.repeat(64)),
+      paddedIp: await seedIoc('ip', ' 203.0.113.7 '),
+      badDomain: await seedIoc('fqdn', `${'x'.repeat(70)}.test`),
+      validKey: await seedAllowList('fqdn', 'cdn.example.test'),
+      upperKey: await seedAllowList('fqdn', 'CDN.Example.Test', older),
+      trailingKey: await seedAllowList('fqdn', 'static.example.test.'),
+      badPattern: await seedAllowList('literal', '[a-'),
+    }
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  describe('check', () => {
+    it('reports invalid, duplicate and non-normalized entries', async () => {
+      const issues = await DataCheckService.check()
+      const byID = issues.reduce((acc, i) => {
+        acc[i.id] = i.problem
+        return acc
+      }, {} as Record<string, string>)
+      expect(byID).toEqual({
+        [ids.badRegex]: 'invalid',
+        [ids.badHash]: 'invalid',
+        [ids.badDomain]: 'invalid',
+        // the normalized entry is kept even though it is newer
+        [ids.upperHash]: 'duplicate',
+        [ids.paddedIp]: 'not_normalized',
+        [ids.upperKey]: 'duplicate',
+        [ids.trailingKey]: 'not_normalized',
+        [ids.badPattern]: 'invalid',
+      })
+      const padded = issues.find((i) => i.id === ids.paddedIp)
+      expect(padded.fixed).toBe('203.0.113.7')
+    })
+    it('reports nothing for clean data', async () => {
+      await knex('iocs').del()
+      await knex('allow_list').del()
+      await seedIoc('fqdn', 'evil\\.test')
+      await seedAllowList('fqdn', 'cdn.example.test')
+      expect(await DataCheckService.check()).toEqual([])
+    })
+  })
+  describe('fix', () => {
+    it('removes invalid and duplicate entries and normalizes the rest', async () => {
+      const before = parseInt((await redisClient.get(VERSION_KEY)) || '0', 10)
+      const res = await DataCheckService.fix(await DataCheckService.check())
+      expect(res).toEqual({ deleted: 6, updated: 2 })
+      const iocs = await Ioc.query().orderBy('value')
+      expect(iocs.map((i) => i.value)).toEqual([
+        '203.0.113.7',
+        'a'.repeat(64),
+        'evil\\.test',
+      ])
+      const keys = await AllowList.query().orderBy('key')
+      expect(keys.map((k) => k.key)).toEqual([
+        'cdn.example.test',
+        'static.example.test',
+      ])
+      expect(await DataCheckService.check()).toEqual([])
+      const after = parseInt(await redisClient.get(VERSION_KEY), 10)
+      expect(after).toBe(before + 1)
+    })
+  })
+})
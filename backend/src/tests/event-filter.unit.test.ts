@@ -0,0 +1,54 @@
+import { parse, EventFilterError } from '../lib/event-filter'
+
+const parseError = (expr: string): Error => {
+  try {
+    parse(expr)
+  } catch (e) {
+    return e
+  }
+  return undefined
+}
+
+describe('Event Filter', () => {
+  describe('parse', () => {
+    it('parses multiple clauses', () => {
+      expect(parse('request.url~"/gateway/",response.status>=500')).toEqual([
+        { path: ['request', 'url'], op: '~', value: '/gateway/' },
+        { path: ['response', 'status'], op: '>=', value: 500 },
+      ])
+    })
+    it('keeps commas and escaped quotes inside strings', () => {
+      expect(parse('message="a, \\"b\\""')).toEqual([
+        { path: ['message'], op: '=', value: 'a, "b"' },
+      ])
+    })
+    it('parses booleans and inequality', () => {
+      expect(parse('alert!=true')).toEqual([
+        { path: ['alert'], op: '!=', value: true },
+      ])
+    })
+    it('rejects invalid path keys', () => {
+      const err = parseError("url'); drop table scans;--=\"a\"")
+      expect(err).toBeInstanceOf(EventFilterError)
+    })
+    it('rejects paths deeper than the max depth', () => {
+      expect(parseError('a.b.c.d.e.f="x"')).toBeInstanceOf(EventFilterError)
+    })
+    it('rejects unquoted string values', () => {
+      expect(parseError('request.url~gateway')).toBeInstanceOf(
+        EventFilterError
+      )
+    })
+    it('rejects non-numeric values for numeric operators', () => {
+      expect(parseError('response.status>"500"')).toBeInstanceOf(
+        EventFilterError
+      )
+    })
+    it('rejects unterminated strings', () => {
+      expect(parseError('url~"abc')).toBeInstanceOf(EventFilterError)
+    })
+    it('rejects missing operators', () => {
+      expect(parseError('url')).toBeInstanceOf(EventFilterError)
+    })
+  })
+})
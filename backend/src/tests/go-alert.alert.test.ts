@@ -1,6 +1,34 @@
-import { queryFromAlert } from '../alerts/go-alert'
+import {
+  bodyTemplate,
+  queryFromAlert,
+  requestBody,
+  requestHeaders,
+} from '../alerts/go-alert'
+import { compileTemplate } from '../lib/template'
+import { signPayload } from '../lib/signature'
 
 describe('Go Alert', function () {
+  const goAlertConfig = {
+    enabled: true,
+    url: 'https://alerts.example.com',
+    token: 'example-token',
+    fallback: '',
+    ruleTypes: [] as string[],
+    quietHours: {
+      start: '',
+      end: '',
+      days: [] as number[],
+      timeZone: 'UTC',
+      minSeverity: 'critical',
+    },
+    signing: {
+      secret: 'example-secret',
+      algorithm: 'sha256',
+      header: 'X-MMK-Signature',
+      timestampHeader: 'X-MMK-Timestamp',
+    },
+    bodyTemplate: '',
+  }
   describe('queryFromAlert', function () {
     it('formats the query string', (done) => {
       const actual = queryFromAlert(
@@ -19,4 +47,97 @@ describe('Go Alert', function () {
       done()
     })
   })
+  describe('requestHeaders', function () {
+    const evt = {
+      name: 'example.name',
+      message: 'example message',
+      details: 'example details',
+      type: 'info' as const,
+      scan_id: '12345',
+    }
+    const now = new Date('2022-10-03T08:00:00Z')
+    it('signs the query string', () => {
+      expect(requestHeaders(goAlertConfig, now)(evt)).toEqual({
+        'X-MMK-Signature': signPayload(
+          'example-secret',
+          'sha256',
+          1664784000,
+          queryFromAlert(evt, 'example-token')
+        ),
+        'X-MMK-Timestamp': '1664784000',
+      })
+    })
+    it('does not sign without a secret', () => {
+      const unsigned = {
+        ...goAlertConfig,
+        signing: { ...goAlertConfig.signing, secret: '' },
+      }
+      expect(requestHeaders(unsigned, now)(evt)).toEqual({})
+    })
+    it('signs the templated body', () => {
+      const templated = {
+        ...goAlertConfig,
+        bodyTemplate: '{"text": {{ summary | json }}}',
+      }
+      expect(requestHeaders(templated, now)(evt)).toEqual({
+        'X-MMK-Signature': signPayload(
+          'example-secret',
+          'sha256',
+          1664784000,
+          '{"text": "example.name - example message"}'
+        ),
+        'X-MMK-Timestamp': '1664784000',
+      })
+    })
+  })
+  describe('requestBody', function () {
+    const evt = {
+      name: 'rule-alert',
+      message: 'unknown.domain - example.com unknown',
+      details: '{}',
+      type: 'info' as const,
+      scan_id: '12345',
+      body: { name: 'unknown.domain', context: { domain: 'example.com' } },
+    }
+    it('renders the alert and its context', () => {
+      const template = compileTemplate(
+        '{"rule": "{{ rule }}", "domain": {{ context.domain | json }}, "url": "{{ scan_url }}"}'
+      )
+      expect(
+        JSON.parse(requestBody(template, 'https://mmk.example.com')(evt))
+      ).toEqual({
+        rule: 'unknown.domain',
+        domain: 'example.com',
+        url: 'https://mmk.example.com/scans/12345',
+      })
+    })
+    it('has no body without a template', () => {
+      expect(requestBody(undefined)(evt)).toBeUndefined()
+    })
+    it('escapes quotes in alert fields', () => {
+      const template = bodyTemplate({
+        ...goAlertConfig,
+        bodyTemplate: '{"summary": "{{ summary }}", "domain": "{{ rule }}"}',
+      })
+      const quoted = {
+        ...evt,
+        message: 'example.com", "severity": "low',
+      }
+      expect(JSON.parse(requestBody(template)(quoted))).toEqual({
+        summary: 'rule-alert - example.com", "severity": "low',
+        domain: 'unknown.domain',
+      })
+    })
+    it('rejects templates not rendering JSON when loaded', () => {
+      expect(() =>
+        bodyTemplate({ ...goAlertConfig, bodyTemplate: '{"text": {{ name }}}' })
+      ).toThrow('goAlert body template renders invalid JSON')
+    })
+    it('rejects rendered bodies that are not JSON', () => {
+      const template = compileTemplate('{"context": {{ context }}}')
+      expect(() =>
+        requestBody(template)({ ...evt, body: undefined })
+      ).toThrow('goAlert body template rendered invalid JSON')
+    })
+  })
 })
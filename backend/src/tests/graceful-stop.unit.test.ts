@@ -0,0 +1,45 @@
+// ./lib/graceful-stop.ts test
+import { GracefulStop } from '../lib/graceful-stop'
+
+describe('GracefulStop', () => {
+  const sleep = (ms: number) =>
+    new Promise<void>((resolve) => setTimeout(resolve, ms))
+  it('stops stages in the configured order', async () => {
+    const stopped: string[] = []
+    const stop = (name: string, ms = 0) => async () => {
+      await sleep(ms)
+      stopped.push(name)
+    }
+    const graceful = new GracefulStop(['scheduler', 'workers', 'reaper'], 0)
+    // registered out of order
+    graceful.register('reaper', 'reaper', stop('reaper'))
+    graceful.register('slow-worker', 'workers', stop('slow-worker', 20))
+    graceful.register('worker', 'workers', stop('worker'))
+    graceful.register('scheduler', 'scheduler', stop('scheduler', 10))
+    await graceful.stop()
+    expect(stopped).toEqual(['scheduler', 'worker', 'slow-worker', 'reaper'])
+  })
+  it('stops unlisted stages last', async () => {
+    const graceful = new GracefulStop(['workers'], 0)
+    graceful.register('cache', 'cache', async () => undefined)
+    graceful.register('worker', 'workers', async () => undefined)
+    graceful.register('queues', 'queues', async () => undefined)
+    expect(graceful.stages()).toEqual(['workers', 'cache', 'queues'])
+  })
+  it('keeps stopping after failures and timeouts', async () => {
+    const graceful = new GracefulStop(['scheduler', 'workers', 'reaper'], 20)
+    const reaper = jest.fn(async () => undefined)
+    graceful.register('scheduler', 'scheduler', async () => {
+      throw new Error('redis down')
+    })
+    graceful.register('worker', 'workers', () => sleep(1000))
+    graceful.register('reaper', 'reaper', reaper)
+    const results = await graceful.stop()
+    expect(results).toEqual([
+      { name: 'scheduler', stage: 'scheduler', error: 'redis down' },
+      { name: 'worker', stage: 'workers', error: 'timed out after 20ms' },
+      { name: 'reaper', stage: 'reaper' },
+    ])
+    expect(reaper).toHaveBeenCalledTimes(1)
+  })
+})
@@ -0,0 +1,36 @@
+// ./lib/headers.ts test
+import { mapToHeaderList, MASKED_VALUE } from '../lib/headers'
+
+describe('Headers', () => {
+  describe('mapToHeaderList', () => {
+    const headers = {
+      Authorization: 'Bearer secret',
+      'content-type': 'application/json',
+      'x-forwarded-for': ['10.0.0.1', '10.0.0.2'],
+    }
+    it('masks Authorization and shows benign headers verbatim', () => {
+      expect(mapToHeaderList(headers)).toEqual([
+        { name: 'Authorization', value: MASKED_VALUE, masked: true },
+        { name: 'content-type', value: 'application/json', masked: false },
+        {
+          name: 'x-forwarded-for',
+          value: '10.0.0.1, 10.0.0.2',
+          masked: false,
+        },
+      ])
+    })
+    it('masks headers missing from the allow list', () => {
+      const list = mapToHeaderList(headers, {
+        allow: ['Content-Type'],
+        mask: [],
+      })
+      expect(list.filter((h) => h.masked).map((h) => h.name)).toEqual([
+        'Authorization',
+        'x-forwarded-for',
+      ])
+    })
+    it('handles missing headers', () => {
+      expect(mapToHeaderList(undefined)).toEqual([])
+    })
+  })
+})
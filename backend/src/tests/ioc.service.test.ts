@@ -0,0 +1,121 @@
+import { addDays, subMinutes } from 'date-fns'
+import { knex } from '../models'
+import Ioc from '../models/iocs'
+import IocFactory from './factories/iocs.factory'
+import IocService, {
+  insertMany,
+  normalizeValue,
+  VERSION_KEY,
+} from '../services/ioc'
+import { redisClient } from '../repos/redis'
+import DataCheckService from '../services/data_check'
+import { resetDB } from './utils'
+
+describe('IOC Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  describe('expire', () => {
+    it('disables expired IOCs and bumps the version', async () => {
+      const expired = await IocFactory.build({
+        expires_at: subMinutes(new Date(), 1),
+      })
+        .$query()
+        .insert()
+      const active = await IocFactory.build({
+        expires_at: addDays(new Date(), 1),
+      })
+        .$query()
+        .insert()
+      const before = parseInt((await redisClient.get(VERSION_KEY)) || '0', 10)
+      expect(await IocService.expire()).toBe(1)
+      expect((await Ioc.query().findById(expired.id)).enabled).toBe(false)
+      expect((await Ioc.query().findById(active.id)).enabled).toBe(true)
+      const after = parseInt(await redisClient.get(VERSION_KEY), 10)
+      expect(after).toBe(before + 1)
+    })
+    it('does not bump the version when nothing expired', async () => {
+      await IocFactory.build().$query().insert()
+      const before = await redisClient.get(VERSION_KEY)
+      expect(await IocService.expire()).toBe(0)
+      expect(await redisClient.get(VERSION_KEY)).toBe(before)
+    })
+  })
+  describe('fqdn values', () => {
+    it('stores hosts normalized like the data check', async () => {
+      const ioc = await IocService.create({
+        type: 'fqdn',
+        value: 'Evil.Example.TEST.',
+        enabled: true,
+      })
+      await IocService.bulkCreate({
+        type: 'fqdn',
+        values: ['Bulk.Example.TEST'],
+        enabled: true,
+      })
+      expect(ioc.value).toBe('evil.example.test')
+      const values = (await Ioc.query().select('value')).map((r) => r.value)
+      expect(values.sort()).toEqual(['bulk.example.test', 'evil.example.test'])
+      expect(await DataCheckService.check()).toEqual([])
+    })
+    it('finds hosts looked up in another form', async () => {
+      await IocService.create({
+        type: 'fqdn',
+        value: 'evil.example.test',
+        enabled: true,
+      })
+      const hit = await IocService.findActive({
+        type: 'fqdn',
+        value: normalizeValue('fqdn', 'EVIL.example.test.'),
+      })
+      expect(hit).toBeDefined()
+    })
+  })
+  describe('insertMany', () => {
+    const values = (n: number) =>
+      Array.from({ length: n }, (_, i) => ({
+        type: 'fqdn' as const,
+        value: `bulk-${i}.example.test`,
+        enabled: true,
+      }))
+    // threshold 0 forces the set based insert, a large one the row insert
+    const paths: Array<[string, number]> = [
+      ['multi-row insert', 100],
+      ['set based insert', 0],
+    ]
+    paths.forEach(([name, threshold]) => {
+      describe(name, () => {
+        it('inserts every IOC', async () => {
+          await insertMany(values(25), threshold)
+          const rows = await Ioc.query().where('value', 'like', 'bulk-%')
+          expect(rows).toHaveLength(25)
+          rows.forEach((row) => {
+            expect(row.id).toBeDefined()
+            expect(row.created_at).toBeInstanceOf(Date)
+            expect(row.enabled).toBe(true)
+          })
+        })
+        it('skips existing and repeated values', async () => {
+          await insertMany(values(2), threshold)
+          await insertMany([...values(3), ...values(3)], threshold)
+          const total = await Ioc.query()
+            .where('value', 'like', 'bulk-%')
+            .resultSize()
+          expect(total).toBe(3)
+        })
+        it('keeps the expiry', async () => {
+          const expires_at = addDays(new Date(), 1)
+          await insertMany(
+            [{ type: 'ip', value: '10.0.0.1', enabled: true, expires_at }],
+            threshold
+          )
+          const row = await Ioc.query().findOne({ value: '10.0.0.1' })
+          expect(row.expires_at).toEqual(expires_at)
+        })
+      })
+    })
+  })
+})
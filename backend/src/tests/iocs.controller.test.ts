@@ -1,4 +1,5 @@
 import request from 'supertest'
+import { addDays, subMinutes } from 'date-fns'
 import { knex } from '../models'
 import Ioc from '../models/iocs'
 import IocFactory from './factories/iocs.factory'
@@ -91,6 +92,57 @@ describe('IOCs Controller', () => {
       expect(res.body.total).toBe(1)
       expect(res.body.results[0].value).toBe('.*.google.com')
     })
+    it('should match url substrings', async () => {
+      await IocFactory.build({ type: 'url', value: '/skimmer.js?' })
+        .$query()
+        .insert()
+      const res = await request(userSession())
+        .get('/api/iocs')
+        .query({ type: 'url', value: 'https://cdn.example.com/skimmer.js?v=1' })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(1)
+      expect(res.body.results[0].value).toBe('/skimmer.js?')
+    })
+    it('should match IPs in a CIDR range', async () => {
+      await IocFactory.build({ type: 'ip_cidr', value: '203.0.113.0/24' })
+        .$query()
+        .insert()
+      const inRange = await request(userSession())
+        .get('/api/iocs')
+        .query({ type: 'ip_cidr', value: '203.0.113.7' })
+      expect(inRange.status).toBe(200)
+      expect(inRange.body.total).toBe(1)
+      const outOfRange = await request(userSession())
+        .get('/api/iocs')
+        .query({ type: 'ip_cidr', value: '198.51.100.7' })
+      expect(outOfRange.body.total).toBe(0)
+    })
+    it('should not match expired or disabled IOCs', async () => {
+      await IocFactory.build({
+        value: 'expired.example',
+        expires_at: subMinutes(new Date(), 5),
+      })
+        .$query()
+        .insert()
+      await IocFactory.build({ value: 'disabled.example', enabled: false })
+        .$query()
+        .insert()
+      for (const value of ['expired.example', 'disabled.example']) {
+        const res = await request(userSession())
+          .get('/api/iocs')
+          .query({ type: 'fqdn', value })
+        expect(res.body.total).toBe(0)
+      }
+    })
+    it('should match sha256 case-insensitively', async () => {
+      const hash = 'a'.repeat(64)
+      await IocFactory.build({ type: 'sha256', value: hash }).$query().insert()
+      const res = await request(userSession())
+        .get('/api/iocs')
+        .query({ type: 'sha256', value: hash.toUpperCase() })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(1)
+    })
   })
   describe('GET /api/iocs/:id', () => {
     it('should return the ioc for auth user', async () => {
@@ -144,6 +196,34 @@ describe('IOCs Controller', () => {
         .set('Accept', 'application/json')
       expect(res.status).toBe(422)
     })
+    it('should reject invalid CIDR', async () => {
+      const res = await request(adminSession())
+        .post('/api/iocs')
+        .send({ ioc: { value: '10.0.0.0/33', type: 'ip_cidr', enabled: true } })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
+    it('should reject invalid sha256', async () => {
+      const res = await request(adminSession())
+        .post('/api/iocs')
+        .send({ ioc: { value: 'abc123', type: 'sha256', enabled: true } })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
+    it('should reject an expiry in the past', async () => {
+      const res = await request(adminSession())
+        .post('/api/iocs')
+        .send({
+          ioc: {
+            value: 'example.com',
+            type: 'fqdn',
+            enabled: true,
+            expires_at: subMinutes(new Date(), 5).toISOString(),
+          },
+        })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
     it('should reject on empty value', async () => {
       const res = await request(adminSession())
         .post('/api/iocs')
@@ -196,6 +276,29 @@ describe('IOCs Controller', () => {
         .set('Accept', 'application/json')
       expect(res.status).toBe(403)
     })
+    it('should only re-enable expired IOCs with a new expiry', async () => {
+      await seed
+        .$query()
+        .patch({ enabled: false, expires_at: subMinutes(new Date(), 5) })
+      const reject = await request(adminSession())
+        .put(`/api/iocs/${seed.id}`)
+        .send({ ioc: { value: seed.value, type: 'fqdn', enabled: true } })
+        .set('Accept', 'application/json')
+      expect(reject.status).toBe(422)
+      const res = await request(adminSession())
+        .put(`/api/iocs/${seed.id}`)
+        .send({
+          ioc: {
+            value: seed.value,
+            type: 'fqdn',
+            enabled: true,
+            expires_at: addDays(new Date(), 1).toISOString(),
+          },
+        })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(200)
+      expect(res.body.enabled).toBe(true)
+    })
     it('should prevent invalid regular expression value', async () => {
       const res = await request(adminSession())
         .put(`/api/iocs/${seed.id}`)
@@ -0,0 +1,51 @@
+import { ajv } from 'aejo'
+import request, { Response } from 'supertest'
+import { guestSession } from './utils'
+
+describe('OpenAPI Controller', () => {
+  describe('GET /api/openapi.json', () => {
+    let res: Response
+    beforeAll(async () => {
+      res = await request(guestSession().app).get('/api/openapi.json')
+    })
+    it('should return the spec', () => {
+      expect(res.status).toBe(200)
+      expect(res.body.openapi).toBe('3.0.0')
+      expect(res.body.paths['/api/scans/']).toBeDefined()
+      expect(res.body.paths['/api/scan_logs/']).toBeDefined()
+    })
+    it('should include the scan and scan log schemas', () => {
+      const { schemas } = res.body.components
+      expect(schemas.Scan.properties.state.type).toBe('string')
+      expect(schemas.ScanLog.properties.entry.enum).toContain('request')
+      expect(schemas.ListResponse.properties.total.type).toBe('integer')
+    })
+    it('should validate a scan log list response', () => {
+      const { schemas } = res.body.components
+      const validate = ajv.compile({
+        ...schemas.ListResponse,
+        properties: {
+          ...schemas.ListResponse.properties,
+          results: { type: 'array', items: schemas.ScanLog },
+        },
+      })
+      const sample = {
+        total: 1,
+        results: [
+          {
+            id: '0b4e2bb0-8f1a-4b3c-9d55-4f2e1c7a9e10',
+            entry: 'request',
+            event: { url: 'https://example.com/' },
+            scan_id: '6a1d4f7e-3c2b-4e8a-9f10-2b7c5d8e4a31',
+            level: 'info',
+            created_at: '2022-09-22T09:00:00.000Z',
+          },
+        ],
+      }
+      expect(validate(sample)).toBe(true)
+      expect(validate({ ...sample, results: [{ entry: 'bogus' }] })).toBe(
+        false
+      )
+    })
+  })
+})
@@ -0,0 +1,71 @@
+import request from 'supertest'
+import { knex } from '../models'
+import SiteFactory from './factories/sites.factory'
+import ScanFactory from './factories/scans.factory'
+import SourceFactory from './factories/sources.factory'
+import ScanLogFactory from './factories/scan_log.factory'
+import { UserRole } from '../models/users'
+import { makeSession, resetDB } from './utils'
+import { WebRequestEvent } from '@merrymaker/types'
+
+const session = (role: UserRole) =>
+  makeSession({
+    firstName: 'Test',
+    lastName: 'User',
+    role,
+    lanid: 'z000n00',
+    email: 'foo@example.com',
+    isAuth: true,
+    exp: 0
+  }).app
+
+describe('Reports Controller', () => {
+  beforeEach(async () => {
+    await resetDB()
+    const source = await SourceFactory.build()
+      .$query()
+      .insert()
+    const site = await SiteFactory.build({ source_id: source.id })
+      .$query()
+      .insert()
+    const scan = await ScanFactory.build({
+      source_id: source.id,
+      site_id: site.id
+    })
+      .$query()
+      .insert()
+    await ScanLogFactory.build({
+      scan_id: scan.id,
+      entry: 'request',
+      event: { url: 'https://cdn.test/lib.js' } as WebRequestEvent
+    })
+      .$query()
+      .insert()
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  describe('GET /api/reports/top-domains', () => {
+    it('returns the top domains', async () => {
+      const res = await request(session('admin'))
+        .get('/api/reports/top-domains')
+        .query({ since: '1d', limit: 5 })
+        .expect(200)
+      expect(res.body.domains).toEqual([
+        { domain: 'cdn.test', events: 1, sites: 1 }
+      ])
+      expect(typeof res.body.since).toBe('string')
+    })
+    it('rejects an invalid window', async () => {
+      await request(session('admin'))
+        .get('/api/reports/top-domains')
+        .query({ since: 'last week' })
+        .expect(400)
+    })
+    it('is admin only', async () => {
+      await request(session('user'))
+        .get('/api/reports/top-domains')
+        .expect(403)
+    })
+  })
+})
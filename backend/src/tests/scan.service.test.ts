@@ -1,11 +1,14 @@
-import ScanService from '../services/scan'
+import ScanService, { IDLE_FAILURE } from '../services/scan'
+import { ScanLog, Site } from '../models'
+import SettingService from '../services/setting'
 import SiteFactory from './factories/sites.factory'
 import ScanFactory from './factories/scans.factory'
 import SourceFactory from './factories/sources.factory'
 import ScanLogFactory from './factories/scan_log.factory'
 import { resetDB } from './utils'
-import { ScanAttributes } from '../models/scans'
-import { WebRequestEvent } from '@merrymaker/types'
+import Scan, { ScanAttributes } from '../models/scans'
+import MerryMaker, { WebRequestEvent } from '@merrymaker/types'
+import { Queue } from 'bull'
 
 const helper = async (scanAttrs: Partial<ScanAttributes> = {}) => {
   const sourceModel = await SourceFactory.build()
@@ -26,6 +29,7 @@ const helper = async (scanAttrs: Partial<ScanAttributes> = {}) => {
 describe('Scan Service', () => {
   beforeEach(async () => {
     await resetDB()
+    SettingService.invalidate()
   })
   it('deletes scans older than 5 days', async () => {
     const now = new Date()
@@ -52,6 +56,64 @@ describe('Scan Service', () => {
     const total = await ScanService.purge(5)
     expect(total).toBe(1)
   })
+  describe('purge retention overrides', () => {
+    const daysAgo = (days: number) =>
+      new Date(Date.now() - days * 24 * 60 * 60 * 1000)
+    let scan: Scan
+    beforeEach(async () => {
+      const source = await SourceFactory.build()
+        .$query()
+        .insert()
+      const site = await SiteFactory.build({ source_id: source.id })
+        .$query()
+        .insert()
+      scan = await ScanFactory.build({
+        created_at: daysAgo(20),
+        source_id: source.id,
+        site_id: site.id
+      })
+        .$query()
+        .insert()
+      for (const entry of ['request', 'rule-alert', 'complete']) {
+        await ScanLogFactory.build({
+          entry,
+          scan_id: scan.id,
+          created_at: daysAgo(20)
+        })
+          .$query()
+          .insert()
+      }
+    })
+    it('keeps alert events past the network event retention', async () => {
+      const total = await ScanService.purge(14, { 'rule-alert': 90 })
+      expect(total).toBe(0)
+      const entries = await ScanLog.query()
+        .where('scan_id', scan.id)
+        .select('entry')
+      expect(entries.map(e => e.entry)).toEqual(['rule-alert'])
+    })
+    it('prunes shorter retained events of recent scans', async () => {
+      const recent = await ScanLogFactory.build({
+        entry: 'request',
+        scan_id: scan.id,
+        created_at: daysAgo(5)
+      })
+        .$query()
+        .insert()
+      await ScanService.pruneEvents(30, { request: 3 })
+      expect(await ScanLog.query().findById(recent.id)).toBeUndefined()
+      expect(
+        await ScanLog.query()
+          .where('scan_id', scan.id)
+          .resultSize()
+      ).toBe(2)
+    })
+    it('deletes the scan once retained events expire', async () => {
+      const total = await ScanService.purge(14, { 'rule-alert': 15 })
+      expect(total).toBe(1)
+      expect(await Scan.query().findById(scan.id)).toBeUndefined()
+    })
+  })
   it('deletes test scans 6 hours or older', async () => {
     const now = new Date()
     const sixHoursAgo = new Date(new Date().setHours(now.getHours() - 6.1))
@@ -154,6 +216,125 @@ describe('Scan Service', () => {
       expect(expiredRunning.state).toBe('expired')
     })
   })
+  describe('findAndFailIdle', () => {
+    const now = new Date('2022-09-01T12:00:00.000Z')
+    const minutesAgo = (m: number) => new Date(now.valueOf() - m * 60000)
+    // scan job of `scanID` picked up by a scanner
+    const fakeQueue = (scanID: string, attemptsMade = 0) => {
+      const job = {
+        data: { scan_id: scanID },
+        opts: { attempts: 3 },
+        attemptsMade,
+        discard: jest.fn(),
+        moveToFailed: jest.fn(async () => null)
+      }
+      const queue = ({
+        getJobs: jest.fn(async () => [job]),
+        add: jest.fn(async () => ({ id: 'retry' }))
+      } as unknown) as Queue<MerryMaker.ScanQueueJob> & { add: jest.Mock }
+      return { queue, job }
+    }
+    const opts = {
+      flagMinutes: 5,
+      failMinutes: 10,
+      exemptSourceIDs: [] as string[],
+      now,
+      queue: fakeQueue('none').queue
+    }
+    const withLastEvent = async (minutes: number) => {
+      const scan = await helper({ state: 'running', created_at: minutesAgo(30) })
+      await ScanLogFactory.build({
+        entry: 'request',
+        event: { url: 'http://www.example.com/' } as WebRequestEvent,
+        scan_id: scan.id,
+        created_at: minutesAgo(minutes)
+      })
+        .$query()
+        .insert()
+      return scan
+    }
+    it('ignores scans with recent events', async () => {
+      const scan = await withLastEvent(4.9)
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res).toEqual({ flagged: 0, cleared: 0, failed: 0, retried: 0 })
+      const actual = await scan.$query()
+      expect(actual.idle_at).toBeNull()
+    })
+    it('flags scans at the first window', async () => {
+      const scan = await withLastEvent(5)
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res.flagged).toBe(1)
+      const actual = await scan.$query()
+      expect(actual.idle_at).toEqual(now)
+      expect(actual.state).toBe('running')
+    })
+    it('does not flag a scan twice', async () => {
+      await withLastEvent(6)
+      await ScanService.findAndFailIdle(opts)
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res.flagged).toBe(0)
+    })
+    it('clears the flag when events resume', async () => {
+      const scan = await withLastEvent(1)
+      await scan.$query().patch({ idle_at: minutesAgo(2) })
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res.cleared).toBe(1)
+    })
+    it('fails scans at the second window', async () => {
+      const scan = await withLastEvent(10)
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res.failed).toBe(1)
+      const actual = await scan.$query()
+      expect(actual.state).toBe('failed')
+      const logs = await ScanLog.query()
+        .where('scan_id', scan.id)
+        .where('level', 'error')
+      expect(JSON.stringify(logs[0].event)).toContain(IDLE_FAILURE)
+    })
+    it('fails the scan job and schedules the site again', async () => {
+      const scan = await withLastEvent(10)
+      const { queue, job } = fakeQueue(scan.id)
+      const res = await ScanService.findAndFailIdle({ ...opts, queue })
+      expect(res.retried).toBe(1)
+      expect(job.discard).toHaveBeenCalled()
+      expect(job.moveToFailed).toHaveBeenCalledWith(
+        { message: IDLE_FAILURE },
+        true
+      )
+      expect(queue.add).toHaveBeenCalledTimes(1)
+      const rescheduled = await Scan.query()
+        .where('site_id', scan.site_id)
+        .whereNot('id', scan.id)
+      expect(rescheduled.map(r => r.state)).toEqual(['scheduled'])
+    })
+    it('does not schedule again without attempts left', async () => {
+      const scan = await withLastEvent(10)
+      const { queue } = fakeQueue(scan.id, 2)
+      const res = await ScanService.findAndFailIdle({ ...opts, queue })
+      expect(res).toMatchObject({ failed: 1, retried: 0 })
+      expect(queue.add).not.toHaveBeenCalled()
+    })
+    it('keeps idle failures final', async () => {
+      const scan = await withLastEvent(10)
+      await ScanService.findAndFailIdle(opts)
+      await ScanService.updateState(scan.id, 'completed')
+      const actual = await scan.$query()
+      expect(actual.state).toBe('failed')
+    })
+    it('uses the scan creation date without events', async () => {
+      await helper({ state: 'active', created_at: minutesAgo(11) })
+      const res = await ScanService.findAndFailIdle(opts)
+      expect(res.failed).toBe(1)
+    })
+    it('skips exempt sources', async () => {
+      const scan = await withLastEvent(11)
+      const res = await ScanService.findAndFailIdle({
+        ...opts,
+        exemptSourceIDs: [scan.source_id]
+      })
+      expect(res.failed).toBe(0)
+    })
+  })
   describe('groupDomainRequests', () => {
     it('returns an array of grouped domains', async () => {
       const viewScan = await helper()
@@ -241,6 +422,442 @@ describe('Scan Service', () => {
       })
     })
   })
+  describe('groupLogsWithStats', () => {
+    it('caps distinct domains and counts the rest', async () => {
+      const viewScan = await helper()
+      const hosts = ['a', 'b', 'c', 'd', 'e', 'a']
+      for (const host of hosts) {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: { url: `http://${host}.example.com/` } as WebRequestEvent,
+          scan_id: viewScan.id
+        })
+          .$query()
+          .insert()
+      }
+      const increment = jest.fn()
+      const actual = await ScanService.groupLogsWithStats(viewScan.id, {
+        entry: 'request',
+        composites: [ScanService.domainComposite],
+        maxKeys: 2,
+        stats: { timing: jest.fn(), gauge: jest.fn(), increment }
+      })
+      expect(actual.capReached).toBe(true)
+      expect(Object.keys(actual.groups.domain)).toHaveLength(2)
+      expect(actual.untracked.domain).toBe(3)
+      expect(actual.heapUsed).toBeGreaterThan(0)
+      expect(increment).toHaveBeenCalledTimes(1)
+      expect(increment).toHaveBeenCalledWith(
+        'scans.summary.domain_cap_reached'
+      )
+    })
+    it('matches whole-batch results when processed in chunks', async () => {
+      const viewScan = await helper()
+      for (let i = 0; i < 25; i += 1) {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: { url: `http://h${i % 7}.example.com/` } as WebRequestEvent,
+          scan_id: viewScan.id
+        })
+          .$query()
+          .insert()
+      }
+      const whole = await ScanService.groupLogsWithStats(viewScan.id, {
+        entry: 'request',
+        composites: [ScanService.domainComposite],
+        chunkSize: 100
+      })
+      const chunked = await ScanService.groupLogsWithStats(viewScan.id, {
+        entry: 'request',
+        composites: [ScanService.domainComposite],
+        chunkSize: 4
+      })
+      expect(whole.chunks).toBe(1)
+      expect(chunked.chunks).toBe(7)
+      expect(chunked.groups).toEqual(whole.groups)
+    })
+    it('does not flag when under the cap', async () => {
+      const viewScan = await helper()
+      const increment = jest.fn()
+      await ScanLogFactory.build({
+        entry: 'request',
+        event: { url: 'http://www.yahoo.com/moo.html' } as WebRequestEvent,
+        scan_id: viewScan.id
+      })
+        .$query()
+        .insert()
+      const actual = await ScanService.groupLogsWithStats(viewScan.id, {
+        entry: 'request',
+        composites: [ScanService.domainComposite],
+        maxKeys: 2,
+        stats: { timing: jest.fn(), gauge: jest.fn(), increment }
+      })
+      expect(actual.capReached).toBe(false)
+      expect(increment).not.toHaveBeenCalled()
+      expect(actual.untracked).toEqual({})
+    })
+  })
+  describe('cancel', () => {
+    const fakeQueue = (scanID: string, active = false) => {
+      const remove = jest.fn()
+      const discard = jest.fn()
+      const queue = ({
+        getJobs: jest.fn(async () => [
+          {
+            data: { scan_id: scanID },
+            isActive: async () => active,
+            remove,
+            discard
+          }
+        ])
+      } as unknown) as Queue<MerryMaker.ScanQueueJob>
+      return { queue, remove, discard }
+    }
+    it('cancels a scheduled scan and removes its job', async () => {
+      const scan = await helper({ state: 'scheduled' })
+      const { queue, remove } = fakeQueue(scan.id)
+      const res = await ScanService.cancel(scan.id, queue)
+      expect(res.scan.state).toBe('cancelled')
+      expect(res.running).toBe(false)
+      expect(remove).toHaveBeenCalledTimes(1)
+      const logs = await ScanLog.query().where({ scan_id: scan.id })
+      expect(logs.map(l => l.event)).toContainEqual({
+        message: 'Scan cancelled'
+      })
+    })
+    it('discards a job a scanner already picked up', async () => {
+      const scan = await helper({ state: 'scheduled' })
+      const { queue, remove, discard } = fakeQueue(scan.id, true)
+      const res = await ScanService.cancel(scan.id, queue)
+      expect(res.scan.state).toBe('cancelled')
+      expect(res.running).toBe(true)
+      expect(discard).toHaveBeenCalledTimes(1)
+      expect(remove).not.toHaveBeenCalled()
+      const logs = await ScanLog.query().where({ scan_id: scan.id })
+      expect(logs.map(l => l.event)).toContainEqual({
+        message: 'Scan cancelled, the running scan job will finish'
+      })
+      await ScanService.updateState(scan.id, 'completed')
+      expect((await ScanService.view(scan.id)).state).toBe('cancelled')
+    })
+    it('rejects running scans', async () => {
+      const scan = await helper({ state: 'running' })
+      const { queue, remove } = fakeQueue(scan.id)
+      await expect(ScanService.cancel(scan.id, queue)).rejects.toThrow(
+        'Cannot cancel running scan'
+      )
+      expect(remove).not.toHaveBeenCalled()
+    })
+    it('keeps cancelled scans cancelled', async () => {
+      const scan = await helper({ state: 'scheduled' })
+      await ScanService.cancel(scan.id, fakeQueue(scan.id).queue)
+      await ScanService.updateState(scan.id, 'active')
+      const res = await ScanService.view(scan.id)
+      expect(res.state).toBe('cancelled')
+    })
+    it('does not count cancelled scans as pending', async () => {
+      const scan = await helper({ state: 'scheduled' })
+      await ScanService.cancel(scan.id, fakeQueue(scan.id).queue)
+      expect(await ScanService.pendingBySite([scan.site_id])).toEqual({})
+    })
+  })
+  describe('maxWaitSeconds', () => {
+    it('reports the oldest scheduled scan per type', async () => {
+      const now = new Date()
+      const waiting: Array<[string, boolean, number]> = [
+        ['scheduled', false, 120],
+        ['scheduled', false, 30],
+        ['scheduled', true, 600],
+        ['running', false, 3600]
+      ]
+      for (const [state, test, seconds] of waiting) {
+        const scan = await helper({ state, test })
+        await Scan.query()
+          .findById(scan.id)
+          .patch({ created_at: new Date(now.getTime() - seconds * 1000) })
+      }
+      expect(await ScanService.maxWaitSeconds(now)).toEqual({
+        scheduled: 120,
+        test: 600
+      })
+    })
+    it('is 0 without waiting scans', async () => {
+      expect(await ScanService.maxWaitSeconds()).toEqual({
+        scheduled: 0,
+        test: 0
+      })
+    })
+  })
+  describe('stateCounts', () => {
+    it('isolates counts by site', async () => {
+      const scanA = await helper({ state: 'completed' })
+      const scanB = await helper({ state: 'failed' })
+      const more: Array<[Scan, string]> = [
+        [scanA, 'completed'],
+        [scanA, 'running'],
+        [scanB, 'scheduled']
+      ]
+      for (const [scan, state] of more) {
+        await ScanFactory.build({
+          source_id: scan.source_id,
+          site_id: scan.site_id,
+          state
+        })
+          .$query()
+          .insert()
+      }
+      const countsA = await ScanService.stateCounts(scanA.site_id)
+      expect(countsA.total).toBe(3)
+      expect(countsA.completed).toBe(2)
+      expect(countsA.running).toBe(1)
+      expect(countsA.failed).toBe(0)
+      const countsB = await ScanService.stateCounts(scanB.site_id)
+      expect(countsB.total).toBe(2)
+      expect(countsB.failed).toBe(1)
+      expect(countsB.scheduled).toBe(1)
+      expect(countsB.completed).toBe(0)
+      const all = await ScanService.stateCounts()
+      expect(all.total).toBe(5)
+    })
+    it('returns zeroed counts for a site without scans', async () => {
+      const scan = await helper()
+      await Scan.query().deleteById(scan.id)
+      expect(await ScanService.stateCounts(scan.site_id)).toEqual({
+        total: 0,
+        scheduled: 0,
+        active: 0,
+        running: 0,
+        completed: 0,
+        failed: 0,
+        expired: 0,
+        cancelled: 0
+      })
+    })
+  })
+  describe('awaitingRules', () => {
+    it('counts completed scans with pending rule work', async () => {
+      const completed = await helper({ state: 'completed' })
+      const running = await helper({ state: 'running' })
+      // completed, rules already processed
+      const processed = await helper({ state: 'completed' })
+      const actual = await ScanService.awaitingRules({
+        [completed.id]: '2',
+        [running.id]: '1',
+        [processed.id]: '0',
+        'not-a-scan': '4'
+      })
+      expect(actual).toEqual({ scans: 1, events: 2 })
+    })
+    it('returns zero without pending jobs', async () => {
+      expect(await ScanService.awaitingRules({})).toEqual({
+        scans: 0,
+        events: 0
+      })
+    })
+  })
+  describe('trackLanding', () => {
+    const documentRequest = (
+      scan_id: string,
+      url: string,
+      created_at: Date,
+      headers: Record<string, string> = {}
+    ) =>
+      ScanLogFactory.build({
+        entry: 'request',
+        event: { url, resourceType: 'document', headers } as WebRequestEvent,
+        scan_id,
+        created_at
+      })
+        .$query()
+        .insert()
+    it('counts consecutive drifting scans', async () => {
+      const scan = await helper({ state: 'completed' })
+      const next = await ScanFactory.build({
+        source_id: scan.source_id,
+        site_id: scan.site_id,
+        state: 'completed'
+      })
+        .$query()
+        .insert()
+      await Site.query()
+        .patch({ target_url: 'https://www.example.com/shop' })
+        .findById(scan.site_id)
+      for (const { id } of [scan, next]) {
+        await documentRequest(
+          id,
+          'https://www.example.com/shop',
+          new Date(Date.now() - 1000)
+        )
+        await documentRequest(id, 'https://www.example.net/', new Date())
+      }
+      expect(await ScanService.landingURL(scan.id)).toBe(
+        'https://www.example.net/'
+      )
+      await ScanService.trackLanding(scan)
+      await ScanService.trackLanding(next)
+      const site = await Site.query().findById(scan.site_id)
+      expect(site.last_url).toBe('https://www.example.net/')
+      expect(site.drift_count).toBe(2)
+      const warnings = await ScanLog.query().where({
+        scan_id: scan.id,
+        level: 'warning'
+      })
+      expect(warnings[0].event).toEqual({
+        message: 'target drift (domain): scan landed on https://www.example.net/'
+      })
+      const results = await ScanService.rulesResults(scan.id)
+      expect(results.target_drift).toEqual({
+        reason: 'domain',
+        landing_url: 'https://www.example.net/'
+      })
+    })
+    it('tracks a scan once', async () => {
+      const scan = await helper({ state: 'completed' })
+      await Site.query()
+        .patch({ target_url: 'https://www.example.com/' })
+        .findById(scan.site_id)
+      await documentRequest(scan.id, 'https://www.example.net/', new Date())
+      await ScanService.trackLanding(scan)
+      await ScanService.trackLanding(scan)
+      const site = await Site.query().findById(scan.site_id)
+      expect(site.drift_count).toBe(1)
+      const warnings = await ScanLog.query().where({
+        scan_id: scan.id,
+        level: 'warning'
+      })
+      expect(warnings).toHaveLength(1)
+    })
+    it('ignores frame documents', async () => {
+      const scan = await helper({ state: 'completed' })
+      await documentRequest(
+        scan.id,
+        'https://www.example.com/',
+        new Date(Date.now() - 1000)
+      )
+      await documentRequest(
+        scan.id,
+        'https://ads.example.net/frame',
+        new Date(),
+        { referer: 'https://www.example.com/' }
+      )
+      expect(await ScanService.landingURL(scan.id)).toBe(
+        'https://www.example.com/'
+      )
+    })
+    it('resets the count when the scan lands on the target', async () => {
+      const scan = await helper({ state: 'completed' })
+      await Site.query()
+        .patch({ target_url: 'https://www.example.com/', drift_count: 4 })
+        .findById(scan.site_id)
+      await documentRequest(scan.id, 'https://shop.example.com/', new Date())
+      await ScanService.trackLanding(scan)
+      const site = await Site.query().findById(scan.site_id)
+      expect(site.drift_count).toBe(0)
+      const results = await ScanService.rulesResults(scan.id)
+      expect(results.target_drift).toBeNull()
+    })
+  })
+  describe('siteSummary', () => {
+    it('aggregates rule alerts across completed scans', async () => {
+      const scanA = await helper({ state: 'completed' })
+      const scanB = await ScanFactory.build({
+        source_id: scanA.source_id,
+        site_id: scanA.site_id,
+        state: 'completed'
+      })
+        .$query()
+        .insert()
+      const alerts: Array<[string, string, boolean]> = [
+        [scanA.id, 'unknown.domain', true],
+        [scanA.id, 'ioc.domain', true],
+        [scanA.id, 'unknown.domain', false],
+        [scanB.id, 'unknown.domain', true],
+        [scanB.id, 'unknown.domain', true]
+      ]
+      for (const [scan_id, name, alert] of alerts) {
+        await ScanLogFactory.build({
+          entry: 'rule-alert',
+          event: { name, alert, level: 'prod', context: {} },
+          scan_id
+        })
+          .$query()
+          .insert()
+      }
+      const actual = await ScanService.siteSummary(scanA.site_id)
+      expect(actual).toEqual({
+        scans: 2,
+        totalAlerts: 4,
+        rules: { 'unknown.domain': 3, 'ioc.domain': 1 },
+        unknownDomains: 3,
+        belowSeenThreshold: 0,
+        iocMatches: 1,
+        scriptHashChanges: 0,
+        exfilAlerts: 0,
+        targetDrift: {
+          target_url: null,
+          last_url: null,
+          runs: 0,
+          drifting: false
+        }
+      })
+    })
+    it('reports alerts below the seen threshold separately', async () => {
+      const scan = await helper({ state: 'completed' })
+      const contexts = [{}, { below_seen_threshold: true, hit_count: 2 }]
+      for (const context of contexts) {
+        await ScanLogFactory.build({
+          entry: 'rule-alert',
+          event: { name: 'unknown.domain', alert: true, level: 'prod', context },
+          scan_id: scan.id
+        })
+          .$query()
+          .insert()
+      }
+      const actual = await ScanService.siteSummary(scan.site_id)
+      expect(actual.rules['unknown.domain']).toBe(2)
+      expect(actual.unknownDomains).toBe(1)
+      expect(actual.belowSeenThreshold).toBe(1)
+    })
+  })
+  describe('summary', () => {
+    it('counts requests to IP hosts', async () => {
+      const viewScan = await helper()
+      const urls = [
+        'http://203.0.113.5:8443/a',
+        'http://[2001:db8::1]/b',
+        'http://www.yahoo.com/c'
+      ]
+      for (const url of urls) {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: { url } as WebRequestEvent,
+          scan_id: viewScan.id
+        })
+          .$query()
+          .insert()
+      }
+      const actual = await ScanService.summary(viewScan.id)
+      expect(actual.totalReq).toBe(3)
+      expect(actual.totalIPHostReq).toBe(2)
+    })
+    it('omits the domain list when samples are disabled', async () => {
+      const viewScan = await helper()
+      for (const url of ['http://www.yahoo.com/a', 'http://www.aol.com/b']) {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: { url } as WebRequestEvent,
+          scan_id: viewScan.id
+        })
+          .$query()
+          .insert()
+      }
+      await SettingService.update('scans.summary.includeDomains', false, 'test')
+      const actual = await ScanService.summary(viewScan.id)
+      expect(actual.requests.domain).toEqual([])
+      expect(actual.samplesDisabled).toBe(true)
+      expect(actual.totalReq).toBe(2)
+    })
+  })
   describe('urlComposite', () => {
     it('should return href', async () => {
       const viewScan = await helper()
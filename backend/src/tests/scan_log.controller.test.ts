@@ -1,5 +1,6 @@
 import request from 'supertest'
 import Chance from 'chance'
+import { config } from 'node-config-ts'
 import { knex, Scan, Site, Source, ScanLog } from '../models'
 import { makeSession, resetDB, guestSession } from './utils'
 import SiteFactory from './factories/sites.factory'
@@ -7,6 +8,7 @@ import ScanFactory from './factories/scans.factory'
 import SourceFactory from './factories/sources.factory'
 import ScanLogFactory from './factories/scan_log.factory'
 import { PathItem, ajv } from 'aejo'
+import { WebRequestEvent } from '@merrymaker/types'
 
 const chance = new Chance()
 
@@ -110,6 +112,171 @@ describe('ScanLog Controller', () => {
       expect(res.body.total).toBe(1)
       expect(res.body.results[0].id).toBe(seedA.id)
     })
+    describe('screenshots', () => {
+      const image = 'aGVsbG8gd29ybGQ='
+      let screenshot: ScanLog
+      beforeEach(async () => {
+        screenshot = await ScanLogFactory.build({
+          entry: 'screenshot',
+          event: { payload: image, type: 'png' },
+          scan_id: scanSeedA.id,
+        })
+          .$query()
+          .insert()
+      })
+      afterEach(() => {
+        config.scans.list.trimScreenshots = true
+      })
+      const listScreenshots = () =>
+        request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ scan_id: scanSeedA.id, 'entry[]': 'screenshot' })
+      it('trims screenshot images by default', async () => {
+        const res = await listScreenshots()
+        expect(res.status).toBe(200)
+        expect(res.body.results[0].id).toBe(screenshot.id)
+        expect(res.body.results[0].event).toEqual({
+          type: 'png',
+          payload_trimmed: true,
+        })
+      })
+      it('keeps screenshot images when trimming is disabled', async () => {
+        config.scans.list.trimScreenshots = false
+        const res = await listScreenshots()
+        expect(res.status).toBe(200)
+        expect(res.body.results[0].event.payload).toBe(image)
+      })
+      it('keeps the image in the ScanLog view', async () => {
+        const res = await request(userSession().app).get(
+          `/api/scan_logs/${screenshot.id}`
+        )
+        expect(res.body.event.payload).toBe(image)
+      })
+    })
+    describe('search_body', () => {
+      const sha256 = 'e3b0c44298fc1c149afbf4c8996fb924'
+      beforeEach(async () => {
+        for (let i = 0; i < 5; i += 1) {
+          await ScanLogFactory.build({
+            entry: 'request',
+            event: {
+              url: `https://cdn.example.com/pay_${i}.js?h=${sha256}`,
+            } as WebRequestEvent,
+            scan_id: scanSeedA.id,
+            created_at: new Date('2022-09-01T00:00:00.000Z'),
+          })
+            .$query()
+            .insert()
+        }
+      })
+      it('matches substrings of the event JSON', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ search: 'CDN.example.com/pay_3', search_body: true })
+        expect(res.status).toBe(200)
+        expect(res.body.total).toBe(1)
+        expect(res.body.results[0].event.url).toMatch(/pay_3\.js/)
+      })
+      it('skips entries outside the trigram index', async () => {
+        await ScanLogFactory.build({
+          entry: 'screenshot',
+          event: { payload: sha256, type: 'png' },
+          scan_id: scanSeedA.id,
+        })
+          .$query()
+          .insert()
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ search: sha256, search_body: true })
+        expect(res.body.total).toBe(5)
+      })
+      it('matches wildcards literally', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ search: 'pay%', search_body: true })
+        expect(res.body.total).toBe(0)
+      })
+      it('pages in a stable order', async () => {
+        const page = async (n: number) =>
+          (
+            await request(userSession().app)
+              .get('/api/scan_logs')
+              .query({
+                search: sha256,
+                search_body: true,
+                page: n,
+                pageSize: 2,
+                orderColumn: 'created_at',
+              })
+          ).body
+        const pages = [await page(1), await page(2), await page(3)]
+        expect(pages[0].total).toBe(5)
+        const ids = pages.reduce(
+          (acc, p) => acc.concat(p.results.map((r: ScanLog) => r.id)),
+          [] as string[]
+        )
+        expect(new Set(ids).size).toBe(5)
+      })
+      it('rejects short searches', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ search: 'ab', search_body: true })
+        expect(res.status).toBe(400)
+      })
+    })
+    describe('where', () => {
+      beforeEach(async () => {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: {
+            url: 'https://example.com/gateway/pay',
+            response: { status: 502 },
+          } as WebRequestEvent,
+          scan_id: scanSeedA.id,
+        })
+          .$query()
+          .insert()
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: {
+            url: 'https://example.com/gateway/pay',
+            response: { status: 200 },
+          } as WebRequestEvent,
+          scan_id: scanSeedA.id,
+        })
+          .$query()
+          .insert()
+      })
+      it('should filter on event paths', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ where: 'url~"/gateway/",response.status>=500' })
+        expect(res.status).toBe(200)
+        expect(res.body.total).toBe(1)
+        expect(res.body.results[0].event.response.status).toBe(502)
+      })
+      it('should return 400 for invalid expressions', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ where: 'response.status>=' })
+        expect(res.status).toBe(400)
+      })
+      it('should treat injection attempts as values', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ where: `url="x' OR '1'='1"` })
+        expect(res.status).toBe(200)
+        expect(res.body.total).toBe(0)
+        const total = await ScanLog.query().resultSize()
+        expect(total).toBe(4)
+      })
+      it('should reject injection attempts in paths', async () => {
+        const res = await request(userSession().app)
+          .get('/api/scan_logs')
+          .query({ where: `url}') OR 1=1;--="x"` })
+        expect(res.status).toBe(400)
+      })
+    })
     it('should return only on matching from date', async () => {
       const res = await request(userSession().app)
         .get('/api/scan_logs')
@@ -159,4 +326,41 @@ describe('ScanLog Controller', () => {
       expect(res.status).toBe(422)
     })
   })
+  describe('GET /api/scan_logs/:id/facets', () => {
+    it('should count ScanLogs per entry for the scan', async () => {
+      await ScanLogFactory.build({
+        entry: 'request',
+        scan_id: scanSeedA.id,
+      })
+        .$query()
+        .insert()
+      await ScanLogFactory.build({
+        entry: 'request',
+        scan_id: scanSeedA.id,
+      })
+        .$query()
+        .insert()
+      const res = await request(userSession().app).get(
+        `/api/scan_logs/${scanSeedA.id}/facets`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual([
+        { entry: 'request', count: 2 },
+        { entry: 'page-error', count: 1 },
+      ])
+      const validate = ajv.compile(
+        api['/api/scan_logs/:id/facets'].get.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should return an empty list for a scan without logs', async () => {
+      const res = await request(userSession().app).get(
+        `/api/scan_logs/${chance.guid({ version: 4 })}/facets`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual([])
+    })
+  })
 })
@@ -1,13 +1,24 @@
 import Chance from 'chance'
 import { Job } from 'bull'
-import ScanLogService from '../services/scan_logs'
+import { config } from 'node-config-ts'
+import ScanLogService, {
+  STORM_RULE,
+  alertFingerprint,
+  alertOnceTTL,
+  dedupeWindow
+} from '../services/scan_logs'
 import ScanService from '../services/scan'
+import SettingService from '../services/setting'
 import SiteFactory from './factories/sites.factory'
 import ScanFactory from './factories/scans.factory'
 import SourceFactory from './factories/sources.factory'
 import ScanLogFactory from './factories/scan_log.factory'
+import Queues from '../jobs/queues'
 import { resetDB } from './utils'
+import { redisClient } from '../repos/redis'
+import { truncationMarker } from '../lib/context'
 import Scan, { ScanAttributes } from '../models/scans'
+import { Alert, Site } from '../models'
 import { RuleAlert, RuleAlertEvent, WebRequestEvent } from '@merrymaker/types'
 
 const chance = Chance.Chance()
@@ -32,6 +43,49 @@ describe('Scan Log Service', () => {
   beforeEach(async () => {
     await resetDB()
   })
+  describe('topDomains', () => {
+    const request = (scan_id: string, url: string, created_at = new Date()) =>
+      ScanLogFactory.build({
+        scan_id,
+        entry: 'request',
+        event: { url } as WebRequestEvent,
+        created_at
+      })
+        .$query()
+        .insert()
+    it('ranks request domains across sites within the window', async () => {
+      const scanA = await helper()
+      const scanB = await helper()
+      for (let i = 0; i < 3; i += 1) {
+        await request(scanA.id, `https://a.example.test/${i}.js`)
+      }
+      await request(scanA.id, 'https://cdn.test/lib.js')
+      await request(scanB.id, 'https://CDN.test/lib.js?v=1')
+      await request(scanB.id, 'https://user@cdn.test:8443/x')
+      await request(scanB.id, 'https://cdn.test')
+      // outside of the window / not a request
+      await request(
+        scanB.id,
+        'https://old.test/',
+        new Date(Date.now() - 10 * 24 * 60 * 60 * 1000)
+      )
+      await ScanLogFactory.build({
+        scan_id: scanB.id,
+        entry: 'log',
+        event: { url: 'https://cdn.test/' }
+      })
+        .$query()
+        .insert()
+      const since = new Date(Date.now() - 7 * 24 * 60 * 60 * 1000)
+      expect(await ScanLogService.topDomains({ since, limit: 10 })).toEqual([
+        { domain: 'cdn.test', events: 4, sites: 2 },
+        { domain: 'a.example.test', events: 3, sites: 1 }
+      ])
+      expect(
+        await ScanLogService.topDomains({ since, limit: 1 })
+      ).toHaveLength(1)
+    })
+  })
   describe('countByScanID', () => {
     it('should return total', async () => {
       const viewScan = await helper()
@@ -93,6 +147,61 @@ describe('Scan Log Service', () => {
       const logEntry = await ScanLogService.work({ data: eventResult } as Job)
       expect(logEntry.scan_id).toBe(viewScan.id)
     })
+    it('promotes the held alert job once the job finished', async () => {
+      const viewScan = await helper()
+      const job = {
+        id: `scan-log-${chance.guid()}`,
+        data: ScanLogFactory.build({
+          entry: 'rule-alert',
+          rule: 'test.rule',
+          event: {
+            name: 'test-rule',
+            level: 'test',
+            message: chance.sentence(),
+            context: { foo: 'bar' },
+            alert: true
+          } as RuleAlert,
+          scan_id: viewScan.id,
+          created_at: new Date()
+        } as RuleAlertEvent)
+      } as Job
+      await ScanLogService.work(job)
+      const held = (await Queues.alertQueue.getDelayed()).find(
+        j => j.data.depends_on === job.id
+      )
+      // still held while bull has not marked the job completed
+      expect(await held.getState()).toBe('delayed')
+      await ScanLogService.releaseHeldBy(job)
+      expect(await held.getState()).toBe('waiting')
+      await held.remove()
+    })
+    it('should keep the event ID assigned by the scanner', async () => {
+      const viewScan = await helper()
+      const id = '3b241101-e2bb-4255-8caf-4136c566a962'
+      const logEntry = await ScanLogService.work({
+        data: {
+          id,
+          entry: 'request',
+          level: 'info',
+          scan_id: viewScan.id,
+          event: { url: 'https://example.com' }
+        }
+      } as Job)
+      expect(logEntry.id).toBe(id)
+    })
+    it('should ignore an invalid event ID', async () => {
+      const viewScan = await helper()
+      const logEntry = await ScanLogService.work({
+        data: {
+          id: 'not-a-uuid',
+          entry: 'request',
+          level: 'info',
+          scan_id: viewScan.id,
+          event: { url: 'https://example.com' }
+        }
+      } as Job)
+      expect(logEntry.id).not.toBe('not-a-uuid')
+    })
     it('should update scan state to "active"', async () => {
       const viewScan = await helper({ state: 'scheduled' })
       const eventResult = ScanLogFactory.build({
@@ -221,5 +330,520 @@ describe('Scan Log Service', () => {
       expect(result.alertEvent).not.toBeUndefined()
       expect(result.job).not.toBeUndefined()
     })
+    it('does not keep the alert when queueing it fails', async () => {
+      const spy = jest
+        .spyOn(Queues.alertQueue, 'add')
+        .mockRejectedValueOnce(new Error('redis down'))
+      await expect(
+        ScanLogService.handleAlert({
+          entry: 'rule-alert',
+          rule: 'test.rule',
+          level: 'info',
+          event: {
+            name: 'test-rule',
+            level: 'test',
+            message: 'queued later',
+            context: { foo: 'bar' },
+            alert: true
+          },
+          scan_id: testScan.id,
+          created_at: new Date()
+        })
+      ).rejects.toThrow('redis down')
+      spy.mockRestore()
+      const alerts = await Alert.query().where('scan_id', testScan.id)
+      expect(alerts).toHaveLength(0)
+    })
+    it('truncates oversized context fields', async () => {
+      const url = `https://example.com/?q=${'a'.repeat(5000)}`
+      const result = await ScanLogService.handleAlert({
+        entry: 'rule-alert',
+        rule: 'ioc.domain',
+        level: 'info',
+        event: {
+          name: 'ioc.domain',
+          level: 'prod',
+          message: 'example.com found in IOC list',
+          context: { domain: 'example.com', url },
+          alert: true
+        },
+        scan_id: testScan.id,
+        created_at: new Date()
+      })
+      const maxLength = config.alerts.context.maxFieldLength
+      expect(result.alertEvent.context.url).toBe(
+        `${url.slice(0, maxLength)}${truncationMarker(url.length - maxLength)}`
+      )
+      expect(result.alertEvent.context.domain).toBe('example.com')
+      expect(result.job.data.event.context.url).toBe(
+        result.alertEvent.context.url
+      )
+    })
+    describe('unknown.domain', () => {
+      const unknownDomainEvent = (
+        scan_id: string,
+        context: Record<string, unknown>
+      ): RuleAlertEvent => ({
+        entry: 'rule-alert',
+        rule: 'unknown.domain',
+        level: 'info',
+        event: {
+          name: 'unknown.domain',
+          level: 'prod',
+          message: `${context.domain} unknown`,
+          context,
+          alert: true
+        },
+        scan_id,
+        created_at: new Date()
+      })
+      it('uses the site severity', async () => {
+        await Site.query()
+          .findById(testScan.site_id)
+          .patch({ unknown_domain_severity: 'critical' })
+        const result = await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, { domain: chance.domain() })
+        )
+        expect(result.alertEvent.severity).toBe('critical')
+      })
+      it('raises the severity from the rule context', async () => {
+        const result = await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, {
+            domain: chance.domain(),
+            severity: 'high'
+          })
+        )
+        expect(result.alertEvent.severity).toBe('high')
+      })
+      it('alerts once per domain within the site TTL', async () => {
+        const domain = chance.domain()
+        const first = await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, { domain })
+        )
+        const second = await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, { domain })
+        )
+        expect(first.result).toBe('alerted')
+        expect(second.result).toBe('suppressed by alert-once window')
+      })
+      it('uses the site TTL override or the rule default', async () => {
+        const overridden = await helper()
+        await Site.query()
+          .findById(overridden.site_id)
+          .patch({ alert_ttl_minutes: 5 })
+        const domain = chance.domain()
+        await ScanLogService.handleAlert(
+          unknownDomainEvent(overridden.id, { domain })
+        )
+        await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, { domain })
+        )
+        const ttl = (site_id: string) =>
+          redisClient.ttl(`alert_once:${site_id}:unknown.domain:${domain}`)
+        expect(await ttl(overridden.site_id)).toBeLessThanOrEqual(5 * 60)
+        expect(await ttl(overridden.site_id)).toBeGreaterThan(0)
+        expect(await ttl(testScan.site_id)).toBeGreaterThan(5 * 60)
+        expect(
+          await alertOnceTTL('unknown.domain', { alert_ttl_minutes: null })
+        ).toBe(config.alerts.alertOnce.ttlMinutes['unknown.domain'])
+        expect(await alertOnceTTL('exfil', { alert_ttl_minutes: 5 })).toBe(
+          config.alerts.alertOnce.ttlMinutes.exfil
+        )
+      })
+      it('prefers site over organization over config windows', async () => {
+        const key = 'alerts.alertOnce.ttlMinutes.unknown.domain'
+        await SettingService.update(key, 30, 'admin')
+        try {
+          expect(
+            await alertOnceTTL('unknown.domain', { alert_ttl_minutes: null })
+          ).toBe(30)
+          expect(
+            await alertOnceTTL('unknown.domain', { alert_ttl_minutes: 5 })
+          ).toBe(5)
+        } finally {
+          await SettingService.reset(key, 'admin')
+        }
+      })
+      it('alerts exactly once under concurrent evaluation', async () => {
+        const domain = chance.domain()
+        const results = await Promise.all(
+          Array.from({ length: 25 }, () =>
+            ScanLogService.handleAlert(
+              unknownDomainEvent(testScan.id, { domain })
+            )
+          )
+        )
+        expect(results.filter(r => r.result === 'alerted')).toHaveLength(1)
+        const total = await Alert.query()
+          .where({ site_id: testScan.site_id, rule: 'unknown.domain' })
+          .resultSize()
+        expect(total).toBe(1)
+      })
+      it('peek does not claim the window', async () => {
+        const evt = unknownDomainEvent(testScan.id, { domain: chance.domain() })
+        expect(
+          await ScanLogService.peekAlertOnce(testScan.site_id, evt)
+        ).toBe(false)
+        expect(
+          await ScanLogService.peekAlertOnce(testScan.site_id, evt)
+        ).toBe(false)
+        const result = await ScanLogService.handleAlert(evt)
+        expect(result.result).toBe('alerted')
+        expect(
+          await ScanLogService.peekAlertOnce(testScan.site_id, evt)
+        ).toBe(true)
+      })
+      it('peeks several domains at once', async () => {
+        const alerted = chance.domain()
+        await ScanLogService.handleAlert(
+          unknownDomainEvent(testScan.id, { domain: alerted })
+        )
+        const actual = await ScanLogService.peekAlertOnceMany(
+          testScan.site_id,
+          [alerted, chance.domain()]
+        )
+        expect(Array.from(actual)).toEqual([alerted])
+      })
+      it('releases the claim when the alert fails', async () => {
+        const evt = unknownDomainEvent(testScan.id, { domain: chance.domain() })
+        const spy = jest.spyOn(Alert, 'query').mockImplementationOnce(() => {
+          throw new Error('insert failed')
+        })
+        await expect(ScanLogService.handleAlert(evt)).rejects.toThrow(
+          'insert failed'
+        )
+        spy.mockRestore()
+        expect(
+          await ScanLogService.peekAlertOnce(testScan.site_id, evt)
+        ).toBe(false)
+        const result = await ScanLogService.handleAlert(evt)
+        expect(result.result).toBe('alerted')
+      })
+    })
+    describe('exfil', () => {
+      const exfilEvent = (scan_id: string, domain: string): RuleAlertEvent => ({
+        entry: 'rule-alert',
+        rule: 'exfil',
+        level: 'info',
+        event: {
+          name: 'exfil',
+          level: 'prod',
+          message: `card fields (cvv) sent to ${domain}`,
+          context: { domain, severity: 'critical' },
+          alert: true
+        },
+        scan_id,
+        created_at: new Date()
+      })
+      it('dedupes within a scan with critical severity', async () => {
+        const domain = chance.domain()
+        const first = await ScanLogService.handleAlert(
+          exfilEvent(testScan.id, domain)
+        )
+        const second = await ScanLogService.handleAlert(
+          exfilEvent(testScan.id, domain)
+        )
+        expect(first.result).toBe('alerted')
+        expect(first.alertEvent.severity).toBe('critical')
+        expect(second.result).toBe('suppressed by alert-once window')
+      })
+      it('alerts again in the next scan', async () => {
+        const domain = chance.domain()
+        const nextScan = await ScanFactory.build({
+          source_id: testScan.source_id,
+          site_id: testScan.site_id
+        })
+          .$query()
+          .insert()
+        await ScanLogService.handleAlert(exfilEvent(testScan.id, domain))
+        const res = await ScanLogService.handleAlert(
+          exfilEvent(nextScan.id, domain)
+        )
+        expect(res.result).toBe('alerted')
+      })
+    })
+    describe('fingerprint dedupe', () => {
+      const windows = { ...config.alerts.dedupe.windowMinutes }
+      beforeEach(() => {
+        config.alerts.dedupe.windowMinutes = { '*': 0, 'ioc.domain': 30 }
+      })
+      afterEach(() => {
+        config.alerts.dedupe.windowMinutes = windows
+      })
+      const iocEvent = (scan_id: string, domain: string): RuleAlertEvent => ({
+        entry: 'rule-alert',
+        rule: 'ioc.domain',
+        level: 'info',
+        event: {
+          name: 'ioc.domain',
+          level: 'prod',
+          message: `${domain} matched an IOC`,
+          context: { domain },
+          alert: true
+        },
+        scan_id,
+        created_at: new Date()
+      })
+      it('returns the active alert instead of a duplicate', async () => {
+        const domain = chance.domain()
+        const first = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        expect(first.result).toBe('alerted')
+        expect(first.alertEvent.context.fingerprint).toBe(
+          alertFingerprint(testScan.site_id, iocEvent(testScan.id, domain))
+        )
+        // another scan of the same site
+        const next = await helper({ site_id: testScan.site_id })
+        const second = await ScanLogService.handleAlert(
+          iocEvent(next.id, domain)
+        )
+        const third = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        expect(second.result).toBe('suppressed by alert fingerprint')
+        expect(second.alertEvent.id).toBe(first.alertEvent.id)
+        expect(second.suppressed).toBe(1)
+        expect(third.suppressed).toBe(2)
+        expect(third.alertEvent.context.suppressed_duplicates).toBe(2)
+        const alerts = await Alert.query().where({
+          site_id: testScan.site_id,
+          rule: 'ioc.domain'
+        })
+        expect(alerts).toHaveLength(1)
+      })
+      it('alerts again once the alert is deleted', async () => {
+        const domain = chance.domain()
+        const first = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        await Alert.query().deleteById(first.alertEvent.id)
+        const second = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        expect(second.result).toBe('alerted')
+        expect(second.alertEvent.id).not.toBe(first.alertEvent.id)
+      })
+      it('only dedupes against open or acknowledged alerts', async () => {
+        const domain = chance.domain()
+        const first = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        await Alert.query()
+          .findById(first.alertEvent.id)
+          .patch({ status: 'acknowledged' })
+        const acked = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        expect(acked.result).toBe('suppressed by alert fingerprint')
+        await Alert.query()
+          .findById(first.alertEvent.id)
+          .patch({ status: 'resolved' })
+        const second = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, domain)
+        )
+        expect(second.result).toBe('alerted')
+        expect(second.alertEvent.id).not.toBe(first.alertEvent.id)
+      })
+      it('keeps distinct subjects and rules apart', async () => {
+        const domain = chance.domain()
+        await ScanLogService.handleAlert(iocEvent(testScan.id, domain))
+        const other = await ScanLogService.handleAlert(
+          iocEvent(testScan.id, chance.domain())
+        )
+        expect(other.result).toBe('alerted')
+        const evt = iocEvent(testScan.id, domain)
+        expect(
+          alertFingerprint(testScan.site_id, { ...evt, rule: 'websocket' })
+        ).not.toBe(alertFingerprint(testScan.site_id, evt))
+      })
+      it('uses the per rule window', () => {
+        expect(dedupeWindow('ioc.domain')).toBe(30)
+        expect(dedupeWindow('websocket')).toBe(0)
+      })
+    })
+    describe('rate limit', () => {
+      const limits = { ...config.alerts.rateLimit }
+      beforeEach(() => {
+        config.alerts.rateLimit.perScan = 2
+      })
+      afterEach(() => {
+        Object.assign(config.alerts.rateLimit, limits)
+      })
+      const domainEvent = (domain: string): RuleAlertEvent => ({
+        entry: 'rule-alert',
+        rule: 'unknown.domain',
+        level: 'info',
+        event: {
+          name: 'unknown.domain',
+          level: 'prod',
+          message: `${domain} unknown`,
+          context: { domain },
+          alert: true
+        },
+        scan_id: testScan.id,
+        created_at: new Date()
+      })
+      it('collapses alerts over the scan limit into a storm alert', async () => {
+        const domains = ['a.test', 'b.test', 'c.test', 'd.test', 'e.test']
+        const results = []
+        for (const domain of domains) {
+          results.push(await ScanLogService.handleAlert(domainEvent(domain)))
+        }
+        expect(results.map(r => r.result)).toEqual([
+          'alerted',
+          'alerted',
+          'suppressed by alert rate limit',
+          'suppressed by alert rate limit',
+          'suppressed by alert rate limit'
+        ])
+        const storms = await Alert.query().where({
+          scan_id: testScan.id,
+          rule: STORM_RULE
+        })
+        expect(storms).toHaveLength(1)
+        expect(storms[0].message).toBe(
+          'alert storm detected: 3 additional unknown domains suppressed'
+        )
+        expect(storms[0].context).toEqual({
+          rule: 'unknown.domain',
+          suppressed_count: 3,
+          domains: ['c.test', 'd.test', 'e.test']
+        })
+        // suppressed domains keep no alert-once window
+        expect(
+          await ScanLogService.peekAlertOnce(
+            testScan.site_id,
+            domainEvent('c.test')
+          )
+        ).toBe(false)
+        expect(
+          await ScanLogService.peekAlertOnce(
+            testScan.site_id,
+            domainEvent('a.test')
+          )
+        ).toBe(true)
+        const summary = await ScanService.summary(testScan.id)
+        expect(summary.suppressedAlerts).toBe(3)
+        expect(summary.suppressedDomains).toEqual(['c.test', 'd.test', 'e.test'])
+      })
+      it('caps the domain sample', async () => {
+        config.alerts.rateLimit.perScan = 0
+        config.alerts.rateLimit.sampleSize = 1
+        await ScanLogService.handleAlert(domainEvent('a.test'))
+        const res = await ScanLogService.handleAlert(domainEvent('b.test'))
+        expect(res.alertEvent.context).toEqual({
+          rule: 'unknown.domain',
+          suppressed_count: 2,
+          domains: ['a.test']
+        })
+      })
+      it('counts alerts over the cap on the scan', async () => {
+        config.alerts.rateLimit.overflow = 'count'
+        const results = []
+        for (const domain of ['a.test', 'b.test', 'c.test', 'd.test']) {
+          results.push(await ScanLogService.handleAlert(domainEvent(domain)))
+        }
+        expect(results.map(r => r.result)).toEqual([
+          'alerted',
+          'alerted',
+          'suppressed by alert cap',
+          'suppressed by alert cap'
+        ])
+        expect(results[3].suppressed).toBe(2)
+        const alerts = await Alert.query().where({ scan_id: testScan.id })
+        expect(alerts).toHaveLength(2)
+        const scan = await Scan.query().findById(testScan.id)
+        expect(scan.suppressed_alerts).toBe(2)
+        expect(
+          await ScanLogService.peekAlertOnce(
+            testScan.site_id,
+            domainEvent('d.test')
+          )
+        ).toBe(false)
+        const summary = await ScanService.summary(testScan.id)
+        expect(summary.suppressedAlerts).toBe(2)
+      })
+      it('releases the fingerprint of alerts not created', async () => {
+        const windows = { ...config.alerts.dedupe.windowMinutes }
+        config.alerts.dedupe.windowMinutes = { '*': 30 }
+        config.alerts.rateLimit.overflow = 'count'
+        try {
+          for (const domain of ['a.test', 'b.test', 'c.test']) {
+            await ScanLogService.handleAlert(domainEvent(domain))
+          }
+          const key = (domain: string) =>
+            `alert_fp:${alertFingerprint(
+              testScan.site_id,
+              domainEvent(domain)
+            )}`
+          expect(await redisClient.get(key('a.test'))).toBeTruthy()
+          expect(await redisClient.get(key('c.test'))).toBeNull()
+        } finally {
+          config.alerts.dedupe.windowMinutes = windows
+        }
+      })
+      it('is disabled by config', async () => {
+        config.alerts.rateLimit.enabled = false
+        for (const domain of ['a.test', 'b.test', 'c.test']) {
+          const res = await ScanLogService.handleAlert(domainEvent(domain))
+          expect(res.result).toBe('alerted')
+        }
+      })
+    })
+  })
+  describe('resolveSeverity', () => {
+    it('keeps the site severity when higher', async () => {
+      expect(
+        await ScanLogService.resolveSeverity(
+          'unknown.domain',
+          { severity: 'high' },
+          { unknown_domain_severity: 'critical' }
+        )
+      ).toBe('critical')
+    })
+    it('ignores unknown context severities', async () => {
+      expect(
+        await ScanLogService.resolveSeverity(
+          'unknown.domain',
+          { severity: 'urgent' },
+          {}
+        )
+      ).toBe('medium')
+    })
+    it('uses the context severity for other rules', async () => {
+      expect(
+        await ScanLogService.resolveSeverity(
+          'ioc.domain',
+          { severity: 'low' },
+          {}
+        )
+      ).toBe('low')
+      expect(
+        await ScanLogService.resolveSeverity('ioc.domain', {}, {})
+      ).toBeNull()
+    })
+    it('prefers site over organization over config severities', async () => {
+      await SettingService.update('alerts.severity.unknown.domain', 'high', 'a')
+      await SettingService.update('alerts.severity.ioc.domain', 'critical', 'a')
+      try {
+        expect(
+          await ScanLogService.resolveSeverity('unknown.domain', {}, {})
+        ).toBe('high')
+        expect(
+          await ScanLogService.resolveSeverity(
+            'unknown.domain',
+            {},
+            { unknown_domain_severity: 'low' }
+          )
+        ).toBe('low')
+        expect(
+          await ScanLogService.resolveSeverity('ioc.domain', {}, {})
+        ).toBe('critical')
+      } finally {
+        await SettingService.reset('alerts.severity.unknown.domain', 'a')
+        await SettingService.reset('alerts.severity.ioc.domain', 'a')
+      }
+    })
   })
 })
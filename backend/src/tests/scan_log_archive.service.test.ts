@@ -0,0 +1,155 @@
+import { ScanLog, Scan } from '../models'
+import { ObjectStorage } from '../lib/object-storage'
+import { Metrics } from '../lib/metrics'
+import ScanLogArchiveService from '../services/scan_log_archive'
+import ScanLogService from '../services/scan_logs'
+import ScanService from '../services/scan'
+import ScanFactory from './factories/scans.factory'
+import ScanLogFactory from './factories/scan_log.factory'
+import SiteFactory from './factories/sites.factory'
+import SourceFactory from './factories/sources.factory'
+import { resetDB } from './utils'
+
+const daysAgo = (days: number) =>
+  new Date(Date.now() - days * 24 * 60 * 60 * 1000)
+
+class MemoryStorage implements ObjectStorage {
+  objects = new Map<string, string>()
+  failing = false
+
+  async put(key: string, body: string): Promise<void> {
+    if (this.failing) throw new Error('unavailable')
+    this.objects.set(key, body)
+  }
+
+  async get(key: string): Promise<string> {
+    return this.objects.get(key)
+  }
+
+  async delete(key: string): Promise<void> {
+    this.objects.delete(key)
+  }
+}
+
+describe('Scan Log Archive Service', () => {
+  let scan: Scan
+  let storage: MemoryStorage
+  const screenshot = { payload: 'aGVsbG8=' }
+  beforeEach(async () => {
+    await resetDB()
+    storage = new MemoryStorage()
+    const source = await SourceFactory.build().$query().insert()
+    const site = await SiteFactory.build({ source_id: source.id })
+      .$query()
+      .insert()
+    scan = await ScanFactory.build({
+      created_at: daysAgo(20),
+      source_id: source.id,
+      site_id: site.id,
+    })
+      .$query()
+      .insert()
+  })
+  const insertLog = (entry: string, created_at: Date) =>
+    ScanLogFactory.build({
+      entry,
+      event: screenshot,
+      scan_id: scan.id,
+      created_at,
+    } as Partial<ScanLog>)
+      .$query()
+      .insert()
+
+  describe('archive', () => {
+    it('moves old events to storage', async () => {
+      const old = await insertLog('screenshot', daysAgo(10))
+      const recent = await insertLog('screenshot', daysAgo(1))
+      const gauges: number[] = []
+      const stats: Metrics = {
+        timing: () => undefined,
+        increment: () => undefined,
+        gauge: (_name, value) => gauges.push(value),
+      }
+      const res = await ScanLogArchiveService.archive(7, {
+        storage,
+        entries: ['screenshot'],
+        stats,
+      })
+      expect(res.events).toBe(1)
+      expect(res.bytes).toBe(JSON.stringify(screenshot).length)
+      expect(gauges).toEqual([res.bytes])
+      const archived = await ScanLog.query().findById(old.id)
+      expect(archived.event).toEqual({ archived: true })
+      expect(archived.archived_at).toBeTruthy()
+      expect(JSON.parse(storage.objects.get(archived.storage_key))).toEqual(
+        screenshot
+      )
+      const kept = await ScanLog.query().findById(recent.id)
+      expect(kept.archived_at).toBeNull()
+      expect(kept.event).toEqual(screenshot)
+    })
+    it('skips entries not archived', async () => {
+      const log = await insertLog('complete', daysAgo(10))
+      await ScanLogArchiveService.archive(7, {
+        storage,
+        entries: ['screenshot'],
+      })
+      expect((await ScanLog.query().findById(log.id)).archived_at).toBeNull()
+    })
+    it('keeps the event when the upload fails', async () => {
+      const log = await insertLog('screenshot', daysAgo(10))
+      storage.failing = true
+      const res = await ScanLogArchiveService.archive(7, { storage })
+      expect(res.events).toBe(0)
+      const kept = await ScanLog.query().findById(log.id)
+      expect(kept.archived_at).toBeNull()
+      expect(kept.event).toEqual(screenshot)
+    })
+    it('is disabled without afterDays', async () => {
+      await insertLog('screenshot', daysAgo(10))
+      const res = await ScanLogArchiveService.archive(0, { storage })
+      expect(res.events).toBe(0)
+      expect(storage.objects.size).toBe(0)
+    })
+  })
+
+  describe('restore', () => {
+    it('fetches archived events from storage', async () => {
+      const log = await insertLog('screenshot', daysAgo(10))
+      await ScanLogArchiveService.archive(7, { storage })
+      const restored = await ScanLogArchiveService.restore(
+        await ScanLog.query().findById(log.id),
+        storage
+      )
+      expect(restored.event).toEqual(screenshot)
+    })
+    it('returns other events as is', async () => {
+      const log = await insertLog('screenshot', daysAgo(1))
+      const restored = await ScanLogArchiveService.restore(log, storage)
+      expect(restored.event).toEqual(screenshot)
+    })
+    it('leaves views of events not archived untouched', async () => {
+      const log = await insertLog('screenshot', daysAgo(1))
+      expect((await ScanLogService.view(log.id)).event).toEqual(screenshot)
+    })
+  })
+
+  describe('purgeArchived', () => {
+    it('deletes archived events and objects past the window', async () => {
+      const log = await insertLog('screenshot', daysAgo(10))
+      await ScanLogArchiveService.archive(7, { storage })
+      expect(await ScanLogArchiveService.purgeArchived(30, { storage })).toBe(0)
+      expect(storage.objects.size).toBe(1)
+      expect(await ScanLogArchiveService.purgeArchived(9, { storage })).toBe(1)
+      expect(storage.objects.size).toBe(0)
+      expect(await ScanLog.query().findById(log.id)).toBeUndefined()
+    })
+    it('keeps scans holding archived events', async () => {
+      await insertLog('screenshot', daysAgo(20))
+      await ScanLogArchiveService.archive(7, { storage })
+      expect(await ScanService.purge(14, {})).toBe(0)
+      await ScanLogArchiveService.purgeArchived(15, { storage })
+      expect(await ScanService.purge(14, {})).toBe(1)
+    })
+  })
+})
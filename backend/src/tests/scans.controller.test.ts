@@ -1,5 +1,6 @@
 import request from 'supertest'
 import Chance from 'chance'
+import { config } from 'node-config-ts'
 import { knex, Source } from '../models'
 import { Scan, Site } from '../models'
 
@@ -9,6 +10,7 @@ import SourceFactory from './factories/sources.factory'
 import ScanLogFactory from './factories/scan_log.factory'
 
 import { makeSession, resetDB } from './utils'
+import ScanLogService from '../services/scan_logs'
 import { WebRequestEvent } from '@merrymaker/types'
 
 const chance = Chance()
@@ -35,6 +37,17 @@ const adminSession = () =>
     isAuth: true
   }).app
 
+const transportSession = () =>
+  makeSession({
+    firstName: 'Transport',
+    lastName: 'User',
+    role: 'transport',
+    lanid: 'transport',
+    email: 'transport@example.com',
+    isAuth: true,
+    exp: 0
+  }).app
+
 describe('Scan Controller', () => {
   let seedA: Scan
   let siteSeedA: Site
@@ -80,6 +93,92 @@ describe('Scan Controller', () => {
       expect(res.body.total).toBe(1)
       expect(res.body.results[0].id).toBe(seedA.id)
     })
+    it('should filter on multiple states', async () => {
+      await ScanFactory.build({
+        site_id: siteSeedA.id,
+        source_id: sourceSeed.id,
+        state: 'failed'
+      })
+        .$query()
+        .insert()
+      await ScanFactory.build({
+        site_id: siteSeedA.id,
+        source_id: sourceSeed.id,
+        state: 'expired'
+      })
+        .$query()
+        .insert()
+      const res = await request(userSession())
+        .get('/api/scans')
+        .query({ 'state[]': 'failed,expired' })
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(2)
+    })
+    describe('cursor pagination', () => {
+      const list = (query: Record<string, unknown>) =>
+        request(userSession())
+          .get('/api/scans')
+          .query({
+            pageSize: 2,
+            orderColumn: 'created_at',
+            orderDirection: 'desc',
+            ...query
+          })
+      beforeEach(async () => {
+        // 5 scans in total, oldest first
+        for (let i = 3; i > 0; i--) {
+          await ScanFactory.build({
+            site_id: siteSeedA.id,
+            source_id: sourceSeed.id,
+            created_at: new Date(Date.now() + i * 60000)
+          })
+            .$query()
+            .insert()
+        }
+      })
+      it('should walk every page with cursors', async () => {
+        const first = await list({})
+        expect(first.status).toBe(200)
+        expect(first.body.total).toBe(5)
+        expect(first.body.prev_cursor).toBeNull()
+        const second = await list({ cursor_after: first.body.next_cursor })
+        expect(second.status).toBe(200)
+        expect(second.body.total).toBeUndefined()
+        const third = await list({ cursor_after: second.body.next_cursor })
+        expect(third.body.results).toHaveLength(1)
+        expect(third.body.next_cursor).toBeNull()
+        const ids = [first, second, third].reduce(
+          (acc: string[], page) =>
+            acc.concat(page.body.results.map((r: Scan) => r.id)),
+          []
+        )
+        expect(new Set(ids).size).toBe(5)
+      })
+      it('should page back with cursor_before', async () => {
+        const first = await list({})
+        const second = await list({ cursor_after: first.body.next_cursor })
+        const back = await list({ cursor_before: second.body.prev_cursor })
+        expect(back.body.results.map((r: Scan) => r.id)).toEqual(
+          first.body.results.map((r: Scan) => r.id)
+        )
+        expect(back.body.prev_cursor).toBeNull()
+      })
+      it('should keep the offset fallback', async () => {
+        const res = await list({ page: 3 })
+        expect(res.body.results).toHaveLength(1)
+        expect(res.body.next_cursor).toBeNull()
+      })
+      it('should reject an invalid cursor', async () => {
+        const res = await list({ cursor_after: 'not-a-cursor' })
+        expect(res.status).toBe(400)
+      })
+    })
+    it('should return 400 when every state is invalid', async () => {
+      const res = await request(userSession())
+        .get('/api/scans')
+        .query({ 'state[]': 'dead_letter' })
+      expect(res.status).toBe(400)
+    })
   })
   describe('GET /api/scans/:id', () => {
     it('should get a Scan record', async () => {
@@ -103,6 +202,34 @@ describe('Scan Controller', () => {
       expect(res.status).toBe(422)
     })
   })
+  describe('POST /api/scans/:id/cancel', () => {
+    it('should cancel a scheduled scan', async () => {
+      await Scan.query()
+        .patch({ state: 'scheduled' })
+        .findById(seedA.id)
+      const res = await request(adminSession()).post(
+        `/api/scans/${seedA.id}/cancel`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.state).toBe('cancelled')
+    })
+    it('should reject cancelling an active scan', async () => {
+      await Scan.query()
+        .patch({ state: 'active' })
+        .findById(seedA.id)
+      const res = await request(adminSession()).post(
+        `/api/scans/${seedA.id}/cancel`
+      )
+      expect(res.status).toBe(422)
+      expect(res.body.message).toBe('Cannot cancel active scan')
+    })
+    it('should be restricted to admins', async () => {
+      const res = await request(userSession()).post(
+        `/api/scans/${seedA.id}/cancel`
+      )
+      expect(res.status).toBe(403)
+    })
+  })
   describe('POST /api/scans/bulk_delete', () => {
     it('should bulk delete scans', async () => {
       const res = await request(adminSession())
@@ -128,6 +255,339 @@ describe('Scan Controller', () => {
       )
       expect(res.status).toBe(200)
       expect(res.body.totalReq).toBe(10)
+      expect(res.body.learningMode).toBe(false)
+    })
+    it('should flag scans run in learning mode', async () => {
+      await Site.query()
+        .patch({ baseline_until: new Date(Date.now() + 60 * 60 * 1000) })
+        .findById(siteSeedA.id)
+      const res = await request(userSession()).get(
+        `/api/scans/${seedA.id}/summary`
+      )
+      expect(res.body.learningMode).toBe(true)
+    })
+  })
+  // buffers the NDJSON body as text
+  const ndjson = (
+    res: NodeJS.ReadableStream,
+    cb: (err: Error | null, body: string) => void
+  ) => {
+    let body = ''
+    res.setEncoding('utf8')
+    res.on('data', chunk => (body += chunk))
+    res.on('end', () => cb(null, body))
+  }
+  const lines = (body: string) =>
+    body
+      .split('\n')
+      .filter(line => line.length > 0)
+      .map(line => JSON.parse(line))
+  describe('GET /api/scans/:id/events/export', () => {
+    const exportEvents = (query: Record<string, string> = {}) =>
+      request(userSession())
+        .get(`/api/scans/${seedA.id}/events/export`)
+        .query(query)
+        .buffer(true)
+        .parse(ndjson)
+    beforeEach(async () => {
+      const base = Date.now()
+      for (let i = 0; i < 7; i += 1) {
+        await ScanLogFactory.build({
+          entry: 'request',
+          event: { url: `https://example.test/${i}` } as WebRequestEvent,
+          scan_id: seedA.id,
+          // pairs share a timestamp, ordered by id
+          created_at: new Date(base + Math.floor(i / 2) * 1000)
+        })
+          .$query()
+          .insert()
+      }
+    })
+    it('should stream the scan logs as NDJSON', async () => {
+      const res = await exportEvents()
+      expect(res.status).toBe(200)
+      expect(res.header['content-type']).toMatch('application/x-ndjson')
+      expect(res.header['content-disposition']).toBe(
+        `attachment; filename="scan-${seedA.id}.ndjson"`
+      )
+      expect(res.header['x-total-count']).toBe('7')
+      const rows = lines(res.body)
+      expect(rows).toHaveLength(7)
+      expect(rows.every(row => row.scan_id === seedA.id)).toBe(true)
+      expect(rows.every(row => typeof row.cursor === 'string')).toBe(true)
+    })
+    it('should resume after the cursor without duplicates or gaps', async () => {
+      const full = lines((await exportEvents()).body)
+      // interrupted after 3 rows
+      const received = full.slice(0, 3)
+      const res = await exportEvents({
+        after_cursor: received[received.length - 1].cursor
+      })
+      expect(res.header['x-total-count']).toBe('4')
+      const resumed = [...received, ...lines(res.body)]
+      expect(resumed.map(row => row.id)).toEqual(full.map(row => row.id))
+      expect(new Set(resumed.map(row => row.id)).size).toBe(7)
+    })
+    it('should reject invalid cursors', async () => {
+      const res = await exportEvents({ after_cursor: 'nope' })
+      expect(res.status).toBe(400)
+    })
+    it('should limit concurrent exports per user', async () => {
+      const { maxPerUser } = config.scans.export
+      for (let i = 0; i < maxPerUser; i += 1) {
+        await ScanLogService.acquireExport('z000n00', maxPerUser)
+      }
+      try {
+        const res = await request(userSession()).get(
+          `/api/scans/${seedA.id}/events/export`
+        )
+        expect(res.status).toBe(429)
+      } finally {
+        for (let i = 0; i < maxPerUser; i += 1) {
+          await ScanLogService.releaseExport('z000n00')
+        }
+      }
+      const res = await exportEvents()
+      expect(res.status).toBe(200)
+    })
+  })
+  describe('GET /api/scans/:id/events.ndjson', () => {
+    const eventsNDJSON = (query: Record<string, string | string[]> = {}) =>
+      request(userSession())
+        .get(`/api/scans/${seedA.id}/events.ndjson`)
+        .query(query)
+        .buffer(true)
+        .parse(ndjson)
+    beforeEach(async () => {
+      const insert = (entry: string, event: Record<string, unknown>) =>
+        ScanLogFactory.build({
+          entry,
+          event,
+          scan_id: seedA.id,
+          created_at: new Date()
+        })
+          .$query()
+          .insert()
+      await insert('request', { url: 'https://cdn.example.test/app.js' })
+      await insert('request', { url: 'https://other.test/' })
+      await insert('screenshot', { payload: 'aW1hZ2U=', type: 'png' })
+    })
+    it('should stream every event of the scan', async () => {
+      const res = await eventsNDJSON()
+      expect(res.status).toBe(200)
+      expect(res.header['content-type']).toMatch('application/x-ndjson')
+      expect(res.header['content-disposition']).toMatch('attachment')
+      expect(lines(res.body)).toHaveLength(3)
+    })
+    it('should honor the list filters', async () => {
+      const byEntry = await eventsNDJSON({ 'entry[]': ['screenshot'] })
+      expect(lines(byEntry.body).map(row => row.entry)).toEqual(['screenshot'])
+      const bySearch = await eventsNDJSON({
+        search: 'cdn.example',
+        search_body: 'true'
+      })
+      expect(lines(bySearch.body).map(row => row.event.url)).toEqual([
+        'https://cdn.example.test/app.js'
+      ])
+      const byWhere = await eventsNDJSON({ where: 'url~"other"' })
+      expect(lines(byWhere.body)).toHaveLength(1)
+    })
+    it('should trim screenshot images', async () => {
+      const full = lines((await eventsNDJSON()).body)
+      expect(full.find(row => row.entry === 'screenshot').event.payload).toBe(
+        'aW1hZ2U='
+      )
+      const trimmed = lines((await eventsNDJSON({ trim: '1' })).body)
+      const screenshot = trimmed.find(row => row.entry === 'screenshot')
+      expect(screenshot.event).toEqual({ type: 'png', payload_trimmed: true })
+      // other events are untouched
+      expect(
+        trimmed.filter(row => row.entry === 'request').map(row => row.event)
+      ).toEqual(
+        full.filter(row => row.entry === 'request').map(row => row.event)
+      )
+    })
+    it('should reject invalid filters', async () => {
+      const res = await eventsNDJSON({ where: 'response.status>=' })
+      expect(res.status).toBe(400)
+    })
+  })
+  describe('GET /api/scans/:id/rules', () => {
+    it('should list rules disabled for the site', async () => {
+      await Site.query()
+        .patch({
+          rules_config: {
+            yara: { enabled: false },
+            'unknown.domain': { enabled: true },
+            'ioc.url': { enabled: false }
+          }
+        })
+        .findById(siteSeedA.id)
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({
+        site_id: siteSeedA.id,
+        disabled: ['ioc.url', 'yara'],
+        ioc_exceptions: [],
+        untrusted_suffixes: [],
+        learning: false,
+        baseline_until: null
+      })
+    })
+    it('should report learning mode until baseline_until', async () => {
+      const until = new Date(Date.now() + 60 * 60 * 1000)
+      await Site.query()
+        .patch({ baseline_until: until })
+        .findById(siteSeedA.id)
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.body.learning).toBe(true)
+      expect(new Date(res.body.baseline_until)).toEqual(until)
+    })
+    it('should leave learning mode once baseline_until passed', async () => {
+      await Site.query()
+        .patch({ baseline_until: new Date(Date.now() - 1000) })
+        .findById(siteSeedA.id)
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.body.learning).toBe(false)
+    })
+    it('should list the site IOC exceptions', async () => {
+      await Site.query()
+        .patch({ ioc_exceptions: ['Partner.test', '203.0.113.7'] })
+        .findById(siteSeedA.id)
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.body.ioc_exceptions).toEqual(['partner.test', '203.0.113.7'])
+    })
+    it('should list the suffixes un-trusted by the site', async () => {
+      await Site.query()
+        .patch({ untrusted_suffixes: ['*.CloudFront.net', 'gstatic.com'] })
+        .findById(siteSeedA.id)
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.body.untrusted_suffixes).toEqual([
+        'cloudfront.net',
+        'gstatic.com'
+      ])
+    })
+    it('should return no disabled rules without a config', async () => {
+      const res = await request(transportSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.disabled).toEqual([])
+    })
+    it('should be restricted to transport', async () => {
+      const res = await request(userSession()).get(
+        `/api/scans/${seedA.id}/rules`
+      )
+      expect(res.status).toBe(403)
+    })
+  })
+  describe('GET /api/scans/:id/rules-results', () => {
+    const ruleAlert = (event: Record<string, unknown>, created_at: Date) =>
+      ScanLogFactory.build({
+        entry: 'rule-alert',
+        event,
+        scan_id: seedA.id,
+        created_at
+      })
+        .$query()
+        .insert()
+    const learned = (url: string, context: Record<string, unknown>) => ({
+      name: 'unknown.domain',
+      alert: false,
+      level: 'prod',
+      message: 'cdn.learning.test unknown (learning mode)',
+      context: { url, domain: 'cdn.learning.test', learning: true, ...context }
+    })
+    it('should return per-domain would-alert details', async () => {
+      await Site.query()
+        .patch({ baseline_until: new Date(Date.now() + 60 * 60 * 1000) })
+        .findById(siteSeedA.id)
+      await ruleAlert(
+        learned('https://cdn.learning.test/a.js', {
+          page_url: 'https://www.site.test/checkout',
+          seen_at: '2022-09-01T10:00:00.000Z'
+        }),
+        new Date('2022-09-01T10:00:01.000Z')
+      )
+      await ruleAlert(
+        learned('https://cdn.learning.test/b.js', {
+          page_url: 'https://www.site.test/cart',
+          seen_at: '2022-09-01T10:00:05.000Z'
+        }),
+        new Date('2022-09-01T10:00:06.000Z')
+      )
+      await ruleAlert(
+        {
+          name: 'ioc.domain',
+          alert: true,
+          level: 'prod',
+          message: 'IOC match',
+          context: { url: 'https://bad.test' }
+        },
+        new Date('2022-09-01T10:00:02.000Z')
+      )
+      const res = await request(userSession()).get(
+        `/api/scans/${seedA.id}/rules-results`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body).toEqual({
+        scan_id: seedA.id,
+        learning_mode: true,
+        target_drift: null,
+        alerts: { 'ioc.domain': 1 },
+        would_alert: [
+          {
+            rule: 'unknown.domain',
+            domain: 'cdn.learning.test',
+            message: 'cdn.learning.test unknown (learning mode)',
+            page_url: 'https://www.site.test/checkout',
+            request_url: 'https://cdn.learning.test/a.js',
+            first_seen: '2022-09-01T10:00:00.000Z',
+            count: 2
+          }
+        ]
+      })
+    })
+    it('should fall back to the landing URL and log time', async () => {
+      await ScanLogFactory.build({
+        entry: 'request',
+        event: {
+          url: 'https://www.site.test/',
+          resourceType: 'document'
+        } as WebRequestEvent,
+        scan_id: seedA.id,
+        created_at: new Date('2022-09-01T09:59:59.000Z')
+      })
+        .$query()
+        .insert()
+      await ruleAlert(
+        learned('https://cdn.learning.test/a.js', {}),
+        new Date('2022-09-01T10:00:01.000Z')
+      )
+      const res = await request(userSession()).get(
+        `/api/scans/${seedA.id}/rules-results`
+      )
+      expect(res.body.learning_mode).toBe(false)
+      expect(res.body.would_alert[0].page_url).toBe('https://www.site.test/')
+      expect(res.body.would_alert[0].first_seen).toBe(
+        '2022-09-01T10:00:01.000Z'
+      )
+    })
+    it('should return 404 for unknown scans', async () => {
+      const res = await request(userSession()).get(
+        `/api/scans/${chance.guid({ version: 4 })}/rules-results`
+      )
+      expect(res.status).toBe(404)
     })
   })
 })
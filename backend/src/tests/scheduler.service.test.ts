@@ -0,0 +1,333 @@
+import Bull, { Queue } from 'bull'
+import { subMinutes } from 'date-fns'
+import MerryMaker from '@merrymaker/types'
+import { knex, Site, Source } from '../models'
+import SiteFactory from './factories/sites.factory'
+import SourceFactory from './factories/sources.factory'
+import ScanFactory from './factories/scans.factory'
+import { resetDB } from './utils'
+
+import SchedulerService from '../services/scheduler'
+import ScanService from '../services/scan'
+import { Metrics } from '../lib/metrics'
+import { createClient } from '../repos/redis'
+
+const fakeQueue = () => {
+  const add = jest.fn(async () => ({ id: 1 }))
+  return {
+    add,
+    queue: ({ add } as unknown) as Queue<MerryMaker.ScanQueueJob>,
+  }
+}
+
+const scanQueue = new Bull<MerryMaker.ScanQueueJob>(
+  'test-scheduler-scan-queue',
+  { createClient }
+)
+
+describe('Scheduler Service', () => {
+  let sourceSeed: Source
+  let siteSeed: Site
+  beforeEach(async () => {
+    await resetDB()
+    sourceSeed = await SourceFactory.build().$query().insert()
+    siteSeed = await SiteFactory.build({
+      source_id: sourceSeed.id,
+      last_run: subMinutes(new Date(), 65),
+    })
+      .$query()
+      .insert()
+  })
+  afterAll(async () => {
+    await scanQueue.close()
+    knex.destroy()
+  })
+
+  const seedPending = async (total: number) => {
+    for (let i = 0; i < total; i += 1) {
+      await ScanFactory.build({
+        site_id: siteSeed.id,
+        source_id: sourceSeed.id,
+        state: i % 2 ? 'active' : 'scheduled',
+      })
+        .$query()
+        .insert()
+    }
+  }
+
+  describe('tick', () => {
+    it('schedules runnable sites', async () => {
+      const { add, queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'queue',
+      })
+      expect(res).toEqual({ due: 1, scheduled: 1, throttled: 0, caughtUp: 0 })
+      expect(add).toHaveBeenCalledTimes(1)
+    })
+    it('ignores queue depth with the "queue" policy', async () => {
+      await seedPending(3)
+      const { queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'queue',
+        maxQueueDepth: 2,
+      })
+      expect(res.scheduled).toBe(1)
+    })
+    it('throttles sites at max queue depth with "queue-bounded"', async () => {
+      await seedPending(2)
+      const { add, queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'queue-bounded',
+        maxQueueDepth: 2,
+      })
+      expect(res).toEqual({ due: 1, scheduled: 0, throttled: 1, caughtUp: 0 })
+      expect(add).not.toHaveBeenCalled()
+    })
+    it('schedules below max queue depth with "queue-bounded"', async () => {
+      await seedPending(1)
+      const { queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'queue-bounded',
+        maxQueueDepth: 2,
+      })
+      expect(res.scheduled).toBe(1)
+    })
+    it('throttles sites with a pending scan with "skip"', async () => {
+      await seedPending(1)
+      const { add, queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'skip',
+        maxQueueDepth: 5,
+      })
+      expect(res).toEqual({ due: 1, scheduled: 0, throttled: 1, caughtUp: 0 })
+      expect(add).not.toHaveBeenCalled()
+    })
+    it('schedules sites without pending scans with "skip"', async () => {
+      const { queue } = fakeQueue()
+      const res = await SchedulerService.tick(queue, {
+        overrunPolicy: 'skip',
+      })
+      expect(res.scheduled).toBe(1)
+    })
+    describe('catch-up', () => {
+      beforeEach(async () => {
+        // down for a day, 24 intervals missed
+        await siteSeed
+          .$query()
+          .patch({ last_run: subMinutes(new Date(), 24 * 60) })
+      })
+      it('schedules a single scan for a long overdue site', async () => {
+        const { add, queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue',
+          maxCatchUpMinutes: 60,
+        })
+        expect(res).toEqual({
+          due: 1,
+          scheduled: 1,
+          throttled: 0,
+          caughtUp: 1,
+        })
+        expect(add).toHaveBeenCalledTimes(1)
+        // next-due marker moved to now
+        const again = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue',
+          maxCatchUpMinutes: 60,
+        })
+        expect(again.due).toBe(0)
+        expect(add).toHaveBeenCalledTimes(1)
+      })
+      it('does not report catch-up within the window', async () => {
+        const { queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue',
+          maxCatchUpMinutes: 48 * 60,
+        })
+        expect(res.caughtUp).toBe(0)
+        expect(res.scheduled).toBe(1)
+      })
+    })
+    describe('site overrun policy', () => {
+      it('throttles a "queue-bounded" site over the "queue" default', async () => {
+        await siteSeed.$query().patch({ overrun_policy: 'queue-bounded' })
+        await seedPending(2)
+        const { add, queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue',
+          maxQueueDepth: 2,
+        })
+        expect(res).toEqual({
+          due: 1,
+          scheduled: 0,
+          throttled: 1,
+          caughtUp: 0,
+        })
+        expect(add).not.toHaveBeenCalled()
+      })
+      it('schedules a "queue" site over the "queue-bounded" default', async () => {
+        await siteSeed.$query().patch({ overrun_policy: 'queue' })
+        await seedPending(3)
+        const { queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue-bounded',
+          maxQueueDepth: 2,
+        })
+        expect(res).toEqual({
+          due: 1,
+          scheduled: 1,
+          throttled: 0,
+          caughtUp: 0,
+        })
+      })
+      it('throttles a "skip" site over the "queue" default', async () => {
+        await siteSeed.$query().patch({ overrun_policy: 'skip' })
+        await seedPending(1)
+        const { queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue',
+        })
+        expect(res.throttled).toBe(1)
+      })
+      it('uses the default when not set', async () => {
+        await seedPending(2)
+        const { queue } = fakeQueue()
+        const res = await SchedulerService.tick(queue, {
+          overrunPolicy: 'queue-bounded',
+          maxQueueDepth: 2,
+        })
+        expect(res.throttled).toBe(1)
+      })
+    })
+  })
+  describe('queue priority', () => {
+    afterEach(async () => {
+      await scanQueue.empty()
+    })
+    // names of the queued scans in the order a scanner reserves them
+    const reserved = async (): Promise<string[]> => {
+      const names: string[] = []
+      let job = await scanQueue.getNextJob()
+      while (job) {
+        names.push(job.data.name)
+        await job.discard()
+        await job.moveToFailed({ message: 'test' }, true)
+        job = await scanQueue.getNextJob()
+      }
+      return names
+    }
+    it('reserves scans of higher priority sites first', async () => {
+      await siteSeed.$query().patch({ name: 'low', priority: 10 })
+      await SchedulerService.tick(scanQueue, {
+        overrunPolicy: 'queue',
+        agingPerMinute: 0,
+      })
+      // due after the low priority site was queued
+      await SiteFactory.build({
+        name: 'high',
+        source_id: sourceSeed.id,
+        priority: 90,
+        last_run: subMinutes(new Date(), 65),
+      })
+        .$query()
+        .insert()
+      await SchedulerService.tick(scanQueue, {
+        overrunPolicy: 'queue',
+        agingPerMinute: 0,
+      })
+      expect(await reserved()).toEqual(['high', 'low'])
+    })
+    it('reserves capped long overdue sites first, oldest first', async () => {
+      // just due, 95 with aging
+      await siteSeed.$query().patch({ name: 'fresh', priority: 90 })
+      await SchedulerService.tick(scanQueue, {
+        overrunPolicy: 'queue',
+        agingPerMinute: 1,
+      })
+      // both aged past the cap
+      for (const [name, minutes] of [
+        ['overdue', 180],
+        ['oldest', 240],
+      ] as const) {
+        await SiteFactory.build({
+          name,
+          source_id: sourceSeed.id,
+          priority: 25,
+          last_run: subMinutes(new Date(), minutes),
+        })
+          .$query()
+          .insert()
+      }
+      await SchedulerService.tick(scanQueue, {
+        overrunPolicy: 'queue',
+        agingPerMinute: 1,
+      })
+      expect(await reserved()).toEqual(['oldest', 'overdue', 'fresh'])
+    })
+    it('reserves test scans first', async () => {
+      await siteSeed.$query().patch({ name: 'site', priority: 100 })
+      await SchedulerService.tick(scanQueue, {
+        overrunPolicy: 'queue',
+        agingPerMinute: 0,
+      })
+      await ScanService.schedule(scanQueue, {
+        source: sourceSeed,
+        test: true,
+      })
+      expect(await reserved()).toEqual([sourceSeed.name, 'site'])
+    })
+  })
+  describe('timedTick', () => {
+    const fakeMetrics = () => ({
+      timing: jest.fn(),
+      gauge: jest.fn(),
+      increment: jest.fn(),
+    })
+    afterEach(() => {
+      jest.restoreAllMocks()
+    })
+    it('runs without a metrics client', async () => {
+      const { queue } = fakeQueue()
+      const res = await SchedulerService.timedTick(queue, null, {
+        overrunPolicy: 'queue',
+      })
+      expect(res.scheduled).toBe(1)
+    })
+    it('reports tick metrics', async () => {
+      const client = fakeMetrics()
+      const { queue } = fakeQueue()
+      await SchedulerService.timedTick(queue, client as Metrics, {
+        overrunPolicy: 'queue',
+      })
+      const tags = { status: 'ok' }
+      expect(client.timing).toHaveBeenCalledWith(
+        'scheduler.tick.duration_ms',
+        expect.any(Number),
+        tags
+      )
+      expect(client.gauge).toHaveBeenCalledWith(
+        'scheduler.tick.tasks_due',
+        1,
+        tags
+      )
+      expect(client.gauge).toHaveBeenCalledWith(
+        'scheduler.tick.tasks_processed',
+        1,
+        tags
+      )
+    })
+    it('tags failed ticks', async () => {
+      jest
+        .spyOn(ScanService, 'totalScheduled')
+        .mockRejectedValue(new Error('db down'))
+      const client = fakeMetrics()
+      const { queue } = fakeQueue()
+      await expect(
+        SchedulerService.timedTick(queue, client as Metrics)
+      ).rejects.toThrow('db down')
+      expect(client.increment).toHaveBeenCalledWith('scheduler.tick.errors', {
+        status: 'error',
+      })
+      expect(client.gauge).not.toHaveBeenCalled()
+    })
+  })
+})
@@ -0,0 +1,58 @@
+import fs from 'fs'
+import os from 'os'
+import path from 'path'
+import { knex } from '../models'
+import {
+  appliedMigrations,
+  checkSchema,
+  pendingMigrations,
+  shippedMigrations,
+  SchemaOutdatedError,
+} from '../lib/schema'
+
+describe('Schema check', () => {
+  let dir: string
+  beforeEach(() => {
+    dir = fs.mkdtempSync(path.join(os.tmpdir(), 'migrations-'))
+  })
+  afterEach(() => {
+    fs.rmdirSync(dir, { recursive: true })
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  it('lists the shipped migrations', () => {
+    ;['20210101000000_b.js', '20200101000000_a.ts', 'index.d.ts'].forEach((f) =>
+      fs.writeFileSync(path.join(dir, f), '')
+    )
+    expect(shippedMigrations(dir)).toEqual([
+      '20200101000000_a',
+      '20210101000000_b',
+    ])
+  })
+  it('proceeds when the schema is current', async () => {
+    await expect(checkSchema(knex)).resolves.toBeUndefined()
+    expect(await appliedMigrations(knex)).toEqual(
+      expect.arrayContaining(shippedMigrations())
+    )
+  })
+  it('fails clearly when the schema is behind', async () => {
+    fs.writeFileSync(path.join(dir, '99990101000000_future.ts'), '')
+    const err = await checkSchema(knex, dir).catch((e) => e)
+    expect(err).toBeInstanceOf(SchemaOutdatedError)
+    expect(err.message).toMatch(/missing 1 migration\(s\)/)
+    expect(err.message).toMatch(/99990101000000_future/)
+    expect(err.message).toMatch(/run migrations/)
+  })
+  it('fails when an older migration was skipped', async () => {
+    const [applied] = await appliedMigrations(knex)
+    fs.writeFileSync(path.join(dir, `${applied}.js`), '')
+    fs.writeFileSync(path.join(dir, '20000101000000_skipped.ts'), '')
+    expect(await pendingMigrations(knex, dir)).toEqual([
+      '20000101000000_skipped',
+    ])
+    await expect(checkSchema(knex, dir)).rejects.toBeInstanceOf(
+      SchemaOutdatedError
+    )
+  })
+})
@@ -0,0 +1,124 @@
+// ./lib/secret-providers.ts test
+import fetch from 'node-fetch'
+import {
+  ProviderTokenError,
+  VaultConfig,
+  VaultProvider,
+} from '../lib/secret-providers'
+
+const vaultConfig: VaultConfig = {
+  enabled: true,
+  address: 'https://vault.example.com/',
+  token: 's.example',
+  path: 'secret',
+  renewToken: true,
+}
+
+type Reply = { status: number; body?: unknown }
+
+// fake fetch answering `replies` by URL
+const fakeFetch = (replies: Record<string, Reply>) =>
+  jest.fn(async (url: string) => {
+    const reply = replies[url] || { status: 404 }
+    return {
+      ok: reply.status >= 200 && reply.status < 300,
+      status: reply.status,
+      json: async () => reply.body,
+    }
+  })
+
+const renewURL = 'https://vault.example.com/v1/auth/token/renew-self'
+const readURL = 'https://vault.example.com/v1/secret/data/team/app'
+
+describe('Secret Providers', () => {
+  describe('VaultProvider', () => {
+    const provider = (replies: Record<string, Reply>) => {
+      const request = fakeFetch(replies)
+      return {
+        request,
+        vault: new VaultProvider(
+          vaultConfig,
+          request as unknown as typeof fetch
+        ),
+      }
+    }
+    it('reads the field of a KV secret', async () => {
+      const { request, vault } = provider({
+        [renewURL]: { status: 200 },
+        [readURL]: { status: 200, body: { data: { data: { token: 'moo' } } } },
+      })
+      expect(
+        await vault.fetch({ name: 'cow', provider_ref: 'team/app#token' })
+      ).toBe('moo')
+      expect(request.mock.calls[1][1]).toEqual({
+        headers: { 'X-Vault-Token': 's.example' },
+      })
+    })
+    it('defaults to the value field', async () => {
+      const { vault } = provider({
+        [renewURL]: { status: 200 },
+        [readURL]: { status: 200, body: { data: { data: { value: 'moo' } } } },
+      })
+      expect(await vault.fetch({ name: 'cow', provider_ref: 'team/app' })).toBe(
+        'moo'
+      )
+    })
+    it('renews the token once half of its lease is used', async () => {
+      const { request, vault } = provider({
+        [renewURL]: { status: 200, body: { auth: { lease_duration: 3600 } } },
+        [readURL]: { status: 200, body: { data: { data: { value: 'moo' } } } },
+      })
+      const now = jest.spyOn(Date, 'now').mockReturnValue(0)
+      const renewals = () =>
+        request.mock.calls.filter(([url]) => url === renewURL).length
+      await vault.fetch({ name: 'cow', provider_ref: 'team/app' })
+      now.mockReturnValue(1799 * 1000)
+      await vault.fetch({ name: 'cow', provider_ref: 'team/app' })
+      expect(renewals()).toBe(1)
+      now.mockReturnValue(1800 * 1000)
+      await vault.fetch({ name: 'cow', provider_ref: 'team/app' })
+      expect(renewals()).toBe(2)
+      now.mockRestore()
+    })
+    it('skips renewals unless enabled', async () => {
+      const request = fakeFetch({
+        [readURL]: { status: 200, body: { data: { data: { value: 'moo' } } } },
+      })
+      const vault = new VaultProvider(
+        { ...vaultConfig, renewToken: false },
+        request as unknown as typeof fetch
+      )
+      expect(await vault.fetch({ name: 'cow', provider_ref: 'team/app' })).toBe(
+        'moo'
+      )
+      expect(request).toHaveBeenCalledTimes(1)
+    })
+    it('fails token renewals distinctly', async () => {
+      const { request, vault } = provider({ [renewURL]: { status: 403 } })
+      const res = vault.fetch({ name: 'cow', provider_ref: 'team/app' })
+      await expect(res).rejects.toThrow(ProviderTokenError)
+      await expect(res).rejects.toThrow('vault token renewal failed')
+      expect(request).toHaveBeenCalledTimes(1)
+    })
+    it('fails rejected reads as token errors', async () => {
+      const { vault } = provider({
+        [renewURL]: { status: 200 },
+        [readURL]: { status: 403 },
+      })
+      await expect(
+        vault.fetch({ name: 'cow', provider_ref: 'team/app' })
+      ).rejects.toThrow(ProviderTokenError)
+    })
+    it('fails other errors as is', async () => {
+      const { vault } = provider({
+        [renewURL]: { status: 200 },
+        [readURL]: { status: 500 },
+      })
+      const err = await vault
+        .fetch({ name: 'cow', provider_ref: 'team/app' })
+        .catch((e) => e)
+      expect(err.message).toMatch('responded with 500')
+      expect(err).not.toBeInstanceOf(ProviderTokenError)
+    })
+  })
+})
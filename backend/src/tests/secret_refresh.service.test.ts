@@ -0,0 +1,256 @@
+import Queue from 'bull'
+import { createClient } from '../repos/redis'
+import SecretRefreshService, {
+  defaultProvider,
+  nextRefreshAt,
+  providerFor,
+  verifyRefresh,
+} from '../services/secret_refresh'
+import { ProviderTokenError, SecretProvider } from '../lib/secret-providers'
+import SourceService from '../services/source'
+import SecretService from '../services/secret'
+import SecretFactory from './factories/secrets.factory'
+import { resetDB } from './utils'
+
+const fetchValue = (value: string | null) => async () => value
+
+const refreshQueue = new Queue('test-secret-refresh-queue', { createClient })
+
+describe('SecretRefresh Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+  })
+  afterAll(async () => {
+    await refreshQueue.close()
+  })
+  describe('verifyRefresh', () => {
+    it('accepts a rotated value', () => {
+      expect(verifyRefresh('old', 'new')).toBeNull()
+    })
+    it('flags empty and identical values', () => {
+      expect(verifyRefresh('old', '')?.status).toBe('failed')
+      expect(verifyRefresh('old', null)?.status).toBe('failed')
+      expect(verifyRefresh('old', 'old')?.status).toBe('unchanged')
+    })
+  })
+  describe('refresh', () => {
+    it('stores a rotated value and updates the source cache', async () => {
+      const secret = await SecretFactory.build({ name: 'cow', value: 'moo' })
+        .$query()
+        .insert()
+      const source = await SourceService.create({
+        name: 'foobar',
+        value: 'call("__cow__")',
+        secret_ids: [secret.id],
+      })
+      const actual = await SecretRefreshService.refresh(secret, {
+        fetch: fetchValue('moocar'),
+      })
+      expect(actual.value).toBe('moocar')
+      expect(actual.last_refresh_status).toBe('succeeded')
+      expect(actual.last_refresh_error).toBeNull()
+      expect(actual.last_refreshed_at).toBeTruthy()
+      expect(await SourceService.getCache(source.id)).toBe('call("moocar")')
+    })
+    it('records an unchanged value', async () => {
+      const secret = await SecretFactory.build({ value: 'moo' })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        fetch: fetchValue('moo'),
+      })
+      expect(actual.last_refresh_status).toBe('unchanged')
+      expect(actual.last_refresh_error).toMatch(/identical/)
+    })
+    it('keeps the value when the refreshed one is empty', async () => {
+      const secret = await SecretFactory.build({ value: 'moo' })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        fetch: fetchValue(''),
+      })
+      expect(actual.value).toBe('moo')
+      expect(actual.last_refresh_status).toBe('failed')
+      expect(actual.last_refresh_error).toMatch(/empty/)
+    })
+    it('records fetch errors', async () => {
+      const secret = await SecretFactory.build({ value: 'moo' })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        fetch: async () => {
+          throw new Error('token endpoint down')
+        },
+      })
+      expect(actual.last_refresh_status).toBe('failed')
+      expect(actual.last_refresh_error).toBe('token endpoint down')
+    })
+    it('stores any value with verification off', async () => {
+      const secret = await SecretFactory.build({ value: 'moo' })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        fetch: fetchValue('moo'),
+        verify: false,
+      })
+      expect(actual.last_refresh_status).toBe('succeeded')
+    })
+  })
+  describe('refresh interval', () => {
+    const now = new Date('2022-10-10T12:00:00Z')
+    beforeEach(async () => {
+      await refreshQueue.clean(0, 'delayed')
+      await refreshQueue.empty()
+    })
+    it('rejects intervals out of bounds', () => {
+      expect(() =>
+        SecretFactory.build({ refresh_interval_minutes: 1 })
+      ).toThrow()
+      expect(() =>
+        SecretFactory.build({ refresh_interval_minutes: 20000 })
+      ).toThrow()
+    })
+    it('leaves secrets without an interval to the global schedule', () => {
+      expect(nextRefreshAt({ last_refreshed_at: now }, now)).toBeNull()
+    })
+    it('schedules the next job after the interval', async () => {
+      const secret = await SecretFactory.build({
+        refresh_interval_minutes: 15,
+      })
+        .$query()
+        .insert()
+      const refreshed = await SecretRefreshService.refreshScheduled(
+        secret.id,
+        { fetch: fetchValue('moocar'), queue: refreshQueue, now }
+      )
+      expect(refreshed?.value).toBe('moocar')
+      const expected =
+        new Date(refreshed.last_refreshed_at).getTime() + 15 * 60 * 1000
+      const [job] = await refreshQueue.getDelayed()
+      expect(job.data).toEqual({ secret_id: secret.id })
+      expect(job.id).toBe(`secret-refresh:${secret.id}:${expected}`)
+    })
+    it('skips jobs of secrets that are not due', async () => {
+      const secret = await SecretFactory.build({
+        refresh_interval_minutes: 60,
+        last_refreshed_at: now,
+      })
+        .$query()
+        .insert()
+      const refreshed = await SecretRefreshService.refreshScheduled(
+        secret.id,
+        { fetch: fetchValue('moocar'), queue: refreshQueue, now }
+      )
+      expect(refreshed).toBeNull()
+      expect(await refreshQueue.getDelayedCount()).toBe(0)
+    })
+    it('schedules interval secrets once from the global run', async () => {
+      const secret = await SecretFactory.build({
+        type: 'qt',
+        refresh_interval_minutes: 1440,
+        last_refreshed_at: now,
+      })
+        .$query()
+        .insert()
+      const opts = { fetch: fetchValue('moocar'), queue: refreshQueue, now }
+      expect(await SecretRefreshService.refreshAll(opts)).toEqual({})
+      await SecretRefreshService.refreshAll(opts)
+      const jobs = await refreshQueue.getDelayed()
+      expect(jobs.length).toBe(1)
+      expect(jobs[0].opts.delay).toBe(24 * 60 * 60 * 1000)
+      expect(jobs[0].data.secret_id).toBe(secret.id)
+    })
+    it('schedules a refresh again once its job failed', async () => {
+      const secret = await SecretFactory.build({
+        refresh_interval_minutes: 60,
+        last_refreshed_at: now,
+      })
+        .$query()
+        .insert()
+      const job = await SecretRefreshService.schedule(secret, {
+        queue: refreshQueue,
+        now,
+      })
+      expect(job.opts.removeOnFail).toBe(true)
+      await job.moveToFailed({ message: 'vault down' }, true)
+      const again = await SecretRefreshService.schedule(secret, {
+        queue: refreshQueue,
+        now,
+      })
+      expect(await again.getState()).toBe('delayed')
+    })
+  })
+  describe('providers', () => {
+    const vault = (fetch: SecretProvider['fetch']): SecretProvider => ({
+      name: 'vault',
+      enabled: true,
+      fetch,
+    })
+    it('selects the provider of the secret', () => {
+      const registry = { default: defaultProvider, vault: vault(jest.fn()) }
+      expect(providerFor({ provider: null }, registry)).toBe(defaultProvider)
+      expect(providerFor({ provider: 'vault' }, registry)).toBe(registry.vault)
+    })
+    it('refreshes secrets from their provider', async () => {
+      const fetch = jest.fn(async () => 'moocar')
+      const secret = await SecretFactory.build({
+        value: 'moo',
+        provider: 'vault',
+        provider_ref: 'team/app#token',
+      })
+        .$query()
+        .insert()
+      const totals = await SecretRefreshService.refreshAll({
+        providers: { default: defaultProvider, vault: vault(fetch) },
+      })
+      expect(totals).toEqual({ succeeded: 1 })
+      expect(fetch).toHaveBeenCalledWith(
+        expect.objectContaining({ provider_ref: 'team/app#token' })
+      )
+      const refreshed = await SecretService.view(secret.id)
+      expect(refreshed.value).toBe('moocar')
+    })
+    it('records identical static values as refreshed', async () => {
+      const secret = await SecretFactory.build({
+        value: 'moo',
+        provider: 'vault',
+      })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        providers: { vault: { ...vault(async () => 'moo'), static: true } },
+      })
+      expect(actual.last_refresh_status).toBe('succeeded')
+      expect(actual.last_refresh_error).toBeNull()
+    })
+    it('skips secrets of disabled providers', async () => {
+      const fetch = jest.fn(async () => 'moocar')
+      await SecretFactory.build({ provider: 'vault' }).$query().insert()
+      const totals = await SecretRefreshService.refreshAll({
+        providers: { vault: { ...vault(fetch), enabled: false } },
+      })
+      expect(totals).toEqual({})
+      expect(fetch).not.toHaveBeenCalled()
+    })
+    it('records token errors distinctly', async () => {
+      const secret = await SecretFactory.build({
+        value: 'moo',
+        provider: 'vault',
+      })
+        .$query()
+        .insert()
+      const actual = await SecretRefreshService.refresh(secret, {
+        providers: {
+          vault: vault(async () => {
+            throw new ProviderTokenError('vault token renewal failed')
+          }),
+        },
+      })
+      expect(actual.value).toBe('moo')
+      expect(actual.last_refresh_status).toBe('failed')
+      expect(actual.last_refresh_error).toBe(
+        'token error: vault token renewal failed'
+      )
+    })
+  })
+})
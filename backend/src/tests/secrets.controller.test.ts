@@ -4,6 +4,7 @@ import SecretFactory from './factories/secrets.factory'
 import SourceFactory from './factories/sources.factory'
 import SourceService from '../services/source'
 import SecretService from '../services/secret'
+import AuditService from '../services/audit'
 import { resetDB, makeSession } from './utils'
 import { PathItem, ajv } from 'aejo'
 
@@ -113,6 +114,15 @@ describe('Secret Controller', () => {
       expect(res.status).toBe(200)
       expect(res.body.value).toBe('moocar')
     })
+    it('should record the session login in the audit log', async () => {
+      await request(adminSession().app)
+        .put(`/api/secrets/${seed.id}`)
+        .send({ secret: { value: 'moocar', type: 'manual' } })
+        .set('Accept', 'application/json')
+      const [entry] = await AuditService.list({ entity_id: seed.id })
+      expect(entry.actor).toBe('z000n00')
+      expect(entry.action).toBe('update')
+    })
     it('should not allow user to update secret name', async () => {
       const res = await request(adminSession().app)
         .put(`/api/secrets/${seed.id}`)
@@ -0,0 +1,67 @@
+import Chance from 'chance'
+import { resetDB } from './utils'
+import { SeenScript, Site } from '../models'
+import SiteFactory from './factories/sites.factory'
+import SourceFactory from './factories/sources.factory'
+import SeenScriptService from '../services/seen_script'
+import { redisClient } from '../repos/redis'
+
+const chance = new Chance()
+
+const sha = () => chance.hash({ length: 64 })
+
+describe('Seen Script Service', () => {
+  let site: Site
+  const url = 'https://www.example.com/js/checkout.js'
+  beforeEach(async () => {
+    await resetDB()
+    const source = await SourceFactory.build().$query().insert()
+    site = await SiteFactory.build({ source_id: source.id }).$query().insert()
+  })
+  describe('observe', () => {
+    it('records new scripts without a change', async () => {
+      const hash = sha()
+      const res = await SeenScriptService.observe(site.id, url, hash)
+      expect(res).toEqual({ previous: null, changed: false })
+      const seen = await SeenScript.query().findOne({ site_id: site.id, url })
+      expect(seen.sha256).toBe(hash)
+    })
+    it('does not report the same hash as changed', async () => {
+      const hash = sha()
+      await SeenScriptService.observe(site.id, url, hash)
+      const res = await SeenScriptService.observe(site.id, url, hash)
+      expect(res).toEqual({ previous: hash, changed: false })
+    })
+    it('reports a changed hash with the previous hash', async () => {
+      const oldHash = sha()
+      const newHash = sha()
+      await SeenScriptService.observe(site.id, url, oldHash)
+      const res = await SeenScriptService.observe(site.id, url, newHash)
+      expect(res).toEqual({ previous: oldHash, changed: true })
+      const seen = await SeenScript.query().findOne({ site_id: site.id, url })
+      expect(seen.sha256).toBe(newHash)
+      expect(seen.changed_at).not.toBeNull()
+      expect(await redisClient.get(`seen_script:${site.id}:${url}`)).toBe(
+        newHash
+      )
+    })
+    it('reports a change once for concurrent observers', async () => {
+      const newHash = sha()
+      await SeenScriptService.observe(site.id, url, sha())
+      const results = await Promise.all(
+        Array.from({ length: 10 }, () =>
+          SeenScriptService.observe(site.id, url, newHash)
+        )
+      )
+      expect(results.filter((r) => r.changed)).toHaveLength(1)
+    })
+    it('tracks scripts per site', async () => {
+      const other = await SiteFactory.build({ source_id: site.source_id })
+        .$query()
+        .insert()
+      await SeenScriptService.observe(site.id, url, sha())
+      const res = await SeenScriptService.observe(other.id, url, sha())
+      expect(res.changed).toBe(false)
+    })
+  })
+})
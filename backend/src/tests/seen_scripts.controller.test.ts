@@ -0,0 +1,62 @@
+import request from 'supertest'
+import Chance from 'chance'
+import { knex, Scan } from '../models'
+import SiteFactory from './factories/sites.factory'
+import ScanFactory from './factories/scans.factory'
+import SourceFactory from './factories/sources.factory'
+import { makeSession, resetDB } from './utils'
+
+const chance = new Chance()
+
+const transportSession = () =>
+  makeSession({
+    firstName: 'Transport',
+    lastName: 'User',
+    role: 'transport',
+    lanid: 'transport',
+    email: 'transport@example.com',
+    isAuth: true,
+    exp: 0,
+  }).app
+
+describe('Seen Scripts Controller', () => {
+  let scan: Scan
+  beforeEach(async () => {
+    await resetDB()
+    const source = await SourceFactory.build().$query().insert()
+    const site = await SiteFactory.build({ source_id: source.id })
+      .$query()
+      .insert()
+    scan = await ScanFactory.build({ site_id: site.id, source_id: source.id })
+      .$query()
+      .insert()
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+  describe('POST /api/seen_scripts/_observe', () => {
+    const observe = (sha256: string) =>
+      request(transportSession())
+        .post('/api/seen_scripts/_observe')
+        .send({
+          seen_script: {
+            scan_id: scan.id,
+            url: 'https://www.example.com/app.js',
+            sha256,
+          },
+        })
+    it('should report a changed script hash', async () => {
+      const oldHash = chance.hash({ length: 64 })
+      const first = await observe(oldHash)
+      expect(first.status).toBe(200)
+      expect(first.body.changed).toBe(false)
+      const second = await observe(chance.hash({ length: 64 }))
+      expect(second.status).toBe(200)
+      expect(second.body).toEqual({ previous: oldHash, changed: true })
+    })
+    it('should reject an invalid hash', async () => {
+      const res = await observe('not-a-hash')
+      expect(res.status).toBe(422)
+    })
+  })
+})
@@ -2,8 +2,12 @@ import { PathItem, ajv } from 'aejo'
 import request from 'supertest'
 import { SeenString, knex } from '../models'
 import { cache } from '../services/seen_string'
+import SettingService from '../services/setting'
 import { redisClient } from '../repos/redis'
 import SeenStringFactory from './factories/seen_strings.factory'
+import SourceFactory from './factories/sources.factory'
+import SiteFactory from './factories/sites.factory'
+import ScanFactory from './factories/scans.factory'
 import { makeSession, guestSession, resetDB } from './utils'
 
 const adminSessionAttr = {
@@ -198,6 +202,143 @@ describe('SeenStrings Controller', () => {
       const actual = await testSeenString.$query()
       expect(actual.last_cached.valueOf()).toBeGreaterThan(origCache)
     })
+    it('should treat strings past the baseline TTL as unseen', async () => {
+      await redisClient.del('seen_strings:domain:stale.example.com')
+      await SettingService.update('seenStrings.baselineTTLDays', 30, 'test')
+      const lastCached = new Date()
+      lastCached.setDate(lastCached.getDate() - 31)
+      const stale = await SeenStringFactory.build({
+        type: 'domain',
+        key: 'stale.example.com',
+        last_cached: lastCached
+      })
+        .$query()
+        .insert()
+        .returning('*')
+      const res = await request(adminSession())
+        .post('/api/seen_strings/_cache')
+        .send({
+          seen_string: {
+            key: 'stale.example.com',
+            type: 'domain'
+          }
+        })
+        .set('Accept', 'application/json')
+      expect(res.body.has).toBe(false)
+      // re-baselined
+      const actual = await stale.$query()
+      expect(actual.last_cached.valueOf()).toBeGreaterThan(
+        lastCached.valueOf()
+      )
+      await SettingService.reset('seenStrings.baselineTTLDays', 'test')
+    })
+    it('should expire cached strings past the site baseline TTL', async () => {
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({
+        source_id: source.id,
+        seen_baseline_ttl_days: 7
+      })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        source_id: source.id,
+        site_id: site.id
+      })
+        .$query()
+        .insert()
+      const lastCached = new Date()
+      lastCached.setDate(lastCached.getDate() - 10)
+      await SeenStringFactory.build({
+        type: 'domain',
+        key: 'cached.example.com',
+        last_cached: lastCached
+      })
+        .$query()
+        .insert()
+      await redisClient.set('seen_strings:domain:cached.example.com', 1)
+      const res = await request(adminSession())
+        .post('/api/seen_strings/_cache')
+        .send({
+          seen_string: {
+            key: 'cached.example.com',
+            type: 'domain',
+            scan_id: scan.id
+          }
+        })
+        .set('Accept', 'application/json')
+      expect(res.body.has).toBe(false)
+      await redisClient.del('seen_strings:domain:cached.example.com')
+    })
+    it('should require min hits before a string is seen', async () => {
+      await redisClient.del('seen_strings:domain:rare.example.com')
+      await SettingService.update('seenStrings.minHits', 3, 'test')
+      const payload = {
+        seen_string: {
+          key: 'rare.example.com',
+          type: 'domain'
+        }
+      }
+      const post = () =>
+        request(adminSession())
+          .post('/api/seen_strings/_cache')
+          .send(payload)
+          .set('Accept', 'application/json')
+      const first = await post()
+      expect(first.body).toEqual({
+        has: false,
+        store: 'none',
+        hit_count: 1,
+        below_threshold: true
+      })
+      const second = await post()
+      expect(second.body.has).toBe(false)
+      expect(second.body.hit_count).toBe(2)
+      const third = await post()
+      expect(third.body).toEqual({ has: true, store: 'database' })
+      const validate = ajv.compile(
+        api['/api/seen_strings/_cache'].post.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(first.body)).toBe(true)
+      await SettingService.reset('seenStrings.minHits', 'test')
+    })
+    it('should use the site min hits of the scan', async () => {
+      await redisClient.del('seen_strings:domain:site.example.com')
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({
+        source_id: source.id,
+        seen_min_hits: 5
+      })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        source_id: source.id,
+        site_id: site.id
+      })
+        .$query()
+        .insert()
+      await SeenStringFactory.build({
+        type: 'domain',
+        key: 'site.example.com',
+        hit_count: 3
+      })
+        .$query()
+        .insert()
+      const res = await request(adminSession())
+        .post('/api/seen_strings/_cache')
+        .send({
+          seen_string: {
+            key: 'site.example.com',
+            type: 'domain',
+            scan_id: scan.id
+          }
+        })
+        .set('Accept', 'application/json')
+      expect(res.body.has).toBe(false)
+      expect(res.body.hit_count).toBe(4)
+      expect(res.body.below_threshold).toBe(true)
+    })
     it('should return validation error', async () => {
       const res = await request(adminSession())
         .post('/api/seen_strings/_cache')
@@ -230,4 +371,56 @@ describe('SeenStrings Controller', () => {
       expect(res.body.store).toBe('local')
     })
   })
+  describe('POST /api/seen_strings/_cache/_batch', () => {
+    const batch = (keys: string[]) =>
+      request(transportSession())
+        .post('/api/seen_strings/_cache/_batch')
+        .send({ seen_strings: { type: 'domain', keys } })
+        .set('Accept', 'application/json')
+    beforeEach(async () => {
+      cache.clear()
+      await redisClient.del(
+        'seen_strings:domain:local.test',
+        'seen_strings:domain:redis.test',
+        'seen_strings:domain:db.test',
+        'seen_strings:domain:new.test'
+      )
+    })
+    it('should resolve every store in one call', async () => {
+      cache.set('seen_strings:domain:local.test', 1)
+      await redisClient.set('seen_strings:domain:redis.test', 1)
+      await SeenStringFactory.build({ type: 'domain', key: 'db.test' })
+        .$query()
+        .insert()
+      const res = await batch([
+        'local.test',
+        'redis.test',
+        'db.test',
+        'new.test',
+        'new.test'
+      ])
+      expect(res.status).toBe(200)
+      expect(res.body.results).toEqual({
+        'local.test': { has: true, store: 'local' },
+        'redis.test': { has: true, store: 'redis' },
+        'db.test': { has: true, store: 'database' },
+        'new.test': { has: false, store: 'none' }
+      })
+      const validate = ajv.compile(
+        api['/api/seen_strings/_cache/_batch'].post.responses['200'].content[
+          'application/json'
+        ].schema
+      )
+      expect(validate(res.body)).toBe(true)
+    })
+    it('should not record hits', async () => {
+      await batch(['new.test'])
+      const actual = await SeenString.query().where({ key: 'new.test' })
+      expect(actual).toHaveLength(0)
+    })
+    it('should reject an empty batch', async () => {
+      const res = await batch([])
+      expect(res.status).toBe(422)
+    })
+  })
 })
@@ -2,10 +2,15 @@ import { resetDB } from './utils'
 import SeenString from '../models/seen_strings'
 import SeenStringFactory from './factories/seen_strings.factory'
 import SeenStringService from '../services/seen_string'
+import SettingService from '../services/setting'
+import SiteFactory from './factories/sites.factory'
+import ScanFactory from './factories/scans.factory'
+import SourceFactory from './factories/sources.factory'
 
 describe('Seen String Service', () => {
   beforeEach(async () => {
     await resetDB()
+    SettingService.invalidate()
   })
   describe('create', () => {
     it('creates a seen string', async () => {
@@ -15,6 +20,27 @@ describe('Seen String Service', () => {
       })
       expect(res.key).toBe('example.com')
     })
+    it('stores IDN domains in punycode form', async () => {
+      const res = await SeenStringService.create({
+        type: 'domain',
+        key: 'Bücher.test',
+      })
+      expect(res.key).toBe('xn--bcher-kva.test')
+    })
+    it('keeps lowercase ASCII domains unchanged', async () => {
+      const res = await SeenStringService.create({
+        type: 'domain',
+        key: 'cdn-1.example.com',
+      })
+      expect(res.key).toBe('cdn-1.example.com')
+    })
+    it('does not normalize non-domain keys', async () => {
+      const res = await SeenStringService.create({
+        type: 'url',
+        key: 'https://Bücher.test/',
+      })
+      expect(res.key).toBe('https://Bücher.test/')
+    })
   })
   describe('view', () => {
     it('returns a seen string', async () => {
@@ -67,4 +93,113 @@ describe('Seen String Service', () => {
       expect(seenStringSet.some(s => s.key === 'newone')).toEqual(true)
     })
   })
+  describe('purgeDBCache batches', () => {
+    it('deletes all matching rows in batches', async () => {
+      const daysAgo = new Date()
+      daysAgo.setDate(daysAgo.getDate() - 3)
+      for (const key of ['old1', 'old2', 'old3']) {
+        await SeenStringFactory.build({ key, last_cached: daysAgo })
+          .$query()
+          .insert()
+      }
+      await SeenStringFactory.build({ key: 'newone' }).$query().insert()
+      const total = await SeenStringService.purgeDBCache(2, 2)
+      expect(total).toBe(3)
+      const remaining = await SeenString.query()
+      expect(remaining.map((s) => s.key)).toEqual(['newone'])
+    })
+  })
+  describe('isExpiredBaseline', () => {
+    const daysAgo = (days: number) => {
+      const d = new Date()
+      d.setDate(d.getDate() - days)
+      return d
+    }
+    it('never expires when disabled', () => {
+      const seen = SeenString.build({ key: 'a', last_cached: daysAgo(400) })
+      expect(SeenStringService.isExpiredBaseline(seen, 0)).toBe(false)
+    })
+    it('expires strings older than the baseline TTL', () => {
+      const stale = SeenString.build({ key: 'a', last_cached: daysAgo(31) })
+      const fresh = SeenString.build({ key: 'b', last_cached: daysAgo(29) })
+      expect(SeenStringService.isExpiredBaseline(stale, 30)).toBe(true)
+      expect(SeenStringService.isExpiredBaseline(fresh, 30)).toBe(false)
+    })
+  })
+  describe('baselineTTLDays', () => {
+    it('prefers the site TTL over the organization setting', async () => {
+      await SettingService.update('seenStrings.baselineTTLDays', 30, 'test')
+      const source = await SourceFactory.build().$query().insert()
+      const site = await SiteFactory.build({
+        source_id: source.id,
+        seen_baseline_ttl_days: 7,
+      })
+        .$query()
+        .insert()
+      const scan = await ScanFactory.build({
+        source_id: source.id,
+        site_id: site.id,
+      })
+        .$query()
+        .insert()
+      expect(await SeenStringService.baselineTTLDays(scan.id)).toBe(7)
+      expect(await SeenStringService.baselineTTLDays()).toBe(30)
+    })
+  })
+  describe('bulkRecord', () => {
+    const hits = async () =>
+      (await SeenString.query().where('type', 'domain').orderBy('key')).map(
+        (s) => [s.key, s.hit_count]
+      )
+    it('accumulates hit counts across batches', async () => {
+      await SeenStringFactory.build({
+        key: 'known.com',
+        type: 'domain',
+        hit_count: 3,
+      })
+        .$query()
+        .insert()
+      const keys = ['a.com', 'b.com', 'known.com', 'a.com', 'c.com']
+      // 2 distinct keys per statement
+      expect(await SeenStringService.bulkRecord('domain', keys, 2)).toBe(4)
+      expect(await hits()).toEqual([
+        ['a.com', 2],
+        ['b.com', 1],
+        ['c.com', 1],
+        ['known.com', 4],
+      ])
+      await SeenStringService.bulkRecord('domain', ['a.com', 'known.com'], 1)
+      expect(await hits()).toEqual([
+        ['a.com', 3],
+        ['b.com', 1],
+        ['c.com', 1],
+        ['known.com', 5],
+      ])
+    })
+    it('refreshes last_cached and normalizes keys', async () => {
+      const now = new Date('2022-10-03T08:00:00Z')
+      await SeenStringService.bulkRecord('domain', ['bücher.de'], 500, now)
+      const [seen] = await SeenString.query().where('type', 'domain')
+      expect(seen.key).toBe('xn--bcher-kva.de')
+      expect(new Date(seen.last_cached)).toEqual(now)
+    })
+    it('restarts expired baselines', async () => {
+      await SettingService.update('seenStrings.baselineTTLDays', 30, 'test')
+      const stale = new Date()
+      stale.setDate(stale.getDate() - 31)
+      await SeenStringFactory.build({
+        key: 'stale.com',
+        type: 'domain',
+        hit_count: 10,
+        last_cached: stale,
+      })
+        .$query()
+        .insert()
+      await SeenStringService.bulkRecord('domain', ['stale.com', 'stale.com'])
+      expect(await hits()).toEqual([['stale.com', 2]])
+    })
+    it('ignores empty batches', async () => {
+      expect(await SeenStringService.bulkRecord('domain', [])).toBe(0)
+    })
+  })
 })
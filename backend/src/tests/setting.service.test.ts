@@ -0,0 +1,127 @@
+import { config } from 'node-config-ts'
+import { knex } from '../models'
+import { resetDB } from './utils'
+
+import SettingService from '../services/setting'
+import AuditService from '../services/audit'
+
+describe('Setting Service', () => {
+  beforeEach(async () => {
+    await resetDB()
+    SettingService.invalidate()
+  })
+  afterAll(async () => {
+    knex.destroy()
+  })
+
+  describe('resolve', () => {
+    it('falls back to the config default', async () => {
+      const actual = await SettingService.resolve('scheduler.maxQueueDepth')
+      expect(actual).toBe(config.scheduler.maxQueueDepth)
+    })
+    it('prefers the organization setting over config', async () => {
+      await SettingService.update('scheduler.maxQueueDepth', 7, 'admin')
+      const actual = await SettingService.resolve('scheduler.maxQueueDepth')
+      expect(actual).toBe(7)
+    })
+    it('prefers the site value over the organization setting', async () => {
+      await SettingService.update('scheduler.maxQueueDepth', 7, 'admin')
+      const actual = await SettingService.resolve('scheduler.maxQueueDepth', 3)
+      expect(actual).toBe(3)
+    })
+    it('ignores null site values', async () => {
+      await SettingService.update('scheduler.maxQueueDepth', 7, 'admin')
+      const actual = await SettingService.resolve(
+        'scheduler.maxQueueDepth',
+        null
+      )
+      expect(actual).toBe(7)
+    })
+  })
+
+  describe('update', () => {
+    it('invalidates the cache on write', async () => {
+      await SettingService.get('scheduler.overrunPolicy')
+      await SettingService.update(
+        'scheduler.overrunPolicy',
+        'queue-bounded',
+        'admin'
+      )
+      const actual = await SettingService.get('scheduler.overrunPolicy')
+      expect(actual).toBe('queue-bounded')
+    })
+    it('rejects invalid values', async () => {
+      let err: Error
+      try {
+        await SettingService.update('scheduler.overrunPolicy', 'drop', 'admin')
+      } catch (e) {
+        err = e
+      }
+      expect(err).not.toBeUndefined()
+    })
+    it('rejects unknown time zones', async () => {
+      await expect(
+        SettingService.update('scheduler.timeZone', 'Mars/Olympus', 'admin')
+      ).rejects.toThrow('unknown time zone')
+      await SettingService.update(
+        'scheduler.timeZone',
+        'Europe/Berlin',
+        'admin'
+      )
+      expect(await SettingService.get('scheduler.timeZone')).toBe(
+        'Europe/Berlin'
+      )
+    })
+    it('rejects unknown rules of alert sinks', async () => {
+      await expect(
+        SettingService.update(
+          'alerts.sinks.goAlert.ruleTypes',
+          ['ioc.domian'],
+          'admin'
+        )
+      ).rejects.toThrow('invalid value for "alerts.sinks.goAlert.ruleTypes"')
+      await SettingService.update(
+        'alerts.sinks.goAlert.ruleTypes',
+        ['ioc.domain'],
+        'admin'
+      )
+      expect(
+        await SettingService.get('alerts.sinks.goAlert.ruleTypes')
+      ).toEqual(['ioc.domain'])
+    })
+    it('rejects unknown keys', async () => {
+      let err: Error
+      try {
+        await SettingService.update('foo.bar', 1, 'admin')
+      } catch (e) {
+        err = e
+      }
+      expect(err).not.toBeUndefined()
+    })
+  })
+
+  describe('audit', () => {
+    it('records changes and resets', async () => {
+      await SettingService.update('scheduler.jitterSeconds', 30, 'admin')
+      await SettingService.update('scheduler.jitterSeconds', 45, 'admin')
+      await SettingService.reset('scheduler.jitterSeconds', 'root')
+      const entries = await AuditService.list({ entity_type: 'setting' })
+      expect(entries.map((e) => [e.actor, e.action])).toEqual([
+        ['admin', 'create'],
+        ['admin', 'update'],
+        ['root', 'delete'],
+      ])
+      expect(entries[1].entity_id).toBe('scheduler.jitterSeconds')
+      expect(entries[1].changes.value).toEqual({ from: 30, to: 45 })
+    })
+  })
+
+  describe('reset', () => {
+    it('reverts to the config default', async () => {
+      await SettingService.update('scheduler.jitterSeconds', 30, 'admin')
+      await SettingService.reset('scheduler.jitterSeconds', 'admin')
+      const actual = await SettingService.get('scheduler.jitterSeconds')
+      expect(actual).toBe(config.scheduler.jitterSeconds)
+    })
+  })
+})
@@ -0,0 +1,46 @@
+// ./lib/signature.ts test
+import { signPayload, signatureHeaders } from '../lib/signature'
+
+describe('Signature', () => {
+  const now = new Date('2022-10-03T08:00:00Z')
+  const expected =
+    'sha256=711e86cc2cfc4e8b08c6f3b9161c11ef5e917bc9b6ed2953d53b93e5e857c38a'
+  describe('signPayload', () => {
+    it('matches the test vector', () => {
+      expect(
+        signPayload('mmk-secret', 'sha256', 1664784000, 'summary=rule-alert')
+      ).toEqual(expected)
+    })
+  })
+  describe('signatureHeaders', () => {
+    it('adds the signature and timestamp headers', () => {
+      expect(
+        signatureHeaders(
+          {
+            secret: 'mmk-secret',
+            algorithm: 'sha256',
+            header: 'X-MMK-Signature',
+            timestampHeader: 'X-MMK-Timestamp',
+          },
+          'summary=rule-alert',
+          now
+        )
+      ).toEqual({
+        'X-MMK-Signature': expected,
+        'X-MMK-Timestamp': '1664784000',
+      })
+    })
+    it('uses configured header names', () => {
+      const headers = signatureHeaders(
+        { secret: 'mmk-secret', header: 'X-Sig', timestampHeader: 'X-Ts' },
+        'summary=rule-alert',
+        now
+      )
+      expect(headers).toEqual({ 'X-Sig': expected, 'X-Ts': '1664784000' })
+    })
+    it('does not sign without a secret', () => {
+      expect(signatureHeaders({ secret: '' }, 'body', now)).toEqual({})
+      expect(signatureHeaders(undefined, 'body', now)).toEqual({})
+    })
+  })
+})
@@ -0,0 +1,19 @@
+import { parseSince } from '../lib/since'
+
+describe('parseSince', () => {
+  const now = new Date('2022-09-27T12:00:00Z')
+  it('resolves relative windows', () => {
+    expect(parseSince('7d', now)).toEqual(new Date('2022-09-20T12:00:00Z'))
+    expect(parseSince('24h', now)).toEqual(new Date('2022-09-26T12:00:00Z'))
+    expect(parseSince('30m', now)).toEqual(new Date('2022-09-27T11:30:00Z'))
+  })
+  it('accepts dates', () => {
+    expect(parseSince('2022-09-01T00:00:00Z', now)).toEqual(
+      new Date('2022-09-01T00:00:00Z')
+    )
+  })
+  it('rejects anything else', () => {
+    expect(parseSince('last week', now)).toBeNull()
+    expect(parseSince('', now)).toBeNull()
+  })
+})
@@ -105,6 +105,18 @@ describe('Sites Controller', () => {
         .set('Accept', 'application/json')
       expect(res.status).toBe(400)
     })
+    it('should return 409 for a duplicate name', async () => {
+      const newSite: Site = SiteFactory.build({
+        source_id: sourceSeed.id,
+        name: seed.name,
+      })
+      const res = await request(adminSession())
+        .post('/api/sites')
+        .send({ site: newSite.toJSON() })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(409)
+      expect(res.body.type).toBe('Conflict')
+    })
   })
   describe('PUT /api/sites/:id', () => {
     it('should update Site for admin user', async () => {
@@ -147,6 +159,97 @@ describe('Sites Controller', () => {
         .set('Accept', 'application/json')
       expect(res.status).toBe(403)
     })
+    it('should update rules config', async () => {
+      const update: SiteAttributes = {
+        name: 'newName',
+        active: true,
+        run_every_minutes: 60,
+        source_id: seed.source_id,
+        rules_config: { yara: { enabled: false } },
+      }
+      const res = await request(adminSession())
+        .put(`/api/sites/${seed.id}`)
+        .send({ site: update })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(200)
+      expect(res.body.rules_config).toEqual({ yara: { enabled: false } })
+    })
+    it('should reject rules config without enabled', async () => {
+      const res = await request(adminSession())
+        .put(`/api/sites/${seed.id}`)
+        .send({
+          site: {
+            name: 'newName',
+            active: true,
+            run_every_minutes: 60,
+            source_id: seed.source_id,
+            rules_config: { yara: {} },
+          },
+        })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
+    it('should update alert overrides', async () => {
+      const update: SiteAttributes = {
+        name: 'newName',
+        active: true,
+        run_every_minutes: 60,
+        source_id: seed.source_id,
+        alert_ttl_minutes: 60,
+        unknown_domain_severity: 'critical',
+      }
+      const res = await request(adminSession())
+        .put(`/api/sites/${seed.id}`)
+        .send({ site: update })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(200)
+      expect(res.body.alert_ttl_minutes).toBe(60)
+      expect(res.body.unknown_domain_severity).toBe('critical')
+    })
+    it('should reject an alert TTL below 1 minute', async () => {
+      const update: SiteAttributes = {
+        name: 'newName',
+        active: true,
+        run_every_minutes: 60,
+        source_id: seed.source_id,
+        alert_ttl_minutes: 0,
+      }
+      const res = await request(adminSession())
+        .put(`/api/sites/${seed.id}`)
+        .send({ site: update })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
+    it('should reject an unknown severity', async () => {
+      const update: SiteAttributes = {
+        name: 'newName',
+        active: true,
+        run_every_minutes: 60,
+        source_id: seed.source_id,
+        unknown_domain_severity: 'urgent',
+      }
+      const res = await request(adminSession())
+        .put(`/api/sites/${seed.id}`)
+        .send({ site: update })
+        .set('Accept', 'application/json')
+      expect(res.status).toBe(422)
+    })
+  })
+  describe('GET /api/sites/:id/scan_stats', () => {
+    it('should return zeroed counts for a site without scans', async () => {
+      const res = await request(userSession()).get(
+        `/api/sites/${seed.id}/scan_stats`
+      )
+      expect(res.status).toBe(200)
+      expect(res.body.total).toBe(0)
+      expect(res.body.completed).toBe(0)
+    })
+    it('should return 404 for a missing site', async () => {
+      const res = await request(userSession()).get(
+        `/api/sites/${chance.guid({ version: 4 })}/scan_stats`
+      )
+      expect(res.status).toBe(404)
+    })
   })
   describe('DELETE /api/sites/:id', () => {
     it('should delete Site for admin user', async () => {
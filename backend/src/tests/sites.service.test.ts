@@ -1,15 +1,21 @@
-import { subMinutes } from 'date-fns'
+import { addMinutes, subMinutes, subSeconds } from 'date-fns'
 import { knex, Source } from '../models'
 import SiteFactory from './factories/sites.factory'
 import SourceFactory from './factories/sources.factory'
 import { resetDB } from './utils'
 
-import SiteService from '../services/site'
+import SiteService, {
+  clampInterval,
+  SiteExistsError,
+} from '../services/site'
+import SettingService from '../services/setting'
+import logger from '../loaders/logger'
 
 describe('Site Service', () => {
   let sourceSeed: Source
   beforeEach(async () => {
     await resetDB()
+    SettingService.invalidate()
     sourceSeed = await SourceFactory.build().$query().insert()
   })
   afterAll(async () => {
@@ -37,6 +43,131 @@ describe('Site Service', () => {
       const actual = await SiteService.getRunnable()
       expect(actual.length).toBe(0)
     })
+    it('warns about sites below the floor once', async () => {
+      const warn = jest.spyOn(logger, 'warn').mockImplementation(() => undefined)
+      try {
+        const model = await SiteFactory.build({
+          source_id: sourceSeed.id,
+          run_every_minutes: 0,
+        })
+          .$query()
+          .insert()
+        await SiteService.getRunnable()
+        await SiteService.getRunnable()
+        const warned = warn.mock.calls.filter(
+          ([entry]) => (entry as { site_id?: string }).site_id === model.id
+        )
+        expect(warned).toHaveLength(1)
+      } finally {
+        warn.mockRestore()
+      }
+    })
+    describe('priority aging', () => {
+      const now = new Date()
+      beforeEach(async () => {
+        // low priority, overdue for 2 hours
+        await SiteFactory.build({
+          source_id: sourceSeed.id,
+          name: 'old low priority',
+          run_every_minutes: 60,
+          priority: 25,
+          last_run: subMinutes(now, 180),
+        })
+          .$query()
+          .insert()
+        // high priority, just due
+        await SiteFactory.build({
+          source_id: sourceSeed.id,
+          name: 'new high priority',
+          run_every_minutes: 60,
+          priority: 75,
+          last_run: subMinutes(now, 61),
+        })
+          .$query()
+          .insert()
+      })
+      it('orders by priority without aging', async () => {
+        const actual = await SiteService.getRunnable(now, 0, 0)
+        expect(actual.map((s) => s.name)).toEqual([
+          'new high priority',
+          'old low priority',
+        ])
+      })
+      it('runs long overdue sites first with aging', async () => {
+        const actual = await SiteService.getRunnable(now, 0, 10)
+        expect(actual.map((s) => s.name)).toEqual([
+          'old low priority',
+          'new high priority',
+        ])
+      })
+    })
+    describe('priority cap', () => {
+      it('is not starved by a stream of top priority sites', async () => {
+        const now = new Date()
+        await SiteFactory.build({
+          source_id: sourceSeed.id,
+          name: 'low priority',
+          run_every_minutes: 60,
+          priority: 25,
+          last_run: subMinutes(now, 60),
+        })
+          .$query()
+          .insert()
+        let tick = 0
+        let first = ''
+        // a new top priority site is due every minute, the first
+        // runnable site runs
+        while (first !== 'low priority' && tick < 30) {
+          tick += 1
+          const at = addMinutes(now, tick)
+          await SiteFactory.build({
+            source_id: sourceSeed.id,
+            name: `burst ${tick}`,
+            run_every_minutes: 60,
+            priority: 100,
+            last_run: subMinutes(at, 60),
+          })
+            .$query()
+            .insert()
+          const [next] = await SiteService.getRunnable(at, 0, 5)
+          await next.$query().patch({ last_run: at })
+          first = next.name
+        }
+        // aged to the cap (25 + 5 * 15) it ties and runs as the oldest
+        expect(first).toBe('low priority')
+        expect(tick).toBe(15)
+      })
+    })
+    describe('jitter', () => {
+      const now = new Date()
+      // offsets with a 600 second jitter: a = 207s, b = 54s
+      const last_run = subSeconds(subMinutes(now, 60), 100)
+      beforeEach(async () => {
+        for (const name of ['jitter site a', 'jitter site b']) {
+          await SiteFactory.build({
+            source_id: sourceSeed.id,
+            name,
+            run_every_minutes: 60,
+            last_run,
+          })
+            .$query()
+            .insert()
+        }
+      })
+      it('returns both sites without jitter', async () => {
+        const actual = await SiteService.getRunnable(now, 0)
+        expect(actual.length).toBe(2)
+      })
+      it('spreads sites with the same interval', async () => {
+        const actual = await SiteService.getRunnable(now, 600)
+        expect(actual.map((s) => s.name)).toEqual(['jitter site b'])
+      })
+      it('offsets deterministically', () => {
+        expect(SiteService.jitterOffset('jitter site a', 600)).toBe(207)
+        expect(SiteService.jitterOffset('jitter site a', 600)).toBe(207)
+        expect(SiteService.jitterOffset('jitter site a', 0)).toBe(0)
+      })
+    })
   })
 
   describe('create', () => {
@@ -49,6 +180,73 @@ describe('Site Service', () => {
       })
       expect(res.name).toBe('example site')
     })
+    it('rejects a duplicate name with SiteExistsError', async () => {
+      const attrs = {
+        name: 'duplicate site',
+        active: true,
+        run_every_minutes: 5,
+        source_id: sourceSeed.id,
+      }
+      await SiteService.create(attrs)
+      await expect(SiteService.create(attrs)).rejects.toBeInstanceOf(
+        SiteExistsError
+      )
+      const count = await knex('sites').where({ name: attrs.name }).count()
+      expect(count[0].count).toBe('1')
+    })
+    it('clamps run_every_minutes below the floor', async () => {
+      const res = await SiteService.create({
+        name: 'too frequent',
+        active: true,
+        run_every_minutes: 0,
+        source_id: sourceSeed.id,
+      })
+      expect(res.run_every_minutes).toBe(1)
+    })
+  })
+
+  describe('clampInterval', () => {
+    it('raises an interval below the floor', () => {
+      expect(clampInterval(2, 5)).toBe(5)
+    })
+    it('leaves a valid interval untouched', () => {
+      expect(clampInterval(60, 5)).toBe(60)
+      expect(clampInterval(5, 5)).toBe(5)
+    })
+  })
+
+  describe('schedule', () => {
+    const now = new Date('2022-09-26T14:00:00Z')
+    it('returns the next run in the display time zone', async () => {
+      await SettingService.update(
+        'scheduler.timeZone',
+        'America/Chicago',
+        'admin'
+      )
+      const model = await SiteFactory.build({
+        source_id: sourceSeed.id,
+        run_every_minutes: 60,
+        last_run: new Date('2022-09-26T13:30:00Z'),
+      })
+        .$query()
+        .insert()
+      const res = await SiteService.schedule(model, now)
+      expect(res.next_run).toEqual(new Date('2022-09-26T14:30:00Z'))
+      expect(res.time_zone).toBe('America/Chicago')
+      expect(res.next_run_local).toBe('2022-09-26 09:30')
+    })
+    it('is due now when overdue', () => {
+      const res = SiteService.nextRun(
+        {
+          name: 'overdue',
+          run_every_minutes: 5,
+          last_run: subMinutes(now, 30),
+        },
+        now,
+        0
+      )
+      expect(res).toEqual(now)
+    })
   })
 
   describe('view', () => {
@@ -73,6 +271,18 @@ describe('Site Service', () => {
       const res = await SiteService.update(model.id, { name: 'example update' })
       expect(res.name).toBe('example update')
     })
+    it('rejects renaming to an existing name', async () => {
+      const [a, b] = await Promise.all(
+        ['site a', 'site b'].map((name) =>
+          SiteFactory.build({ source_id: sourceSeed.id, name })
+            .$query()
+            .insert()
+        )
+      )
+      await expect(
+        SiteService.update(b.id, { name: a.name })
+      ).rejects.toThrow('A site named "site a" already exists')
+    })
   })
 
   describe('destroy', () => {
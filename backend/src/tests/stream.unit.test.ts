@@ -0,0 +1,104 @@
+// ./lib/stream.ts test
+import { PassThrough } from 'stream'
+import {
+  StreamClosedError,
+  writeJSONList,
+  writeNDJSON,
+} from '../lib/stream'
+
+const collect = (out: PassThrough): string[] => {
+  const chunks: string[] = []
+  out.on('data', (chunk: Buffer) => chunks.push(chunk.toString()))
+  return chunks
+}
+
+// instrumented source, records what was sent before each fetch
+const fakeSource = (batches: unknown[][], chunks: string[]) => {
+  const seen: string[] = []
+  const nextBatch = jest.fn(async () => {
+    await new Promise(setImmediate)
+    seen.push(chunks.join(''))
+    return batches.shift() || []
+  })
+  return { nextBatch, seen }
+}
+
+describe('Stream', () => {
+  describe('writeJSONList', () => {
+    it('writes the header before fetching rows', async () => {
+      const out = new PassThrough()
+      const chunks = collect(out)
+      const { nextBatch, seen } = fakeSource(
+        [[{ id: 1 }, { id: 2 }], [{ id: 3 }]],
+        chunks
+      )
+      await writeJSONList(out, { total: 3, nextBatch })
+      expect(seen[0]).toEqual('{"total":3,"results":[')
+      // first batch is sent before the second one is fetched
+      expect(seen[1]).toEqual('{"total":3,"results":[{"id":1},{"id":2}')
+    })
+    it('produces a valid list response', async () => {
+      const out = new PassThrough()
+      const chunks = collect(out)
+      const { nextBatch } = fakeSource([[{ id: 1 }], [{ id: 2 }]], chunks)
+      const written = await writeJSONList(out, { total: 10, nextBatch })
+      await new Promise(setImmediate)
+      expect(written).toBe(2)
+      expect(JSON.parse(chunks.join(''))).toEqual({
+        total: 10,
+        results: [{ id: 1 }, { id: 2 }],
+      })
+    })
+    it('handles empty results', async () => {
+      const out = new PassThrough()
+      const chunks = collect(out)
+      const { nextBatch } = fakeSource([], chunks)
+      await writeJSONList(out, { total: 0, nextBatch })
+      await new Promise(setImmediate)
+      expect(JSON.parse(chunks.join(''))).toEqual({ total: 0, results: [] })
+    })
+  })
+  describe('writeNDJSON', () => {
+    it('writes one row per line', async () => {
+      const out = new PassThrough()
+      const chunks = collect(out)
+      const { nextBatch, seen } = fakeSource(
+        [[{ id: 1 }, { id: 2 }], [{ id: 3 }]],
+        chunks
+      )
+      const written = await writeNDJSON(out, nextBatch)
+      await new Promise(setImmediate)
+      expect(written).toBe(3)
+      // first batch is sent before the second one is fetched
+      expect(seen[1]).toEqual('{"id":1}\n{"id":2}\n')
+      expect(chunks.join('')).toEqual('{"id":1}\n{"id":2}\n{"id":3}\n')
+    })
+    it('stops when the stream closes while waiting to drain', async () => {
+      // nothing reads `out`, writes past the buffer wait for a drain
+      const out = new PassThrough({ highWaterMark: 8 })
+      const nextBatch = jest.fn(async () => [{ id: 'a'.repeat(32) }])
+      const writing = writeNDJSON(out, nextBatch)
+      await new Promise(setImmediate)
+      out.destroy()
+      await expect(writing).rejects.toBeInstanceOf(StreamClosedError)
+      expect(nextBatch).toHaveBeenCalledTimes(1)
+    })
+    it('stops when the stream errors while waiting to drain', async () => {
+      const out = new PassThrough({ highWaterMark: 8 })
+      out.on('error', () => undefined)
+      const nextBatch = jest.fn(async () => [{ id: 'a'.repeat(32) }])
+      const writing = writeNDJSON(out, nextBatch)
+      await new Promise(setImmediate)
+      out.destroy(new Error('reset'))
+      await expect(writing).rejects.toThrow('reset')
+    })
+    it('reports the written count before ending', async () => {
+      const out = new PassThrough()
+      const chunks = collect(out)
+      const { nextBatch } = fakeSource([[{ id: 1 }]], chunks)
+      const beforeEnd = jest.fn()
+      await writeNDJSON(out, nextBatch, beforeEnd)
+      expect(beforeEnd).toHaveBeenCalledWith(1)
+    })
+  })
+})
@@ -0,0 +1,56 @@
+// ./lib/target-drift.ts test
+import { compareTarget, registrableDomain } from '../lib/target-drift'
+
+describe('Target drift', () => {
+  describe('registrableDomain', () => {
+    it('reduces hosts to eTLD+1', () => {
+      expect(registrableDomain('shop.example.co.uk')).toBe('example.co.uk')
+      expect(registrableDomain('WWW.Example.com.')).toBe('example.com')
+    })
+    it('keeps unlisted hosts', () => {
+      expect(registrableDomain('localhost')).toBe('localhost')
+    })
+  })
+  describe('compareTarget', () => {
+    it('allows redirects to subdomains', () => {
+      expect(
+        compareTarget('https://example.com/', 'https://www.example.com/home')
+      ).toEqual({ drift: false, reason: null })
+    })
+    it('reports a different TLD as domain drift', () => {
+      expect(
+        compareTarget('https://www.example.com/', 'https://www.example.de/')
+      ).toEqual({ drift: true, reason: 'domain' })
+    })
+    it('reports a path change as path drift', () => {
+      expect(
+        compareTarget(
+          'https://www.example.com/checkout',
+          'https://www.example.com/cart'
+        )
+      ).toEqual({ drift: true, reason: 'path' })
+    })
+    it('allows deeper paths below the target', () => {
+      expect(
+        compareTarget(
+          'https://www.example.com/shop/',
+          'https://www.example.com/shop/item?id=1'
+        )
+      ).toEqual({ drift: false, reason: null })
+    })
+    it('matches whole path segments', () => {
+      expect(
+        compareTarget(
+          'https://www.example.com/shop',
+          'https://www.example.com/shopping'
+        ).drift
+      ).toBe(true)
+    })
+    it('ignores URLs that do not parse', () => {
+      expect(compareTarget('https://www.example.com/', 'about:blank')).toEqual({
+        drift: false,
+        reason: null,
+      })
+    })
+  })
+})
@@ -0,0 +1,88 @@
+import { cardFromAlert, requestBody } from '../alerts/teams'
+import { compileTemplate } from '../lib/template'
+
+describe('Teams Alert', function () {
+  describe('cardFromAlert', function () {
+    it('formats a MessageCard', () => {
+      const actual = cardFromAlert(
+        {
+          name: 'scan-failed',
+          message: 'scan of example.com failed',
+          details: 'navigation timeout of 30000 ms exceeded',
+          type: 'error',
+          scan_id: '12345',
+        },
+        'https://merrymaker.example.com'
+      )
+      expect(actual).toEqual({
+        '@type': 'MessageCard',
+        '@context': 'https://schema.org/extensions',
+        summary: 'scan-failed - scan of example.com failed',
+        themeColor: 'D32F2F',
+        title: 'scan-failed',
+        sections: [
+          {
+            activityTitle: 'scan of example.com failed',
+            facts: [
+              { name: 'Level', value: 'error' },
+              { name: 'Scan', value: '12345' },
+            ],
+            text: 'navigation timeout of 30000 ms exceeded',
+          },
+        ],
+        potentialAction: [
+          {
+            '@type': 'OpenUri',
+            name: 'View scan',
+            targets: [
+              {
+                os: 'default',
+                uri: 'https://merrymaker.example.com/scans/12345',
+              },
+            ],
+          },
+        ],
+      })
+    })
+    it('truncates long details', () => {
+      const actual = cardFromAlert(
+        {
+          name: 'rule-alert',
+          message: 'unknown.domain',
+          details: 'x'.repeat(2000),
+          type: 'info',
+          scan_id: '12345',
+        },
+        'https://merrymaker.example.com'
+      )
+      expect(actual.themeColor).toBe('1976D2')
+      expect(actual.sections[0].text).toHaveLength(1024)
+    })
+  })
+  describe('requestBody', function () {
+    const evt = {
+      name: 'scan-failed',
+      message: 'scan of example.com failed',
+      details: 'navigation timeout',
+      type: 'error' as const,
+      scan_id: '12345',
+    }
+    it('defaults to the MessageCard', () => {
+      expect(JSON.parse(requestBody(undefined, 'https://mmk')(evt))).toEqual(
+        cardFromAlert(evt, 'https://mmk')
+      )
+    })
+    it('renders the body template', () => {
+      const template = compileTemplate('{"text": {{ message | json }}}')
+      expect(requestBody(template, 'https://mmk')(evt)).toBe(
+        '{"text": "scan of example.com failed"}'
+      )
+    })
+    it('rejects templates rendering invalid JSON', () => {
+      const template = compileTemplate('{"text": {{ message }}}')
+      expect(() => requestBody(template, 'https://mmk')(evt)).toThrow(
+        'teams body template rendered invalid JSON'
+      )
+    })
+  })
+})
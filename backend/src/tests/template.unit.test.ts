@@ -0,0 +1,83 @@
+// ./lib/template.ts test
+import {
+  compileTemplate,
+  jsonEscape,
+  jsonTemplate,
+  optionalTemplate,
+  TemplateError,
+} from '../lib/template'
+
+describe('Template', () => {
+  const data = {
+    name: 'rule-alert',
+    count: 3,
+    context: { domain: 'example.com', quote: 'say "hi"' },
+  }
+  describe('compileTemplate', () => {
+    it('renders fields', () => {
+      expect(
+        compileTemplate('{{name}} x{{ count }} on {{ context.domain }}')(data)
+      ).toEqual('rule-alert x3 on example.com')
+    })
+    it('renders missing fields as empty strings', () => {
+      expect(compileTemplate('[{{ context.missing.deep }}]')(data)).toEqual(
+        '[]'
+      )
+    })
+    it('renders objects as JSON', () => {
+      expect(compileTemplate('{{ context }}')(data)).toEqual(
+        '{"domain":"example.com","quote":"say \\"hi\\""}'
+      )
+    })
+    it('JSON encodes with the json filter', () => {
+      const body = compileTemplate(
+        '{"text": {{ context.quote | json }}, "none": {{ missing | json }}}'
+      )(data)
+      expect(JSON.parse(body)).toEqual({ text: 'say "hi"', none: null })
+    })
+    it('escapes unfiltered fields', () => {
+      const body = compileTemplate(
+        '{"text": "{{ context.quote }}", "ctx": "{{ context }}"}',
+        jsonEscape
+      )(data)
+      expect(JSON.parse(body)).toEqual({
+        text: 'say "hi"',
+        ctx: JSON.stringify(data.context),
+      })
+    })
+    it.each([
+      ['{"text": "{{ name }"}', 'unclosed tag at 10'],
+      ['{{ }}', 'invalid field "" at 0'],
+      ['{{ context[0] }}', 'invalid field "context[0]" at 0'],
+      ['{{ name | upper }}', 'unknown filter "upper" at 0'],
+      ['{{ name | json | json }}', 'unknown filter "json" at 0'],
+    ])('rejects %s', (source, message) => {
+      expect(() => compileTemplate(source)).toThrow(message)
+    })
+  })
+  describe('optionalTemplate', () => {
+    it('is undefined without a source', () => {
+      expect(optionalTemplate('', 'goAlert')).toBeUndefined()
+      expect(optionalTemplate(undefined, 'goAlert')).toBeUndefined()
+    })
+    it('names the sink of an invalid template', () => {
+      expect(() => optionalTemplate('{{ name', 'teams')).toThrow(
+        new TemplateError('teams body template: unclosed tag at 0')
+      )
+    })
+  })
+  describe('jsonTemplate', () => {
+    it('escapes fields', () => {
+      const template = jsonTemplate('{"text": "{{ context.quote }}"}', 'x', {})
+      expect(JSON.parse(template(data))).toEqual({ text: 'say "hi"' })
+    })
+    it('rejects templates not rendering JSON', () => {
+      expect(() =>
+        jsonTemplate('{"text": {{ context.quote }}}', 'goAlert', data)
+      ).toThrow('goAlert body template renders invalid JSON')
+    })
+    it('is undefined without a source', () => {
+      expect(jsonTemplate('', 'goAlert', data)).toBeUndefined()
+    })
+  })
+})
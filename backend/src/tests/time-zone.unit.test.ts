@@ -0,0 +1,67 @@
+// ./lib/time-zone.ts test
+import {
+  formatInZone,
+  inWindow,
+  isTimeZone,
+  TimeWindow,
+  zonedTime,
+} from '../lib/time-zone'
+
+const chicago = 'America/Chicago'
+
+describe('Time zone', () => {
+  it('isTimeZone', () => {
+    expect(isTimeZone(chicago)).toBe(true)
+    expect(isTimeZone('UTC')).toBe(true)
+    expect(isTimeZone('Mars/Olympus')).toBe(false)
+  })
+  it('zonedTime', () => {
+    // 03:30 UTC Monday is 22:30 Sunday in Chicago (CDT)
+    expect(zonedTime(new Date('2022-09-26T03:30:00Z'), chicago)).toEqual({
+      day: 0,
+      minutes: 22 * 60 + 30,
+    })
+    expect(zonedTime(new Date('2022-09-26T00:00:00Z'), 'UTC')).toEqual({
+      day: 1,
+      minutes: 0,
+    })
+  })
+  it('formatInZone', () => {
+    const date = new Date('2022-09-26T03:30:00Z')
+    expect(formatInZone(date, chicago)).toBe('2022-09-25 22:30')
+    expect(formatInZone(date, 'Asia/Kolkata')).toBe('2022-09-26 09:00')
+  })
+  describe('inWindow', () => {
+    const inChicago = (iso: string, window: TimeWindow) =>
+      inWindow(new Date(iso), window, chicago)
+    const businessHours = {
+      start: '09:00',
+      end: '17:00',
+      days: [1, 2, 3, 4, 5],
+    }
+    it('evaluates local windows against UTC', () => {
+      // 14:30 UTC is 09:30 in Chicago
+      expect(inChicago('2022-09-26T14:30:00Z', businessHours)).toBe(true)
+      // 13:30 UTC is 08:30 in Chicago
+      expect(inChicago('2022-09-26T13:30:00Z', businessHours)).toBe(false)
+      // 23:30 in Tokyo
+      expect(
+        inWindow(new Date('2022-09-26T14:30:00Z'), businessHours, 'Asia/Tokyo')
+      ).toBe(false)
+    })
+    it('follows daylight saving time', () => {
+      // 09:30 / 08:30 CST (UTC-6) in December
+      expect(inChicago('2022-12-05T15:30:00Z', businessHours)).toBe(true)
+      expect(inChicago('2022-12-05T14:30:00Z', businessHours)).toBe(false)
+    })
+    it('handles windows spanning midnight', () => {
+      const overnight = { start: '22:00', end: '06:00', days: [5] }
+      // Friday 23:00 in Chicago
+      expect(inChicago('2022-09-24T04:00:00Z', overnight)).toBe(true)
+      // Saturday 05:00 in Chicago, started Friday
+      expect(inChicago('2022-09-24T10:00:00Z', overnight)).toBe(true)
+      // Sunday 05:00 in Chicago, started Saturday
+      expect(inChicago('2022-09-25T10:00:00Z', overnight)).toBe(false)
+    })
+  })
+})
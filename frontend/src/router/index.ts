@@ -168,6 +168,22 @@ const routes: Array<RouteConfig> = [
           authorize: ['admin']
         }
       },
+      {
+        name: 'Settings',
+        path: '/settings',
+        component: () => import('../views/dashboard/Settings.vue'),
+        meta: {
+          authorize: ['admin']
+        }
+      },
+      {
+        name: 'AuditLog',
+        path: '/audit_log',
+        component: () => import('../views/dashboard/AuditLog.vue'),
+        meta: {
+          authorize: ['admin']
+        }
+      },
       {
         name: 'UserForm',
         path: '/users/edit',
@@ -1,9 +1,17 @@
 /* eslint-disable camelcase */
 import axios from 'axios'
-import { ObjectListResult, ListRequest, ObjectDistinctResult } from './index'
+import {
+  CursorListResult,
+  CursorRequest,
+  ListRequest,
+  ObjectDistinctResult
+} from './index'
+import { ScanLogAttributes } from './scan_logs'
 
 type EagerLoad = 'site'
 
+export type AlertStatus = 'open' | 'acknowledged' | 'resolved' | 'false_positive'
+
 export interface AlertAttributes {
   id: string
   rule: string
@@ -12,17 +20,106 @@ export interface AlertAttributes {
   scan_id?: string
   site_id?: string
   site?: { name: string }
+  severity?: string | null
+  status?: AlertStatus
+  status_updated_at?: Date | null
+  status_updated_by?: string | null
+  status_note?: string | null
   created_at: Date
 }
 
-interface AlertListRequest extends ListRequest<AlertAttributes> {
+interface AlertFilterRequest {
   site_id?: string
   scan_id?: string
   rule?: string[]
+  severity?: string[]
+  status?: AlertStatus[]
+  created_after?: string
+  created_before?: string
   search?: string
+}
+
+interface AlertListRequest
+  extends ListRequest<AlertAttributes>,
+    AlertFilterRequest,
+    CursorRequest {
   eager?: Array<EagerLoad>
 }
 
+type AlertEventResult = {
+  event_id: string | null
+  // false when the event was purged
+  available: boolean
+  scan_log?: ScanLogAttributes
+}
+
+export interface AlertDeliveryAttributes {
+  id: string
+  alert_id?: string | null
+  sink: string
+  attempt: number
+  status: string
+  response?: Record<string, unknown> | null
+  retry_delay_ms?: number | null
+  next_attempt_at?: Date | null
+  // failed attempt this one redelivers
+  redelivery_of?: string | null
+  created_at: Date
+}
+
+export type AlertDeliveryHistory = {
+  sink: string
+  // status of the latest attempt
+  status: string
+  attempts: number
+  first_attempt_at?: Date
+  last_attempt_at?: Date
+  // retry of a failed latest attempt
+  next_attempt_at: Date | null
+  next_retry_in_ms: number | null
+  // oldest first
+  history: AlertDeliveryAttributes[]
+}
+
+export type AlertSinkAttributes = {
+  key: string
+  name: string
+  enabled: boolean
+  fallback: string | null
+  // empty when the sink receives every rule
+  rule_types: string[]
+}
+
+export type AlertSinkTestResult = {
+  sink: string
+  delivered: boolean
+  // null for sinks without HTTP responses
+  status: number | null
+  latency_ms: number
+  error?: string
+}
+
+type AlertRedeliveryResult = {
+  job_id: string
+  delivery_id: string
+  sink: string
+}
+
+type AlertTransitionRequest = {
+  id: string
+  status: AlertStatus
+  note?: string
+  // false positives only, allow-lists the alert's context domain
+  allow_list?: boolean
+}
+
+type AlertTransitionResult = {
+  alert: AlertAttributes
+  allow_list?: { id: string; key: string; type: string }
+}
+
+type AlertStatusCounts = Record<AlertStatus | 'handled', number>
+
 type AlertAggRequest = {
   interval_hours?: number
   start_time?: Date
@@ -34,11 +131,18 @@ type AlertAggResult = {
 }
 
 const list = async (params?: AlertListRequest) =>
-  axios.get<ObjectListResult<AlertAttributes>>('/api/alerts', { params })
+  axios.get<CursorListResult<AlertAttributes>>('/api/alerts', { params })
+
+// total of the list filters, cursor pages omit it
+const count = async (params?: AlertFilterRequest) =>
+  axios.get<{ total: number }>('/api/alerts/count', { params })
 
 const view = async (params: { id: string }) =>
   axios.get<AlertAttributes>(`/api/alerts/${params.id}`)
 
+const event = async (params: { id: string }) =>
+  axios.get<AlertEventResult>(`/api/alerts/${params.id}/event`)
+
 const destroy = async (params: { id: string }) =>
   axios.delete(`/api/scans/${params.id}`)
 
@@ -50,11 +154,52 @@ const distinct = async (params: { column: keyof AlertAttributes }) =>
 const agg = async (params?: AlertAggRequest) =>
   axios.get<AlertAggResult>('/api/alerts/agg', { params })
 
+const transition = async ({ id, ...alert_status }: AlertTransitionRequest) =>
+  axios.post<AlertTransitionResult>(`/api/alerts/${id}/status`, {
+    alert_status
+  })
+
+const deliveries = async (params: { id: string; status?: string[] }) =>
+  axios.get<{ results: AlertDeliveryAttributes[] }>(
+    `/api/alerts/${params.id}/deliveries`,
+    { params: { status: params.status } }
+  )
+
+// attempts grouped per sink, the latest `limit` of each when set
+const deliveryHistory = async (params: { id: string; limit?: number }) =>
+  axios.get<{ results: AlertDeliveryHistory[] }>(
+    `/api/alerts/${params.id}/deliveries/history`,
+    { params: { limit: params.limit } }
+  )
+
+const redeliver = async (params: { id: string; delivery_id: string }) =>
+  axios.post<AlertRedeliveryResult>(
+    `/api/alerts/${params.id}/deliveries/${params.delivery_id}/redeliver`
+  )
+
+const sinks = async () =>
+  axios.get<{ results: AlertSinkAttributes[] }>('/api/alerts/sinks')
+
+// sends a synthetic event, no alert is created
+const testSink = async (key: string) =>
+  axios.post<AlertSinkTestResult>(`/api/alerts/sinks/${key}/test`)
+
+const statusCounts = async () =>
+  axios.get<AlertStatusCounts>('/api/alerts/status-counts')
 
 export default {
   agg,
+  count,
+  deliveries,
+  deliveryHistory,
+  redeliver,
+  sinks,
+  statusCounts,
+  testSink,
+  transition,
   list,
   view,
+  event,
   destroy,
   distinct
 }
@@ -13,6 +13,8 @@ export interface AllowListAttributes {
   id: string
   type: AllowListType
   key: string
+  // null never expires
+  expires_at: string | null
   created_at: Date
 }
 
@@ -20,6 +22,7 @@ export interface AllowListRequest {
   id?: string
   type: AllowListType
   key: string
+  expires_at?: string | null
 }
 
 interface AllowListListRequest extends ListRequest<AllowListAttributes> {
@@ -0,0 +1,40 @@
+/* eslint-disable camelcase */
+import axios from 'axios'
+import { ObjectListResult, ListRequest } from './index'
+
+export type AuditEntityType =
+  | 'site'
+  | 'allow_list'
+  | 'ioc'
+  | 'secret'
+  | 'alert_sink'
+  | 'setting'
+
+export type AuditChanges = Record<string, { from?: unknown; to?: unknown }>
+
+export interface AuditLogAttributes {
+  id: string
+  actor: string
+  action: string
+  entity_type: AuditEntityType
+  entity_id: string | null
+  changes: AuditChanges | null
+  created_at: Date
+}
+
+interface AuditLogListRequest extends ListRequest<AuditLogAttributes> {
+  actor?: string
+  entity_type?: AuditEntityType
+  entity_id?: string
+  from?: string
+  to?: string
+}
+
+const list = async (params?: AuditLogListRequest) =>
+  axios.get<ObjectListResult<AuditLogAttributes>>('/api/audit_logs', {
+    params,
+  })
+
+export default {
+  list,
+}
@@ -3,6 +3,19 @@ export interface ObjectListResult<M> {
   total: number
 }
 
+// keyset pages omit `total`
+export interface CursorListResult<M> {
+  results: M[]
+  total?: number
+  next_cursor: string | null
+  prev_cursor: string | null
+}
+
+export interface CursorRequest {
+  cursor_after?: string
+  cursor_before?: string
+}
+
 export type ObjectDistinctResult<M> = Array<Record<keyof M, string>>
 
 export interface ListRequest<M> {
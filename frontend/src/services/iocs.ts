@@ -2,13 +2,22 @@
 import axios from 'axios'
 import { ObjectListResult, ListRequest } from './index'
 
-export type IocType = 'fqdn' | 'ip' | 'regex' | 'wildcard' | 'literal'
+export type IocType =
+  | 'fqdn'
+  | 'ip'
+  | 'regex'
+  | 'wildcard'
+  | 'literal'
+  | 'url'
+  | 'ip_cidr'
+  | 'sha256'
 
 export interface IocAttributes {
   id: string
   type: IocType
   value: string
   enabled: boolean
+  expires_at: string | null
   created_at: Date
 }
 
@@ -18,6 +27,7 @@ export interface IocRequest {
     type: IocType
     value: string
     enabled: boolean
+    expires_at?: string | null
   }
 }
 
@@ -26,6 +36,7 @@ export interface IocBulkCreateRequest {
     values: string[]
     enabled: boolean
     type: IocType
+    expires_at?: string | null
   }
 }
 
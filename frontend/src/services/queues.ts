@@ -4,6 +4,19 @@ export interface Queues {
   schedule: number
   event: number
   scanner: number
+  // completed scans with events waiting for rules
+  awaiting_rules?: number
+  awaiting_rule_events?: number
+  // alert jobs waiting for their scan log job
+  held_alerts?: number
+  held_alert_jobs?: HeldAlert[]
+}
+
+export interface HeldAlert {
+  job_id: string
+  scan_id: string
+  // scan log job the alert job waits for
+  depends_on: string
 }
 
 const view = async () => axios.get<Queues>('/api/queues')
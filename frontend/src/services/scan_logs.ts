@@ -30,6 +30,10 @@ export interface ListRequest<M> {
   orderColumn?: keyof M
   orderDirection?: 'asc' | 'desc'
   search?: string
+  // match `search` as a substring of the event JSON
+  search_body?: boolean
+  // event filter expression (see `where` on /api/scan_logs)
+  where?: string
 }
 
 export type ObjectDistinctResult<M> = Array<Record<keyof M, string>>
@@ -41,6 +45,13 @@ export type ObjectDistinctResult<M> = Array<Record<keyof M, string>>
 const list = async (params?: ListRequest<ScanLogAttributes>) =>
   axios.get<ObjectListResult<ScanLogAttributes>>('/api/scan_logs', { params })
 
+/**
+ * view
+ * returns a single `ScanLog`
+ */
+const view = async (params: { id: string }) =>
+  axios.get<ScanLogAttributes>(`/api/scan_logs/${params.id}`)
+
 /**
  * distinct
  * returns array of distinct `column` values for a given scan
@@ -54,7 +65,21 @@ const distinct = async (params: {
     { params: { column: params.column } }
   )
 
+export type EntryFacet = {
+  entry: string
+  count: number
+}
+
+/**
+ * facets
+ * returns the number of events per `entry` for a given scan
+ */
+const facets = async (params: { id: string }) =>
+  axios.get<EntryFacet[]>(`/api/scan_logs/${params.id}/facets`)
+
 export default {
   list,
+  view,
   distinct,
+  facets,
 }
@@ -1,6 +1,6 @@
 /* eslint-disable camelcase */
 import axios from 'axios'
-import { ObjectListResult, ListRequest } from './index'
+import { CursorListResult, CursorRequest, ListRequest } from './index'
 import { SiteAttributes } from './sites'
 import { SourceAttributes } from './sources'
 
@@ -18,24 +18,36 @@ export interface ScanAttributes {
   source?: SourceAttributes
 }
 
-export interface ScanListRequest extends ListRequest<ScanAttributes> {
+export interface ScanListRequest
+  extends ListRequest<ScanAttributes>,
+    CursorRequest {
   eager?: Array<EagerLoad>
   site_id?: string
   entry?: string[]
+  state?: string[]
   no_test?: boolean
 }
 
 export interface ScanSummary {
   requests: Record<string, Array<[string, number]>>
   totalReq: number
+  totalIPHostReq: number
   totalAlerts: number
   totalErrors: number
   totalFunc: number
   totalCookies: number
+  domainCapReached: boolean
+  untrackedReq: number
+  samplesDisabled: boolean
+  // alerts collapsed into an alert storm summary
+  suppressedAlerts: number
+  suppressedDomains: string[]
+  // scan ran while the site was in learning mode
+  learningMode: boolean
 }
 
 const list = async (params?: ScanListRequest) =>
-  axios.get<ObjectListResult<ScanAttributes>>('/api/scans', { params })
+  axios.get<CursorListResult<ScanAttributes>>('/api/scans', { params })
 
 const view = async (params: { id: string; eager?: EagerLoad[] }) =>
   axios.get<ScanAttributes>(`/api/scans/${params.id}`, {
@@ -48,13 +60,84 @@ const summary = (params: { id: string }) =>
 const destroy = async (params: { id: string }) =>
   axios.delete(`/api/scans/${params.id}`)
 
+const cancel = async (params: { id: string }) =>
+  axios.post<ScanAttributes>(`/api/scans/${params.id}/cancel`)
+
 const bulkDelete = async (params: { ids: string[] }) =>
   axios.post('/api/scans/bulk_delete', { scans: { ids: params.ids } })
 
+export class ExportError extends Error {
+  constructor(public status: number, message: string) {
+    super(message)
+  }
+}
+
+/**
+ * exportEvents
+ *
+ * Downloads every event of the scan as NDJSON. An interrupted
+ * download resumes after the last complete line (`cursor`), up
+ * to `retries` times, so no event is skipped or duplicated
+ */
+const exportEvents = async (params: {
+  id: string
+  onProgress: (received: number, total: number) => void
+  retries?: number
+}): Promise<Blob> => {
+  const retries = params.retries === undefined ? 3 : params.retries
+  const lines: string[] = []
+  let cursor = ''
+  let total = 0
+  let attempts = 0
+  for (;;) {
+    const query = cursor ? `?after_cursor=${encodeURIComponent(cursor)}` : ''
+    try {
+      const res = await fetch(`/api/scans/${params.id}/events/export${query}`, {
+        credentials: 'same-origin',
+      })
+      if (!res.ok || !res.body) {
+        const body = await res.json().catch(() => ({}))
+        throw new ExportError(res.status, body.message || res.statusText)
+      }
+      // rows left after the cursor
+      total = lines.length + Number(res.headers.get('X-Total-Count') || 0)
+      const reader = res.body.getReader()
+      const decoder = new TextDecoder()
+      let partial = ''
+      for (;;) {
+        const { done, value } = await reader.read()
+        if (done) break
+        partial += decoder.decode(value, { stream: true })
+        const complete = partial.split('\n')
+        partial = complete.pop() || ''
+        complete
+          .filter((line) => line.length > 0)
+          .forEach((line) => {
+            lines.push(line)
+            cursor = JSON.parse(line).cursor
+          })
+        params.onProgress(lines.length, total)
+      }
+      return new Blob(
+        lines.map((line) => `${line}\n`),
+        { type: 'application/x-ndjson' }
+      )
+    } catch (e) {
+      // client errors (limits, bad cursor) are not retried
+      if (e instanceof ExportError || attempts >= retries) {
+        throw e
+      }
+      attempts += 1
+    }
+  }
+}
+
 export default {
   list,
   view,
   destroy,
+  cancel,
   bulkDelete,
   summary,
+  exportEvents,
 }
@@ -4,11 +4,23 @@ import { ObjectListResult, ListRequest } from './index'
 
 export type SecretTypes = 'qt' | 'manual'
 
+// source of refreshed values, null for the default
+export type SecretProvider = 'vault'
+
+// unchanged: the refreshed value is identical to the previous one
+export type SecretRefreshStatus = 'succeeded' | 'failed' | 'unchanged'
+
 export interface SecretAttributes {
   id?: string
   name: string
   type: SecretTypes
   value: string
+  last_refreshed_at?: Date | null
+  last_refresh_status?: SecretRefreshStatus | null
+  last_refresh_error?: string | null
+  refresh_interval_minutes?: number | null
+  provider?: SecretProvider | null
+  provider_ref?: string | null
   created_at?: Date
   updated_at?: Date
 }
@@ -17,9 +29,20 @@ export interface SecretTypesResponse {
   types: Partial<SecretTypes>[]
 }
 
-type SecretCreateRequest = Pick<SecretAttributes, 'name' | 'type' | 'value'>
+type SecretCreateRequest = Pick<
+  SecretAttributes,
+  | 'name'
+  | 'type'
+  | 'value'
+  | 'refresh_interval_minutes'
+  | 'provider'
+  | 'provider_ref'
+>
 
-type SecretUpdateRequest = Pick<SecretAttributes, 'type' | 'value'>
+type SecretUpdateRequest = Pick<
+  SecretAttributes,
+  'type' | 'value' | 'refresh_interval_minutes' | 'provider' | 'provider_ref'
+>
 
 interface SecretListRequest extends ListRequest<SecretAttributes> {
   name?: string
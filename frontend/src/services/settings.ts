@@ -0,0 +1,37 @@
+/* eslint-disable camelcase */
+import axios from 'axios'
+
+export type SettingValue = string | number | boolean | string[]
+
+export interface SettingAttributes {
+  key: string
+  description: string
+  schema: {
+    type: 'string' | 'integer' | 'number' | 'boolean' | 'array'
+    enum?: string[]
+    minimum?: number
+    // arrays, e.g. the rules of an alert sink
+    items?: { type: string; enum?: string[] }
+  }
+  default: SettingValue
+  value: SettingValue | null
+  effective: SettingValue
+  updated_by?: string
+  updated_at?: Date
+}
+
+const list = async () => axios.get<SettingAttributes[]>('/api/settings')
+
+const update = async (key: string, value: SettingValue) =>
+  axios.put<SettingAttributes>(`/api/settings/${key}`, {
+    setting: { value },
+  })
+
+const destroy = async (params: { key: string }) =>
+  axios.delete(`/api/settings/${params.key}`)
+
+export default {
+  list,
+  update,
+  destroy,
+}
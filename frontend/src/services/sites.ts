@@ -2,6 +2,27 @@
 import axios from 'axios'
 import { ObjectListResult, ListRequest } from './index'
 
+export type OverrunPolicy = 'queue' | 'queue-bounded' | 'skip'
+
+export type Severity = 'low' | 'medium' | 'high' | 'critical'
+
+export type RulesConfig = Record<string, { enabled: boolean }>
+
+// scanner rules that can be turned off per site
+export const configurableRules = [
+  'unknown.domain',
+  'ioc.domain',
+  'ioc.url',
+  'ioc.ip',
+  'ioc.hash',
+  'ioc.payload',
+  'google.analytics',
+  'yara',
+  'domain.via.websocket',
+  'script.hash',
+  'exfil',
+]
+
 export interface SiteAttributes {
   id: string
   name: string
@@ -9,6 +30,20 @@ export interface SiteAttributes {
   active: boolean
   run_every_minutes: number
   source_id: string
+  overrun_policy: OverrunPolicy | null
+  alert_ttl_minutes: number | null
+  unknown_domain_severity: Severity
+  seen_min_hits: number | null
+  seen_baseline_ttl_days: number | null
+  priority: number
+  rules_config: RulesConfig | null
+  ioc_exceptions: string[] | null
+  untrusted_suffixes: string[] | null
+  // learning mode (no unknown domain alerts) ends at
+  baseline_until: Date | string | null
+  target_url: string | null
+  last_url: string | null
+  drift_count: number
   created_at: Date
   updated_at: Date
 }
@@ -19,6 +54,39 @@ export interface SiteRequest {
   active: boolean
   run_every_minutes: number
   source_id: string
+  overrun_policy: OverrunPolicy | null
+  alert_ttl_minutes: number | null
+  unknown_domain_severity: Severity
+  seen_min_hits: number | null
+  seen_baseline_ttl_days: number | null
+  priority: number
+  rules_config: RulesConfig | null
+  ioc_exceptions: string[] | null
+  untrusted_suffixes: string[] | null
+  // learning mode (no unknown domain alerts) ends at
+  baseline_until: Date | string | null
+  target_url: string | null
+}
+
+export interface TargetDrift {
+  target_url: string | null
+  last_url: string | null
+  runs: number
+  drifting: boolean
+}
+
+export interface SiteSummary {
+  scans: number
+  totalAlerts: number
+  rules: Record<string, number>
+  targetDrift: TargetDrift
+}
+
+export interface SiteSchedule {
+  last_run: string | null
+  next_run: string
+  time_zone: string
+  next_run_local: string
 }
 
 export interface NewSiteResult {
@@ -33,6 +101,12 @@ const list = async (params?: SiteListRequest) =>
 const view = async (params: { id: string }) =>
   axios.get<SiteAttributes>(`/api/sites/${params.id}`)
 
+const summary = async (params: { id: string }) =>
+  axios.get<SiteSummary>(`/api/sites/${params.id}/summary`)
+
+const schedule = async (params: { id: string }) =>
+  axios.get<SiteSchedule>(`/api/sites/${params.id}/schedule`)
+
 const create = async (params: SiteRequest) =>
   axios.post<SiteRequest>('/api/sites', { site: params })
 
@@ -45,6 +119,8 @@ const destroy = async (params: { id: string }) =>
 export default {
   list,
   view,
+  summary,
+  schedule,
   create,
   update,
   destroy,
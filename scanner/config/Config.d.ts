@@ -8,6 +8,67 @@ declare module "node-config-ts" {
     session: Session
     oauth: Oauth
     transport: Transport
+    worker: Worker
+    seenStrings: SeenStrings
+    rules: Rules
+    metrics: Metrics
+  }
+  interface Metrics {
+    client: 'none' | 'log'
+  }
+  interface SeenStrings {
+    // hits per bulk record request
+    recordBatchSize: number
+  }
+  interface Rules {
+    unknownDomain: UnknownDomain
+    dns: Dns
+  }
+  interface Dns {
+    enabled: boolean
+    timeoutMs: number
+    maxPerScan: number
+    cacheSeconds: number
+  }
+  interface UnknownDomain {
+    normalizeDomain: boolean
+    alertOnIPHosts: boolean
+    globalAllowlist: GlobalAllowlist
+    risk: Risk
+    // context fields kept in alerts, `domain` and `severity` always are
+    contextFields: string[]
+  }
+  interface GlobalAllowlist {
+    enabled: boolean
+    file: string
+  }
+  interface Risk {
+    enabled: boolean
+    severity: string
+    tlds: string[]
+    dga: Dga
+  }
+  interface Dga {
+    minLength: number
+    digitRatio: number
+    consonantRun: number
+    minSignals: number
+  }
+  interface Worker {
+    pollInterval: number
+    maxPollInterval: number
+    batchSize: number
+    ruleConcurrency: number
+    domainConcurrency: number
+    leaseMs: number
+    // attempts of a rule job, jobs cancelled at the lease deadline
+    // are retried until they run out
+    ruleJobAttempts: number
+    // rule job lock, extended every `heartbeatMs` while batches run
+    lockMs: number
+    heartbeatMs: number
+    // how often jobs with an expired lock are moved back to wait
+    stalledCheckMs: number
   }
   interface Transport {
     http: string
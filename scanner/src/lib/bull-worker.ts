@@ -3,34 +3,196 @@
 import { EventEmitter } from 'events'
 import { Job, Queue, JobId, DoneCallback } from 'bull'
 
+// HGETALL reply (flat key / value list) to an object
+const toObject = (raw: string[]): Record<string, string> => {
+  const obj: Record<string, string> = {}
+  for (let i = 0; i < raw.length; i += 2) {
+    obj[raw[i]] = raw[i + 1]
+  }
+  return obj
+}
+
 export default class BullWorker extends EventEmitter {
-  public job!: Job | null
+  public job: Job | null = null
+  protected currentDelay: number
+  private wakeUp: (() => void) | null = null
+  private draining = false
+  private polling = false
+  /**
+   * @param delay base poll interval (ms) used while jobs are available
+   * @param queue bull queue to reserve jobs from
+   * @param work job handler
+   * @param maxDelay upper bound (ms) for the empty-queue backoff
+   */
   constructor(
     protected delay: number,
     protected queue: Queue<any>,
-    public work: (job: Job, done?: DoneCallback) => Promise<any>
+    public work: (job: Job, done?: DoneCallback) => Promise<any>,
+    protected maxDelay: number = delay
   ) {
     super()
+    this.currentDelay = delay
+  }
+
+  /**
+   * pollInterval
+   *
+   * current delay (ms) used between empty-queue checks
+   */
+  get pollInterval(): number {
+    return this.currentDelay
   }
 
   private async sleep(ms: number) {
     this.emit('info', `Sleeping for ${ms}ms`)
-    return new Promise((resolve) => setTimeout(resolve, ms))
+    return new Promise<void>((resolve) => {
+      const timer = setTimeout(() => {
+        this.wakeUp = null
+        resolve()
+      }, ms)
+      this.wakeUp = () => {
+        clearTimeout(timer)
+        this.wakeUp = null
+        resolve()
+      }
+    })
+  }
+
+  /**
+   * wake
+   *
+   * interrupts the current empty-queue sleep so the next
+   * check happens immediately (e.g. on a queue `waiting` event)
+   */
+  wake(): void {
+    if (this.wakeUp) {
+      this.wakeUp()
+    }
+  }
+
+  /**
+   * isDraining
+   *
+   * true while new jobs are refused
+   */
+  get isDraining(): boolean {
+    return this.draining
+  }
+
+  /**
+   * setDraining
+   *
+   * stops (or resumes) reserving new jobs. The job in progress
+   * is still completed / failed and its lock released
+   */
+  setDraining(draining: boolean): void {
+    this.draining = draining
+    if (draining) {
+      this.wake()
+    }
+  }
+
+  /**
+   * drain
+   *
+   * refuses new jobs and resolves once `poll` has finished
+   * the job in progress (immediately when not polling)
+   */
+  async drain(): Promise<void> {
+    const drained = this.polling
+      ? new Promise<void>((resolve) => this.once('drained', resolve))
+      : Promise.resolve()
+    this.setDraining(true)
+    return drained
+  }
+
+  /**
+   * reserveBatch
+   *
+   * reserves up to `max` waiting jobs (queue priority order) in a
+   * single redis round-trip, each locked exactly as `poll` locks a
+   * single job (queue rate limits are not applied). Returns an
+   * empty array when the queue is empty or the worker is draining
+   */
+  async reserveBatch(max: number): Promise<Job[]> {
+    if (this.draining || max < 1) return []
+    const queue = this.queue as any
+    const keys = queue.keys
+    const pipeline = queue.client.pipeline()
+    for (let i = 0; i < max; i++) {
+      // same keys and arguments as bull's `scripts.moveToActive`,
+      // an empty job ID pops the next waiting job
+      pipeline.moveToActive([
+        keys.wait,
+        keys.active,
+        keys.priority,
+        `${keys.active}@${queue.token}`,
+        keys.stalled,
+        keys.limiter,
+        keys.delayed,
+        keys.drained,
+        keys[''],
+        queue.token,
+        queue.settings.lockDuration,
+        Date.now(),
+        ''
+      ])
+    }
+    const replies: Array<[Error | null, [string[], string] | null]> =
+      await pipeline.exec()
+    const jobs: Job[] = []
+    for (const [err, reply] of replies) {
+      if (err) {
+        this.emit('error', `error reserving job - (${err.message})`)
+        continue
+      }
+      if (!reply || !reply[0] || reply[0].length === 0) continue
+      jobs.push(this.queue.nextJobFromJobData(toObject(reply[0]), reply[1]))
+    }
+    return jobs
+  }
+
+  /**
+   * checkStalled
+   *
+   * moves jobs whose lock expired (e.g. of a crashed worker) back to
+   * wait every `intervalMs`. Bull only runs this check for queues it
+   * processes itself, never for jobs reserved by `poll`/`pollBatch`.
+   * Returns a stop function
+   */
+  checkStalled(intervalMs: number): () => void {
+    const timer = setInterval(() => {
+      ;(this.queue as any).moveUnlockedJobsToWait().catch((e: Error) => {
+        this.emit('error', `error checking stalled jobs - (${e.message})`)
+      })
+    }, intervalMs)
+    return () => clearInterval(timer)
   }
 
   async poll(): Promise<void> {
+    this.polling = true
     this.emit('info', 'Checking for new jobs')
-    this.job = await this.queue.getNextJob()
+    if (!this.draining) {
+      this.job = await this.queue.getNextJob()
+    }
     let result: null | [any, JobId]
     while (true) {
       await this.waitForJob()
-      if (this.job === null) continue
+      if (this.job === null) {
+        if (this.draining) break
+        continue
+      }
       this.emit('info', `new job ${this.job.id} found`)
       this.emit('info', `starting work on ${this.job.id}`)
       try {
         await this.work(this.job)
         this.emit('info', `job ${this.job.id} completed`)
-        result = await this.job.moveToCompleted('succeeded', true)
+        // fetching the next job reserves it, skipped while draining
+        result = await this.job.moveToCompleted(
+          'succeeded',
+          true,
+          this.draining
+        )
       } catch (e) {
         this.emit(
           'error',
@@ -55,13 +217,136 @@ export default class BullWorker extends EventEmitter {
         this.job = null
       }
     }
+    this.polling = false
+    this.emit('info', 'drained')
+    this.emit('drained')
+  }
+
+  /**
+   * heartbeat
+   *
+   * extends the lock of every job in `jobs` to `lockMs` each
+   * `intervalMs`, independently (a lost lock only affects its job).
+   * Finished jobs are removed from the set by the caller. Returns
+   * a stop function
+   */
+  heartbeat(jobs: Set<Job>, lockMs: number, intervalMs: number): () => void {
+    const timer = setInterval(() => {
+      jobs.forEach((job) => {
+        job.extendLock(lockMs).catch((e: Error) => {
+          this.emit('error', `error extending lock on ${job.id} - (${e.message})`)
+        })
+      })
+    }, intervalMs)
+    return () => clearInterval(timer)
+  }
+
+  /**
+   * pollBatch
+   *
+   * same as `poll`, but reserves up to `size` jobs at a time and
+   * hands them to `workBatch`, which resolves with one result per
+   * job. Jobs with an `Error` result are failed (bull retries them
+   * while attempts are left), the others are completed. Each job's
+   * lock is released on its own.
+   *
+   * With `heartbeatMs` the locks of unfinished jobs are extended
+   * to `lockMs` while the batch runs, locks can then stay short
+   * (the queue `lockDuration`) so jobs of a crashed worker are
+   * picked up again quickly by `checkStalled`
+   */
+  async pollBatch(
+    size: number,
+    workBatch: (jobs: Job[]) => Promise<unknown[]>,
+    opts: { lockMs?: number; heartbeatMs?: number } = {}
+  ): Promise<void> {
+    this.polling = true
+    this.emit('info', 'Checking for new jobs')
+    while (true) {
+      const jobs = await this.waitForBatch(size)
+      if (jobs.length === 0) {
+        if (this.draining) break
+        continue
+      }
+      this.emit('info', `starting work on batch of ${jobs.length} jobs`)
+      const unfinished = new Set(jobs)
+      const stopHeartbeat =
+        opts.heartbeatMs > 0
+          ? this.heartbeat(unfinished, opts.lockMs, opts.heartbeatMs)
+          : () => undefined
+      let results: unknown[]
+      try {
+        results = await workBatch(jobs)
+      } catch (e) {
+        results = jobs.map(() => e)
+      }
+      for (let i = 0; i < jobs.length; i++) {
+        const job = jobs[i]
+        const result = results[i]
+        unfinished.delete(job)
+        try {
+          if (result instanceof Error) {
+            this.emit(
+              'error',
+              `error while working ${job.id} - attempts (${job.attemptsMade}) (${result.message})`
+            )
+            await job.moveToFailed(result, true)
+            if (job.finishedOn) {
+              this.emit('failed', job)
+            }
+          } else {
+            this.emit('info', `job ${job.id} completed`)
+            await job.moveToCompleted('succeeded', true, true)
+          }
+        } catch (e) {
+          this.emit('error', `error finishing ${job.id} - (${e.message})`)
+        }
+        try {
+          await job.releaseLock()
+        } catch (e) {
+          this.emit('error', `error releasing lock on ${job.id} - (${e.message}`)
+        }
+      }
+      stopHeartbeat()
+    }
+    this.polling = false
+    this.emit('info', 'drained')
+    this.emit('drained')
+  }
+
+  /**
+   * waitForBatch
+   *
+   * `waitForJob` for `pollBatch`, resolves with the reserved jobs
+   * (empty while draining)
+   */
+  async waitForBatch(size: number): Promise<Job[]> {
+    while (true) {
+      const jobs = await this.reserveBatch(size)
+      if (jobs.length > 0 || this.draining) {
+        this.currentDelay = this.delay
+        return jobs
+      }
+      await this.sleep(this.currentDelay)
+      this.currentDelay = Math.min(this.currentDelay * 2, this.maxDelay)
+    }
   }
 
+  /**
+   * waitForJob
+   *
+   * polls the queue until a job is reserved. Each empty check doubles
+   * the poll interval (capped at `maxDelay`); finding work resets it.
+   * Returns without a job while draining
+   */
   async waitForJob(): Promise<void> {
     while (!this.job) {
+      if (this.draining) return
       this.job = await this.queue.getNextJob()
-      if (this.job) return
-      await this.sleep(this.delay)
+      if (this.job) break
+      await this.sleep(this.currentDelay)
+      this.currentDelay = Math.min(this.currentDelay * 2, this.maxDelay)
     }
+    this.currentDelay = this.delay
   }
 }
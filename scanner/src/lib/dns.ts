@@ -0,0 +1,152 @@
+// DNS answers recorded with alerts (forensics)
+import { promises as dns } from 'dns'
+import LRUCache from 'lru-native2'
+
+export type DNSAnswers = {
+  a: string[]
+  aaaa: string[]
+  cname: string[]
+  resolved_at: string
+  // set when the lookup failed or timed out
+  error?: string
+}
+
+export interface DNSResolver {
+  resolve4(hostname: string): Promise<string[]>
+  resolve6(hostname: string): Promise<string[]>
+  resolveCname(hostname: string): Promise<string[]>
+}
+
+// subset of the redis client used to share answers between jobs
+export interface DNSCache {
+  get(key: string): Promise<string | null>
+  setex(key: string, seconds: number, value: string): Promise<unknown>
+}
+
+export type DNSLookupOptions = {
+  enabled: boolean
+  timeoutMs: number
+  // max lookups per scan
+  maxPerScan: number
+  cacheSeconds: number
+  resolver?: DNSResolver
+  cache?: DNSCache | null
+}
+
+// no record of the type is not an error
+const noData = ['ENODATA', 'ENOTFOUND']
+
+const withTimeout = <T>(p: Promise<T>, ms: number): Promise<T> =>
+  new Promise((resolve, reject) => {
+    const timer = setTimeout(() => reject(new Error('timeout')), ms)
+    p.then(
+      (v) => {
+        clearTimeout(timer)
+        resolve(v)
+      },
+      (e) => {
+        clearTimeout(timer)
+        reject(e)
+      }
+    )
+  })
+
+export class DNSLookup {
+  options: DNSLookupOptions
+  resolver: DNSResolver
+  // lookups made per scan
+  counts = new LRUCache<number>({
+    maxElements: 1000,
+    maxAge: 1000 * 60 * 60,
+    size: 100,
+    maxLoadFactor: 2.0
+  })
+
+  constructor(options: DNSLookupOptions) {
+    this.options = options
+    this.resolver = options.resolver || new dns.Resolver()
+  }
+
+  /**
+   * lookup
+   *
+   * resolves A / AAAA / CNAME records of `hostname`. returns null
+   * when disabled or `maxPerScan` lookups were already made for
+   * `scanID`. never throws, failures are returned in `error`
+   */
+  async lookup(hostname: string, scanID: string): Promise<DNSAnswers | null> {
+    if (!this.options.enabled) {
+      return null
+    }
+    const cacheKey = `dns:${hostname}`
+    const cached = await this.fromCache(cacheKey)
+    if (cached) {
+      return cached
+    }
+    const count = this.counts.get(scanID) || 0
+    if (count >= this.options.maxPerScan) {
+      return null
+    }
+    this.counts.set(scanID, count + 1)
+    const answers = await this.resolve(hostname)
+    if (answers.error === undefined && this.options.cache) {
+      try {
+        await this.options.cache.setex(
+          cacheKey,
+          this.options.cacheSeconds,
+          JSON.stringify(answers)
+        )
+      } catch (e) {
+        // cache is best effort
+      }
+    }
+    return answers
+  }
+
+  async resolve(hostname: string): Promise<DNSAnswers> {
+    const answers: DNSAnswers = {
+      a: [],
+      aaaa: [],
+      cname: [],
+      resolved_at: new Date().toISOString()
+    }
+    const query = async (fn: (h: string) => Promise<string[]>) => {
+      try {
+        return await fn.call(this.resolver, hostname)
+      } catch (e) {
+        if (noData.includes(e.code)) {
+          return []
+        }
+        throw e
+      }
+    }
+    try {
+      const [a, aaaa, cname] = await withTimeout(
+        Promise.all([
+          query(this.resolver.resolve4),
+          query(this.resolver.resolve6),
+          query(this.resolver.resolveCname)
+        ]),
+        this.options.timeoutMs
+      )
+      answers.a = a
+      answers.aaaa = aaaa
+      answers.cname = cname
+    } catch (e) {
+      answers.error = e.message
+    }
+    return answers
+  }
+
+  async fromCache(key: string): Promise<DNSAnswers | null> {
+    if (!this.options.cache) {
+      return null
+    }
+    try {
+      const hit = await this.options.cache.get(key)
+      return hit ? JSON.parse(hit) : null
+    } catch (e) {
+      return null
+    }
+  }
+}
@@ -0,0 +1,108 @@
+// Heuristics for suspicious looking domains (risky TLDs, DGA-like names)
+import { IResult } from 'tldts-core'
+
+const severities = ['low', 'medium', 'high', 'critical']
+
+export type DGAOptions = {
+  // registrable label length
+  minLength: number
+  // share of digits in the label
+  digitRatio: number
+  // consecutive consonants
+  consonantRun: number
+  // signals required to flag a label
+  minSignals: number
+}
+
+export type DomainRiskOptions = {
+  enabled: boolean
+  // severity of risky domains
+  severity: string
+  // without leading dot, e.g. `top`
+  tlds: string[]
+  dga: DGAOptions
+}
+
+export type DomainRisk = {
+  // matched TLD from the risk list
+  risky_tld?: string
+  // DGA signals that matched, e.g. `length`
+  dga_signals?: string[]
+}
+
+/**
+ * longestConsonantRun
+ *
+ * length of the longest run of consonants (`y` included) in `label`
+ */
+export const longestConsonantRun = (label: string): number =>
+  (label.toLowerCase().match(/[bcdfghjklmnpqrstvwxyz]+/g) || []).reduce(
+    (max, run) => Math.max(max, run.length),
+    0
+  )
+
+/**
+ * dgaSignals
+ *
+ * DGA-like signals of a registrable label (eTLD+1 without suffix).
+ * punycode labels are skipped, they are handled by the IDN checks
+ */
+export const dgaSignals = (label: string, options: DGAOptions): string[] => {
+  if (!label || label.startsWith('xn--')) {
+    return []
+  }
+  const signals: string[] = []
+  if (label.length >= options.minLength) {
+    signals.push('length')
+  }
+  const digits = (label.match(/[0-9]/g) || []).length
+  if (digits / label.length >= options.digitRatio) {
+    signals.push('digit_ratio')
+  }
+  if (longestConsonantRun(label) >= options.consonantRun) {
+    signals.push('consonant_run')
+  }
+  return signals.length >= options.minSignals ? signals : []
+}
+
+/**
+ * domainRisk
+ *
+ * returns why `url` looks suspicious, null when it does not
+ * (or `options.enabled` is false)
+ */
+export const domainRisk = (
+  url: IResult,
+  options: DomainRiskOptions
+): DomainRisk | null => {
+  if (!options.enabled || url.isIp || !url.domain) {
+    return null
+  }
+  const risk: DomainRisk = {}
+  const tld = (url.publicSuffix || '').toLowerCase()
+  if (options.tlds.some((t) => t.toLowerCase() === tld)) {
+    risk.risky_tld = tld
+  }
+  const signals = dgaSignals(url.domainWithoutSuffix || '', options.dga)
+  if (signals.length > 0) {
+    risk.dga_signals = signals
+  }
+  return Object.keys(risk).length > 0 ? risk : null
+}
+
+/**
+ * raiseSeverity
+ *
+ * returns the higher of `current` and `severity`
+ */
+export const raiseSeverity = (
+  current: unknown,
+  severity: string
+): string => {
+  if (typeof current !== 'string') {
+    return severity
+  }
+  return severities.indexOf(current) >= severities.indexOf(severity)
+    ? current
+    : severity
+}
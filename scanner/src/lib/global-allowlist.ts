@@ -0,0 +1,97 @@
+// Known infrastructure domains (CDNs, tag managers) trusted on every site
+import { readFileSync } from 'fs'
+
+// bump when `builtinSuffixes` changes
+export const GLOBAL_ALLOWLIST_VERSION = '2022.10.1'
+
+// single-tenant infrastructure only. Shared CDN hosts (cloudfront.net,
+// fastly.net, akamaihd.net, jsdelivr.net, unpkg.com...) serve anyone's
+// content, including skimmers, and are left to site allow lists
+export const builtinSuffixes = [
+  'cdnjs.cloudflare.com',
+  'doubleclick.net',
+  'fonts.googleapis.com',
+  'google-analytics.com',
+  'googletagmanager.com',
+  'gstatic.com',
+  'ytimg.com'
+]
+
+export type GlobalAllowlistOptions = {
+  enabled: boolean
+  // extra suffixes, one per line (`#` comments)
+  file: string
+}
+
+export type GlobalAllowlist = {
+  version: string
+  enabled: boolean
+  suffixes: string[]
+  // suffixes read from `file`
+  extra: string[]
+}
+
+const normalize = (suffix: string): string =>
+  suffix.trim().toLowerCase().replace(/^\*?\./, '')
+
+/**
+ * parseSuffixes
+ *
+ * one suffix per line, blank lines and `#` comments are skipped
+ */
+export const parseSuffixes = (text: string): string[] =>
+  text
+    .split('\n')
+    .map((line) => normalize(line.replace(/#.*$/, '')))
+    .filter((line) => line.length > 0)
+
+/**
+ * loadGlobalAllowlist
+ *
+ * built-in suffixes extended with `file`, empty when disabled
+ */
+export const loadGlobalAllowlist = (
+  options: GlobalAllowlistOptions
+): GlobalAllowlist => {
+  const extra = options.file
+    ? parseSuffixes(readFileSync(options.file, 'utf8'))
+    : []
+  return {
+    version: GLOBAL_ALLOWLIST_VERSION,
+    enabled: options.enabled,
+    suffixes: options.enabled
+      ? Array.from(new Set([...builtinSuffixes, ...extra])).sort()
+      : [],
+    extra
+  }
+}
+
+/**
+ * matchSuffix
+ *
+ * suffix of `hostname` (itself or a parent domain) found in
+ * `suffixes` and not in `untrusted`, null otherwise
+ */
+export const matchSuffix = (
+  hostname: string,
+  suffixes: string[],
+  untrusted: Set<string> = new Set()
+): string | null => {
+  const host = hostname.toLowerCase().replace(/\.$/, '')
+  const match = suffixes.find(
+    (suffix) => host === suffix || host.endsWith(`.${suffix}`)
+  )
+  if (match === undefined) {
+    return null
+  }
+  // un-trusting a domain covers its subdomains, e.g. `cloudfront.net`
+  // or only `d111.cloudfront.net`
+  const labels = host.split('.')
+  const depth = labels.length - match.split('.').length
+  for (let i = 0; i <= depth; i++) {
+    if (untrusted.has(labels.slice(i).join('.'))) {
+      return null
+    }
+  }
+  return match
+}
@@ -0,0 +1,78 @@
+// Internationalized domain name helpers
+import { domainToASCII, domainToUnicode } from 'url'
+
+type Script = 'latin' | 'greek' | 'cyrillic' | 'armenian' | 'cherokee' | 'other'
+
+// code point ranges of scripts commonly abused in lookalike domains
+const scriptRanges: Array<[number, number, Script]> = [
+  [0x0041, 0x024f, 'latin'],
+  [0x1e00, 0x1eff, 'latin'],
+  [0x0370, 0x03ff, 'greek'],
+  [0x1f00, 0x1fff, 'greek'],
+  [0x0400, 0x052f, 'cyrillic'],
+  [0x2de0, 0x2dff, 'cyrillic'],
+  [0xa640, 0xa69f, 'cyrillic'],
+  [0x0530, 0x058f, 'armenian'],
+  [0x13a0, 0x13ff, 'cherokee']
+]
+
+// non-latin characters rendered (nearly) identical to latin letters
+const confusables = new Set(
+  Array.from(
+    // cyrillic
+    'аеорсухіјѕԁԛԝһӏкАВЕКМНОРСТХ' +
+      // greek
+      'αονριτκΑΒΕΗΙΚΜΝΟΡΤΧΥΖ' +
+      // armenian
+      'օսցհոզ'
+  )
+)
+
+const scriptOf = (char: string): Script | null => {
+  const code = char.codePointAt(0)
+  // digits, hyphens and other ascii are shared by all scripts
+  if (code < 0x80 && !/[a-z]/i.test(char)) {
+    return null
+  }
+  const range = scriptRanges.find(([lo, hi]) => code >= lo && code <= hi)
+  return range ? range[2] : 'other'
+}
+
+export type IDNForms = {
+  // ACE (punycode) form, used for lookups / storage
+  ascii: string
+  // display form
+  unicode: string
+}
+
+/**
+ * idnForms
+ *
+ * returns the ASCII (punycode) and Unicode forms of `hostname`.
+ * plain lowercase ASCII hosts are returned unchanged
+ */
+export const idnForms = (hostname: string): IDNForms => {
+  const host = hostname.toLowerCase()
+  const ascii = domainToASCII(host) || host
+  const unicode = domainToUnicode(ascii) || host
+  return { ascii, unicode }
+}
+
+/**
+ * isHomograph
+ *
+ * true if a label of the Unicode `hostname` mixes scripts
+ * or is written entirely with characters confusable with latin
+ */
+export const isHomograph = (hostname: string): boolean =>
+  hostname.split('.').some((label) => {
+    const chars = Array.from(label)
+    const scripts = new Set(chars.map(scriptOf).filter((s) => s !== null))
+    if (scripts.size > 1) {
+      return true
+    }
+    if (scripts.size === 1 && !scripts.has('latin')) {
+      return chars.every((c) => scriptOf(c) === null || confusables.has(c))
+    }
+    return false
+  })
@@ -0,0 +1,60 @@
+// IOC caches (matches only), per indicator type
+import LRUCache from 'lru-native2'
+import redis from 'ioredis'
+
+const oneHour = 1000 * 60 * 60
+
+export type IOCCacheType = 'fqdn' | 'url' | 'ip_cidr' | 'sha256'
+
+// bumped by the backend on every IOC change
+export const IOC_VERSION_KEY = 'iocs:version'
+
+const newCache = () =>
+  new LRUCache<number>({
+    maxElements: 1000,
+    maxAge: oneHour,
+    size: 1000,
+    maxLoadFactor: 2.0
+  })
+
+export const iocCaches: Record<IOCCacheType, LRUCache<number>> = {
+  fqdn: newCache(),
+  url: newCache(),
+  ip_cidr: newCache(),
+  sha256: newCache()
+}
+
+let currentVersion: string | null = null
+
+/**
+ * syncVersion
+ *
+ * clears every IOC type cache when `version` differs from the
+ * last version seen. Returns true if the caches were cleared
+ */
+export const syncVersion = (version: string | null): boolean => {
+  if (version === currentVersion) {
+    return false
+  }
+  currentVersion = version
+  Object.values(iocCaches).forEach((cache) => cache.clear())
+  return true
+}
+
+/**
+ * watchVersion
+ *
+ * polls the IOC version every `intervalMs`
+ */
+export const watchVersion = (
+  client: redis.Redis,
+  intervalMs: number,
+  onError: (e: Error) => void = () => undefined
+): NodeJS.Timeout =>
+  setInterval(async () => {
+    try {
+      syncVersion(await client.get(IOC_VERSION_KEY))
+    } catch (e) {
+      onError(e)
+    }
+  }, intervalMs)
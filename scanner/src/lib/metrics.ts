@@ -0,0 +1,52 @@
+import { config } from 'node-config-ts'
+import logger from '../loaders/logger'
+
+export type MetricTags = Record<string, string>
+
+export interface Metrics {
+  timing(name: string, ms: number, tags?: MetricTags): void
+  gauge(name: string, value: number, tags?: MetricTags): void
+  increment(name: string, tags?: MetricTags, value?: number): void
+}
+
+/**
+ * noopMetrics
+ *
+ * Discards all metrics
+ */
+export const noopMetrics: Metrics = {
+  timing: () => undefined,
+  gauge: () => undefined,
+  increment: () => undefined,
+}
+
+/**
+ * logMetrics
+ *
+ * Writes metrics to the application log
+ */
+export const logMetrics: Metrics = {
+  timing: (name, ms, tags) =>
+    logger.info({ metric: name, type: 'timing', value: ms, tags }),
+  gauge: (name, value, tags) =>
+    logger.info({ metric: name, type: 'gauge', value, tags }),
+  increment: (name, tags, value = 1) =>
+    logger.info({ metric: name, type: 'counter', value, tags }),
+}
+
+/**
+ * metrics
+ *
+ * Resolves the configured metrics client, null / unset clients
+ * fall back to `noopMetrics`
+ */
+export const metrics = (client?: Metrics | null): Metrics => {
+  if (client) return client
+  return config.metrics?.client === 'log' ? logMetrics : noopMetrics
+}
+
+export default {
+  metrics,
+  noopMetrics,
+  logMetrics,
+}
@@ -0,0 +1,73 @@
+// rule work left per scan, read by the backend for its
+// "awaiting rules" gauge (see backend `ScanService.awaitingRules`)
+import redis from 'ioredis'
+
+// scan ID -> events with rule jobs left
+export const PENDING_SCANS_KEY = 'rules:pending:scans'
+
+// rule jobs left of an event
+export const pendingEventKey = (eventID: string): string =>
+  `rules:pending:event:${eventID}`
+
+// counters of events never finished (e.g. jobs removed by hand) expire
+const EVENT_TTL_SECONDS = 24 * 60 * 60
+
+// counts a finished job of an event, the event leaves the scan
+// count with its last job. Unknown (expired) events are ignored
+const FINISH_SCRIPT = `
+if redis.call('EXISTS', KEYS[1]) == 0 then return -1 end
+local left = redis.call('DECR', KEYS[1])
+if left > 0 then return left end
+redis.call('DEL', KEYS[1])
+if redis.call('HINCRBY', KEYS[2], ARGV[1], -1) <= 0 then
+  redis.call('HDEL', KEYS[2], ARGV[1])
+end
+return 0
+`
+
+/**
+ * trackEvent
+ *
+ * records the `jobs` rule jobs scheduled for an event, before
+ * they are queued so no job finishes untracked
+ */
+export const trackEvent = async (
+  client: redis.Redis,
+  scanID: string,
+  eventID: string | undefined,
+  jobs: number
+): Promise<void> => {
+  if (!eventID || jobs === 0) return
+  await client
+    .multi()
+    .set(pendingEventKey(eventID), jobs, 'EX', EVENT_TTL_SECONDS)
+    .hincrby(PENDING_SCANS_KEY, scanID, 1)
+    .exec()
+}
+
+/**
+ * finishJob
+ *
+ * counts a rule job of an event as done (processed, or failed
+ * for good). Resolves with the jobs left of the event, -1 when
+ * the event is not tracked
+ */
+export const finishJob = async (
+  client: redis.Redis,
+  scanID: string,
+  eventID: string | undefined
+): Promise<number> => {
+  if (!eventID) return -1
+  return client.eval(
+    FINISH_SCRIPT,
+    2,
+    pendingEventKey(eventID),
+    PENDING_SCANS_KEY,
+    scanID
+  )
+}
+
+export default {
+  trackEvent,
+  finishJob,
+}
@@ -0,0 +1,210 @@
+// Per batch rule processing totals
+import { performance } from 'perf_hooks'
+import { RuleAlert } from '@merrymaker/types'
+
+// prefetch: batch cache / seen lookups, rules: rule evaluation,
+// publish: alert creation (scan log queue writes)
+export const RulePhases = ['prefetch', 'rules', 'publish'] as const
+
+export type RulePhase = typeof RulePhases[number]
+
+// time spent per phase (ms), summed over workers
+export type RulePhaseTimings = Record<RulePhase, number>
+
+export type RuleTimingSummary = RulePhaseTimings & {
+  // wall clock time of the batch
+  total: number
+}
+
+// domain lanes processed, and most lanes of a rule running at once
+export type RuleLaneStats = {
+  lanes: number
+  peak: number
+}
+
+export type RuleTotals = {
+  events: number
+  alerts: number
+  // results without alert (allow-listed, seen, excepted...)
+  passed: number
+  errors: number
+  // passed results by `context.suppressed_by` (allow_list, global_allowlist)
+  suppressed: Record<string, number>
+  // results whose host was collapsed to its registrable domain
+  normalized: number
+}
+
+export type RuleResultsSummary = RuleTotals & {
+  byRule: Record<string, RuleTotals>
+  // first alerts, ordered by rule name then processing order
+  samples: RuleAlert[]
+}
+
+const emptyTotals = (): RuleTotals => ({
+  events: 0,
+  alerts: 0,
+  passed: 0,
+  errors: 0,
+  suppressed: {},
+  normalized: 0
+})
+
+const emptyTimings = (): RulePhaseTimings => ({
+  prefetch: 0,
+  rules: 0,
+  publish: 0
+})
+
+const addTotals = (a: RuleTotals, b: RuleTotals): RuleTotals => {
+  const suppressed = { ...a.suppressed }
+  Object.keys(b.suppressed).forEach((bucket) => {
+    suppressed[bucket] = (suppressed[bucket] || 0) + b.suppressed[bucket]
+  })
+  return {
+    events: a.events + b.events,
+    alerts: a.alerts + b.alerts,
+    passed: a.passed + b.passed,
+    errors: a.errors + b.errors,
+    suppressed,
+    normalized: a.normalized + b.normalized
+  }
+}
+
+/**
+ * RuleResults
+ *
+ * Counts and alert samples of processed rule jobs. A RuleResults is
+ * owned by a single worker, concurrent workers each fill their own
+ * and `merge` them once done, so totals never depend on scheduling.
+ * Phase timings and lane stats are kept apart from the (deterministic)
+ * summary
+ */
+export class RuleResults {
+  byRule = new Map<string, RuleTotals>()
+  samples = new Map<string, RuleAlert[]>()
+  phases: RulePhaseTimings = emptyTimings()
+  laneStats: RuleLaneStats = { lanes: 0, peak: 0 }
+
+  constructor(public sampleSize = 10) {}
+
+  /**
+   * add
+   *
+   * records the outcome of one rule job
+   */
+  add(rule: string, result: RuleAlert[] | Error): void {
+    const totals = this.byRule.get(rule) || emptyTotals()
+    totals.events += 1
+    if (result instanceof Error) {
+      totals.errors += 1
+    } else {
+      const alerts = result.filter((r) => r.alert)
+      totals.alerts += alerts.length
+      totals.passed += result.length - alerts.length
+      result.forEach((r) => {
+        const bucket = !r.alert && r.context?.suppressed_by
+        if (typeof bucket === 'string') {
+          totals.suppressed[bucket] = (totals.suppressed[bucket] || 0) + 1
+        }
+        if (r.context?.normalized === true) {
+          totals.normalized += 1
+        }
+      })
+      const samples = this.samples.get(rule) || []
+      samples.push(...alerts.slice(0, this.sampleSize - samples.length))
+      this.samples.set(rule, samples)
+    }
+    this.byRule.set(rule, totals)
+  }
+
+  /**
+   * time
+   *
+   * adds `ms` to the time spent in `phase`
+   */
+  time(phase: RulePhase, ms: number): void {
+    this.phases[phase] += ms
+  }
+
+  /**
+   * laneStarted
+   *
+   * records a domain lane starting while `active` lanes (itself
+   * included) of the rule run
+   */
+  laneStarted(active: number): void {
+    this.laneStats.lanes += 1
+    this.laneStats.peak = Math.max(this.laneStats.peak, active)
+  }
+
+  /**
+   * measure
+   *
+   * runs `fn`, counting its duration (failed or not) to `phase`
+   */
+  async measure<T>(phase: RulePhase, fn: () => Promise<T>): Promise<T> {
+    const start = performance.now()
+    try {
+      return await fn()
+    } finally {
+      this.time(phase, performance.now() - start)
+    }
+  }
+
+  /**
+   * merge
+   *
+   * adds the totals and samples of `other`, samples of a rule
+   * keep `this` first
+   */
+  merge(other: RuleResults): RuleResults {
+    other.byRule.forEach((totals, rule) => {
+      this.byRule.set(
+        rule,
+        addTotals(this.byRule.get(rule) || emptyTotals(), totals)
+      )
+    })
+    other.samples.forEach((samples, rule) => {
+      const mine = this.samples.get(rule) || []
+      this.samples.set(rule, mine.concat(samples).slice(0, this.sampleSize))
+    })
+    RulePhases.forEach((phase) => this.time(phase, other.phases[phase]))
+    this.laneStats = {
+      lanes: this.laneStats.lanes + other.laneStats.lanes,
+      peak: Math.max(this.laneStats.peak, other.laneStats.peak)
+    }
+    return this
+  }
+
+  /**
+   * timings
+   *
+   * rounded phase timings (ms) of a batch that took `totalMs`.
+   * phases of concurrent workers overlap, their sum can then
+   * exceed the total
+   */
+  timings(totalMs: number): RuleTimingSummary {
+    const res = { total: Math.round(totalMs) } as RuleTimingSummary
+    RulePhases.forEach((phase) => {
+      res[phase] = Math.round(this.phases[phase])
+    })
+    return res
+  }
+
+  summary(): RuleResultsSummary {
+    const rules = Array.from(this.byRule.keys()).sort()
+    const byRule: Record<string, RuleTotals> = {}
+    let totals = emptyTotals()
+    let samples: RuleAlert[] = []
+    rules.forEach((rule) => {
+      byRule[rule] = addTotals(emptyTotals(), this.byRule.get(rule))
+      totals = addTotals(totals, byRule[rule])
+      samples = samples.concat(this.samples.get(rule) || [])
+    })
+    return {
+      ...totals,
+      byRule,
+      samples: samples.slice(0, this.sampleSize)
+    }
+  }
+}
@@ -7,12 +7,20 @@ import {
 } from '@merrymaker/types'
 import { Rule } from '../rules/base'
 import { JobOptions, Queue } from 'bull'
+import { config } from 'node-config-ts'
+import { parse } from 'tldts'
 
 import logger from '../loaders/logger'
+import { SiteRules, siteRules } from './site-rules'
+import { RuleResults } from './rule-results'
+import { SeenRecorder } from './seen-recorder'
+
+// `eventID` is shared by the scan log entry and the alerts it triggers
+export type TrackedScanEvent = ScanEvent & { eventID?: string }
 
 export interface RuleJobData {
   rule: string
-  event: ScanEvent
+  event: TrackedScanEvent
 }
 
 export interface RuleJob {
@@ -21,6 +29,59 @@ export interface RuleJob {
   opts?: JobOptions
 }
 
+export type ScheduleResult = {
+  scheduled: string[]
+  skipped: string[]
+}
+
+/**
+ * withEventID
+ *
+ * adds the ID of the triggering event to the alert context
+ */
+export const withEventID = (alert: RuleAlert, eventID?: string): RuleAlert =>
+  eventID
+    ? { ...alert, context: { ...alert.context, event_id: eventID } }
+    : alert
+
+/**
+ * laneKey
+ *
+ * registrable domain (or host) the event concerns, jobs of a rule
+ * sharing a key are processed serially. Events without a URL share
+ * the '' lane
+ */
+export const laneKey = (se: ScanEvent): string => {
+  const url = (se.payload as { url?: unknown })?.url
+  if (typeof url !== 'string') {
+    return ''
+  }
+  const parsed = parse(url)
+  return (parsed.domain || parsed.hostname || '').toLowerCase()
+}
+
+// failure of rule jobs left once the batch deadline passed,
+// they are retried (see `worker.ruleJobAttempts`)
+export class LeaseExpiredError extends Error {
+  constructor() {
+    super('rule batch cancelled, lease expired')
+    this.name = 'LeaseExpiredError'
+  }
+}
+
+export const cancelledError = (): LeaseExpiredError => new LeaseExpiredError()
+
+/**
+ * ruleCopy
+ *
+ * copy of the shared `rule` for one job or lane, rules keep
+ * per-event state. seen hits are buffered in `recorder`
+ */
+export const ruleCopy = (rule: Rule, recorder: SeenRecorder): Rule =>
+  Object.assign(Object.create(Object.getPrototypeOf(rule)), rule, {
+    recorder
+  })
+
 export type EventHandlerFunction = (
   payload: ScanEventPayload
 ) => Promise<EventResult[]>
@@ -30,9 +91,11 @@ export default class ScanEventHandler {
   // Determine type
   promiseMap: Record<ScanEventType, Rule[]>
   byName: Map<string, Rule>
-  constructor() {
+  siteRules: SiteRules
+  constructor(rules: SiteRules = siteRules) {
     this.promiseMap = {} as Record<ScanEventType, Rule[]>
     this.byName = new Map<string, Rule>()
+    this.siteRules = rules
   }
   use(st: ScanEventType, handler: Rule): void {
     if (!this.promiseMap[st]) {
@@ -41,33 +104,215 @@ export default class ScanEventHandler {
     this.promiseMap[st].push(handler)
     this.byName.set(handler.ruleDetails.name, handler)
   }
-  async scheduleRules(se: ScanEvent, queue: Queue): Promise<void> {
+  /**
+   * scheduleRules
+   *
+   * queues a job per rule of the event not disabled for its site,
+   * `beforeQueue` is given the number of jobs before they are added
+   */
+  async scheduleRules(
+    se: TrackedScanEvent,
+    queue: Queue,
+    beforeQueue?: (jobs: number) => Promise<void>
+  ): Promise<ScheduleResult> {
+    const result: ScheduleResult = { scheduled: [], skipped: [] }
     if (this.promiseMap[se.type]) {
+      const disabled = await this.siteRules.disabled(se.scanID)
       const jobs: RuleJob[] = []
       this.promiseMap[se.type].forEach((rule) => {
-        logger.info(`scheduling rule ${rule.ruleDetails.name}`)
+        const name = rule.ruleDetails.name
+        if (disabled.has(name)) {
+          logger.debug(`rule ${name} disabled for site`)
+          result.skipped.push(name)
+          return
+        }
+        logger.info(`scheduling rule ${name}`)
+        result.scheduled.push(name)
         jobs.push({
           name: 'rule-job',
           data: {
-            rule: rule.ruleDetails.name,
+            rule: name,
             event: se,
           },
           opts: {
             removeOnComplete: true,
+            // jobs cancelled at a batch deadline are retried
+            attempts: config.worker.ruleJobAttempts || 1,
           },
         })
       })
-      const res = await queue.addBulk(jobs)
-      logger.info(`Add Bulk Result ${res[0].name}`)
+      if (jobs.length > 0) {
+        if (beforeQueue) {
+          await beforeQueue(jobs.length)
+        }
+        const res = await queue.addBulk(jobs)
+        logger.info(`Add Bulk Result ${res[0].name}`)
+      }
     } else {
       logger.debug(`no handler for ${se.type}`)
     }
+    return result
   }
+  /**
+   * process
+   *
+   * runs the rule of `rj` on its own copy, recording its seen
+   * hits with a recorder of the job closed once done
+   */
   async process(rj: RuleJobData): Promise<RuleAlert[]> {
     if (this.byName.has(rj.rule)) {
-      return this.byName.get(rj.rule).process(rj.event)
+      const recorder = new SeenRecorder()
+      try {
+        return await ruleCopy(this.byName.get(rj.rule), recorder).process(
+          rj.event
+        )
+      } finally {
+        await recorder.close()
+      }
     } else {
       return Promise.reject(`no matching rule for ${rj.rule}`)
     }
   }
+  /**
+   * processCounted
+   *
+   * `process` counting the outcome of the job (suppression
+   * buckets included) into `results`, like `processBatch` does
+   */
+  async processCounted(
+    rj: RuleJobData,
+    results: RuleResults
+  ): Promise<RuleAlert[]> {
+    try {
+      const alerts = await this.process(rj)
+      results.add(rj.rule, alerts || [])
+      return alerts
+    } catch (e) {
+      results.add(rj.rule, e instanceof Error ? e : new Error(String(e)))
+      throw e
+    }
+  }
+  /**
+   * processBatch
+   *
+   * lets each rule prefetch lookups for its events in one go, then
+   * processes the jobs of each rule by domain lane (see `laneKey`).
+   * Jobs of a lane run serially, so alerting and seen-recording of a
+   * domain never race, up to `domainConcurrency` lanes of a rule run
+   * at once, each on its own copy of the rule (rules keep per-event
+   * state). Up to `concurrency` rules are processed at once, each
+   * worker counts into its own RuleResults merged into `results`
+   * in rule name order. Jobs not started by `deadline` (epoch ms)
+   * fail with `cancelledError`. resolves with the alerts, or the
+   * failure, of each job in order. prefetch and rule evaluation
+   * times are counted to the `prefetch` and `rules` phases.
+   * Seen hits of the batch are buffered by its own recorder, flushed
+   * once each rule is done and closed once the batch is, even when
+   * processing failed
+   */
+  async processBatch(
+    jobs: RuleJobData[],
+    opts: {
+      concurrency?: number
+      domainConcurrency?: number
+      deadline?: number
+      results?: RuleResults
+    } = {}
+  ): Promise<Array<RuleAlert[] | Error>> {
+    // job indexes by rule
+    const byRule = new Map<string, number[]>()
+    jobs.forEach((rj, i) => {
+      if (!byRule.has(rj.rule)) {
+        byRule.set(rj.rule, [])
+      }
+      byRule.get(rj.rule).push(i)
+    })
+    const names = Array.from(byRule.keys()).sort()
+    const results: Array<RuleAlert[] | Error> = new Array(jobs.length)
+    const partials = new Map<string, RuleResults>()
+    const expired = () => opts.deadline && Date.now() >= opts.deadline
+    const recorder = new SeenRecorder()
+    const processRule = async (name: string) => {
+      const indexes = byRule.get(name)
+      const partial = new RuleResults(opts.results?.sampleSize)
+      const rule = this.byName.get(name)
+      if (rule) {
+        try {
+          await partial.measure('prefetch', () =>
+            rule.prefetch(indexes.map((i) => jobs[i].event))
+          )
+        } catch (e) {
+          // prefetch is an optimization, jobs fall back to single lookups
+          logger.warn(`prefetch failed for rule ${name}: ${e.message}`)
+        }
+      }
+      // job indexes by lane, in job order
+      const lanes = new Map<string, number[]>()
+      indexes.forEach((i) => {
+        const key = laneKey(jobs[i].event)
+        if (!lanes.has(key)) {
+          lanes.set(key, [])
+        }
+        lanes.get(key).push(i)
+      })
+      const queue = Array.from(lanes.values())
+      const laneWorkers = Math.max(
+        1,
+        Math.min(opts.domainConcurrency || 1, queue.length)
+      )
+      let nextLane = 0
+      let active = 0
+      const laneWorker = async () => {
+        const instance = rule && ruleCopy(rule, recorder)
+        while (nextLane < queue.length) {
+          const lane = queue[nextLane]
+          nextLane += 1
+          active += 1
+          partial.laneStarted(active)
+          for (const i of lane) {
+            if (expired()) {
+              results[i] = cancelledError()
+              continue
+            }
+            try {
+              results[i] = instance
+                ? await instance.process(jobs[i].event)
+                : await this.process(jobs[i])
+            } catch (e) {
+              results[i] = e instanceof Error ? e : new Error(String(e))
+            }
+          }
+          active -= 1
+        }
+      }
+      try {
+        await partial.measure('rules', () =>
+          Promise.all(Array.from({ length: laneWorkers }, laneWorker))
+        )
+      } finally {
+        await recorder.flush()
+      }
+      // counted in job order, whatever order the lanes finished in
+      indexes.forEach((i) => partial.add(name, results[i]))
+      partials.set(name, partial)
+    }
+    let next = 0
+    const worker = async () => {
+      while (next < names.length) {
+        const name = names[next]
+        next += 1
+        await processRule(name)
+      }
+    }
+    const workers = Math.max(1, Math.min(opts.concurrency || 1, names.length))
+    try {
+      await Promise.all(Array.from({ length: workers }, worker))
+    } finally {
+      await recorder.close()
+    }
+    if (opts.results) {
+      names.forEach((name) => opts.results.merge(partials.get(name)))
+    }
+    return results
+  }
 }
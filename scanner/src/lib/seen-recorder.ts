@@ -0,0 +1,104 @@
+// Buffered seen_strings hit recording
+import fetch from 'node-fetch'
+import { config } from 'node-config-ts'
+
+import logger from '../loaders/logger'
+
+/**
+ * SeenRecorder
+ *
+ * Buffers hits of seen strings found by read-only batch lookups
+ * (the remote read-through counts the other misses) and records
+ * them with one bulk request per `batchSize` hits of a type.
+ * One recorder is used per job, rule batches flush after each
+ * rule and close once done, failed or not
+ */
+export class SeenRecorder {
+  // buffered keys by type, once per hit
+  pending = new Map<string, string[]>()
+
+  constructor(
+    public batchSize = config.seenStrings.recordBatchSize,
+    public url = `${config.transport.http}/api/seen_strings/_record/_batch`
+  ) {}
+
+  record(type: string, key: string): void {
+    this.add(type, [key])
+  }
+
+  private add(type: string, keys: string[]): void {
+    if (!this.pending.has(type)) {
+      this.pending.set(type, [])
+    }
+    this.pending.get(type).push(...keys)
+  }
+
+  get size(): number {
+    let total = 0
+    this.pending.forEach((keys) => {
+      total += keys.length
+    })
+    return total
+  }
+
+  /**
+   * flush
+   *
+   * sends the buffered hits, resolves with the number sent. batches
+   * failing to post are logged and buffered again for the next
+   * flush, baselines are best-effort and must never fail a rule job
+   */
+  async flush(): Promise<number> {
+    const pending = this.pending
+    this.pending = new Map()
+    let sent = 0
+    for (const [type, keys] of pending) {
+      for (let i = 0; i < keys.length; i += this.batchSize) {
+        const batch = keys.slice(i, i + this.batchSize)
+        try {
+          const res = await fetch(this.url, {
+            method: 'post',
+            body: JSON.stringify({ seen_strings: { type, keys: batch } }),
+            headers: { 'Content-Type': 'application/json' }
+          })
+          if (!res.ok) {
+            throw new Error(`responded with ${res.status}`)
+          }
+          sent += batch.length
+        } catch (e) {
+          logger.warn({
+            module: 'lib/seen-recorder',
+            method: 'flush',
+            type,
+            requeued: batch.length,
+            error: e.message
+          })
+          this.add(type, batch)
+        }
+      }
+    }
+    return sent
+  }
+
+  /**
+   * close
+   *
+   * flushes a last time once the job is done. hits still failing
+   * to post are logged with their keys, so the baseline can be
+   * replayed, and dropped
+   */
+  async close(): Promise<number> {
+    const sent = await this.flush()
+    this.pending.forEach((keys, type) => {
+      logger.error({
+        module: 'lib/seen-recorder',
+        method: 'close',
+        type,
+        dropped: keys.length,
+        keys
+      })
+    })
+    this.pending = new Map()
+    return sent
+  }
+}
@@ -0,0 +1,107 @@
+// Rules disabled per site (sites.rules_config), site IOC exceptions,
+// learning mode (sites.baseline_until) and global allowlist suffixes
+// the site does not trust (sites.untrusted_suffixes)
+import fetch from 'node-fetch'
+import LRUCache from 'lru-native2'
+import { config } from 'node-config-ts'
+
+import { isOfType } from './utils'
+import logger from '../loaders/logger'
+
+export const scanRulesResponseSchema = {
+  type: 'object',
+  properties: {
+    disabled: { type: 'array', items: { type: 'string' } },
+    ioc_exceptions: { type: 'array', items: { type: 'string' } },
+    learning: { type: 'boolean' },
+    untrusted_suffixes: { type: 'array', items: { type: 'string' } }
+  },
+  required: ['disabled']
+}
+
+type ScanRules = {
+  disabled: string[]
+  ioc_exceptions?: string[]
+  learning?: boolean
+  untrusted_suffixes?: string[]
+}
+
+export class SiteRules {
+  // site config by scan, a scan config does not change mid-run
+  cache = new LRUCache<ScanRules>({
+    maxElements: 1000,
+    maxAge: 1000 * 60 * 10,
+    size: 100,
+    maxLoadFactor: 2.0
+  })
+
+  /**
+   * disabled
+   *
+   * rule names disabled for the site of `scanID`. Every rule
+   * stays enabled when the backend cannot be reached
+   */
+  async disabled(scanID: string): Promise<Set<string>> {
+    return new Set((await this.fetch(scanID)).disabled)
+  }
+
+  /**
+   * iocExceptions
+   *
+   * IOC values (lowercase) that do not alert for the site of
+   * `scanID`. Empty when the backend cannot be reached
+   */
+  async iocExceptions(scanID: string): Promise<Set<string>> {
+    return new Set((await this.fetch(scanID)).ioc_exceptions || [])
+  }
+
+  /**
+   * learning
+   *
+   * true while the site of `scanID` builds its seen baseline,
+   * unknown domains are recorded without alerting. False when
+   * the backend cannot be reached
+   */
+  async learning(scanID: string): Promise<boolean> {
+    return (await this.fetch(scanID)).learning === true
+  }
+
+  /**
+   * untrustedSuffixes
+   *
+   * global allowlist suffixes (lowercase) the site of `scanID`
+   * does not trust. Empty when the backend cannot be reached
+   */
+  async untrustedSuffixes(scanID: string): Promise<Set<string>> {
+    return new Set((await this.fetch(scanID)).untrusted_suffixes || [])
+  }
+
+  private async fetch(scanID: string): Promise<ScanRules> {
+    const cached = this.cache.get(scanID)
+    if (cached) {
+      return cached
+    }
+    try {
+      const res = await fetch(
+        `${config.transport.http}/api/scans/${scanID}/rules`
+      )
+      if (!res.ok) {
+        throw new Error(`status ${res.status}`)
+      }
+      const body = await res.json()
+      if (isOfType<ScanRules>(body, scanRulesResponseSchema)) {
+        this.cache.set(scanID, body)
+        return body
+      }
+    } catch (e) {
+      logger.warn({
+        component: 'lib/site-rules#fetch',
+        scan_id: scanID,
+        message: `failed to fetch site rules (${e.message})`
+      })
+    }
+    return { disabled: [] }
+  }
+}
+
+export const siteRules = new SiteRules()
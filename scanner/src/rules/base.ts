@@ -5,6 +5,8 @@ import { config } from 'node-config-ts'
 
 import { isOfType } from '../lib/utils'
 import logger from '../loaders/logger'
+import { siteRules } from '../lib/site-rules'
+import { SeenRecorder } from '../lib/seen-recorder'
 
 const allowListURL = `${config.transport.http}/api/allow_list`
 
@@ -32,13 +34,65 @@ export const storeNameResponseSchema = {
   required: ['store']
 }
 
+export type AllowListResponse = {
+  total: number
+  // matching entries, `expires_at` is null for permanent entries
+  results?: Array<{ expires_at?: string | null }>
+}
+
+/**
+ * allowListExpiry
+ *
+ * local cache value for matching allow list entries: the earliest
+ * `expires_at` (epoch ms), or 1 when no entry expires
+ */
+export const allowListExpiry = (res: AllowListResponse): number => {
+  const expiries = (res.results || [])
+    .map((r) => (r.expires_at ? Date.parse(r.expires_at) : NaN))
+    .filter((t) => !isNaN(t))
+  return expiries.length > 0 ? Math.min(...expiries) : 1
+}
+
+/**
+ * cachedAllowed
+ *
+ * true when `key` is allow-listed in `cache` and its earliest
+ * expiry has not passed. expired keys are removed
+ */
+export const cachedAllowed = (
+  cache: LRUCache<number>,
+  key: string,
+  now = Date.now()
+): boolean => {
+  const value = cache.get(key)
+  if (!value) {
+    return false
+  }
+  if (value !== 1 && value <= now) {
+    cache.remove(key)
+    return false
+  }
+  return true
+}
+
+// seen cache value of strings found by a read-only batch lookup
+// (`prefetch`), their hit is recorded when first served
+export const UNCOUNTED_HIT = 2
+
 export type StoreTypeResponse = {
   store: 'local' | 'redis' | 'database' | 'none'
+  // times seen, set when below the seen threshold
+  hit_count?: number
+  below_threshold?: boolean
+  // batch lookups, the site already alerted on the domain
+  alert_once?: boolean
 }
 
 export abstract class Rule {
   event: ScanEvent
   alertResults: MerryMakerTypes.RuleAlert[]
+  // buffers the seen hits of the job being processed
+  recorder?: SeenRecorder
   constructor(protected readonly options: MerryMakerTypes.RuleAlert) {}
   abstract process(scanEvent: ScanEvent): Promise<MerryMakerTypes.RuleAlert[]>
   get ruleDetails(): MerryMakerTypes.RuleAlert {
@@ -50,23 +104,36 @@ export abstract class Rule {
     this.alertResults.push(evt)
     return Promise.resolve(this.alertResults)
   }
+  /**
+   * fetchRemoteAllowList
+   *
+   * active (not expired) allow list entries of `type` matching `key`
+   */
   async fetchRemoteAllowList(
     key: string,
     type: string
-  ): Promise<{ total: number }> {
+  ): Promise<AllowListResponse> {
     const allow = await fetch(
       `${allowListURL}/?key=${key}&type=${type}&field=key`
     )
     const res = await allow.json()
-    if (isOfType<{ total: number }>(res, totalResponseSchema)) {
+    if (isOfType<AllowListResponse>(res, totalResponseSchema)) {
       return res
     }
   }
 
-  async fetchRemoteIOC(hostname: string): Promise<{ total: number }> {
-    const remoteIOC = await fetch(
-      `${config.transport.http}/api/iocs/?type=fqdn&value=${hostname}`
-    )
+  /**
+   * fetchRemoteIOC
+   *
+   * counts IOCs of `type` matching `value` (hostname, URL, IP or hash)
+   */
+  async fetchRemoteIOC(
+    value: string,
+    type = 'fqdn'
+  ): Promise<{ total: number }> {
+    const url = new URL(`${config.transport.http}/api/iocs/`)
+    url.search = new URLSearchParams({ type, value }).toString()
+    const remoteIOC = await fetch(url.toString())
     const res = await remoteIOC.json()
     if (isOfType<{ total: number }>(res, totalResponseSchema)) {
       return res
@@ -102,7 +169,8 @@ export abstract class Rule {
         body: JSON.stringify({
           seen_string: {
             key,
-            type
+            type,
+            scan_id: this.event.scanID
           }
         }),
         headers: { 'Content-Type': 'application/json' }
@@ -139,12 +207,77 @@ export abstract class Rule {
     }
   }
 
+  /**
+   * fetchSeenStringsBatch
+   *
+   * read-only lookup of several `keys` of `type` in one request,
+   * results are keyed by the requested key
+   */
+  async fetchSeenStringsBatch(
+    keys: string[],
+    type: string,
+    scanID?: string
+  ): Promise<Record<string, StoreTypeResponse>> {
+    const seenReq = await fetch(
+      `${config.transport.http}/api/seen_strings/_cache/_batch`,
+      {
+        method: 'post',
+        body: JSON.stringify({
+          seen_strings: { type, keys, scan_id: scanID }
+        }),
+        headers: { 'Content-Type': 'application/json' }
+      }
+    )
+    const res = await seenReq.json()
+    return res?.results || {}
+  }
+
+  /**
+   * fetchRemoteAllowListBatch
+   *
+   * matches several `values` against the allow list entries of
+   * `type` in one request. values without a match are left out,
+   * results hold the total and earliest expiry of the matches
+   */
+  async fetchRemoteAllowListBatch(
+    values: string[],
+    type: string
+  ): Promise<Record<string, AllowListResponse>> {
+    const allowReq = await fetch(`${allowListURL}/_cache/_batch`, {
+      method: 'post',
+      body: JSON.stringify({ allow_list: { type, keys: values } }),
+      headers: { 'Content-Type': 'application/json' }
+    })
+    const res = await allowReq.json()
+    const matches: Record<string, AllowListResponse> = {}
+    Object.entries(res?.results || {}).forEach(
+      ([value, match]: [string, { total: number; expires_at?: string }]) => {
+        matches[value] = {
+          total: match.total,
+          results: [{ expires_at: match.expires_at }]
+        }
+      }
+    )
+    return matches
+  }
+
+  /**
+   * prefetch
+   *
+   * warms local caches for a batch of events before they are
+   * processed one by one. no-op unless the rule batches lookups
+   */
+  // eslint-disable-next-line @typescript-eslint/no-unused-vars
+  async prefetch(_events: ScanEvent[]): Promise<void> {
+    return
+  }
+
   /**
    * isAllowed
    *
    * check to see if key/value is found in remote allow list
    *
-   * updates `cache` if found
+   * updates `cache` if found, until the earliest expiry of the entries
    */
   async isAllowed(options: {
     value: string
@@ -152,7 +285,7 @@ export abstract class Rule {
     cache: LRUCache<number>
   }): Promise<boolean> {
     let cacheKey = options.value
-    if (options.cache.get(cacheKey)) {
+    if (cachedAllowed(options.cache, cacheKey)) {
       logger.info({
         module: 'rules/base',
         method: 'isAllowed',
@@ -170,12 +303,60 @@ export abstract class Rule {
       if (this.event.test) {
         cacheKey = `${cacheKey}|${this.event.scanID}`
       }
-      options.cache.set(cacheKey, 1)
+      options.cache.set(cacheKey, allowListExpiry(allowed))
       return true
     }
     return false
   }
 
+  /**
+   * matchIOC
+   *
+   * checks `value` against local then remote IOCs of `type`.
+   * returns where the match was found (null when not found)
+   *
+   * updates `cache` if found remotely
+   */
+  async matchIOC(options: {
+    value: string
+    type: string
+    cache: LRUCache<number>
+  }): Promise<'cache' | 'DB' | null> {
+    if (options.cache.get(options.value)) {
+      return 'cache'
+    }
+    const iocs = await this.fetchRemoteIOC(options.value, options.type)
+    if (iocs.total > 0) {
+      options.cache.set(options.value, 1)
+      return 'DB'
+    }
+    return null
+  }
+
+  /**
+   * exceptIOC
+   *
+   * clears the alert of an IOC match on any of `values` excepted
+   * for the scan's site. The match is kept in the result
+   * (`context.ioc_excepted`). Returns true when excepted
+   */
+  async exceptIOC(
+    res: MerryMakerTypes.RuleAlert,
+    values: string[]
+  ): Promise<boolean> {
+    const exceptions = await siteRules.iocExceptions(this.event.scanID)
+    const excepted = values.find(
+      (v) => v && exceptions.has(v.toLowerCase())
+    )
+    if (excepted === undefined) {
+      return false
+    }
+    res.alert = false
+    res.message = `${res.message} (excepted for site: ${excepted})`
+    res.context = { ...res.context, ioc_excepted: excepted }
+    return true
+  }
+
   /**
    * wasSeen
    *
@@ -183,7 +364,10 @@ export abstract class Rule {
    *
    * scopes test scans by scanID in local cache
    *
-   * wrapper around `fetchSeenStrings` and `bumpRemoteCache`
+   * wrapper around `fetchSeenStrings` and `bumpRemoteCache`. local
+   * hits were counted when cached, except the ones of read-only
+   * batch lookups (`UNCOUNTED_HIT`): those are buffered in the job's
+   * `recorder` (see `SeenRecorder`), or bumped without one
    */
   async wasSeen(options: {
     value: string
@@ -194,12 +378,21 @@ export abstract class Rule {
     if (this.event.test) {
       seenString = `${seenString}|${this.event.scanID}`
     }
-    if (options.cache.get(options.value) === 1) {
+    const cached = options.cache.get(options.value)
+    if (cached === 1 || cached === UNCOUNTED_HIT) {
       logger.info({
         module: 'rules/base',
         method: 'wasSeen',
         result: `${options.key}/${seenString} found in cache`
       })
+      if (cached === UNCOUNTED_HIT && !this.event.test) {
+        options.cache.set(options.value, 1)
+        if (this.recorder) {
+          this.recorder.record(options.key, options.value)
+        } else {
+          await this.bumpRemoteCache(options.value, options.key)
+        }
+      }
       return { store: 'local' }
     }
     let seenData: StoreTypeResponse
@@ -218,7 +411,10 @@ export abstract class Rule {
       // Check remote cache and update (read-through)
       seenData = await this.bumpRemoteCache(options.value, options.key)
     }
-    options.cache.set(seenString, 1)
+    // strings below the seen threshold are checked again next time
+    if (!seenData?.below_threshold) {
+      options.cache.set(seenString, 1)
+    }
     return seenData
   }
 }
@@ -0,0 +1,210 @@
+// Outbound payload (exfiltration) rule
+import { parse } from 'tldts'
+import LRUCache from 'lru-native2'
+import * as MerryMaker from '@merrymaker/types'
+import { config } from 'node-config-ts'
+import { Rule } from './base'
+import { seenDomainKey } from './unknown-domain'
+
+const oneHour = 1000 * 60 * 60
+
+export const exfilAllowListCache = new LRUCache<number>({
+  maxElements: 1000,
+  maxAge: oneHour,
+  size: 50,
+  maxLoadFactor: 2.0,
+})
+
+export const exfilSeenCache = new LRUCache<number>({
+  maxElements: 10000,
+  maxAge: oneHour,
+  size: 1000,
+  maxLoadFactor: 2.0,
+})
+
+// request methods carrying a body
+const payloadMethods = ['POST', 'PUT', 'PATCH']
+
+// field name tokens of payment card data
+const sensitiveTokens = [
+  'card',
+  'cardnumber',
+  'cardholder',
+  'cc',
+  'ccnum',
+  'ccexp',
+  'cvv',
+  'cvv2',
+  'cvc',
+  'pan',
+  'expiry',
+  'securitycode',
+]
+
+const headerValue = (
+  headers: Record<string, string> | undefined,
+  name: string
+): string =>
+  Object.keys(headers || {})
+    .filter((h) => h.toLowerCase() === name)
+    .map((h) => headers[h])[0] || ''
+
+const jsonKeys = (value: unknown, depth = 0): string[] => {
+  if (depth > 5 || value === null || typeof value !== 'object') {
+    return []
+  }
+  if (Array.isArray(value)) {
+    return value.reduce(
+      (acc: string[], v) => acc.concat(jsonKeys(v, depth + 1)),
+      []
+    )
+  }
+  return Object.keys(value).reduce(
+    (acc: string[], k) =>
+      acc.concat([k], jsonKeys((value as Record<string, unknown>)[k], depth + 1)),
+    []
+  )
+}
+
+/**
+ * postFieldNames
+ *
+ * field names of a JSON, multipart or url-encoded request body.
+ * bodies that do not parse return no names
+ */
+export const postFieldNames = (
+  contentType: string,
+  postData: string | undefined
+): string[] => {
+  if (!postData) {
+    return []
+  }
+  const type = contentType.toLowerCase()
+  let names: string[] = []
+  if (type.includes('multipart/form-data')) {
+    const re = /content-disposition:[^\r\n]*\bname="([^"]*)"/gi
+    let m: RegExpExecArray | null
+    while ((m = re.exec(postData)) !== null) {
+      names.push(m[1])
+    }
+  } else if (type.includes('json') || /^\s*[{[]/.test(postData)) {
+    try {
+      names = jsonKeys(JSON.parse(postData))
+    } catch (e) {
+      names = []
+    }
+  } else if (postData.includes('=')) {
+    names = Array.from(new URLSearchParams(postData).keys())
+  }
+  return Array.from(new Set(names.filter((n) => n.length > 0)))
+}
+
+/**
+ * isSensitiveField
+ *
+ * true when a token of `name` (split on case and separators)
+ * names payment card data, e.g. `cardNumber`, `billing[cvv]`
+ */
+export const isSensitiveField = (name: string): boolean => {
+  const tokens = name
+    .replace(/([a-z0-9])([A-Z])/g, '$1 $2')
+    .toLowerCase()
+    .split(/[^a-z0-9]+/)
+  const compact = name.toLowerCase().replace(/[^a-z0-9]/g, '')
+  return (
+    tokens.some((t) => sensitiveTokens.includes(t)) ||
+    sensitiveTokens.includes(compact)
+  )
+}
+
+/**
+ * ExfilRule
+ *
+ * Alerts on payload-bearing requests (POST / PUT / PATCH with a body)
+ * to domains neither allow-listed nor in the seen baseline. Requests
+ * carrying card field names are critical
+ */
+export class ExfilRule extends Rule {
+  alertResults: MerryMaker.RuleAlert[]
+  normalizeDomain: boolean = config.rules.unknownDomain.normalizeDomain
+  async process(
+    scanEvent: MerryMaker.ScanEvent
+  ): Promise<MerryMaker.RuleAlert[]> {
+    this.event = scanEvent
+    const payload = scanEvent.payload as MerryMaker.WebRequestEvent
+    this.alertResults = []
+    const res: MerryMaker.RuleAlert = {
+      name: this.options.name,
+      alert: false,
+      message: 'no alert',
+      level: this.options.level,
+      context: { url: payload.url },
+    }
+    const method = (payload.method || 'GET').toUpperCase()
+    if (!payloadMethods.includes(method) || !payload.postData) {
+      res.message = 'not a payload-bearing request'
+      return this.resolveEvent(res)
+    }
+    const url = parse(payload.url)
+    if (!url.hostname) {
+      res.message = `unable to parse url ${payload.url}`
+      return this.resolveEvent(res)
+    }
+    const domain = seenDomainKey(url, this.normalizeDomain)
+    const allowed = await this.isAllowed({
+      value: url.domain || url.hostname,
+      key: 'fqdn',
+      cache: exfilAllowListCache,
+    })
+    if (allowed) {
+      res.message = `domain allow-listed ${domain}`
+      return this.resolveEvent(res)
+    }
+    if (await this.isBaselined(domain)) {
+      res.message = `domain in seen baseline ${domain}`
+      return this.resolveEvent(res)
+    }
+    const contentType = headerValue(payload.headers, 'content-type')
+    const fields = postFieldNames(contentType, payload.postData)
+    const sensitive = fields.filter(isSensitiveField)
+    res.alert = true
+    res.message = sensitive.length
+      ? `card fields (${sensitive.join(', ')}) sent to ${domain}`
+      : `${method} payload sent to ${domain}`
+    res.context = {
+      url: payload.url,
+      domain,
+      method,
+      content_type: contentType,
+      fields,
+      sensitive_fields: sensitive,
+      severity: sensitive.length ? 'critical' : 'high',
+    }
+    return this.resolveEvent(res)
+  }
+
+  /**
+   * isBaselined
+   *
+   * read-only seen check, the unknown.domain rule records hits
+   */
+  async isBaselined(domain: string): Promise<boolean> {
+    if (exfilSeenCache.get(domain) === 1) {
+      return true
+    }
+    const seen = await this.fetchSeenStrings(domain, 'domain')
+    if (seen.store !== 'none' && !seen.below_threshold) {
+      exfilSeenCache.set(domain, 1)
+      return true
+    }
+    return false
+  }
+}
+
+export default new ExfilRule({
+  name: 'exfil',
+  level: 'prod',
+  alert: false,
+  context: {},
+  description: 'detects payloads sent to unknown domains',
+})
@@ -3,7 +3,7 @@ import { parse } from 'tldts'
 import { URL } from 'url'
 import LRUCache from 'lru-native2'
 import * as MerryMaker from '@merrymaker/types'
-import { Rule } from './base'
+import { allowListExpiry, cachedAllowed, Rule } from './base'
 
 const oneHour = 1000 * 60 * 60
 const GOOGLE_ANALYTICS = 'google-analytics.com'
@@ -11,7 +11,7 @@ const GOOGLE_ANALYTICS = 'google-analytics.com'
 // we are looking for GoogleTID
 // trackingID
 
-const trackingIDAllowListCache = new LRUCache({
+const trackingIDAllowListCache = new LRUCache<number>({
   maxElements: 1000,
   maxAge: oneHour,
   size: 50,
@@ -57,7 +57,7 @@ export class GoogleAnalyticsRule extends Rule {
 
       if (tid) {
         // Check allow_list cache
-        if (trackingIDAllowListCache.get(tid)) {
+        if (cachedAllowed(trackingIDAllowListCache, tid)) {
           res.message = `allow-listed (cache) ${tid}`
           return this.resolveEvent(res)
         }
@@ -69,7 +69,7 @@ export class GoogleAnalyticsRule extends Rule {
         // Checkout backend transport
         if (allowList.total > 0) {
           res.message = `allow-listed (DB) ${tid}`
-          trackingIDAllowListCache.set(tid, 1)
+          trackingIDAllowListCache.set(tid, allowListExpiry(allowList))
           return this.resolveEvent(res)
         } else {
           // post to remoteAllowList
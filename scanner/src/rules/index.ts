@@ -1,7 +1,12 @@
 import ScanEventHandler from '../lib/scan-event-handler'
 import unknownDomainRule from './unknown-domain'
 import iocDomainRule from './ioc.domain'
+import iocURLRule from './ioc.url'
+import iocIPRule from './ioc.ip'
+import iocHashRule from './ioc.hash'
 import iocPayloadRule from './ioc.payload'
+import scriptHashRule from './script.hash'
+import exfilRule from './exfil'
 import yaraRule from './yara'
 import webSocketRule from './websocket'
 import googleAnalyticsRule from './google-analytics'
@@ -12,9 +17,14 @@ const scanHandler = new ScanEventHandler()
 // Rules
 scanHandler.use('request', unknownDomainRule)
 scanHandler.use('request', iocDomainRule)
+scanHandler.use('request', iocURLRule)
+scanHandler.use('request', iocIPRule)
 scanHandler.use('request', iocPayloadRule)
 scanHandler.use('request', googleAnalyticsRule)
+scanHandler.use('request', exfilRule)
 scanHandler.use('script-response', yaraRule)
+scanHandler.use('script-response', iocHashRule)
+scanHandler.use('script-response', scriptHashRule)
 scanHandler.use('function-call', webSocketRule)
 scanHandler.use('html-snapshot', htmlSnapshot)
 
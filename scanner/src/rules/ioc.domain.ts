@@ -2,18 +2,14 @@ import { parse } from 'tldts'
 import LRUCache from 'lru-native2'
 
 import * as MerryMaker from '@merrymaker/types'
-import { Rule } from './base'
+import { allowListExpiry, cachedAllowed, Rule } from './base'
+import { iocCaches } from '../lib/ioc-cache'
 
 const oneHour = 1000 * 60 * 60
 
-const iocDomainCache = new LRUCache({
-  maxElements: 1000,
-  maxAge: oneHour,
-  size: 1000,
-  maxLoadFactor: 2.0,
-})
+const iocDomainCache = iocCaches.fqdn
 
-const domainAllowListCache = new LRUCache({
+const domainAllowListCache = new LRUCache<number>({
   maxElements: 1000,
   maxAge: oneHour,
   size: 50,
@@ -27,6 +23,7 @@ const domainAllowListCache = new LRUCache({
  *
  * 1. Check local and remote allow-listed cache, don't alert if found
  * 2. Check local and and remote IOC cache (domain), alert if found and update cache
+ * 3. Matches excepted for the site (host or domain) are recorded without alerting
  */
 export class IOCDomainRule extends Rule {
   alertResults: MerryMaker.RuleAlert[]
@@ -50,7 +47,7 @@ export class IOCDomainRule extends Rule {
     }
     // check local allow-listed cache
     const payloadURL = parse(payload.url)
-    if (domainAllowListCache.get(payloadURL.domain)) {
+    if (cachedAllowed(domainAllowListCache, payloadURL.domain)) {
       res.message = `allow-listed (cache) ${payloadURL.domain}`
       return this.resolveEvent(res)
     }
@@ -63,13 +60,14 @@ export class IOCDomainRule extends Rule {
 
     if (allowListed.total > 0) {
       res.message = `allow-listed (DB) ${payloadURL.domain}`
-      domainAllowListCache.set(payloadURL.domain, 1)
+      domainAllowListCache.set(payloadURL.domain, allowListExpiry(allowListed))
       return this.resolveEvent(res)
     }
 
     if (iocDomainCache.get(payloadURL.hostname)) {
       res.alert = true
       res.message = `known IOC (cache) ${payloadURL.hostname}`
+      await this.exceptIOC(res, [payloadURL.hostname, payloadURL.domain])
       return this.resolveEvent(res)
     }
 
@@ -78,6 +76,7 @@ export class IOCDomainRule extends Rule {
       res.alert = true
       res.message = `known IOC (DB) ${payloadURL.hostname}`
       iocDomainCache.set(payloadURL.hostname, 1)
+      await this.exceptIOC(res, [payloadURL.hostname, payloadURL.domain])
     }
     return this.resolveEvent(res)
   }
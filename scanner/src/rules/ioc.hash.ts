@@ -0,0 +1,49 @@
+import * as MerryMaker from '@merrymaker/types'
+import { Rule } from './base'
+import { iocCaches } from '../lib/ioc-cache'
+
+/**
+ * IOCHashRule
+ *
+ * Checks script hashes against known bad files (IOCs)
+ */
+export class IOCHashRule extends Rule {
+  alertResults: MerryMaker.RuleAlert[]
+  async process(
+    scanEvent: MerryMaker.ScanEvent
+  ): Promise<MerryMaker.RuleAlert[]> {
+    this.event = scanEvent
+    const payload = scanEvent.payload as MerryMaker.WebScriptEvent
+    this.alertResults = []
+    const res: MerryMaker.RuleAlert = {
+      name: this.options.name,
+      alert: false,
+      message: 'no alert',
+      level: this.options.level,
+      context: { url: payload.url, sha256: payload.sha256 },
+    }
+    if (!payload.sha256) {
+      res.message = 'missing file hash'
+      return this.resolveEvent(res)
+    }
+    const found = await this.matchIOC({
+      value: payload.sha256.toLowerCase(),
+      type: 'sha256',
+      cache: iocCaches.sha256,
+    })
+    if (found) {
+      res.alert = true
+      res.message = `known IOC file hash (${found}) ${payload.sha256}`
+      await this.exceptIOC(res, [payload.sha256])
+    }
+    return this.resolveEvent(res)
+  }
+}
+
+export default new IOCHashRule({
+  name: 'ioc.hash',
+  level: 'prod',
+  alert: false,
+  context: {},
+  description: 'detects known malicious scripts by hash',
+})
@@ -0,0 +1,52 @@
+import * as MerryMaker from '@merrymaker/types'
+import { Rule } from './base'
+import { iocCaches } from '../lib/ioc-cache'
+import { ipHostLiteral } from './unknown-domain'
+
+/**
+ * IOCIPRule
+ *
+ * Checks requests made to IP hosts against known bad ranges (IOCs)
+ */
+export class IOCIPRule extends Rule {
+  alertResults: MerryMaker.RuleAlert[]
+  async process(
+    scanEvent: MerryMaker.ScanEvent
+  ): Promise<MerryMaker.RuleAlert[]> {
+    this.event = scanEvent
+    const payload = scanEvent.payload as MerryMaker.WebRequestEvent
+    this.alertResults = []
+    const res: MerryMaker.RuleAlert = {
+      name: this.options.name,
+      alert: false,
+      message: 'no alert',
+      level: this.options.level,
+      context: { url: payload.url },
+    }
+    const ip = ipHostLiteral(payload.url)
+    if (ip === null) {
+      res.message = 'not an IP host'
+      return this.resolveEvent(res)
+    }
+    res.context.ip = ip
+    const found = await this.matchIOC({
+      value: ip,
+      type: 'ip_cidr',
+      cache: iocCaches.ip_cidr,
+    })
+    if (found) {
+      res.alert = true
+      res.message = `known IOC IP range (${found}) ${ip}`
+      await this.exceptIOC(res, [ip])
+    }
+    return this.resolveEvent(res)
+  }
+}
+
+export default new IOCIPRule({
+  name: 'ioc.ip',
+  level: 'prod',
+  alert: false,
+  context: {},
+  description: 'detects requests to known malicious IP ranges',
+})
@@ -4,14 +4,14 @@ import path from 'path'
 import { IResult } from 'tldts-core'
 import LRUCache from 'lru-native2'
 import MerryMaker from '@merrymaker/types'
-import { Rule } from './base'
+import { allowListExpiry, cachedAllowed, Rule } from './base'
 import YaraSync from '../lib/yara-sync'
 import logger from '../loaders/logger'
 
 const yara = new YaraSync()
 const oneHour = 1000 * 60 * 60
 
-const payloadAllowListCache = new LRUCache({
+const payloadAllowListCache = new LRUCache<number>({
   maxElements: 1000,
   maxAge: oneHour,
   size: 50,
@@ -75,7 +75,7 @@ export class IOCPayloadRule extends Rule {
     }
 
     // pass through allowed ioc payload domains
-    if (payloadAllowListCache.get(payloadURL.hostname)) {
+    if (cachedAllowed(payloadAllowListCache, payloadURL.hostname)) {
       res.message = `allow-listed (cache) ${payloadURL.domain}`
       return this.resolveEvent(res)
     }
@@ -92,7 +92,10 @@ export class IOCPayloadRule extends Rule {
 
     if (allowListed.total > 0) {
       res.message = `allow-listed (DB) ${payloadURL.hostname}`
-      payloadAllowListCache.set(payloadURL.hostname, 1)
+      payloadAllowListCache.set(
+        payloadURL.hostname,
+        allowListExpiry(allowListed)
+      )
       return this.resolveEvent(res)
     }
 
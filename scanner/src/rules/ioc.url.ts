@@ -0,0 +1,45 @@
+import * as MerryMaker from '@merrymaker/types'
+import { Rule } from './base'
+import { iocCaches } from '../lib/ioc-cache'
+
+/**
+ * IOCURLRule
+ *
+ * Checks request URLs for known bad URL substrings (IOCs)
+ */
+export class IOCURLRule extends Rule {
+  alertResults: MerryMaker.RuleAlert[]
+  async process(
+    scanEvent: MerryMaker.ScanEvent
+  ): Promise<MerryMaker.RuleAlert[]> {
+    this.event = scanEvent
+    const payload = scanEvent.payload as MerryMaker.WebRequestEvent
+    this.alertResults = []
+    const res: MerryMaker.RuleAlert = {
+      name: this.options.name,
+      alert: false,
+      message: 'no alert',
+      level: this.options.level,
+      context: { url: payload.url },
+    }
+    const found = await this.matchIOC({
+      value: payload.url,
+      type: 'url',
+      cache: iocCaches.url,
+    })
+    if (found) {
+      res.alert = true
+      res.message = `known IOC URL (${found}) ${payload.url}`
+      await this.exceptIOC(res, [payload.url])
+    }
+    return this.resolveEvent(res)
+  }
+}
+
+export default new IOCURLRule({
+  name: 'ioc.url',
+  level: 'prod',
+  alert: false,
+  context: {},
+  description: 'detects requests to known malicious URLs',
+})
@@ -0,0 +1,92 @@
+import * as MerryMaker from '@merrymaker/types'
+import fetch from 'node-fetch'
+import { config } from 'node-config-ts'
+import { Rule } from './base'
+import { isOfType } from '../lib/utils'
+
+export type ScriptObservation = {
+  previous: string | null
+  changed: boolean
+}
+
+export const scriptObservationSchema = {
+  type: 'object',
+  properties: {
+    previous: { type: ['string', 'null'] },
+    changed: { type: 'boolean' },
+  },
+  required: ['changed'],
+}
+
+/**
+ * ScriptHashRule
+ *
+ * Alerts when a script previously seen on the site
+ * is served with a different hash
+ */
+export class ScriptHashRule extends Rule {
+  alertResults: MerryMaker.RuleAlert[]
+  async process(
+    scanEvent: MerryMaker.ScanEvent
+  ): Promise<MerryMaker.RuleAlert[]> {
+    this.event = scanEvent
+    const payload = scanEvent.payload as MerryMaker.WebScriptEvent
+    this.alertResults = []
+    const res: MerryMaker.RuleAlert = {
+      name: this.options.name,
+      alert: false,
+      message: 'no alert',
+      level: this.options.level,
+      context: { url: payload.url, sha256: payload.sha256 },
+    }
+    if (!payload.sha256 || !payload.url) {
+      res.message = 'missing script url or hash'
+      return this.resolveEvent(res)
+    }
+    const seen = await this.observeScript(payload.url, payload.sha256)
+    if (seen.changed) {
+      res.alert = true
+      res.message = `script hash changed ${payload.url}`
+      res.context = {
+        url: payload.url,
+        sha256: payload.sha256.toLowerCase(),
+        previous_sha256: seen.previous,
+        severity: 'high',
+      }
+    }
+    return this.resolveEvent(res)
+  }
+
+  async observeScript(url: string, sha256: string): Promise<ScriptObservation> {
+    const req = await fetch(
+      `${config.transport.http}/api/seen_scripts/_observe`,
+      {
+        method: 'post',
+        body: JSON.stringify({
+          seen_script: {
+            scan_id: this.event.scanID,
+            url,
+            sha256,
+          },
+        }),
+        headers: { 'Content-Type': 'application/json' },
+      }
+    )
+    if (!req.ok) {
+      throw new Error(`script observation responded with ${req.status}`)
+    }
+    const res = await req.json()
+    if (!isOfType<ScriptObservation>(res, scriptObservationSchema)) {
+      throw new Error('invalid script observation')
+    }
+    return res
+  }
+}
+
+export default new ScriptHashRule({
+  name: 'script.hash',
+  level: 'prod',
+  alert: false,
+  context: {},
+  description: 'detects changed hashes of previously seen scripts',
+})
@@ -1,9 +1,25 @@
 // Unknown domain rule
+import { isIP } from 'net'
 import { parse } from 'tldts'
 import LRUCache from 'lru-native2'
 import * as MerryMaker from '@merrymaker/types'
-import { Rule } from './base'
+import { config } from 'node-config-ts'
+import {
+  allowListExpiry,
+  cachedAllowed,
+  Rule,
+  UNCOUNTED_HIT
+} from './base'
+import { siteRules } from '../lib/site-rules'
 import { IResult } from 'tldts-core'
+import { idnForms, isHomograph } from '../lib/idn'
+import { DNSLookup } from '../lib/dns'
+import { domainRisk, DomainRiskOptions, raiseSeverity } from '../lib/domain-risk'
+import {
+  GlobalAllowlist,
+  loadGlobalAllowlist,
+  matchSuffix
+} from '../lib/global-allowlist'
 
 const oneHour = 1000 * 60 * 60
 
@@ -21,10 +37,132 @@ export const seenDomainCache = new LRUCache<number>({
   maxLoadFactor: 2.0
 })
 
+// `scanID|domain` of unseen domains inside the site's alert-once
+// window (batch lookups), the backend suppresses their alerts
+export const alertOnceCache = new LRUCache<number>({
+  maxElements: 10000,
+  maxAge: 1000 * 60,
+  size: 1000,
+  maxLoadFactor: 2.0
+})
+
+// known infrastructure suffixes, checked before the allow_list
+export const globalAllowlist = loadGlobalAllowlist(
+  config.rules.unknownDomain.globalAllowlist
+)
+
+// answers are shared between jobs once the worker sets a cache
+export const dnsLookup = new DNSLookup({ ...config.rules.dns, cache: null })
+
+/**
+ * seenDomainKey
+ *
+ * resolves the key used for the seen_strings lookup of a parsed URL
+ *
+ * when `normalize` is set, hosts are reduced to their registrable
+ * domain (eTLD+1). IP addresses and single-label hosts are kept as-is
+ */
+export const seenDomainKey = (url: IResult, normalize: boolean): string => {
+  const hostname = (url.hostname || '').replace(/\.+$/, '')
+  if (!normalize || url.isIp || !url.domain) {
+    return hostname
+  }
+  return url.domain.replace(/\.+$/, '')
+}
+
+/**
+ * ipHostLiteral
+ *
+ * returns the IPv4 / IPv6 literal (without port or brackets)
+ * of `rawURL`, or null if the host is not an IP address
+ */
+export const ipHostLiteral = (rawURL: string): string | null => {
+  let hostname: string
+  try {
+    hostname = new URL(rawURL).hostname
+  } catch (e) {
+    return null
+  }
+  const literal = hostname.replace(/^\[|\]$/g, '')
+  return isIP(literal) ? literal : null
+}
+
+// keys per seen_strings / allow_list batch request
+const LOOKUP_BATCH_SIZE = 500
+
+/**
+ * requestURL
+ *
+ * parsed URL `process` checks for a request to `rawURL` (ASCII
+ * form of IDN hosts), null when the request skips the domain
+ * checks (IP hosts, invalid URLs or missing domains)
+ */
+export const requestURL = (rawURL: string): IResult | null => {
+  if (ipHostLiteral(rawURL) !== null) {
+    return null
+  }
+  let url: IResult
+  try {
+    url = parse(rawURL)
+  } catch (e) {
+    return null
+  }
+  const idn = idnForms(url.hostname || '')
+  if (idn.ascii !== url.hostname) {
+    url = parse(idn.ascii)
+  }
+  return url.domain === null ? null : url
+}
+
+/**
+ * requestSeenKey
+ *
+ * seen_strings key `process` looks up for a request to `rawURL`,
+ * null when the request skips the domain seen check
+ */
+export const requestSeenKey = (
+  rawURL: string,
+  normalize: boolean
+): string | null => {
+  const url = requestURL(rawURL)
+  return url === null ? null : seenDomainKey(url, normalize)
+}
+
+// context fields the backend relies on (alert dedupe, severity
+// and the learning report)
+const requiredContextFields = ['domain', 'severity', 'learning']
+
+/**
+ * pickContext
+ *
+ * `context` reduced to the allowed `fields`, fields
+ * required by the backend are always kept
+ */
+export const pickContext = (
+  context: Record<string, unknown>,
+  fields: string[]
+): Record<string, unknown> =>
+  Object.keys(context)
+    .filter(
+      key => fields.includes(key) || requiredContextFields.includes(key)
+    )
+    .reduce((acc, key) => ({ ...acc, [key]: context[key] }), {})
+
 export class UnknownDomainRule extends Rule {
   alertResults: MerryMaker.RuleAlert[]
   payload: MerryMaker.WebRequestEvent
   payloadURL: IResult
+  // reduce hosts to eTLD+1 before seen checks
+  normalizeDomain: boolean = config.rules.unknownDomain.normalizeDomain
+  // alert on requests made directly to IP hosts
+  alertOnIPHosts: boolean = config.rules.unknownDomain.alertOnIPHosts
+  // resolves alerting domains (no-op when disabled)
+  dns: DNSLookup = dnsLookup
+  // risky TLD / DGA-like name heuristics
+  domainRisk: DomainRiskOptions = config.rules.unknownDomain.risk
+  globalAllowlist: GlobalAllowlist = globalAllowlist
+  // context fields included in alerts
+  contextFields: string[] = config.rules.unknownDomain.contextFields
   async process(
     scanEvent: MerryMaker.ScanEvent
   ): Promise<MerryMaker.RuleAlert[]> {
@@ -47,11 +185,41 @@ export class UnknownDomainRule extends Rule {
       return this.resolveEvent(res)
     }
 
+    const ipHost = ipHostLiteral(this.payload.url)
+    if (ipHost !== null) {
+      return this.processIPHost(ipHost, res)
+    }
+
+    // IDN hosts are evaluated in their ASCII (punycode) form so
+    // Unicode and ACE representations share the same baseline
+    const idn = idnForms(this.payloadURL.hostname || '')
+    if (idn.ascii !== this.payloadURL.hostname) {
+      this.payloadURL = parse(idn.ascii)
+    }
+
     if (this.payloadURL.domain === null) {
       res.message = `missing / empty domain for payload (${this.payload.url})`
       return this.resolveEvent(res)
     }
 
+    // known infrastructure, unless un-trusted by the site
+    if (this.globalAllowlist.suffixes.length > 0) {
+      const suffix = matchSuffix(
+        this.payloadURL.hostname,
+        this.globalAllowlist.suffixes,
+        await siteRules.untrustedSuffixes(this.event.scanID)
+      )
+      if (suffix !== null) {
+        res.message = `domain on global allowlist ${this.payloadURL.hostname} (${suffix})`
+        res.context.suppressed_by = 'global_allowlist'
+        res.context.global_allowlist = {
+          suffix,
+          version: this.globalAllowlist.version
+        }
+        return this.resolveEvent(res)
+      }
+    }
+
     // Check allow_list cache
     const allowedDomain = await this.isAllowed({
       value: this.payloadURL.domain,
@@ -61,6 +229,7 @@ export class UnknownDomainRule extends Rule {
 
     if (allowedDomain) {
       res.message = `domain allow-listed ${this.payloadURL.domain}`
+      res.context.suppressed_by = 'allow_list'
       return this.resolveEvent(res)
     }
 
@@ -73,8 +242,9 @@ export class UnknownDomainRule extends Rule {
       }
     }
 
+    const seenKey = seenDomainKey(this.payloadURL, this.normalizeDomain)
     const seenDomain = await this.wasSeen({
-      value: this.payloadURL.hostname,
+      value: seenKey,
       key: 'domain',
       cache: seenDomainCache
     })
@@ -82,15 +252,197 @@ export class UnknownDomainRule extends Rule {
     // Alert if domain was not found in any store
     if (seenDomain.store === 'none') {
       res.alert = true
-      res.message = `${this.payloadURL.hostname} unknown`
+      res.message = `${seenKey} unknown`
+    }
+    // seen before, but not often enough to be trusted
+    if (seenDomain.below_threshold && seenDomain.hit_count > 1) {
+      res.message = `${seenKey} below seen threshold (${seenDomain.hit_count} hits)`
+      res.context.below_seen_threshold = true
+      res.context.hit_count = seenDomain.hit_count
     }
 
     // attach domain
-    res.context.domain = this.payloadURL.hostname
+    res.context.domain = seenKey
+    // keep the full host for analysts when normalization collapsed it
+    if (
+      this.normalizeDomain &&
+      seenKey !== this.payloadURL.hostname.replace(/\.+$/, '')
+    ) {
+      res.context.hostname = this.payloadURL.hostname
+      res.context.normalized = true
+    }
+    // lookalike IDN, raise severity and keep both forms
+    if (idn.unicode !== idn.ascii && isHomograph(idn.unicode)) {
+      res.context.severity = 'high'
+      res.context.homograph = true
+      res.context.ascii_hostname = idn.ascii
+      res.context.unicode_hostname = idn.unicode
+    }
+    // suspicious looking domain, raise severity (seen checks are unchanged)
+    const risk = domainRisk(this.payloadURL, this.domainRisk)
+    if (risk !== null) {
+      res.context.severity = raiseSeverity(
+        res.context.severity,
+        this.domainRisk.severity
+      )
+      res.context.domain_risk = risk
+    }
+    await this.learn(res)
+    // record where the domain resolves at evaluation time, unless
+    // the alert is suppressed by the site's alert-once window
+    if (
+      res.alert &&
+      alertOnceCache.get(`${this.event.scanID}|${seenKey}`) !== 1
+    ) {
+      const dns = await this.dns.lookup(
+        this.payloadURL.hostname,
+        this.event.scanID
+      )
+      if (dns !== null) {
+        res.context.dns = dns
+      }
+    }
+
+    return this.resolveEvent(res)
+  }
+
+  /**
+   * prefetch
+   *
+   * looks up the domains of request `events` in the allow list,
+   * then the ones not allowed in seen_strings (one batch request
+   * per scan), and caches the matches locally so `process` skips
+   * their round-trips. the lookups are read-only, `wasSeen` records
+   * the hit of matches when served (`UNCOUNTED_HIT`) and counts
+   * unseen domains. domains inside the site's alert-once window
+   * are noted (`alertOnceCache`). test scans are skipped
+   */
+  async prefetch(events: MerryMaker.ScanEvent[]): Promise<void> {
+    const urls = events
+      .filter((evt) => evt.type === 'request' && !evt.test)
+      .map((evt) => ({
+        scanID: evt.scanID,
+        url: requestURL((evt.payload as MerryMaker.WebRequestEvent).url)
+      }))
+      .filter(({ url }) => url !== null)
+    const domains = Array.from(
+      new Set(
+        urls
+          .map(({ url }) => url.domain)
+          .filter((domain) => !cachedAllowed(domainAllowListCache, domain))
+      )
+    )
+    for (let i = 0; i < domains.length; i += LOOKUP_BATCH_SIZE) {
+      const matches = await this.fetchRemoteAllowListBatch(
+        domains.slice(i, i + LOOKUP_BATCH_SIZE),
+        'fqdn'
+      )
+      Object.entries(matches).forEach(([domain, match]) => {
+        domainAllowListCache.set(domain, allowListExpiry(match))
+      })
+    }
+    const byScan = new Map<string, Set<string>>()
+    urls.forEach(({ scanID, url }) => {
+      if (cachedAllowed(domainAllowListCache, url.domain)) return
+      const key = seenDomainKey(url, this.normalizeDomain)
+      if (seenDomainCache.get(key)) return
+      if (!byScan.has(scanID)) {
+        byScan.set(scanID, new Set())
+      }
+      byScan.get(scanID).add(key)
+    })
+    for (const [scanID, keySet] of byScan) {
+      const keys = Array.from(keySet)
+      for (let i = 0; i < keys.length; i += LOOKUP_BATCH_SIZE) {
+        const results = await this.fetchSeenStringsBatch(
+          keys.slice(i, i + LOOKUP_BATCH_SIZE),
+          'domain',
+          scanID
+        )
+        Object.entries(results).forEach(([key, res]) => {
+          // same rule as `wasSeen`, below threshold is checked again
+          if (res.store !== 'none' && !res.below_threshold) {
+            seenDomainCache.set(key, UNCOUNTED_HIT)
+          }
+          if (res.alert_once) {
+            alertOnceCache.set(`${scanID}|${key}`, 1)
+          }
+        })
+      }
+    }
+  }
 
+  /**
+   * processIPHost
+   *
+   * separate decision path for requests to IPv4 / IPv6 literals.
+   * checks the `ip` allow-list and seen_strings, alerting
+   * only when `alertOnIPHosts` is enabled
+   */
+  async processIPHost(
+    ipHost: string,
+    res: MerryMaker.RuleAlert
+  ): Promise<MerryMaker.RuleAlert[]> {
+    res.context.domain = ipHost
+    res.context.ip_host = true
+    if (!this.alertOnIPHosts) {
+      res.message = `IP host ${ipHost} (alerting disabled)`
+      return this.resolveEvent(res)
+    }
+    const allowedIP = await this.isAllowed({
+      value: ipHost,
+      key: 'ip',
+      cache: domainAllowListCache
+    })
+    if (allowedIP) {
+      res.message = `IP host allow-listed ${ipHost}`
+      return this.resolveEvent(res)
+    }
+    const seenIP = await this.wasSeen({
+      value: ipHost,
+      key: 'ip',
+      cache: seenDomainCache
+    })
+    if (seenIP.store === 'none') {
+      res.alert = true
+      res.message = `Unknown IP host ${ipHost}`
+    }
+    await this.learn(res)
     return this.resolveEvent(res)
   }
 
+  /**
+   * learn
+   *
+   * clears the alert while the scan's site is in learning mode,
+   * `wasSeen` already added the domain to the baseline. The result
+   * is kept (`context.learning`) to explain the missing alerts,
+   * with the page and time of the request for allowlist reviews
+   */
+  async learn(res: MerryMaker.RuleAlert): Promise<void> {
+    if (!res.alert || !(await siteRules.learning(this.event.scanID))) {
+      return
+    }
+    res.alert = false
+    res.message = `${res.message} (learning mode)`
+    res.context.learning = true
+    res.context.page_url = this.payload.headers?.referer || null
+    res.context.seen_at = new Date().toISOString()
+  }
+
+  /**
+   * resolveEvent
+   *
+   * drops context fields not in `contextFields` before
+   * the result is recorded
+   */
+  async resolveEvent(
+    evt: MerryMaker.RuleAlert
+  ): Promise<MerryMaker.RuleAlert[]> {
+    evt.context = pickContext(evt.context, this.contextFields)
+    return super.resolveEvent(evt)
+  }
+
   /**
    * allowedReferrer
    *
@@ -106,7 +458,7 @@ export class UnknownDomainRule extends Rule {
     const refererURL = parse(this.payload.headers.referer)
     let lruKey = `${this.payloadURL.domain}|${refererURL.domain}`
     // check local cache before checking remote allow-list
-    if (domainAllowListCache.get(lruKey)) {
+    if (cachedAllowed(domainAllowListCache, lruKey)) {
       return {
         allowed: true,
         message: `allow-listed / referer (cache) ${lruKey}`
@@ -121,7 +473,7 @@ export class UnknownDomainRule extends Rule {
       if (this.event.test) {
         lruKey = `${lruKey}|${this.event.scanID}`
       }
-      domainAllowListCache.set(lruKey, 1)
+      domainAllowListCache.set(lruKey, allowListExpiry(allowedReferrer))
       return {
         allowed: true,
         message: `allow-listed / referer (${refererURL.domain}) (DB)`
@@ -2,12 +2,12 @@
 import { parse } from 'tldts'
 import LRUCache from 'lru-native2'
 import * as MerryMaker from '@merrymaker/types'
-import { Rule } from './base'
+import { allowListExpiry, cachedAllowed, Rule } from './base'
 import { IResult } from 'tldts-core'
 
 const oneHour = 1000 * 60 * 60
 
-const domainAllowListCache = new LRUCache({
+const domainAllowListCache = new LRUCache<number>({
   maxElements: 1000,
   maxAge: oneHour,
   size: 50,
@@ -63,7 +63,7 @@ export class WebsocketRule extends Rule {
     }
 
     // Check allow_list cache
-    if (domainAllowListCache.get(payloadURL.domain)) {
+    if (cachedAllowed(domainAllowListCache, payloadURL.domain)) {
       res.message = `allow-listed (cache) ${payloadURL.domain}`
       return this.resolveEvent(res)
     }
@@ -72,7 +72,7 @@ export class WebsocketRule extends Rule {
     // Checkout backend transport
     if (allowList.total > 0) {
       res.message = `allow-listed (DB) ${payloadURL.domain}`
-      domainAllowListCache.set(payloadURL.domain, 1)
+      domainAllowListCache.set(payloadURL.domain, allowListExpiry(allowList))
       return this.resolveEvent(res)
     }
 
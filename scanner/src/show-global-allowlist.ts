@@ -0,0 +1,18 @@
+// usage: yarn show-global-allowlist [--json]
+import { config } from 'node-config-ts'
+import { builtinSuffixes, loadGlobalAllowlist } from './lib/global-allowlist'
+
+const options = config.rules.unknownDomain.globalAllowlist
+const list = loadGlobalAllowlist(options)
+
+if (process.argv.includes('--json')) {
+  console.log(JSON.stringify({ ...list, file: options.file || null }))
+} else {
+  console.log(`global allowlist ${list.version}`)
+  console.log(`enabled: ${list.enabled}`)
+  console.log(`extra file: ${options.file || '(none)'}`)
+  list.suffixes.forEach((suffix) => {
+    const source = builtinSuffixes.includes(suffix) ? 'builtin' : 'file'
+    console.log(`${source}\t${suffix}`)
+  })
+}
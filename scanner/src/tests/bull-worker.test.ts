@@ -0,0 +1,252 @@
+import { Job, Queue } from 'bull'
+import BullWorker from '../lib/bull-worker'
+
+type FakeQueue = Queue & {
+  client: { pipeline: jest.Mock }
+  moveUnlockedJobsToWait: jest.Mock
+}
+
+// `getNextJob` and the pipelined `moveToActive` reservations
+// both take the next job of `results`
+const fakeQueue = (results: Array<Job | null>): FakeQueue => {
+  const next = () => (results.length ? results.shift() : null)
+  const reserved = new Map<string, Job>()
+  const pipeline = () => {
+    let calls = 0
+    const p = {
+      moveToActive: jest.fn(() => {
+        calls += 1
+        return p
+      }),
+      exec: jest.fn(async () =>
+        Array.from({ length: calls }, () => {
+          const job = next()
+          if (!job) return [null, null]
+          reserved.set(String(job.id), job)
+          return [null, [['id', String(job.id)], String(job.id)]]
+        })
+      )
+    }
+    return p
+  }
+  return ({
+    keys: {},
+    token: 'token',
+    settings: { lockDuration: 1000 },
+    client: { pipeline: jest.fn(pipeline) },
+    getNextJob: jest.fn(async () => next()),
+    nextJobFromJobData: jest.fn((_data: unknown, id: string) =>
+      reserved.get(id)
+    ),
+    moveUnlockedJobsToWait: jest.fn(async () => undefined)
+  } as unknown) as FakeQueue
+}
+
+const sleeps = (worker: BullWorker): number[] => {
+  const found: number[] = []
+  worker.on('info', (msg: string) => {
+    const match = /^Sleeping for (\d+)ms$/.exec(msg)
+    if (match) {
+      found.push(parseInt(match[1], 10))
+    }
+  })
+  return found
+}
+
+describe('BullWorker', () => {
+  describe('waitForJob', () => {
+    it('backs off while the queue is empty', async () => {
+      const job = ({ id: 1 } as unknown) as Job
+      const worker = new BullWorker(
+        1,
+        fakeQueue([null, null, null, null, job]),
+        async () => undefined,
+        4
+      )
+      const slept = sleeps(worker)
+      await worker.waitForJob()
+      expect(slept).toEqual([1, 2, 4, 4])
+      expect(worker.job).toBe(job)
+    })
+    it('resets the poll interval when work appears', async () => {
+      const job = ({ id: 1 } as unknown) as Job
+      const queue = fakeQueue([null, null, null, job, null, job])
+      const worker = new BullWorker(1, queue, async () => undefined, 8)
+      const slept = sleeps(worker)
+      await worker.waitForJob()
+      expect(worker.pollInterval).toEqual(1)
+      worker.job = null
+      await worker.waitForJob()
+      expect(slept).toEqual([1, 2, 4, 1])
+    })
+    it('wakes early when signaled', async () => {
+      const job = ({ id: 1 } as unknown) as Job
+      const worker = new BullWorker(
+        60000,
+        fakeQueue([null, job]),
+        async () => undefined
+      )
+      const waiting = worker.waitForJob()
+      setImmediate(() => worker.wake())
+      await waiting
+      expect(worker.job).toBe(job)
+    })
+  })
+  describe('reserveBatch', () => {
+    const jobs = (ids: number[]) => ids.map(id => ({ id } as unknown) as Job)
+    it('reserves up to max jobs in one round-trip', async () => {
+      const queue = fakeQueue(jobs([1, 2, 3, 4]))
+      const worker = new BullWorker(1, queue, async () => undefined)
+      const batch = await worker.reserveBatch(3)
+      expect(batch.map(j => j.id)).toEqual([1, 2, 3])
+      expect(queue.client.pipeline).toHaveBeenCalledTimes(1)
+      const pipeline = queue.client.pipeline.mock.results[0].value
+      expect(pipeline.moveToActive).toHaveBeenCalledTimes(3)
+      expect(pipeline.exec).toHaveBeenCalledTimes(1)
+      expect(queue.getNextJob).not.toHaveBeenCalled()
+    })
+    it('returns a partial batch', async () => {
+      const queue = fakeQueue(jobs([1, 2]))
+      const worker = new BullWorker(1, queue, async () => undefined)
+      const batch = await worker.reserveBatch(5)
+      expect(batch.map(j => j.id)).toEqual([1, 2])
+      expect(queue.client.pipeline).toHaveBeenCalledTimes(1)
+    })
+    it('returns an empty batch when nothing is waiting', async () => {
+      const worker = new BullWorker(1, fakeQueue([]), async () => undefined)
+      await expect(worker.reserveBatch(5)).resolves.toEqual([])
+    })
+    it('reserves nothing while draining', async () => {
+      const queue = fakeQueue(jobs([1]))
+      const worker = new BullWorker(1, queue, async () => undefined)
+      worker.setDraining(true)
+      await expect(worker.reserveBatch(5)).resolves.toEqual([])
+      expect(queue.client.pipeline).not.toHaveBeenCalled()
+    })
+  })
+  describe('checkStalled', () => {
+    beforeEach(() => jest.useFakeTimers())
+    afterEach(() => jest.useRealTimers())
+    it('moves unlocked jobs back to wait until stopped', () => {
+      const queue = fakeQueue([])
+      const worker = new BullWorker(1, queue, async () => undefined)
+      const stop = worker.checkStalled(1000)
+      jest.advanceTimersByTime(2500)
+      expect(queue.moveUnlockedJobsToWait).toHaveBeenCalledTimes(2)
+      stop()
+      jest.advanceTimersByTime(5000)
+      expect(queue.moveUnlockedJobsToWait).toHaveBeenCalledTimes(2)
+    })
+  })
+  describe('draining', () => {
+    const fakeJob = (id: number) =>
+      (({
+        id,
+        moveToCompleted: jest.fn(async () => null),
+        moveToFailed: jest.fn(async () => null),
+        releaseLock: jest.fn(async () => undefined)
+      } as unknown) as Job & {
+        moveToCompleted: jest.Mock
+        releaseLock: jest.Mock
+      })
+    it('refuses new jobs', async () => {
+      const queue = fakeQueue([fakeJob(1)])
+      const worker = new BullWorker(1, queue, async () => undefined)
+      worker.setDraining(true)
+      await worker.poll()
+      expect(worker.isDraining).toBe(true)
+      expect(queue.getNextJob).not.toHaveBeenCalled()
+    })
+    it('completes the job in progress', async () => {
+      const job = fakeJob(1)
+      const queue = fakeQueue([job, fakeJob(2)])
+      let finish: () => void = () => undefined
+      const worker = new BullWorker(
+        1,
+        queue,
+        () => new Promise<void>((resolve) => (finish = resolve))
+      )
+      const polling = worker.poll()
+      await new Promise(setImmediate)
+      const drained = worker.drain()
+      finish()
+      await Promise.all([polling, drained])
+      // completed without fetching (reserving) the next job
+      expect(job.moveToCompleted).toHaveBeenCalledWith('succeeded', true, true)
+      expect(job.releaseLock).toHaveBeenCalled()
+      expect(queue.getNextJob).toHaveBeenCalledTimes(1)
+    })
+    it('resolves immediately when not polling', async () => {
+      const worker = new BullWorker(1, fakeQueue([]), async () => undefined)
+      await expect(worker.drain()).resolves.toBeUndefined()
+    })
+  })
+  describe('pollBatch', () => {
+    const fakeJob = (id: number) =>
+      (({
+        id,
+        moveToCompleted: jest.fn(async () => null),
+        moveToFailed: jest.fn(async () => null),
+        releaseLock: jest.fn(async () => undefined)
+      } as unknown) as Job & {
+        moveToCompleted: jest.Mock
+        moveToFailed: jest.Mock
+        releaseLock: jest.Mock
+      })
+    it('finishes each job of the batch', async () => {
+      const ok = fakeJob(1)
+      const failed = fakeJob(2)
+      const worker = new BullWorker(1, fakeQueue([ok, failed]), async () =>
+        undefined
+      )
+      const workBatch = jest.fn(async (batch: Job[]) => {
+        worker.setDraining(true)
+        return batch.map(j => (j.id === 2 ? new Error('boom') : null))
+      })
+      await worker.pollBatch(5, workBatch)
+      expect(workBatch).toHaveBeenCalledTimes(1)
+      expect(workBatch.mock.calls[0][0]).toEqual([ok, failed])
+      expect(ok.moveToCompleted).toHaveBeenCalledWith('succeeded', true, true)
+      expect(failed.moveToFailed).toHaveBeenCalledWith(new Error('boom'), true)
+      expect(ok.releaseLock).toHaveBeenCalled()
+      expect(failed.releaseLock).toHaveBeenCalled()
+    })
+    it('extends the locks of unfinished jobs', async () => {
+      const jobs = [1, 2].map(id =>
+        Object.assign(fakeJob(id), {
+          extendLock: jest.fn(async () => undefined)
+        })
+      )
+      const worker = new BullWorker(1, fakeQueue([...jobs]), async () =>
+        undefined
+      )
+      await worker.pollBatch(
+        5,
+        async batch => {
+          worker.setDraining(true)
+          await new Promise(resolve => setTimeout(resolve, 30))
+          return batch.map(() => null)
+        },
+        { lockMs: 1000, heartbeatMs: 5 }
+      )
+      const beats = jobs.map(j => j.extendLock.mock.calls.length)
+      jobs.forEach(j => {
+        expect(j.extendLock).toHaveBeenCalledWith(1000)
+      })
+      // stopped once the batch finished
+      await new Promise(resolve => setTimeout(resolve, 20))
+      expect(jobs.map(j => j.extendLock.mock.calls.length)).toEqual(beats)
+    })
+    it('fails the whole batch when the handler throws', async () => {
+      const jobs = [fakeJob(1), fakeJob(2)]
+      const worker = new BullWorker(1, fakeQueue([...jobs]), async () =>
+        undefined
+      )
+      await worker.pollBatch(5, async () => {
+        worker.setDraining(true)
+        throw new Error('down')
+      })
+      jobs.forEach(j => expect(j.moveToFailed).toHaveBeenCalled())
+    })
+  })
+})
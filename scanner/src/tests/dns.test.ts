@@ -0,0 +1,88 @@
+import { DNSLookup, DNSResolver, DNSCache } from '../lib/dns'
+
+const answers: Record<string, string[]> = {
+  resolve4: ['203.0.113.7'],
+  resolve6: [],
+  resolveCname: ['cdn.example.net']
+}
+
+class StubResolver implements DNSResolver {
+  calls = 0
+  delayMs = 0
+  async answer(kind: string): Promise<string[]> {
+    this.calls += 1
+    if (this.delayMs) {
+      await new Promise(resolve => setTimeout(resolve, this.delayMs))
+    }
+    return answers[kind]
+  }
+  resolve4(): Promise<string[]> {
+    return this.answer('resolve4')
+  }
+  resolve6(): Promise<string[]> {
+    return this.answer('resolve6')
+  }
+  resolveCname(): Promise<string[]> {
+    return this.answer('resolveCname')
+  }
+}
+
+class MemoryCache implements DNSCache {
+  store: Record<string, string> = {}
+  async get(key: string): Promise<string | null> {
+    return this.store[key] || null
+  }
+  async setex(key: string, _seconds: number, value: string): Promise<void> {
+    this.store[key] = value
+  }
+}
+
+const options = {
+  enabled: true,
+  timeoutMs: 50,
+  maxPerScan: 2,
+  cacheSeconds: 3600
+}
+
+describe('DNSLookup', () => {
+  let resolver: StubResolver
+  let cache: MemoryCache
+  let lookup: DNSLookup
+  beforeEach(() => {
+    resolver = new StubResolver()
+    cache = new MemoryCache()
+    lookup = new DNSLookup({ ...options, resolver, cache })
+  })
+  it('resolves A / AAAA / CNAME records', async () => {
+    const res = await lookup.lookup('www.example.com', 'scan-a')
+    expect(res.a).toEqual(['203.0.113.7'])
+    expect(res.aaaa).toEqual([])
+    expect(res.cname).toEqual(['cdn.example.net'])
+    expect(res.error).toBeUndefined()
+  })
+  it('reuses cached answers', async () => {
+    await lookup.lookup('www.example.com', 'scan-a')
+    await lookup.lookup('www.example.com', 'scan-b')
+    expect(resolver.calls).toBe(3)
+    expect(JSON.parse(cache.store['dns:www.example.com']).a).toEqual([
+      '203.0.113.7'
+    ])
+  })
+  it('caps lookups per scan', async () => {
+    expect(await lookup.lookup('a.example.com', 'scan-a')).not.toBeNull()
+    expect(await lookup.lookup('b.example.com', 'scan-a')).not.toBeNull()
+    expect(await lookup.lookup('c.example.com', 'scan-a')).toBeNull()
+    expect(await lookup.lookup('c.example.com', 'scan-b')).not.toBeNull()
+  })
+  it('returns timeouts as errors', async () => {
+    resolver.delayMs = 200
+    const res = await lookup.lookup('slow.example.com', 'scan-a')
+    expect(res.error).toBe('timeout')
+    expect(cache.store['dns:slow.example.com']).toBeUndefined()
+  })
+  it('does nothing when disabled', async () => {
+    lookup = new DNSLookup({ ...options, enabled: false, resolver, cache })
+    expect(await lookup.lookup('www.example.com', 'scan-a')).toBeNull()
+    expect(resolver.calls).toBe(0)
+  })
+})
@@ -0,0 +1,66 @@
+import { parse } from 'tldts'
+import {
+  dgaSignals,
+  domainRisk,
+  DomainRiskOptions,
+  longestConsonantRun,
+  raiseSeverity
+} from '../lib/domain-risk'
+
+const options: DomainRiskOptions = {
+  enabled: true,
+  severity: 'high',
+  tlds: ['top', 'XYZ'],
+  dga: { minLength: 16, digitRatio: 0.3, consonantRun: 5, minSignals: 2 }
+}
+
+describe('domain risk', () => {
+  describe('domainRisk', () => {
+    it('flags risky TLDs', () => {
+      expect(domainRisk(parse('https://cdn.shop.top/a.js'), options)).toEqual({
+        risky_tld: 'top'
+      })
+      expect(domainRisk(parse('https://shop.xyz/'), options)).toEqual({
+        risky_tld: 'xyz'
+      })
+    })
+    it('flags DGA-like names', () => {
+      expect(
+        domainRisk(parse('https://xkqzt79vbn3tz8w2.test/'), options)
+      ).toEqual({ dga_signals: ['length', 'digit_ratio', 'consonant_run'] })
+    })
+    it('ignores ordinary domains', () => {
+      ;[
+        'https://www.testsite.test/',
+        'https://cdn.eu.shopify.com/',
+        'https://xn--bcher-kva.test/',
+        'https://203.0.113.5/'
+      ].forEach((url) => {
+        expect(domainRisk(parse(url), options)).toBeNull()
+      })
+    })
+    it('can be disabled', () => {
+      expect(
+        domainRisk(parse('https://shop.top/'), { ...options, enabled: false })
+      ).toBeNull()
+    })
+  })
+  describe('dgaSignals', () => {
+    it('requires minSignals', () => {
+      // long, but pronounceable
+      expect(dgaSignals('mybigshoppingcenter', options.dga)).toEqual([])
+      expect(
+        dgaSignals('mybigshoppingcenter', { ...options.dga, minSignals: 1 })
+      ).toEqual(['length'])
+    })
+  })
+  it('longestConsonantRun', () => {
+    expect(longestConsonantRun('testsite')).toEqual(3)
+    expect(longestConsonantRun('qzxwvk1a')).toEqual(6)
+  })
+  it('raiseSeverity', () => {
+    expect(raiseSeverity(undefined, 'high')).toEqual('high')
+    expect(raiseSeverity('medium', 'high')).toEqual('high')
+    expect(raiseSeverity('critical', 'high')).toEqual('critical')
+  })
+})
@@ -0,0 +1,80 @@
+import { mkdtempSync, writeFileSync } from 'fs'
+import { tmpdir } from 'os'
+import path from 'path'
+
+import {
+  builtinSuffixes,
+  GLOBAL_ALLOWLIST_VERSION,
+  loadGlobalAllowlist,
+  matchSuffix,
+  parseSuffixes
+} from '../lib/global-allowlist'
+
+describe('Global allowlist', () => {
+  describe('loadGlobalAllowlist', () => {
+    it('uses the built-in suffixes', () => {
+      const list = loadGlobalAllowlist({ enabled: true, file: '' })
+      expect(list.version).toEqual(GLOBAL_ALLOWLIST_VERSION)
+      expect(list.suffixes).toEqual([...builtinSuffixes].sort())
+      expect(list.extra).toEqual([])
+    })
+    it('leaves out shared CDN hosts', () => {
+      const list = loadGlobalAllowlist({ enabled: true, file: '' })
+      ;['cloudfront.net', 'fastly.net', 'jsdelivr.net', 'unpkg.com'].forEach(
+        (host) => expect(matchSuffix(`x.${host}`, list.suffixes)).toBeNull()
+      )
+    })
+    it('is empty when disabled', () => {
+      const list = loadGlobalAllowlist({ enabled: false, file: '' })
+      expect(list.suffixes).toEqual([])
+    })
+    it('extends the list from a file', () => {
+      const dir = mkdtempSync(path.join(tmpdir(), 'allowlist-'))
+      const file = path.join(dir, 'suffixes.txt')
+      writeFileSync(
+        file,
+        '# partner CDNs\ncdn.partner.test\n\n*.Static.Test\ngstatic.com\n'
+      )
+      const list = loadGlobalAllowlist({ enabled: true, file })
+      expect(list.extra).toEqual([
+        'cdn.partner.test',
+        'static.test',
+        'gstatic.com'
+      ])
+      expect(list.suffixes).toContain('cdn.partner.test')
+      // no duplicates with built-ins
+      expect(list.suffixes.filter((s) => s === 'gstatic.com')).toHaveLength(1)
+    })
+  })
+  describe('parseSuffixes', () => {
+    it('skips comments and blank lines', () => {
+      expect(parseSuffixes('a.test # trailing\n  \n#b.test\n.c.test')).toEqual([
+        'a.test',
+        'c.test'
+      ])
+    })
+  })
+  describe('matchSuffix', () => {
+    const suffixes = ['cloudfront.net', 'gstatic.com']
+    it('matches the suffix and its subdomains', () => {
+      expect(matchSuffix('cloudfront.net', suffixes)).toEqual('cloudfront.net')
+      expect(matchSuffix('d111.CloudFront.net.', suffixes)).toEqual(
+        'cloudfront.net'
+      )
+    })
+    it('does not match lookalike domains', () => {
+      expect(matchSuffix('evilcloudfront.net', suffixes)).toBeNull()
+      expect(matchSuffix('cloudfront.net.evil.test', suffixes)).toBeNull()
+    })
+    it('honors suffixes un-trusted by the site', () => {
+      const all = new Set(['cloudfront.net'])
+      expect(matchSuffix('d111.cloudfront.net', suffixes, all)).toBeNull()
+      // only one distribution un-trusted
+      const untrusted = new Set(['d111.cloudfront.net'])
+      expect(matchSuffix('d111.cloudfront.net', suffixes, untrusted)).toBeNull()
+      expect(matchSuffix('d222.cloudfront.net', suffixes, untrusted)).toEqual(
+        'cloudfront.net'
+      )
+    })
+  })
+})
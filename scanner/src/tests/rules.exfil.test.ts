@@ -0,0 +1,135 @@
+import { WebRequestEvent } from '@merrymaker/types'
+import Chance from 'chance'
+import nock from 'nock'
+import { config } from 'node-config-ts'
+
+import exfilRule, {
+  exfilAllowListCache,
+  exfilSeenCache,
+  isSensitiveField,
+  postFieldNames
+} from '../rules/exfil'
+
+const chance = new Chance()
+
+const request = (attrs: Record<string, unknown>) =>
+  exfilRule.process({
+    scanID: chance.guid(),
+    type: 'request',
+    payload: ({
+      url: 'https://collect.testsite.test/p',
+      method: 'POST',
+      ...attrs
+    } as unknown) as WebRequestEvent
+  })
+
+const unknownDomain = () => {
+  nock(config.transport.http)
+    .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+    .reply(200, { total: 0 })
+  nock(config.transport.http)
+    .get('/api/seen_strings/_cache')
+    .query({ key: 'collect.testsite.test', type: 'domain' })
+    .reply(200, { store: 'none' })
+}
+
+describe('Exfil Rule', () => {
+  beforeEach(() => {
+    exfilAllowListCache.clear()
+    exfilSeenCache.clear()
+  })
+  afterEach(() => {
+    nock.cleanAll()
+  })
+  describe('postFieldNames', () => {
+    it('reads multipart field names', () => {
+      const body = [
+        '------b',
+        'Content-Disposition: form-data; name="cc_number"',
+        '',
+        '4111111111111111',
+        '------b',
+        'Content-Disposition: form-data; name="email"',
+        '',
+        'a@b.test',
+        '------b--'
+      ].join('\r\n')
+      expect(
+        postFieldNames('multipart/form-data; boundary=----b', body)
+      ).toEqual(['cc_number', 'email'])
+    })
+    it('reads nested JSON keys', () => {
+      const body = JSON.stringify({ billing: { cardNumber: '4111', cvv: 1 } })
+      expect(postFieldNames('application/json', body)).toEqual([
+        'billing',
+        'cardNumber',
+        'cvv'
+      ])
+    })
+    it('reads url-encoded field names', () => {
+      expect(
+        postFieldNames('application/x-www-form-urlencoded', 'pan=1&exp=2')
+      ).toEqual(['pan', 'exp'])
+    })
+    it('ignores bodies that do not parse', () => {
+      expect(postFieldNames('application/json', '{broken')).toEqual([])
+    })
+  })
+  describe('isSensitiveField', () => {
+    it('matches card field names', () => {
+      expect(isSensitiveField('cardNumber')).toBe(true)
+      expect(isSensitiveField('billing[cvv]')).toBe(true)
+      expect(isSensitiveField('CC-EXP')).toBe(true)
+      expect(isSensitiveField('company')).toBe(false)
+      expect(isSensitiveField('discard')).toBe(false)
+    })
+  })
+  it('raises a critical alert for card fields in JSON', async () => {
+    unknownDomain()
+    const result = await request({
+      headers: { 'Content-Type': 'application/json' },
+      postData: JSON.stringify({ cardnumber: '4111', cvc: '123' })
+    })
+    expect(result[0].alert).toBe(true)
+    expect(result[0].context.severity).toBe('critical')
+    expect(result[0].context.sensitive_fields).toEqual(['cardnumber', 'cvc'])
+  })
+  it('raises a critical alert for card fields in multipart bodies', async () => {
+    unknownDomain()
+    const result = await request({
+      headers: { 'content-type': 'multipart/form-data; boundary=x' },
+      postData:
+        '--x\r\nContent-Disposition: form-data; name="cvv"\r\n\r\n123\r\n--x--'
+    })
+    expect(result[0].alert).toBe(true)
+    expect(result[0].context.severity).toBe('critical')
+  })
+  it('raises a high alert for other payloads', async () => {
+    unknownDomain()
+    const result = await request({
+      headers: { 'content-type': 'application/json' },
+      postData: '{"event":"view"}'
+    })
+    expect(result[0].alert).toBe(true)
+    expect(result[0].context.severity).toBe('high')
+  })
+  it('skips requests without a payload', async () => {
+    const result = await request({ method: 'GET' })
+    expect(result[0].alert).toBe(false)
+    expect(result[0].message).toBe('not a payload-bearing request')
+  })
+  it('skips domains in the seen baseline', async () => {
+    nock(config.transport.http)
+      .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+      .reply(200, { total: 0 })
+    nock(config.transport.http)
+      .get('/api/seen_strings/_cache')
+      .query({ key: 'collect.testsite.test', type: 'domain' })
+      .reply(200, { store: 'database' })
+    const result = await request({ postData: 'cvv=123' })
+    expect(result[0].alert).toBe(false)
+    expect(result[0].message).toBe(
+      'domain in seen baseline collect.testsite.test'
+    )
+  })
+})
@@ -0,0 +1,155 @@
+import MerryMaker, { WebRequestEvent, WebScriptEvent } from '@merrymaker/types'
+import Chance from 'chance'
+import nock from 'nock'
+import { config } from 'node-config-ts'
+
+import iocURLRule from '../rules/ioc.url'
+import iocIPRule from '../rules/ioc.ip'
+import iocHashRule from '../rules/ioc.hash'
+import { iocCaches, syncVersion } from '../lib/ioc-cache'
+
+const chance = new Chance()
+
+describe('IOC Rules', () => {
+  afterEach(() => {
+    nock.cleanAll()
+  })
+  describe('url', () => {
+    const url = 'https://cdn.testsite.test/skimmer.js?v=1'
+    let result: MerryMaker.RuleAlert[]
+    beforeAll(async () => {
+      iocCaches.url.clear()
+      nock(config.transport.http)
+        .get('/api/iocs/')
+        .query({ type: 'url', value: url })
+        .reply(200, { total: 1 })
+      result = await iocURLRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url } as WebRequestEvent
+      })
+    })
+    it('alerts on known URL', () => {
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].message).toEqual(`known IOC URL (DB) ${url}`)
+    })
+    it('caches the match', () => {
+      expect(iocCaches.url.get(url)).toEqual(1)
+    })
+  })
+
+  describe('ip', () => {
+    it('alerts on IP hosts in a known range', async () => {
+      iocCaches.ip_cidr.clear()
+      nock(config.transport.http)
+        .get('/api/iocs/')
+        .query({ type: 'ip_cidr', value: '203.0.113.7' })
+        .reply(200, { total: 1 })
+      const result = await iocIPRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url: 'http://203.0.113.7/a.js' } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].context.ip).toEqual('203.0.113.7')
+    })
+    it('skips hostnames', async () => {
+      const result = await iocIPRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url: 'https://www.testsite.test' } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(false)
+      expect(result[0].message).toEqual('not an IP host')
+    })
+  })
+
+  describe('site exceptions', () => {
+    const ip = '203.0.113.9'
+    const siteRules = (scanID: string, exceptions: string[]) =>
+      nock(config.transport.http)
+        .get(`/api/scans/${scanID}/rules`)
+        .reply(200, {
+          site_id: chance.guid(),
+          disabled: [],
+          ioc_exceptions: exceptions
+        })
+    it('records excepted matches without alerting', async () => {
+      iocCaches.ip_cidr.clear()
+      const scanA = chance.guid()
+      const scanB = chance.guid()
+      siteRules(scanA, [ip])
+      siteRules(scanB, ['203.0.113.10'])
+      nock(config.transport.http)
+        .get('/api/iocs/')
+        .query({ type: 'ip_cidr', value: ip })
+        .reply(200, { total: 1 })
+      const event = (scanID: string) => ({
+        scanID,
+        type: 'request' as const,
+        payload: { url: `http://${ip}/a.js` } as WebRequestEvent
+      })
+      const [siteA] = await iocIPRule.process(event(scanA))
+      expect(siteA.alert).toEqual(false)
+      expect(siteA.context.ioc_excepted).toEqual(ip)
+      expect(siteA.message).toEqual(
+        `known IOC IP range (DB) ${ip} (excepted for site: ${ip})`
+      )
+      // same indicator, other site
+      const [siteB] = await iocIPRule.process(event(scanB))
+      expect(siteB.alert).toEqual(true)
+      expect(siteB.context.ioc_excepted).toBeUndefined()
+    })
+    it('matches exceptions case-insensitively', async () => {
+      const sha256 = 'C'.repeat(64)
+      iocCaches.sha256.clear()
+      const scanID = chance.guid()
+      siteRules(scanID, [sha256.toLowerCase()])
+      nock(config.transport.http)
+        .get('/api/iocs/')
+        .query({ type: 'sha256', value: sha256.toLowerCase() })
+        .reply(200, { total: 1 })
+      const [result] = await iocHashRule.process({
+        scanID,
+        type: 'script-response',
+        payload: {
+          url: 'https://www.testsite.test/a.js',
+          sha256
+        } as WebScriptEvent
+      })
+      expect(result.alert).toEqual(false)
+    })
+  })
+
+  describe('hash', () => {
+    it('does not alert on unknown hashes', async () => {
+      const sha256 = 'b'.repeat(64)
+      iocCaches.sha256.clear()
+      nock(config.transport.http)
+        .get('/api/iocs/')
+        .query({ type: 'sha256', value: sha256 })
+        .reply(200, { total: 0 })
+      const result = await iocHashRule.process({
+        scanID: chance.guid(),
+        type: 'script-response',
+        payload: {
+          url: 'https://www.testsite.test/a.js',
+          sha256
+        } as WebScriptEvent
+      })
+      expect(result[0].alert).toEqual(false)
+      expect(iocCaches.sha256.get(sha256)).toBeUndefined()
+    })
+  })
+
+  describe('syncVersion', () => {
+    it('clears caches when the version changes', () => {
+      syncVersion('1')
+      iocCaches.fqdn.set('example.com', 1)
+      expect(syncVersion('1')).toEqual(false)
+      expect(iocCaches.fqdn.get('example.com')).toEqual(1)
+      expect(syncVersion('2')).toEqual(true)
+      expect(iocCaches.fqdn.get('example.com')).toBeUndefined()
+    })
+  })
+})
@@ -0,0 +1,70 @@
+import { WebScriptEvent } from '@merrymaker/types'
+import Chance from 'chance'
+import nock from 'nock'
+import { config } from 'node-config-ts'
+
+import scriptHashRule from '../rules/script.hash'
+
+const chance = new Chance()
+
+describe('Script Hash Rule', () => {
+  const url = 'https://www.testsite.test/js/checkout.js'
+  const sha256 = 'a'.repeat(64)
+  const scanID = chance.guid()
+  afterEach(() => {
+    nock.cleanAll()
+  })
+  it('alerts when a known script hash changed', async () => {
+    const previous = 'b'.repeat(64)
+    nock(config.transport.http)
+      .post('/api/seen_scripts/_observe', {
+        seen_script: { scan_id: scanID, url, sha256 }
+      })
+      .reply(200, { previous, changed: true })
+    const result = await scriptHashRule.process({
+      scanID,
+      type: 'script-response',
+      payload: { url, sha256 } as WebScriptEvent
+    })
+    expect(result[0].alert).toEqual(true)
+    expect(result[0].message).toEqual(`script hash changed ${url}`)
+    expect(result[0].context).toEqual({
+      url,
+      sha256,
+      previous_sha256: previous,
+      severity: 'high'
+    })
+  })
+  it('does not alert on new or unchanged scripts', async () => {
+    nock(config.transport.http)
+      .post('/api/seen_scripts/_observe')
+      .reply(200, { previous: null, changed: false })
+    const result = await scriptHashRule.process({
+      scanID,
+      type: 'script-response',
+      payload: { url, sha256 } as WebScriptEvent
+    })
+    expect(result[0].alert).toEqual(false)
+  })
+  it('fails when the observation is rejected', async () => {
+    nock(config.transport.http)
+      .post('/api/seen_scripts/_observe')
+      .reply(404, { message: 'Scan Not Found' })
+    await expect(
+      scriptHashRule.process({
+        scanID,
+        type: 'script-response',
+        payload: { url, sha256 } as WebScriptEvent
+      })
+    ).rejects.toThrow('script observation responded with 404')
+  })
+  it('skips scripts without a hash', async () => {
+    const result = await scriptHashRule.process({
+      scanID,
+      type: 'script-response',
+      payload: { url } as WebScriptEvent
+    })
+    expect(result[0].alert).toEqual(false)
+    expect(result[0].message).toEqual('missing script url or hash')
+  })
+})
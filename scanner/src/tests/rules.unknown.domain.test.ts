@@ -3,12 +3,25 @@ import Chance from 'chance'
 import nock from 'nock'
 import { config } from 'node-config-ts'
 
+import { parse } from 'tldts'
 import unknownDomainRule, {
   domainAllowListCache,
-  seenDomainCache
+  seenDomainCache,
+  seenDomainKey,
+  ipHostLiteral,
+  requestSeenKey,
+  alertOnceCache,
+  globalAllowlist,
+  pickContext
 } from '../rules/unknown-domain'
+import { UNCOUNTED_HIT } from '../rules/base'
+import { idnForms, isHomograph } from '../lib/idn'
+import { SeenRecorder } from '../lib/seen-recorder'
+import { ruleCopy } from '../lib/scan-event-handler'
 
 const chance = new Chance()
+// scan of the event, posted with seen_strings lookups
+const anyScanID = /^[0-9a-f-]{36}$/
 
 describe('Unknown Domain Rule', () => {
   afterEach(() => {
@@ -26,7 +39,8 @@ describe('Unknown Domain Rule', () => {
         .post('/api/seen_strings/_cache', {
           seen_string: {
             key: 'www.testsite.test',
-            type: 'domain'
+            type: 'domain',
+            scan_id: anyScanID
           }
         })
         .reply(200, { store: 'none' })
@@ -47,6 +61,178 @@ describe('Unknown Domain Rule', () => {
     })
   })
 
+  describe('global allowlist', () => {
+    const siteRules = (scanID: string, untrusted: string[]) =>
+      nock(config.transport.http)
+        .get(`/api/scans/${scanID}/rules`)
+        .reply(200, {
+          site_id: chance.guid(),
+          disabled: [],
+          untrusted_suffixes: untrusted
+        })
+    beforeEach(() => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+    })
+    it('suppresses known infrastructure before the allow_list', async () => {
+      const scanID = chance.guid()
+      siteRules(scanID, [])
+      const [res] = await unknownDomainRule.process({
+        scanID,
+        type: 'request',
+        payload: { url: 'https://www.googletagmanager.com/gtm.js' } as WebRequestEvent
+      })
+      expect(res.alert).toEqual(false)
+      expect(res.context.suppressed_by).toEqual('global_allowlist')
+      expect(res.context.global_allowlist).toEqual({
+        suffix: 'googletagmanager.com',
+        version: globalAllowlist.version
+      })
+      // no allow_list or seen_strings lookups
+      expect(nock.pendingMocks()).toEqual([])
+    })
+    it('checks suffixes un-trusted by the site', async () => {
+      const scanID = chance.guid()
+      siteRules(scanID, ['googletagmanager.com'])
+      nock(config.transport.http)
+        .get(/\/api\/allow_list\//)
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: {
+            key: 'www.googletagmanager.com',
+            type: 'domain',
+            scan_id: anyScanID
+          }
+        })
+        .reply(200, { store: 'none' })
+      const [res] = await unknownDomainRule.process({
+        scanID,
+        type: 'request',
+        payload: { url: 'https://www.googletagmanager.com/gtm.js' } as WebRequestEvent
+      })
+      expect(res.alert).toEqual(true)
+      expect(res.context.suppressed_by).toBeUndefined()
+    })
+  })
+
+  describe('learning mode', () => {
+    const siteRules = (scanID: string, learning: boolean) =>
+      nock(config.transport.http)
+        .get(`/api/scans/${scanID}/rules`)
+        .reply(200, {
+          site_id: chance.guid(),
+          disabled: [],
+          ioc_exceptions: [],
+          learning
+        })
+    const unknown = (key: string) =>
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: { key, type: 'domain', scan_id: anyScanID }
+        })
+        .reply(200, { store: 'none' })
+    beforeEach(() => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+      nock(config.transport.http)
+        .get(/\/api\/allow_list\//)
+        .reply(200, { total: 0 })
+    })
+    it('records unknown domains without alerting', async () => {
+      const scanID = chance.guid()
+      siteRules(scanID, true)
+      unknown('www.learning.test')
+      const [res] = await unknownDomainRule.process({
+        scanID,
+        type: 'request',
+        payload: { url: 'https://www.learning.test' } as WebRequestEvent
+      })
+      expect(res.alert).toEqual(false)
+      expect(res.context.learning).toEqual(true)
+      expect(res.message).toEqual('www.learning.test unknown (learning mode)')
+      // still added to the baseline
+      expect(seenDomainCache.get('www.learning.test')).toEqual(1)
+      expect(res.context.page_url).toBeNull()
+      expect(Date.parse(res.context.seen_at)).not.toBeNaN()
+    })
+    it('records the page of would-alert requests', async () => {
+      const scanID = chance.guid()
+      siteRules(scanID, true)
+      unknown('cdn.learning.test')
+      // referrer allow-list lookup
+      nock(config.transport.http)
+        .get(/\/api\/allow_list\//)
+        .reply(200, { total: 0 })
+      const [res] = await unknownDomainRule.process({
+        scanID,
+        type: 'request',
+        payload: {
+          url: 'https://cdn.learning.test/app.js',
+          headers: { referer: 'https://www.site.test/checkout' }
+        } as WebRequestEvent
+      })
+      expect(res.alert).toEqual(false)
+      expect(res.context.url).toEqual('https://cdn.learning.test/app.js')
+      expect(res.context.page_url).toEqual('https://www.site.test/checkout')
+    })
+    it('alerts once learning mode ended', async () => {
+      const scanID = chance.guid()
+      siteRules(scanID, false)
+      unknown('www.learned.test')
+      const [res] = await unknownDomainRule.process({
+        scanID,
+        type: 'request',
+        payload: { url: 'https://www.learned.test' } as WebRequestEvent
+      })
+      expect(res.alert).toEqual(true)
+      expect(res.context.learning).toBeUndefined()
+    })
+  })
+
+  describe('below seen threshold', () => {
+    let result: MerryMaker.RuleAlert[]
+    beforeAll(async () => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: {
+            key: 'www.testsite.test',
+            type: 'domain',
+            scan_id: anyScanID
+          }
+        })
+        .reply(200, {
+          has: false,
+          store: 'none',
+          hit_count: 2,
+          below_threshold: true
+        })
+      result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://www.testsite.test'
+        } as WebRequestEvent
+      })
+    })
+    it('alerts on domain below the threshold', () => {
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].message).toEqual(
+        'www.testsite.test below seen threshold (2 hits)'
+      )
+      expect(result[0].context.below_seen_threshold).toEqual(true)
+      expect(result[0].context.hit_count).toEqual(2)
+    })
+    it('does not update local seen_strings cache', () => {
+      expect(seenDomainCache.get('www.testsite.test')).not.toEqual(1)
+    })
+  })
+
   describe('known domain', () => {
     beforeEach(() => {
       domainAllowListCache.clear()
@@ -61,7 +247,8 @@ describe('Unknown Domain Rule', () => {
         .post('/api/seen_strings/_cache', {
           seen_string: {
             key: 'www.testsite.test',
-            type: 'domain'
+            type: 'domain',
+            scan_id: anyScanID
           }
         })
         .reply(200, { store: 'database' })
@@ -89,6 +276,51 @@ describe('Unknown Domain Rule', () => {
       })
       expect(result[0].alert).toEqual(false)
     })
+    it('caches remote allow list entries until the earliest expiry', async () => {
+      const soon = new Date(Date.now() + 60 * 1000).toISOString()
+      const later = new Date(Date.now() + 120 * 1000).toISOString()
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, {
+          total: 2,
+          results: [{ expires_at: later }, { expires_at: soon }]
+        })
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://www.testsite.test'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(false)
+      expect(domainAllowListCache.get('testsite.test')).toEqual(
+        Date.parse(soon)
+      )
+    })
+    it('checks the remote allow list once a cached entry expired', async () => {
+      domainAllowListCache.set('testsite.test', Date.now() - 1000)
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: {
+            key: 'www.testsite.test',
+            type: 'domain',
+            scan_id: anyScanID
+          }
+        })
+        .reply(200, { store: 'none' })
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://www.testsite.test'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(true)
+      expect(domainAllowListCache.get('testsite.test')).toBeFalsy()
+    })
     it('does not alert on domain in local allow list cache', async () => {
       domainAllowListCache.set('testsite.test', 1)
       const result = await unknownDomainRule.process({
@@ -138,7 +370,8 @@ describe('Unknown Domain Rule', () => {
           .post('/api/seen_strings/_cache', {
             seen_string: {
               key: 'www.testsite.test',
-              type: 'domain'
+              type: 'domain',
+              scan_id: anyScanID
             }
           })
           .reply(200, { store: 'none' })
@@ -213,7 +446,8 @@ describe('Unknown Domain Rule', () => {
         .post('/api/seen_strings/_cache', {
           seen_string: {
             key: 'www.testsite.test',
-            type: 'domain'
+            type: 'domain',
+            scan_id: anyScanID
           }
         })
         .reply(200, { foo: 'database' })
@@ -283,4 +517,505 @@ describe('Unknown Domain Rule', () => {
       expect(res2[0].alert).toEqual(false)
     })
   })
+  describe('domain normalization', () => {
+    describe('seenDomainKey', () => {
+      it('keeps the full host when disabled', () => {
+        expect(seenDomainKey(parse('https://cdn.eu.shop.test/a'), false)).toEqual(
+          'cdn.eu.shop.test'
+        )
+      })
+      it('reduces to the registrable domain', () => {
+        expect(seenDomainKey(parse('https://cdn.eu.shopify.com/a'), true)).toEqual(
+          'shopify.com'
+        )
+      })
+      it('skips IP addresses', () => {
+        expect(seenDomainKey(parse('https://203.0.113.5/a'), true)).toEqual(
+          '203.0.113.5'
+        )
+      })
+      it('keeps single-label hosts', () => {
+        expect(seenDomainKey(parse('http://intranet/a'), true)).toEqual(
+          'intranet'
+        )
+      })
+      it('strips trailing dots', () => {
+        expect(seenDomainKey(parse('https://www.shopify.com./'), true)).toEqual(
+          'shopify.com'
+        )
+      })
+    })
+    describe('enabled', () => {
+      let result: MerryMaker.RuleAlert[]
+      beforeAll(async () => {
+        unknownDomainRule.normalizeDomain = true
+        domainAllowListCache.clear()
+        seenDomainCache.clear()
+        nock(config.transport.http)
+          .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+          .reply(200, { total: 0 })
+        nock(config.transport.http)
+          .post('/api/seen_strings/_cache', {
+            seen_string: {
+              key: 'testsite.test',
+              type: 'domain',
+              scan_id: anyScanID
+            }
+          })
+          .reply(200, { store: 'none' })
+        result = await unknownDomainRule.process({
+          scanID: chance.guid(),
+          type: 'request',
+          payload: {
+            url: 'https://eu.cdn.testsite.test'
+          } as WebRequestEvent
+        })
+      })
+      afterAll(() => {
+        unknownDomainRule.normalizeDomain = false
+      })
+      it('alerts on the registrable domain', () => {
+        expect(result[0].alert).toEqual(true)
+        expect(result[0].context.domain).toEqual('testsite.test')
+      })
+      it('records the full host', () => {
+        expect(result[0].context.hostname).toEqual('eu.cdn.testsite.test')
+        expect(result[0].context.normalized).toEqual(true)
+      })
+    })
+    describe('disabled', () => {
+      it('does not flag trailing dot hosts as normalized', async () => {
+        domainAllowListCache.clear()
+        seenDomainCache.clear()
+        nock(config.transport.http)
+          .get(/\/api\/allow_list\//)
+          .reply(200, { total: 0 })
+        nock(config.transport.http)
+          .post('/api/seen_strings/_cache', {
+            seen_string: {
+              key: 'www.testsite.test',
+              type: 'domain',
+              scan_id: anyScanID
+            }
+          })
+          .reply(200, { store: 'none' })
+        const res = await unknownDomainRule.process({
+          scanID: chance.guid(),
+          type: 'request',
+          payload: {
+            url: 'https://www.testsite.test./'
+          } as WebRequestEvent
+        })
+        expect(res[0].context.domain).toEqual('www.testsite.test')
+        expect(res[0].context.normalized).toBeUndefined()
+      })
+    })
+  })
+  describe('IP hosts', () => {
+    beforeEach(() => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+    })
+    afterEach(() => {
+      unknownDomainRule.alertOnIPHosts = true
+    })
+    describe('ipHostLiteral', () => {
+      it('strips ports from IPv4 hosts', () => {
+        expect(ipHostLiteral('https://203.0.113.5:8443/a')).toEqual(
+          '203.0.113.5'
+        )
+      })
+      it('strips brackets from IPv6 literals', () => {
+        expect(ipHostLiteral('http://[2001:db8::1]:8080/')).toEqual(
+          '2001:db8::1'
+        )
+      })
+      it('returns null for domains', () => {
+        expect(ipHostLiteral('https://www.testsite.test')).toBeNull()
+      })
+    })
+    it('alerts on unknown IP hosts', async () => {
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=203.0.113.5&type=ip&field=key')
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: {
+            key: '203.0.113.5',
+            type: 'ip',
+            scan_id: anyScanID
+          }
+        })
+        .reply(200, { store: 'none' })
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://203.0.113.5:8443/pay'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].message).toEqual('Unknown IP host 203.0.113.5')
+      expect(result[0].context.ip_host).toEqual(true)
+    })
+    it('does not alert when disabled', async () => {
+      unknownDomainRule.alertOnIPHosts = false
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'http://[2001:db8::1]/'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(false)
+      expect(result[0].context.domain).toEqual('2001:db8::1')
+    })
+  })
+  describe('context fields', () => {
+    const fields = unknownDomainRule.contextFields
+    beforeEach(() => {
+      // resolves without remote lookups
+      unknownDomainRule.alertOnIPHosts = false
+    })
+    afterEach(() => {
+      unknownDomainRule.alertOnIPHosts = true
+      unknownDomainRule.contextFields = fields
+    })
+    describe('pickContext', () => {
+      it('keeps required fields', () => {
+        expect(
+          pickContext({ url: 'u', domain: 'd', severity: 'high' }, [])
+        ).toEqual({ domain: 'd', severity: 'high' })
+      })
+      it('keeps the learning flag', () => {
+        expect(pickContext({ url: 'u', learning: true }, [])).toEqual({
+          learning: true
+        })
+      })
+    })
+    it('includes all fields by default', async () => {
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url: 'http://[2001:db8::1]/' } as WebRequestEvent
+      })
+      expect(Object.keys(result[0].context).sort()).toEqual([
+        'domain',
+        'ip_host',
+        'url'
+      ])
+    })
+    it('omits excluded fields', async () => {
+      unknownDomainRule.contextFields = fields.filter(f => f !== 'url')
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url: 'http://[2001:db8::1]/' } as WebRequestEvent
+      })
+      expect(result[0].context.url).toBeUndefined()
+      expect(result[0].context.domain).toEqual('2001:db8::1')
+      expect(result[0].context.ip_host).toEqual(true)
+    })
+  })
+
+  describe('IDN hosts', () => {
+    beforeEach(() => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+    })
+    const nockLookups = (key: string) => {
+      nock(config.transport.http)
+        .get(`/api/allow_list/?key=${key}&type=fqdn&field=key`)
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: {
+            key,
+            type: 'domain',
+            scan_id: anyScanID
+          }
+        })
+        .reply(200, { store: 'none' })
+    }
+    it('evaluates Unicode hosts in punycode form', async () => {
+      nockLookups('xn--bcher-kva.test')
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://bücher.test/cart'
+        } as WebRequestEvent
+      })
+      expect(result[0].context.domain).toEqual('xn--bcher-kva.test')
+      expect(result[0].context.severity).toBeUndefined()
+    })
+    it('dedupes Unicode and ACE forms', async () => {
+      nockLookups('xn--bcher-kva.test')
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=xn--bcher-kva.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://xn--bcher-kva.test/cart'
+        } as WebRequestEvent
+      })
+      // served from the seen cache, no remote seen_strings lookup
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://bücher.test/cart'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(false)
+    })
+    it('flags mixed script homographs', async () => {
+      // cyrillic "а" in place of latin "a"
+      const ascii = idnForms('pаypal.test').ascii
+      nockLookups(ascii)
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://pаypal.test/'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].context.severity).toEqual('high')
+      expect(result[0].context.ascii_hostname).toEqual(ascii)
+      expect(result[0].context.unicode_hostname).toEqual('pаypal.test')
+    })
+    it('raises the severity of risky TLDs', async () => {
+      nockLookups('shop.top')
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://shop.top/skim.js'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(true)
+      expect(result[0].context.severity).toEqual('high')
+      expect(result[0].context.domain_risk).toEqual({ risky_tld: 'top' })
+    })
+    it('does not alert on seen risky domains', async () => {
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=seen.top&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache', {
+          seen_string: { key: 'seen.top', type: 'domain', scan_id: anyScanID }
+        })
+        .reply(200, { store: 'redis' })
+      const result = await unknownDomainRule.process({
+        scanID: chance.guid(),
+        type: 'request',
+        payload: {
+          url: 'https://seen.top/'
+        } as WebRequestEvent
+      })
+      expect(result[0].alert).toEqual(false)
+      expect(result[0].context.domain_risk).toEqual({ risky_tld: 'top' })
+    })
+    describe('idnForms', () => {
+      it('round-trips lowercase ASCII domains unchanged', () => {
+        ;['www.testsite.test', 'cdn-1.shop.example.com', 'a.b'].forEach(
+          (host) => {
+            expect(idnForms(host)).toEqual({ ascii: host, unicode: host })
+          }
+        )
+      })
+      it('converts Unicode hosts to punycode', () => {
+        expect(idnForms('Bücher.test')).toEqual({
+          ascii: 'xn--bcher-kva.test',
+          unicode: 'bücher.test'
+        })
+      })
+    })
+    describe('isHomograph', () => {
+      it('allows single script hosts', () => {
+        expect(isHomograph('bücher.test')).toEqual(false)
+        expect(isHomograph('пример.рф')).toEqual(false)
+      })
+      it('detects mixed scripts', () => {
+        expect(isHomograph('pаypal.test')).toEqual(true)
+      })
+      it('detects whole script confusables', () => {
+        // all cyrillic
+        expect(isHomograph('аррӏе.test')).toEqual(true)
+      })
+    })
+  })
+  describe('batch prefetch', () => {
+    const requestEvent = (url: string, scanID: string) => ({
+      scanID,
+      type: 'request' as const,
+      payload: { url } as WebRequestEvent
+    })
+    const noAllowed = () =>
+      nock(config.transport.http)
+        .post('/api/allow_list/_cache/_batch')
+        .reply(200, { results: {} })
+    beforeEach(() => {
+      domainAllowListCache.clear()
+      seenDomainCache.clear()
+      alertOnceCache.clear()
+    })
+    it('looks up the unique domains of the batch in one request', async () => {
+      const scanID = chance.guid()
+      const allowScope = nock(config.transport.http)
+        .post('/api/allow_list/_cache/_batch', {
+          allow_list: { type: 'fqdn', keys: ['testsite.test', 'new.test'] }
+        })
+        .once()
+        .reply(200, { results: {} })
+      const scope = nock(config.transport.http)
+        .post('/api/seen_strings/_cache/_batch', {
+          seen_strings: {
+            type: 'domain',
+            keys: ['www.testsite.test', 'cdn.testsite.test', 'new.test'],
+            scan_id: scanID
+          }
+        })
+        .once()
+        .reply(200, {
+          results: {
+            'www.testsite.test': { store: 'redis' },
+            'cdn.testsite.test': {
+              store: 'database',
+              hit_count: 1,
+              below_threshold: true
+            },
+            'new.test': { store: 'none' }
+          }
+        })
+      await unknownDomainRule.prefetch([
+        requestEvent('https://www.testsite.test/a.js', scanID),
+        requestEvent('https://www.testsite.test/b.js', scanID),
+        requestEvent('https://cdn.testsite.test/c.js', scanID),
+        requestEvent('https://new.test/', scanID),
+        requestEvent('https://10.0.0.1/', scanID)
+      ])
+      expect(allowScope.isDone()).toBe(true)
+      expect(scope.isDone()).toBe(true)
+      expect(seenDomainCache.get('www.testsite.test')).toEqual(UNCOUNTED_HIT)
+      expect(seenDomainCache.get('cdn.testsite.test')).toBeUndefined()
+      expect(seenDomainCache.get('new.test')).toBeUndefined()
+    })
+    it('skips seen domains on process', async () => {
+      const scanID = chance.guid()
+      noAllowed()
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache/_batch')
+        .reply(200, { results: { 'www.testsite.test': { store: 'redis' } } })
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      const event = requestEvent('https://www.testsite.test', scanID)
+      await unknownDomainRule.prefetch([event])
+      // no single seen_strings lookup is mocked
+      const recorder = new SeenRecorder()
+      const rule = ruleCopy(unknownDomainRule, recorder)
+      const result = await rule.process(event)
+      expect(result[0].alert).toEqual(false)
+      // the read-only lookup did not count the hit
+      expect(recorder.pending.get('domain')).toEqual(['www.testsite.test'])
+      expect(seenDomainCache.get('www.testsite.test')).toEqual(1)
+    })
+    it('does not record hits of the local cache', async () => {
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      seenDomainCache.set('www.testsite.test', 1)
+      const recorder = new SeenRecorder()
+      await ruleCopy(unknownDomainRule, recorder).process(
+        requestEvent('https://www.testsite.test', chance.guid())
+      )
+      expect(recorder.size).toBe(0)
+    })
+    it('bumps prefetched hits without a recorder', async () => {
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=testsite.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      const bump = nock(config.transport.http)
+        .post('/api/seen_strings/_cache')
+        .reply(200, { store: 'redis' })
+      seenDomainCache.set('www.testsite.test', UNCOUNTED_HIT)
+      const result = await unknownDomainRule.process(
+        requestEvent('https://www.testsite.test', chance.guid())
+      )
+      expect(result[0].alert).toEqual(false)
+      expect(bump.isDone()).toBe(true)
+    })
+    it('skips allow-listed domains', async () => {
+      const scanID = chance.guid()
+      nock(config.transport.http)
+        .post('/api/allow_list/_cache/_batch')
+        .reply(200, {
+          results: { 'testsite.test': { total: 1, expires_at: null } }
+        })
+      const seenScope = nock(config.transport.http)
+        .post('/api/seen_strings/_cache/_batch')
+        .reply(200, { results: {} })
+      const event = requestEvent('https://www.testsite.test', scanID)
+      await unknownDomainRule.prefetch([event])
+      expect(seenScope.isDone()).toBe(false)
+      // no single allow_list lookup is mocked
+      const result = await unknownDomainRule.process(event)
+      expect(result[0].context.suppressed_by).toEqual('allow_list')
+    })
+    it('skips DNS lookups of alerts suppressed by alert-once', async () => {
+      const scanID = chance.guid()
+      noAllowed()
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache/_batch')
+        .reply(200, {
+          results: { 'new.test': { store: 'none', alert_once: true } }
+        })
+      nock(config.transport.http)
+        .get('/api/allow_list/?key=new.test&type=fqdn&field=key')
+        .reply(200, { total: 0 })
+      nock(config.transport.http)
+        .post('/api/seen_strings/_cache')
+        .reply(200, { store: 'none' })
+      const event = requestEvent('https://new.test/', scanID)
+      await unknownDomainRule.prefetch([event])
+      expect(alertOnceCache.get(`${scanID}|new.test`)).toEqual(1)
+      const dns = unknownDomainRule.dns
+      const lookup = jest.fn(async () => null)
+      unknownDomainRule.dns = ({ lookup } as unknown) as typeof dns
+      try {
+        const result = await unknownDomainRule.process(event)
+        expect(result[0].alert).toEqual(true)
+        expect(lookup).not.toHaveBeenCalled()
+      } finally {
+        unknownDomainRule.dns = dns
+      }
+    })
+    it('does not prefetch test scans', async () => {
+      const scope = nock(config.transport.http)
+        .post('/api/seen_strings/_cache/_batch')
+        .reply(200, { results: {} })
+      await unknownDomainRule.prefetch([
+        { ...requestEvent('https://www.testsite.test', chance.guid()), test: true }
+      ])
+      expect(scope.isDone()).toBe(false)
+    })
+    describe('requestSeenKey', () => {
+      it('matches the key used by process', () => {
+        expect(requestSeenKey('https://www.testsite.test/x', false)).toEqual(
+          'www.testsite.test'
+        )
+        expect(requestSeenKey('https://www.testsite.test/x', true)).toEqual(
+          'testsite.test'
+        )
+      })
+      it('skips IP hosts and invalid URLs', () => {
+        expect(requestSeenKey('https://10.0.0.1/', false)).toBeNull()
+        expect(requestSeenKey('not a url', false)).toBeNull()
+      })
+    })
+  })
 })
@@ -0,0 +1,645 @@
+import MerryMaker, { ScanEvent, WebRequestEvent } from '@merrymaker/types'
+import Chance from 'chance'
+import nock from 'nock'
+import { config } from 'node-config-ts'
+import { Queue } from 'bull'
+
+import { Rule } from '../rules/base'
+import ScanEventHandler, {
+  LeaseExpiredError,
+  RuleJobData,
+  cancelledError,
+  laneKey,
+  withEventID
+} from '../lib/scan-event-handler'
+import { SiteRules } from '../lib/site-rules'
+import { RuleResults } from '../lib/rule-results'
+import { SeenRecorder } from '../lib/seen-recorder'
+
+const chance = new Chance()
+
+class StubRule extends Rule {
+  async process(): Promise<MerryMaker.RuleAlert[]> {
+    return []
+  }
+}
+
+const stubRule = (name: string) =>
+  new StubRule({ name, alert: false, level: 'prod', message: '' })
+
+const fakeQueue = () => {
+  const addBulk = jest.fn(async (jobs: unknown[]) =>
+    jobs.map(() => ({ name: 'rule-job' }))
+  )
+  return { queue: ({ addBulk } as unknown) as Queue, addBulk }
+}
+
+describe('ScanEventHandler', () => {
+  let handler: ScanEventHandler
+  let event: ScanEvent
+  beforeEach(() => {
+    handler = new ScanEventHandler(new SiteRules())
+    handler.use('request', stubRule('unknown.domain'))
+    handler.use('request', stubRule('ioc.domain'))
+    event = {
+      scanID: chance.guid(),
+      type: 'request',
+      payload: { url: 'https://www.testsite.test' } as WebRequestEvent
+    }
+  })
+  afterEach(() => {
+    nock.cleanAll()
+  })
+  it('skips rules disabled for the site', async () => {
+    nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .reply(200, { site_id: chance.guid(), disabled: ['ioc.domain'] })
+    const { queue, addBulk } = fakeQueue()
+    const res = await handler.scheduleRules(event, queue)
+    expect(res).toEqual({
+      scheduled: ['unknown.domain'],
+      skipped: ['ioc.domain']
+    })
+    expect(addBulk).toHaveBeenCalledTimes(1)
+    expect(addBulk.mock.calls[0][0]).toHaveLength(1)
+  })
+  it('reports the jobs of an event before queueing them', async () => {
+    nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .reply(200, { site_id: chance.guid(), disabled: [] })
+    const { queue, addBulk } = fakeQueue()
+    const beforeQueue = jest.fn(async (jobs: number) => {
+      expect(jobs).toBe(2)
+      expect(addBulk).not.toHaveBeenCalled()
+    })
+    await handler.scheduleRules(event, queue, beforeQueue)
+    expect(beforeQueue).toHaveBeenCalledTimes(1)
+    expect(addBulk).toHaveBeenCalledTimes(1)
+  })
+  it('caches the site rules per scan', async () => {
+    const scope = nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .once()
+      .reply(200, { site_id: chance.guid(), disabled: [] })
+    const { queue } = fakeQueue()
+    await handler.scheduleRules(event, queue)
+    const res = await handler.scheduleRules(event, queue)
+    expect(scope.isDone()).toBe(true)
+    expect(res.scheduled).toHaveLength(2)
+  })
+  it('does not queue when every rule is disabled', async () => {
+    nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .reply(200, { disabled: ['ioc.domain', 'unknown.domain'] })
+    const { queue, addBulk } = fakeQueue()
+    const res = await handler.scheduleRules(event, queue)
+    expect(res.scheduled).toEqual([])
+    expect(addBulk).not.toHaveBeenCalled()
+  })
+  it('runs every rule when the backend fails', async () => {
+    nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .reply(500)
+    const { queue } = fakeQueue()
+    const res = await handler.scheduleRules(event, queue)
+    expect(res.scheduled).toEqual(['unknown.domain', 'ioc.domain'])
+  })
+  it('passes the event ID to rule jobs', async () => {
+    nock(config.transport.http)
+      .get(`/api/scans/${event.scanID}/rules`)
+      .reply(200, { disabled: ['ioc.domain'] })
+    const { queue, addBulk } = fakeQueue()
+    const eventID = chance.guid({ version: 4 })
+    await handler.scheduleRules({ ...event, eventID }, queue)
+    expect(addBulk.mock.calls[0][0]).toMatchObject([
+      { data: { rule: 'unknown.domain', event: { eventID } } }
+    ])
+  })
+})
+
+describe('ScanEventHandler.processCounted', () => {
+  class SuppressingRule extends Rule {
+    async process(): Promise<MerryMaker.RuleAlert[]> {
+      return [
+        {
+          name: this.ruleDetails.name,
+          alert: false,
+          level: 'prod',
+          message: 'domain on global allowlist',
+          context: { suppressed_by: 'global_allowlist' }
+        }
+      ]
+    }
+  }
+  it('counts suppression buckets of single jobs', async () => {
+    const handler = new ScanEventHandler(new SiteRules())
+    handler.use(
+      'request',
+      new SuppressingRule({
+        name: 'unknown.domain',
+        alert: false,
+        level: 'prod',
+        message: ''
+      })
+    )
+    const results = new RuleResults()
+    const job = {
+      rule: 'unknown.domain',
+      event: {
+        scanID: chance.guid(),
+        type: 'request',
+        payload: { url: 'https://www.gstatic.com' } as WebRequestEvent
+      }
+    } as RuleJobData
+    await handler.processCounted(job, results)
+    expect(results.summary().suppressed).toEqual({ global_allowlist: 1 })
+  })
+  it('counts failures and rethrows them', async () => {
+    const results = new RuleResults()
+    const job = { rule: 'missing', event: {} } as RuleJobData
+    await expect(
+      new ScanEventHandler(new SiteRules()).processCounted(job, results)
+    ).rejects.toEqual('no matching rule for missing')
+    expect(results.summary().errors).toEqual(1)
+  })
+})
+
+describe('ScanEventHandler.processBatch', () => {
+  class BatchRule extends Rule {
+    prefetch = jest.fn(async () => undefined)
+    async process(evt: ScanEvent): Promise<MerryMaker.RuleAlert[]> {
+      if ((evt.payload as WebRequestEvent).url === 'https://fail.test') {
+        throw new Error('failed')
+      }
+      return [
+        {
+          name: this.ruleDetails.name,
+          alert: true,
+          level: 'prod',
+          message: (evt.payload as WebRequestEvent).url
+        }
+      ]
+    }
+  }
+  const request = (url: string): ScanEvent => ({
+    scanID: chance.guid(),
+    type: 'request',
+    payload: { url } as WebRequestEvent
+  })
+  it('prefetches once per rule and keeps job order', async () => {
+    const handler = new ScanEventHandler(new SiteRules())
+    const rule = new BatchRule({
+      name: 'unknown.domain',
+      alert: false,
+      level: 'prod',
+      message: ''
+    })
+    handler.use('request', rule)
+    const events = [
+      request('https://a.test'),
+      request('https://fail.test'),
+      request('https://b.test')
+    ]
+    const results = await handler.processBatch([
+      ...events.map((event) => ({ rule: 'unknown.domain', event })),
+      { rule: 'missing.rule', event: events[0] }
+    ])
+    expect(rule.prefetch).toHaveBeenCalledTimes(1)
+    expect(rule.prefetch).toHaveBeenCalledWith(events)
+    expect(results[0]).toMatchObject([{ message: 'https://a.test' }])
+    expect(results[1]).toEqual(new Error('failed'))
+    expect(results[2]).toMatchObject([{ message: 'https://b.test' }])
+    expect(results[3]).toEqual(new Error('no matching rule for missing.rule'))
+  })
+  it('processes jobs when prefetch fails', async () => {
+    const handler = new ScanEventHandler(new SiteRules())
+    const rule = new BatchRule({
+      name: 'unknown.domain',
+      alert: false,
+      level: 'prod',
+      message: ''
+    })
+    rule.prefetch.mockRejectedValueOnce(new Error('down'))
+    handler.use('request', rule)
+    const results = await handler.processBatch([
+      { rule: 'unknown.domain', event: request('https://a.test') }
+    ])
+    expect(results[0]).toMatchObject([{ alert: true }])
+  })
+  it('aggregates deterministic totals under concurrency', async () => {
+    // alerts on even events after a random delay
+    class SlowRule extends Rule {
+      async process(evt: ScanEvent): Promise<MerryMaker.RuleAlert[]> {
+        await new Promise((resolve) => setTimeout(resolve, Math.random() * 3))
+        const n = Number((evt.payload as WebRequestEvent).url.split('/').pop())
+        if (n % 7 === 0) {
+          throw new Error('failed')
+        }
+        return [
+          {
+            name: this.ruleDetails.name,
+            alert: n % 2 === 0,
+            level: 'prod',
+            message: `${this.ruleDetails.name} ${n}`
+          }
+        ]
+      }
+    }
+    const handler = new ScanEventHandler(new SiteRules())
+    const names = ['rule.a', 'rule.b', 'rule.c', 'rule.d', 'rule.e']
+    names.forEach((name) =>
+      handler.use(
+        'request',
+        new SlowRule({ name, alert: false, level: 'prod', message: '' })
+      )
+    )
+    const jobs = names.reduce(
+      (acc, rule) =>
+        acc.concat(
+          Array.from({ length: 40 }, (_, n) => ({
+            rule,
+            event: request(`https://a.test/${n}`)
+          }))
+        ),
+      [] as RuleJobData[]
+    )
+    const run = async (concurrency: number) => {
+      const totals = new RuleResults(5)
+      const results = await handler.processBatch(jobs, {
+        concurrency,
+        results: totals
+      })
+      return { results, summary: totals.summary() }
+    }
+    const serial = await run(1)
+    for (let i = 0; i < 3; i += 1) {
+      const concurrent = await run(4)
+      expect(concurrent.summary).toEqual(serial.summary)
+      expect(concurrent.results).toEqual(serial.results)
+    }
+    // 0..39: 6 failures (multiples of 7), 17 even alerts, 17 passed
+    expect(serial.summary).toMatchObject({
+      events: 200,
+      errors: 30,
+      alerts: 85,
+      passed: 85
+    })
+    expect(serial.summary.byRule['rule.c']).toEqual({
+      events: 40,
+      errors: 6,
+      alerts: 17,
+      passed: 17,
+      suppressed: {},
+      normalized: 0
+    })
+    expect(serial.summary.samples.map((s) => s.message)).toEqual([
+      'rule.a 2',
+      'rule.a 4',
+      'rule.a 6',
+      'rule.a 8',
+      'rule.a 10'
+    ])
+  })
+  it('records phase timings adding up to the batch time', async () => {
+    const sleep = (ms: number) =>
+      new Promise<void>((resolve) => setTimeout(resolve, ms))
+    class TimedRule extends Rule {
+      prefetch = jest.fn(() => sleep(20))
+      async process(): Promise<MerryMaker.RuleAlert[]> {
+        await sleep(5)
+        return []
+      }
+    }
+    const handler = new ScanEventHandler(new SiteRules())
+    handler.use(
+      'request',
+      new TimedRule({
+        name: 'rule.a',
+        alert: false,
+        level: 'prod',
+        message: ''
+      })
+    )
+    const totals = new RuleResults()
+    const start = Date.now()
+    await handler.processBatch(
+      Array.from({ length: 4 }, () => ({
+        rule: 'rule.a',
+        event: request('https://a.test')
+      })),
+      { results: totals }
+    )
+    await totals.measure('publish', () => sleep(10))
+    const timings = totals.timings(Date.now() - start)
+    expect(timings.prefetch).toBeGreaterThanOrEqual(15)
+    expect(timings.rules).toBeGreaterThanOrEqual(15)
+    expect(timings.publish).toBeGreaterThanOrEqual(5)
+    const sum = timings.prefetch + timings.rules + timings.publish
+    expect(sum).toBeLessThanOrEqual(timings.total + 3)
+    expect(sum).toBeGreaterThanOrEqual(timings.total - 10)
+  })
+  it('flushes seen hits per rule and when rules fail', async () => {
+    // records a hit per event, fails on fail.test
+    class RecordingRule extends Rule {
+      async process(evt: ScanEvent): Promise<MerryMaker.RuleAlert[]> {
+        const url = (evt.payload as WebRequestEvent).url
+        this.recorder.record('domain', url)
+        if (url === 'https://fail.test') {
+          throw new Error('failed')
+        }
+        return []
+      }
+    }
+    const recorders = new Set<SeenRecorder>()
+    const flushed: string[][] = []
+    const flush = jest
+      .spyOn(SeenRecorder.prototype, 'flush')
+      .mockImplementation(async function (this: SeenRecorder) {
+        recorders.add(this)
+        flushed.push(this.pending.get('domain') || [])
+        this.pending = new Map()
+        return 0
+      })
+    try {
+      const handler = new ScanEventHandler(new SiteRules())
+      const rule = (name: string) =>
+        new RecordingRule({ name, alert: false, level: 'prod', message: '' })
+      handler.use('request', rule('rule.a'))
+      handler.use('request', rule('rule.b'))
+      const event = request('https://fail.test')
+      const results = await handler.processBatch([
+        { rule: 'rule.a', event: request('https://a.test') },
+        { rule: 'rule.b', event },
+        { rule: 'rule.a', event }
+      ])
+      expect(results[1]).toEqual(new Error('failed'))
+      // rule.a, rule.b, then the batch closes
+      expect(flushed).toEqual([
+        ['https://a.test', 'https://fail.test'],
+        ['https://fail.test'],
+        []
+      ])
+      // shared rules keep no recorder
+      expect(handler.byName.get('rule.a').recorder).toBeUndefined()
+      await handler.process({
+        rule: 'rule.a',
+        event: request('https://b.test')
+      })
+      expect(flushed[3]).toEqual(['https://b.test'])
+      // one recorder per batch and per job
+      expect(recorders.size).toBe(2)
+    } finally {
+      flush.mockRestore()
+    }
+  })
+  describe('domain lanes', () => {
+    // kept before timers are faked
+    const realSetImmediate = setImmediate
+    const sleep = (ms: number) =>
+      new Promise<void>((resolve) => setTimeout(resolve, ms))
+    // events of each domain in flight, shared by the rule copies
+    type Tracker = {
+      inFlight: Map<string, number>
+      max: number
+      order: string[]
+    }
+    class LaneRule extends Rule {
+      tracker: Tracker = { inFlight: new Map(), max: 0, order: [] }
+      async process(evt: ScanEvent): Promise<MerryMaker.RuleAlert[]> {
+        const url = (evt.payload as WebRequestEvent).url
+        const domain = laneKey(evt)
+        const { inFlight } = this.tracker
+        inFlight.set(domain, (inFlight.get(domain) || 0) + 1)
+        this.tracker.max = Math.max(this.tracker.max, inFlight.get(domain))
+        await sleep(5 + Math.random() * 5)
+        this.tracker.order.push(url)
+        inFlight.set(domain, inFlight.get(domain) - 1)
+        return [
+          {
+            name: this.ruleDetails.name,
+            alert: true,
+            level: 'prod',
+            message: url
+          }
+        ]
+      }
+    }
+    const laneRule = () =>
+      new LaneRule({
+        name: 'unknown.domain',
+        alert: false,
+        level: 'prod',
+        message: ''
+      })
+    const urlOf = (rj: RuleJobData) => (rj.event.payload as WebRequestEvent).url
+    // 4 events on each of 8 domains, interleaved
+    const jobs = Array.from({ length: 32 }, (_, n) => ({
+      rule: 'unknown.domain',
+      event: request(`https://sub${n}.domain${n % 8}.test/${n}`)
+    }))
+    it('keys lanes by registrable domain', () => {
+      expect(laneKey(request('https://a.B.example.co.uk/x'))).toBe(
+        'example.co.uk'
+      )
+      expect(laneKey(request('https://10.0.0.1/x'))).toBe('10.0.0.1')
+      expect(
+        laneKey({ scanID: '1', type: 'log-message', payload: {} } as ScanEvent)
+      ).toBe('')
+    })
+    it('serializes events of a domain', async () => {
+      const handler = new ScanEventHandler(new SiteRules())
+      const rule = laneRule()
+      handler.use('request', rule)
+      const totals = new RuleResults()
+      const results = await handler.processBatch(jobs, {
+        domainConcurrency: 4,
+        results: totals
+      })
+      expect(rule.tracker.max).toBe(1)
+      expect(totals.laneStats).toEqual({ lanes: 8, peak: 4 })
+      results.forEach((res, n) =>
+        expect(res).toMatchObject([{ message: urlOf(jobs[n]) }])
+      )
+      expect(totals.summary()).toMatchObject({ events: 32, alerts: 32 })
+    })
+    it('keeps job order within a lane', async () => {
+      const handler = new ScanEventHandler(new SiteRules())
+      const rule = laneRule()
+      handler.use('request', rule)
+      await handler.processBatch(jobs, { domainConcurrency: 8 })
+      for (let d = 0; d < 8; d += 1) {
+        const lane = jobs.filter((_, n) => n % 8 === d).map(urlOf)
+        expect(rule.tracker.order.filter((url) => lane.includes(url))).toEqual(
+          lane
+        )
+      }
+    })
+    describe('with fake timers', () => {
+      beforeEach(() => {
+        jest.useFakeTimers('modern')
+      })
+      afterEach(() => {
+        jest.useRealTimers()
+      })
+      // settles `work`, advancing the fake clock 1ms at a time
+      const settle = async <T>(work: Promise<T>): Promise<T> => {
+        let done = false
+        const finish = () => {
+          done = true
+        }
+        work.then(finish, finish)
+        while (!done) {
+          await new Promise((resolve) => realSetImmediate(resolve))
+          jest.advanceTimersByTime(1)
+        }
+        return work
+      }
+      it('fails jobs not started by the deadline', async () => {
+        // each job takes 5ms of the 12ms lease
+        class SlowRule extends Rule {
+          async process(): Promise<MerryMaker.RuleAlert[]> {
+            jest.setSystemTime(Date.now() + 5)
+            return []
+          }
+        }
+        const handler = new ScanEventHandler(new SiteRules())
+        handler.use(
+          'request',
+          new SlowRule({
+            name: 'unknown.domain',
+            alert: false,
+            level: 'prod',
+            message: ''
+          })
+        )
+        const results = await handler.processBatch(jobs, {
+          deadline: Date.now() + 12
+        })
+        const cancelled = results.filter(
+          (res) => res instanceof LeaseExpiredError
+        )
+        expect(cancelled).toHaveLength(jobs.length - 3)
+        expect(cancelled[0]).toEqual(cancelledError())
+      })
+      // benchmark, 8 domains with 10ms lookups
+      it('speeds up batches spanning domains', async () => {
+        class LookupRule extends Rule {
+          async process(): Promise<MerryMaker.RuleAlert[]> {
+            await sleep(10)
+            return []
+          }
+        }
+        const handler = new ScanEventHandler(new SiteRules())
+        handler.use(
+          'request',
+          new LookupRule({
+            name: 'unknown.domain',
+            alert: false,
+            level: 'prod',
+            message: ''
+          })
+        )
+        const run = async (domainConcurrency: number) => {
+          const start = Date.now()
+          await settle(handler.processBatch(jobs, { domainConcurrency }))
+          return Date.now() - start
+        }
+        // 32 lookups in a row, then 4 per lane
+        expect(await run(1)).toBeGreaterThanOrEqual(320)
+        expect(await run(8)).toBeLessThan(60)
+      })
+    })
+  })
+})
+
+describe('RuleResults', () => {
+  const alert = (name: string, n: number): MerryMaker.RuleAlert => ({
+    name,
+    alert: true,
+    level: 'prod',
+    message: `${name} ${n}`
+  })
+  it('merges partial results', () => {
+    const a = new RuleResults(2)
+    a.add('rule.a', [alert('rule.a', 1)])
+    a.add('rule.a', new Error('failed'))
+    const b = new RuleResults(2)
+    b.add('rule.a', [alert('rule.a', 2), alert('rule.a', 3)])
+    b.add('rule.b', [
+      {
+        ...alert('rule.b', 1),
+        alert: false,
+        context: { suppressed_by: 'global_allowlist' }
+      }
+    ])
+    const summary = a.merge(b).summary()
+    expect(summary.byRule).toEqual({
+      'rule.a': {
+        events: 3,
+        alerts: 3,
+        passed: 0,
+        errors: 1,
+        suppressed: {},
+        normalized: 0
+      },
+      'rule.b': {
+        events: 1,
+        alerts: 0,
+        passed: 1,
+        errors: 0,
+        suppressed: { global_allowlist: 1 },
+        normalized: 0
+      }
+    })
+    expect(summary.suppressed).toEqual({ global_allowlist: 1 })
+    expect(summary.samples.map((s) => s.message)).toEqual([
+      'rule.a 1',
+      'rule.a 2'
+    ])
+  })
+  it('counts results collapsed by domain normalization', () => {
+    const a = new RuleResults()
+    a.add('unknown.domain', [
+      { ...alert('unknown.domain', 1), context: { normalized: true } },
+      alert('unknown.domain', 2)
+    ])
+    const b = new RuleResults()
+    b.add('unknown.domain', [
+      { ...alert('unknown.domain', 3), context: { normalized: true } }
+    ])
+    expect(a.merge(b).summary().normalized).toEqual(2)
+  })
+  it('sums phase timings of merged results', () => {
+    const a = new RuleResults()
+    a.time('prefetch', 2.4)
+    a.time('rules', 10)
+    const b = new RuleResults()
+    b.time('rules', 5.3)
+    b.time('publish', 1)
+    expect(a.merge(b).timings(20)).toEqual({
+      prefetch: 2,
+      rules: 15,
+      publish: 1,
+      total: 20
+    })
+  })
+})
+
+describe('withEventID', () => {
+  const alert: MerryMaker.RuleAlert = {
+    name: 'unknown.domain',
+    alert: true,
+    level: 'prod',
+    message: 'example.com',
+    context: { url: 'https://example.com' }
+  }
+  it('adds the event ID to the alert context', () => {
+    expect(withEventID(alert, 'abc').context).toEqual({
+      url: 'https://example.com',
+      event_id: 'abc'
+    })
+  })
+  it('leaves the alert untouched without an event ID', () => {
+    expect(withEventID(alert)).toBe(alert)
+  })
+})
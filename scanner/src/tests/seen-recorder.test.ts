@@ -0,0 +1,66 @@
+import nock from 'nock'
+import { config } from 'node-config-ts'
+
+import { SeenRecorder } from '../lib/seen-recorder'
+
+describe('SeenRecorder', () => {
+  afterEach(() => {
+    nock.cleanAll()
+  })
+  it('sends buffered hits in batches per type', async () => {
+    const recorder = new SeenRecorder(2)
+    const bodies: unknown[] = []
+    const scope = nock(config.transport.http)
+      .post('/api/seen_strings/_record/_batch', (body) => {
+        bodies.push(body)
+        return true
+      })
+      .times(3)
+      .reply(200, { recorded: 1 })
+    recorder.record('domain', 'a.com')
+    recorder.record('domain', 'b.com')
+    recorder.record('domain', 'a.com')
+    recorder.record('ip', '10.0.0.1')
+    expect(recorder.size).toBe(4)
+    expect(await recorder.flush()).toBe(4)
+    expect(recorder.size).toBe(0)
+    expect(bodies).toEqual([
+      { seen_strings: { type: 'domain', keys: ['a.com', 'b.com'] } },
+      { seen_strings: { type: 'domain', keys: ['a.com'] } },
+      { seen_strings: { type: 'ip', keys: ['10.0.0.1'] } }
+    ])
+    expect(scope.isDone()).toBe(true)
+  })
+  it('does not send empty buffers', async () => {
+    const recorder = new SeenRecorder(2)
+    expect(await recorder.flush()).toBe(0)
+  })
+  it('buffers failed batches again without throwing', async () => {
+    const recorder = new SeenRecorder(1)
+    nock(config.transport.http)
+      .post('/api/seen_strings/_record/_batch')
+      .reply(500)
+      .post('/api/seen_strings/_record/_batch')
+      .reply(200, { recorded: 1 })
+    recorder.record('domain', 'a.com')
+    recorder.record('domain', 'b.com')
+    expect(await recorder.flush()).toBe(1)
+    expect(recorder.pending.get('domain')).toEqual(['a.com'])
+    nock(config.transport.http)
+      .post('/api/seen_strings/_record/_batch', {
+        seen_strings: { type: 'domain', keys: ['a.com'] }
+      })
+      .reply(200, { recorded: 1 })
+    expect(await recorder.flush()).toBe(1)
+    expect(recorder.size).toBe(0)
+  })
+  it('drops hits still failing when closed', async () => {
+    const recorder = new SeenRecorder(2)
+    nock(config.transport.http)
+      .post('/api/seen_strings/_record/_batch')
+      .reply(500)
+    recorder.record('domain', 'a.com')
+    expect(await recorder.close()).toBe(0)
+    expect(recorder.size).toBe(0)
+  })
+})
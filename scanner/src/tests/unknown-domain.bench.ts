@@ -0,0 +1,113 @@
+// usage: yarn bench:unknown-domain [events] [domains] [latencyMs]
+//
+// compares per-event lookups of the unknown domain rule with batch
+// prefetching (worker `batchSize` > 1) against a mocked backend
+// answering every request after `latencyMs`
+import nock from 'nock'
+import { performance } from 'perf_hooks'
+import { config } from 'node-config-ts'
+import * as MerryMaker from '@merrymaker/types'
+import unknownDomainRule, {
+  alertOnceCache,
+  domainAllowListCache,
+  seenDomainCache
+} from '../rules/unknown-domain'
+import { SeenRecorder } from '../lib/seen-recorder'
+import { ruleCopy } from '../lib/scan-event-handler'
+
+const [totalEvents = 2000, totalDomains = 200, latencyMs = 2] = process.argv
+  .slice(2)
+  .map(Number)
+const scanID = '00000000-0000-4000-8000-000000000000'
+
+const events: MerryMaker.ScanEvent[] = Array.from(
+  { length: totalEvents },
+  (_, i) => ({
+    scanID,
+    type: 'request',
+    payload: {
+      url: `https://cdn${i % totalDomains}.bench-site.test/app.js`
+    } as MerryMaker.WebRequestEvent
+  })
+)
+
+// every domain is seen, none is allow-listed
+let requests = 0
+const backend = () => {
+  const scope = nock(config.transport.http).persist()
+  // counts the request, `body` gets the keys of batch lookups
+  const reply = (body: (keys?: string[]) => unknown) => (
+    _uri: string,
+    req: { seen_strings?: { keys: string[] } }
+  ) => {
+    requests += 1
+    return body(req?.seen_strings?.keys)
+  }
+  scope
+    .get(`/api/scans/${scanID}/rules`)
+    .delay(latencyMs)
+    .reply(200, reply(() => ({ disabled: [], untrusted_suffixes: [] })))
+  scope
+    .get(/\/api\/allow_list\//)
+    .delay(latencyMs)
+    .reply(200, reply(() => ({ total: 0 })))
+  scope
+    .post('/api/allow_list/_cache/_batch')
+    .delay(latencyMs)
+    .reply(200, reply(() => ({ results: {} })))
+  scope
+    .post('/api/seen_strings/_cache')
+    .delay(latencyMs)
+    .reply(200, reply(() => ({ store: 'redis' })))
+  scope
+    .post('/api/seen_strings/_cache/_batch')
+    .delay(latencyMs)
+    .reply(
+      200,
+      reply(keys => ({
+        results: keys.reduce((acc, key) => {
+          acc[key] = { store: 'redis' }
+          return acc
+        }, {} as Record<string, { store: string }>)
+      }))
+    )
+  scope
+    .post('/api/seen_strings/_record/_batch')
+    .delay(latencyMs)
+    .reply(200, reply(() => ({ recorded: 0 })))
+}
+
+const run = async (name: string, batched: boolean) => {
+  domainAllowListCache.clear()
+  seenDomainCache.clear()
+  alertOnceCache.clear()
+  requests = 0
+  // the job's recorder, like the worker
+  const recorder = new SeenRecorder()
+  const rule = ruleCopy(unknownDomainRule, recorder)
+  const start = performance.now()
+  if (batched) {
+    await unknownDomainRule.prefetch(events)
+  }
+  for (const evt of events) {
+    await rule.process(evt)
+  }
+  await recorder.close()
+  const ms = performance.now() - start
+  console.log(
+    `${name}\t${ms.toFixed(1)} ms\t${requests} requests\t` +
+      `${((ms * 1000) / events.length).toFixed(1)} µs/event`
+  )
+}
+
+;(async () => {
+  backend()
+  console.log(
+    `${totalEvents} events, ${totalDomains} domains, ${latencyMs} ms latency`
+  )
+  // warm up module and site caches
+  await run('warmup', false)
+  await run('per-event', false)
+  await run('batched', true)
+  nock.cleanAll()
+})()
@@ -5,33 +5,63 @@ import {
   GeneralErrorEvent
 } from '@merrymaker/types'
 import Bull, { Job } from 'bull'
+import { randomUUID } from 'crypto'
+import { performance } from 'perf_hooks'
+import { config } from 'node-config-ts'
 import BullWorker from './lib/bull-worker'
-import { resolveClient } from './lib/redis'
+import { client, resolveClient } from './lib/redis'
+import { watchVersion } from './lib/ioc-cache'
+import { dnsLookup } from './rules/unknown-domain'
 import { scanHandler } from './rules'
-import { RuleJobData } from './lib/scan-event-handler'
+import {
+  LeaseExpiredError,
+  RuleJobData,
+  withEventID
+} from './lib/scan-event-handler'
+import { RuleResults } from './lib/rule-results'
+import { metrics } from './lib/metrics'
+import {
+  PENDING_SCANS_KEY,
+  finishJob,
+  trackEvent
+} from './lib/pending-rules'
 
 import logger from './loaders/logger'
 
+const stats = metrics()
+
 const jsScopeEventQueue = new Bull<EventResult>('browser-event-queue', {
   createClient: resolveClient
 })
 
-const scanLogEventQueue = new Bull<EventResult>('scan-log-queue', {
+// `id` is used as the scan log ID
+type ScanLogEvent = EventResult & { id?: string }
+
+const scanLogEventQueue = new Bull<ScanLogEvent>('scan-log-queue', {
   createClient: resolveClient
 })
-const ruleQueue = new Bull('rule-queue', { createClient: resolveClient })
+// short locks, extended while jobs are worked on (see `pollBatch`)
+// and released once expired (see `checkStalled`)
+const ruleQueue = new Bull('rule-queue', {
+  createClient: resolveClient,
+  settings: { lockDuration: config.worker.lockMs }
+})
 ;(async () => {
   await jsScopeEventQueue.isReady()
   await scanLogEventQueue.isReady()
   await ruleQueue.isReady()
   // temp empty for testing
   await ruleQueue.empty()
+  // the emptied jobs never finish
+  await client.del(PENDING_SCANS_KEY)
 })()
 
 jsScopeEventQueue.process(async (job: Job) => {
   if (job.data.type && typeof job.data.type === 'string') {
+    const eventID = randomUUID()
     await scanLogEventQueue.add(
       {
+        id: eventID,
         scan_id: job.data.scanID,
         entry: job.data.type,
         test: job.data.test,
@@ -43,7 +73,28 @@ jsScopeEventQueue.process(async (job: Job) => {
         removeOnFail: 25
       }
     )
-    await scanHandler.scheduleRules(job.data, ruleQueue)
+    const scheduled = await scanHandler.scheduleRules(
+      { ...job.data, eventID },
+      ruleQueue,
+      jobs =>
+        trackEvent(client, job.data.scanID, eventID, jobs).catch(e => {
+          logger.error({
+            queue: 'browser-event',
+            module: 'pending-rules',
+            error: e.message
+          })
+        })
+    )
+    if (scheduled.skipped.length > 0) {
+      logger.info({
+        queue: 'browser-event',
+        scan_id: job.data.scanID,
+        skipped: scheduled.skipped,
+        message: 'rules disabled for site'
+      })
+    }
+    // kept as the job result
+    return scheduled
   }
 })
 
@@ -53,6 +104,7 @@ ruleQueue.on('error', e => {
 
 ruleQueue.on('waiting', (jobID: string) => {
   logger.info({ queue: 'rule', status: 'waiting', jobID })
+  ruleQueueManager.wake()
 })
 
 // eslint-disable-next-line @typescript-eslint/no-explicit-any
@@ -60,70 +112,174 @@ ruleQueue.on('completed', (_job: Job, result: any) => {
   logger.info({ queue: 'rule', status: 'completed', result })
 })
 
+// counts a rule job out of the pending rule work of its scan,
+// the count is informational so failures are only logged
+const finishPending = async (data: RuleJobData) => {
+  try {
+    await finishJob(client, data.event.scanID, data.event.eventID)
+  } catch (e) {
+    logger.error({ queue: 'rule', module: 'pending-rules', error: e.message })
+  }
+}
+
+// queue the alerts of a rule job
+const publishAlerts = async (data: RuleJobData, events: RuleAlert[]) => {
+  if (events) {
+    await scanLogEventQueue.addBulk(
+      events
+        .filter((evt: RuleAlert) => {
+          // IOC matches excepted for the site and unknown domains
+          // of learning sites are still recorded
+          if (
+            evt.alert === false &&
+            !evt.context?.ioc_excepted &&
+            !evt.context?.learning
+          ) {
+            logger.info({
+              queue: 'rule',
+              scan_id: data.event.scanID,
+              rule: evt.name,
+              event: evt,
+              message: 'dropping false alert'
+            })
+            return false
+          }
+          return true
+        })
+        .map((evt: RuleAlert) => {
+          return {
+            data: {
+              entry: 'rule-alert',
+              level: 'info',
+              rule: evt.name,
+              scan_id: data.event.scanID,
+              test: data.event.test,
+              event: withEventID(evt, data.event.eventID)
+            } as RuleAlertEvent,
+            opts: {
+              removeOnComplete: true
+            }
+          }
+        })
+    )
+  } else {
+    logger.info({ queue: 'rule', status: 'no rule alerts' })
+  }
+}
+
+// record a failed rule job in the scan log
+const publishError = async (data: RuleJobData, e: Error) => {
+  logger.error({ queue: 'rule', error: e.message })
+  await scanLogEventQueue.add(
+    {
+      entry: 'error',
+      level: 'error',
+      scan_id: data.event.scanID,
+      event: {
+        message: e.message
+      }
+    } as GeneralErrorEvent,
+    { removeOnComplete: true }
+  )
+}
+
 const ruleQueueManager = new BullWorker(
-  5,
+  config.worker.pollInterval,
   ruleQueue,
   async (job: Job<RuleJobData>) => {
+    const totals = new RuleResults()
     try {
-      const events = await scanHandler.process(job.data)
-      if (events) {
-        await scanLogEventQueue.addBulk(
-          events
-            .filter((evt: RuleAlert) => {
-              if (evt.alert === false) {
-                logger.info({
-                  queue: 'rule',
-                  scan_id: job.data.event.scanID,
-                  rule: evt.name,
-                  event: evt,
-                  message: 'dropping false alert'
-                })
-                return false
-              }
-              return true
-            })
-            .map((evt: RuleAlert) => {
-              return {
-                data: {
-                  entry: 'rule-alert',
-                  level: 'info',
-                  rule: evt.name,
-                  scan_id: job.data.event.scanID,
-                  test: job.data.event.test,
-                  event: evt
-                } as RuleAlertEvent,
-                opts: {
-                  removeOnComplete: true
-                }
-              }
-            })
-        )
-      } else {
-        logger.info({ queue: 'rule', status: 'no rule alerts' })
-      }
-    } catch (e) {
-      logger.error({ queue: 'rule', error: e.message })
-      await scanLogEventQueue.add(
-        {
-          entry: 'error',
-          level: 'error',
-          scan_id: job.data.event.scanID,
-          event: {
-            message: e.message
-          }
-        } as GeneralErrorEvent,
-        { removeOnComplete: true }
+      await publishAlerts(
+        job.data,
+        await scanHandler.processCounted(job.data, totals)
       )
+    } catch (e) {
+      await publishError(job.data, e)
+    } finally {
+      await finishPending(job.data)
     }
-  }
+    // eslint-disable-next-line @typescript-eslint/no-unused-vars
+    const { samples, byRule, ...counts } = totals.summary()
+    logger.info({
+      queue: 'rule',
+      status: 'job processed',
+      rule: job.data.rule,
+      ...counts
+    })
+  },
+  config.worker.maxPollInterval
 )
 
+// a failed attempt is retried by bull while attempts are left
+const retriesLeft = (job: Job) =>
+  job.attemptsMade + 1 < (job.opts.attempts || 1)
+
+// batch mode, lookups of the batch are shared (see `processBatch`).
+// rule failures are logged like single jobs and never fail the job,
+// jobs cancelled at the lease deadline fail so they are retried
+const ruleBatchWork = async (jobs: Job<RuleJobData>[]) => {
+  const start = performance.now()
+  const totals = new RuleResults()
+  const results = await scanHandler.processBatch(
+    jobs.map(job => job.data),
+    {
+      concurrency: config.worker.ruleConcurrency,
+      domainConcurrency: config.worker.domainConcurrency,
+      // jobs left once the batch lock expires are failed, not raced
+      deadline: Date.now() + config.worker.leaseMs,
+      results: totals
+    }
+  )
+  let cancelled = 0
+  for (let i = 0; i < jobs.length; i++) {
+    const result = results[i]
+    if (result instanceof LeaseExpiredError) {
+      cancelled += 1
+      // its events are lost once no retry is left
+      if (retriesLeft(jobs[i])) continue
+    }
+    await totals.measure('publish', async () => {
+      try {
+        if (result instanceof Error) {
+          throw result
+        }
+        await publishAlerts(jobs[i].data, result)
+      } catch (e) {
+        await publishError(jobs[i].data, e)
+      }
+    })
+    await finishPending(jobs[i].data)
+  }
+  const { samples, ...counts } = totals.summary()
+  const timings = totals.timings(performance.now() - start)
+  logger.info({
+    queue: 'rule',
+    status: 'batch processed',
+    ...counts,
+    cancelled,
+    timings,
+    lanes: totals.laneStats,
+    samples: samples.map(s => s.message)
+  })
+  stats.timing('rules.batch.duration', timings.total)
+  stats.gauge('rules.batch.jobs', jobs.length)
+  stats.gauge('rules.batch.lanes', totals.laneStats.lanes)
+  stats.gauge('rules.batch.lane_peak', totals.laneStats.peak)
+  if (cancelled > 0) {
+    stats.increment('rules.batch.cancelled', undefined, cancelled)
+  }
+  return results.map(result =>
+    result instanceof LeaseExpiredError ? result : null
+  )
+}
+
 ruleQueueManager.on('info', msg => {
   logger.info(`rules queue manager info - ${msg}`, msg)
 })
 ruleQueueManager.on('error', err => {
   logger.error(`rules queue manager error (${err.message})`)
 })
+let stopStalledCheck: () => void = () => undefined
 // eslint-disable-next-line @typescript-eslint/explicit-function-return-type
 ;(async () => {
   logger.info('starting!!!')
@@ -132,6 +288,35 @@ ruleQueueManager.on('error', err => {
     logger.debug(`Rule Queue Count ${total}`)
   }, 5000)
 
-  await ruleQueueManager.poll()
+  // share DNS answers between jobs
+  dnsLookup.options.cache = client
+  // drop cached IOC matches when IOCs change
+  watchVersion(client, 30000, e => {
+    logger.error({ module: 'ioc-cache', error: e.message })
+  })
+
+  // releases the jobs of a crashed worker once their lock expires
+  stopStalledCheck = ruleQueueManager.checkStalled(
+    config.worker.stalledCheckMs
+  )
+  if (config.worker.batchSize > 1) {
+    await ruleQueueManager.pollBatch(config.worker.batchSize, ruleBatchWork, {
+      lockMs: config.worker.lockMs,
+      heartbeatMs: config.worker.heartbeatMs
+    })
+  } else {
+    await ruleQueueManager.poll()
+  }
   logger.info('started')
 })()
+
+// graceful shutdown, stop reserving new jobs and
+// let the ones in progress finish
+process.once('SIGTERM', async () => {
+  logger.info('SIGTERM received, draining workers')
+  await Promise.all([ruleQueueManager.drain(), jsScopeEventQueue.close()])
+  stopStalledCheck()
+  await Promise.all([ruleQueue.close(), scanLogEventQueue.close()])
+  logger.info('workers drained')
+  process.exit(0)
+})